@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultResolveAfter is how long an alert's condition must stay clear
+// before the alert is closed
+const DefaultResolveAfter = 5 * time.Minute
+
+// alertDetailLimit is the number of destinations listed in an alert
+const alertDetailLimit = 20
+
+// alertConditions are what the alerting sinks, PagerDuty and Opsgenie,
+// alert on, and the alerts open. Its parameters are
+//
+//	removed        prefix rules as in -critical: alert when a route they
+//	               select is removed, until it is added back (default
+//	               the default routes)
+//	withdrawn      alert when a change set removes more than this many
+//	               routes from a table, until no more than this many of
+//	               them are still missing (0 disables)
+//	resolve-after  how long a condition must stay clear before its alert
+//	               is closed, so a flapping route doesn't page again every
+//	               time it comes back (default 5m)
+//
+// Every condition has a key of its own, such as
+// go-watcher/core.txt/removed/0.0.0.0/0, for the service to deduplicate
+// alerts by.
+type alertConditions struct {
+	removed      *PrefixRules
+	withdrawn    int
+	resolveAfter time.Duration
+
+	// open and close raise and clear an alert with the service
+	open  func(ctx context.Context, a *alert) error
+	close func(ctx context.Context, key string) error
+	// service names the service in logs
+	service string
+
+	mu sync.Mutex
+	// alerts are those open, by key
+	alerts map[string]*openAlert
+	// missing holds, by table, the routes withdrawn while a withdrawal
+	// alert is raised, and whether each is critical
+	missing map[string]map[string]bool
+}
+
+// alert is a condition that fired
+type alert struct {
+	// Key identifies the condition
+	Key string
+	// Class is route-removed or routes-withdrawn
+	Class   string
+	Summary string
+	cs      *ChangeSet
+	// Destinations are the routes removed, at most alertDetailLimit of
+	// them, and Unlisted the number left out
+	Destinations []string
+	Unlisted     int
+	// Critical is set if any of the routes is critical
+	Critical bool
+}
+
+// openAlert is an alert raised with the service
+type openAlert struct {
+	// close is pending while the condition is clear
+	close *time.Timer
+}
+
+// parse takes the conditions' parameters from q
+func (ac *alertConditions) parse(q url.Values) error {
+	ac.resolveAfter = DefaultResolveAfter
+	ac.alerts = make(map[string]*openAlert)
+	ac.missing = make(map[string]map[string]bool)
+	rules := DefaultCriticalRules
+	if q.Has("removed") {
+		rules = q.Get("removed")
+	}
+	var err error
+	if ac.removed, err = parsePrefixRules(rules); err != nil {
+		return fmt.Errorf("invalid removed: %w", err)
+	}
+	if v := q.Get("withdrawn"); v != "" {
+		if ac.withdrawn, err = strconv.Atoi(v); err != nil || ac.withdrawn < 0 {
+			return fmt.Errorf("invalid withdrawn %q", v)
+		}
+	}
+	if v := q.Get("resolve-after"); v != "" {
+		if ac.resolveAfter, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("invalid resolve-after: %w", err)
+		}
+	}
+	for _, p := range []string{"removed", "withdrawn", "resolve-after"} {
+		q.Del(p)
+	}
+	return nil
+}
+
+// check raises the alerts of the conditions cs fires and schedules the
+// closing of those it clears
+func (ac *alertConditions) check(ctx context.Context, cs *ChangeSet) error {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	var errs []error
+	var removed, added []Change
+	for _, c := range cs.Notifiable() {
+		switch c.Type {
+		case ChangeRemoved:
+			removed = append(removed, c)
+		case ChangeAdded:
+			added = append(added, c)
+		}
+	}
+
+	for _, c := range removed {
+		if ac.removed.Match(c.Destination) {
+			errs = append(errs, ac.raise(ctx, &alert{
+				Key:          fmt.Sprintf("go-watcher/%s/removed/%s", cs.Path, c.Destination),
+				Class:        "route-removed",
+				Summary:      fmt.Sprintf("%s removed from %s", c.Destination, cs.Path),
+				cs:           cs,
+				Destinations: []string{c.Destination},
+				Critical:     c.Critical,
+			}))
+		}
+	}
+	for _, c := range added {
+		if ac.removed.Match(c.Destination) {
+			ac.clear(fmt.Sprintf("go-watcher/%s/removed/%s", cs.Path, c.Destination))
+		}
+	}
+
+	if ac.withdrawn > 0 {
+		key := fmt.Sprintf("go-watcher/%s/withdrawn", cs.Path)
+		missing := ac.missing[cs.Path]
+		if missing == nil && len(removed) > ac.withdrawn {
+			missing = make(map[string]bool)
+			ac.missing[cs.Path] = missing
+		}
+		if missing != nil {
+			for _, c := range removed {
+				missing[c.Destination] = c.Critical
+			}
+			for _, c := range added {
+				delete(missing, c.Destination)
+			}
+			if len(missing) > ac.withdrawn {
+				a := &alert{
+					Key:     key,
+					Class:   "routes-withdrawn",
+					Summary: fmt.Sprintf("%d routes withdrawn from %s", len(missing), cs.Path),
+					cs:      cs,
+				}
+				for dest, critical := range missing {
+					a.Destinations = append(a.Destinations, dest)
+					a.Critical = a.Critical || critical
+				}
+				sort.Strings(a.Destinations)
+				if len(a.Destinations) > alertDetailLimit {
+					a.Unlisted = len(a.Destinations) - alertDetailLimit
+					a.Destinations = a.Destinations[:alertDetailLimit]
+				}
+				errs = append(errs, ac.raise(ctx, a))
+			} else {
+				delete(ac.missing, cs.Path)
+				ac.clear(key)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// raise opens a unless its alert is already open, in which case any
+// pending close is called off
+func (ac *alertConditions) raise(ctx context.Context, a *alert) error {
+	if o := ac.alerts[a.Key]; o != nil {
+		if o.close != nil {
+			o.close.Stop()
+			o.close = nil
+		}
+		return nil
+	}
+	if err := ac.open(ctx, a); err != nil {
+		return fmt.Errorf("failed to raise %s: %w", a.Key, err)
+	}
+	ac.alerts[a.Key] = &openAlert{}
+	return nil
+}
+
+// clear closes the alert of key, if open, once resolveAfter has passed
+// without it being raised again
+func (ac *alertConditions) clear(key string) {
+	o := ac.alerts[key]
+	if o == nil || o.close != nil {
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(ac.resolveAfter, func() {
+		ac.mu.Lock()
+		defer ac.mu.Unlock()
+		if ac.alerts[key] != o || o.close != t {
+			return
+		}
+		delete(ac.alerts, key)
+		if err := ac.close(context.Background(), key); err != nil {
+			slog.Error("failed to close alert", "service", ac.service, "key", key, "err", err)
+		}
+	})
+	o.close = t
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultAMQPTimeout bounds the publishing of a change set, including
+// waiting for the broker to confirm it
+const DefaultAMQPTimeout = 10 * time.Second
+
+// DefaultAMQPRoutingKey is the routing key template unless the spec sets
+// one
+const DefaultAMQPRoutingKey = "{type}.{destination}"
+
+// amqpMaxFrame is the largest frame the sink asks for
+const amqpMaxFrame = 128 << 10
+
+// amqpWindow is the number of messages sent before waiting for their
+// confirms
+const amqpWindow = 100
+
+// AMQP 0-9-1 frame types and the class and method IDs the sink uses
+const (
+	amqpFrameMethod = 1
+	amqpFrameHeader = 2
+	amqpFrameBody   = 3
+	amqpFrameEnd    = 0xce
+
+	amqpConnection = 10
+	amqpChannel    = 20
+	amqpBasic      = 60
+	amqpConfirm    = 85
+)
+
+func init() {
+	sinkFactories["amqp"] = func(u *url.URL) (Sink, error) {
+		return newAMQPSink(u)
+	}
+}
+
+// AMQPSink publishes every change to an AMQP 0-9-1 exchange, such as
+// RabbitMQ's, as a change event as -output jsonl writes it, and waits for
+// the broker to confirm it has taken each one. The spec is
+// amqp://[user@]broker[:5672][/vhost], or amqp+tls://broker[:5671], with
+// these parameters:
+//
+//	exchange             exchange to publish to (default amq.topic)
+//	routing-key          template of the routing key, with the
+//	                     placeholders of the NATS sink's subject (default
+//	                     {type}.{destination})
+//	mandatory            true to fail when no queue is bound to a change's
+//	                     routing key, rather than have the broker drop it
+//	persistent           false to publish transient messages
+//	password-env         environment variable holding the user's password
+//	password-file        file holding it, instead
+//	timeout              time allowed to publish a change set (default 10s)
+//	path, type, prefix   only publish the changes selected as for /events
+//
+// The user defaults to guest, with the password guest, as RabbitMQ's
+// default user. Dots in destinations are kept, so a topic exchange binding
+// removed.10.# gets the removals under 10.0.0.0/8.
+type AMQPSink struct {
+	name       string
+	addr       string
+	tls        *tls.Config
+	vhost      string
+	user       string
+	password   string
+	exchange   string
+	routingKey string
+	mandatory  bool
+	persistent bool
+	timeout    time.Duration
+	filter     changeFilter
+
+	mu       sync.Mutex
+	conn     *amqpConn
+	frameMax int
+	// tag is the delivery tag of the last message published on conn
+	tag uint64
+}
+
+// amqpError is an error reported by the broker, such as a missing
+// exchange or a refused login, which resending won't cure. closed is set
+// when the broker closed the connection or channel over it.
+type amqpError struct {
+	msg    string
+	closed bool
+}
+
+func (e *amqpError) Error() string { return e.msg }
+
+// amqpCloseError returns the error in the arguments of a Close method
+func amqpCloseError(args []byte) *amqpError {
+	r := amqpReader{b: args}
+	code, text := r.uint16(), r.shortStr()
+	return &amqpError{fmt.Sprintf("broker closed the channel: %s (%d)", text, code), true}
+}
+
+func newAMQPSink(u *url.URL) (*AMQPSink, error) {
+	s := &AMQPSink{name: sinkName(u), exchange: "amq.topic", routingKey: DefaultAMQPRoutingKey, persistent: true, timeout: DefaultAMQPTimeout}
+	if err := s.parse(u); err != nil {
+		return nil, fmt.Errorf("amqp sink %s: %w", s.name, err)
+	}
+	return s, nil
+}
+
+// parse takes the sink's options from u
+func (s *AMQPSink) parse(u *url.URL) error {
+	if u.Hostname() == "" {
+		return errors.New("needs the broker, as amqp://broker:5672")
+	}
+	port := u.Port()
+	switch _, transport, _ := strings.Cut(u.Scheme, "+"); transport {
+	case "":
+		if port == "" {
+			port = "5672"
+		}
+	case "tls":
+		s.tls = &tls.Config{MinVersion: tls.VersionTLS12, ServerName: u.Hostname()}
+		if port == "" {
+			port = "5671"
+		}
+	default:
+		return fmt.Errorf("unknown transport %q (want amqp:// or amqp+tls://)", u.Scheme)
+	}
+	s.addr = net.JoinHostPort(u.Hostname(), port)
+	if s.vhost = strings.TrimPrefix(u.Path, "/"); s.vhost == "" {
+		s.vhost = "/"
+	}
+	q := u.Query()
+	var err error
+
+	if q.Has("exchange") {
+		s.exchange = q.Get("exchange")
+	}
+	if v := q.Get("routing-key"); v != "" {
+		s.routingKey = v
+	}
+	if key := renderTopic(s.routingKey, topicSample, topicSample.Changes[0]); strings.ContainsAny(key, "{}") {
+		return fmt.Errorf("unknown placeholder in routing-key %q (known: %s)", s.routingKey, strings.Join(topicPlaceholders, ", "))
+	}
+	for _, p := range []struct {
+		name string
+		dst  *bool
+	}{{"mandatory", &s.mandatory}, {"persistent", &s.persistent}} {
+		if v := q.Get(p.name); v != "" {
+			if *p.dst, err = strconv.ParseBool(v); err != nil {
+				return fmt.Errorf("invalid %s %q", p.name, v)
+			}
+		}
+	}
+	if v := q.Get("timeout"); v != "" {
+		if s.timeout, err = time.ParseDuration(v); err != nil || s.timeout <= 0 {
+			return fmt.Errorf("invalid timeout %q", v)
+		}
+	}
+	password, err := readSecret(q, "password")
+	if err != nil {
+		return err
+	}
+	s.user, s.password = "guest", "guest"
+	if u.User != nil {
+		if password == nil {
+			return errors.New("a user needs password-env or password-file")
+		}
+		s.user, s.password = u.User.Username(), string(password)
+	} else if password != nil {
+		return errors.New("a password needs a user, as amqp://user@broker")
+	}
+
+	if s.filter, err = parseChangeFilter(q.Get("path"), q.Get("type"), q.Get("prefix")); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *AMQPSink) Name() string { return s.name }
+
+// amqpMessage is a message to publish
+type amqpMessage struct {
+	key, id string
+	data    []byte
+}
+
+// Deliver publishes the changes of cs the sink selects, reconnecting and
+// trying again once if the connection has failed
+func (s *AMQPSink) Deliver(ctx context.Context, cs *ChangeSet) error {
+	changes := s.filter.changes(cs)
+	if len(changes) == 0 {
+		return nil
+	}
+	msgs := make([]amqpMessage, 0, len(changes))
+	for _, c := range changes {
+		data, err := changeEvent(cs, c)
+		if err != nil {
+			return fmt.Errorf("failed to encode change: %w", err)
+		}
+		key := renderTopic(s.routingKey, cs, c)
+		if len(key) > 255 {
+			return fmt.Errorf("routing key %q is longer than 255 bytes", key)
+		}
+		msgs = append(msgs, amqpMessage{key: key, id: changeEventID(cs, c), data: data})
+	}
+	ts := cs.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fresh := s.conn == nil
+	err := s.publish(ctx, msgs, ts)
+	var berr *amqpError
+	if err != nil && !fresh && !errors.As(err, &berr) && ctx.Err() == nil {
+		err = s.publish(ctx, msgs, ts)
+	}
+	return err
+}
+
+// publish sends msgs, in windows of amqpWindow, and waits for the broker
+// to confirm them
+func (s *AMQPSink) publish(ctx context.Context, msgs []amqpMessage, ts time.Time) error {
+	if s.conn == nil {
+		if err := s.dial(ctx); err != nil {
+			return err
+		}
+	}
+	deadline, _ := ctx.Deadline()
+	s.conn.conn.SetDeadline(deadline)
+	for len(msgs) > 0 {
+		n := min(len(msgs), amqpWindow)
+		if err := s.exchangeMessages(msgs[:n], ts); err != nil {
+			var berr *amqpError
+			if !errors.As(err, &berr) || berr.closed {
+				s.close()
+			}
+			return err
+		}
+		msgs = msgs[n:]
+	}
+	return nil
+}
+
+// exchangeMessages writes msgs on channel 1 and reads until the broker has
+// confirmed them all
+func (s *AMQPSink) exchangeMessages(msgs []amqpMessage, ts time.Time) error {
+	c := s.conn
+	first := s.tag + 1
+	mode := byte(1)
+	if s.persistent {
+		mode = 2
+	}
+	for _, m := range msgs {
+		var args []byte
+		args = binary.BigEndian.AppendUint16(args, 0)
+		args = appendAMQPShortStr(args, s.exchange)
+		args = appendAMQPShortStr(args, m.key)
+		if s.mandatory {
+			args = append(args, 1)
+		} else {
+			args = append(args, 0)
+		}
+		c.writeMethod(1, amqpBasic, 40, args)
+
+		// Content header: content-type, delivery-mode, message-id,
+		// timestamp, type and app-id
+		var hdr []byte
+		hdr = binary.BigEndian.AppendUint16(hdr, amqpBasic)
+		hdr = binary.BigEndian.AppendUint16(hdr, 0)
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(len(m.data)))
+		hdr = binary.BigEndian.AppendUint16(hdr, 0x8000|0x1000|0x0080|0x0040|0x0020|0x0008)
+		hdr = appendAMQPShortStr(hdr, "application/json")
+		hdr = append(hdr, mode)
+		hdr = appendAMQPShortStr(hdr, m.id)
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(ts.Unix()))
+		hdr = appendAMQPShortStr(hdr, "change")
+		hdr = appendAMQPShortStr(hdr, "go-watcher")
+		c.writeFrame(amqpFrameHeader, 1, hdr)
+		for data := m.data; len(data) > 0; {
+			n := min(len(data), s.frameMax-8)
+			c.writeFrame(amqpFrameBody, 1, data[:n])
+			data = data[n:]
+		}
+		s.tag++
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	// acked is the highest tag up to which every message is confirmed;
+	// tags confirmed out of order wait in confirmed
+	acked, last := first-1, s.tag
+	confirmed := make(map[uint64]bool)
+	var failed error
+	for acked < last {
+		class, method, args, err := c.readMethod()
+		if err != nil {
+			return err
+		}
+		switch {
+		case class == amqpBasic && (method == 80 || method == 120): // Ack, Nack
+			if len(args) < 9 {
+				return errors.New("short confirm")
+			}
+			tag, multiple := binary.BigEndian.Uint64(args), args[8]&1 == 1
+			if method == 120 && failed == nil {
+				failed = &amqpError{msg: "broker rejected a change (nack)"}
+			}
+			if multiple {
+				acked = max(acked, tag)
+			} else {
+				confirmed[tag] = true
+			}
+			for confirmed[acked+1] {
+				delete(confirmed, acked+1)
+				acked++
+			}
+		case class == amqpBasic && method == 50: // Return
+			r := amqpReader{b: args}
+			code, text := r.uint16(), r.shortStr()
+			r.shortStr()
+			key := r.shortStr()
+			if failed == nil {
+				failed = &amqpError{msg: fmt.Sprintf("broker returned a change: %s for routing key %s (%d)", text, key, code)}
+			}
+		case class == amqpChannel && method == 40, class == amqpConnection && method == 50: // Close
+			channel := uint16(1)
+			if class == amqpConnection {
+				channel = 0
+			}
+			c.writeMethod(channel, class, method+1, nil)
+			c.w.Flush()
+			return amqpCloseError(args)
+		}
+	}
+	return failed
+}
+
+// dial connects to the broker, logs in and opens channel 1 in confirm
+// mode, without heartbeats since connections are remade when they fail
+func (s *AMQPSink) dial(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if s.tls != nil {
+		tc := tls.Client(conn, s.tls)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return fmt.Errorf("TLS handshake with %s: %w", s.addr, err)
+		}
+		conn = tc
+	}
+	s.conn = &amqpConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	s.tag = 0
+	if err := s.handshake(); err != nil {
+		s.close()
+		return fmt.Errorf("connecting to %s: %w", s.addr, err)
+	}
+	return nil
+}
+
+func (s *AMQPSink) handshake() error {
+	c := s.conn
+	c.w.WriteString("AMQP\x00\x00\x09\x01")
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	args, err := c.expect(amqpConnection, 10) // Start
+	if err != nil {
+		return err
+	}
+	r := amqpReader{b: args}
+	r.take(2)
+	r.longStr() // server properties
+	if mechs := strings.Fields(r.longStr()); !slices.Contains(mechs, "PLAIN") {
+		return fmt.Errorf("broker doesn't accept PLAIN (offers %s)", strings.Join(mechs, ", "))
+	}
+	var props []byte
+	props = appendAMQPShortStr(props, "product")
+	props = append(props, 'S')
+	props = appendAMQPLongStr(props, "go-watcher")
+	props = appendAMQPShortStr(props, "connection_name")
+	props = append(props, 'S')
+	props = appendAMQPLongStr(props, s.name)
+	var startOk []byte
+	startOk = appendAMQPLongStr(startOk, string(props))
+	startOk = appendAMQPShortStr(startOk, "PLAIN")
+	startOk = appendAMQPLongStr(startOk, "\x00"+s.user+"\x00"+s.password)
+	startOk = appendAMQPShortStr(startOk, "en_US")
+	c.writeMethod(0, amqpConnection, 11, startOk)
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	if args, err = c.expect(amqpConnection, 30); err != nil { // Tune
+		return err
+	}
+	r = amqpReader{b: args}
+	channelMax, frameMax := r.uint16(), int(r.uint32())
+	if r.err != nil {
+		return r.err
+	}
+	s.frameMax = amqpMaxFrame
+	if frameMax > 0 {
+		s.frameMax = min(frameMax, amqpMaxFrame)
+	}
+	var tuneOk []byte
+	tuneOk = binary.BigEndian.AppendUint16(tuneOk, channelMax)
+	tuneOk = binary.BigEndian.AppendUint32(tuneOk, uint32(s.frameMax))
+	tuneOk = binary.BigEndian.AppendUint16(tuneOk, 0)
+	c.writeMethod(0, amqpConnection, 31, tuneOk)
+	c.writeMethod(0, amqpConnection, 40, append(appendAMQPShortStr(nil, s.vhost), 0, 0)) // Open
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := c.expect(amqpConnection, 41); err != nil {
+		return err
+	}
+
+	c.writeMethod(1, amqpChannel, 10, []byte{0}) // Channel.Open
+	c.writeMethod(1, amqpConfirm, 10, []byte{0}) // Confirm.Select
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := c.expect(amqpChannel, 11); err != nil {
+		return err
+	}
+	_, err = c.expect(amqpConfirm, 11)
+	return err
+}
+
+// close drops the connection, to be made again on the next delivery
+func (s *AMQPSink) close() {
+	if s.conn != nil {
+		s.conn.conn.Close()
+		s.conn = nil
+	}
+}
+
+// amqpConn is a connection speaking AMQP 0-9-1 frames
+type amqpConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// writeFrame buffers a frame
+func (c *amqpConn) writeFrame(typ byte, channel uint16, payload []byte) {
+	var head [7]byte
+	head[0] = typ
+	binary.BigEndian.PutUint16(head[1:], channel)
+	binary.BigEndian.PutUint32(head[3:], uint32(len(payload)))
+	c.w.Write(head[:])
+	c.w.Write(payload)
+	c.w.WriteByte(amqpFrameEnd)
+}
+
+// writeMethod buffers a method frame
+func (c *amqpConn) writeMethod(channel, class, method uint16, args []byte) {
+	payload := binary.BigEndian.AppendUint16(nil, class)
+	payload = binary.BigEndian.AppendUint16(payload, method)
+	c.writeFrame(amqpFrameMethod, channel, append(payload, args...))
+}
+
+// readFrame reads a frame
+func (c *amqpConn) readFrame() (byte, uint16, []byte, error) {
+	var head [7]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(head[3:])
+	if n > 1<<24 {
+		return 0, 0, nil, fmt.Errorf("invalid frame size %d", n)
+	}
+	payload := make([]byte, n+1)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	if payload[n] != amqpFrameEnd {
+		return 0, 0, nil, errors.New("invalid frame end")
+	}
+	return head[0], binary.BigEndian.Uint16(head[1:]), payload[:n], nil
+}
+
+// readMethod reads frames up to the next method frame, skipping content
+// and heartbeats
+func (c *amqpConn) readMethod() (class, method uint16, args []byte, err error) {
+	for {
+		typ, _, payload, err := c.readFrame()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		if typ != amqpFrameMethod {
+			continue
+		}
+		if len(payload) < 4 {
+			return 0, 0, nil, errors.New("short method frame")
+		}
+		return binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:]), payload[4:], nil
+	}
+}
+
+// expect reads the next method, which must be the given one or a Close
+func (c *amqpConn) expect(class, method uint16) ([]byte, error) {
+	gotClass, gotMethod, args, err := c.readMethod()
+	if err != nil {
+		return nil, err
+	}
+	if gotClass == amqpConnection && gotMethod == 50 || gotClass == amqpChannel && gotMethod == 40 {
+		return nil, amqpCloseError(args)
+	}
+	if gotClass != class || gotMethod != method {
+		return nil, fmt.Errorf("expected method %d.%d, got %d.%d", class, method, gotClass, gotMethod)
+	}
+	return args, nil
+}
+
+// amqpReader decodes method arguments. The first error sticks.
+type amqpReader struct {
+	b   []byte
+	err error
+}
+
+func (r *amqpReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.b) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *amqpReader) uint16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *amqpReader) uint32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *amqpReader) shortStr() string {
+	if b := r.take(1); b != nil {
+		return string(r.take(int(b[0])))
+	}
+	return ""
+}
+
+func (r *amqpReader) longStr() string {
+	return string(r.take(int(r.uint32())))
+}
+
+func appendAMQPShortStr(b []byte, s string) []byte {
+	return append(append(b, byte(len(s))), s...)
+}
+
+func appendAMQPLongStr(b []byte, s string) []byte {
+	return append(binary.BigEndian.AppendUint32(b, uint32(len(s))), s...)
+}
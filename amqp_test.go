@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// amqpPublished is a message received by fakeAMQP
+type amqpPublished struct {
+	exchange, key, id, contentType, body string
+	mode                                 byte
+}
+
+// fakeAMQP runs an AMQP broker that confirms every message, or returns
+// those published mandatory to a routing key starting with "unbound", and
+// returns its address, the login responses and the messages received
+func fakeAMQP(t *testing.T) (string, func() ([]string, []amqpPublished)) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var mu sync.Mutex
+	var logins []string
+	var msgs []amqpPublished
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				c := &amqpConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+				var proto [8]byte
+				if _, err := io.ReadFull(c.r, proto[:]); err != nil || string(proto[:]) != "AMQP\x00\x00\x09\x01" {
+					t.Errorf("protocol header %q", proto)
+					return
+				}
+				start := []byte{0, 9}
+				start = appendAMQPLongStr(start, "")
+				start = appendAMQPLongStr(start, "AMQPLAIN PLAIN")
+				start = appendAMQPLongStr(start, "en_US")
+				c.writeMethod(0, amqpConnection, 10, start)
+				c.w.Flush()
+				var tag uint64
+				var pub *amqpPublished
+				var mandatory bool
+				for {
+					typ, _, payload, err := c.readFrame()
+					if err != nil {
+						return
+					}
+					switch typ {
+					case amqpFrameHeader:
+						r := amqpReader{b: payload}
+						r.take(14)
+						pub.contentType = r.shortStr()
+						pub.mode = r.take(1)[0]
+						pub.id = r.shortStr()
+						continue
+					case amqpFrameBody:
+						pub.body += string(payload)
+						tag++
+						mu.Lock()
+						msgs = append(msgs, *pub)
+						mu.Unlock()
+						if mandatory && strings.HasPrefix(pub.key, "unbound") {
+							ret := binary.BigEndian.AppendUint16(nil, 312)
+							ret = appendAMQPShortStr(ret, "NO_ROUTE")
+							ret = appendAMQPShortStr(ret, pub.exchange)
+							ret = appendAMQPShortStr(ret, pub.key)
+							c.writeMethod(1, amqpBasic, 50, ret)
+						}
+						c.writeMethod(1, amqpBasic, 80, append(binary.BigEndian.AppendUint64(nil, tag), 0))
+						c.w.Flush()
+						continue
+					}
+					class, method := binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:])
+					r := amqpReader{b: payload[4:]}
+					switch class<<8 | method {
+					case amqpConnection<<8 | 11: // StartOk
+						r.longStr()
+						r.shortStr()
+						mu.Lock()
+						logins = append(logins, r.longStr())
+						mu.Unlock()
+						c.writeMethod(0, amqpConnection, 30, []byte{0, 0, 0, 2, 0, 0, 0, 0x3c})
+					case amqpConnection<<8 | 40: // Open
+						if vhost := r.shortStr(); vhost != "edge" {
+							t.Errorf("vhost %q", vhost)
+						}
+						c.writeMethod(0, amqpConnection, 41, []byte{0})
+					case amqpChannel<<8 | 10:
+						c.writeMethod(1, amqpChannel, 11, []byte{0, 0, 0, 0})
+					case amqpConfirm<<8 | 10:
+						c.writeMethod(1, amqpConfirm, 11, nil)
+					case amqpBasic<<8 | 40: // Publish
+						r.take(2)
+						pub = &amqpPublished{exchange: r.shortStr(), key: r.shortStr()}
+						mandatory = r.take(1)[0]&1 == 1
+					}
+					c.w.Flush()
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), func() ([]string, []amqpPublished) {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), logins...), append([]amqpPublished(nil), msgs...)
+	}
+}
+
+func TestAMQPSink(t *testing.T) {
+	addr, received := fakeAMQP(t)
+	t.Setenv("AMQP_TEST_PASSWORD", "pw")
+	sink, err := newSink("amqp://watcher@" + addr + "/edge?password-env=AMQP_TEST_PASSWORD&exchange=routes&routing-key={source}.{type}.{destination}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &ChangeSet{Stream: "s1", ID: 4, Path: "/data/core.txt", Changes: []Change{
+		{Seq: 1, Type: ChangeAdded, Destination: "10.1.0.0/16"},
+		{Seq: 2, Type: ChangeRemoved, Destination: "2001:db8::/32"},
+	}}
+	for range 2 {
+		if err := sink.Deliver(context.Background(), cs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logins, msgs := received()
+	if len(logins) != 1 || logins[0] != "\x00watcher\x00pw" {
+		t.Errorf("logins = %q", logins)
+	}
+	if len(msgs) != 4 {
+		t.Fatalf("%d messages, want 4", len(msgs))
+	}
+	for i, want := range []struct{ key, id string }{
+		{"core.added.10.1.0.0/16", "s1-1"},
+		{"core.removed.2001:db8::/32", "s1-2"},
+	} {
+		m := msgs[i]
+		if m.exchange != "routes" || m.key != want.key || m.id != want.id || m.contentType != "application/json" || m.mode != 2 {
+			t.Errorf("message %d = %+v, want key %s and id %s", i, m, want.key, want.id)
+		}
+	}
+	var e jsonChange
+	if err := json.Unmarshal([]byte(msgs[0].body), &e); err != nil || e.ChangeSet != 4 || e.Change.Destination != "10.1.0.0/16" {
+		t.Errorf("body %s (%v)", msgs[0].body, err)
+	}
+}
+
+func TestAMQPSinkMandatory(t *testing.T) {
+	addr, _ := fakeAMQP(t)
+	sink, err := newSink("amqp://" + addr + "/edge?mandatory=true&routing-key=unbound.{type}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.Deliver(context.Background(), &ChangeSet{Path: "t.txt", Changes: []Change{{Type: ChangeAdded, Destination: "10.1.0.0/16"}}})
+	if err == nil || !strings.Contains(err.Error(), "NO_ROUTE for routing key unbound.added") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestNewAMQPSinkErrors(t *testing.T) {
+	t.Setenv("AMQP_TEST_PASSWORD", "pw")
+	for _, spec := range []string{
+		"amqp://",
+		"amqp+ws://broker",
+		"amqp://broker?routing-key={table}",
+		"amqp://broker?mandatory=maybe",
+		"amqp://watcher@broker",
+		"amqp://broker?password-env=AMQP_TEST_PASSWORD",
+	} {
+		if _, err := newSink(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Limits on the chunks listed by /api/v1/chunks
+const (
+	defaultChunkPage = 1000
+	maxChunkPage     = 10000
+)
+
+// The REST API, served with the web UI for scripts and other services:
+//
+//	GET  /api/v1/files                    the watched files, as TargetStatus
+//	GET  /api/v1/chunks?file=             a file's chunks, by destination
+//	GET  /api/v1/chunks/{dest}?file=      one chunk, with its content
+//	POST /api/v1/rescan?file=             re-chunks a file, or all of them
+//	GET  /api/v1/changesets?n=            the last n change sets, oldest first
+//
+// file may be left out when only one file is watched. Chunks are listed
+// without their content unless content=true, a page of limit at a time
+// (1000, at most 10000); after=DEST continues from the page ending at DEST.
+func (ui *WebUI) routeAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/files", ui.apiFiles)
+	mux.HandleFunc("GET /api/v1/chunks", ui.apiChunks)
+	mux.HandleFunc("GET /api/v1/chunks/{dest...}", ui.apiChunk)
+	mux.HandleFunc("POST /api/v1/rescan", ui.apiRescan)
+	mux.HandleFunc("GET /api/v1/changesets", ui.apiChangeSets)
+}
+
+// apiError is the body of an API error response
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeAPIError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	writeJSON(w, apiError{msg})
+}
+
+// apiChunkPage is the response of /api/v1/chunks. Next, if set, is the
+// after parameter for the next page.
+type apiChunkPage struct {
+	File   string     `json:"file"`
+	Total  int        `json:"total"`
+	Chunks []webChunk `json:"chunks"`
+	Next   string     `json:"next,omitempty"`
+}
+
+func (ui *WebUI) apiFiles(w http.ResponseWriter, r *http.Request) {
+	files := []TargetStatus{}
+	for _, t := range ui.Targets() {
+		files = append(files, t.Status())
+	}
+	slices.SortFunc(files, func(a, b TargetStatus) int { return strings.Compare(a.Name, b.Name) })
+	writeJSON(w, files)
+}
+
+// target returns the target named by the file parameter, or the only one,
+// writing an error if there is none
+func (ui *WebUI) target(w http.ResponseWriter, r *http.Request) *Target {
+	file := r.URL.Query().Get("file")
+	targets := ui.Targets()
+	if file == "" {
+		if len(targets) == 1 {
+			return targets[0]
+		}
+		writeAPIError(w, http.StatusBadRequest, "file is required when watching more than one file")
+		return nil
+	}
+	for _, t := range targets {
+		if t.Name == file {
+			return t
+		}
+	}
+	writeAPIError(w, http.StatusNotFound, "not watching "+file)
+	return nil
+}
+
+func (ui *WebUI) apiChunks(w http.ResponseWriter, r *http.Request) {
+	t := ui.target(w, r)
+	if t == nil {
+		return
+	}
+	q := r.URL.Query()
+	limit := defaultChunkPage
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			writeAPIError(w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+		limit = min(n, maxChunkPage)
+	}
+	content, _ := strconv.ParseBool(q.Get("content"))
+	after := q.Get("after")
+
+	t.Table.mu.RLock()
+	page := apiChunkPage{File: t.Name, Total: len(t.Table.Chunks), Chunks: []webChunk{}}
+	var chunks []*Chunk
+	for dest, c := range t.Table.Chunks {
+		if after == "" || dest > after {
+			chunks = append(chunks, c)
+		}
+	}
+	t.Table.mu.RUnlock()
+	slices.SortFunc(chunks, func(a, b *Chunk) int { return strings.Compare(a.Destination, b.Destination) })
+	if len(chunks) > limit {
+		chunks = chunks[:limit]
+		page.Next = chunks[limit-1].Destination
+	}
+	for _, c := range chunks {
+		page.Chunks = append(page.Chunks, apiChunk(t, c, content))
+	}
+	writeJSON(w, page)
+}
+
+func (ui *WebUI) apiChunk(w http.ResponseWriter, r *http.Request) {
+	t := ui.target(w, r)
+	if t == nil {
+		return
+	}
+	dest := r.PathValue("dest")
+	t.Table.mu.RLock()
+	c, ok := t.Table.Chunks[dest]
+	t.Table.mu.RUnlock()
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "no route to "+dest+" in "+t.Name)
+		return
+	}
+	writeJSON(w, apiChunk(t, c, true))
+}
+
+// apiChunk describes chunk c of t, reading back its content if asked to
+func apiChunk(t *Target, c *Chunk, content bool) webChunk {
+	wc := webChunk{Target: t.Name, Destination: c.Destination, StartLine: c.StartLine, EndLine: c.EndLine, Hash: c.Hash}
+	if content {
+		if data, err := c.Content(); err != nil {
+			wc.Error = err.Error()
+		} else {
+			wc.Content = string(data)
+		}
+	}
+	return wc
+}
+
+// apiRescan re-chunks the file, or every file, as SIGHUP does, answering
+// before the rescan is done
+func (ui *WebUI) apiRescan(w http.ResponseWriter, r *http.Request) {
+	targets := ui.Targets()
+	if r.URL.Query().Get("file") != "" || len(targets) == 1 {
+		t := ui.target(w, r)
+		if t == nil {
+			return
+		}
+		targets = []*Target{t}
+	}
+	files := []string{}
+	for _, t := range targets {
+		t.Reload()
+		files = append(files, t.Name)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, map[string][]string{"rescanning": files})
+}
+
+func (ui *WebUI) apiChangeSets(w http.ResponseWriter, r *http.Request) {
+	recent := ui.Feed.Recent()
+	if s := r.URL.Query().Get("n"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			writeAPIError(w, http.StatusBadRequest, "n must be a positive number")
+			return
+		}
+		recent = recent[max(0, len(recent)-n):]
+	}
+	writeChangeSets(w, recent)
+}
+
+// serveArgs turns the arguments of "go-watcher serve [-listen ADDR]
+// [options]" into the watcher's, serving the web UI and API on ADDR, :8080
+// by default
+func serveArgs(args []string) []string {
+	out := []string{}
+	listen := ":8080"
+	for i := 0; i < len(args); i++ {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		if !strings.HasPrefix(args[i], "-") || name != "listen" && name != "http-addr" {
+			out = append(out, args[i])
+			continue
+		}
+		if !hasValue && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+		listen = value
+	}
+	return append([]string{"-http-addr", listen}, out...)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAPI(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"), routeBlock("0.0.0.0/0", "Static", "172.31.0.254"), routeBlock("192.0.2.0/24", "OSPF", "172.31.0.2"))
+	target := NewTarget(path, loadTable(t, path), NewDispatcher(nil, nil))
+	targets := []*Target{target}
+	feed := NewChangeFeed(10)
+	for id := uint64(1); id <= 3; id++ {
+		feed.Publish(&ChangeSet{ID: id, Path: path})
+	}
+	srv := httptest.NewServer((&WebUI{Targets: func() []*Target { return targets }, Feed: feed}).Handler())
+	defer srv.Close()
+
+	call := func(method, url string, code int, v any) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+url, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != code {
+			t.Fatalf("%s %s: %s, want %d", method, url, resp.Status, code)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %v", method, url, err)
+		}
+	}
+
+	var files []TargetStatus
+	call("GET", "/api/v1/files", http.StatusOK, &files)
+	if len(files) != 1 || files[0].Name != path || files[0].Routes != 3 {
+		t.Errorf("files = %+v", files)
+	}
+
+	var page apiChunkPage
+	call("GET", "/api/v1/chunks?limit=2", http.StatusOK, &page)
+	if page.Total != 3 || len(page.Chunks) != 2 || page.Chunks[0].Destination != "0.0.0.0/0" || page.Chunks[0].Content != "" || page.Next != "10.0.0.0/8" {
+		t.Errorf("first page = %+v", page)
+	}
+	next := page.Next
+	page = apiChunkPage{}
+	call("GET", "/api/v1/chunks?content=true&after="+next+"&file="+path, http.StatusOK, &page)
+	if len(page.Chunks) != 1 || page.Chunks[0].Destination != "192.0.2.0/24" || !strings.Contains(page.Chunks[0].Content, "OSPF") || page.Next != "" {
+		t.Errorf("second page = %+v", page)
+	}
+
+	var chunk webChunk
+	call("GET", "/api/v1/chunks/10.0.0.0/8", http.StatusOK, &chunk)
+	if !strings.HasPrefix(chunk.Content, "Destination: 10.0.0.0/8") || chunk.Hash == "" {
+		t.Errorf("chunk = %+v", chunk)
+	}
+	var apiErr apiError
+	call("GET", "/api/v1/chunks/10.9.0.0/16", http.StatusNotFound, &apiErr)
+	call("GET", "/api/v1/chunks?file=/elsewhere", http.StatusNotFound, &apiErr)
+	if apiErr.Error != "not watching /elsewhere" {
+		t.Errorf("error = %+v", apiErr)
+	}
+
+	var rescan map[string][]string
+	call("POST", "/api/v1/rescan", http.StatusAccepted, &rescan)
+	if !slices.Equal(rescan["rescanning"], []string{path}) {
+		t.Errorf("rescan = %v", rescan)
+	}
+
+	var recent []struct {
+		ID uint64 `json:"id"`
+	}
+	call("GET", "/api/v1/changesets?n=2", http.StatusOK, &recent)
+	if len(recent) != 2 || recent[0].ID != 2 || recent[1].ID != 3 {
+		t.Errorf("change sets = %+v", recent)
+	}
+	call("GET", "/api/v1/changesets?n=x", http.StatusBadRequest, &apiErr)
+
+	// With more than one file, the file must be named
+	targets = append(targets, NewTarget("other", loadTable(t, path), NewDispatcher(nil, nil)))
+	call("GET", "/api/v1/chunks", http.StatusBadRequest, &apiErr)
+}
+
+func TestServeArgs(t *testing.T) {
+	for _, tt := range []struct{ args, want string }{
+		{"-file t.txt", "-http-addr :8080 -file t.txt"},
+		{"--listen :9000 -file t.txt", "-http-addr :9000 -file t.txt"},
+		{"-file t.txt -listen=127.0.0.1:80", "-http-addr 127.0.0.1:80 -file t.txt"},
+	} {
+		if got := strings.Join(serveArgs(strings.Fields(tt.args)), " "); got != tt.want {
+			t.Errorf("serve %s = %s, want %s", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultAuditBackups is how many rotated audit logs are kept by default
+const DefaultAuditBackups = 10
+
+// AuditLog appends every change set to a local file as a JSON line,
+// independent of the report and of sink deliveries, so there is a durable
+// record of every change to the tables. The file is rotated by size and
+// age; rotated files are renamed with the time of the rotation.
+type AuditLog struct {
+	Path string
+	// Sync fsyncs the file after every record
+	Sync bool
+	// MaxSize and MaxAge rotate the file once it is this large or its
+	// first record this old; zero disables either
+	MaxSize int64
+	MaxAge  time.Duration
+	// MaxBackups is the number of rotated files kept; zero keeps all
+	MaxBackups int
+
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	started time.Time
+}
+
+// OpenAuditLog opens (creating if needed) the audit log at path for
+// appending
+func OpenAuditLog(path string) (*AuditLog, error) {
+	a := &AuditLog{Path: path, MaxBackups: DefaultAuditBackups}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// auditRecord is one line of the audit log
+type auditRecord struct {
+	*ChangeSet
+	Summary Summary `json:"summary"`
+}
+
+// Write appends cs to the log, rotating it first if it is due
+func (a *AuditLog) Write(cs *ChangeSet) error {
+	data, err := json.Marshal(auditRecord{ChangeSet: cs, Summary: cs.Summarize(0)})
+	if err != nil {
+		return fmt.Errorf("failed to encode audit record: %w", err)
+	}
+	data = append(data, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return fmt.Errorf("audit log %s is closed", a.Path)
+	}
+	if a.due(cs.Time, int64(len(data))) {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.f.Write(data)
+	a.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	if a.started.IsZero() {
+		a.started = cs.Time
+	}
+	if a.Sync {
+		if err := a.f.Sync(); err != nil {
+			return fmt.Errorf("failed to sync audit log: %w", err)
+		}
+	}
+	return nil
+}
+
+// Close closes the log
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
+
+// open opens the file for appending, picking up the size and first
+// record time of an existing log
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat audit log: %w", err)
+	}
+	a.f, a.size, a.started = f, info.Size(), time.Time{}
+	if a.size > 0 {
+		a.started = firstRecordTime(a.Path)
+	}
+	return nil
+}
+
+// firstRecordTime returns the time of the first record in the log at
+// path, or now if it can't be read
+func firstRecordTime(path string) time.Time {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Now()
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	var rec struct {
+		Time time.Time `json:"time"`
+	}
+	if err != nil || json.Unmarshal(line, &rec) != nil || rec.Time.IsZero() {
+		return time.Now()
+	}
+	return rec.Time
+}
+
+// due reports whether the log must be rotated before writing n bytes at
+// now
+func (a *AuditLog) due(now time.Time, n int64) bool {
+	if a.size == 0 {
+		return false
+	}
+	if a.MaxSize > 0 && a.size+n > a.MaxSize {
+		return true
+	}
+	return a.MaxAge > 0 && !a.started.IsZero() && now.Sub(a.started) >= a.MaxAge
+}
+
+// rotate renames the current file aside, starts a new one and removes
+// the oldest rotated files beyond MaxBackups
+func (a *AuditLog) rotate() error {
+	if err := a.f.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log: %w", err)
+	}
+	a.f = nil
+	rotated := a.Path + "." + time.Now().UTC().Format("20060102T150405.000000000Z")
+	if err := os.Rename(a.Path, rotated); err != nil {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+	if err := a.open(); err != nil {
+		return err
+	}
+	metrics.Counter("audit_rotations_total", "Times the audit log was rotated").Inc()
+	return a.prune()
+}
+
+// prune removes rotated files beyond MaxBackups, oldest first
+func (a *AuditLog) prune() error {
+	if a.MaxBackups <= 0 {
+		return nil
+	}
+	matches, err := filepath.Glob(a.Path + ".*")
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, m := range matches {
+		// Rotated files are suffixed with a timestamp, which sorts by age
+		if suffix := strings.TrimPrefix(m, a.Path+"."); len(suffix) > 0 && suffix[0] >= '0' && suffix[0] <= '9' {
+			backups = append(backups, m)
+		}
+	}
+	sort.Strings(backups)
+	for len(backups) > a.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return fmt.Errorf("failed to remove old audit log: %w", err)
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "changes.log")
+	a, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Sync = true
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cs := func(id uint64, at time.Time) *ChangeSet {
+		return &ChangeSet{ID: id, Path: "t.txt", Time: at, Routes: 2, Changes: []Change{
+			{Seq: id, Type: ChangeAdded, Destination: "10.0.0.0/8", NewHash: "aa"},
+		}}
+	}
+	for id := uint64(1); id <= 2; id++ {
+		if err := a.Write(cs(id, start)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Close()
+
+	// Reopening appends, and rotates by the age of the first record
+	if a, err = OpenAuditLog(path); err != nil {
+		t.Fatal(err)
+	}
+	a.MaxAge = time.Hour
+	a.MaxBackups = 2
+	if err := a.Write(cs(3, start.Add(30*time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	if got := auditIDs(t, path); len(got) != 3 || got[2] != 3 {
+		t.Fatalf("log holds change sets %v, want 1 to 3", got)
+	}
+	if err := a.Write(cs(4, start.Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	if got := auditIDs(t, path); len(got) != 1 || got[0] != 4 {
+		t.Errorf("log after rotating by age holds %v, want [4]", got)
+	}
+
+	// Rotating by size keeps MaxBackups rotated files
+	a.MaxAge = 0
+	info, _ := os.Stat(path)
+	a.MaxSize = info.Size() + 1
+	for id := uint64(5); id <= 8; id++ {
+		if err := a.Write(cs(id, start.Add(time.Hour))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Close()
+	if got := auditIDs(t, path); len(got) != 1 || got[0] != 8 {
+		t.Errorf("log after rotating by size holds %v, want [8]", got)
+	}
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Errorf("kept %d rotated logs, want 2: %v", len(backups), backups)
+	} else if got := auditIDs(t, backups[1]); len(got) != 1 || got[0] != 7 {
+		t.Errorf("newest rotated log holds %v, want [7]", got)
+	}
+	if err := a.Write(cs(9, start)); err == nil {
+		t.Error("wrote to a closed audit log")
+	}
+}
+
+// auditIDs returns the IDs of the change sets recorded in the log at path
+func auditIDs(t *testing.T, path string) []uint64 {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var ids []uint64
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var rec struct {
+			ID      uint64 `json:"id"`
+			Summary Summary
+		}
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Summary.Added != 1 || rec.Summary.Routes != 2 {
+			t.Errorf("record %d summary = %+v", rec.ID, rec.Summary)
+		}
+		ids = append(ids, rec.ID)
+	}
+	return ids
+}
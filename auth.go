@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" // for the 384 and 512 bit JWS algorithms
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authenticator checks the credentials of requests to the web UI, REST,
+// GraphQL, WebSocket and gRPC APIs, whose chunks reveal the network's
+// topology. A request is let through with a static token from the tokens
+// file or, if an OIDC issuer is configured, a JWT it signed for the
+// audience. Credentials are read from, in order:
+//
+//	Authorization: Bearer <token>   also gRPC's authorization metadata
+//	X-API-Key: <token>
+//	?access_token=<token>           for browsers' EventSource and WebSocket
+//
+// With ClientCerts, requests must also come over TLS with a client
+// certificate the server verified; without tokens or OIDC, that is
+// enough. A nil *Authenticator lets every request through.
+type Authenticator struct {
+	// tokens maps the SHA-256 of each static token to its name
+	tokens map[[32]byte]string
+	// OIDC, if set, verifies JWTs
+	OIDC *OIDCVerifier
+	// ClientCerts requires a verified client certificate
+	ClientCerts bool
+}
+
+// errUnauthenticated is returned for requests without credentials
+var errUnauthenticated = errors.New("authentication required")
+
+// LoadTokens reads the static tokens of path, one per line, each
+// optionally after a name for the logs: "[name] token". Blank lines and
+// lines starting with # are ignored.
+func (a *Authenticator) LoadTokens(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tokens := make(map[[32]byte]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		var name, token string
+		switch len(fields) {
+		case 1:
+			name, token = fmt.Sprintf("line %d", n), fields[0]
+		case 2:
+			name, token = fields[0], fields[1]
+		default:
+			return fmt.Errorf("%s:%d: want a token, optionally after a name", path, n)
+		}
+		if len(token) < 16 {
+			return fmt.Errorf("%s:%d: token is shorter than 16 characters", path, n)
+		}
+		tokens[sha256.Sum256([]byte(token))] = name
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return fmt.Errorf("%s: no tokens", path)
+	}
+	a.tokens = tokens
+	return nil
+}
+
+// Authenticate returns who made r, from its credentials
+func (a *Authenticator) Authenticate(r *http.Request) (string, error) {
+	if a.ClientCerts {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return "", errors.New("client certificate required")
+		}
+		if a.tokens == nil && a.OIDC == nil {
+			return r.TLS.VerifiedChains[0][0].Subject.CommonName, nil
+		}
+	}
+	token := requestToken(r)
+	if token == "" {
+		return "", errUnauthenticated
+	}
+	if name, ok := a.tokens[sha256.Sum256([]byte(token))]; ok {
+		return name, nil
+	}
+	if a.OIDC != nil && strings.Count(token, ".") == 2 {
+		return a.OIDC.Verify(r.Context(), token)
+	}
+	return "", errors.New("invalid token")
+}
+
+// requestToken returns the credentials of r, or nothing
+func requestToken(r *http.Request) string {
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// HTTP returns next with every request but those public reports true
+// for, if public is set, required to authenticate. Others are answered
+// with 401.
+func (a *Authenticator) HTTP(next http.Handler, public func(*http.Request) bool) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if public != nil && public(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, err := a.check(r); err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="go-watcher"`)
+			writeAPIError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GRPC returns next with every RPC required to authenticate. Others end
+// with status UNAUTHENTICATED.
+func (a *Authenticator) GRPC(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := a.check(r); err != nil {
+			if grpcStart(w, r) {
+				grpcFinish(w, &grpcError{grpcUnauthenticated, err.Error()})
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// check authenticates r, counting and logging failures
+func (a *Authenticator) check(r *http.Request) (string, error) {
+	who, err := a.Authenticate(r)
+	if err != nil {
+		metrics.Counter("auth_failures_total", "API requests refused for missing or invalid credentials").Inc()
+		slog.Debug("refused unauthenticated request", "path", r.URL.Path, "remote", r.RemoteAddr, "err", err)
+	}
+	return who, err
+}
+
+// OIDCVerifier verifies JWTs issued by an OpenID Connect provider. The
+// provider's signing keys are found through its discovery document and
+// fetched again when a token names a key that isn't known, at most once a
+// minute.
+type OIDCVerifier struct {
+	Issuer   string
+	Audience string
+	client   *http.Client
+	now      func() time.Time
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	// fetch is the fetch of the keys in progress, if any
+	fetch *keyFetch
+}
+
+// keyFetch is a fetch of an issuer's keys that concurrent verifications
+// wait for rather than starting their own
+type keyFetch struct {
+	done chan struct{}
+	// err is set before done is closed
+	err error
+}
+
+// Limits of OIDC verification
+const (
+	// oidcLeeway is the clock skew allowed for exp and nbf
+	oidcLeeway = time.Minute
+	// oidcRefetch is how soon the keys may be fetched again
+	oidcRefetch = time.Minute
+	// oidcFetchTimeout bounds a fetch of the keys
+	oidcFetchTimeout = 10 * time.Second
+)
+
+// NewOIDCVerifier creates a verifier of tokens from issuer for audience
+func NewOIDCVerifier(issuer, audience string) *OIDCVerifier {
+	return &OIDCVerifier{
+		Issuer:   strings.TrimSuffix(issuer, "/"),
+		Audience: audience,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		now:      time.Now,
+	}
+}
+
+// jwtClaims are the claims of a JWT that are checked
+type jwtClaims struct {
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	Audience  jwtAudience `json:"aud"`
+	Expires   *jwtTime    `json:"exp"`
+	NotBefore *jwtTime    `json:"nbf"`
+}
+
+// jwtAudience is the aud claim, a string or a list of them
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*a = jwtAudience{one}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+// jwtTime is a NumericDate claim, in seconds since the Unix epoch
+type jwtTime float64
+
+func (t jwtTime) Time() time.Time { return time.Unix(0, int64(float64(t)*1e9)) }
+
+// Verify checks the signature and claims of token, returning its subject
+func (v *OIDCVerifier) Verify(ctx context.Context, token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", fmt.Errorf("JWT header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("JWT signature: %w", err)
+	}
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return "", err
+	}
+	if err := verifyJWS(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return "", err
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("JWT claims: %w", err)
+	}
+	now := v.now()
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != v.Issuer:
+		return "", fmt.Errorf("JWT issued by %q", claims.Issuer)
+	case v.Audience != "" && !slices.Contains(claims.Audience, v.Audience):
+		return "", fmt.Errorf("JWT not for audience %q", v.Audience)
+	case claims.Expires == nil:
+		return "", errors.New("JWT has no expiry")
+	case now.After(claims.Expires.Time().Add(oidcLeeway)):
+		return "", errors.New("JWT expired")
+	case claims.NotBefore != nil && now.Add(oidcLeeway).Before(claims.NotBefore.Time()):
+		return "", errors.New("JWT not valid yet")
+	}
+	return claims.Subject, nil
+}
+
+// decodeJWTPart decodes a base64url JSON part of a JWT into v
+func decodeJWTPart(s string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// verifyJWS checks sig of signed with key by alg
+func verifyJWS(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch alg[len(alg)-min(len(alg), 3):] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+	invalid := errors.New("invalid JWT signature")
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch {
+		case hash != 0 && strings.HasPrefix(alg, "RS"):
+			if rsa.VerifyPKCS1v15(k, hash, digest, sig) != nil {
+				return invalid
+			}
+			return nil
+		case hash != 0 && strings.HasPrefix(alg, "PS"):
+			if rsa.VerifyPSS(k, hash, digest, sig, nil) != nil {
+				return invalid
+			}
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		// Each ES algorithm is defined for one curve
+		curves := map[string]string{"ES256": "P-256", "ES384": "P-384", "ES512": "P-521"}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if curves[alg] != k.Curve.Params().Name || len(sig) != 2*size {
+			break
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return invalid
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			break
+		}
+		if !ed25519.Verify(k, signed, sig) {
+			return invalid
+		}
+		return nil
+	}
+	return fmt.Errorf("JWT algorithm %q doesn't match its key", alg)
+}
+
+// key returns the issuer's signing key named kid, fetching the keys if it
+// isn't known. The keys are fetched without holding mu, so tokens signed
+// with known keys are verified meanwhile, and verifications needing the
+// fetch wait for the one in progress.
+func (v *OIDCVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	if key, ok := v.keys[kid]; ok {
+		v.mu.Unlock()
+		return key, nil
+	}
+	fetch := v.fetch
+	if fetch == nil {
+		if !v.fetched.IsZero() && v.now().Sub(v.fetched) < oidcRefetch {
+			v.mu.Unlock()
+			return nil, fmt.Errorf("unknown JWT key %q", kid)
+		}
+		fetch = &keyFetch{done: make(chan struct{})}
+		v.fetch = fetch
+		// The fetch is shared, so it mustn't end with the request that
+		// happened to start it
+		go v.fetchShared(context.WithoutCancel(ctx), fetch)
+	}
+	v.mu.Unlock()
+	select {
+	case <-fetch.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if fetch.err != nil {
+		return nil, errors.New("OIDC keys unavailable")
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown JWT key %q", kid)
+}
+
+// fetchShared runs fetch, keeping the keys and starting the wait before
+// the next fetch only if it succeeded
+func (v *OIDCVerifier) fetchShared(ctx context.Context, fetch *keyFetch) {
+	ctx, cancel := context.WithTimeout(ctx, oidcFetchTimeout)
+	defer cancel()
+	keys, err := v.fetchKeys(ctx)
+	if err != nil {
+		slog.Error("failed to fetch OIDC keys", "issuer", v.Issuer, "err", err)
+	}
+	v.mu.Lock()
+	if err == nil {
+		v.keys, v.fetched = keys, v.now()
+	}
+	v.fetch = nil
+	v.mu.Unlock()
+	fetch.err = err
+	close(fetch.done)
+}
+
+// fetchKeys fetches the issuer's signing keys, by key ID
+func (v *OIDCVerifier) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := v.getJSON(ctx, v.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != v.Issuer || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document is for issuer %q with keys at %q", discovery.Issuer, discovery.JWKSURI)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := v.getJSON(ctx, discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			slog.Warn("skipping OIDC key", "kid", k.Kid, "err", err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (v *OIDCVerifier) getJSON(ctx context.Context, url string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(nil, resp.Body, 1<<20)).Decode(out); err != nil {
+		return fmt.Errorf("GET %s: %w", url, err)
+	}
+	return nil
+}
+
+// jwk is a JSON Web Key
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey returns the key k describes
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	field := func(s string) []byte {
+		b, _ := base64.RawURLEncoding.DecodeString(s)
+		return b
+	}
+	switch k.Kty {
+	case "RSA":
+		n, e := field(k.N), field(k.E)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid or short RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		x, y := field(k.X), field(k.Y)
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("invalid EC key")
+		}
+		return ecdsa.ParseUncompressedPublicKey(curve, append(append([]byte{4}, x...), y...))
+	case "OKP":
+		x := field(k.X)
+		if k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("unsupported OKP key %q", k.Crv)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
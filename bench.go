@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"text/tabwriter"
+	"time"
+)
+
+// generateTable writes a synthetic routing table with n routes in the
+// layout expected by the given chunker. When variant is non-zero the
+// next hop of one route in the middle differs, so two variants of the same
+// size differ by exactly one modified route.
+func generateTable(w io.Writer, n int, chunker string, variant int) error {
+	bw := bufio.NewWriter(w)
+	for i := 0; i < n; i++ {
+		dest := fmt.Sprintf("%d.%d.%d.0/24", 1+i/65536%223, i/256%256, i%256)
+		nextHop := "172.31.251.131"
+		if variant != 0 && i == n/2 {
+			nextHop = fmt.Sprintf("172.31.252.%d", variant%256)
+		}
+		var err error
+		switch chunker {
+		case ChunkByLine:
+			_, err = fmt.Fprintf(bw, "%s via %s dev Global-VE1.75 proto bgp metric 0\n", dest, nextHop)
+		default:
+			_, err = fmt.Fprintf(bw, `Destination: %s
+     Protocol: IBGP               Process ID: 0
+   Preference: 255                      Cost: 0
+      NextHop: %s      Neighbour: %s
+        State: Active Adv Relied         Age: 27d02h01m21s
+          Tag: 0                    Priority: low
+        Label: NULL                  QoSInfo: 0x0
+   IndirectID: 0x6005CE7            Instance:
+ RelayNextHop: 172.31.254.50       Interface: Global-VE1.75
+     TunnelID: 0x0                     Flags: RD
+
+`, dest, nextHop, nextHop)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// BenchResult is one benchmark measurement in the bench report
+type BenchResult struct {
+	Name        string  `json:"name"`
+	Routes      int     `json:"routes"`
+	Chunker     string  `json:"chunker"`
+	Hash        string  `json:"hash"`
+	Iterations  int     `json:"iterations"`
+	NsPerOp     int64   `json:"ns_per_op"`
+	BytesPerOp  int64   `json:"bytes_per_op"`
+	AllocsPerOp int64   `json:"allocs_per_op"`
+	MBPerSec    float64 `json:"mb_per_sec"`
+}
+
+// BenchReport is the machine-readable output of the bench command
+type BenchReport struct {
+	Time      time.Time     `json:"time"`
+	GoVersion string        `json:"go_version"`
+	GOOS      string        `json:"goos"`
+	GOARCH    string        `json:"goarch"`
+	CPUs      int           `json:"cpus"`
+	Results   []BenchResult `json:"results"`
+}
+
+// benchCase is one benchmark to run against a fixture
+type benchCase struct {
+	name    string
+	chunker string
+	hash    HashAlgorithm
+	fn      func(b *testing.B, fixture []byte, path string)
+}
+
+// benchCases returns the benchmarks run for every fixture size: a full load
+// per hash algorithm and per chunker, and full versus incremental detection
+func benchCases() []benchCase {
+	var cases []benchCase
+	for _, algo := range hashAlgorithms {
+		cases = append(cases, benchCase{"load", ChunkByDestination, algo, benchLoad})
+	}
+	for _, ck := range chunkers {
+		if ck != ChunkByDestination {
+			cases = append(cases, benchCase{"load", ck, DefaultHash, benchLoad})
+		}
+	}
+	cases = append(cases,
+		benchCase{"load-lean", ChunkByDestination, DefaultHash, benchLoadLean},
+		benchCase{"detect-full", ChunkByDestination, DefaultHash, benchDetect(false)},
+		benchCase{"detect-incremental", ChunkByDestination, DefaultHash, benchDetect(true)},
+	)
+	return cases
+}
+
+// benchLoad measures chunking and hashing a whole table from memory
+func benchLoad(b *testing.B, fixture []byte, _ string) {
+	rt := NewDataTable("")
+	rt.Options.Chunker = benchChunker
+	rt.Options.Hash = benchHash
+	b.SetBytes(int64(len(fixture)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := rt.LoadFrom(context.Background(), bytes.NewReader(fixture)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchLoadLean measures loading the table file in lean mode
+func benchLoadLean(b *testing.B, fixture []byte, path string) {
+	rt := NewDataTable(path)
+	rt.Options.Lean = true
+	b.SetBytes(int64(len(fixture)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := rt.LoadDataTable(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchDetect measures DetectChanges after one route in the middle of the
+// file changed, with or without the incremental block index
+func benchDetect(incremental bool) func(b *testing.B, fixture []byte, path string) {
+	return func(b *testing.B, fixture []byte, path string) {
+		var alt bytes.Buffer
+		if err := generateTable(&alt, bytes.Count(fixture, []byte("Destination:")), ChunkByDestination, 1); err != nil {
+			b.Fatal(err)
+		}
+		versions := [][]byte{alt.Bytes(), fixture}
+		if err := os.WriteFile(path, fixture, 0o644); err != nil {
+			b.Fatal(err)
+		}
+		rt := NewDataTable(path)
+		rt.Options.Incremental = incremental
+		if err := rt.LoadDataTable(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+
+		b.SetBytes(int64(len(fixture)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			if err := os.WriteFile(path, versions[i%2], 0o644); err != nil {
+				b.Fatal(err)
+			}
+			b.StartTimer()
+			cs, err := rt.DetectChanges(context.Background())
+			if err != nil {
+				b.Fatal(err)
+			}
+			if cs.Len() != 1 {
+				b.Fatalf("detected %d changes, want 1", cs.Len())
+			}
+		}
+	}
+}
+
+// benchChunker and benchHash pass the case settings to benchLoad, since
+// testing.Benchmark only takes a func(*testing.B)
+var (
+	benchChunker string
+	benchHash    HashAlgorithm
+)
+
+// runBench implements the bench command
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s bench [options]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Benchmark loading and change detection against generated tables.\n\n")
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	var sizes string
+	var asJSON bool
+	fs.StringVar(&sizes, "sizes", "10000,100000,1000000", "Comma separated route counts to generate fixtures for")
+	fs.BoolVar(&asJSON, "json", false, "Print a machine-readable JSON report")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var counts []int
+	for _, s := range splitList(sizes) {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			fmt.Fprintf(os.Stderr, "Error: invalid size %q\n", s)
+			return 2
+		}
+		counts = append(counts, n)
+	}
+
+	dir, err := os.MkdirTemp("", "go-watcher-bench")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	report := BenchReport{
+		Time:      time.Now().UTC(),
+		GoVersion: runtime.Version(),
+		GOOS:      runtime.GOOS,
+		GOARCH:    runtime.GOARCH,
+		CPUs:      runtime.NumCPU(),
+	}
+	for _, n := range counts {
+		fixtures := make(map[string][]byte)
+		for _, c := range benchCases() {
+			fixture, ok := fixtures[c.chunker]
+			if !ok {
+				var buf bytes.Buffer
+				if err := generateTable(&buf, n, c.chunker, 0); err != nil {
+					fmt.Fprintf(os.Stderr, "Error generating fixture: %v\n", err)
+					return 1
+				}
+				fixture = buf.Bytes()
+				fixtures[c.chunker] = fixture
+			}
+			path := filepath.Join(dir, fmt.Sprintf("%s-%d.txt", c.chunker, n))
+			if err := os.WriteFile(path, fixture, 0o644); err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing fixture: %v\n", err)
+				return 1
+			}
+
+			benchChunker, benchHash = c.chunker, c.hash
+			res := testing.Benchmark(func(b *testing.B) { c.fn(b, fixture, path) })
+			if res.N == 0 {
+				fmt.Fprintf(os.Stderr, "Error: benchmark %s/%d failed\n", c.name, n)
+				return 1
+			}
+			r := BenchResult{
+				Name:        c.name,
+				Routes:      n,
+				Chunker:     c.chunker,
+				Hash:        string(c.hash),
+				Iterations:  res.N,
+				NsPerOp:     res.NsPerOp(),
+				BytesPerOp:  res.AllocedBytesPerOp(),
+				AllocsPerOp: res.AllocsPerOp(),
+			}
+			if res.T > 0 {
+				r.MBPerSec = float64(res.Bytes) * float64(res.N) / 1e6 / res.T.Seconds()
+			}
+			report.Results = append(report.Results, r)
+			if !asJSON {
+				fmt.Fprintf(os.Stderr, "%s/%s/%s/%d: %v/op\n", r.Name, r.Chunker, r.Hash, r.Routes, time.Duration(r.NsPerOp))
+			}
+		}
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "BENCHMARK\tCHUNKER\tHASH\tROUTES\tNS/OP\tMB/S\tB/OP\tALLOCS/OP\t")
+	for _, r := range report.Results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%.1f\t%d\t%d\t\n", r.Name, r.Chunker, r.Hash, r.Routes, r.NsPerOp, r.MBPerSec, r.BytesPerOp, r.AllocsPerOp)
+	}
+	tw.Flush()
+	return 0
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a CircuitBreaker
+type BreakerState string
+
+const (
+	// BreakerClosed lets every operation through
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen rejects operations until the cooldown has passed
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen has let one probe through and waits for its outcome
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// CircuitBreaker stops calling a failing dependency. After Threshold
+// consecutive failures it opens for Cooldown; the first call allowed after
+// that is a probe, whose success closes the breaker and whose failure
+// opens it again.
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu        sync.Mutex
+	state     BreakerState
+	failures  int
+	openUntil time.Time
+	now       func() time.Time
+}
+
+// NewCircuitBreaker creates a closed breaker. A threshold of zero disables
+// it, so it never opens.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		Threshold: threshold,
+		Cooldown:  cooldown,
+		state:     BreakerClosed,
+		now:       time.Now,
+	}
+}
+
+// Allow reports whether an operation may run now
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Before(b.openUntil) {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		return true
+	case BreakerHalfOpen:
+		return false
+	}
+	return true
+}
+
+// Success records a successful operation and closes the breaker. It
+// returns true if the breaker was not closed before.
+func (b *CircuitBreaker) Success() (recovered bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	recovered = b.state != BreakerClosed
+	b.state = BreakerClosed
+	b.failures = 0
+	return recovered
+}
+
+// Failure records a failed operation. It returns true if this failure
+// opened the breaker.
+func (b *CircuitBreaker) Failure() (opened bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.Threshold <= 0 || b.state == BreakerOpen {
+		return false
+	}
+	if b.state == BreakerHalfOpen || b.failures >= b.Threshold {
+		b.state = BreakerOpen
+		b.openUntil = b.now().Add(b.Cooldown)
+		return true
+	}
+	return false
+}
+
+// State returns the current state
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
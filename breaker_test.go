@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := NewCircuitBreaker(3, time.Minute)
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if b.Failure() {
+			t.Fatalf("opened after %d failures", i+1)
+		}
+	}
+	b.Success()
+	b.Failure()
+	b.Failure()
+	if !b.Failure() || b.State() != BreakerOpen {
+		t.Fatalf("state after 3 consecutive failures = %s", b.State())
+	}
+	if b.Allow() {
+		t.Error("open breaker allowed a call")
+	}
+
+	now = now.Add(time.Minute)
+	if !b.Allow() || b.State() != BreakerHalfOpen {
+		t.Fatalf("state after cooldown = %s", b.State())
+	}
+	if b.Allow() {
+		t.Error("half-open breaker allowed a second probe")
+	}
+	if !b.Failure() || b.Allow() {
+		t.Error("failed probe did not reopen the breaker")
+	}
+
+	now = now.Add(time.Minute)
+	b.Allow()
+	if !b.Success() || b.State() != BreakerClosed || !b.Allow() {
+		t.Errorf("state after successful probe = %s", b.State())
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b := NewCircuitBreaker(0, time.Minute)
+	for i := 0; i < 100; i++ {
+		if b.Failure() {
+			t.Fatal("disabled breaker opened")
+		}
+	}
+	if !b.Allow() {
+		t.Error("disabled breaker rejected a call")
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// ChangeType describes how a route changed between two loads
+type ChangeType string
+
+const (
+	ChangeAdded    ChangeType = "added"
+	ChangeRemoved  ChangeType = "removed"
+	ChangeModified ChangeType = "modified"
+)
+
+// Change is a single changed route
+type Change struct {
+	// Seq is the change's sequence number within its stream; zero for
+	// volatile changes, which are not delivered
+	Seq         uint64     `json:"seq,omitempty"`
+	Type        ChangeType `json:"type"`
+	Destination string     `json:"destination"`
+	OldHash     string     `json:"old_hash,omitempty"`
+	NewHash     string     `json:"new_hash,omitempty"`
+	// Volatile marks changes to chunks that change on every load; they are
+	// kept for history but left out of notifications
+	Volatile bool `json:"volatile,omitempty"`
+	// Critical marks changes that matched a priority rule and were
+	// delivered without waiting for the batch window
+	Critical bool `json:"critical,omitempty"`
+	// Refs link the change to external records such as the change
+	// request that authorized it
+	Refs []ExternalRef `json:"refs,omitempty"`
+	// Coalesced lists the sequence numbers of earlier changes to the same
+	// route that were merged into this one while batching
+	Coalesced []uint64 `json:"coalesced,omitempty"`
+
+	// Old and New are the chunks on either side of the change; Old is nil
+	// for added routes and New is nil for removed routes
+	Old *Chunk `json:"-"`
+	New *Chunk `json:"-"`
+}
+
+// Chunk returns the most recent chunk for the change: the new chunk, or the
+// old one if the route was removed
+func (c *Change) Chunk() *Chunk {
+	if c.New != nil {
+		return c.New
+	}
+	return c.Old
+}
+
+// ChangeSet is the result of one DetectChanges run
+type ChangeSet struct {
+	// Stream and ID identify the DetectChanges run; see DataTable.Stream
+	Stream  string    `json:"stream,omitempty"`
+	ID      uint64    `json:"id,omitempty"`
+	Path    string    `json:"path"`
+	Time    time.Time `json:"time"`
+	Changes []Change  `json:"changes"`
+	// Routes is the number of routes in the table after the changes
+	Routes int `json:"routes"`
+
+	// NewlyVolatile and ClearedVolatile list chunks that started or stopped
+	// being treated as volatile with this change set
+	NewlyVolatile   []string `json:"newly_volatile,omitempty"`
+	ClearedVolatile []string `json:"cleared_volatile,omitempty"`
+
+	// MergedIDs lists the IDs of earlier change sets merged into this one
+	// while batching, and Cancelled the sequence numbers of changes that
+	// cancelled out (e.g. a route added and removed again)
+	MergedIDs []uint64 `json:"merged_ids,omitempty"`
+	Cancelled []uint64 `json:"cancelled,omitempty"`
+
+	// File is the table file's metadata when it was read and
+	// MetaChanges describes how it changed since the last read, if
+	// metadata is being watched
+	File        *FileMeta `json:"file,omitempty"`
+	MetaChanges []string  `json:"meta_changes,omitempty"`
+
+	// Truncated is set when the file was found truncated to zero bytes.
+	// Its routes are reported removed unless the previous table is being
+	// held, in which case the set has no changes.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Len returns the number of changes in the set
+func (cs *ChangeSet) Len() int {
+	return len(cs.Changes)
+}
+
+// Notifiable returns the changes that should be reported, leaving out
+// changes to volatile chunks
+func (cs *ChangeSet) Notifiable() []Change {
+	out := make([]Change, 0, len(cs.Changes))
+	for _, c := range cs.Changes {
+		if !c.Volatile {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// Count returns the number of changes of the given type
+func (cs *ChangeSet) Count(t ChangeType) int {
+	n := 0
+	for _, c := range cs.Changes {
+		if c.Type == t {
+			n++
+		}
+	}
+	return n
+}
+
+// Summary counts the changes of a change set by type, for the line closing
+// each report. Volatile changes are counted apart.
+type Summary struct {
+	Added    int     `json:"added"`
+	Removed  int     `json:"removed"`
+	Modified int     `json:"modified"`
+	Volatile int     `json:"volatile,omitempty"`
+	Routes   int     `json:"routes"`
+	TookMS   float64 `json:"took_ms"`
+}
+
+// Summarize returns the summary of cs, detected in took
+func (cs *ChangeSet) Summarize(took time.Duration) Summary {
+	s := Summary{Routes: cs.Routes, TookMS: milliseconds(took)}
+	for _, c := range cs.Changes {
+		switch {
+		case c.Volatile:
+			s.Volatile++
+		case c.Type == ChangeAdded:
+			s.Added++
+		case c.Type == ChangeRemoved:
+			s.Removed++
+		case c.Type == ChangeModified:
+			s.Modified++
+		}
+	}
+	return s
+}
+
+// diffChunks compares two chunk maps and returns the changes ordered by
+// destination
+func diffChunks(oldChunks, newChunks map[string]*Chunk) []Change {
+	var changes []Change
+
+	// Check existing chunks for changes
+	for dest, oldChunk := range oldChunks {
+		newChunk, exists := newChunks[dest]
+		if !exists {
+			// Route was deleted
+			changes = append(changes, Change{Type: ChangeRemoved, Destination: dest, OldHash: oldChunk.Hash, Old: oldChunk})
+		} else if newChunk.Hash != oldChunk.Hash {
+			// Route was modified
+			changes = append(changes, Change{Type: ChangeModified, Destination: dest, OldHash: oldChunk.Hash, NewHash: newChunk.Hash, Old: oldChunk, New: newChunk})
+		}
+	}
+
+	// Check for new routes
+	for dest, newChunk := range newChunks {
+		if _, exists := oldChunks[dest]; !exists {
+			changes = append(changes, Change{Type: ChangeAdded, Destination: dest, NewHash: newChunk.Hash, New: newChunk})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return lessDestination(changes[i].Destination, changes[j].Destination)
+	})
+	return changes
+}
+
+// forNotification returns a copy of cs holding only the notifiable changes
+func (cs *ChangeSet) forNotification() *ChangeSet {
+	out := *cs
+	out.Changes = cs.Notifiable()
+	return &out
+}
+
+// merge folds a later change set into cs, so a route changed in both
+// appears once with its net change. Routes that ended up back where they
+// started are dropped.
+func (cs *ChangeSet) merge(next *ChangeSet) {
+	index := make(map[string]int, len(cs.Changes))
+	for i, c := range cs.Changes {
+		index[c.Destination] = i
+	}
+	for _, c := range next.Changes {
+		i, ok := index[c.Destination]
+		if !ok {
+			index[c.Destination] = len(cs.Changes)
+			cs.Changes = append(cs.Changes, c)
+			continue
+		}
+		cs.Changes[i] = combineChanges(cs.Changes[i], c)
+	}
+
+	kept := cs.Changes[:0]
+	for _, c := range cs.Changes {
+		if c.Type != "" {
+			kept = append(kept, c)
+		} else {
+			cs.Cancelled = append(cs.Cancelled, c.Coalesced...)
+			if c.Seq != 0 {
+				cs.Cancelled = append(cs.Cancelled, c.Seq)
+			}
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		return lessDestination(kept[i].Destination, kept[j].Destination)
+	})
+	cs.Changes = kept
+	cs.MergedIDs = append(append(cs.MergedIDs, cs.ID), next.MergedIDs...)
+	cs.Cancelled = append(cs.Cancelled, next.Cancelled...)
+	cs.Stream = next.Stream
+	cs.ID = next.ID
+	cs.Path = next.Path
+	cs.Time = next.Time
+	cs.Routes = next.Routes
+	if next.File != nil {
+		cs.File = next.File
+	}
+	cs.MetaChanges = append(cs.MetaChanges, next.MetaChanges...)
+	cs.Truncated = next.Truncated
+	cs.NewlyVolatile = append(cs.NewlyVolatile, next.NewlyVolatile...)
+	cs.ClearedVolatile = append(cs.ClearedVolatile, next.ClearedVolatile...)
+}
+
+// combineChanges returns the net effect of change a followed by change b to
+// the same route. The result has an empty Type if the two cancel out.
+func combineChanges(a, b Change) Change {
+	c := b
+	c.Old, c.OldHash = a.Old, a.OldHash
+	c.Coalesced = append([]uint64(nil), a.Coalesced...)
+	if a.Seq != 0 {
+		c.Coalesced = append(c.Coalesced, a.Seq)
+	}
+	c.Coalesced = append(c.Coalesced, b.Coalesced...)
+	c.Refs = append([]ExternalRef(nil), a.Refs...)
+	for _, r := range b.Refs {
+		c.Refs = addRef(c.Refs, r)
+	}
+	switch {
+	case a.Type == ChangeAdded && b.Type == ChangeRemoved:
+		c.Type = ""
+	case a.Type == ChangeAdded:
+		c.Type = ChangeAdded
+	case b.Type == ChangeRemoved:
+		c.Type = ChangeRemoved
+	case a.OldHash == b.NewHash:
+		c.Type = ""
+	default:
+		c.Type = ChangeModified
+	}
+	return c
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of chat sinks
+const (
+	// DefaultChatInterval keeps within the chat services' limits of about
+	// a message a second per channel
+	DefaultChatInterval = time.Second
+	// DefaultChatTop is the number of address blocks in a message
+	DefaultChatTop = 5
+)
+
+// chatNotifier is what the chat sinks, Slack and Teams, share: the filter
+// that routes change sets to a channel, the summary posted and the
+// spacing of messages. Its parameters are
+//
+//	path, type, prefix  only post the changes selected as for /events
+//	link                the web UI's address, to link to the change set
+//	interval            least time between messages (default 1s)
+//	top                 address blocks listed (default 5)
+type chatNotifier struct {
+	filter   changeFilter
+	link     string
+	top      int
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// parse takes the notifier's parameters from q
+func (n *chatNotifier) parse(q url.Values) error {
+	n.top, n.interval = DefaultChatTop, DefaultChatInterval
+	var err error
+	if n.filter, err = parseChangeFilter(q.Get("path"), q.Get("type"), q.Get("prefix")); err != nil {
+		return err
+	}
+	n.link = strings.TrimSuffix(q.Get("link"), "/")
+	if v := q.Get("interval"); v != "" {
+		if n.interval, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("invalid interval: %w", err)
+		}
+	}
+	if v := q.Get("top"); v != "" {
+		if n.top, err = strconv.Atoi(v); err != nil || n.top < 0 {
+			return fmt.Errorf("invalid top %q", v)
+		}
+	}
+	for _, p := range []string{"path", "type", "prefix", "link", "interval", "top"} {
+		q.Del(p)
+	}
+	return nil
+}
+
+// wait waits for the next message's turn, spacing messages out by interval
+func (n *chatNotifier) wait(ctx context.Context) error {
+	n.mu.Lock()
+	now := time.Now()
+	wait := n.next.Sub(now)
+	n.next = now.Add(max(wait, 0) + n.interval)
+	n.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// chatSummary is what a chat message says about a change set
+type chatSummary struct {
+	cs *ChangeSet
+	// Changes are those of cs the notifier selects
+	Changes                            int
+	Added, Removed, Modified, Critical int
+	// Blocks are the top address blocks, formatted
+	Blocks string
+	// Link is the change set in the web UI, if the notifier has a link
+	Link string
+}
+
+// summarize returns the summary of cs to post, or nil if the filter
+// leaves nothing of it
+func (n *chatNotifier) summarize(cs *ChangeSet) *chatSummary {
+	changes := n.filter.changes(cs)
+	if len(changes) == 0 && !cs.Truncated {
+		return nil
+	}
+	s := &chatSummary{cs: cs, Changes: len(changes)}
+	blocks := make(groupCounter)
+	for _, c := range changes {
+		switch c.Type {
+		case ChangeAdded:
+			s.Added++
+		case ChangeRemoved:
+			s.Removed++
+		case ChangeModified:
+			s.Modified++
+		}
+		if c.Critical {
+			s.Critical++
+		}
+		blocks.add(prefixBlock(c.Destination), c.Type)
+	}
+	if n.top > 0 && len(blocks) > 0 {
+		s.Blocks = formatGroups(blocks.sorted(), n.top)
+	}
+	if n.link != "" {
+		s.Link = n.link + "/#" + changeSetAnchor(cs)
+	}
+	return s
+}
+
+// changeSetAnchor is the fragment of cs in the web UI's feed
+func changeSetAnchor(cs *ChangeSet) string {
+	if cs.Stream == "" {
+		return "changeset-" + strconv.FormatUint(cs.ID, 10)
+	}
+	return "changeset-" + cs.Stream + "-" + strconv.FormatUint(cs.ID, 10)
+}
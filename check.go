@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Exit codes of the check command
+const (
+	checkUnchanged = 0
+	checkChanged   = 1
+	checkFailed    = 2
+)
+
+// runCheck implements the check command: the table is compared once with
+// the state saved by the previous run, the changes are reported and the
+// new state is saved. The exit code tells cron jobs and CI whether
+// anything changed.
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s check -file <file> -state <file> [options]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Compare a table with the state saved by the previous check, print the changes and save the new state.\n")
+		fmt.Fprintf(fs.Output(), "Exits 0 if nothing changed, 1 if routes changed and 2 on error. The first check only records the state.\n\n")
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	var path, statePath, ignoreFields, normalize, hashName, chunkerName, output, tsFormat, tz string
+	var maxLineBytes int
+	var reportOpts ReportOptions
+	fs.StringVar(&path, "file", "", "Table file to check")
+	fs.StringVar(&statePath, "state", "", "File the table's state is kept in between checks")
+	fs.StringVar(&ignoreFields, "ignore-fields", "Age", "Comma separated route fields to ignore when hashing (empty to hash everything)")
+	fs.StringVar(&normalize, "normalize", "none", "Whitespace normalization before hashing: comma separated eol, trim, collapse, or all/none")
+	fs.StringVar(&hashName, "hash", string(DefaultHash), "Chunk hash algorithm: sha256, xxhash, blake3 or fnv")
+	fs.StringVar(&chunkerName, "chunker", ChunkByDestination, "How to split the table into routes: destination (\"Destination:\" blocks) or line (one route per unindented line)")
+	fs.IntVar(&maxLineBytes, "max-line-bytes", DefaultMaxLineBytes, "Longest line a table may contain")
+	fs.IntVar(&reportOpts.PreviewLimit, "preview-limit", 10, "Number of changed routes to list; larger change sets get a stratified preview")
+	fs.StringVar(&output, "output", OutputText, "Report format: text, json, jsonl, yaml, csv or protobuf, as in watch mode")
+	fs.StringVar(&tsFormat, "ts-format", DefaultTimeFormat, "Format of report timestamps, as in watch mode")
+	fs.StringVar(&tz, "tz", DefaultTimeZone, "Time zone of report timestamps: UTC, Local or an IANA name")
+	if err := fs.Parse(args); err != nil {
+		return checkFailed
+	}
+	if path == "" || statePath == "" {
+		fmt.Fprintf(os.Stderr, "Error: -file and -state are required\n\n")
+		fs.Usage()
+		return checkFailed
+	}
+
+	rt := NewDataTable(path)
+	rt.Options.IgnoreFields = splitList(ignoreFields)
+	rt.Options.MaxLineBytes = maxLineBytes
+	var err error
+	if rt.Options.Normalize, err = parseNormalize(normalize); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -normalize: %v\n", err)
+		return checkFailed
+	}
+	if rt.Options.Chunker, err = parseChunker(chunkerName); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -chunker: %v\n", err)
+		return checkFailed
+	}
+	if rt.Options.Hash, err = parseHashAlgorithm(hashName); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -hash: %v\n", err)
+		return checkFailed
+	}
+	if err := checkOutput(output); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return checkFailed
+	}
+	if reportOpts.Time, err = parseTimeFormat(tsFormat, tz); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return checkFailed
+	}
+	if output != OutputText {
+		reportOpts.Objects = newObjectWriter(os.Stdout, output)
+		reportOpts.Objects.times = reportOpts.Time
+	}
+
+	code, err := check(context.Background(), rt, statePath, reportOpts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return checkFailed
+	}
+	return code
+}
+
+// check compares rt's file with the state saved at statePath, reports the
+// changes and saves the new state. It returns the exit code for the
+// outcome.
+func check(ctx context.Context, rt *DataTable, statePath string, opts ReportOptions) (int, error) {
+	saved, err := rt.LoadState(statePath)
+	if err != nil {
+		return checkFailed, err
+	}
+	if !saved {
+		if err := rt.LoadDataTable(ctx); err != nil {
+			return checkFailed, err
+		}
+		if err := rt.SaveState(statePath); err != nil {
+			return checkFailed, err
+		}
+		fmt.Fprintf(os.Stderr, "No saved state in %s; recorded %d routes from %s\n", statePath, len(rt.Chunks), rt.FilePath)
+		return checkUnchanged, nil
+	}
+
+	start := time.Now()
+	cs, err := rt.DetectChanges(ctx)
+	if err != nil {
+		return checkFailed, err
+	}
+	reportChanges(os.Stdout, cs, time.Since(start), opts)
+	if err := rt.SaveState(statePath); err != nil {
+		return checkFailed, err
+	}
+	if len(cs.Notifiable()) == 0 {
+		return checkUnchanged, nil
+	}
+	return checkChanged, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	path := writeTable(t,
+		routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"),
+		routeBlock("0.0.0.0/0", "Static", "172.31.0.254"))
+	state := filepath.Join(t.TempDir(), "state.db")
+
+	var out bytes.Buffer
+	run := func() int {
+		t.Helper()
+		out.Reset()
+		code, err := check(context.Background(), NewDataTable(path), state, ReportOptions{Objects: newObjectWriter(&out, OutputJSONL)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	// The first check only records the state
+	if code := run(); code != checkUnchanged || out.Len() != 0 {
+		t.Fatalf("first check = %d, output %q", code, out.String())
+	}
+	if code := run(); code != checkUnchanged {
+		t.Errorf("unchanged check = %d", code)
+	}
+
+	rewriteFile(t, path, "172.31.0.1", "172.31.0.2")
+	if code := run(); code != checkChanged || !strings.Contains(out.String(), `"destination":"10.0.0.0/8","old_hash"`) {
+		t.Errorf("check after change = %d, output:\n%s", code, out.String())
+	}
+	// The change was saved, so it is reported once
+	if code := run(); code != checkUnchanged {
+		t.Errorf("check after reporting = %d", code)
+	}
+
+	// Errors, such as a state from other options, are exit code 2
+	rt := NewDataTable(path)
+	rt.Options.Hash = HashBLAKE3
+	if code, err := check(context.Background(), rt, state, ReportOptions{}); code != checkFailed || err == nil {
+		t.Errorf("check with other options = %d, %v", code, err)
+	}
+	if err := os.WriteFile(state, []byte("not a snapshot"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if code, err := check(context.Background(), NewDataTable(path), state, ReportOptions{}); code != checkFailed || err == nil {
+		t.Errorf("check with a corrupt state = %d, %v", code, err)
+	}
+}
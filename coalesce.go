@@ -0,0 +1,125 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultMaxDelay bounds how long a burst of file events can hold back a
+// notification
+const DefaultMaxDelay = 10 * time.Second
+
+// Coalescer merges bursts of events into single notifications. A burst is
+// reported once no event has arrived for the quiet period, and never later
+// than MaxDelay after its first event, so continuous events can neither
+// postpone a notification forever nor turn into one notification each.
+type Coalescer struct {
+	// Quiet is how long events must stop before a burst is reported; zero
+	// reports every event
+	Quiet time.Duration
+	// MaxWait, if set, makes the quiet period adaptive: it grows while
+	// events keep arriving, so a long regeneration isn't read
+	// half-written, but a burst is always reported within MaxWait of its
+	// first event
+	MaxWait time.Duration
+	// MaxDelay bounds the latency of every notification from the first
+	// event of its burst (0 for no bound)
+	MaxDelay time.Duration
+
+	notify func(events int)
+
+	mu         sync.Mutex
+	timer      *time.Timer
+	burstStart time.Time
+	events     int
+	stopped    bool
+}
+
+// NewCoalescer creates a coalescer that calls notify with the number of
+// events in each burst
+func NewCoalescer(quiet time.Duration, notify func(events int)) *Coalescer {
+	return &Coalescer{Quiet: quiet, MaxDelay: DefaultMaxDelay, notify: notify}
+}
+
+// Configure replaces the timings of a coalescer that may be in use. They
+// apply from the next event.
+func (c *Coalescer) Configure(quiet, maxWait, maxDelay time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Quiet, c.MaxWait, c.MaxDelay = quiet, maxWait, maxDelay
+}
+
+// Event records an event, (re)starting the wait for the burst to end
+func (c *Coalescer) Event() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return
+	}
+	now := time.Now()
+	if c.events == 0 {
+		c.burstStart = now
+	}
+	c.events++
+
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	if c.Quiet <= 0 {
+		go c.flush()
+		return
+	}
+	c.timer = time.AfterFunc(c.delay(now.Sub(c.burstStart)), c.flush)
+}
+
+// delay returns how long to wait for further events in a burst that has
+// been going on for burst: the quiet period, or with MaxWait a quarter of
+// the burst so far if that is longer, cut short at the burst's deadline
+func (c *Coalescer) delay(burst time.Duration) time.Duration {
+	d := c.Quiet
+	if c.MaxWait > 0 {
+		d = max(d, burst/4)
+	}
+	if limit := c.limit(); limit > 0 {
+		d = max(0, min(d, limit-burst))
+	}
+	return d
+}
+
+// limit returns the longest a burst may wait, or 0 for no limit
+func (c *Coalescer) limit() time.Duration {
+	switch {
+	case c.MaxWait > 0 && c.MaxDelay > 0:
+		return min(c.MaxWait, c.MaxDelay)
+	case c.MaxWait > 0:
+		return c.MaxWait
+	}
+	return c.MaxDelay
+}
+
+// flush reports the pending burst
+func (c *Coalescer) flush() {
+	c.mu.Lock()
+	n := c.events
+	latency := time.Since(c.burstStart)
+	c.events = 0
+	stopped := c.stopped
+	c.mu.Unlock()
+	if n == 0 || stopped {
+		return
+	}
+	metrics.Counter("watch_notifications_total", "Coalesced file change notifications").Inc()
+	metrics.Counter("watch_events_total", "File events received, before coalescing").Add(int64(n))
+	metrics.Gauge("watch_notify_delay_ms", "Delay between the first event of the last burst and its notification").Set(latency.Milliseconds())
+	c.notify(n)
+}
+
+// Stop drops any pending burst and ignores further events
+func (c *Coalescer) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
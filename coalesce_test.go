@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCoalescerDelay(t *testing.T) {
+	c := &Coalescer{Quiet: 500 * time.Millisecond}
+	if d := c.delay(time.Minute); d != 500*time.Millisecond {
+		t.Errorf("unbounded delay = %v", d)
+	}
+
+	c.MaxDelay = 10 * time.Second
+	for _, tc := range []struct{ burst, want time.Duration }{
+		{0, 500 * time.Millisecond},
+		{4 * time.Second, 500 * time.Millisecond},
+		{9800 * time.Millisecond, 200 * time.Millisecond},
+		{12 * time.Second, 0},
+	} {
+		if d := c.delay(tc.burst); d != tc.want {
+			t.Errorf("fixed delay after %v = %v, want %v", tc.burst, d, tc.want)
+		}
+	}
+
+	// Adaptive: the quiet period grows with the burst, up to the earlier
+	// of MaxWait and MaxDelay
+	c.MaxWait = 8 * time.Second
+	for _, tc := range []struct{ burst, want time.Duration }{
+		{0, 500 * time.Millisecond},
+		{time.Second, 500 * time.Millisecond},
+		{4 * time.Second, time.Second},
+		{7 * time.Second, time.Second},
+		{8 * time.Second, 0},
+	} {
+		if d := c.delay(tc.burst); d != tc.want {
+			t.Errorf("adaptive delay after %v = %v, want %v", tc.burst, d, tc.want)
+		}
+	}
+}
+
+// notifications records the event counts passed to a coalescer's notify
+type notifications struct {
+	mu     sync.Mutex
+	counts []int
+}
+
+func (n *notifications) add(events int) {
+	n.mu.Lock()
+	n.counts = append(n.counts, events)
+	n.mu.Unlock()
+}
+
+func (n *notifications) get() []int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]int(nil), n.counts...)
+}
+
+func TestCoalescerBurst(t *testing.T) {
+	var got notifications
+	c := NewCoalescer(20*time.Millisecond, got.add)
+	for i := 0; i < 5; i++ {
+		c.Event()
+	}
+	waitFor(t, "notification", func() bool { return len(got.get()) > 0 })
+	time.Sleep(40 * time.Millisecond)
+	if counts := got.get(); len(counts) != 1 || counts[0] != 5 {
+		t.Errorf("notifications = %v, want one of 5 events", counts)
+	}
+}
+
+func TestCoalescerMaxDelay(t *testing.T) {
+	var got notifications
+	c := NewCoalescer(20*time.Millisecond, got.add)
+	c.MaxDelay = 50 * time.Millisecond
+
+	// Events that never leave a quiet period are reported in batches at
+	// most MaxDelay apart
+	for start := time.Now(); time.Since(start) < 300*time.Millisecond; {
+		c.Event()
+		time.Sleep(2 * time.Millisecond)
+	}
+	c.Stop()
+	counts := got.get()
+	if len(counts) < 3 {
+		t.Fatalf("notifications = %v, want several batches", counts)
+	}
+	for _, n := range counts {
+		if n < 2 {
+			t.Errorf("notifications = %v, want batches of several events", counts)
+			break
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// ANSI escape sequences for colored reports
+const (
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+	ansiCyan   = "\x1b[36m"
+	ansiReset  = "\x1b[0m"
+)
+
+// colorEnabled reports whether reports written to f should be colored: f
+// is a terminal, -no-color isn't set and neither NO_COLOR
+// (https://no-color.org) nor TERM=dumb asks otherwise
+func colorEnabled(f *os.File, noColor bool) bool {
+	if noColor || os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// paint wraps s in the escape sequence code if on is set
+func paint(on bool, code, s string) string {
+	if !on || s == "" {
+		return s
+	}
+	return code + s + ansiReset
+}
+
+// changeColor is the color of a change type: green for added, red for
+// removed and yellow for modified routes
+func changeColor(t ChangeType) string {
+	switch t {
+	case ChangeAdded:
+		return ansiGreen
+	case ChangeRemoved:
+		return ansiRed
+	}
+	return ansiYellow
+}
+
+// diffLineColor is the color of a line of a unified or side-by-side diff,
+// by its leading marker
+func diffLineColor(line string) string {
+	switch {
+	case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+		return ""
+	case strings.HasPrefix(line, "+"):
+		return ansiGreen
+	case strings.HasPrefix(line, "-"):
+		return ansiRed
+	case strings.HasPrefix(line, "@@"):
+		return ansiCyan
+	}
+	return ""
+}
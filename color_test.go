@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReportColor(t *testing.T) {
+	r, err := NewDiffRenderer(LoadOptions{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &ChangeSet{Path: "t.txt", Changes: []Change{
+		*modifiedChange(t, "Destination: 10.0.0.0/8\nNextHop: 1.1.1.1", "Destination: 10.0.0.0/8\nNextHop: 2.2.2.2"),
+		{Type: ChangeAdded, Destination: "10.1.0.0/16"},
+	}}
+	opts := ReportOptions{PreviewLimit: 10, Diff: DiffUnified, Renderer: r, Color: true}
+
+	var out bytes.Buffer
+	reportChanges(&out, cs, time.Millisecond, opts)
+	for _, want := range []string{
+		ansiYellow + "modified" + ansiReset,
+		ansiGreen + "added   " + ansiReset,
+		ansiRed + "-NextHop: 1.1.1.1" + ansiReset,
+		ansiGreen + "+NextHop: 2.2.2.2" + ansiReset,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report lacks %q:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	opts.Color = false
+	reportChanges(&out, cs, time.Millisecond, opts)
+	if strings.Contains(out.String(), "\x1b[") {
+		t.Errorf("uncolored report has escapes:\n%s", out.String())
+	}
+}
+
+func TestColorEnabled(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if colorEnabled(f, false) {
+		t.Error("colored a regular file")
+	}
+
+	// Terminals are told apart as character devices, which /dev/null is
+	// too
+	tty, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer tty.Close()
+	t.Setenv("NO_COLOR", "")
+	t.Setenv("TERM", "xterm")
+	if !colorEnabled(tty, false) {
+		t.Error("didn't color a terminal")
+	}
+	if colorEnabled(tty, true) {
+		t.Error("colored with -no-color")
+	}
+	t.Setenv("NO_COLOR", "1")
+	if colorEnabled(tty, false) {
+		t.Error("colored with NO_COLOR set")
+	}
+}
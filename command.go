@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// CommandSource produces the routing table by running a command, such as
+// "ssh router display ip routing-table", and reading its standard output.
+// It lets the watcher diff devices directly without an intermediate dump
+// file.
+type CommandSource struct {
+	Command string
+	// Timeout kills the command if it runs longer; zero means no limit
+	Timeout time.Duration
+}
+
+// Output runs the command through the shell and returns its standard
+// output. A failed command's error includes the end of its standard error.
+func (c *CommandSource) Output(ctx context.Context) ([]byte, error) {
+	return runShell(ctx, c.Command, c.Timeout, nil, nil)
+}
+
+// Load runs the command and loads its output into rt
+func (c *CommandSource) Load(ctx context.Context, rt *DataTable) error {
+	out, err := c.Output(ctx)
+	if err != nil {
+		return err
+	}
+	return rt.LoadFrom(ctx, bytes.NewReader(out))
+}
+
+// DetectChanges runs the command and diffs its output against rt
+func (c *CommandSource) DetectChanges(ctx context.Context, rt *DataTable) (*ChangeSet, error) {
+	out, err := c.Output(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return rt.DetectChangesFrom(ctx, bytes.NewReader(out))
+}
+
+// Event describes a reload for the report
+func (c *CommandSource) Event() string {
+	return "Running Command"
+}
+
+// runShell runs command through the shell with stdin as its standard input
+// and env added to its environment, killing it after timeout unless that
+// is zero, and returns its standard output. A failed command's error
+// includes the end of its standard error.
+func runShell(ctx context.Context, command string, timeout time.Duration, stdin io.Reader, env []string) ([]byte, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd := shellCommand(ctx, command)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %v", timeout)
+		}
+		if msg := lastLine(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("command %q failed: %w: %s", command, err, msg)
+		}
+		return nil, fmt.Errorf("command %q failed: %w", command, err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// shellCommand runs command through the platform shell so quoting and
+// pipes work as they do on the command line
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	}
+	// Don't wait for children of a killed shell to close its output
+	cmd.WaitDelay = 500 * time.Millisecond
+	return cmd
+}
+
+// lastLine returns the last non-empty line of s
+func lastLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		s = s[i+1:]
+	}
+	return strings.TrimSpace(s)
+}
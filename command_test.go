@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandSource(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses /bin/sh")
+	}
+	path := writeTable(t,
+		routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"),
+		routeBlock("0.0.0.0/0", "Static", "172.31.0.254"),
+	)
+	src := &CommandSource{Command: "cat '" + path + "'", Timeout: 5 * time.Second}
+	rt := NewDataTable(src.Command)
+	if err := src.Load(context.Background(), rt); err != nil {
+		t.Fatal(err)
+	}
+	if len(rt.Chunks) != 2 {
+		t.Fatalf("loaded %d chunks", len(rt.Chunks))
+	}
+
+	rewriteFile(t, path, "172.31.0.254", "172.31.0.253")
+	cs, err := src.DetectChanges(context.Background(), rt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := changeSummary(cs); len(got) != 1 || got[0] != "modified 0.0.0.0/0" || cs.Path != src.Command {
+		t.Errorf("changes = %v from %q", got, cs.Path)
+	}
+}
+
+func TestCommandSourceErrors(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses /bin/sh")
+	}
+	src := &CommandSource{Command: "echo partial; echo 'ssh: connect to host router: Connection refused' >&2; exit 255"}
+	_, err := src.Output(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "Connection refused") {
+		t.Errorf("err = %v", err)
+	}
+
+	src = &CommandSource{Command: "sleep 5", Timeout: 50 * time.Millisecond}
+	_, err = src.Output(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestTargetPollsCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses /bin/sh")
+	}
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	src := &CommandSource{Command: "cat '" + path + "'"}
+	rt := NewDataTable(src.Command)
+	if err := src.Load(context.Background(), rt); err != nil {
+		t.Fatal(err)
+	}
+	sink := &fakeSink{name: "hook"}
+	target := NewTarget(t.Name(), rt, NewDispatcher([]Sink{sink}, nil))
+	target.Command = src
+	target.Out = io.Discard
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	target.Start(ctx)
+	target.Poll(ctx, 10*time.Millisecond)
+
+	rewriteFile(t, path, "172.31.0.1", "172.31.0.2")
+	waitFor(t, "delivery", func() bool { return len(sink.delivered()) > 0 })
+	if got := changeSummary(sink.delivered()[0]); len(got) != 1 || got[0] != "modified 10.0.0.0/8" {
+		t.Errorf("changes = %v", got)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// compression returns "gzip" or "zstd" if the open table file starts with
+// that format's magic bytes, or "" for a plain file. The magic bytes are
+// checked rather than the extension, so a dump compressed in place still
+// reads correctly whatever it's called.
+func compression(file *os.File) (string, error) {
+	magic := make([]byte, len(zstdMagic))
+	n, err := file.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+	magic = magic[:n]
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return "gzip", nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		return "zstd", nil
+	}
+	return "", nil
+}
+
+// maxSizeReader fails with ErrTooLarge once more than max bytes have
+// been read from r, the decompressed content of the table file at path
+type maxSizeReader struct {
+	r    io.Reader
+	path string
+	max  int64
+	n    int64
+}
+
+func (mr *maxSizeReader) Read(p []byte) (int, error) {
+	n, err := mr.r.Read(p)
+	if mr.n += int64(n); mr.n > mr.max {
+		return n, fmt.Errorf("%s decompresses to over the %d byte limit, and compressed tables can't be loaded lean: %w", mr.path, mr.max, ErrTooLarge)
+	}
+	return n, err
+}
+
+// decompress returns a reader of the decompressed content of r
+func decompress(format string, r io.Reader) (io.ReadCloser, error) {
+	switch format {
+	case "gzip":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gzip header: %w", err)
+		}
+		return zr, nil
+	case "zstd":
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read zstd stream: %w", err)
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return io.NopCloser(r), nil
+}
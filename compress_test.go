@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestLoadCompressed(t *testing.T) {
+	table := routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1") + "\n" + routeBlock("0.0.0.0/0", "Static", "172.31.0.254") + "\n"
+	path := filepath.Join(t.TempDir(), "plain.txt")
+	if err := os.WriteFile(path, []byte(table), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	plain := NewDataTable(path)
+	if err := plain.LoadDataTable(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(table))
+	w.Close()
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zst := enc.EncodeAll([]byte(table), nil)
+
+	for name, data := range map[string][]byte{"table.gz": gz.Bytes(), "table.zst": zst, "table.txt": zst} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			rt := NewDataTable(path)
+			if err := rt.LoadDataTable(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if len(rt.Chunks) != len(plain.Chunks) {
+				t.Fatalf("loaded %d chunks, want %d", len(rt.Chunks), len(plain.Chunks))
+			}
+			for dest, c := range plain.Chunks {
+				if got := rt.Chunks[dest]; got == nil || got.Hash != c.Hash {
+					t.Errorf("%s: chunk %+v, want hash %s", dest, got, c.Hash)
+				}
+			}
+
+			// Changes are detected by decompressing the new content
+			var gz bytes.Buffer
+			w := gzip.NewWriter(&gz)
+			w.Write([]byte(routeBlock("10.0.0.0/8", "IBGP", "172.31.0.2") + "\n"))
+			w.Close()
+			if err := os.WriteFile(path, gz.Bytes(), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			cs, err := rt.DetectChanges(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := changeSummary(cs); len(got) != 2 || got[0] != "removed 0.0.0.0/0" || got[1] != "modified 10.0.0.0/8" {
+				t.Errorf("changes = %v", got)
+			}
+		})
+	}
+}
+
+func TestLoadCompressedLimits(t *testing.T) {
+	table := routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1") + "\n" + routeBlock("0.0.0.0/0", "Static", "172.31.0.254") + "\n"
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(strings.Repeat(table, 50)))
+	w.Close()
+	path := filepath.Join(t.TempDir(), "table.gz")
+	if err := os.WriteFile(path, gz.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The limit is on the decompressed content, not the file
+	rt := NewDataTable(path)
+	rt.Options.MaxSize = int64(gz.Len()) + 1
+	if err := rt.LoadDataTable(context.Background()); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("load over -max-size = %v, want ErrTooLarge", err)
+	}
+	rt.Options.MaxSize = int64(len(table)) * 50
+	if err := rt.LoadDataTable(context.Background()); err != nil || rt.Len() != 2 {
+		t.Errorf("load within -max-size: %v, %d routes", err, rt.Len())
+	}
+
+	rt = NewDataTable(path)
+	rt.Options.Lean = true
+	if err := rt.LoadDataTable(context.Background()); err == nil || !strings.Contains(err.Error(), "-lean") {
+		t.Errorf("lean load of a compressed table = %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Config is a -config file. Top-level keys set flags by name, as they
+// would be given on the command line; flags given explicitly on the
+// command line win. Files holds settings for individual watched files,
+// keyed by path, and Routing the rules picking the changes each sink is
+// sent:
+//
+//	{
+//	  "sink": ["webhook+https://hooks.example.com/routes"],
+//	  "debounce": "1s",
+//	  "files": {
+//	    "/data/core.txt": {"debounce": "0s"}
+//	  },
+//	  "routing": [
+//	    {"prefix": ["10.0.0.0/8+"], "sinks": ["webhook-hooks.example.com"]}
+//	  ]
+//	}
+type Config struct {
+	Flags   map[string]json.RawMessage
+	Files   map[string]FileConfig
+	Routing []RoutingRule
+
+	explicit map[string]bool
+}
+
+// FileConfig holds settings for one watched file
+type FileConfig struct {
+	// Debounce overrides the debounce interval for this file
+	Debounce *Duration `json:"debounce,omitempty"`
+	// DebounceMax overrides the adaptive debounce's maximum wait
+	DebounceMax *Duration `json:"debounce_max,omitempty"`
+	// MaxDelay overrides the bound on notification latency
+	MaxDelay *Duration `json:"max_delay,omitempty"`
+}
+
+// Duration is a time.Duration written as a string such as "500ms" in JSON
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"500ms\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// LoadConfig reads a config file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	c := &Config{Flags: raw, Files: make(map[string]FileConfig)}
+	if files, ok := raw["files"]; ok {
+		delete(raw, "files")
+		var byPath map[string]FileConfig
+		if err := json.Unmarshal(files, &byPath); err != nil {
+			return nil, fmt.Errorf("failed to parse files in %s: %w", path, err)
+		}
+		for p, fc := range byPath {
+			c.Files[filepath.Clean(p)] = fc
+		}
+	}
+	if routing, ok := raw["routing"]; ok {
+		delete(raw, "routing")
+		dec := json.NewDecoder(bytes.NewReader(routing))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&c.Routing); err != nil {
+			return nil, fmt.Errorf("failed to parse routing in %s: %w", path, err)
+		}
+	}
+	return c, nil
+}
+
+// routing returns the routing rules, if any
+func (c *Config) routing() []RoutingRule {
+	if c == nil {
+		return nil
+	}
+	return c.Routing
+}
+
+// apply sets the flags in fs named by the config, skipping those already
+// set on the command line. Arrays set repeatable flags once per element.
+func (c *Config) apply(fs *flag.FlagSet) error {
+	c.explicit = make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { c.explicit[f.Name] = true })
+
+	for name, raw := range c.Flags {
+		if name == "config" || fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown option %q", name)
+		}
+		if c.explicit[name] {
+			continue
+		}
+		values, err := flagValues(raw)
+		if err != nil {
+			return fmt.Errorf("option %q: %w", name, err)
+		}
+		for _, v := range values {
+			if err := fs.Set(name, v); err != nil {
+				return fmt.Errorf("option %q: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// flagValues converts a JSON value to the strings a flag would be set to
+func flagValues(raw json.RawMessage) ([]string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) > 0 && raw[0] == '[' {
+		var list []json.RawMessage
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return nil, err
+		}
+		var values []string
+		for _, item := range list {
+			v, err := flagValues(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v...)
+		}
+		return values, nil
+	}
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case string:
+		return []string{v}, nil
+	case bool:
+		return []string{strconv.FormatBool(v)}, nil
+	case float64:
+		return []string{strconv.FormatFloat(v, 'f', -1, 64)}, nil
+	}
+	return nil, fmt.Errorf("want a string, number, boolean or array, got %s", raw)
+}
+
+// debounce returns the debounce interval for the file at path: the
+// -debounce flag if given on the command line, otherwise the file's own
+// setting, otherwise d
+func (c *Config) debounce(path string, d time.Duration) time.Duration {
+	return c.fileDuration(path, "debounce", d, func(fc FileConfig) *Duration { return fc.Debounce })
+}
+
+// debounceMax is like debounce for the -debounce-max flag
+func (c *Config) debounceMax(path string, d time.Duration) time.Duration {
+	return c.fileDuration(path, "debounce-max", d, func(fc FileConfig) *Duration { return fc.DebounceMax })
+}
+
+// maxDelay is like debounce for the -max-delay flag
+func (c *Config) maxDelay(path string, d time.Duration) time.Duration {
+	return c.fileDuration(path, "max-delay", d, func(fc FileConfig) *Duration { return fc.MaxDelay })
+}
+
+func (c *Config) fileDuration(path, flagName string, d time.Duration, get func(FileConfig) *Duration) time.Duration {
+	if c == nil || c.explicit[flagName] {
+		return d
+	}
+	if fc, ok := c.Files[filepath.Clean(path)]; ok && get(fc) != nil {
+		return time.Duration(*get(fc))
+	}
+	return d
+}
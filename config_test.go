@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, body string) *Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestConfigApply(t *testing.T) {
+	c := writeConfig(t, `{
+		"file": "t.txt",
+		"workers": 4,
+		"lean": true,
+		"debounce": "1s",
+		"sink": ["a://x", "b://y"],
+		"files": {"./t.txt": {"debounce": "0s"}, "other.txt": {}}
+	}`)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	file := fs.String("file", "", "")
+	workers := fs.Int("workers", 1, "")
+	lean := fs.Bool("lean", false, "")
+	debounce := fs.Duration("debounce", 500*time.Millisecond, "")
+	var sinks stringList
+	fs.Var(&sinks, "sink", "")
+	if err := fs.Parse([]string{"-workers", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.apply(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	// The command line wins over the config
+	if *file != "t.txt" || *workers != 2 || !*lean || *debounce != time.Second {
+		t.Errorf("file=%q workers=%d lean=%v debounce=%v", *file, *workers, *lean, *debounce)
+	}
+	if len(sinks) != 2 || sinks[1] != "b://y" {
+		t.Errorf("sinks = %v", sinks)
+	}
+
+	// Per-file settings override the config's top level
+	if d := c.debounce("t.txt", *debounce); d != 0 {
+		t.Errorf("t.txt debounce = %v", d)
+	}
+	if d := c.debounce("other.txt", *debounce); d != time.Second {
+		t.Errorf("other.txt debounce = %v", d)
+	}
+	var none *Config
+	if d := none.debounce("t.txt", time.Second); d != time.Second {
+		t.Errorf("no config debounce = %v", d)
+	}
+}
+
+func TestConfigExplicitDebounce(t *testing.T) {
+	c := writeConfig(t, `{"files": {"t.txt": {"debounce": "0s"}}}`)
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	debounce := fs.Duration("debounce", 500*time.Millisecond, "")
+	if err := fs.Parse([]string{"-debounce", "2s"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.apply(fs); err != nil {
+		t.Fatal(err)
+	}
+	if d := c.debounce("t.txt", *debounce); d != 2*time.Second {
+		t.Errorf("debounce = %v, want the command line value", d)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	for body, want := range map[string]string{
+		`{"nope": 1}`:         `unknown option "nope"`,
+		`{"workers": "many"}`: `option "workers"`,
+		`{"workers": {}}`:     `want a string`,
+	} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.Int("workers", 1, "")
+		err := writeConfig(t, body).apply(fs)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: err = %v, want %q", body, err, want)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"files": {"t.txt": {"debounce": 5}}}`), 0o644)
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("numeric debounce accepted")
+	}
+}
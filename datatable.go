@@ -0,0 +1,650 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Chunk represents a single route entry in the routing table
+type Chunk struct {
+	StartLine   int64
+	EndLine     int64
+	Hash        string
+	Data        []byte
+	Destination string
+	// Offset and Length locate the chunk in the file, in bytes
+	Offset int64
+	Length int64
+
+	// src is set on chunks loaded without Data so the body can be read
+	// back from disk on demand
+	src *chunkSource
+}
+
+// LoadOptions controls how chunks are hashed
+type LoadOptions struct {
+	// IgnoreFields lists volatile route fields (e.g. "Age") whose values are
+	// blanked before hashing so they don't cause false-positive changes
+	IgnoreFields []string
+	// Normalize lists the whitespace normalization steps applied to each
+	// line before hashing (see normalizeSteps)
+	Normalize []string
+	// Hash selects the chunk hash algorithm; empty means DefaultHash
+	Hash HashAlgorithm
+	// Lean drops chunk Data after hashing and keeps only hashes and byte
+	// offsets; bodies are read back from the file when needed
+	Lean bool
+	// Chunker selects how the table is split into routes; empty means
+	// ChunkByDestination
+	Chunker string
+	// Incremental keeps a block hash index of the file so DetectChanges
+	// only re-parses the regions that changed
+	Incremental bool
+	// MaxLineBytes is the longest line the table may contain; zero means
+	// DefaultMaxLineBytes
+	MaxLineBytes int
+	// MaxSize, if set, is the largest table file held in memory. Larger
+	// files are loaded lean, or refused with ErrTooLarge if
+	// RefuseOversize is set.
+	MaxSize        int64
+	RefuseOversize bool
+}
+
+// What to do with a table file over LoadOptions.MaxSize
+const (
+	OversizeLean  = "lean"
+	OversizeError = "error"
+)
+
+// DefaultMaxLineBytes is the default line length limit. It is well above
+// bufio.MaxScanTokenSize so single-line exports load without tuning.
+const DefaultMaxLineBytes = 1 << 20
+
+// DataTable manages the routing table file and its chunks
+type DataTable struct {
+	FilePath string
+	Chunks   map[string]*Chunk // key is destination (e.g., "0.0.0.0/0")
+	Options  LoadOptions
+	// Algorithm is the hash algorithm the current Chunks were hashed with
+	Algorithm HashAlgorithm
+	// Volatile, if set, flags chunks that change on every load
+	Volatile *VolatileTracker
+	// Stream identifies the sequence of change sets detected by this
+	// table. Change set IDs and change sequence numbers count up from 1
+	// within a stream, so consumers can deduplicate on (stream, seq) and
+	// treat a new stream as a restart rather than a gap.
+	Stream string
+	// OnProgress, if set, is called every ProgressInterval (or
+	// DefaultProgressInterval) while the file is loaded
+	OnProgress       func(LoadProgress)
+	ProgressInterval time.Duration
+	mu               sync.RWMutex
+
+	ids  atomic.Uint64
+	seqs atomic.Uint64
+
+	// blocks indexes the file contents the chunks were parsed from, for
+	// incremental re-scans
+	blocks *blockIndex
+	// oversize is set when the last load exceeded Options.MaxSize and was
+	// loaded lean
+	oversize bool
+	// digest is the xxhash of the file the chunks were parsed from, for
+	// snapshots; empty if they weren't parsed from the whole file
+	digest string
+	// loading tracks the load in progress, outside mu so it can be read
+	// while the load holds it
+	loading atomic.Pointer[loadTracker]
+}
+
+// NewDataTable creates a new DataTable instance
+func NewDataTable(filePath string) *DataTable {
+	return &DataTable{
+		FilePath: filePath,
+		Chunks:   make(map[string]*Chunk),
+		Stream:   strconv.FormatInt(time.Now().UnixNano(), 36),
+	}
+}
+
+// hashChunk computes SHA256 hash of the chunk data
+func hashChunk(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// hashLines hashes chunk lines after applying the table's normalization, so
+// that volatile fields and layout noise don't affect the result
+func hashLines(lines []string, norm *normalizer, algo HashAlgorithm) string {
+	lh := newLineHasher(norm, algo)
+	for _, line := range lines {
+		lh.add([]byte(line))
+	}
+	return lh.sum()
+}
+
+// lineHasher feeds normalized chunk lines straight into a hash.Hash, with a
+// newline between lines, so chunks are hashed while they are scanned
+// instead of being joined into one string first. It hashes exactly what
+// hashLines would.
+type lineHasher struct {
+	h     hash.Hash
+	norm  *normalizer
+	lines int
+}
+
+func newLineHasher(norm *normalizer, algo HashAlgorithm) *lineHasher {
+	return &lineHasher{h: algo.New(), norm: norm}
+}
+
+// add hashes the next line of the chunk
+func (lh *lineHasher) add(line []byte) {
+	if lh.lines > 0 {
+		lh.h.Write(newline)
+	}
+	lh.lines++
+	if lh.norm.identity() {
+		lh.h.Write(line)
+		return
+	}
+	io.WriteString(lh.h, lh.norm.line(string(line)))
+}
+
+// sum returns the hex encoded hash of the lines added since the last sum
+// and resets the hasher for the next chunk
+func (lh *lineHasher) sum() string {
+	var buf [64]byte
+	s := hex.EncodeToString(lh.h.Sum(buf[:0]))
+	lh.h.Reset()
+	lh.lines = 0
+	return s
+}
+
+var newline = []byte{'\n'}
+
+// LoadDataTable loads the routing table file, chunks it by routes, and hashes each chunk.
+// Files compressed with gzip or zstd are decompressed on the fly. They
+// can't be loaded lean, so Options.Lean is an error for them and content
+// decompressing to more than Options.MaxSize is refused with ErrTooLarge.
+// Cancelling ctx aborts the load and leaves the current chunks in place.
+func (rt *DataTable) LoadDataTable(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "LoadDataTable", "path", rt.FilePath)
+	defer func() {
+		span.SetAttributes("routes", rt.Len())
+		span.End(err)
+	}()
+	file, err := openTable(rt.FilePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	format, err := compression(file)
+	if err != nil {
+		return err
+	}
+	var lean bool
+	if format == "" {
+		if lean, err = rt.leanFor(file); err != nil {
+			return err
+		}
+	} else if rt.Options.Lean {
+		return fmt.Errorf("%s is %s compressed, so chunk bodies can't be read back from it as -lean needs", rt.FilePath, format)
+	}
+	var size int64
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
+	span.SetAttributes("bytes", size, "lean", lean, "compression", format)
+	lt, done := rt.trackLoad(size)
+	defer done()
+	if format == "" {
+		return rt.load(ctx, lt.reader(file), true, lean)
+	}
+
+	// Chunk bodies can't be read back from a compressed file, so it is
+	// always loaded whole, and re-read whole on every change
+	slog.Debug("decompressing table", "path", rt.FilePath, "format", format)
+	r, err := decompress(format, lt.reader(file))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	rt.mu.Lock()
+	rt.oversize = false
+	rt.mu.Unlock()
+	if rt.Options.MaxSize > 0 {
+		return rt.load(ctx, &maxSizeReader{r: r, path: rt.FilePath, max: rt.Options.MaxSize}, false, false)
+	}
+	return rt.load(ctx, r, false, false)
+}
+
+// leanFor reports whether the open table file should be loaded lean: if
+// Options.Lean is set or the file exceeds Options.MaxSize
+func (rt *DataTable) leanFor(file *os.File) (bool, error) {
+	if rt.Options.MaxSize <= 0 {
+		return rt.Options.Lean, nil
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to stat file: %w", err)
+	}
+	over := info.Size() > rt.Options.MaxSize
+	if over && rt.Options.RefuseOversize {
+		return false, fmt.Errorf("%s is %d bytes, over the %d byte limit: %w", rt.FilePath, info.Size(), rt.Options.MaxSize, ErrTooLarge)
+	}
+	rt.mu.Lock()
+	rt.oversize = over
+	rt.mu.Unlock()
+	return rt.Options.Lean || over, nil
+}
+
+// Len returns the number of routes in the table
+func (rt *DataTable) Len() int {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return len(rt.Chunks)
+}
+
+// Oversize reports whether the table file exceeded Options.MaxSize when it
+// was last loaded, so only hashes and offsets are held in memory
+func (rt *DataTable) Oversize() bool {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.oversize
+}
+
+// openTable opens a table file, classifying a missing file as
+// ErrFileMissing
+func openTable(path string) (*os.File, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to open file: %w: %w", ErrFileMissing, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	return file, nil
+}
+
+// LoadFrom reads a routing table from r, replacing the current chunks.
+// Lean mode is ignored because there is no file to read bodies back from.
+func (rt *DataTable) LoadFrom(ctx context.Context, r io.Reader) error {
+	return rt.load(ctx, r, false, false)
+}
+
+// load chunks and hashes the table read from r. fromFile says r is the
+// table file itself, which lean mode and incremental re-scans rely on;
+// lean drops chunk bodies.
+func (rt *DataTable) load(ctx context.Context, r io.Reader, fromFile, lean bool) error {
+	start := time.Now()
+	r = contextReader{ctx, r}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	ck, err := rt.newChunker(fromFile && lean)
+	if err != nil {
+		return err
+	}
+
+	var blocks *blockIndexer
+	if fromFile && rt.Options.Incremental {
+		blocks = newBlockIndexer()
+		r = io.TeeReader(r, blocks)
+	}
+	var digest *xxhash.Digest
+	if fromFile {
+		digest = xxhash.New()
+		r = io.TeeReader(r, digest)
+	}
+
+	chunks := make(map[string]*Chunk)
+	lt := rt.loading.Load()
+	emit := func(c *Chunk) {
+		chunks[c.Destination] = c
+		if lt != nil {
+			lt.chunks.Add(1)
+		}
+	}
+	if _, err := ck.parse(r, 0, 0, emit); err != nil {
+		return err
+	}
+
+	rt.Chunks = chunks
+	rt.Algorithm = ck.algo
+	rt.blocks = nil
+	if blocks != nil {
+		rt.blocks = blocks.index()
+	}
+	rt.digest = ""
+	if digest != nil {
+		rt.digest = fmt.Sprintf("%016x", digest.Sum64())
+	}
+	metrics.Counter("chunks_loaded_total", "Chunks parsed from tables, on every load and reload", "path", rt.FilePath).Add(int64(len(chunks)))
+	metrics.Histogram("table_load_seconds", "Time taken to read, chunk and hash a table", DurationBuckets, "path", rt.FilePath).ObserveDuration(time.Since(start))
+	slog.Debug("parsed table", "path", rt.FilePath, "routes", len(chunks), "chunker", ck.mode, "hash", ck.algo, "lean", ck.src != nil)
+	return nil
+}
+
+// newChunker returns a chunker configured from the table's options
+func (rt *DataTable) newChunker(lean bool) (*chunker, error) {
+	norm, err := newNormalizer(rt.Options)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := parseChunker(rt.Options.Chunker)
+	if err != nil {
+		return nil, err
+	}
+	ck := &chunker{path: rt.FilePath, mode: mode, norm: norm, algo: rt.Options.Hash.orDefault(), maxLine: rt.Options.MaxLineBytes}
+	if ck.maxLine <= 0 {
+		ck.maxLine = DefaultMaxLineBytes
+	}
+	if lean {
+		ck.src = &chunkSource{path: rt.FilePath, norm: norm, algo: ck.algo}
+	}
+	return ck, nil
+}
+
+// Chunking strategies
+const (
+	// ChunkByDestination starts a chunk at every "Destination:" line, as in
+	// Huawei-style "display ip routing-table verbose" dumps
+	ChunkByDestination = "destination"
+	// ChunkByLine starts a chunk at every line that isn't indented and keys
+	// it by the line's first word; indented lines continue the chunk. This
+	// suits one-route-per-line tables like "ip route" or "show ip route".
+	ChunkByLine = "line"
+)
+
+// chunkers lists the supported chunking strategies
+var chunkers = []string{ChunkByDestination, ChunkByLine}
+
+// parseChunker validates a -chunker value
+func parseChunker(s string) (string, error) {
+	if s == "" {
+		return ChunkByDestination, nil
+	}
+	if !slices.Contains(chunkers, s) {
+		return "", fmt.Errorf("unknown chunker %q (want %s)", s, strings.Join(chunkers, " or "))
+	}
+	return s, nil
+}
+
+// chunker splits a routing table into per-route chunks and hashes them
+type chunker struct {
+	// path names the table in parse errors
+	path    string
+	mode    string
+	norm    *normalizer
+	algo    HashAlgorithm
+	maxLine int
+	// src, when set, makes chunks lean: Data is dropped and read back
+	// through src on demand
+	src *chunkSource
+}
+
+// parse reads the table from r and calls emit for every chunk. offset and
+// lineNum give the byte offset and the number of lines preceding r in the
+// file, so that chunks parsed from the middle of a file get absolute
+// positions. It returns the number of lines read.
+func (ck *chunker) parse(r io.Reader, offset, lineNum int64, emit func(*Chunk)) (int64, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, min(ck.maxLine, bufio.MaxScanTokenSize)), ck.maxLine)
+	// Track byte offsets alongside the scanner: lineOffset is where the
+	// current line starts and consumed is where the next one will
+	consumed, lineOffset, chunkEnd := offset, offset, offset
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if token != nil {
+			lineOffset = consumed
+			consumed += int64(advance)
+		}
+		return advance, token, err
+	})
+
+	firstLine := lineNum
+	var currentChunk *Chunk
+	hasher := newLineHasher(ck.norm, ck.algo)
+	// data collects the raw chunk for non-lean loads; it is reused between
+	// chunks and copied out once per chunk
+	var data []byte
+
+	addLine := func(line []byte) {
+		hasher.add(line)
+		if ck.src == nil {
+			if len(data) > 0 {
+				data = append(data, '\n')
+			}
+			data = append(data, line...)
+		}
+		chunkEnd = lineOffset + int64(len(line))
+	}
+	saveChunk := func(endLine int64) {
+		if ck.src == nil {
+			currentChunk.Data = append([]byte(nil), data...)
+			data = data[:0]
+		}
+		currentChunk.src = ck.src
+		currentChunk.Hash = hasher.sum()
+		currentChunk.EndLine = endLine
+		currentChunk.Length = chunkEnd - currentChunk.Offset
+		emit(currentChunk)
+	}
+
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Bytes()
+
+		// Check if this line starts a new route
+		if currentDestination, ok := ck.startsChunk(line, lineNum); ok {
+			// Save previous chunk if exists
+			if currentChunk != nil {
+				saveChunk(lineNum - 1)
+			}
+
+			// Start new chunk
+			currentChunk = &Chunk{
+				StartLine:   lineNum,
+				Destination: currentDestination,
+				Offset:      lineOffset,
+			}
+			addLine(line)
+		} else if currentChunk != nil {
+			// Add line to current chunk
+			addLine(line)
+
+			// If we hit a blank line after some content, it might be end of route
+			// But we'll continue until the next route starts to be safe
+		}
+	}
+
+	// Save last chunk
+	if currentChunk != nil {
+		saveChunk(lineNum)
+	}
+
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return lineNum - firstLine, &ParseError{
+				Path: ck.path,
+				Line: lineNum + 1,
+				Err:  fmt.Errorf("line is longer than %d bytes (raise -max-line-bytes): %w: %w", ck.maxLine, ErrTooLarge, err),
+			}
+		}
+		return lineNum - firstLine, fmt.Errorf("error reading file: %w", err)
+	}
+	return lineNum - firstLine, nil
+}
+
+// startsChunk reports whether line begins a new route and returns the
+// route's destination
+func (ck *chunker) startsChunk(line []byte, lineNum int64) (string, bool) {
+	switch ck.mode {
+	case ChunkByLine:
+		if len(line) == 0 || line[0] == ' ' || line[0] == '\t' {
+			return "", false
+		}
+		fields := bytes.Fields(line)
+		if len(fields) == 0 {
+			return "", false
+		}
+		return string(fields[0]), true
+	default:
+		if !bytes.HasPrefix(line, destinationPrefix) {
+			return "", false
+		}
+		// Extract destination from line (e.g., "Destination: 0.0.0.0/0")
+		parts := bytes.Fields(line)
+		if len(parts) >= 2 {
+			return string(parts[1]), true
+		}
+		return fmt.Sprintf("unknown_%d", lineNum), true
+	}
+}
+
+var destinationPrefix = []byte("Destination:")
+
+// DetectChanges re-hashes chunks and returns the set of changed routes.
+// Cancelling ctx aborts the reload and leaves the current chunks in place.
+func (rt *DataTable) DetectChanges(ctx context.Context) (cs *ChangeSet, err error) {
+	ctx, span := startSpan(ctx, "DetectChanges", "path", rt.FilePath)
+	defer func() { endDetectSpan(span, cs, err) }()
+	if rt.Options.Incremental {
+		var ok bool
+		if cs, ok, err = rt.detectIncremental(ctx); ok || err != nil {
+			span.SetAttributes("incremental", true)
+			return cs, err
+		}
+	}
+	return rt.detectFull(ctx)
+}
+
+// DetectChangesFull is DetectChanges without the incremental shortcut: the
+// whole file is re-chunked, rebuilding the block index
+func (rt *DataTable) DetectChangesFull(ctx context.Context) (cs *ChangeSet, err error) {
+	ctx, span := startSpan(ctx, "DetectChanges", "path", rt.FilePath, "full", true)
+	defer func() { endDetectSpan(span, cs, err) }()
+	return rt.detectFull(ctx)
+}
+
+func (rt *DataTable) detectFull(ctx context.Context) (*ChangeSet, error) {
+	return rt.detect(func(tempRT *DataTable) error {
+		return tempRT.LoadDataTable(ctx)
+	})
+}
+
+// endDetectSpan ends the span of a detection with what it found
+func endDetectSpan(span *Span, cs *ChangeSet, err error) {
+	if cs != nil {
+		span.SetAttributes("changeset.id", cs.ID, "changes", cs.Len(), "routes", cs.Routes)
+	}
+	span.End(err)
+}
+
+// DetectChangesFrom compares the table read from r with the current chunks,
+// then makes it the current state
+func (rt *DataTable) DetectChangesFrom(ctx context.Context, r io.Reader) (*ChangeSet, error) {
+	return rt.detect(func(tempRT *DataTable) error {
+		return tempRT.LoadFrom(ctx, r)
+	})
+}
+
+// detect loads a new state of the table with load and diffs it against the
+// current chunks
+func (rt *DataTable) detect(load func(tempRT *DataTable) error) (*ChangeSet, error) {
+	rt.mu.RLock()
+	oldChunks := make(map[string]*Chunk)
+	for k, v := range rt.Chunks {
+		oldChunks[k] = v
+	}
+	oldAlgo := rt.Algorithm
+	rt.mu.RUnlock()
+
+	// Create temporary routing table to load new state
+	tempRT := NewDataTable(rt.FilePath)
+	tempRT.Options = rt.Options
+	if err := load(tempRT); err != nil {
+		return nil, fmt.Errorf("failed to reload routing table: %w", err)
+	}
+	if oldAlgo != "" && oldAlgo != tempRT.Algorithm {
+		return nil, fmt.Errorf("cannot compare %s hashes with %s hashes; reload the table instead", oldAlgo, tempRT.Algorithm)
+	}
+
+	cs := &ChangeSet{
+		Path:    rt.FilePath,
+		Time:    time.Now(),
+		Changes: diffChunks(oldChunks, tempRT.Chunks),
+		Routes:  len(tempRT.Chunks),
+	}
+	rt.observe(cs)
+
+	// Update our chunks with new state
+	rt.mu.Lock()
+	rt.Chunks = tempRT.Chunks
+	rt.blocks = tempRT.blocks
+	rt.oversize = tempRT.oversize
+	rt.digest = tempRT.digest
+	rt.mu.Unlock()
+
+	return cs, nil
+}
+
+// observe finishes a detected change set: volatile changes are flagged,
+// the set gets the next changeset ID, and each notifiable change gets the
+// next sequence number. Volatile changes are never delivered, so they get
+// no sequence number and leave no gaps.
+func (rt *DataTable) observe(cs *ChangeSet) {
+	if rt.Volatile != nil {
+		rt.Volatile.Observe(cs)
+	}
+	cs.Stream = rt.Stream
+	cs.ID = rt.ids.Add(1)
+	for i := range cs.Changes {
+		if !cs.Changes[i].Volatile {
+			cs.Changes[i].Seq = rt.seqs.Add(1)
+		}
+	}
+}
+
+// DiffReaders chunks two routing tables read from old and new with the
+// default options and returns the routes that differ between them
+func DiffReaders(ctx context.Context, old, new io.Reader) (*ChangeSet, error) {
+	rt := NewDataTable("")
+	if err := rt.LoadFrom(ctx, old); err != nil {
+		return nil, fmt.Errorf("failed to load old table: %w", err)
+	}
+	return rt.DetectChangesFrom(ctx, new)
+}
+
+// contextReader fails reads once ctx is done, so that a long load stops
+// at the next read instead of running to the end of the file
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
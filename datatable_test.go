@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLoadFrom(t *testing.T) {
+	rt := NewDataTable("")
+	table := routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1") + "\n" + routeBlock("0.0.0.0/0", "Static", "172.31.0.254")
+	if err := rt.LoadFrom(context.Background(), strings.NewReader(table)); err != nil {
+		t.Fatal(err)
+	}
+	if len(rt.Chunks) != 2 {
+		t.Fatalf("loaded %d chunks", len(rt.Chunks))
+	}
+	c := rt.Chunks["0.0.0.0/0"]
+	if c.StartLine != 6 || c.EndLine != 10 {
+		t.Errorf("lines %d-%d", c.StartLine, c.EndLine)
+	}
+	if got := table[c.Offset : c.Offset+c.Length]; got != string(c.Data) {
+		t.Errorf("offsets select %q, data is %q", got, c.Data)
+	}
+
+	// Loading again replaces the chunks rather than merging
+	if err := rt.LoadFrom(context.Background(), strings.NewReader(routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))); err != nil {
+		t.Fatal(err)
+	}
+	if len(rt.Chunks) != 1 {
+		t.Errorf("reload left %d chunks", len(rt.Chunks))
+	}
+}
+
+func TestDiffReaders(t *testing.T) {
+	old := strings.Join([]string{
+		routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"),
+		routeBlock("0.0.0.0/0", "Static", "172.31.0.254"),
+	}, "\n")
+	new := strings.Join([]string{
+		routeBlock("10.0.0.0/8", "IBGP", "172.31.0.2"),
+		routeBlock("192.168.0.0/16", "OSPF", "172.31.0.3"),
+	}, "\n")
+
+	cs, err := DiffReaders(context.Background(), strings.NewReader(old), strings.NewReader(new))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]ChangeType{
+		"0.0.0.0/0":      ChangeRemoved,
+		"10.0.0.0/8":     ChangeModified,
+		"192.168.0.0/16": ChangeAdded,
+	}
+	if cs.Len() != len(want) {
+		t.Fatalf("changes = %+v", cs.Changes)
+	}
+	for _, c := range cs.Changes {
+		if want[c.Destination] != c.Type {
+			t.Errorf("%s: %s, want %s", c.Destination, c.Type, want[c.Destination])
+		}
+	}
+}
+
+func TestLineChunker(t *testing.T) {
+	rt := NewDataTable("")
+	rt.Options.Chunker = ChunkByLine
+	table := `default via 172.31.0.254 dev eth0 proto static
+10.0.0.0/8 proto bgp metric 20
+	nexthop via 172.31.0.1 dev eth1 weight 1
+	nexthop via 172.31.0.2 dev eth2 weight 1
+192.168.0.0/16 via 172.31.0.3 dev eth0 proto ospf
+`
+	if err := rt.LoadFrom(context.Background(), strings.NewReader(table)); err != nil {
+		t.Fatal(err)
+	}
+	if len(rt.Chunks) != 3 {
+		t.Fatalf("loaded %d chunks", len(rt.Chunks))
+	}
+	c := rt.Chunks["10.0.0.0/8"]
+	if c == nil || c.StartLine != 2 || c.EndLine != 4 {
+		t.Fatalf("multipath route = %+v", c)
+	}
+
+	if _, err := parseChunker("paragraph"); err == nil {
+		t.Error("unknown chunker accepted")
+	}
+}
+
+func TestGenerateTable(t *testing.T) {
+	for _, ck := range chunkers {
+		var a, b strings.Builder
+		if err := generateTable(&a, 300, ck, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := generateTable(&b, 300, ck, 1); err != nil {
+			t.Fatal(err)
+		}
+		rt := NewDataTable("")
+		rt.Options.Chunker = ck
+		if err := rt.LoadFrom(context.Background(), strings.NewReader(a.String())); err != nil {
+			t.Fatal(err)
+		}
+		if len(rt.Chunks) != 300 {
+			t.Errorf("%s: generated %d routes", ck, len(rt.Chunks))
+		}
+		cs, err := rt.DetectChangesFrom(context.Background(), strings.NewReader(b.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cs.Len() != 1 || cs.Changes[0].Type != ChangeModified {
+			t.Errorf("%s: variants differ by %+v", ck, cs.Changes)
+		}
+	}
+}
+
+func TestMaxLineBytes(t *testing.T) {
+	long := routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1") + "\n   Communities: " + strings.Repeat("65000:1 ", 20000)
+	rt := NewDataTable("")
+	if err := rt.LoadFrom(context.Background(), strings.NewReader(long)); err != nil {
+		t.Fatalf("default limit rejected a %d byte line: %v", len(long), err)
+	}
+	if len(rt.Chunks) != 1 {
+		t.Fatalf("loaded %d chunks", len(rt.Chunks))
+	}
+
+	rt.Options.MaxLineBytes = 1024
+	err := rt.LoadFrom(context.Background(), strings.NewReader(long))
+	if err == nil || !strings.Contains(err.Error(), "line 6") {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestLoadCancelled(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	rt := loadTable(t, path)
+	rewriteFile(t, path, "172.31.0.1", "172.31.0.2")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := rt.LoadDataTable(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("load err = %v", err)
+	}
+	for _, incremental := range []bool{false, true} {
+		rt.Options.Incremental = incremental
+		if _, err := rt.DetectChanges(ctx); !errors.Is(err, context.Canceled) {
+			t.Fatalf("incremental=%v: detect err = %v", incremental, err)
+		}
+	}
+	if c := rt.Chunks["10.0.0.0/8"]; c == nil || !strings.Contains(string(c.Data), "172.31.0.1") {
+		t.Errorf("cancelled reload replaced the chunks: %+v", c)
+	}
+}
+
+func TestChangeSetSequence(t *testing.T) {
+	for _, incremental := range []bool{false, true} {
+		path := writeTable(t,
+			routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"),
+			routeBlock("0.0.0.0/0", "Static", "172.31.0.254"),
+		)
+		rt := NewDataTable(path)
+		rt.Options.Incremental = incremental
+		if err := rt.LoadDataTable(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		var seqs []uint64
+		for i, edit := range [][2]string{
+			{"172.31.0.1", "172.31.0.2"},
+			{"x", "x"},
+			{"172.31.0.2", "172.31.0.3"},
+			{"172.31.0.254", "172.31.0.253"},
+		} {
+			rewriteFile(t, path, edit[0], edit[1])
+			cs, err := rt.DetectChanges(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cs.ID != uint64(i+1) || cs.Stream != rt.Stream {
+				t.Errorf("incremental=%v: run %d has ID %s/%d", incremental, i, cs.Stream, cs.ID)
+			}
+			for _, c := range cs.Changes {
+				seqs = append(seqs, c.Seq)
+			}
+		}
+		// Runs without changes get an ID but use no sequence numbers, so
+		// the sequence has no gaps
+		want := []uint64{1, 2, 3}
+		if len(seqs) != len(want) {
+			t.Fatalf("incremental=%v: seqs = %v, want %v", incremental, seqs, want)
+		}
+		for i := range want {
+			if seqs[i] != want[i] {
+				t.Errorf("incremental=%v: seqs = %v, want %v", incremental, seqs, want)
+			}
+		}
+	}
+}
+
+func TestChangeSetMergeSequence(t *testing.T) {
+	cs := &ChangeSet{ID: 1, Changes: []Change{
+		{Seq: 1, Type: ChangeAdded, Destination: "10.1.0.0/16", NewHash: "a"},
+		{Seq: 2, Type: ChangeModified, Destination: "10.2.0.0/16", OldHash: "a", NewHash: "b"},
+	}}
+	cs.merge(&ChangeSet{ID: 2, Changes: []Change{
+		{Seq: 3, Type: ChangeRemoved, Destination: "10.1.0.0/16", OldHash: "a"},
+		{Seq: 4, Type: ChangeModified, Destination: "10.2.0.0/16", OldHash: "b", NewHash: "c"},
+	}})
+	cs.merge(&ChangeSet{ID: 3, Changes: []Change{
+		{Seq: 5, Type: ChangeModified, Destination: "10.2.0.0/16", OldHash: "c", NewHash: "d"},
+	}})
+
+	if cs.ID != 3 || len(cs.MergedIDs) != 2 || cs.MergedIDs[0] != 1 || cs.MergedIDs[1] != 2 {
+		t.Errorf("ID %d, merged %v", cs.ID, cs.MergedIDs)
+	}
+	if len(cs.Changes) != 1 {
+		t.Fatalf("changes = %+v", cs.Changes)
+	}
+	if c := cs.Changes[0]; c.Seq != 5 || len(c.Coalesced) != 2 || c.Coalesced[0] != 2 || c.Coalesced[1] != 4 {
+		t.Errorf("seq %d, coalesced %v", c.Seq, c.Coalesced)
+	}
+	if len(cs.Cancelled) != 2 || cs.Cancelled[0] != 1 || cs.Cancelled[1] != 3 {
+		t.Errorf("cancelled = %v", cs.Cancelled)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// FieldChange is one route field whose value differs between two versions
+// of a chunk. Old or New is empty if the field was added or removed.
+type FieldChange struct {
+	Name string `json:"name"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+}
+
+// Diff renderings
+const (
+	DiffNone       = "none"
+	DiffFields     = "fields"
+	DiffUnified    = "unified"
+	DiffSideBySide = "side-by-side"
+)
+
+// diffContext is the number of unchanged lines shown around each hunk of a
+// unified diff
+const diffContext = 3
+
+// DiffRenderer renders unified and field diffs of changes. Lines and
+// fields are compared after the table's normalization, so differences in
+// ignored fields or whitespace don't show up as changes, which keeps a
+// rendering valid for every chunk pair with the same hashes. Renderings
+// are cached by hash pair because reports, sinks and the UI tend to render
+// the same diff repeatedly.
+type DiffRenderer struct {
+	norm  *normalizer
+	cache *DiffCache
+}
+
+// NewDiffRenderer creates a renderer for tables loaded with opts, caching
+// up to cacheSize renderings (0 disables the cache)
+func NewDiffRenderer(opts LoadOptions, cacheSize int) (*DiffRenderer, error) {
+	norm, err := newNormalizer(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &DiffRenderer{norm: norm, cache: NewDiffCache(cacheSize)}, nil
+}
+
+// Unified returns a unified diff of the old and new chunk of c
+func (r *DiffRenderer) Unified(c *Change) (string, error) {
+	key := diffKey{DiffUnified, c.OldHash, c.NewHash}
+	if v, ok := r.cache.get(key); ok {
+		return v.(string), nil
+	}
+	a, b, err := changeLines(c)
+	if err != nil {
+		return "", err
+	}
+	out := r.unified("old/"+c.Destination, "new/"+c.Destination, a, b)
+	r.cache.put(key, out)
+	return out, nil
+}
+
+// SideBySide returns the old and new chunk of c in two columns. The gutter
+// between them marks changed lines with "|", and lines only on one side
+// with "<" or ">". Under each changed pair, carets point out the values of
+// the fields that differ.
+func (r *DiffRenderer) SideBySide(c *Change) (string, error) {
+	key := diffKey{DiffSideBySide, c.OldHash, c.NewHash}
+	if v, ok := r.cache.get(key); ok {
+		return v.(string), nil
+	}
+	a, b, err := changeLines(c)
+	if err != nil {
+		return "", err
+	}
+	out := r.sideBySide("old/"+c.Destination, "new/"+c.Destination, a, b)
+	r.cache.put(key, out)
+	return out, nil
+}
+
+// Fields returns the fields whose values differ between the old and new
+// chunk of c, in the order they appear in the chunk
+func (r *DiffRenderer) Fields(c *Change) ([]FieldChange, error) {
+	key := diffKey{DiffFields, c.OldHash, c.NewHash}
+	if v, ok := r.cache.get(key); ok {
+		return v.([]FieldChange), nil
+	}
+	a, b, err := changeLines(c)
+	if err != nil {
+		return nil, err
+	}
+	out := r.fields(a, b)
+	r.cache.put(key, out)
+	return out, nil
+}
+
+// changeLines returns the lines of the old and new chunk of c
+func changeLines(c *Change) (a, b []string, err error) {
+	for _, side := range []struct {
+		chunk *Chunk
+		lines *[]string
+	}{{c.Old, &a}, {c.New, &b}} {
+		if side.chunk == nil {
+			continue
+		}
+		data, err := side.chunk.Content()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s: %w", c.Destination, err)
+		}
+		*side.lines = strings.Split(string(data), "\n")
+	}
+	return a, b, nil
+}
+
+// fields diffs the fields found in two versions of a chunk
+func (r *DiffRenderer) fields(a, b []string) []FieldChange {
+	oldValues := make(map[string]string)
+	var names []string
+	seen := make(map[string]bool)
+	collect := func(lines []string, into map[string]string) {
+		for _, line := range lines {
+			for _, f := range parseFields(line) {
+				if r.norm.ignore.has(f.Name) {
+					continue
+				}
+				into[f.Name] = f.Value
+				if !seen[f.Name] {
+					seen[f.Name] = true
+					names = append(names, f.Name)
+				}
+			}
+		}
+	}
+	newValues := make(map[string]string)
+	collect(a, oldValues)
+	collect(b, newValues)
+
+	var out []FieldChange
+	for _, name := range names {
+		o, n := oldValues[name], newValues[name]
+		if r.norm.line(o) != r.norm.line(n) {
+			out = append(out, FieldChange{Name: name, Old: o, New: n})
+		}
+	}
+	return out
+}
+
+// unified renders a unified diff of a and b
+func (r *DiffRenderer) unified(oldName, newName string, a, b []string) string {
+	ops := diffLines(a, b, func(i, j int) bool { return r.norm.line(a[i]) == r.norm.line(b[j]) })
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", oldName, newName)
+	for start := 0; start < len(ops); {
+		// Find the next change and the extent of its hunk
+		for start < len(ops) && ops[start].kind == ' ' {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+		end := start
+		for k := start; k < len(ops); k++ {
+			if ops[k].kind != ' ' {
+				end = k + 1
+			} else if k-end >= 2*diffContext {
+				break
+			}
+		}
+		lo := max(start-diffContext, 0)
+		hi := min(end+diffContext, len(ops))
+
+		oldStart, newStart := ops[lo].i, ops[lo].j
+		oldCount, newCount := 0, 0
+		for _, op := range ops[lo:hi] {
+			if op.kind != '+' {
+				oldCount++
+			}
+			if op.kind != '-' {
+				newCount++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(oldStart, oldCount), hunkRange(newStart, newCount))
+		for _, op := range ops[lo:hi] {
+			switch op.kind {
+			case '-':
+				fmt.Fprintf(&sb, "-%s\n", a[op.i])
+			default:
+				fmt.Fprintf(&sb, "%c%s\n", op.kind, b[op.j])
+			}
+		}
+		start = hi
+	}
+	return sb.String()
+}
+
+// sideRow is one row of a side-by-side diff
+type sideRow struct {
+	left, right string
+	gutter      byte
+}
+
+// sideBySide renders a and b in two columns
+func (r *DiffRenderer) sideBySide(oldName, newName string, a, b []string) string {
+	ops := diffLines(a, b, func(i, j int) bool { return r.norm.line(a[i]) == r.norm.line(b[j]) })
+
+	// Pair each run of deleted lines with the inserted lines that follow
+	rows := []sideRow{{oldName, newName, ' '}}
+	var dels, ins []string
+	flush := func() {
+		for k := 0; k < max(len(dels), len(ins)); k++ {
+			switch {
+			case k >= len(ins):
+				rows = append(rows, sideRow{dels[k], "", '<'})
+			case k >= len(dels):
+				rows = append(rows, sideRow{"", ins[k], '>'})
+			default:
+				rows = append(rows, sideRow{dels[k], ins[k], '|'})
+			}
+		}
+		dels, ins = nil, nil
+	}
+	for _, op := range ops {
+		switch op.kind {
+		case '-':
+			dels = append(dels, a[op.i])
+		case '+':
+			ins = append(ins, b[op.j])
+		default:
+			flush()
+			rows = append(rows, sideRow{a[op.i], b[op.j], ' '})
+		}
+	}
+	flush()
+
+	width := 0
+	for _, row := range rows {
+		width = max(width, len(row.left))
+	}
+	var sb strings.Builder
+	for _, row := range rows {
+		line := fmt.Sprintf("%-*s %c %s", width, row.left, row.gutter, row.right)
+		sb.WriteString(strings.TrimRight(line, " "))
+		sb.WriteByte('\n')
+		if row.gutter != '|' {
+			continue
+		}
+		left, right := r.changedValues(row.left, row.right)
+		if marks := strings.TrimRight(fmt.Sprintf("%-*s   %s", width, left, right), " "); marks != "" {
+			sb.WriteString(marks)
+			sb.WriteByte('\n')
+		}
+	}
+	return sb.String()
+}
+
+// changedValues returns lines of carets under the values of the fields
+// that differ between two versions of a line
+func (r *DiffRenderer) changedValues(a, b string) (string, string) {
+	oldFields, newFields := parseFields(a), parseFields(b)
+	oldValues := make(map[string]string, len(oldFields))
+	for _, f := range oldFields {
+		oldValues[f.Name] = f.Value
+	}
+	newValues := make(map[string]string, len(newFields))
+	for _, f := range newFields {
+		newValues[f.Name] = f.Value
+	}
+	changed := func(name string) bool {
+		return !r.norm.ignore.has(name) && r.norm.line(oldValues[name]) != r.norm.line(newValues[name])
+	}
+	carets := func(line string, fields []Field) string {
+		marks := []byte(strings.Repeat(" ", len(line)))
+		for _, f := range fields {
+			if changed(f.Name) {
+				for k := f.valueStart; k < f.valueEnd; k++ {
+					marks[k] = '^'
+				}
+			}
+		}
+		return string(marks)
+	}
+	return carets(a, oldFields), carets(b, newFields)
+}
+
+// hunkRange formats the start,count of a hunk header; start is 0-based
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// diffOp is one line of an edit script: ' ' keeps a[i] (as b[j]), '-'
+// deletes a[i] and '+' inserts b[j]. i and j are the positions in a and b
+// at which the op applies.
+type diffOp struct {
+	kind byte
+	i, j int
+}
+
+// diffLines computes an edit script turning a into b from their longest
+// common subsequence. Chunks are a handful of lines, so the quadratic
+// table is cheap.
+func diffLines(a, b []string, equal func(i, j int) bool) []diffOp {
+	n, m := len(a), len(b)
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if equal(i, j) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	ops := make([]diffOp, 0, n+m)
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && equal(i, j):
+			ops = append(ops, diffOp{' ', i, j})
+			i++
+			j++
+		case j < m && (i == n || lcs[i][j+1] > lcs[i+1][j]):
+			ops = append(ops, diffOp{'+', i, j})
+			j++
+		default:
+			ops = append(ops, diffOp{'-', i, j})
+			i++
+		}
+	}
+	return ops
+}
+
+// diffKey identifies a cached rendering
+type diffKey struct {
+	kind    string
+	oldHash string
+	newHash string
+}
+
+// DiffCache is an LRU cache of rendered diffs
+type DiffCache struct {
+	size int
+
+	mu      sync.Mutex
+	order   *list.List // front is most recently used
+	entries map[diffKey]*list.Element
+}
+
+type diffEntry struct {
+	key   diffKey
+	value any
+}
+
+// NewDiffCache creates a cache holding up to size renderings; a size of
+// zero or less caches nothing
+func NewDiffCache(size int) *DiffCache {
+	return &DiffCache{size: size, order: list.New(), entries: make(map[diffKey]*list.Element)}
+}
+
+func (c *DiffCache) get(key diffKey) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		metrics.Counter("diff_cache_hits_total", "Diff renderings served from the cache", "kind", key.kind).Inc()
+		return e.Value.(*diffEntry).value, true
+	}
+	metrics.Counter("diff_cache_misses_total", "Diff renderings not found in the cache", "kind", key.kind).Inc()
+	return nil, false
+}
+
+func (c *DiffCache) put(key diffKey, value any) {
+	if c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*diffEntry).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&diffEntry{key, value})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*diffEntry).key)
+		metrics.Counter("diff_cache_evictions_total", "Diff renderings evicted to stay within the size limit").Inc()
+	}
+	metrics.Gauge("diff_cache_entries", "Diff renderings in the cache").Set(int64(c.order.Len()))
+}
+
+// Len returns the number of cached renderings
+func (c *DiffCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
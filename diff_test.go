@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// modifiedChange builds a Change between two versions of a route block
+func modifiedChange(t *testing.T, old, new string) *Change {
+	t.Helper()
+	oc := &Chunk{Data: []byte(old), Hash: HashSHA256.Sum([]byte(old))}
+	nc := &Chunk{Data: []byte(new), Hash: HashSHA256.Sum([]byte(new))}
+	return &Change{Type: ChangeModified, Destination: "10.0.0.0/8", OldHash: oc.Hash, NewHash: nc.Hash, Old: oc, New: nc}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	r, err := NewDiffRenderer(LoadOptions{IgnoreFields: []string{"Age"}}, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1")
+	new := strings.Replace(routeBlock("10.0.0.0/8", "IBGP", "172.31.0.2"), "27d02h01m21s", "27d02h01m22s", 1)
+	diff, err := r.Unified(modifiedChange(t, old, new))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `--- old/10.0.0.0/8
++++ new/10.0.0.0/8
+@@ -1,5 +1,5 @@
+ Destination: 10.0.0.0/8
+      Protocol: IBGP               Process ID: 0
+    Preference: 255                      Cost: 0
+-      NextHop: 172.31.0.1      Neighbour: 172.31.0.1
++      NextHop: 172.31.0.2      Neighbour: 172.31.0.2
+         State: Active Adv Relied         Age: 27d02h01m22s
+`
+	if diff != want {
+		t.Errorf("diff:\n%s\nwant:\n%s", diff, want)
+	}
+
+	added := &Change{Type: ChangeAdded, Destination: "10.0.0.0/8", NewHash: "x", New: &Chunk{Data: []byte("a\nb")}}
+	if diff, _ := r.Unified(added); !strings.Contains(diff, "@@ -0,0 +1,2 @@\n+a\n+b\n") {
+		t.Errorf("added route diff:\n%s", diff)
+	}
+}
+
+func TestUnifiedDiffHunks(t *testing.T) {
+	r, _ := NewDiffRenderer(LoadOptions{}, 0)
+	var a, b []string
+	for i := 0; i < 20; i++ {
+		a = append(a, string(rune('a'+i)))
+	}
+	b = append(b, a...)
+	b[1], b[18] = "B", "S"
+	diff := r.unified("old", "new", a, b)
+	if n := strings.Count(diff, "@@ -"); n != 2 {
+		t.Errorf("%d hunks:\n%s", n, diff)
+	}
+	if !strings.Contains(diff, "@@ -1,5 +1,5 @@") || !strings.Contains(diff, "@@ -16,5 +16,5 @@") {
+		t.Errorf("hunk headers:\n%s", diff)
+	}
+}
+
+func TestFieldDiff(t *testing.T) {
+	r, _ := NewDiffRenderer(LoadOptions{IgnoreFields: []string{"Age"}}, 8)
+	old := routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1")
+	new := strings.Replace(routeBlock("10.0.0.0/8", "OSPF", "172.31.0.1"), "27d02h01m21s", "1h", 1)
+	fields, err := r.Fields(modifiedChange(t, old, new))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 1 || fields[0] != (FieldChange{Name: "Protocol", Old: "IBGP", New: "OSPF"}) {
+		t.Errorf("fields = %+v", fields)
+	}
+}
+
+func TestDiffCache(t *testing.T) {
+	r, _ := NewDiffRenderer(LoadOptions{}, 2)
+	hits := metrics.Counter("diff_cache_hits_total", "", "kind", DiffUnified)
+	base := hits.Value()
+
+	c1 := modifiedChange(t, "a", "b")
+	c2 := modifiedChange(t, "a", "c")
+	c3 := modifiedChange(t, "a", "d")
+	first, _ := r.Unified(c1)
+	// Same hashes with no chunk bodies must come from the cache
+	again, err := r.Unified(&Change{Type: ChangeModified, Destination: "10.0.0.0/8", OldHash: c1.OldHash, NewHash: c1.NewHash})
+	if err != nil || again != first || hits.Value() != base+1 {
+		t.Fatalf("cached diff = %q, %v (hits %d)", again, err, hits.Value()-base)
+	}
+
+	r.Unified(c2)
+	r.Unified(c3)
+	if n := r.cache.Len(); n != 2 {
+		t.Errorf("cache holds %d entries, limit 2", n)
+	}
+	if _, ok := r.cache.get(diffKey{DiffUnified, c1.OldHash, c1.NewHash}); ok {
+		t.Error("least recently used entry was not evicted")
+	}
+}
+
+func TestSideBySideDiff(t *testing.T) {
+	r, err := NewDiffRenderer(LoadOptions{IgnoreFields: []string{"Age"}}, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := "Destination: 10.0.0.0/8\n  NextHop: 172.31.0.1   Cost: 0\n  State: Active   Age: 1d"
+	new := "Destination: 10.0.0.0/8\n  NextHop: 172.31.0.2   Cost: 0\n  State: Active   Age: 2d\n  Tag: 7"
+	diff, err := r.SideBySide(modifiedChange(t, old, new))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `old/10.0.0.0/8                    new/10.0.0.0/8
+Destination: 10.0.0.0/8           Destination: 10.0.0.0/8
+  NextHop: 172.31.0.1   Cost: 0 |   NextHop: 172.31.0.2   Cost: 0
+           ^^^^^^^^^^                        ^^^^^^^^^^
+  State: Active   Age: 1d           State: Active   Age: 2d
+                                >   Tag: 7
+`
+	if diff != want {
+		t.Errorf("diff:\n%s\nwant:\n%s", diff, want)
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// DeadLetter is a change set that a sink failed to accept
+type DeadLetter struct {
+	ID       string     `json:"id"`
+	Sink     string     `json:"sink"`
+	Reason   string     `json:"reason"`
+	Time     time.Time  `json:"time"`
+	Attempts int        `json:"attempts"`
+	Payload  *ChangeSet `json:"payload"`
+	// Contents holds the old and new text of each change of Payload, by
+	// index, which the change set doesn't carry, so a retry delivers what
+	// the failed delivery would have
+	Contents []letterContent `json:"contents,omitempty"`
+}
+
+type letterContent struct {
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+// keepContents records the content of the payload's changes
+func (dl *DeadLetter) keepContents() {
+	if dl.Payload == nil {
+		return
+	}
+	var kept bool
+	contents := make([]letterContent, len(dl.Payload.Changes))
+	for i, c := range dl.Payload.Changes {
+		contents[i] = letterContent{Old: chunkText(c.Old), New: chunkText(c.New)}
+		kept = kept || contents[i] != letterContent{}
+	}
+	if kept {
+		dl.Contents = contents
+	}
+}
+
+// restoreContents gives the payload's changes back their content
+func (dl *DeadLetter) restoreContents() {
+	if dl.Payload == nil || len(dl.Contents) != len(dl.Payload.Changes) {
+		return
+	}
+	for i := range dl.Payload.Changes {
+		c := &dl.Payload.Changes[i]
+		if content := dl.Contents[i]; content.Old != "" {
+			c.Old = &Chunk{Data: []byte(content.Old), Hash: c.OldHash, Destination: c.Destination}
+		}
+		if content := dl.Contents[i]; content.New != "" {
+			c.New = &Chunk{Data: []byte(content.New), Hash: c.NewHash, Destination: c.Destination}
+		}
+	}
+}
+
+// letterDir keeps letters as one JSON file each, written atomically, so
+// they survive restarts
+type letterDir struct {
+	dir string
+	mu  sync.Mutex
+	seq atomic.Uint64
+}
+
+func openLetterDir(dir string) (*letterDir, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	return &letterDir{dir: dir}, nil
+}
+
+// newLetter returns a letter for cs, to sink, keeping its content
+func (d *letterDir) newLetter(sink string, cs *ChangeSet) *DeadLetter {
+	now := time.Now()
+	dl := &DeadLetter{
+		ID:      fmt.Sprintf("%d-%d-%s", now.UnixNano(), d.seq.Add(1), sanitizeName(sink)),
+		Sink:    sink,
+		Time:    now,
+		Payload: cs,
+	}
+	dl.keepContents()
+	return dl
+}
+
+// write stores dl atomically, replacing any previous version
+func (d *letterDir) write(dl *DeadLetter) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	data, err := json.MarshalIndent(dl, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode dead letter: %w", err)
+	}
+	tmp := filepath.Join(d.dir, "."+dl.ID+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write dead letter: %w", err)
+	}
+	return os.Rename(tmp, d.path(dl.ID))
+}
+
+func (d *letterDir) path(id string) string {
+	return filepath.Join(d.dir, id+".json")
+}
+
+// list returns the letters, oldest first
+func (d *letterDir) list() ([]*DeadLetter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(d.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]*DeadLetter, 0, len(paths))
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dead letter: %w", err)
+		}
+		var dl DeadLetter
+		if err := json.Unmarshal(data, &dl); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", filepath.Base(p), err)
+		}
+		dl.restoreContents()
+		letters = append(letters, &dl)
+	}
+	sort.SliceStable(letters, func(i, j int) bool { return letters[i].Time.Before(letters[j].Time) })
+	return letters, nil
+}
+
+func (d *letterDir) remove(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return os.Remove(d.path(id))
+}
+
+// DeadLetterQueue persists failed deliveries as one JSON file per entry so
+// they survive restarts and can be replayed once the sink recovers
+type DeadLetterQueue struct {
+	letters *letterDir
+}
+
+// OpenDeadLetterQueue opens (creating if needed) a dead-letter queue in dir
+func OpenDeadLetterQueue(dir string) (*DeadLetterQueue, error) {
+	letters, err := openLetterDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dead-letter directory: %w", err)
+	}
+	q := &DeadLetterQueue{letters: letters}
+	if letters, err := q.List(); err == nil {
+		dlqDepth().Set(int64(len(letters)))
+	}
+	return q, nil
+}
+
+func dlqDepth() *Gauge {
+	return metrics.Gauge("dlq_depth", "Dead letters waiting to be retried")
+}
+
+func dlqCounter(name, help, sink string) *Counter {
+	return metrics.Counter(name, help, "sink", sink)
+}
+
+// Put records a failed delivery of cs to sink
+func (q *DeadLetterQueue) Put(sink string, cs *ChangeSet, reason error) error {
+	dl := q.letters.newLetter(sink, cs)
+	dl.Reason = reason.Error()
+	dl.Attempts = 1
+	return q.add(dl)
+}
+
+// add queues a letter made elsewhere
+func (q *DeadLetterQueue) add(dl *DeadLetter) error {
+	if err := q.letters.write(dl); err != nil {
+		return err
+	}
+	dlqCounter("dlq_enqueued_total", "Deliveries moved to the dead-letter queue", dl.Sink).Inc()
+	dlqDepth().Add(1)
+	return nil
+}
+
+// List returns the queued dead letters, oldest first
+func (q *DeadLetterQueue) List() ([]*DeadLetter, error) {
+	return q.letters.list()
+}
+
+// Remove deletes a dead letter
+func (q *DeadLetterQueue) Remove(id string) error {
+	if err := q.letters.remove(id); err != nil {
+		return err
+	}
+	dlqDepth().Add(-1)
+	return nil
+}
+
+// Retry redelivers every dead letter accepted by match to the sink it
+// failed on. Delivered letters are removed; failed ones stay queued with
+// their attempt count and reason updated. Letters whose sink is not in
+// sinks are skipped.
+func (q *DeadLetterQueue) Retry(ctx context.Context, sinks []Sink, match func(*DeadLetter) bool) (delivered, failed, skipped int, err error) {
+	byName := make(map[string]Sink, len(sinks))
+	for _, s := range sinks {
+		byName[s.Name()] = s
+	}
+
+	letters, err := q.List()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	for _, dl := range letters {
+		if match != nil && !match(dl) {
+			continue
+		}
+		sink, ok := byName[dl.Sink]
+		if !ok {
+			skipped++
+			continue
+		}
+		if derr := sink.Deliver(ctx, dl.Payload); derr != nil {
+			failed++
+			dl.Attempts++
+			dl.Reason = derr.Error()
+			dlqCounter("dlq_retry_failures_total", "Dead-letter retries that failed again", dl.Sink).Inc()
+			if err := q.letters.write(dl); err != nil {
+				return delivered, failed, skipped, err
+			}
+			continue
+		}
+		delivered++
+		dlqCounter("dlq_retried_total", "Dead letters delivered on retry", dl.Sink).Inc()
+		if err := q.Remove(dl.ID); err != nil {
+			return delivered, failed, skipped, err
+		}
+	}
+	return delivered, failed, skipped, nil
+}
+
+// Purge removes every dead letter accepted by match and returns how many
+// were removed
+func (q *DeadLetterQueue) Purge(match func(*DeadLetter) bool) (int, error) {
+	letters, err := q.List()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, dl := range letters {
+		if match != nil && !match(dl) {
+			continue
+		}
+		if err := q.Remove(dl.ID); err != nil {
+			return n, err
+		}
+		dlqCounter("dlq_purged_total", "Dead letters discarded without delivery", dl.Sink).Inc()
+		n++
+	}
+	return n, nil
+}
+
+// sanitizeName makes a sink name safe to use in a file name
+func sanitizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// runDLQ implements the dlq command
+func runDLQ(args []string) int {
+	usage := func(fs *flag.FlagSet) func() {
+		return func() {
+			fmt.Fprintf(fs.Output(), "Usage: %s dlq list|show|retry|purge -dir <dir> [options]\n\n", os.Args[0])
+			fmt.Fprintf(fs.Output(), "Inspect, replay or discard change sets that sinks failed to accept.\n\n")
+			fmt.Fprintf(fs.Output(), "Options:\n")
+			fs.PrintDefaults()
+		}
+	}
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: dlq needs a subcommand: list, show, retry or purge\n")
+		return 2
+	}
+	sub := args[0]
+
+	fs := flag.NewFlagSet("dlq "+sub, flag.ContinueOnError)
+	fs.Usage = usage(fs)
+	var dir, only, ids string
+	var olderThan time.Duration
+	var sinkSpecs stringList
+	fs.StringVar(&dir, "dir", "", "Dead-letter directory (required)")
+	fs.StringVar(&only, "only", "", "Only act on dead letters for this sink name")
+	fs.StringVar(&ids, "id", "", "Only act on the dead letters with these IDs (comma-separated)")
+	fs.DurationVar(&olderThan, "older-than", 0, "Only act on dead letters older than this")
+	fs.Var(&sinkSpecs, "sink", "Sink URL to retry against (repeatable; must match the watcher's -sink flags)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if dir == "" {
+		fmt.Fprintf(os.Stderr, "Error: -dir is required\n\n")
+		fs.Usage()
+		return 2
+	}
+
+	q, err := OpenDeadLetterQueue(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	idList := splitList(ids)
+	match := func(dl *DeadLetter) bool {
+		if only != "" && dl.Sink != only {
+			return false
+		}
+		if len(idList) > 0 && !slices.Contains(idList, dl.ID) {
+			return false
+		}
+		return olderThan == 0 || time.Since(dl.Time) > olderThan
+	}
+
+	switch sub {
+	case "list":
+		letters, err := q.List()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tSINK\tTIME\tATTEMPTS\tCHANGES\tREASON")
+		n := 0
+		for _, dl := range letters {
+			if !match(dl) {
+				continue
+			}
+			n++
+			changes := 0
+			if dl.Payload != nil {
+				changes = dl.Payload.Len()
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\n", dl.ID, dl.Sink, dl.Time.Format(time.RFC3339), dl.Attempts, changes, dl.Reason)
+		}
+		tw.Flush()
+		fmt.Printf("%d dead letters\n", n)
+	case "show":
+		letters, err := q.List()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		for _, dl := range letters {
+			if match(dl) {
+				enc.Encode(dl)
+			}
+		}
+	case "retry":
+		sinks, err := newSinks(sinkSpecs)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 2
+		}
+		delivered, failed, skipped, err := q.Retry(context.Background(), sinks, match)
+		fmt.Printf("%d delivered, %d failed, %d skipped (no matching -sink)\n", delivered, failed, skipped)
+		// Sinks holding change sets back, such as email digests, send them now
+		for _, s := range sinks {
+			if f, ok := s.(flusher); ok {
+				if ferr := f.Flush(context.Background()); ferr != nil {
+					err = errors.Join(err, fmt.Errorf("sink %s: %w", s.Name(), ferr))
+				}
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		if failed > 0 {
+			return 1
+		}
+	case "purge":
+		n, err := q.Purge(match)
+		fmt.Printf("%d dead letters purged\n", n)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown dlq subcommand %q\n", sub)
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSink records deliveries and fails while err is set
+type fakeSink struct {
+	name string
+	mu   sync.Mutex
+	err  error
+	got  []*ChangeSet
+}
+
+func (s *fakeSink) Name() string { return s.name }
+
+func (s *fakeSink) Deliver(ctx context.Context, cs *ChangeSet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.got = append(s.got, cs)
+	return nil
+}
+
+func (s *fakeSink) delivered() []*ChangeSet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*ChangeSet(nil), s.got...)
+}
+
+// historyFakeSink is a fakeSink that keeps history
+type historyFakeSink struct {
+	fakeSink
+}
+
+func (s *historyFakeSink) recordsHistory() bool { return true }
+
+func TestDispatcherVolatileHistory(t *testing.T) {
+	hook, history := &fakeSink{name: "hook"}, &historyFakeSink{fakeSink{name: "history"}}
+	router := NewRouter(nil)
+	d := NewDispatcher([]Sink{router.Route(hook), router.Route(history)}, nil)
+	volatile := Change{Type: ChangeModified, Destination: "0.0.0.0/0", Volatile: true}
+	d.Dispatch(context.Background(), &ChangeSet{Path: "t.txt", Changes: []Change{
+		{Type: ChangeAdded, Destination: "10.0.0.0/8", NewHash: "abc"},
+		volatile,
+	}})
+	d.Dispatch(context.Background(), &ChangeSet{Path: "t.txt", Changes: []Change{volatile}})
+
+	if got := hook.delivered(); len(got) != 1 || got[0].Len() != 1 || got[0].Changes[0].Volatile {
+		t.Errorf("notified of %+v", got)
+	}
+	got := history.delivered()
+	if len(got) != 2 || got[0].Len() != 2 || got[1].Len() != 1 || !got[1].Changes[0].Volatile {
+		t.Errorf("history got %+v", got)
+	}
+}
+
+func TestDispatcherDeadLetters(t *testing.T) {
+	q, err := OpenDeadLetterQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &fakeSink{name: "hook", err: errors.New("connection refused")}
+	d := NewDispatcher([]Sink{sink}, q)
+	var errs []error
+	d.OnError = func(err error) { errs = append(errs, err) }
+
+	cs := &ChangeSet{Path: "t.txt", Changes: []Change{
+		{Type: ChangeAdded, Destination: "10.0.0.0/8", NewHash: "abc"},
+		{Type: ChangeModified, Destination: "0.0.0.0/0", Volatile: true},
+	}}
+	d.Dispatch(context.Background(), cs)
+	if len(errs) != 1 {
+		t.Fatalf("errors = %v", errs)
+	}
+
+	letters, err := q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].Sink != "hook" || letters[0].Reason == "" {
+		t.Fatalf("letters = %+v", letters)
+	}
+	if p := letters[0].Payload; p.Len() != 1 || p.Changes[0].Destination != "10.0.0.0/8" {
+		t.Errorf("payload = %+v", p)
+	}
+
+	// Still failing: the letter stays with one more attempt
+	delivered, failed, _, err := q.Retry(context.Background(), []Sink{sink}, nil)
+	if err != nil || delivered != 0 || failed != 1 {
+		t.Fatalf("retry = %d, %d, %v", delivered, failed, err)
+	}
+	if letters, _ = q.List(); letters[0].Attempts != 2 {
+		t.Errorf("attempts = %d", letters[0].Attempts)
+	}
+
+	// Unknown sinks are skipped
+	if _, _, skipped, _ := q.Retry(context.Background(), nil, nil); skipped != 1 {
+		t.Errorf("skipped = %d", skipped)
+	}
+
+	sink.err = nil
+	delivered, failed, _, err = q.Retry(context.Background(), []Sink{sink}, nil)
+	if err != nil || delivered != 1 || failed != 0 {
+		t.Fatalf("retry = %d, %d, %v", delivered, failed, err)
+	}
+	if letters, _ = q.List(); len(letters) != 0 {
+		t.Errorf("delivered letter still queued: %+v", letters)
+	}
+	if got := sink.delivered(); len(got) != 1 || got[0].Changes[0].NewHash != "abc" {
+		t.Errorf("delivered = %+v", got)
+	}
+}
+
+func TestDeadLetterPurge(t *testing.T) {
+	q, err := OpenDeadLetterQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "a"} {
+		if err := q.Put(name, &ChangeSet{}, errors.New("down")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := q.Purge(func(dl *DeadLetter) bool { return dl.Sink == "a" })
+	if err != nil || n != 2 {
+		t.Fatalf("purged %d, %v", n, err)
+	}
+	if letters, _ := q.List(); len(letters) != 1 || letters[0].Sink != "b" {
+		t.Errorf("remaining = %+v", letters)
+	}
+}
+
+func TestDeadLetterContents(t *testing.T) {
+	q, err := OpenDeadLetterQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := pluginChangeSetSample(t)
+	if err := q.Put("hook", cs, errors.New("down")); err != nil {
+		t.Fatal(err)
+	}
+	// The table changing doesn't change what is redelivered
+	if err := os.WriteFile(cs.Path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sink := &fakeSink{name: "hook"}
+	if delivered, _, _, err := q.Retry(context.Background(), []Sink{sink}, nil); err != nil || delivered != 1 {
+		t.Fatalf("retry = %d, %v", delivered, err)
+	}
+	got := sink.delivered()[0]
+	if text := chunkText(got.Changes[0].New); !strings.HasPrefix(text, "Destination: 10.0.0.0/8") {
+		t.Errorf("new content = %q", text)
+	}
+	if c := got.Changes[1]; chunkText(c.Old) == "" || c.Old.Hash != c.OldHash {
+		t.Errorf("old chunk = %+v", c.Old)
+	}
+	if c := got.Changes[2]; c.Old != nil || c.New != nil {
+		t.Errorf("removed change without content has chunks: %+v", c)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultElasticsearchIndex names the daily index changes are written to
+const DefaultElasticsearchIndex = "go-watcher-{date}"
+
+// elasticsearchBulkSize is the most documents sent in one bulk request
+const elasticsearchBulkSize = 500
+
+func init() {
+	factory := func(u *url.URL) (Sink, error) {
+		return newElasticsearchSink(u)
+	}
+	sinkFactories["elasticsearch"] = factory
+	sinkFactories["opensearch"] = factory
+}
+
+// ElasticsearchSink indexes every change as a document in Elasticsearch
+// or OpenSearch, for full-text search of route history. The spec is
+// elasticsearch+https://[user@]host:9200, or opensearch+https:// and
+// +http://, with these parameters:
+//
+//	index                index name, where {date} is the change set's day
+//	                     in UTC as 2006.01.02 (default go-watcher-{date})
+//	api-key-env          environment variable holding an API key
+//	api-key-file         file holding it, instead
+//	password-env         environment variable holding the user's password
+//	password-file        file holding it, instead
+//	path, type, prefix   only index the changes selected as for /events
+//
+// plus the webhook sink's timeout, retries and backoff. Documents carry
+// @timestamp, path, stream, changeset, seq, type, destination, critical,
+// the old and new hashes and chunk text, and the chunks' fields as parsed
+// for -ignore-fields in old_fields and new_fields. Their IDs are the
+// change's stream and sequence number, so a change delivered again
+// replaces its document rather than adding another.
+type ElasticsearchSink struct {
+	name   string
+	post   *WebhookSink
+	index  string
+	filter changeFilter
+}
+
+// elasticsearchDoc is the document of a change
+type elasticsearchDoc struct {
+	Timestamp   time.Time         `json:"@timestamp"`
+	Path        string            `json:"path"`
+	Stream      string            `json:"stream,omitempty"`
+	ChangeSet   uint64            `json:"changeset,omitempty"`
+	Seq         uint64            `json:"seq,omitempty"`
+	Type        ChangeType        `json:"type"`
+	Destination string            `json:"destination"`
+	Critical    bool              `json:"critical"`
+	OldHash     string            `json:"old_hash,omitempty"`
+	NewHash     string            `json:"new_hash,omitempty"`
+	OldContent  string            `json:"old_content,omitempty"`
+	NewContent  string            `json:"new_content,omitempty"`
+	OldFields   map[string]string `json:"old_fields,omitempty"`
+	NewFields   map[string]string `json:"new_fields,omitempty"`
+}
+
+func newElasticsearchSink(u *url.URL) (*ElasticsearchSink, error) {
+	s := &ElasticsearchSink{name: sinkName(u), index: DefaultElasticsearchIndex}
+	if err := s.parse(u); err != nil {
+		return nil, fmt.Errorf("%s sink %s: %w", sinkKind(u), s.name, err)
+	}
+	return s, nil
+}
+
+// parse takes the sink's options from u
+func (s *ElasticsearchSink) parse(u *url.URL) error {
+	kind, transport, _ := strings.Cut(u.Scheme, "+")
+	if transport != "http" && transport != "https" {
+		return fmt.Errorf("needs %s+https:// or %s+http://", kind, kind)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("needs the server, as %s+https://host:9200", kind)
+	}
+	q := u.Query()
+	apiKey, err := readSecret(q, "api-key")
+	if err != nil {
+		return err
+	}
+	password, err := readSecret(q, "password")
+	if err != nil {
+		return err
+	}
+	var auth string
+	switch {
+	case apiKey != nil && u.User != nil:
+		return errors.New("takes an API key or a user, not both")
+	case apiKey != nil:
+		auth = "ApiKey " + string(apiKey)
+	case u.User != nil:
+		if password == nil {
+			return errors.New("a user needs password-env or password-file")
+		}
+		auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+string(password)))
+	}
+	if v := q.Get("index"); v != "" {
+		s.index = v
+	}
+	if name := s.indexName(time.Time{}); name != strings.ToLower(name) || strings.ContainsAny(name, `{}\/*?"<>| ,#:`) || strings.HasPrefix(name, "_") || strings.HasPrefix(name, "-") {
+		return fmt.Errorf("invalid index %q (lower case, without spaces or \\/*?\"<>|,#:, and only {date} for a placeholder)", s.index)
+	}
+	if s.filter, err = parseChangeFilter(q.Get("path"), q.Get("type"), q.Get("prefix")); err != nil {
+		return err
+	}
+	for _, p := range []string{"index", "path", "type", "prefix"} {
+		q.Del(p)
+	}
+	// Only the errors are of interest in bulk replies, which can be large
+	q.Set("filter_path", "errors,items.*.error")
+
+	target := *u
+	target.Scheme, target.User, target.Path = transport, nil, "/_bulk"
+	if s.post, err = newPoster(s.name, &target, q); err != nil {
+		return err
+	}
+	s.post.header = http.Header{"Content-Type": {"application/x-ndjson"}}
+	if auth != "" {
+		s.post.header.Set("Authorization", auth)
+	}
+	s.post.accept = elasticsearchAccept
+	return nil
+}
+
+func (s *ElasticsearchSink) Name() string { return s.name }
+
+// indexName returns the index for a change set of time t
+func (s *ElasticsearchSink) indexName(t time.Time) string {
+	return strings.ReplaceAll(s.index, "{date}", t.UTC().Format("2006.01.02"))
+}
+
+// Deliver indexes the changes of cs the sink selects, in bulk requests of
+// up to elasticsearchBulkSize documents
+func (s *ElasticsearchSink) Deliver(ctx context.Context, cs *ChangeSet) error {
+	changes := s.filter.changes(cs)
+	ts := cs.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	index := s.indexName(ts)
+	for len(changes) > 0 {
+		n := min(len(changes), elasticsearchBulkSize)
+		var body bytes.Buffer
+		for _, c := range changes[:n] {
+			action := map[string]string{"_index": index}
+			if c.Seq != 0 {
+				action["_id"] = changeEventID(cs, c)
+			}
+			doc := elasticsearchDoc{
+				Timestamp: ts, Path: cs.Path, Stream: cs.Stream, ChangeSet: cs.ID, Seq: c.Seq,
+				Type: c.Type, Destination: c.Destination, Critical: c.Critical,
+				OldHash: c.OldHash, NewHash: c.NewHash,
+			}
+			doc.OldContent, doc.OldFields = elasticsearchChunk(c.Old)
+			doc.NewContent, doc.NewFields = elasticsearchChunk(c.New)
+			line, err := json.Marshal(map[string]any{"index": action})
+			if err != nil {
+				return err
+			}
+			body.Write(line)
+			body.WriteByte('\n')
+			if line, err = json.Marshal(doc); err != nil {
+				return fmt.Errorf("failed to encode change: %w", err)
+			}
+			body.Write(line)
+			body.WriteByte('\n')
+		}
+		if err := s.post.send(ctx, body.Bytes()); err != nil {
+			return err
+		}
+		changes = changes[n:]
+	}
+	return nil
+}
+
+// elasticsearchChunk returns the text of chunk and its fields by name.
+// Dots in names, which Elasticsearch takes for object paths, become
+// underscores.
+func elasticsearchChunk(chunk *Chunk) (string, map[string]string) {
+	if chunk == nil {
+		return "", nil
+	}
+	data, err := chunk.Content()
+	if err != nil {
+		return "", nil
+	}
+	fields := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		for _, f := range parseFields(line) {
+			if f.Value != "" {
+				fields[strings.ReplaceAll(f.Name, ".", "_")] = f.Value
+			}
+		}
+	}
+	return string(data), fields
+}
+
+// elasticsearchAccept checks a bulk reply for documents that failed
+func elasticsearchAccept(body []byte) error {
+	var reply struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Error *struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(body, &reply); err != nil || !reply.Errors {
+		return nil
+	}
+	failed := 0
+	var first string
+	for _, item := range reply.Items {
+		for _, result := range item {
+			if result.Error != nil {
+				if failed++; first == "" {
+					first = result.Error.Type + ": " + result.Error.Reason
+				}
+			}
+		}
+	}
+	return fmt.Errorf("%d documents failed to index, the first with %s", failed, first)
+}
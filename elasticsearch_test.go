@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestElasticsearchSink(t *testing.T) {
+	var requests []*http.Request
+	var bodies []string
+	reply := `{"errors":false}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests, bodies = append(requests, r), append(bodies, string(body))
+		io.WriteString(w, reply)
+	}))
+	defer srv.Close()
+	t.Setenv("ES_TEST_PASSWORD", "pw")
+
+	spec := strings.Replace(srv.URL, "http://", "elasticsearch+http://watcher@", 1) + "?password-env=ES_TEST_PASSWORD&index=routes-{date}&retries=0"
+	sink, err := newSink(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &ChangeSet{Stream: "s1", ID: 3, Path: "core.txt", Time: time.Date(2024, 5, 1, 23, 0, 0, 0, time.FixedZone("", -3600)), Changes: []Change{
+		{Seq: 5, Type: ChangeModified, Destination: "10.1.0.0/16",
+			Old: &Chunk{Data: []byte("Destination: 10.1.0.0/16  Protocol: OSPF\nNextHop: 192.0.2.1  Interface: ge-0/0/1\n")},
+			New: &Chunk{Data: []byte("Destination: 10.1.0.0/16  Protocol: OSPF\nNextHop: 192.0.2.9  Interface: ge-0/0/1\n")}},
+		{Seq: 6, Type: ChangeAdded, Destination: "10.2.0.0/16", Volatile: true},
+	}}
+	if err := sink.Deliver(context.Background(), cs); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("%d requests", len(requests))
+	}
+	r := requests[0]
+	if r.URL.Path != "/_bulk" || r.URL.Query().Get("filter_path") != "errors,items.*.error" || r.URL.Query().Has("index") {
+		t.Errorf("posted to %s", r.URL)
+	}
+	if user, password, ok := r.BasicAuth(); !ok || user != "watcher" || password != "pw" {
+		t.Errorf("basic auth %q %q %v", user, password, ok)
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type %q", ct)
+	}
+	lines := strings.Split(strings.TrimSuffix(bodies[0], "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d lines:\n%s", len(lines), bodies[0])
+	}
+	if lines[0] != `{"index":{"_id":"s1-5","_index":"routes-2024.05.02"}}` {
+		t.Errorf("action %s", lines[0])
+	}
+	var doc map[string]any
+	if err := json.Unmarshal([]byte(lines[1]), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["@timestamp"] != "2024-05-01T23:00:00-01:00" || doc["type"] != "modified" || doc["changeset"] != 3.0 || doc["seq"] != 5.0 {
+		t.Errorf("document %s", lines[1])
+	}
+	if !strings.Contains(doc["new_content"].(string), "NextHop: 192.0.2.9") {
+		t.Errorf("new_content %q", doc["new_content"])
+	}
+	if got := doc["old_fields"].(map[string]any)["NextHop"]; got != "192.0.2.1" {
+		t.Errorf("old NextHop %v", got)
+	}
+	if got := doc["new_fields"].(map[string]any)["Interface"]; got != "ge-0/0/1" {
+		t.Errorf("new Interface %v", got)
+	}
+
+	// Documents that fail to index fail the delivery
+	reply = `{"errors":true,"items":[{"index":{"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}]}`
+	err = sink.Deliver(context.Background(), cs)
+	if err == nil || !strings.Contains(err.Error(), "1 documents failed to index, the first with mapper_parsing_exception: failed to parse") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestNewElasticsearchSinkErrors(t *testing.T) {
+	t.Setenv("ES_TEST_KEY", "key")
+	for _, spec := range []string{
+		"elasticsearch://es:9200",
+		"opensearch+https://",
+		"elasticsearch+https://watcher@es:9200",
+		"elasticsearch+https://watcher@es:9200?api-key-env=ES_TEST_KEY",
+		"elasticsearch+https://es:9200?index=Routes",
+		"elasticsearch+https://es:9200?index=routes-{day}",
+		"elasticsearch+https://es:9200?type=changed",
+	} {
+		if _, err := newSink(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// DefaultEmailTimeout bounds the sending of one email
+const DefaultEmailTimeout = 30 * time.Second
+
+// emailListLimit is the number of changes of a change set listed in an
+// email; the rest are only counted
+const emailListLimit = 100
+
+// Default templates of emails
+const (
+	defaultEmailSubject = `[go-watcher] {{if .Digest}}{{len .ChangeSets}} change sets, {{end}}{{.Changes}} changed routes in {{join .Paths ", "}}`
+	defaultEmailBody    = `{{range .ChangeSets}}{{.Path}}, changeset {{.ID}} at {{.Time.Format "2006-01-02 15:04:05 MST"}}:
+{{if .Truncated}}  the file was truncated to zero bytes
+{{end}}{{if .Changes}}  {{.Added}} added, {{.Removed}} removed, {{.Modified}} modified; {{.Routes}} routes in table
+{{range .Changes}}  {{.Type}} {{.Destination}}{{if .Critical}} (critical){{end}}
+{{end}}{{if .Unlisted}}  ({{.Unlisted}} more not listed)
+{{end}}{{end}}
+{{end}}{{if .Link}}Web UI: {{.Link}}
+{{end}}`
+)
+
+func init() {
+	sinkFactories["smtp"] = func(u *url.URL) (Sink, error) {
+		return newEmailSink(u)
+	}
+}
+
+// EmailSink emails the change sets its filter selects, one email each or
+// a digest every so often. The spec is smtp://[user@]host[:port] with
+// these parameters:
+//
+//	to                   comma separated recipients (required)
+//	from                 sender (default go-watcher@ the host name)
+//	password-env         environment variable holding the user's password
+//	password-file        file holding it, instead
+//	tls                  starttls (the default), tls for implicit TLS, as
+//	                     on port 465, or none
+//	timeout              time allowed to send an email (default 30s)
+//	digest               send the change sets of this long as one email
+//	                     (default 0, an email per change set)
+//	subject              template of the subject
+//	body-file            file holding the template of the body
+//	path, type, prefix   only email the changes selected as for /events
+//	link                 the web UI's address, to link to
+//
+// Templates are executed with EmailData.
+type EmailSink struct {
+	name     string
+	addr     string
+	host     string
+	tls      string
+	auth     smtp.Auth
+	from     string
+	to       []string
+	timeout  time.Duration
+	digest   time.Duration
+	subject  *template.Template
+	body     *template.Template
+	filter   changeFilter
+	link     string
+	hostname string
+
+	mu sync.Mutex
+	// pending holds the change sets of the digest being collected
+	pending []*EmailChangeSet
+	timer   *time.Timer
+}
+
+// EmailData is what the subject and body templates of emails are executed
+// with
+type EmailData struct {
+	// ChangeSets are those in the email, oldest first
+	ChangeSets []*EmailChangeSet
+	// Changes counts their changes; Paths are their tables
+	Changes int
+	Paths   []string
+	// Digest is set for a digest email
+	Digest bool
+	Link   string
+}
+
+// EmailChangeSet is a change set in an email, with only the changes the
+// sink selects
+type EmailChangeSet struct {
+	*ChangeSet
+	// Changes are those selected, at most emailListLimit of them, and
+	// Unlisted the number left out
+	Changes                            []Change
+	Unlisted                           int
+	Added, Removed, Modified, Critical int
+}
+
+// emailFuncs are the functions email templates can call
+var emailFuncs = template.FuncMap{"join": strings.Join}
+
+func newEmailSink(u *url.URL) (*EmailSink, error) {
+	s := &EmailSink{name: sinkName(u), host: u.Hostname(), tls: "starttls", timeout: DefaultEmailTimeout}
+	if s.host == "" {
+		return nil, fmt.Errorf("smtp sink %s: needs the server, as smtp://host:port", s.name)
+	}
+	if err := s.parse(u); err != nil {
+		return nil, fmt.Errorf("smtp sink %s: %w", s.name, err)
+	}
+	return s, nil
+}
+
+// parse takes the sink's options from u
+func (s *EmailSink) parse(u *url.URL) error {
+	q := u.Query()
+	var err error
+	for _, addr := range splitList(q.Get("to")) {
+		a, err := mail.ParseAddress(addr)
+		if err != nil {
+			return fmt.Errorf("invalid recipient %q: %w", addr, err)
+		}
+		s.to = append(s.to, a.Address)
+	}
+	if len(s.to) == 0 {
+		return errors.New("needs recipients in to")
+	}
+	if s.hostname, err = os.Hostname(); err != nil {
+		s.hostname = "localhost"
+	}
+	s.from = "go-watcher@" + s.hostname
+	if v := q.Get("from"); v != "" {
+		a, err := mail.ParseAddress(v)
+		if err != nil {
+			return fmt.Errorf("invalid from %q: %w", v, err)
+		}
+		s.from = a.Address
+	}
+
+	if v := q.Get("tls"); v != "" {
+		if v != "starttls" && v != "tls" && v != "none" {
+			return fmt.Errorf("unknown tls %q (want starttls, tls or none)", v)
+		}
+		s.tls = v
+	}
+	port := u.Port()
+	if port == "" {
+		port = "587"
+		if s.tls == "tls" {
+			port = "465"
+		}
+	}
+	s.addr = net.JoinHostPort(s.host, port)
+	password, err := readSecret(q, "password")
+	if err != nil {
+		return err
+	}
+	if u.User != nil {
+		s.auth = smtp.PlainAuth("", u.User.Username(), string(password), s.host)
+	} else if password != nil {
+		return errors.New("a password needs a user, as smtp://user@host")
+	}
+
+	if v := q.Get("timeout"); v != "" {
+		if s.timeout, err = time.ParseDuration(v); err != nil || s.timeout <= 0 {
+			return fmt.Errorf("invalid timeout %q", v)
+		}
+	}
+	if v := q.Get("digest"); v != "" {
+		if s.digest, err = time.ParseDuration(v); err != nil || s.digest < 0 {
+			return fmt.Errorf("invalid digest %q", v)
+		}
+	}
+	subject := defaultEmailSubject
+	if q.Has("subject") {
+		subject = q.Get("subject")
+	}
+	if s.subject, err = template.New("subject").Funcs(emailFuncs).Parse(subject); err != nil {
+		return fmt.Errorf("invalid subject: %w", err)
+	}
+	body := defaultEmailBody
+	if v := q.Get("body-file"); v != "" {
+		data, err := os.ReadFile(v)
+		if err != nil {
+			return fmt.Errorf("failed to read body template: %w", err)
+		}
+		body = string(data)
+	}
+	if s.body, err = template.New("body").Funcs(emailFuncs).Parse(body); err != nil {
+		return fmt.Errorf("invalid body template: %w", err)
+	}
+	if s.filter, err = parseChangeFilter(q.Get("path"), q.Get("type"), q.Get("prefix")); err != nil {
+		return err
+	}
+	s.link = q.Get("link")
+	return nil
+}
+
+func (s *EmailSink) Name() string { return s.name }
+
+// Deliver emails the changes of cs the sink selects, or adds them to the
+// digest
+func (s *EmailSink) Deliver(ctx context.Context, cs *ChangeSet) error {
+	ecs := s.pick(cs)
+	if ecs == nil {
+		return nil
+	}
+	if s.digest <= 0 {
+		return s.send(ctx, []*EmailChangeSet{ecs}, false)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending == nil {
+		s.timer = time.AfterFunc(s.digest, func() {
+			if err := s.Flush(context.Background()); err != nil {
+				slog.Error("failed to send digest email", "sink", s.name, "err", err)
+			}
+		})
+	}
+	s.pending = append(s.pending, ecs)
+	return nil
+}
+
+// Flush sends the digest being collected, if any
+func (s *EmailSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = nil
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	return s.send(ctx, pending, true)
+}
+
+// pick returns cs with the changes the sink selects, or nil if it
+// selects nothing. Chunks are left out, so digests don't hold on to old
+// tables.
+func (s *EmailSink) pick(cs *ChangeSet) *EmailChangeSet {
+	changes := s.filter.changes(cs)
+	if len(changes) == 0 && !cs.Truncated {
+		return nil
+	}
+	lean := *cs
+	lean.Changes = nil
+	ecs := &EmailChangeSet{ChangeSet: &lean}
+	for i, c := range changes {
+		switch c.Type {
+		case ChangeAdded:
+			ecs.Added++
+		case ChangeRemoved:
+			ecs.Removed++
+		case ChangeModified:
+			ecs.Modified++
+		}
+		if c.Critical {
+			ecs.Critical++
+		}
+		changes[i].Old, changes[i].New = nil, nil
+	}
+	if len(changes) > emailListLimit {
+		ecs.Unlisted = len(changes) - emailListLimit
+		changes = changes[:emailListLimit]
+	}
+	ecs.Changes = changes
+	return ecs
+}
+
+// send emails sets
+func (s *EmailSink) send(ctx context.Context, sets []*EmailChangeSet, digest bool) error {
+	data := &EmailData{ChangeSets: sets, Digest: digest, Link: s.link}
+	for _, ecs := range sets {
+		data.Changes += ecs.Added + ecs.Removed + ecs.Modified
+		if !slices.Contains(data.Paths, ecs.Path) {
+			data.Paths = append(data.Paths, ecs.Path)
+		}
+	}
+	msg, err := s.message(data)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.transmit(ctx, msg)
+}
+
+// message renders the email of data with its headers
+func (s *EmailSink) message(data *EmailData) ([]byte, error) {
+	var subject, body bytes.Buffer
+	if err := s.subject.Execute(&subject, data); err != nil {
+		return nil, fmt.Errorf("failed to render subject: %w", err)
+	}
+	if err := s.body.Execute(&body, data); err != nil {
+		return nil, fmt.Errorf("failed to render body: %w", err)
+	}
+	var msg bytes.Buffer
+	header := func(k, v string) { fmt.Fprintf(&msg, "%s: %s\r\n", k, v) }
+	header("From", s.from)
+	header("To", strings.Join(s.to, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", strings.Join(strings.Fields(subject.String()), " ")))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	msg.WriteString("\r\n")
+	qp := quotedprintable.NewWriter(&msg)
+	qp.Write(bytes.ReplaceAll(body.Bytes(), []byte("\n"), []byte("\r\n")))
+	qp.Close()
+	return msg.Bytes(), nil
+}
+
+// transmit sends msg through the sink's server
+func (s *EmailSink) transmit(ctx context.Context, msg []byte) error {
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", s.addr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if s.tls == "tls" {
+		conn = tls.Client(conn, &tls.Config{ServerName: s.host})
+	}
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to greet %s: %w", s.addr, err)
+	}
+	defer c.Close()
+	if err := c.Hello(s.hostname); err != nil {
+		return err
+	}
+	if s.tls == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s doesn't offer STARTTLS; set tls=none to send in the clear", s.addr)
+		}
+		if err := c.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return fmt.Errorf("failed to start TLS: %w", err)
+		}
+	}
+	if s.auth != nil {
+		if err := c.Auth(s.auth); err != nil {
+			return fmt.Errorf("failed to authenticate: %w", err)
+		}
+	}
+	if err := c.Mail(s.from); err != nil {
+		return err
+	}
+	for _, to := range s.to {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("recipient %s: %w", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpMail is an email received by fakeSMTP
+type smtpMail struct {
+	from, auth string
+	to         []string
+	msg        *mail.Message
+	body       string
+}
+
+// fakeSMTP runs a plain SMTP server offering PLAIN auth and returns its
+// address and the mails it has received
+func fakeSMTP(t *testing.T) (string, func() []smtpMail) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var mu sync.Mutex
+	var mails []smtpMail
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				reply := func(s string) { io.WriteString(conn, s+"\r\n") }
+				reply("220 fake ESMTP")
+				var m smtpMail
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					cmd := strings.TrimRight(line, "\r\n")
+					switch verb := strings.ToUpper(strings.SplitN(cmd, " ", 2)[0]); verb {
+					case "EHLO":
+						reply("250-fake")
+						reply("250 AUTH PLAIN")
+					case "AUTH":
+						creds, _ := base64.StdEncoding.DecodeString(strings.Fields(cmd)[2])
+						m.auth = string(creds)
+						reply("235 ok")
+					case "MAIL":
+						m.from = strings.Trim(strings.TrimPrefix(cmd, "MAIL FROM:"), "<>")
+						reply("250 ok")
+					case "RCPT":
+						m.to = append(m.to, strings.Trim(strings.TrimPrefix(cmd, "RCPT TO:"), "<>"))
+						reply("250 ok")
+					case "DATA":
+						reply("354 go on")
+						var data strings.Builder
+						for {
+							l, err := r.ReadString('\n')
+							if err != nil || l == ".\r\n" {
+								break
+							}
+							data.WriteString(strings.TrimPrefix(l, "."))
+						}
+						msg, err := mail.ReadMessage(strings.NewReader(data.String()))
+						if err != nil {
+							t.Errorf("invalid message: %v", err)
+							return
+						}
+						body, _ := io.ReadAll(quotedprintable.NewReader(msg.Body))
+						m.msg, m.body = msg, strings.ReplaceAll(string(body), "\r\n", "\n")
+						mu.Lock()
+						mails = append(mails, m)
+						mu.Unlock()
+						m = smtpMail{}
+						reply("250 queued")
+					case "QUIT":
+						reply("221 bye")
+						return
+					default:
+						reply("250 ok")
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), func() []smtpMail {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]smtpMail(nil), mails...)
+	}
+}
+
+func TestEmailSink(t *testing.T) {
+	addr, mails := fakeSMTP(t)
+	t.Setenv("SMTP_TEST_PASSWORD", "pw")
+	sink, err := newSink("smtp://alerts@" + addr + "?tls=none&password-env=SMTP_TEST_PASSWORD&to=noc@example.com,Ops+<ops@example.com>&from=watcher@example.com&type=removed&link=http://watcher:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &ChangeSet{ID: 3, Path: "core.txt", Routes: 10, Time: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), Changes: []Change{
+		{Type: ChangeRemoved, Destination: "0.0.0.0/0", Critical: true},
+		{Type: ChangeAdded, Destination: "10.1.0.0/16"},
+	}}
+	if err := sink.Deliver(context.Background(), cs); err != nil {
+		t.Fatal(err)
+	}
+	// Not selected
+	if err := sink.Deliver(context.Background(), &ChangeSet{Path: "core.txt", Changes: []Change{{Type: ChangeAdded, Destination: "10.2.0.0/16"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := mails()
+	if len(got) != 1 {
+		t.Fatalf("%d mails, want 1", len(got))
+	}
+	m := got[0]
+	if m.from != "watcher@example.com" || strings.Join(m.to, ",") != "noc@example.com,ops@example.com" || m.auth != "\x00alerts\x00pw" {
+		t.Errorf("envelope = %+v", m)
+	}
+	if subject := m.msg.Header.Get("Subject"); subject != "[go-watcher] 1 changed routes in core.txt" {
+		t.Errorf("subject = %q", subject)
+	}
+	want := "core.txt, changeset 3 at 2024-05-01 12:00:00 UTC:\n" +
+		"  0 added, 1 removed, 0 modified; 10 routes in table\n" +
+		"  removed 0.0.0.0/0 (critical)\n" +
+		"\n" +
+		"Web UI: http://watcher:8080\n"
+	if m.body != want {
+		t.Errorf("body =\n%s\nwant\n%s", m.body, want)
+	}
+}
+
+func TestEmailSinkDigest(t *testing.T) {
+	addr, mails := fakeSMTP(t)
+	body := filepath.Join(t.TempDir(), "body.tmpl")
+	if err := os.WriteFile(body, []byte("{{range .ChangeSets}}{{.ID}} {{end}}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sink, err := newSink("smtp://" + addr + "?tls=none&to=noc@example.com&digest=1h&subject={{len .ChangeSets}}+sets&body-file=" + body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := range uint64(3) {
+		if err := sink.Deliver(context.Background(), &ChangeSet{ID: id + 1, Path: "core.txt", Changes: []Change{{Type: ChangeAdded, Destination: "10.1.0.0/16"}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(mails()); n != 0 {
+		t.Fatalf("%d mails before the digest is due", n)
+	}
+
+	// The dispatcher flushes digests on shutdown
+	d := NewDispatcher([]Sink{sink}, nil)
+	if err := d.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got := mails()
+	if len(got) != 1 {
+		t.Fatalf("%d mails, want 1", len(got))
+	}
+	if subject := got[0].msg.Header.Get("Subject"); subject != "3 sets" {
+		t.Errorf("subject = %q", subject)
+	}
+	if got[0].body != "1 2 3 \n" {
+		t.Errorf("body = %q", got[0].body)
+	}
+}
+
+func TestEmailSinkRequiresStartTLS(t *testing.T) {
+	addr, _ := fakeSMTP(t)
+	sink, err := newSink("smtp://" + addr + "?to=noc@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.Deliver(context.Background(), &ChangeSet{Path: "t.txt", Truncated: true})
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestNewEmailSinkErrors(t *testing.T) {
+	for _, spec := range []string{
+		"smtp://mail.example.com",
+		"smtp://?to=noc@example.com",
+		"smtp://mail.example.com?to=not-an-address",
+		"smtp://mail.example.com?to=noc@example.com&tls=maybe",
+		"smtp://mail.example.com?to=noc@example.com&subject={{.Nope",
+		"smtp://mail.example.com?to=noc@example.com&password-env=SMTP_TEST_PASSWORD",
+	} {
+		t.Setenv("SMTP_TEST_PASSWORD", "pw")
+		if _, err := newSink(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
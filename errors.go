@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error classes returned by loading, detection and watching. They are
+// wrapped with details, so test for them with errors.Is.
+var (
+	// ErrFileMissing means the table file does not exist
+	ErrFileMissing = errors.New("file missing")
+	// ErrParse means the table could not be split into routes
+	ErrParse = errors.New("parse error")
+	// ErrWatcherClosed means the file watcher was closed or its event
+	// stream ended
+	ErrWatcherClosed = errors.New("watcher closed")
+	// ErrTooLarge means the input exceeds a configured size limit
+	ErrTooLarge = errors.New("too large")
+)
+
+// ParseError reports where in a table parsing failed. It matches ErrParse
+// as well as the underlying error.
+type ParseError struct {
+	Path string
+	Line int64
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s:%d: %v", e.Path, e.Line, e.Err)
+}
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// Is makes every ParseError match ErrParse
+func (e *ParseError) Is(target error) bool { return target == ErrParse }
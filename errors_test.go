@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestErrFileMissing(t *testing.T) {
+	rt := NewDataTable(filepath.Join(t.TempDir(), "missing.txt"))
+	err := rt.LoadDataTable(context.Background())
+	if !errors.Is(err, ErrFileMissing) || !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("load err = %v", err)
+	}
+	if _, err := rt.DetectChanges(context.Background()); !errors.Is(err, ErrFileMissing) {
+		t.Errorf("detect err = %v", err)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"), strings.Repeat("x", 200))
+	rt := NewDataTable(path)
+	rt.Options.MaxLineBytes = 100
+	err := rt.LoadDataTable(context.Background())
+	if !errors.Is(err, ErrParse) || !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("err = %v", err)
+	}
+	var pe *ParseError
+	if !errors.As(err, &pe) || pe.Path != path || pe.Line != 6 {
+		t.Errorf("parse error = %+v", pe)
+	}
+}
+
+func TestErrWatcherClosed(t *testing.T) {
+	fw, err := NewFileWatcher(filepath.Join(t.TempDir(), "t.txt"), func() {}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Errorf("second close = %v", err)
+	}
+	if err := fw.Start(context.Background()); !errors.Is(err, ErrWatcherClosed) {
+		t.Errorf("start after close = %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultEventSource is the Windows Event Log source change summaries are
+// written under
+const DefaultEventSource = "go-watcher"
+
+// eventLogLimit is the number of changes listed in an event; the rest are
+// only counted
+const eventLogLimit = 50
+
+// eventLogMessage summarizes cs for the Windows Event Log. It reports
+// whether the event should be a warning rather than information: for a
+// truncated file or critical changes.
+func eventLogMessage(cs *ChangeSet) (string, bool) {
+	var b strings.Builder
+	warn := cs.Truncated
+	if cs.Truncated {
+		fmt.Fprintf(&b, "%s was truncated to zero bytes.\r\n", cs.Path)
+	}
+	changes := cs.Notifiable()
+	s := cs.Summarize(0)
+	fmt.Fprintf(&b, "%d changed routes in %s, changeset %d: %d added, %d removed, %d modified; %d routes in table.\r\n",
+		len(changes), cs.Path, cs.ID, s.Added, s.Removed, s.Modified, s.Routes)
+	for i, c := range changes {
+		warn = warn || c.Critical
+		if i >= eventLogLimit {
+			continue
+		}
+		critical := ""
+		if c.Critical {
+			critical = " (critical)"
+		}
+		fmt.Fprintf(&b, "  %s %s%s\r\n", c.Type, c.Destination, critical)
+	}
+	if len(changes) > eventLogLimit {
+		fmt.Fprintf(&b, "  (%d more not listed)\r\n", len(changes)-eventLogLimit)
+	}
+	return b.String(), warn
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"net/url"
+)
+
+func init() {
+	sinkFactories["eventlog"] = func(u *url.URL) (Sink, error) {
+		return nil, errors.New("the eventlog sink needs Windows")
+	}
+}
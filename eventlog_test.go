@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestEventLogMessage(t *testing.T) {
+	cs := &ChangeSet{ID: 7, Path: "t.txt", Routes: 12, Changes: []Change{
+		{Type: ChangeAdded, Destination: "10.0.0.0/8"},
+		{Type: ChangeModified, Destination: "10.1.0.0/16", Volatile: true},
+		{Type: ChangeRemoved, Destination: "10.2.0.0/16"},
+	}}
+	msg, warn := eventLogMessage(cs)
+	want := "2 changed routes in t.txt, changeset 7: 1 added, 1 removed, 0 modified; 12 routes in table.\r\n" +
+		"  added 10.0.0.0/8\r\n" +
+		"  removed 10.2.0.0/16\r\n"
+	if msg != want || warn {
+		t.Errorf("message = %q, %v; want %q, false", msg, warn, want)
+	}
+
+	cs.Changes[2].Critical = true
+	if msg, warn := eventLogMessage(cs); !warn || !strings.Contains(msg, "removed 10.2.0.0/16 (critical)") {
+		t.Errorf("critical change: message = %q, warning = %v", msg, warn)
+	}
+
+	cs = &ChangeSet{ID: 8, Path: "t.txt", Truncated: true}
+	if msg, warn := eventLogMessage(cs); !warn || !strings.HasPrefix(msg, "t.txt was truncated to zero bytes.\r\n") {
+		t.Errorf("truncation: message = %q, warning = %v", msg, warn)
+	}
+
+	cs = &ChangeSet{Path: "t.txt"}
+	for i := range eventLogLimit + 5 {
+		cs.Changes = append(cs.Changes, Change{Type: ChangeAdded, Destination: fmt.Sprintf("10.0.%d.0/24", i)})
+	}
+	msg, _ = eventLogMessage(cs)
+	if n := strings.Count(msg, "  added "); n != eventLogLimit {
+		t.Errorf("listed %d changes, want %d", n, eventLogLimit)
+	}
+	if !strings.HasSuffix(msg, "  (5 more not listed)\r\n") {
+		t.Errorf("message doesn't count the unlisted changes: %q", msg[len(msg)-40:])
+	}
+}
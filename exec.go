@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Defaults of exec sinks
+const (
+	DefaultExecTimeout     = 30 * time.Second
+	DefaultExecConcurrency = 1
+)
+
+func init() {
+	sinkFactories["exec"] = func(u *url.URL) (Sink, error) {
+		return newExecSink(u)
+	}
+}
+
+// ExecSink runs a shell command for every change set, with the change set
+// as JSON, in the form of the audit log, on its standard input, so any
+// reaction can be scripted. The spec is exec://?command=... with these
+// optional parameters:
+//
+//	timeout      time the command may run before it is killed (default
+//	             30s)
+//	concurrency  commands running at once (default 1, so they run in the
+//	             order change sets are delivered)
+//
+// The command's environment has the change set's key fields:
+// GO_WATCHER_PATH, GO_WATCHER_STREAM, GO_WATCHER_CHANGESET (its ID),
+// GO_WATCHER_TIME, GO_WATCHER_ADDED, GO_WATCHER_REMOVED,
+// GO_WATCHER_MODIFIED, GO_WATCHER_VOLATILE, GO_WATCHER_CRITICAL (the
+// number of critical changes), GO_WATCHER_ROUTES and GO_WATCHER_TRUNCATED
+// (1 or 0). A command that fails or times out fails the delivery, which
+// is retried from the dead-letter queue like any other.
+type ExecSink struct {
+	name    string
+	command string
+	timeout time.Duration
+	slots   chan struct{}
+}
+
+func newExecSink(u *url.URL) (*ExecSink, error) {
+	s := &ExecSink{name: sinkName(u), timeout: DefaultExecTimeout}
+	if err := s.parse(u.Query()); err != nil {
+		return nil, fmt.Errorf("exec sink %s: %w", s.name, err)
+	}
+	return s, nil
+}
+
+// parse takes the sink's options from q
+func (s *ExecSink) parse(q url.Values) error {
+	if s.command = q.Get("command"); s.command == "" {
+		return errors.New("needs the command, as exec://?command=/path/to/script")
+	}
+	concurrency := DefaultExecConcurrency
+	var err error
+	if v := q.Get("timeout"); v != "" {
+		if s.timeout, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("invalid timeout: %w", err)
+		}
+	}
+	if v := q.Get("concurrency"); v != "" {
+		if concurrency, err = strconv.Atoi(v); err != nil {
+			return fmt.Errorf("invalid concurrency: %w", err)
+		}
+	}
+	if s.timeout <= 0 || concurrency <= 0 {
+		return errors.New("timeout and concurrency must be positive")
+	}
+	s.slots = make(chan struct{}, concurrency)
+	return nil
+}
+
+// execSpec returns the spec of the exec sink of -on-change-exec
+func execSpec(command string, timeout time.Duration, concurrency int) string {
+	q := url.Values{"name": {"on-change-exec"}, "command": {command}}
+	q.Set("timeout", timeout.String())
+	q.Set("concurrency", strconv.Itoa(concurrency))
+	return "exec://?" + q.Encode()
+}
+
+func (s *ExecSink) Name() string { return s.name }
+
+// Deliver runs the command for cs, waiting for a free slot first
+func (s *ExecSink) Deliver(ctx context.Context, cs *ChangeSet) error {
+	sum := cs.Summarize(0)
+	body, err := json.Marshal(auditRecord{ChangeSet: cs, Summary: sum})
+	if err != nil {
+		return fmt.Errorf("failed to encode change set: %w", err)
+	}
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-s.slots }()
+	_, err = runShell(ctx, s.command, s.timeout, bytes.NewReader(body), execEnv(cs, sum))
+	return err
+}
+
+// execEnv returns the environment variables describing cs, whose summary
+// is sum
+func execEnv(cs *ChangeSet, sum Summary) []string {
+	critical := 0
+	for _, c := range cs.Notifiable() {
+		if c.Critical {
+			critical++
+		}
+	}
+	truncated := "0"
+	if cs.Truncated {
+		truncated = "1"
+	}
+	var ts string
+	if !cs.Time.IsZero() {
+		ts = cs.Time.UTC().Format(time.RFC3339Nano)
+	}
+	return []string{
+		"GO_WATCHER_PATH=" + cs.Path,
+		"GO_WATCHER_STREAM=" + cs.Stream,
+		"GO_WATCHER_CHANGESET=" + strconv.FormatUint(cs.ID, 10),
+		"GO_WATCHER_TIME=" + ts,
+		"GO_WATCHER_ADDED=" + strconv.Itoa(sum.Added),
+		"GO_WATCHER_REMOVED=" + strconv.Itoa(sum.Removed),
+		"GO_WATCHER_MODIFIED=" + strconv.Itoa(sum.Modified),
+		"GO_WATCHER_VOLATILE=" + strconv.Itoa(sum.Volatile),
+		"GO_WATCHER_CRITICAL=" + strconv.Itoa(critical),
+		"GO_WATCHER_ROUTES=" + strconv.Itoa(sum.Routes),
+		"GO_WATCHER_TRUNCATED=" + truncated,
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecSink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses /bin/sh")
+	}
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	spec := execSpec("cat > '"+out+".json'; env | grep ^GO_WATCHER_ | sort > '"+out+".env'", 5*time.Second, 1)
+	s, err := newSink(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Name() != "on-change-exec" {
+		t.Errorf("name = %q", s.Name())
+	}
+	cs := &ChangeSet{Stream: "s1", ID: 7, Path: "/data/core.txt", Time: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), Routes: 5, Changes: []Change{
+		{Seq: 1, Type: ChangeAdded, Destination: "10.0.0.0/8", Critical: true},
+		{Seq: 2, Type: ChangeRemoved, Destination: "0.0.0.0/0", Critical: true},
+		{Type: ChangeModified, Destination: "192.0.2.0/24", Volatile: true},
+	}}
+	if err := s.Deliver(context.Background(), cs); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(out + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got auditRecord
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("stdin %q: %v", data, err)
+	}
+	if got.ID != 7 || len(got.Changes) != 3 || got.Summary.Added != 1 {
+		t.Errorf("stdin = %s", data)
+	}
+	env, err := os.ReadFile(out + ".env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `GO_WATCHER_ADDED=1
+GO_WATCHER_CHANGESET=7
+GO_WATCHER_CRITICAL=2
+GO_WATCHER_MODIFIED=0
+GO_WATCHER_PATH=/data/core.txt
+GO_WATCHER_REMOVED=1
+GO_WATCHER_ROUTES=5
+GO_WATCHER_STREAM=s1
+GO_WATCHER_TIME=2024-03-01T12:00:00Z
+GO_WATCHER_TRUNCATED=0
+GO_WATCHER_VOLATILE=1
+`
+	if string(env) != want {
+		t.Errorf("environment:\n%s\nwant:\n%s", env, want)
+	}
+}
+
+func TestExecSinkFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses /bin/sh")
+	}
+	cs := &ChangeSet{Path: "t.txt"}
+	s, err := newSink(execSpec("echo no route to pager >&2; exit 3", time.Second, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deliver(context.Background(), cs); err == nil || !strings.Contains(err.Error(), "exit status 3: no route to pager") {
+		t.Errorf("failing command: %v", err)
+	}
+	s, err = newSink(execSpec("sleep 5", 50*time.Millisecond, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := s.Deliver(context.Background(), cs); err == nil || !strings.Contains(err.Error(), "timed out after 50ms") {
+		t.Errorf("slow command: %v", err)
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("slow command killed after %v", took)
+	}
+}
+
+func TestNewExecSinkErrors(t *testing.T) {
+	for _, q := range []string{
+		"",
+		"command=true&timeout=soon",
+		"command=true&timeout=0s",
+		"command=true&concurrency=0",
+		"command=true&concurrency=many",
+	} {
+		if _, err := newExecSink(&url.URL{Scheme: "exec", RawQuery: q}); err == nil {
+			t.Errorf("exec://?%s: no error", q)
+		}
+	}
+}
@@ -0,0 +1,922 @@
+package main
+
+// Filter expressions: the subset of CEL, the Common Expression Language,
+// that selecting changes needs. Expressions are parsed and checked once,
+// then evaluated per change. As in CEL, && and || ignore an error on one
+// side when the other decides the result, == between values of different
+// types is false, and a missing map key is an error ("Protocol" in
+// change.fields tests for one first).
+//
+// Literals are strings in double or single quotes, integers, true, false
+// and lists in brackets. The operators, loosest first, are ?:, ||, &&,
+// the comparisons == != < <= > >= and in (of a list or map), + - (also
+// joining strings and lists), * / %, and the unary ! and -. Functions are
+// size, int and string, and the string methods contains, startsWith,
+// endsWith, matches (a regular expression), lowerAscii, upperAscii, size
+// and within, which is true for a prefix equal to or inside its argument.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// exprVars are the variables an expression can use
+var exprVars = []string{"change", "prefix", "table", "stream"}
+
+// exprChangeFields are the fields of change
+var exprChangeFields = []string{"type", "destination", "seq", "critical", "volatile", "old_hash", "new_hash", "old", "new", "fields"}
+
+// exprFuncs maps the functions to their numbers of arguments, counting the
+// receiver of methods
+var exprFuncs = map[string]int{
+	"size": 1, "int": 1, "string": 1,
+	"contains": 2, "startsWith": 2, "endsWith": 2, "matches": 2, "within": 2,
+	"lowerAscii": 1, "upperAscii": 1,
+}
+
+// Expr is a parsed filter expression
+type Expr struct {
+	src  string
+	root exprNode
+}
+
+// exprNode is a node of an expression's syntax tree
+type exprNode interface {
+	eval(env *exprEnv) (any, error)
+}
+
+type (
+	exprLit    struct{ v any }
+	exprIdent  struct{ name string }
+	exprSelect struct {
+		x     exprNode
+		field string
+	}
+	exprIndex struct{ x, i exprNode }
+	exprCall  struct {
+		fn   string
+		args []exprNode
+		// re and rules are compiled when matches and within have a literal
+		// argument
+		re    *regexp.Regexp
+		rules *PrefixRules
+	}
+	exprUnary struct {
+		op string
+		x  exprNode
+	}
+	exprBinary struct {
+		op   string
+		l, r exprNode
+	}
+	exprCond struct{ c, t, f exprNode }
+	exprList struct{ elems []exprNode }
+)
+
+// parseExpr parses and checks a filter expression
+func parseExpr(src string) (*Expr, error) {
+	toks, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	root, err := p.cond()
+	if err == nil && p.peek().kind != tokEOF {
+		err = p.errorf("unexpected %s", p.peek())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", src, err)
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+func (e *Expr) String() string { return e.src }
+
+// Match reports whether the expression is true for change c of cs
+func (e *Expr) Match(cs *ChangeSet, c *Change) (bool, error) {
+	v, err := e.root.eval(&exprEnv{cs: cs, c: c})
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression is %s, not bool", exprType(v))
+	}
+	return b, nil
+}
+
+// Tokens
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokIdent
+	tokInt
+	tokString
+	tokOp
+)
+
+type exprToken struct {
+	kind tokKind
+	text string
+	// val is the value of string and integer literals
+	val any
+	pos int
+}
+
+func (t exprToken) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+// exprOps are the operators, longest first so they are lexed greedily
+var exprOps = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "+", "-", "*", "/", "%", "(", ")", "[", "]", ",", ".", "?", ":"}
+
+// lexExpr splits src into tokens
+func lexExpr(src string) ([]exprToken, error) {
+	var toks []exprToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || src[j] >= 'a' && src[j] <= 'z' || src[j] >= 'A' && src[j] <= 'Z' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			toks = append(toks, exprToken{kind: tokIdent, text: src[i:j], pos: i})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i + 1
+			for j < len(src) && src[j] >= '0' && src[j] <= '9' {
+				j++
+			}
+			n, err := strconv.ParseInt(src[i:j], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %s at %d", src[i:j], i)
+			}
+			toks = append(toks, exprToken{kind: tokInt, text: src[i:j], val: n, pos: i})
+			i = j
+		case c == '"' || c == '\'':
+			s, n, err := lexString(src[i:])
+			if err != nil {
+				return nil, fmt.Errorf("%w at %d", err, i)
+			}
+			toks = append(toks, exprToken{kind: tokString, text: src[i : i+n], val: s, pos: i})
+			i += n
+		default:
+			op := ""
+			for _, o := range exprOps {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			toks = append(toks, exprToken{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(toks, exprToken{kind: tokEOF, pos: len(src)}), nil
+}
+
+// lexString reads the quoted string at the start of s, returning its
+// value and length
+func lexString(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; c {
+		case quote:
+			return b.String(), i + 1, nil
+		case '\\':
+			if i++; i == len(s) {
+				break
+			}
+			switch e := s[i]; e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '\\', '"', '\'':
+				b.WriteByte(e)
+			default:
+				return "", 0, fmt.Errorf("unknown escape \\%c", e)
+			}
+		case '\n':
+			return "", 0, errors.New("newline in string")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, errors.New("unterminated string")
+}
+
+// Parsing
+
+type exprParser struct {
+	toks []exprToken
+	pos  int
+}
+
+func (p *exprParser) peek() exprToken { return p.toks[p.pos] }
+
+func (p *exprParser) next() exprToken {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is the operator op
+func (p *exprParser) accept(op string) bool {
+	if t := p.peek(); t.kind == tokOp && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.accept(op) {
+		return p.errorf("expected %q, found %s", op, p.peek())
+	}
+	return nil
+}
+
+func (p *exprParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("%s at %d", fmt.Sprintf(format, args...), p.peek().pos)
+}
+
+// cond parses a conditional, the loosest binding expression
+func (p *exprParser) cond() (exprNode, error) {
+	c, err := p.binary(0)
+	if err != nil || !p.accept("?") {
+		return c, err
+	}
+	t, err := p.cond()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	f, err := p.cond()
+	if err != nil {
+		return nil, err
+	}
+	return &exprCond{c, t, f}, nil
+}
+
+// exprLevels are the binary operators by precedence, loosest first
+var exprLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">=", "in"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// binary parses the operators of exprLevels[level] and tighter ones
+func (p *exprParser) binary(level int) (exprNode, error) {
+	if level == len(exprLevels) {
+		return p.unary()
+	}
+	l, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if (t.kind != tokOp && !(t.kind == tokIdent && t.text == "in")) || !slices.Contains(exprLevels[level], t.text) {
+			return l, nil
+		}
+		p.next()
+		r, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		l = &exprBinary{t.text, l, r}
+	}
+}
+
+func (p *exprParser) unary() (exprNode, error) {
+	for _, op := range []string{"!", "-"} {
+		if p.accept(op) {
+			x, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			return &exprUnary{op, x}, nil
+		}
+	}
+	return p.member()
+}
+
+// member parses a primary expression followed by field selections, method
+// calls and indexes
+func (p *exprParser) member() (exprNode, error) {
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			t := p.next()
+			if t.kind != tokIdent {
+				return nil, p.errorf("expected a field or method name, found %s", t)
+			}
+			if p.accept("(") {
+				args, err := p.args(")")
+				if err != nil {
+					return nil, err
+				}
+				if x, err = p.call(t.text, append([]exprNode{x}, args...)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if id, ok := x.(*exprIdent); ok && id.name == "change" && !slices.Contains(exprChangeFields, t.text) {
+				return nil, p.errorf("change has no field %q (it has %s)", t.text, strings.Join(exprChangeFields, ", "))
+			}
+			x = &exprSelect{x, t.text}
+		case p.accept("["):
+			i, err := p.cond()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &exprIndex{x, i}
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *exprParser) primary() (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokInt, tokString:
+		return &exprLit{t.val}, nil
+	case tokIdent:
+		switch t.text {
+		case "true", "false":
+			return &exprLit{t.text == "true"}, nil
+		}
+		if p.accept("(") {
+			args, err := p.args(")")
+			if err != nil {
+				return nil, err
+			}
+			return p.call(t.text, args)
+		}
+		if !slices.Contains(exprVars, t.text) {
+			return nil, fmt.Errorf("unknown variable %q at %d (known: %s)", t.text, t.pos, strings.Join(exprVars, ", "))
+		}
+		return &exprIdent{t.text}, nil
+	case tokOp:
+		switch t.text {
+		case "(":
+			x, err := p.cond()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		case "[":
+			elems, err := p.args("]")
+			if err != nil {
+				return nil, err
+			}
+			return &exprList{elems}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %s at %d", t, t.pos)
+}
+
+// args parses a comma separated list of expressions up to end
+func (p *exprParser) args(end string) ([]exprNode, error) {
+	var args []exprNode
+	if p.accept(end) {
+		return nil, nil
+	}
+	for {
+		a, err := p.cond()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a)
+		if p.accept(end) {
+			return args, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// call checks a call of fn and compiles its literal arguments
+func (p *exprParser) call(fn string, args []exprNode) (exprNode, error) {
+	n, ok := exprFuncs[fn]
+	if !ok {
+		return nil, p.errorf("unknown function %q", fn)
+	}
+	if len(args) != n {
+		return nil, p.errorf("%s takes %d arguments, not %d", fn, n, len(args))
+	}
+	call := &exprCall{fn: fn, args: args}
+	if lit, ok := args[len(args)-1].(*exprLit); ok {
+		var err error
+		switch s, _ := lit.v.(string); fn {
+		case "matches":
+			call.re, err = regexp.Compile(s)
+		case "within":
+			call.rules, err = exprPrefixRules(s)
+		}
+		if err != nil {
+			return nil, p.errorf("%s: %v", fn, err)
+		}
+	}
+	return call, nil
+}
+
+// exprPrefixRules returns the rules matching prefix and those inside it
+func exprPrefixRules(prefix string) (*PrefixRules, error) {
+	prefix = strings.TrimSuffix(prefix, "+")
+	if _, err := netip.ParsePrefix(prefix); err != nil {
+		return nil, err
+	}
+	return newPrefixRules([]string{prefix + "+"})
+}
+
+// Evaluation
+
+// exprEnv is what an expression is evaluated against
+type exprEnv struct {
+	cs *ChangeSet
+	c  *Change
+}
+
+// exprChange is the value of change
+type exprChange struct{ env *exprEnv }
+
+func (x *exprLit) eval(*exprEnv) (any, error) { return x.v, nil }
+
+func (x *exprIdent) eval(env *exprEnv) (any, error) {
+	switch x.name {
+	case "change":
+		return exprChange{env}, nil
+	case "prefix":
+		return env.c.Destination, nil
+	case "table":
+		return env.cs.Path, nil
+	case "stream":
+		return env.cs.Stream, nil
+	}
+	return nil, fmt.Errorf("unknown variable %q", x.name)
+}
+
+func (x *exprSelect) eval(env *exprEnv) (any, error) {
+	v, err := x.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case exprChange:
+		return v.field(x.field)
+	case map[string]any:
+		f, ok := v[x.field]
+		if !ok {
+			return nil, fmt.Errorf("no such key: %s", x.field)
+		}
+		return f, nil
+	}
+	return nil, fmt.Errorf("%s has no fields", exprType(v))
+}
+
+// field returns a field of the change
+func (ch exprChange) field(name string) (any, error) {
+	c := ch.env.c
+	switch name {
+	case "type":
+		return string(c.Type), nil
+	case "destination":
+		return c.Destination, nil
+	case "seq":
+		return int64(c.Seq), nil
+	case "critical":
+		return c.Critical, nil
+	case "volatile":
+		return c.Volatile, nil
+	case "old_hash":
+		return c.OldHash, nil
+	case "new_hash":
+		return c.NewHash, nil
+	case "old":
+		return chunkText(c.Old), nil
+	case "new":
+		return chunkText(c.New), nil
+	case "fields":
+		fields := make(map[string]any)
+		for _, line := range strings.Split(chunkText(c.Chunk()), "\n") {
+			for _, f := range parseFields(line) {
+				fields[f.Name] = f.Value
+			}
+		}
+		return fields, nil
+	}
+	return nil, fmt.Errorf("change has no field %q", name)
+}
+
+func (x *exprIndex) eval(env *exprEnv) (any, error) {
+	v, err := x.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	i, err := x.i.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case []any:
+		n, ok := i.(int64)
+		if !ok {
+			return nil, fmt.Errorf("list index is %s, not int", exprType(i))
+		}
+		if n < 0 || n >= int64(len(v)) {
+			return nil, fmt.Errorf("index %d out of range", n)
+		}
+		return v[n], nil
+	case map[string]any:
+		k, ok := i.(string)
+		if !ok {
+			return nil, fmt.Errorf("map key is %s, not string", exprType(i))
+		}
+		f, ok := v[k]
+		if !ok {
+			return nil, fmt.Errorf("no such key: %s", k)
+		}
+		return f, nil
+	}
+	return nil, fmt.Errorf("%s can't be indexed", exprType(v))
+}
+
+func (x *exprList) eval(env *exprEnv) (any, error) {
+	list := make([]any, len(x.elems))
+	for i, e := range x.elems {
+		v, err := e.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = v
+	}
+	return list, nil
+}
+
+func (x *exprCond) eval(env *exprEnv) (any, error) {
+	c, err := x.c.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := c.(bool)
+	if !ok {
+		return nil, fmt.Errorf("condition is %s, not bool", exprType(c))
+	}
+	if b {
+		return x.t.eval(env)
+	}
+	return x.f.eval(env)
+}
+
+func (x *exprUnary) eval(env *exprEnv) (any, error) {
+	v, err := x.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case bool:
+		if x.op == "!" {
+			return !v, nil
+		}
+	case int64:
+		if x.op == "-" {
+			return -v, nil
+		}
+	}
+	return nil, fmt.Errorf("no operator %s%s", x.op, exprType(v))
+}
+
+func (x *exprBinary) eval(env *exprEnv) (any, error) {
+	if x.op == "&&" || x.op == "||" {
+		return x.logical(env)
+	}
+	l, err := x.l.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	r, err := x.r.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch x.op {
+	case "==":
+		return exprEqual(l, r), nil
+	case "!=":
+		return !exprEqual(l, r), nil
+	case "in":
+		switch r := r.(type) {
+		case []any:
+			return slices.ContainsFunc(r, func(e any) bool { return exprEqual(l, e) }), nil
+		case map[string]any:
+			k, ok := l.(string)
+			_, found := r[k]
+			return ok && found, nil
+		}
+	}
+	switch l := l.(type) {
+	case int64:
+		if r, ok := r.(int64); ok {
+			return exprInts(x.op, l, r)
+		}
+	case string:
+		if r, ok := r.(string); ok {
+			switch x.op {
+			case "+":
+				return l + r, nil
+			case "<":
+				return l < r, nil
+			case "<=":
+				return l <= r, nil
+			case ">":
+				return l > r, nil
+			case ">=":
+				return l >= r, nil
+			}
+		}
+	case []any:
+		if r, ok := r.([]any); ok && x.op == "+" {
+			return append(append([]any(nil), l...), r...), nil
+		}
+	}
+	return nil, fmt.Errorf("no operator %s %s %s", exprType(l), x.op, exprType(r))
+}
+
+// logical evaluates && and ||, which, as in CEL, give the result of one
+// side if it decides it even when the other fails
+func (x *exprBinary) logical(env *exprEnv) (any, error) {
+	decides := x.op == "||"
+	side := func(n exprNode) (bool, error) {
+		v, err := n.eval(env)
+		if err != nil {
+			return false, err
+		}
+		b, ok := v.(bool)
+		if !ok {
+			return false, fmt.Errorf("no operator %s %s", exprType(v), x.op)
+		}
+		return b, nil
+	}
+	l, lerr := side(x.l)
+	if lerr == nil && l == decides {
+		return decides, nil
+	}
+	r, rerr := side(x.r)
+	switch {
+	case rerr == nil && r == decides:
+		return decides, nil
+	case lerr != nil:
+		return nil, lerr
+	case rerr != nil:
+		return nil, rerr
+	}
+	return !decides, nil
+}
+
+// exprInts applies an arithmetic or comparison operator to integers
+func exprInts(op string, l, r int64) (any, error) {
+	switch op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/", "%":
+		if r == 0 {
+			return nil, errors.New("division by zero")
+		}
+		if op == "/" {
+			return l / r, nil
+		}
+		return l % r, nil
+	case "<":
+		return l < r, nil
+	case "<=":
+		return l <= r, nil
+	case ">":
+		return l > r, nil
+	case ">=":
+		return l >= r, nil
+	}
+	return nil, fmt.Errorf("no operator int %s int", op)
+}
+
+// exprEqual reports whether two values are equal; values of different
+// types never are
+func exprEqual(a, b any) bool {
+	switch a := a.(type) {
+	case []any:
+		b, ok := b.([]any)
+		return ok && slices.EqualFunc(a, b, exprEqual)
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			if w, ok := b[k]; !ok || !exprEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case exprChange:
+		return false
+	}
+	return a == b
+}
+
+func (x *exprCall) eval(env *exprEnv) (any, error) {
+	args := make([]any, len(x.args))
+	for i, a := range x.args {
+		v, err := a.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	switch x.fn {
+	case "size":
+		switch v := args[0].(type) {
+		case string:
+			return int64(len([]rune(v))), nil
+		case []any:
+			return int64(len(v)), nil
+		case map[string]any:
+			return int64(len(v)), nil
+		}
+	case "int":
+		switch v := args[0].(type) {
+		case int64:
+			return v, nil
+		case string:
+			n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("int(%q): not an integer", v)
+			}
+			return n, nil
+		}
+	case "string":
+		switch v := args[0].(type) {
+		case string:
+			return v, nil
+		case int64:
+			return strconv.FormatInt(v, 10), nil
+		case bool:
+			return strconv.FormatBool(v), nil
+		}
+	default:
+		s, ok := args[0].(string)
+		if !ok {
+			break
+		}
+		if len(args) == 1 {
+			if x.fn == "lowerAscii" {
+				return exprMapASCII(s, 'A', 'Z', 'a'-'A'), nil
+			}
+			return exprMapASCII(s, 'a', 'z', 'A'-'a'), nil
+		}
+		arg, ok := args[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("%s takes a string, not %s", x.fn, exprType(args[1]))
+		}
+		return x.stringMethod(s, arg)
+	}
+	return nil, fmt.Errorf("no function %s(%s)", x.fn, exprType(args[0]))
+}
+
+// stringMethod applies a string method taking a string to s
+func (x *exprCall) stringMethod(s, arg string) (any, error) {
+	switch x.fn {
+	case "contains":
+		return strings.Contains(s, arg), nil
+	case "startsWith":
+		return strings.HasPrefix(s, arg), nil
+	case "endsWith":
+		return strings.HasSuffix(s, arg), nil
+	case "matches":
+		re := x.re
+		if re == nil {
+			var err error
+			if re, err = regexp.Compile(arg); err != nil {
+				return nil, fmt.Errorf("matches: %w", err)
+			}
+		}
+		return re.MatchString(s), nil
+	case "within":
+		rules := x.rules
+		if rules == nil {
+			var err error
+			if rules, err = exprPrefixRules(arg); err != nil {
+				return nil, fmt.Errorf("within: %w", err)
+			}
+		}
+		return rules.Match(s), nil
+	}
+	return nil, fmt.Errorf("no method string.%s", x.fn)
+}
+
+// exprMapASCII shifts the ASCII letters from lo to hi in s by delta
+func exprMapASCII(s string, lo, hi byte, delta int) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= lo && c <= hi {
+			b[i] = byte(int(c) + delta)
+		}
+	}
+	return string(b)
+}
+
+// exprType names the type of a value in errors
+func exprType(v any) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case int64:
+		return "int"
+	case bool:
+		return "bool"
+	case []any:
+		return "list"
+	case map[string]any:
+		return "map"
+	case exprChange:
+		return "change"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// ExprFilter leaves out the changes an expression is false for, before
+// they are reported and delivered. Changes it fails on are kept.
+type ExprFilter struct {
+	expr *Expr
+}
+
+// newExprFilter builds the filter of a -filter expression
+func newExprFilter(src string) (*ExprFilter, error) {
+	e, err := parseExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	return &ExprFilter{expr: e}, nil
+}
+
+// Enrich drops the changes of cs the expression is false for
+func (f *ExprFilter) Enrich(ctx context.Context, cs *ChangeSet) error {
+	var failed int
+	var first error
+	kept := cs.Changes[:0]
+	for _, c := range cs.Changes {
+		ok, err := f.expr.Match(cs, &c)
+		if err != nil {
+			if failed++; first == nil {
+				first = fmt.Errorf("%s: %w", c.Destination, err)
+			}
+			ok = true
+		}
+		if ok {
+			kept = append(kept, c)
+		}
+	}
+	cs.Changes = kept
+	if failed > 0 {
+		return fmt.Errorf("filter %q failed on %d changes, which were kept; the first: %w", f.expr, failed, first)
+	}
+	return nil
+}
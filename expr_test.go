@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestExprMatch(t *testing.T) {
+	cs := pluginChangeSetSample(t)
+	added, modified, removed := &cs.Changes[0], &cs.Changes[1], &cs.Changes[2]
+	for _, tt := range []struct {
+		src  string
+		c    *Change
+		want bool
+	}{
+		{`change.type == "removed" && prefix.contains("192.0.")`, removed, true},
+		{`change.type == "removed" && prefix.contains("10.0.")`, removed, false},
+		{`change.type in ['added', 'modified']`, modified, true},
+		{`prefix.within("10.0.0.0/8")`, added, true},
+		{`prefix.within("10.0.0.0/16")`, added, false},
+		{`prefix.within("0.0.0.0/0")`, removed, true},
+		{`change.fields.Protocol == "IBGP"`, added, true},
+		{`change.fields["NextHop"].startsWith("172.31.") && change.fields.Protocol != "Static"`, modified, false},
+		{`change.new.matches("(?m)^Destination: 10\\.")`, added, true},
+		{`"Protocol" in change.fields`, removed, false},
+		// The missing field is an error, but || doesn't need it
+		{`change.fields.Protocol == "Static" || change.type == "removed"`, removed, true},
+		{`change.seq * 2 + 1 >= 3 && change.seq % 2 == 0`, modified, true},
+		{`size(prefix) == 10 && prefix.size() == 10`, added, true},
+		{`int("12") - 2 == 10 && string(change.seq) == "3"`, removed, true},
+		{`change.type == 1`, added, false},
+		{`!change.critical ? change.type.upperAscii() == "ADDED" : false`, added, true},
+		{`table.endsWith(".txt") && stream == "s"`, added, true},
+		{`size([1, 2] + [3]) == 3 && [1, "a"][1] == 'a'`, added, true},
+	} {
+		e, err := parseExpr(tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		got, err := e.Match(cs, tt.c)
+		if err != nil || got != tt.want {
+			t.Errorf("%s on %s = %v, %v; want %v", tt.src, tt.c.Destination, got, err, tt.want)
+		}
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	for _, src := range []string{
+		``,
+		`change.kind == "added"`,
+		`route == 1`,
+		`prefix.startswith("10")`,
+		`prefix.contains()`,
+		`prefix.matches("(")`,
+		`prefix.within("10.0.0.0")`,
+		`(change.seq == 1`,
+		`"unterminated`,
+		`change.seq == 1 1`,
+		`a ~ b`,
+	} {
+		if _, err := parseExpr(src); err == nil {
+			t.Errorf("%s: no error", src)
+		}
+	}
+
+	cs := pluginChangeSetSample(t)
+	for _, src := range []string{
+		`change.fields.Protocol == "IBGP"`,
+		`change.seq / 0 == 1`,
+		`change.seq`,
+		`prefix + 1 == "x"`,
+		`change.fields.Protocol == "IBGP" && true`,
+	} {
+		e, err := parseExpr(src)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if got, err := e.Match(cs, &cs.Changes[2]); err == nil {
+			t.Errorf("%s = %v, want an error", src, got)
+		}
+	}
+}
+
+func TestExprFilter(t *testing.T) {
+	f, err := newExprFilter(`change.type != "modified" && change.fields.Protocol == "IBGP"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := pluginChangeSetSample(t)
+	// The removed change has no content, so no fields, and is kept
+	err = f.Enrich(context.Background(), cs)
+	if err == nil || !strings.Contains(err.Error(), "failed on 1 changes") || !strings.Contains(err.Error(), "192.0.2.0/24: no such key: Protocol") {
+		t.Errorf("error = %v", err)
+	}
+	if got := changeSummary(cs); strings.Join(got, ", ") != "added 10.0.0.0/8, removed 192.0.2.0/24" {
+		t.Errorf("changes kept: %v", got)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// FileMeta is the stat metadata of a table file. Some pipelines signal new
+// data by touching the file's mode or owner rather than its content.
+type FileMeta struct {
+	Mode    string    `json:"mode"`
+	UID     int       `json:"uid"`
+	GID     int       `json:"gid"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// statMeta returns the metadata of the file at path. The owner is -1 where
+// the platform doesn't report one.
+func statMeta(path string) (*FileMeta, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return fileMeta(info), nil
+}
+
+func fileMeta(info os.FileInfo) *FileMeta {
+	uid, gid := fileOwner(info)
+	return &FileMeta{
+		Mode:    info.Mode().String(),
+		UID:     uid,
+		GID:     gid,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+}
+
+// sameAttrs reports whether m and o have the same mode and owner
+func (m *FileMeta) sameAttrs(o *FileMeta) bool {
+	return m.Mode == o.Mode && m.UID == o.UID && m.GID == o.GID
+}
+
+// changes describes how the metadata differs from prev, e.g.
+// "mode -rw-r--r-- -> -rw-------"
+func (m *FileMeta) changes(prev *FileMeta) []string {
+	var out []string
+	if m.Mode != prev.Mode {
+		out = append(out, fmt.Sprintf("mode %s -> %s", prev.Mode, m.Mode))
+	}
+	if m.UID != prev.UID || m.GID != prev.GID {
+		out = append(out, fmt.Sprintf("owner %d:%d -> %d:%d", prev.UID, prev.GID, m.UID, m.GID))
+	}
+	if !m.ModTime.Equal(prev.ModTime) {
+		out = append(out, fmt.Sprintf("mtime %s -> %s", prev.ModTime.Format(time.RFC3339), m.ModTime.Format(time.RFC3339)))
+	}
+	return out
+}
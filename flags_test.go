@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestByteSize(t *testing.T) {
+	for in, want := range map[string]int64{
+		"0":     0,
+		"1500":  1500,
+		"64K":   64 << 10,
+		"512MB": 512 << 20,
+		"2GiB":  2 << 30,
+		" 1t ":  1 << 40,
+		"100B":  100,
+	} {
+		var b byteSize
+		if err := b.Set(in); err != nil {
+			t.Errorf("%q: %v", in, err)
+			continue
+		}
+		if int64(b) != want {
+			t.Errorf("%q = %d, want %d", in, b, want)
+		}
+	}
+	for _, in := range []string{"", "-1", "1.5G", "12X", "99999999999T"} {
+		var b byteSize
+		if err := b.Set(in); err == nil {
+			t.Errorf("%q accepted as %d", in, b)
+		}
+	}
+	if s := byteSize(2 << 30); s.String() != "2G" {
+		t.Errorf("String() = %q", s.String())
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import "fmt"
+
+// FSInfo describes the filesystem holding a watched file and whether
+// fsnotify can be trusted on it
+type FSInfo struct {
+	Type string `json:"type"`
+	// Reliable is false where fsnotify is known to miss changes
+	Reliable bool `json:"reliable"`
+	// Reason explains why fsnotify is unreliable
+	Reason string `json:"reason,omitempty"`
+}
+
+func (fi FSInfo) String() string {
+	if fi.Reliable {
+		return fi.Type
+	}
+	return fmt.Sprintf("%s (%s)", fi.Type, fi.Reason)
+}
+
+// Watch mechanisms
+const (
+	WatchAuto     = "auto"
+	WatchFsnotify = "fsnotify"
+	WatchPoll     = "poll"
+)
+
+// chooseMechanism resolves a -watch-mode value for a file on fi. Auto
+// picks polling where fsnotify is unreliable.
+func chooseMechanism(mode string, fi FSInfo) (string, error) {
+	switch mode {
+	case WatchFsnotify, WatchPoll:
+		return mode, nil
+	case WatchAuto, "":
+		if fi.Reliable {
+			return WatchFsnotify, nil
+		}
+		return WatchPoll, nil
+	}
+	return "", fmt.Errorf("unknown watch mode %q (want auto, fsnotify or poll)", mode)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Filesystem magic numbers from statfs(2)
+var linuxFilesystems = map[uint32]FSInfo{
+	0xEF53:     {Type: "ext4", Reliable: true},
+	0x58465342: {Type: "xfs", Reliable: true},
+	0x9123683E: {Type: "btrfs", Reliable: true},
+	0x01021994: {Type: "tmpfs", Reliable: true},
+	0x2FC12FC1: {Type: "zfs", Reliable: true},
+	0x6969:     {Type: "nfs", Reason: "network filesystem; changes made by other hosts raise no events"},
+	0x517B:     {Type: "smb", Reason: "network filesystem; changes made by other hosts raise no events"},
+	0xFF534D42: {Type: "cifs", Reason: "network filesystem; changes made by other hosts raise no events"},
+	0xFE534D42: {Type: "smb2", Reason: "network filesystem; changes made by other hosts raise no events"},
+	0x00C36400: {Type: "ceph", Reason: "network filesystem; changes made by other hosts raise no events"},
+	0x01021997: {Type: "9p", Reason: "host share; changes made on the host raise no events"},
+	0x786F4256: {Type: "vboxsf", Reason: "host share; changes made on the host raise no events"},
+	0x65735546: {Type: "fuse", Reason: "FUSE filesystems often raise no events"},
+	0x794C7630: {Type: "overlayfs", Reason: "changes to lower layers raise no events"},
+}
+
+// detectFilesystem reports the type of the filesystem holding path
+func detectFilesystem(path string) (FSInfo, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(filepath.Dir(path), &st); err != nil {
+		return FSInfo{Type: "unknown", Reliable: true}, fmt.Errorf("statfs: %w", err)
+	}
+	if fi, ok := linuxFilesystems[uint32(st.Type)]; ok {
+		return fi, nil
+	}
+	return FSInfo{Type: fmt.Sprintf("0x%X", uint32(st.Type)), Reliable: true}, nil
+}
+
+// fileOwner returns the user and group owning a file
+func fileOwner(info os.FileInfo) (uid, gid int) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(st.Uid), int(st.Gid)
+	}
+	return -1, -1
+}
+
+// inotifyLimitError explains the errors inotify returns when a kernel
+// limit is reached, which otherwise read as "no space left on device" and
+// "too many open files"
+func inotifyLimitError(err error) error {
+	switch {
+	case errors.Is(err, syscall.ENOSPC):
+		return fmt.Errorf("%w (inotify watch limit reached: fs.inotify.max_user_watches = %s; raise it with sysctl or use -watch-mode poll)", err, inotifyLimit("max_user_watches"))
+	case errors.Is(err, syscall.EMFILE):
+		return fmt.Errorf("%w (inotify instance limit reached: fs.inotify.max_user_instances = %s; raise it with sysctl or use -watch-mode poll)", err, inotifyLimit("max_user_instances"))
+	}
+	return err
+}
+
+// inotifyLimit reads an inotify limit from /proc
+func inotifyLimit(name string) string {
+	data, err := os.ReadFile("/proc/sys/fs/inotify/" + name)
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// detectFilesystem can't identify filesystems on this platform, so it
+// assumes fsnotify works
+func detectFilesystem(path string) (FSInfo, error) {
+	return FSInfo{Type: "unknown", Reliable: true}, nil
+}
+
+// fileOwner can't read file owners on this platform
+func fileOwner(info os.FileInfo) (uid, gid int) {
+	return -1, -1
+}
+
+// inotifyLimitError returns err unchanged; there is no inotify here
+func inotifyLimitError(err error) error {
+	return err
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestChooseMechanism(t *testing.T) {
+	local := FSInfo{Type: "ext4", Reliable: true}
+	nfs := FSInfo{Type: "nfs", Reason: "network filesystem"}
+	tests := []struct {
+		mode string
+		fi   FSInfo
+		want string
+	}{
+		{WatchAuto, local, WatchFsnotify},
+		{WatchAuto, nfs, WatchPoll},
+		{WatchFsnotify, nfs, WatchFsnotify},
+		{WatchPoll, local, WatchPoll},
+	}
+	for _, tt := range tests {
+		got, err := chooseMechanism(tt.mode, tt.fi)
+		if err != nil || got != tt.want {
+			t.Errorf("chooseMechanism(%s, %s) = %s, %v; want %s", tt.mode, tt.fi, got, err, tt.want)
+		}
+	}
+	if _, err := chooseMechanism("inotify", local); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
+
+func TestDetectFilesystem(t *testing.T) {
+	fi, err := detectFilesystem(filepath.Join(t.TempDir(), "t.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Type == "" || (!fi.Reliable && fi.Reason == "") {
+		t.Errorf("filesystem = %+v", fi)
+	}
+}
+
+func TestInotifyLimitError(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("inotify is Linux only")
+	}
+	err := inotifyLimitError(fmt.Errorf("/data: %w", syscall.ENOSPC))
+	if !errors.Is(err, syscall.ENOSPC) || !strings.Contains(err.Error(), "fs.inotify.max_user_watches") {
+		t.Errorf("error = %v", err)
+	}
+	if err := inotifyLimitError(os.ErrPermission); err != os.ErrPermission {
+		t.Errorf("unrelated error rewritten: %v", err)
+	}
+}
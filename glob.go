@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DefaultGlobRescan is how often a GlobWatcher re-lists its directory in
+// case a directory event was missed
+const DefaultGlobRescan = 30 * time.Second
+
+// isGlob reports whether a -file value is a pattern rather than a path
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// GlobWatcher keeps track of the files matching a pattern, calling OnAdd
+// for files that start matching and OnRemove for files that stop. Only the
+// file name of the pattern may contain wildcards; its directory is watched
+// for files being created, removed and renamed, and re-listed every
+// Interval as well.
+type GlobWatcher struct {
+	// OnAdd is called with each file that appears, including those
+	// matching when the watcher starts. A file it returns an error for is
+	// offered again on the next scan.
+	OnAdd func(path string) error
+	// OnRemove is called with each file that disappears
+	OnRemove func(path string)
+	// OnError is called for errors listing or watching the directory
+	OnError func(error)
+	// Interval is how often the directory is re-listed regardless of
+	// events (0 for DefaultGlobRescan)
+	Interval time.Duration
+	// Exclude lists file name patterns, such as "*.swp", of matching files
+	// to leave alone
+	Exclude []string
+
+	pattern   string
+	coalescer *Coalescer
+
+	watchMu  sync.Mutex
+	dirWatch *dirWatch
+
+	// mu serializes scans, so files are reported in the order they came
+	// and went
+	mu    sync.Mutex
+	known map[string]bool
+	stop  chan struct{}
+	once  sync.Once
+}
+
+// NewGlobWatcher creates a watcher for pattern. Directory events are
+// coalesced for the quiet period before the directory is re-listed, so a
+// file being written out isn't picked up half-way.
+func NewGlobWatcher(pattern string, quiet time.Duration) (*GlobWatcher, error) {
+	pattern = filepath.Clean(pattern)
+	dir := filepath.Dir(pattern)
+	if isGlob(dir) {
+		return nil, fmt.Errorf("only the file name of pattern %s may contain wildcards", pattern)
+	}
+	if _, err := filepath.Match(filepath.Base(pattern), ""); err != nil {
+		return nil, fmt.Errorf("bad pattern %s: %w", pattern, err)
+	}
+	watch, err := sharedWatchPool.Watch(dir)
+	if err != nil {
+		return nil, err
+	}
+	g := &GlobWatcher{
+		OnAdd:    func(string) error { return nil },
+		OnRemove: func(string) {},
+		OnError:  func(err error) { slog.Error("pattern watcher error", "err", err) },
+		pattern:  pattern,
+		dirWatch: watch,
+		known:    make(map[string]bool),
+		stop:     make(chan struct{}),
+	}
+	g.coalescer = NewCoalescer(quiet, func(int) { g.Scan() })
+	return g, nil
+}
+
+// Start lists the matching files and then follows the directory until
+// ctx is cancelled or the watcher is closed
+func (g *GlobWatcher) Start(ctx context.Context) error {
+	g.Scan()
+	interval := g.Interval
+	if interval <= 0 {
+		interval = DefaultGlobRescan
+	}
+	go g.watch(ctx, interval)
+	return nil
+}
+
+func (g *GlobWatcher) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	w := g.currentWatch()
+	for {
+		// A nil watch blocks its cases until the directory is watched
+		// again
+		var events <-chan fsnotify.Event
+		var errs <-chan error
+		var done <-chan struct{}
+		if w != nil {
+			events, errs, done = w.Events, w.Errors, w.Done
+		}
+		select {
+		case <-ctx.Done():
+			g.Close()
+			return
+		case <-g.stop:
+			return
+		case <-ticker.C:
+			if w == nil {
+				w = g.resubscribe()
+			}
+			g.Scan()
+		case <-done:
+			// The pooled watcher's event stream ended; rely on rescans
+			// until the directory can be watched again
+			g.OnError(ErrWatcherClosed)
+			w = g.resubscribe()
+			g.Scan()
+		case event := <-events:
+			// Writes to matching files are their own watchers' business
+			if event.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 && !g.excluded(event.Name) {
+				g.coalescer.Event()
+			}
+		case err := <-errs:
+			g.OnError(err)
+		}
+	}
+}
+
+func (g *GlobWatcher) currentWatch() *dirWatch {
+	g.watchMu.Lock()
+	defer g.watchMu.Unlock()
+	return g.dirWatch
+}
+
+// resubscribe watches the pattern's directory again after the pooled
+// watcher failed, returning nil if it still can't be watched
+func (g *GlobWatcher) resubscribe() *dirWatch {
+	w, err := sharedWatchPool.Watch(filepath.Dir(g.pattern))
+	if err != nil {
+		g.OnError(err)
+		return nil
+	}
+	g.watchMu.Lock()
+	defer g.watchMu.Unlock()
+	select {
+	case <-g.stop:
+		w.Close()
+		return nil
+	default:
+	}
+	g.dirWatch = w
+	return w
+}
+
+// Scan lists the regular files matching the pattern and reports those
+// added and removed since the last scan
+func (g *GlobWatcher) Scan() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	matches, err := filepath.Glob(g.pattern)
+	if err != nil {
+		g.OnError(fmt.Errorf("failed to list %s: %w", g.pattern, err))
+		return
+	}
+	current := make(map[string]bool, len(matches))
+	for _, m := range matches {
+		if g.excluded(m) {
+			continue
+		}
+		if info, err := os.Stat(m); err == nil && info.Mode().IsRegular() {
+			current[filepath.Clean(m)] = true
+		}
+	}
+
+	var added, removed []string
+	for path := range current {
+		if !g.known[path] {
+			added = append(added, path)
+		}
+	}
+	for path := range g.known {
+		if !current[path] {
+			removed = append(removed, path)
+		}
+	}
+	g.known = current
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	for _, path := range removed {
+		g.OnRemove(path)
+	}
+	for _, path := range added {
+		if err := g.OnAdd(path); err != nil {
+			delete(g.known, path)
+		}
+	}
+}
+
+// excluded reports whether path matches one of the Exclude patterns
+func (g *GlobWatcher) excluded(path string) bool {
+	name := filepath.Base(path)
+	for _, pattern := range g.Exclude {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExclude parses a comma separated list of file name patterns
+func parseExclude(s string) ([]string, error) {
+	patterns := splitList(s)
+	for _, p := range patterns {
+		if strings.ContainsRune(p, filepath.Separator) {
+			return nil, fmt.Errorf("pattern %q must match file names, not paths", p)
+		}
+		if _, err := filepath.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %w", p, err)
+		}
+	}
+	return patterns, nil
+}
+
+// Close stops watching the directory
+func (g *GlobWatcher) Close() error {
+	var err error
+	g.once.Do(func() {
+		g.watchMu.Lock()
+		close(g.stop)
+		w := g.dirWatch
+		g.watchMu.Unlock()
+		g.coalescer.Stop()
+		err = w.Close()
+	})
+	return err
+}
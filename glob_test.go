@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGlobWatcher(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewGlobWatcher(filepath.Join(dir, "*.txt"), 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var added, removed []string
+	g.OnAdd = func(path string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		added = append(added, filepath.Base(path))
+		return nil
+	}
+	g.OnRemove = func(path string) {
+		mu.Lock()
+		defer mu.Unlock()
+		removed = append(removed, filepath.Base(path))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	g.Start(ctx)
+	seen := func(list *[]string, want ...string) func() bool {
+		return func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return slices.Equal(*list, want)
+		}
+	}
+	waitFor(t, "existing file", seen(&added, "a.txt"))
+
+	// Only new regular files matching the pattern are picked up
+	for _, name := range []string{"b.txt", "notes.md"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "old.txt"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "new file", seen(&added, "a.txt", "b.txt"))
+
+	if err := os.Remove(filepath.Join(dir, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "removed file", seen(&removed, "a.txt"))
+}
+
+func TestGlobWatcherRetry(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewGlobWatcher(filepath.Join(dir, "*.txt"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	var offers int
+	g.OnAdd = func(string) error {
+		offers++
+		if offers == 1 {
+			return errors.New("half written")
+		}
+		return nil
+	}
+	g.Scan()
+	g.Scan()
+	g.Scan()
+	if offers != 2 {
+		t.Errorf("file offered %d times, want once more after the failure", offers)
+	}
+}
+
+func TestGlobWatcherPattern(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := NewGlobWatcher(filepath.Join(dir, "*", "t.txt"), 0); err == nil {
+		t.Error("wildcard in the directory accepted")
+	}
+	if _, err := NewGlobWatcher(filepath.Join(dir, "[.txt"), 0); err == nil {
+		t.Error("malformed pattern accepted")
+	}
+}
+
+func TestGlobWatcherExclude(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"core", "core.swp", "core.bak", "core~"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	excludes, err := parseExclude("*.swp, *.bak,*~")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewGlobWatcher(filepath.Join(dir, "core*"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.Exclude = excludes
+	var added []string
+	g.OnAdd = func(path string) error {
+		added = append(added, filepath.Base(path))
+		return nil
+	}
+	g.Scan()
+	if !slices.Equal(added, []string{"core"}) {
+		t.Errorf("added %v, want only core", added)
+	}
+
+	if _, err := parseExclude("backups/*.bak"); err == nil {
+		t.Error("path pattern accepted")
+	}
+}
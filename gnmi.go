@@ -0,0 +1,420 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gnmiBatchSize is the most routes updated or deleted in one
+// notification, which keeps notifications of whole tables well under
+// gRPC's usual 4 MiB message limit
+const gnmiBatchSize = 500
+
+// GNMIServer serves the watched tables as gNMI telemetry, so collectors
+// that already subscribe to routers, such as gnmic or Telegraf's gnmi
+// input, take in go-watcher's changes the same way. It implements the
+// Capabilities and Subscribe RPCs of the gNMI service, over gRPC on
+// HTTP/2, with TLS when -tls-cert is set. Routes are at
+//
+//	/tables/table[name=PATH]/route[prefix=DEST]/hash      the route's hash
+//	/tables/table[name=PATH]/route[prefix=DEST]/content   its text
+//	/tables/table[name=PATH]/routes                       the table's size
+//
+// Subscriptions select paths as gNMI does, with * for any element name or
+// key value, a missing key for any value and ... for any elements after.
+// STREAM subscriptions get the current routes, unless updates_only is
+// set, the sync response and then, for every change set, a notification
+// updating the added and modified routes and deleting the removed ones.
+// Every subscription mode is sent changes as they happen, as ON_CHANGE.
+// ONCE subscriptions get the current routes and the sync response, and
+// POLL ones the same for every poll.
+type GNMIServer struct {
+	// Targets returns the targets being watched
+	Targets func() []*Target
+	Feed    *ChangeFeed
+}
+
+// gnmiSubscription is the subscription of a Subscribe RPC
+type gnmiSubscription struct {
+	mode        int
+	encoding    int
+	updatesOnly bool
+	// target is echoed in the prefix of every notification
+	target string
+	// paths are the subscribed paths, with the list's prefix
+	paths [][]gnmiElem
+}
+
+// Handler returns the server's HTTP handler, to be served over HTTP/2
+func (g *GNMIServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /gnmi.gNMI/Capabilities", g.capabilities)
+	mux.HandleFunc("POST /gnmi.gNMI/Subscribe", g.subscribe)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if grpcStart(w, r) {
+			grpcFinish(w, &grpcError{grpcUnimplemented, "unknown method " + r.URL.Path})
+		}
+	})
+	return mux
+}
+
+// grpcStart checks that r is a gRPC request and sends the headers of the
+// response, reporting whether to go on
+func grpcStart(w http.ResponseWriter, r *http.Request) bool {
+	if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return false
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	// Send the headers now, as clients wait for them before streaming
+	// their requests
+	http.NewResponseController(w).Flush()
+	return true
+}
+
+// grpcFinish ends an RPC with the status of err
+func grpcFinish(w http.ResponseWriter, err error) {
+	code, msg := grpcOK, ""
+	var ge *grpcError
+	switch {
+	case errors.As(err, &ge):
+		code, msg = ge.code, ge.msg
+	case err != nil:
+		code, msg = grpcInternal, err.Error()
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set("Grpc-Message", grpcEscape(msg))
+	}
+}
+
+// grpcSend sends a response message straight away
+func grpcSend(w http.ResponseWriter, msg []byte) error {
+	if _, err := w.Write(grpcFrame(msg)); err != nil {
+		return err
+	}
+	return http.NewResponseController(w).Flush()
+}
+
+func (g *GNMIServer) capabilities(w http.ResponseWriter, r *http.Request) {
+	if !grpcStart(w, r) {
+		return
+	}
+	_, err := readGRPCMessage(r.Body)
+	if err == nil {
+		err = grpcSend(w, marshalGNMICapabilities())
+	}
+	grpcFinish(w, err)
+}
+
+func (g *GNMIServer) subscribe(w http.ResponseWriter, r *http.Request) {
+	if !grpcStart(w, r) {
+		return
+	}
+	grpcFinish(w, g.serveSubscribe(w, r))
+}
+
+// serveSubscribe sends the notifications of the subscription r makes
+func (g *GNMIServer) serveSubscribe(w http.ResponseWriter, r *http.Request) error {
+	msg, err := readGRPCMessage(r.Body)
+	if err == io.EOF {
+		return &grpcError{grpcInvalidArgument, "no subscription"}
+	}
+	if err != nil {
+		return err
+	}
+	req, err := decodeGNMISubscribeRequest(msg)
+	if err != nil {
+		return &grpcError{grpcInvalidArgument, err.Error()}
+	}
+	if req.List == nil {
+		return &grpcError{grpcInvalidArgument, "the first request must be a subscription list"}
+	}
+	sub, err := newGNMISubscription(req.List)
+	if err != nil {
+		return err
+	}
+	send := func(n *gnmiNotification) error {
+		return grpcSend(w, marshalGNMISubscribeResponse(n))
+	}
+
+	switch sub.mode {
+	case gnmiOnce:
+		if err := g.sendState(sub, send); err != nil {
+			return err
+		}
+		return send(nil)
+	case gnmiPoll:
+		for {
+			msg, err := readGRPCMessage(r.Body)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if req, err := decodeGNMISubscribeRequest(msg); err != nil || !req.Poll {
+				return &grpcError{grpcInvalidArgument, "a POLL subscription takes only polls"}
+			}
+			if err := g.sendState(sub, send); err != nil {
+				return err
+			}
+			if err := send(nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Subscribe to the feed first, so no change set is missed between the
+	// current routes and those that follow
+	var feed <-chan *feedEntry
+	if g.Feed != nil {
+		_, ch, stop := g.Feed.Subscribe()
+		defer stop()
+		feed = ch
+	}
+	if !sub.updatesOnly {
+		if err := g.sendState(sub, send); err != nil {
+			return err
+		}
+	}
+	if err := send(nil); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case e := <-feed:
+			if err := g.sendChanges(sub, e.cs, send); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// newGNMISubscription checks the subscription list and returns the
+// subscription it makes
+func newGNMISubscription(list *gnmiSubscriptionList) (*gnmiSubscription, error) {
+	switch list.Mode {
+	case gnmiStream, gnmiOnce, gnmiPoll:
+	default:
+		return nil, &grpcError{grpcInvalidArgument, fmt.Sprintf("unknown subscription mode %d", list.Mode)}
+	}
+	switch list.Encoding {
+	case gnmiJSON, gnmiJSONIETF, gnmiProto, gnmiASCII:
+	default:
+		return nil, &grpcError{grpcUnimplemented, fmt.Sprintf("unsupported encoding %d", list.Encoding)}
+	}
+	sub := &gnmiSubscription{mode: list.Mode, encoding: list.Encoding, updatesOnly: list.UpdatesOnly, target: list.Prefix.Target}
+	paths := list.Paths
+	if len(paths) == 0 {
+		paths = []gnmiPath{{}}
+	}
+	for _, p := range paths {
+		sub.paths = append(sub.paths, append(append([]gnmiElem(nil), list.Prefix.Elem...), p.Elem...))
+	}
+	return sub, nil
+}
+
+// matches reports whether the node at path is subscribed to: whether a
+// subscribed path leads to it or, for a subtree being deleted, whether it
+// leads to a subscribed path
+func (s *gnmiSubscription) matches(path []gnmiElem, subtree bool) bool {
+next:
+	for _, p := range s.paths {
+		for i, e := range p {
+			if e.Name == "..." {
+				return true
+			}
+			if i == len(path) {
+				if subtree {
+					return true
+				}
+				continue next
+			}
+			if e.Name != "*" && e.Name != path[i].Name {
+				continue next
+			}
+			for k, v := range e.Key {
+				if v != "*" && path[i].Key[k] != v {
+					continue next
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gnmiTable returns the elements of the path of the table at path
+func gnmiTable(path string) []gnmiElem {
+	return []gnmiElem{{Name: "tables"}, {Name: "table", Key: map[string]string{"name": path}}}
+}
+
+// gnmiRoute returns the element of the route to dest
+func gnmiRoute(dest string) gnmiElem {
+	return gnmiElem{Name: "route", Key: map[string]string{"prefix": dest}}
+}
+
+// gnmiBatch collects the updates and deletions of a table into
+// notifications of up to gnmiBatchSize nodes
+type gnmiBatch struct {
+	sub   *gnmiSubscription
+	table []gnmiElem
+	time  int64
+	send  func(*gnmiNotification) error
+	n     *gnmiNotification
+}
+
+// update adds an update of the node at path under the table to v
+func (b *gnmiBatch) update(v any, path ...gnmiElem) error {
+	if !b.sub.matches(append(append([]gnmiElem(nil), b.table...), path...), false) {
+		return nil
+	}
+	b.notification().Updates = append(b.n.Updates, gnmiUpdate{Path: gnmiPath{Elem: path}, Val: gnmiValue(b.sub.encoding, v)})
+	return b.full()
+}
+
+// delete adds a deletion of the subtree at path under the table
+func (b *gnmiBatch) delete(path ...gnmiElem) error {
+	if !b.sub.matches(append(append([]gnmiElem(nil), b.table...), path...), true) {
+		return nil
+	}
+	b.notification().Deletes = append(b.n.Deletes, gnmiPath{Elem: path})
+	return b.full()
+}
+
+// route adds updates of the route to dest, whose hash is hash, and of
+// its text if chunk is set
+func (b *gnmiBatch) route(dest, hash string, chunk *Chunk) error {
+	route := gnmiRoute(dest)
+	if err := b.update(hash, route, gnmiElem{Name: "hash"}); err != nil {
+		return err
+	}
+	if chunk == nil {
+		return nil
+	}
+	content := []gnmiElem{route, {Name: "content"}}
+	if !b.sub.matches(append(append([]gnmiElem(nil), b.table...), content...), false) {
+		return nil
+	}
+	data, err := chunk.Content()
+	if err != nil {
+		return nil
+	}
+	return b.update(string(data), content...)
+}
+
+func (b *gnmiBatch) notification() *gnmiNotification {
+	if b.n == nil {
+		b.n = &gnmiNotification{Timestamp: b.time, Prefix: gnmiPath{Target: b.sub.target, Elem: b.table}}
+	}
+	return b.n
+}
+
+// full sends the notification if it has gnmiBatchSize nodes
+func (b *gnmiBatch) full() error {
+	if len(b.n.Updates)+len(b.n.Deletes) < gnmiBatchSize {
+		return nil
+	}
+	return b.flush()
+}
+
+// flush sends the notification, if there is one
+func (b *gnmiBatch) flush() error {
+	if b.n == nil {
+		return nil
+	}
+	n := b.n
+	b.n = nil
+	return b.send(n)
+}
+
+// sendState sends the current routes of the tables sub selects
+func (g *GNMIServer) sendState(sub *gnmiSubscription, send func(*gnmiNotification) error) error {
+	targets := g.Targets()
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Table.FilePath < targets[j].Table.FilePath })
+	now := time.Now().UnixNano()
+	for _, t := range targets {
+		table := gnmiTable(t.Table.FilePath)
+		if !sub.matches(table, true) {
+			continue
+		}
+		t.Table.mu.RLock()
+		chunks := make([]*Chunk, 0, len(t.Table.Chunks))
+		for _, c := range t.Table.Chunks {
+			chunks = append(chunks, c)
+		}
+		t.Table.mu.RUnlock()
+		sort.Slice(chunks, func(i, j int) bool { return chunks[i].Destination < chunks[j].Destination })
+
+		// Lean bodies are read back outside the table's lock
+		b := &gnmiBatch{sub: sub, table: table, time: now, send: send}
+		if err := b.update(uint64(len(chunks)), gnmiElem{Name: "routes"}); err != nil {
+			return err
+		}
+		for _, c := range chunks {
+			if err := b.route(c.Destination, c.Hash, c); err != nil {
+				return err
+			}
+		}
+		if err := b.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendChanges sends the changes of cs that sub selects. The feed keeps
+// change sets without their chunks, so the text of a route is taken from
+// its table, and left out if the route has changed again since.
+func (g *GNMIServer) sendChanges(sub *gnmiSubscription, cs *ChangeSet, send func(*gnmiNotification) error) error {
+	table := gnmiTable(cs.Path)
+	if !sub.matches(table, true) {
+		return nil
+	}
+	var target *Target
+	for _, t := range g.Targets() {
+		if t.Table.FilePath == cs.Path {
+			target = t
+			break
+		}
+	}
+	ts := cs.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	b := &gnmiBatch{sub: sub, table: table, time: ts.UnixNano(), send: send}
+	if err := b.update(uint64(cs.Routes), gnmiElem{Name: "routes"}); err != nil {
+		return err
+	}
+	for _, c := range cs.Notifiable() {
+		if c.Type == ChangeRemoved {
+			if err := b.delete(gnmiRoute(c.Destination)); err != nil {
+				return err
+			}
+			continue
+		}
+		var chunk *Chunk
+		if target != nil {
+			target.Table.mu.RLock()
+			if ch := target.Table.Chunks[c.Destination]; ch != nil && ch.Hash == c.NewHash {
+				chunk = ch
+			}
+			target.Table.mu.RUnlock()
+		}
+		if err := b.route(c.Destination, c.NewHash, chunk); err != nil {
+			return err
+		}
+	}
+	return b.flush()
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startGNMI serves g over HTTP/2 without TLS and returns its address
+func startGNMI(t *testing.T, g *GNMIServer) string {
+	t.Helper()
+	return startGRPC(t, g.Handler())
+}
+
+// startGRPC serves h over HTTP/2 without TLS, returning its address
+func startGRPC(t *testing.T, h http.Handler) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	srv := &http.Server{Handler: h, Protocols: &protocols}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return "http://" + ln.Addr().String()
+}
+
+// gnmiCall starts an RPC, returning a pipe to write its request messages
+// to and the response
+func gnmiCall(t *testing.T, addr, method string) (*io.PipeWriter, *http.Response) {
+	t.Helper()
+	return grpcCall(t, addr, "/gnmi.gNMI/"+method)
+}
+
+// grpcCall starts the RPC at path, as gnmiCall does
+func grpcCall(t *testing.T, addr, path string) (*io.PipeWriter, *http.Response) {
+	t.Helper()
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+	body, w := io.Pipe()
+	t.Cleanup(func() { w.Close() })
+	req, err := http.NewRequest("POST", addr+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s: %s", path, resp.Status)
+	}
+	return w, resp
+}
+
+// gnmiResponses reads the responses of an RPC, written as text by
+// gnmiText, until n are read or the RPC ends, and returns them with the
+// RPC's status if it ended
+func gnmiResponses(t *testing.T, resp *http.Response, n int) ([]string, string) {
+	t.Helper()
+	var out []string
+	for len(out) < n {
+		msg, err := readGRPCMessage(resp.Body)
+		if err == io.EOF {
+			return out, resp.Trailer.Get("Grpc-Status") + " " + resp.Trailer.Get("Grpc-Message")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, gnmiText(t, msg))
+	}
+	return out, ""
+}
+
+// gnmiText renders a SubscribeResponse as text: sync, or a line per
+// update and deletion
+func gnmiText(t *testing.T, msg []byte) string {
+	t.Helper()
+	fields, err := parseProto(msg)
+	if err != nil || len(fields) != 1 {
+		t.Fatalf("bad response %x: %v", msg, err)
+	}
+	if fields[0].field == 3 {
+		return "sync"
+	}
+	n, err := parseProto(fields[0].data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prefix string
+	var lines []string
+	for _, f := range n {
+		switch f.field {
+		case 2:
+			p, _ := decodeGNMIPath(f.data)
+			prefix = gnmiPathText(p)
+		case 4:
+			u, _ := parseProto(f.data)
+			p, _ := decodeGNMIPath(u[0].data)
+			val, _ := parseProto(u[1].data)
+			v := fmt.Sprint(val[0].num)
+			if val[0].wire == wireBytes {
+				v = string(val[0].data)
+			}
+			lines = append(lines, fmt.Sprintf("%s = %s", gnmiPathText(p), v))
+		case 5:
+			p, _ := decodeGNMIPath(f.data)
+			lines = append(lines, "delete "+gnmiPathText(p))
+		}
+	}
+	return prefix + ": " + strings.Join(lines, "; ")
+}
+
+func gnmiPathText(p gnmiPath) string {
+	var b strings.Builder
+	if p.Target != "" {
+		b.WriteString(p.Target + ":")
+	}
+	for _, e := range p.Elem {
+		b.WriteString("/" + e.Name)
+		keys := make([]string, 0, len(e.Key))
+		for k := range e.Key {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&b, "[%s=%s]", k, e.Key[k])
+		}
+	}
+	return b.String()
+}
+
+// gnmiPathMsg encodes a Path of elements written as name or name=key=value
+func gnmiPathMsg(elems ...string) []byte {
+	var p gnmiPath
+	for _, s := range elems {
+		name, kv, ok := strings.Cut(s, "=")
+		e := gnmiElem{Name: name}
+		if ok {
+			k, v, _ := strings.Cut(kv, "=")
+			e.Key = map[string]string{k: v}
+		}
+		p.Elem = append(p.Elem, e)
+	}
+	return marshalGNMIPath(p)
+}
+
+// gnmiSubscribeMsg encodes a SubscribeRequest of a subscription list
+func gnmiSubscribeMsg(mode, encoding int, target string, paths ...[]byte) []byte {
+	var list []byte
+	list = appendProtoBytes(list, 1, marshalGNMIPath(gnmiPath{Target: target}))
+	for _, p := range paths {
+		list = appendProtoBytes(list, 2, appendProtoBytes(nil, 1, p))
+	}
+	list = appendProtoVarint(list, 5, uint64(mode))
+	list = appendProtoVarint(list, 8, uint64(encoding))
+	return grpcFrame(appendProtoBytes(nil, 1, list))
+}
+
+func TestGNMISubscribe(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"), routeBlock("0.0.0.0/0", "Static", "172.31.0.254"))
+	target := NewTarget("core", loadTable(t, path), NewDispatcher(nil, nil))
+	feed := NewChangeFeed(0)
+	addr := startGNMI(t, &GNMIServer{Targets: func() []*Target { return []*Target{target} }, Feed: feed})
+	table := "/tables/table[name=" + path + "]"
+	hash := target.Table.Chunks["10.0.0.0/8"].Hash
+
+	// ONCE: the current routes, then the sync response
+	w, resp := gnmiCall(t, addr, "Subscribe")
+	w.Write(gnmiSubscribeMsg(gnmiOnce, gnmiProto, "core", gnmiPathMsg("tables", "table", "route=prefix=10.0.0.0/8")))
+	got, status := gnmiResponses(t, resp, 3)
+	if len(got) != 2 || got[1] != "sync" || status != "0 " {
+		t.Fatalf("ONCE responses = %q, status %q", got, status)
+	}
+	if want := "core:" + table + ": /route[prefix=10.0.0.0/8]/hash = " + hash + "; /route[prefix=10.0.0.0/8]/content = "; !strings.HasPrefix(got[0], want) || !strings.Contains(got[0], "IBGP") {
+		t.Errorf("ONCE notification = %q, want %q...", got[0], want)
+	}
+
+	// STREAM: the current routes, the sync response, then changes
+	w, resp = gnmiCall(t, addr, "Subscribe")
+	w.Write(gnmiSubscribeMsg(gnmiStream, gnmiJSONIETF, "", gnmiPathMsg("tables", "table=name=*", "*", "hash"), gnmiPathMsg("tables", "table", "routes")))
+	got, _ = gnmiResponses(t, resp, 2)
+	if want := table + `: /routes = "2"; /route[prefix=0.0.0.0/0]/hash = "`; len(got) != 2 || !strings.HasPrefix(got[0], want) || got[1] != "sync" {
+		t.Fatalf("STREAM responses = %q, want %q...", got, want)
+	}
+	// The stream subscribed to the feed before the sync response
+	feed.Publish(&ChangeSet{Path: path, Time: time.Unix(1700000000, 0), Routes: 2, Changes: []Change{
+		{Seq: 1, Type: ChangeModified, Destination: "10.0.0.0/8", NewHash: hash},
+		{Seq: 2, Type: ChangeRemoved, Destination: "172.16.0.0/12"},
+		{Type: ChangeModified, Destination: "0.0.0.0/0", Volatile: true},
+	}})
+	got, _ = gnmiResponses(t, resp, 1)
+	if want := table + `: /routes = "2"; /route[prefix=10.0.0.0/8]/hash = "` + hash + `"; delete /route[prefix=172.16.0.0/12]`; len(got) != 1 || got[0] != want {
+		t.Errorf("STREAM change = %q, want %q", got, want)
+	}
+	w.Close()
+}
+
+func TestGNMIPoll(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	target := NewTarget("core", loadTable(t, path), NewDispatcher(nil, nil))
+	addr := startGNMI(t, &GNMIServer{Targets: func() []*Target { return []*Target{target} }})
+
+	w, resp := gnmiCall(t, addr, "Subscribe")
+	w.Write(gnmiSubscribeMsg(gnmiPoll, gnmiASCII, "", gnmiPathMsg("tables", "...")))
+	poll := grpcFrame(appendProtoBytes(nil, 3, nil))
+	for range 2 {
+		w.Write(poll)
+		got, _ := gnmiResponses(t, resp, 2)
+		if len(got) != 2 || !strings.Contains(got[0], "/routes = 1;") || got[1] != "sync" {
+			t.Fatalf("poll responses = %q", got)
+		}
+	}
+	w.Close()
+	if got, status := gnmiResponses(t, resp, 1); len(got) != 0 || status != "0 " {
+		t.Errorf("after polls: %q, status %q", got, status)
+	}
+}
+
+func TestGNMIErrors(t *testing.T) {
+	addr := startGNMI(t, &GNMIServer{Targets: func() []*Target { return nil }})
+	for _, tc := range []struct {
+		req  []byte
+		want string
+	}{
+		{nil, "3 no subscription"},
+		{grpcFrame(appendProtoBytes(nil, 3, nil)), "3 the first request must be a subscription list"},
+		{gnmiSubscribeMsg(gnmiOnce, gnmiBytes, ""), "12 unsupported encoding 1"},
+		{gnmiSubscribeMsg(7, gnmiJSON, ""), "3 unknown subscription mode 7"},
+		{[]byte{1, 0, 0, 0, 0}, "12 compressed messages are not supported"},
+	} {
+		w, resp := gnmiCall(t, addr, "Subscribe")
+		w.Write(tc.req)
+		w.Close()
+		if got, status := gnmiResponses(t, resp, 1); len(got) != 0 || status != tc.want {
+			t.Errorf("request %x: %q, status %q, want %q", tc.req, got, status, tc.want)
+		}
+	}
+
+	// Methods other than Subscribe and Capabilities aren't implemented
+	w, resp := gnmiCall(t, addr, "Get")
+	w.Close()
+	if _, status := gnmiResponses(t, resp, 1); status != "12 unknown method /gnmi.gNMI/Get" {
+		t.Errorf("Get status %q", status)
+	}
+}
+
+func TestGNMICapabilities(t *testing.T) {
+	addr := startGNMI(t, &GNMIServer{Targets: func() []*Target { return nil }})
+	w, resp := gnmiCall(t, addr, "Capabilities")
+	w.Write(grpcFrame(nil))
+	w.Close()
+	msg, err := readGRPCMessage(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err := parseProto(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encodings []uint64
+	var version string
+	for _, f := range fields {
+		switch f.field {
+		case 2:
+			for b := f.data; len(b) > 0; {
+				v, n := binary.Uvarint(b)
+				encodings, b = append(encodings, v), b[n:]
+			}
+		case 3:
+			version = string(f.data)
+		}
+	}
+	if fmt.Sprint(encodings) != "[0 2 3 4]" || version != gNMIVersion {
+		t.Errorf("capabilities: encodings %v, version %q", encodings, version)
+	}
+	io.ReadAll(resp.Body)
+	if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("status %q", status)
+	}
+}
+
+func TestGNMIValue(t *testing.T) {
+	for _, tc := range []struct {
+		encoding int
+		v        any
+		want     []byte
+	}{
+		{gnmiProto, "abc", []byte{0x0a, 3, 'a', 'b', 'c'}},
+		{gnmiProto, uint64(0), []byte{0x18, 0}},
+		{gnmiJSON, uint64(12), []byte{0x52, 2, '1', '2'}},
+		{gnmiJSONIETF, uint64(12), []byte{0x5a, 4, '"', '1', '2', '"'}},
+		{gnmiASCII, "a", []byte{0x62, 1, 'a'}},
+	} {
+		if got := gnmiValue(tc.encoding, tc.v); !bytes.Equal(got, tc.want) {
+			t.Errorf("gnmiValue(%d, %v) = %x, want %x", tc.encoding, tc.v, got, tc.want)
+		}
+	}
+	if got := grpcEscape("bad: 100%\n"); got != "bad: 100%25%0A" {
+		t.Errorf("grpcEscape = %q", got)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+// Just enough gRPC and gNMI to serve telemetry: the length-prefixed
+// message framing of gRPC over HTTP/2, and the messages of gnmi.proto
+// (github.com/openconfig/gnmi) that the Capabilities and Subscribe RPCs
+// exchange, encoded by hand as in protobuf.go.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// gNMIVersion is the version of the gNMI specification served
+const gNMIVersion = "0.10.0"
+
+// grpcMaxMessage is the largest request message read, gRPC's default
+const grpcMaxMessage = 4 << 20
+
+// gRPC status codes
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcNotFound          = 5
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnauthenticated   = 16
+)
+
+// grpcError is an error to end an RPC with
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string { return e.msg }
+
+// readGRPCMessage reads a length-prefixed message from an RPC's request
+// body. It returns io.EOF when the client has no more.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, &grpcError{grpcInvalidArgument, "truncated message"}
+		}
+		return nil, err
+	}
+	if head[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, "compressed messages are not supported"}
+	}
+	size := binary.BigEndian.Uint32(head[1:])
+	if size > grpcMaxMessage {
+		return nil, &grpcError{grpcInvalidArgument, fmt.Sprintf("message of %d bytes is over the limit of %d", size, grpcMaxMessage)}
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "truncated message"}
+	}
+	return msg, nil
+}
+
+// grpcFrame prefixes msg with its length, uncompressed
+func grpcFrame(msg []byte) []byte {
+	b := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// grpcEscape percent-encodes a status message for the grpc-message
+// trailer
+func grpcEscape(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// gNMI encodings
+const (
+	gnmiJSON     = 0
+	gnmiBytes    = 1
+	gnmiProto    = 2
+	gnmiASCII    = 3
+	gnmiJSONIETF = 4
+)
+
+// gNMI subscription list modes
+const (
+	gnmiStream = 0
+	gnmiOnce   = 1
+	gnmiPoll   = 2
+)
+
+// gnmiElem is an element of a path, with its keys
+type gnmiElem struct {
+	Name string
+	Key  map[string]string
+}
+
+// gnmiPath is a path to a node in the data tree
+type gnmiPath struct {
+	Origin string
+	Target string
+	Elem   []gnmiElem
+}
+
+// gnmiUpdate sets the value, an encoded TypedValue, of the node at Path
+type gnmiUpdate struct {
+	Path gnmiPath
+	Val  []byte
+}
+
+// gnmiNotification is a set of updates and deletions of nodes under
+// Prefix at one time
+type gnmiNotification struct {
+	Timestamp int64
+	Prefix    gnmiPath
+	Updates   []gnmiUpdate
+	Deletes   []gnmiPath
+}
+
+// gnmiSubscriptionList is the subscription of a SubscribeRequest
+type gnmiSubscriptionList struct {
+	Prefix      gnmiPath
+	Paths       []gnmiPath
+	Mode        int
+	Encoding    int
+	UpdatesOnly bool
+}
+
+// gnmiSubscribeRequest is a SubscribeRequest: a subscription list, or
+// a poll of one made earlier
+type gnmiSubscribeRequest struct {
+	List *gnmiSubscriptionList
+	Poll bool
+}
+
+// marshalGNMIPath encodes p as a Path message
+func marshalGNMIPath(p gnmiPath) []byte {
+	var b []byte
+	b = appendProtoString(b, 2, p.Origin)
+	for _, e := range p.Elem {
+		var elem []byte
+		elem = appendProtoString(elem, 1, e.Name)
+		keys := make([]string, 0, len(e.Key))
+		for k := range e.Key {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			var entry []byte
+			entry = appendProtoString(entry, 1, k)
+			entry = appendProtoString(entry, 2, e.Key[k])
+			elem = appendProtoBytes(elem, 2, entry)
+		}
+		b = appendProtoBytes(b, 3, elem)
+	}
+	return appendProtoString(b, 4, p.Target)
+}
+
+// marshalGNMINotification encodes n as a Notification message
+func marshalGNMINotification(n *gnmiNotification) []byte {
+	var b []byte
+	b = appendProtoVarint(b, 1, uint64(n.Timestamp))
+	b = appendProtoBytes(b, 2, marshalGNMIPath(n.Prefix))
+	for _, u := range n.Updates {
+		update := appendProtoBytes(nil, 1, marshalGNMIPath(u.Path))
+		update = appendProtoBytes(update, 3, u.Val)
+		b = appendProtoBytes(b, 4, update)
+	}
+	for _, p := range n.Deletes {
+		b = appendProtoBytes(b, 5, marshalGNMIPath(p))
+	}
+	return b
+}
+
+// marshalGNMISubscribeResponse encodes a SubscribeResponse carrying n, or
+// the sync response if n is nil
+func marshalGNMISubscribeResponse(n *gnmiNotification) []byte {
+	if n == nil {
+		return appendProtoBool(nil, 3, true)
+	}
+	return appendProtoBytes(nil, 1, marshalGNMINotification(n))
+}
+
+// marshalGNMICapabilities encodes a CapabilityResponse
+func marshalGNMICapabilities() []byte {
+	var model []byte
+	model = appendProtoString(model, 1, "go-watcher-routes")
+	model = appendProtoString(model, 2, "go-watcher")
+	model = appendProtoString(model, 3, "1")
+	b := appendProtoBytes(nil, 1, model)
+	b = appendProtoPacked(b, 2, []uint64{gnmiJSON, gnmiProto, gnmiASCII, gnmiJSONIETF})
+	return appendProtoString(b, 3, gNMIVersion)
+}
+
+// gnmiValue encodes v, a string or uint64, as a TypedValue in encoding
+func gnmiValue(encoding int, v any) []byte {
+	// The value is a oneof, so it is written even when zero
+	switch encoding {
+	case gnmiJSON, gnmiJSONIETF:
+		field := 10
+		if encoding == gnmiJSONIETF {
+			field = 11
+			// RFC 7951 writes 64-bit integers as strings
+			if n, ok := v.(uint64); ok {
+				v = fmt.Sprint(n)
+			}
+		}
+		data, _ := json.Marshal(v)
+		return appendProtoBytes(nil, field, data)
+	case gnmiASCII:
+		return appendProtoBytes(nil, 12, []byte(fmt.Sprint(v)))
+	}
+	if n, ok := v.(uint64); ok {
+		return binary.AppendUvarint(appendProtoTag(nil, 3, wireVarint), n)
+	}
+	return appendProtoBytes(nil, 1, []byte(v.(string)))
+}
+
+// decodeGNMIPath decodes a Path message, taking the element names of
+// paths written the old way, as strings
+func decodeGNMIPath(b []byte) (gnmiPath, error) {
+	var p gnmiPath
+	fields, err := parseProto(b)
+	if err != nil {
+		return p, err
+	}
+	for _, f := range fields {
+		switch {
+		case f.field == 1 && f.wire == wireBytes:
+			p.Elem = append(p.Elem, gnmiElem{Name: string(f.data)})
+		case f.field == 2 && f.wire == wireBytes:
+			p.Origin = string(f.data)
+		case f.field == 3 && f.wire == wireBytes:
+			e, err := decodeGNMIElem(f.data)
+			if err != nil {
+				return p, err
+			}
+			p.Elem = append(p.Elem, e)
+		case f.field == 4 && f.wire == wireBytes:
+			p.Target = string(f.data)
+		}
+	}
+	return p, nil
+}
+
+// decodeGNMIElem decodes a PathElem message
+func decodeGNMIElem(b []byte) (gnmiElem, error) {
+	var e gnmiElem
+	fields, err := parseProto(b)
+	if err != nil {
+		return e, err
+	}
+	for _, f := range fields {
+		switch {
+		case f.field == 1 && f.wire == wireBytes:
+			e.Name = string(f.data)
+		case f.field == 2 && f.wire == wireBytes:
+			entry, err := parseProto(f.data)
+			if err != nil {
+				return e, err
+			}
+			var k, v string
+			for _, ef := range entry {
+				switch {
+				case ef.field == 1 && ef.wire == wireBytes:
+					k = string(ef.data)
+				case ef.field == 2 && ef.wire == wireBytes:
+					v = string(ef.data)
+				}
+			}
+			if e.Key == nil {
+				e.Key = make(map[string]string)
+			}
+			e.Key[k] = v
+		}
+	}
+	return e, nil
+}
+
+// decodeGNMISubscribeRequest decodes a SubscribeRequest message
+func decodeGNMISubscribeRequest(b []byte) (*gnmiSubscribeRequest, error) {
+	fields, err := parseProto(b)
+	if err != nil {
+		return nil, err
+	}
+	req := &gnmiSubscribeRequest{}
+	for _, f := range fields {
+		switch {
+		case f.field == 1 && f.wire == wireBytes:
+			if req.List, err = decodeGNMISubscriptionList(f.data); err != nil {
+				return nil, err
+			}
+		case f.field == 3 && f.wire == wireBytes:
+			req.Poll = true
+		}
+	}
+	return req, nil
+}
+
+// decodeGNMISubscriptionList decodes a SubscriptionList message, keeping
+// the paths of its subscriptions
+func decodeGNMISubscriptionList(b []byte) (*gnmiSubscriptionList, error) {
+	fields, err := parseProto(b)
+	if err != nil {
+		return nil, err
+	}
+	list := &gnmiSubscriptionList{}
+	for _, f := range fields {
+		switch {
+		case f.field == 1 && f.wire == wireBytes:
+			if list.Prefix, err = decodeGNMIPath(f.data); err != nil {
+				return nil, err
+			}
+		case f.field == 2 && f.wire == wireBytes:
+			sub, err := parseProto(f.data)
+			if err != nil {
+				return nil, err
+			}
+			var p gnmiPath
+			for _, sf := range sub {
+				if sf.field == 1 && sf.wire == wireBytes {
+					if p, err = decodeGNMIPath(sf.data); err != nil {
+						return nil, err
+					}
+				}
+			}
+			list.Paths = append(list.Paths, p)
+		case f.field == 5 && f.wire == wireVarint:
+			list.Mode = int(f.num)
+		case f.field == 8 && f.wire == wireVarint:
+			list.Encoding = int(f.num)
+		case f.field == 9 && f.wire == wireVarint:
+			list.UpdatesOnly = f.num != 0
+		}
+	}
+	return list, nil
+}
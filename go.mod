@@ -2,6 +2,13 @@ module github.com/pershinghar/go-watcher
 
 go 1.25.4
 
-require github.com/fsnotify/fsnotify v1.9.0
+require (
+	github.com/cespare/xxhash/v2 v2.3.0
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/klauspost/compress v1.20.1
+	golang.org/x/sys v0.38.0
+	gopkg.in/yaml.v3 v3.0.1
+	lukechampine.com/blake3 v1.4.1
+)
 
-require golang.org/x/sys v0.38.0 // indirect
+require github.com/klauspost/cpuid/v2 v2.0.9 // indirect
@@ -0,0 +1,800 @@
+package main
+
+// GraphQL queries: the part of the GraphQL language a read-only API
+// needs. A document's operations must be queries; they can have
+// variables, aliases, fragments, inline fragments and the @include and
+// @skip directives. There are no interfaces or unions, so a fragment
+// applies to objects of the type it is on, and no introspection beyond
+// __typename. Fields are checked against a gqlSchema as they are
+// executed and resolved by the gqlObject they belong to, so a field a type
+// doesn't have is an error of that field rather than of the query.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// gqlObject is a value of a GraphQL object type
+type gqlObject interface {
+	// gqlType returns the name of the object's type
+	gqlType() string
+	// gqlField resolves a field to a scalar, a gqlObject, a []gqlObject
+	// or nil; args holds the field's arguments, with variables replaced
+	gqlField(name string, args map[string]any) (any, error)
+}
+
+// gqlError is an error of a GraphQL response
+type gqlError struct {
+	Message string `json:"message"`
+	Path    []any  `json:"path,omitempty"`
+}
+
+// gqlResponse is the response to a GraphQL request
+type gqlResponse struct {
+	Data   *gqlMap    `json:"data,omitempty"`
+	Errors []gqlError `json:"errors,omitempty"`
+}
+
+// gqlMap is an object of a response, whose fields are in the order they
+// were selected
+type gqlMap struct {
+	keys   []string
+	values []any
+}
+
+func (m *gqlMap) set(key string, v any) {
+	m.keys = append(m.keys, key)
+	m.values = append(m.values, v)
+}
+
+func (m *gqlMap) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range m.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		v, err := json.Marshal(m.values[i])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// Documents
+
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlOperation struct {
+	kind string
+	name string
+	vars []gqlVarDef
+	sel  []*gqlSelection
+}
+
+// gqlVarDef declares a variable of an operation
+type gqlVarDef struct {
+	name string
+	// required is set for non-null types without a default
+	required bool
+	def      *gqlValue
+}
+
+type gqlFragment struct {
+	on  string
+	sel []*gqlSelection
+}
+
+// gqlSelection is a field, if name is set, or else a spread of the
+// fragment named by spread or an inline fragment
+type gqlSelection struct {
+	alias, name string
+	args        []gqlArg
+	directives  []gqlDirective
+	sel         []*gqlSelection
+	spread      string
+	on          string
+}
+
+// key returns the name of a field in the response
+func (s *gqlSelection) key() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+type gqlArg struct {
+	name  string
+	value *gqlValue
+}
+
+type gqlDirective struct {
+	name string
+	args []gqlArg
+}
+
+// gqlValue is a value written in a document. Literals hold their value in
+// lit; variables their name in name, lists their elements in list and
+// input objects their fields in fields.
+type gqlValue struct {
+	lit    any
+	name   string
+	list   []*gqlValue
+	fields []gqlArg
+	isList bool
+	isObj  bool
+}
+
+// resolve returns the value, with variables replaced
+func (v *gqlValue) resolve(vars map[string]any) (any, error) {
+	switch {
+	case v.name != "":
+		val, ok := vars[v.name]
+		if !ok {
+			return nil, fmt.Errorf("variable $%s is not defined", v.name)
+		}
+		return val, nil
+	case v.isList:
+		list := make([]any, len(v.list))
+		for i, e := range v.list {
+			val, err := e.resolve(vars)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = val
+		}
+		return list, nil
+	case v.isObj:
+		obj := make(map[string]any, len(v.fields))
+		for _, f := range v.fields {
+			val, err := f.value.resolve(vars)
+			if err != nil {
+				return nil, err
+			}
+			obj[f.name] = val
+		}
+		return obj, nil
+	}
+	return v.lit, nil
+}
+
+// Lexing
+
+// gqlPunctuators are GraphQL's punctuators, longest first
+var gqlPunctuators = []string{"...", "{", "}", "(", ")", "[", "]", ":", "=", "$", "!", "@"}
+
+// lexGQL splits a document into tokens, dropping commas and comments as
+// GraphQL does
+func lexGQL(src string) ([]exprToken, error) {
+	var toks []exprToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' && src[i] != '\r' {
+				i++
+			}
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || src[j] >= 'a' && src[j] <= 'z' || src[j] >= 'A' && src[j] <= 'Z' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			toks = append(toks, exprToken{kind: tokIdent, text: src[i:j], pos: i})
+			i = j
+		case c == '-' || c >= '0' && c <= '9':
+			j := i + 1
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || strings.IndexByte(".eE+-", src[j]) >= 0) {
+				j++
+			}
+			text := src[i:j]
+			var val any
+			var err error
+			if strings.ContainsAny(text, ".eE") {
+				val, err = strconv.ParseFloat(text, 64)
+			} else {
+				val, err = strconv.ParseInt(text, 10, 64)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %s at %d", text, i)
+			}
+			toks = append(toks, exprToken{kind: tokInt, text: text, val: val, pos: i})
+			i = j
+		case c == '"':
+			if strings.HasPrefix(src[i:], `"""`) {
+				return nil, fmt.Errorf("block strings are not supported, at %d", i)
+			}
+			j := i + 1
+			for j < len(src) && src[j] != '"' && src[j] != '\n' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			var s string
+			if j >= len(src) || src[j] != '"' || json.Unmarshal([]byte(src[i:j+1]), &s) != nil {
+				return nil, fmt.Errorf("invalid string at %d", i)
+			}
+			toks = append(toks, exprToken{kind: tokString, text: src[i : j+1], val: s, pos: i})
+			i = j + 1
+		default:
+			op := ""
+			for _, p := range gqlPunctuators {
+				if strings.HasPrefix(src[i:], p) {
+					op = p
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			toks = append(toks, exprToken{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(toks, exprToken{kind: tokEOF, pos: len(src)}), nil
+}
+
+// Parsing
+
+// parseGQL parses a query document
+func parseGQL(src string) (*gqlDocument, error) {
+	toks, err := lexGQL(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{exprParser{toks: toks}}
+	doc := &gqlDocument{fragments: make(map[string]*gqlFragment)}
+	for p.peek().kind != tokEOF {
+		t := p.peek()
+		switch {
+		case t.kind == tokOp && t.text == "{":
+			sel, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &gqlOperation{kind: "query", sel: sel})
+		case t.kind == tokIdent && t.text == "fragment":
+			p.next()
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if doc.fragments[name] != nil {
+				return nil, fmt.Errorf("fragment %s is defined twice", name)
+			}
+			if on := p.next(); on.kind != tokIdent || on.text != "on" {
+				return nil, p.errorf("expected \"on\", found %s", on)
+			}
+			f := &gqlFragment{}
+			if f.on, err = p.name(); err != nil {
+				return nil, err
+			}
+			if f.sel, err = p.selectionSet(); err != nil {
+				return nil, err
+			}
+			doc.fragments[name] = f
+		case t.kind == tokIdent && (t.text == "query" || t.text == "mutation" || t.text == "subscription"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		default:
+			return nil, p.errorf("expected an operation or fragment, found %s", t)
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, errors.New("no operations")
+	}
+	return doc, nil
+}
+
+type gqlParser struct {
+	exprParser
+}
+
+func (p *gqlParser) name() (string, error) {
+	if t := p.peek(); t.kind != tokIdent {
+		return "", p.errorf("expected a name, found %s", t)
+	}
+	return p.next().text, nil
+}
+
+// operation parses an operation with its keyword
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{kind: p.next().text}
+	if p.peek().kind == tokIdent {
+		op.name = p.next().text
+	}
+	if p.accept("(") {
+		for !p.accept(")") {
+			if err := p.expect("$"); err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			nonNull, err := p.typeRef()
+			if err != nil {
+				return nil, err
+			}
+			v := gqlVarDef{name: name}
+			if p.accept("=") {
+				if v.def, err = p.value(true); err != nil {
+					return nil, err
+				}
+			}
+			v.required = nonNull && v.def == nil
+			op.vars = append(op.vars, v)
+		}
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	var err error
+	op.sel, err = p.selectionSet()
+	return op, err
+}
+
+// typeRef parses a variable's type, reporting whether it is non-null
+func (p *gqlParser) typeRef() (bool, error) {
+	if p.accept("[") {
+		if _, err := p.typeRef(); err != nil {
+			return false, err
+		}
+		if err := p.expect("]"); err != nil {
+			return false, err
+		}
+	} else if _, err := p.name(); err != nil {
+		return false, err
+	}
+	return p.accept("!"), nil
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var sel []*gqlSelection
+	for !p.accept("}") {
+		s, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		sel = append(sel, s)
+	}
+	if len(sel) == 0 {
+		return nil, p.errorf("empty selection set")
+	}
+	return sel, nil
+}
+
+func (p *gqlParser) selection() (*gqlSelection, error) {
+	s := &gqlSelection{}
+	var err error
+	if p.accept("...") {
+		if t := p.peek(); t.kind == tokIdent && t.text != "on" {
+			s.spread = p.next().text
+			s.directives, err = p.directives()
+			return s, err
+		}
+		if t := p.peek(); t.kind == tokIdent {
+			p.next()
+			if s.on, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if s.directives, err = p.directives(); err != nil {
+			return nil, err
+		}
+		s.sel, err = p.selectionSet()
+		return s, err
+	}
+	if s.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if p.accept(":") {
+		s.alias = s.name
+		if s.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if s.args, err = p.arguments(false); err != nil {
+		return nil, err
+	}
+	if s.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind == tokOp && t.text == "{" {
+		s.sel, err = p.selectionSet()
+	}
+	return s, err
+}
+
+// arguments parses the arguments in parentheses, if there are any
+func (p *gqlParser) arguments(constant bool) ([]gqlArg, error) {
+	if !p.accept("(") {
+		return nil, nil
+	}
+	var args []gqlArg
+	for !p.accept(")") {
+		a, err := p.field(constant)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a)
+	}
+	return args, nil
+}
+
+// field parses name: value, of an argument or input object
+func (p *gqlParser) field(constant bool) (gqlArg, error) {
+	name, err := p.name()
+	if err != nil {
+		return gqlArg{}, err
+	}
+	if err := p.expect(":"); err != nil {
+		return gqlArg{}, err
+	}
+	v, err := p.value(constant)
+	return gqlArg{name, v}, err
+}
+
+func (p *gqlParser) directives() ([]gqlDirective, error) {
+	var dirs []gqlDirective
+	for p.accept("@") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		args, err := p.arguments(false)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, gqlDirective{name, args})
+	}
+	return dirs, nil
+}
+
+// value parses a value; constant ones, the defaults of variables, can't
+// use variables
+func (p *gqlParser) value(constant bool) (*gqlValue, error) {
+	t := p.peek()
+	if t.kind == tokEOF {
+		return nil, p.errorf("expected a value, found %s", t)
+	}
+	p.next()
+	switch t.kind {
+	case tokInt, tokString:
+		return &gqlValue{lit: t.val}, nil
+	case tokIdent:
+		switch t.text {
+		case "true", "false":
+			return &gqlValue{lit: t.text == "true"}, nil
+		case "null":
+			return &gqlValue{}, nil
+		}
+		// Enum values are taken as their names
+		return &gqlValue{lit: t.text}, nil
+	}
+	switch t.text {
+	case "$":
+		if constant {
+			p.pos--
+			return nil, p.errorf("variables can't be used here")
+		}
+		name, err := p.name()
+		return &gqlValue{name: name}, err
+	case "[":
+		v := &gqlValue{isList: true}
+		for !p.accept("]") {
+			e, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			v.list = append(v.list, e)
+		}
+		return v, nil
+	case "{":
+		v := &gqlValue{isObj: true}
+		for !p.accept("}") {
+			f, err := p.field(constant)
+			if err != nil {
+				return nil, err
+			}
+			v.fields = append(v.fields, f)
+		}
+		return v, nil
+	}
+	p.pos--
+	return nil, p.errorf("expected a value, found %s", t)
+}
+
+// Execution
+
+// gqlSchema lists the fields of each object type with the names of their
+// arguments
+type gqlSchema map[string]map[string][]string
+
+// execGQL runs the operation named, or the only one, of a document
+// against root, with the given variables
+func execGQL(schema gqlSchema, doc *gqlDocument, operation string, variables map[string]any, root gqlObject) (*gqlResponse, error) {
+	var op *gqlOperation
+	switch {
+	case operation != "":
+		for _, o := range doc.operations {
+			if o.name == operation {
+				op = o
+			}
+		}
+		if op == nil {
+			return nil, fmt.Errorf("no operation %s", operation)
+		}
+	case len(doc.operations) > 1:
+		return nil, errors.New("operationName is required for a document of more than one operation")
+	default:
+		op = doc.operations[0]
+	}
+	if op.kind != "query" {
+		return nil, fmt.Errorf("%s operations are not supported", op.kind)
+	}
+	vars := make(map[string]any)
+	for _, v := range op.vars {
+		val, ok := variables[v.name]
+		switch {
+		case ok:
+			vars[v.name] = val
+		case v.def != nil:
+			vars[v.name], _ = v.def.resolve(nil)
+		case v.required:
+			return nil, fmt.Errorf("variable $%s is required", v.name)
+		default:
+			vars[v.name] = nil
+		}
+	}
+	ex := &gqlExec{schema: schema, doc: doc, vars: vars}
+	data := ex.object(root, op.sel, nil)
+	return &gqlResponse{Data: data, Errors: ex.errors}, nil
+}
+
+type gqlExec struct {
+	schema gqlSchema
+	doc    *gqlDocument
+	vars   map[string]any
+	errors []gqlError
+}
+
+func (ex *gqlExec) fail(path []any, err error) {
+	ex.errors = append(ex.errors, gqlError{Message: err.Error(), Path: slices.Clone(path)})
+}
+
+// object executes a selection set on obj
+func (ex *gqlExec) object(obj gqlObject, sel []*gqlSelection, path []any) *gqlMap {
+	var keys []string
+	fields := make(map[string][]*gqlSelection)
+	if err := ex.collect(obj, sel, &keys, fields, make(map[string]bool)); err != nil {
+		ex.fail(path, err)
+		return nil
+	}
+	out := &gqlMap{}
+	for _, key := range keys {
+		out.set(key, ex.field(obj, fields[key], append(path, key)))
+	}
+	return out
+}
+
+// collect gathers the fields selected on obj by their response keys,
+// expanding fragments, as GraphQL's CollectFields does
+func (ex *gqlExec) collect(obj gqlObject, sel []*gqlSelection, keys *[]string, fields map[string][]*gqlSelection, visited map[string]bool) error {
+	for _, s := range sel {
+		include, err := ex.included(s.directives)
+		if err != nil {
+			return err
+		}
+		if !include {
+			continue
+		}
+		switch {
+		case s.name != "":
+			key := s.key()
+			if fields[key] == nil {
+				*keys = append(*keys, key)
+			} else if fields[key][0].name != s.name {
+				return fmt.Errorf("fields %s and %s can't both be called %s", fields[key][0].name, s.name, key)
+			}
+			fields[key] = append(fields[key], s)
+		case s.spread != "":
+			if visited[s.spread] {
+				continue
+			}
+			visited[s.spread] = true
+			f := ex.doc.fragments[s.spread]
+			if f == nil {
+				return fmt.Errorf("no fragment %s", s.spread)
+			}
+			if f.on != obj.gqlType() {
+				continue
+			}
+			if err := ex.collect(obj, f.sel, keys, fields, visited); err != nil {
+				return err
+			}
+		default:
+			if s.on != "" && s.on != obj.gqlType() {
+				continue
+			}
+			if err := ex.collect(obj, s.sel, keys, fields, visited); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// included applies the @include and @skip directives
+func (ex *gqlExec) included(dirs []gqlDirective) (bool, error) {
+	for _, d := range dirs {
+		if d.name != "include" && d.name != "skip" {
+			return false, fmt.Errorf("unknown directive @%s", d.name)
+		}
+		args, err := ex.args(d.args)
+		if err != nil {
+			return false, err
+		}
+		cond, ok := args["if"].(bool)
+		if !ok {
+			return false, fmt.Errorf("@%s needs a boolean if argument", d.name)
+		}
+		if cond == (d.name == "skip") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (ex *gqlExec) args(list []gqlArg) (map[string]any, error) {
+	args := make(map[string]any, len(list))
+	for _, a := range list {
+		v, err := a.value.resolve(ex.vars)
+		if err != nil {
+			return nil, err
+		}
+		args[a.name] = v
+	}
+	return args, nil
+}
+
+// field resolves a field of obj and completes its value, which is null if
+// either fails
+func (ex *gqlExec) field(obj gqlObject, sels []*gqlSelection, path []any) any {
+	s := sels[0]
+	if s.name == "__typename" {
+		return obj.gqlType()
+	}
+	params, ok := ex.schema[obj.gqlType()][s.name]
+	if !ok {
+		ex.fail(path, fmt.Errorf("type %s has no field %s", obj.gqlType(), s.name))
+		return nil
+	}
+	for _, a := range s.args {
+		if !slices.Contains(params, a.name) {
+			ex.fail(path, fmt.Errorf("field %s has no argument %s", s.name, a.name))
+			return nil
+		}
+	}
+	args, err := ex.args(s.args)
+	if err != nil {
+		ex.fail(path, err)
+		return nil
+	}
+	v, err := obj.gqlField(s.name, args)
+	if err != nil {
+		ex.fail(path, err)
+		return nil
+	}
+	if v == nil {
+		return nil
+	}
+	var sel []*gqlSelection
+	for _, s := range sels {
+		sel = append(sel, s.sel...)
+	}
+	switch v := v.(type) {
+	case gqlObject:
+		if sel == nil {
+			ex.fail(path, fmt.Errorf("field %s of type %s must have a selection of subfields", s.name, v.gqlType()))
+			return nil
+		}
+		return ex.object(v, sel, path)
+	case []gqlObject:
+		if sel == nil && len(v) > 0 {
+			ex.fail(path, fmt.Errorf("field %s of type [%s] must have a selection of subfields", s.name, v[0].gqlType()))
+			return nil
+		}
+		list := make([]any, len(v))
+		for i, o := range v {
+			list[i] = ex.object(o, sel, append(path, i))
+		}
+		return list
+	}
+	if sel != nil {
+		ex.fail(path, fmt.Errorf("field %s is a scalar and can't have a selection of subfields", s.name))
+		return nil
+	}
+	return v
+}
+
+// Arguments
+
+// gqlInt returns the integer argument name, or def if it isn't given
+func gqlInt(args map[string]any, name string, def int) (int, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return def, nil
+	case int64:
+		return int(v), nil
+	case float64:
+		// Variables are decoded from JSON as float64
+		if v == float64(int(v)) {
+			return int(v), nil
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return int(n), nil
+		}
+	}
+	return 0, fmt.Errorf("argument %s must be an integer", name)
+}
+
+// gqlString returns the string argument name, or "" if it isn't given
+func gqlString(args map[string]any, name string) (string, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	}
+	return "", fmt.Errorf("argument %s must be a string", name)
+}
+
+// gqlStrings returns the list of strings argument name, which as in
+// GraphQL may be given as a single string
+func gqlStrings(args map[string]any, name string) ([]string, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []any:
+		list := make([]string, len(v))
+		for i, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("argument %s must be a list of strings", name)
+			}
+			list[i] = s
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("argument %s must be a list of strings", name)
+}
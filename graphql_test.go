@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// gqlTestRoot is an object with a field per kind of value
+type gqlTestRoot struct{}
+
+func (gqlTestRoot) gqlType() string { return "Query" }
+
+func (gqlTestRoot) gqlField(name string, args map[string]any) (any, error) {
+	switch name {
+	case "echo":
+		return args["v"], nil
+	case "items":
+		n, err := gqlInt(args, "n", 2)
+		if err != nil {
+			return nil, err
+		}
+		var list []gqlObject
+		for i := range n {
+			list = append(list, gqlTestItem(i))
+		}
+		return list, nil
+	}
+	return nil, nil
+}
+
+type gqlTestItem int
+
+func (gqlTestItem) gqlType() string { return "Item" }
+
+func (i gqlTestItem) gqlField(name string, args map[string]any) (any, error) {
+	return int(i), nil
+}
+
+var gqlTestSchema = gqlSchema{
+	"Query": {"echo": {"v"}, "items": {"n"}},
+	"Item":  {"n": nil},
+}
+
+func TestGraphQL(t *testing.T) {
+	for _, tt := range []struct {
+		query, op, vars, want string
+	}{
+		{`{ echo(v: "a") }`, "", "", `{"data":{"echo":"a"}}`},
+		{`{ b: echo(v: [1, -2.5, true, null, ENUM, {k: "é"}]) a: echo(v: 1) }`, "", "", `{"data":{"b":[1,-2.5,true,null,"ENUM",{"k":"é"}],"a":1}}`},
+		{`query Q($n: Int = 1, $v: String!) { items(n: $n) { n __typename } echo(v: $v) }`, "", `{"v": "x"}`, `{"data":{"items":[{"n":0,"__typename":"Item"}],"echo":"x"}}`},
+		{`query A { echo(v: "a") } query B { echo(v: "b") }`, "B", "", `{"data":{"echo":"b"}}`},
+		// Fragments, and fields selected twice, merge
+		{`{ items { ...F ... on Item { m: n } ... on Query { x: n } } } fragment F on Item { n }`, "", "", `{"data":{"items":[{"n":0,"m":0},{"n":1,"m":1}]}}`},
+		{`query($no: Boolean = false) { items(n: 1) { n @include(if: $no) m: n @skip(if: $no) } }`, "", "", `{"data":{"items":[{"m":0}]}}`},
+		// Errors in fields leave them null
+		{`{ items(n: 1) { n nope } }`, "", "", `{"data":{"items":[{"n":0,"nope":null}]},"errors":[{"message":"type Item has no field nope","path":["items",0,"nope"]}]}`},
+		{`{ items(n: "x") { n } echo(x: 1) }`, "", "", `{"data":{"items":null,"echo":null},"errors":[{"message":"argument n must be an integer","path":["items"]},{"message":"field echo has no argument x","path":["echo"]}]}`},
+		{`{ items }`, "", "", `{"data":{"items":null},"errors":[{"message":"field items of type [Item] must have a selection of subfields","path":["items"]}]}`},
+	} {
+		doc, err := parseGQL(tt.query)
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		var vars map[string]any
+		if tt.vars != "" {
+			json.Unmarshal([]byte(tt.vars), &vars)
+		}
+		resp, err := execGQL(gqlTestSchema, doc, tt.op, vars, gqlTestRoot{})
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		if got, _ := json.Marshal(resp); string(got) != tt.want {
+			t.Errorf("%s = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestGraphQLErrors(t *testing.T) {
+	for _, tt := range []struct{ query, op, want string }{
+		{`{ echo(v: "a" }`, "", "expected a name"},
+		{`{ }`, "", "empty selection set"},
+		{`{ echo(v: """a""") }`, "", "block strings"},
+		{`query($v: Int = $w) { echo(v: $v) }`, "", "variables can't be used here"},
+		{`fragment F on Query { echo } fragment F on Query { echo }`, "", "defined twice"},
+		{`mutation { echo }`, "", "mutation operations are not supported"},
+		{`query A { echo } query B { echo }`, "", "operationName is required"},
+		{`{ echo }`, "B", "no operation B"},
+		{`query($v: String!) { echo(v: $v) }`, "", "variable $v is required"},
+	} {
+		doc, err := parseGQL(tt.query)
+		if err == nil {
+			_, err = execGQL(gqlTestSchema, doc, tt.op, nil, gqlTestRoot{})
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.query, err, tt.want)
+		}
+	}
+}
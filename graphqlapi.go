@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// graphQLSchema is the schema of /graphql, for dashboards that want
+// chunks, their fields and what happened to them in one round trip:
+//
+//	type Query {
+//	  files: [File!]!
+//	  file(path: String): File
+//	  chunks(file: String, prefix: [String!], first: Int, after: String): [Chunk!]!
+//	  chunk(file: String, destination: String!): Chunk
+//	  changeSets(file: String, last: Int): [ChangeSet!]!
+//	}
+//	type File { path: String! routes: Int! mechanism: String!
+//	  chunks(prefix: [String!], first: Int, after: String): [Chunk!]!
+//	  changeSets(last: Int): [ChangeSet!]! }
+//	type Chunk { file: String! destination: String! hash: String!
+//	  startLine: Int! endLine: Int! content: String
+//	  fields(names: [String!]): [Field!]! field(name: String!): String
+//	  history(last: Int, type: [String!]): [Change!]! }
+//	type Field { name: String! value: String! }
+//	type ChangeSet { id: Int! stream: String! path: String! time: String!
+//	  routes: Int! changes(type: [String!], prefix: [String!]): [Change!]! }
+//	type Change { changeSet: Int! stream: String! time: String! seq: Int!
+//	  type: String! destination: String! critical: Boolean!
+//	  volatile: Boolean! oldHash: String newHash: String }
+//
+// file may be left out where only one file is watched. Chunks are listed
+// by destination, a page of first at a time as in /api/v1/chunks. The
+// change sets, and a chunk's history, are those the feed keeps, the last
+// DefaultFeedSize; history is its notifiable changes, newest first.
+var graphQLSchema = gqlSchema{
+	"Query": {
+		"files":      nil,
+		"file":       {"path"},
+		"chunks":     {"file", "prefix", "first", "after"},
+		"chunk":      {"file", "destination"},
+		"changeSets": {"file", "last"},
+	},
+	"File": {
+		"path": nil, "routes": nil, "mechanism": nil,
+		"chunks":     {"prefix", "first", "after"},
+		"changeSets": {"last"},
+	},
+	"Chunk": {
+		"file": nil, "destination": nil, "hash": nil, "startLine": nil, "endLine": nil, "content": nil,
+		"fields":  {"names"},
+		"field":   {"name"},
+		"history": {"last", "type"},
+	},
+	"Field": {"name": nil, "value": nil},
+	"ChangeSet": {
+		"id": nil, "stream": nil, "path": nil, "time": nil, "routes": nil,
+		"changes": {"type", "prefix"},
+	},
+	"Change": {
+		"changeSet": nil, "stream": nil, "time": nil, "seq": nil, "type": nil, "destination": nil,
+		"critical": nil, "volatile": nil, "oldHash": nil, "newHash": nil,
+	},
+}
+
+// graphQLRequest is the body of a POST to /graphql
+type graphQLRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// graphQL serves /graphql: queries in a POSTed JSON body or, for GET, the
+// query, operationName and variables parameters
+func (ui *WebUI) graphQL(w http.ResponseWriter, r *http.Request) {
+	var req graphQLRequest
+	if r.Method == http.MethodGet {
+		q := r.URL.Query()
+		req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				writeGraphQLError(w, fmt.Errorf("invalid variables: %w", err))
+				return
+			}
+		}
+	} else {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			writeGraphQLError(w, err)
+			return
+		}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/graphql") {
+			req.Query = string(body)
+		} else if err := json.Unmarshal(body, &req); err != nil {
+			writeGraphQLError(w, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+	}
+	doc, err := parseGQL(req.Query)
+	if err != nil {
+		writeGraphQLError(w, err)
+		return
+	}
+	root := &gqlQuery{targets: ui.Targets(), recent: ui.Feed.Recent()}
+	resp, err := execGQL(graphQLSchema, doc, req.OperationName, req.Variables, root)
+	if err != nil {
+		writeGraphQLError(w, err)
+		return
+	}
+	writeJSON(w, resp)
+}
+
+// writeGraphQLError answers a request that couldn't be executed
+func writeGraphQLError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	writeJSON(w, gqlResponse{Errors: []gqlError{{Message: err.Error()}}})
+}
+
+// gqlQuery is the Query type. It reads the feed once, so every field of a
+// query sees the same change sets.
+type gqlQuery struct {
+	targets []*Target
+	recent  []*feedEntry
+}
+
+func (q *gqlQuery) gqlType() string { return "Query" }
+
+func (q *gqlQuery) gqlField(name string, args map[string]any) (any, error) {
+	switch name {
+	case "files":
+		slices.SortFunc(q.targets, func(a, b *Target) int { return strings.Compare(a.Name, b.Name) })
+		files := []gqlObject{}
+		for _, t := range q.targets {
+			files = append(files, &gqlFile{q, t})
+		}
+		return files, nil
+	case "file":
+		t, err := q.target(args, "path")
+		if t == nil || err != nil {
+			return nil, err
+		}
+		return &gqlFile{q, t}, nil
+	case "chunks":
+		t, err := q.target(args, "file")
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			return []gqlObject{}, nil
+		}
+		return (&gqlFile{q, t}).gqlField(name, args)
+	case "chunk":
+		t, err := q.target(args, "file")
+		if t == nil || err != nil {
+			return nil, err
+		}
+		dest, err := gqlString(args, "destination")
+		if err != nil {
+			return nil, err
+		}
+		t.Table.mu.RLock()
+		c := t.Table.Chunks[dest]
+		t.Table.mu.RUnlock()
+		if c == nil {
+			return nil, nil
+		}
+		return &gqlChunk{q, t, c}, nil
+	case "changeSets":
+		path, err := gqlString(args, "file")
+		if err != nil {
+			return nil, err
+		}
+		return q.changeSets(path, args)
+	}
+	return nil, nil
+}
+
+// target returns the target named by the argument arg, or the only one.
+// It returns nil without an error for a file that isn't watched.
+func (q *gqlQuery) target(args map[string]any, arg string) (*Target, error) {
+	file, err := gqlString(args, arg)
+	if err != nil {
+		return nil, err
+	}
+	if file == "" {
+		if len(q.targets) == 1 {
+			return q.targets[0], nil
+		}
+		return nil, fmt.Errorf("%s is required when watching more than one file", arg)
+	}
+	for _, t := range q.targets {
+		if t.Name == file {
+			return t, nil
+		}
+	}
+	return nil, nil
+}
+
+// changeSets returns the last of the recent change sets of path, or of
+// every file
+func (q *gqlQuery) changeSets(path string, args map[string]any) ([]gqlObject, error) {
+	last, err := gqlInt(args, "last", len(q.recent))
+	if err != nil {
+		return nil, err
+	}
+	list := []gqlObject{}
+	for _, e := range q.recent {
+		if path == "" || e.cs.Path == path {
+			list = append(list, &gqlChangeSet{e.cs})
+		}
+	}
+	return list[max(0, len(list)-last):], nil
+}
+
+// gqlFile is the File type
+type gqlFile struct {
+	q *gqlQuery
+	t *Target
+}
+
+func (f *gqlFile) gqlType() string { return "File" }
+
+func (f *gqlFile) gqlField(name string, args map[string]any) (any, error) {
+	switch name {
+	case "path":
+		return f.t.Name, nil
+	case "routes":
+		return f.t.Status().Routes, nil
+	case "mechanism":
+		return f.t.Status().Mechanism, nil
+	case "chunks":
+		return f.chunks(args)
+	case "changeSets":
+		return f.q.changeSets(f.t.Name, args)
+	}
+	return nil, nil
+}
+
+func (f *gqlFile) chunks(args map[string]any) (any, error) {
+	first, err := gqlInt(args, "first", defaultChunkPage)
+	if err != nil {
+		return nil, err
+	}
+	first = min(first, maxChunkPage)
+	after, err := gqlString(args, "after")
+	if err != nil {
+		return nil, err
+	}
+	rules, err := gqlStrings(args, "prefix")
+	if err != nil {
+		return nil, err
+	}
+	var prefixes *PrefixRules
+	if len(rules) > 0 {
+		if prefixes, err = newPrefixRules(rules); err != nil {
+			return nil, err
+		}
+	}
+
+	f.t.Table.mu.RLock()
+	var chunks []*Chunk
+	for dest, c := range f.t.Table.Chunks {
+		if (after == "" || dest > after) && (prefixes == nil || prefixes.Match(dest)) {
+			chunks = append(chunks, c)
+		}
+	}
+	f.t.Table.mu.RUnlock()
+	slices.SortFunc(chunks, func(a, b *Chunk) int { return strings.Compare(a.Destination, b.Destination) })
+	list := []gqlObject{}
+	for _, c := range chunks[:min(max(first, 0), len(chunks))] {
+		list = append(list, &gqlChunk{f.q, f.t, c})
+	}
+	return list, nil
+}
+
+// gqlChunk is the Chunk type
+type gqlChunk struct {
+	q *gqlQuery
+	t *Target
+	c *Chunk
+}
+
+func (c *gqlChunk) gqlType() string { return "Chunk" }
+
+func (c *gqlChunk) gqlField(name string, args map[string]any) (any, error) {
+	switch name {
+	case "file":
+		return c.t.Name, nil
+	case "destination":
+		return c.c.Destination, nil
+	case "hash":
+		return c.c.Hash, nil
+	case "startLine":
+		return c.c.StartLine, nil
+	case "endLine":
+		return c.c.EndLine, nil
+	case "content":
+		data, err := c.c.Content()
+		if err != nil {
+			return nil, err
+		}
+		return string(data), nil
+	case "fields", "field":
+		return c.fields(name, args)
+	case "history":
+		return c.history(args)
+	}
+	return nil, nil
+}
+
+// fields returns the chunk's fields, those named or the value of one
+func (c *gqlChunk) fields(name string, args map[string]any) (any, error) {
+	names, err := gqlStrings(args, "names")
+	if err != nil {
+		return nil, err
+	}
+	if name == "field" {
+		field, err := gqlString(args, "name")
+		if err != nil {
+			return nil, err
+		}
+		names = []string{field}
+	}
+	data, err := c.c.Content()
+	if err != nil {
+		return nil, err
+	}
+	list := []gqlObject{}
+	for _, line := range strings.Split(string(data), "\n") {
+		for _, f := range parseFields(line) {
+			if f.Value == "" || names != nil && !slices.ContainsFunc(names, func(n string) bool { return strings.EqualFold(n, f.Name) }) {
+				continue
+			}
+			if name == "field" {
+				return f.Value, nil
+			}
+			list = append(list, &gqlField{f})
+		}
+	}
+	if name == "field" {
+		return nil, nil
+	}
+	return list, nil
+}
+
+// history returns the changes to the chunk's destination in the recent
+// change sets of its file, newest first
+func (c *gqlChunk) history(args map[string]any) (any, error) {
+	last, err := gqlInt(args, "last", len(c.q.recent))
+	if err != nil {
+		return nil, err
+	}
+	types, err := gqlStrings(args, "type")
+	if err != nil {
+		return nil, err
+	}
+	filter, err := parseChangeFilter(c.t.Name, strings.Join(types, ","), "")
+	if err != nil {
+		return nil, err
+	}
+	list := []gqlObject{}
+	for i := len(c.q.recent) - 1; i >= 0 && len(list) < last; i-- {
+		cs := c.q.recent[i].cs
+		changes := filter.changes(cs)
+		for j := len(changes) - 1; j >= 0 && len(list) < last; j-- {
+			if changes[j].Destination == c.c.Destination {
+				list = append(list, &gqlChange{cs, changes[j]})
+			}
+		}
+	}
+	return list, nil
+}
+
+// gqlField is the Field type
+type gqlField struct{ f Field }
+
+func (f *gqlField) gqlType() string { return "Field" }
+
+func (f *gqlField) gqlField(name string, args map[string]any) (any, error) {
+	if name == "name" {
+		return f.f.Name, nil
+	}
+	return f.f.Value, nil
+}
+
+// gqlChangeSet is the ChangeSet type
+type gqlChangeSet struct{ cs *ChangeSet }
+
+func (s *gqlChangeSet) gqlType() string { return "ChangeSet" }
+
+func (s *gqlChangeSet) gqlField(name string, args map[string]any) (any, error) {
+	switch name {
+	case "id":
+		return s.cs.ID, nil
+	case "stream":
+		return s.cs.Stream, nil
+	case "path":
+		return s.cs.Path, nil
+	case "time":
+		return s.cs.Time.Format(time.RFC3339Nano), nil
+	case "routes":
+		return s.cs.Routes, nil
+	case "changes":
+		types, err := gqlStrings(args, "type")
+		if err != nil {
+			return nil, err
+		}
+		prefixes, err := gqlStrings(args, "prefix")
+		if err != nil {
+			return nil, err
+		}
+		filter, err := parseChangeFilter("", strings.Join(types, ","), strings.Join(prefixes, ","))
+		if err != nil {
+			return nil, err
+		}
+		list := []gqlObject{}
+		for _, c := range filter.changes(s.cs) {
+			list = append(list, &gqlChange{s.cs, c})
+		}
+		return list, nil
+	}
+	return nil, nil
+}
+
+// gqlChange is the Change type
+type gqlChange struct {
+	cs *ChangeSet
+	c  Change
+}
+
+func (c *gqlChange) gqlType() string { return "Change" }
+
+func (c *gqlChange) gqlField(name string, args map[string]any) (any, error) {
+	switch name {
+	case "changeSet":
+		return c.cs.ID, nil
+	case "stream":
+		return c.cs.Stream, nil
+	case "time":
+		return c.cs.Time.Format(time.RFC3339Nano), nil
+	case "seq":
+		return c.c.Seq, nil
+	case "type":
+		return string(c.c.Type), nil
+	case "destination":
+		return c.c.Destination, nil
+	case "critical":
+		return c.c.Critical, nil
+	case "volatile":
+		return c.c.Volatile, nil
+	case "oldHash":
+		return gqlNullable(c.c.OldHash), nil
+	case "newHash":
+		return gqlNullable(c.c.NewHash), nil
+	}
+	return nil, nil
+}
+
+// gqlNullable returns s, or null if it is empty
+func gqlNullable(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGraphQLAPI(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"), routeBlock("10.1.0.0/16", "OSPF", "172.31.0.2"), routeBlock("0.0.0.0/0", "Static", "172.31.0.254"))
+	target := NewTarget(path, loadTable(t, path), NewDispatcher(nil, nil))
+	feed := NewChangeFeed(10)
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	feed.Publish(&ChangeSet{Stream: "s", ID: 1, Path: path, Time: at, Changes: []Change{{Seq: 1, Type: ChangeAdded, Destination: "10.0.0.0/8", NewHash: "h1"}}})
+	feed.Publish(&ChangeSet{Stream: "s", ID: 2, Path: path, Time: at, Changes: []Change{
+		{Seq: 2, Type: ChangeModified, Destination: "10.0.0.0/8", OldHash: "h1", NewHash: "h2"},
+		{Seq: 3, Type: ChangeRemoved, Destination: "192.0.2.0/24", OldHash: "h3"},
+	}})
+	feed.Publish(&ChangeSet{Stream: "s", ID: 3, Path: "/elsewhere", Time: at, Changes: []Change{{Seq: 1, Type: ChangeAdded, Destination: "10.0.0.0/8"}}})
+	ui := &WebUI{Targets: func() []*Target { return []*Target{target} }, Feed: feed, GraphQL: true}
+	srv := httptest.NewServer(ui.Handler())
+	defer srv.Close()
+
+	query := func(q string, code int) string {
+		t.Helper()
+		body, _ := json.Marshal(graphQLRequest{Query: q})
+		resp, err := http.Post(srv.URL+"/graphql", "application/json", strings.NewReader(string(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != code {
+			t.Fatalf("%s: %s, want %d", q, resp.Status, code)
+		}
+		var out json.RawMessage
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	}
+
+	got := query(`{ chunks(prefix: "10.0.0.0/8+", first: 1) { destination fields(names: ["protocol", "NextHop"]) { name value } nh: field(name: "NextHop") history { changeSet type oldHash } } }`, http.StatusOK)
+	want := `{"data":{"chunks":[{"destination":"10.0.0.0/8","fields":[{"name":"Protocol","value":"IBGP"},{"name":"NextHop","value":"172.31.0.1"}],"nh":"172.31.0.1","history":[{"changeSet":2,"type":"modified","oldHash":"h1"},{"changeSet":1,"type":"added","oldHash":null}]}]}}`
+	if got != want {
+		t.Errorf("chunks = %s, want %s", got, want)
+	}
+
+	got = query(`{ files { path routes chunks(after: "10.0.0.0/8") { destination } changeSets(last: 1) { id time changes(type: "removed") { destination } } } missing: file(path: "/nope") { path } }`, http.StatusOK)
+	want = `{"data":{"files":[{"path":"` + path + `","routes":3,"chunks":[{"destination":"10.1.0.0/16"}],"changeSets":[{"id":2,"time":"2026-01-02T03:04:05Z","changes":[{"destination":"192.0.2.0/24"}]}]}],"missing":null}}`
+	if got != want {
+		t.Errorf("files = %s, want %s", got, want)
+	}
+
+	got = query(`{ chunk(destination: "0.0.0.0/0") { hash content } changeSets { id } }`, http.StatusOK)
+	if !strings.Contains(got, `"hash":"`+target.Table.Chunks["0.0.0.0/0"].Hash+`"`) || !strings.Contains(got, "Static") || !strings.Contains(got, `"changeSets":[{"id":1},{"id":2},{"id":3}]`) {
+		t.Errorf("chunk = %s", got)
+	}
+	if got = query(`{ chunks(prefix: "10.0.0.0/33+") { hash } }`, http.StatusOK); !strings.Contains(got, `"errors"`) {
+		t.Errorf("bad prefix = %s", got)
+	}
+	query(`{ chunks { hash }`, http.StatusBadRequest)
+
+	// GET takes the query in the URL
+	resp, err := http.Get(srv.URL + "/graphql?query=" + url.QueryEscape(`query($d: String!) { chunk(destination: $d) { startLine } }`) + "&variables=" + url.QueryEscape(`{"d": "10.0.0.0/8"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Data struct{ Chunk struct{ StartLine int } }
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil || out.Data.Chunk.StartLine != 1 {
+		t.Errorf("GET = %+v, %v", out, err)
+	}
+
+	// Without -graphql there is no endpoint
+	ui.GraphQL = false
+	noGraphQL := httptest.NewServer(ui.Handler())
+	defer noGraphQL.Close()
+	if resp, err := http.Post(noGraphQL.URL+"/graphql", "application/json", strings.NewReader("{}")); err != nil || resp.StatusCode == http.StatusOK {
+		t.Errorf("without GraphQL: %v, %v", resp.Status, err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Group counts the changes to the routes sharing a protocol or interface
+// by type
+type Group struct {
+	Key      string `json:"key"`
+	Added    int    `json:"added,omitempty"`
+	Removed  int    `json:"removed,omitempty"`
+	Modified int    `json:"modified,omitempty"`
+}
+
+// Total returns the number of changes in the group
+func (g Group) Total() int {
+	return g.Added + g.Removed + g.Modified
+}
+
+// Groups breaks a change set down by the Protocol and Interface fields of
+// the changed routes, to show the blast radius of a large change
+type Groups struct {
+	ByProtocol  []Group `json:"by_protocol"`
+	ByInterface []Group `json:"by_interface"`
+}
+
+// changeInterface returns the outgoing interface of the changed route
+func changeInterface(c *Change) string {
+	if iface := chunkField(c.Chunk(), "Interface"); iface != "" {
+		return iface
+	}
+	return "unknown"
+}
+
+// groupCounter accumulates Groups by key
+type groupCounter map[string]*Group
+
+func (gc groupCounter) add(key string, t ChangeType) {
+	g := gc[key]
+	if g == nil {
+		g = &Group{Key: key}
+		gc[key] = g
+	}
+	switch t {
+	case ChangeAdded:
+		g.Added++
+	case ChangeRemoved:
+		g.Removed++
+	case ChangeModified:
+		g.Modified++
+	}
+}
+
+// sorted returns the groups, largest first, then by key
+func (gc groupCounter) sorted() []Group {
+	groups := make([]Group, 0, len(gc))
+	for _, g := range gc {
+		groups = append(groups, *g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Total() != groups[j].Total() {
+			return groups[i].Total() > groups[j].Total()
+		}
+		return groups[i].Key < groups[j].Key
+	})
+	return groups
+}
+
+// groupChanges groups changes by protocol and by interface
+func groupChanges(changes []Change) *Groups {
+	protocols, interfaces := make(groupCounter), make(groupCounter)
+	for i := range changes {
+		c := &changes[i]
+		protocols.add(changeProtocol(c), c.Type)
+		interfaces.add(changeInterface(c), c.Type)
+	}
+	return &Groups{ByProtocol: protocols.sorted(), ByInterface: interfaces.sorted()}
+}
+
+// formatGroups renders the first max groups as
+// "IBGP: 230 modified, 2 added; Static: 1 removed", noting how many were
+// left out
+func formatGroups(groups []Group, max int) string {
+	var parts []string
+	for i, g := range groups {
+		if i == max {
+			parts = append(parts, fmt.Sprintf("+%d more", len(groups)-max))
+			break
+		}
+		var counts []string
+		for _, c := range []struct {
+			n int
+			t ChangeType
+		}{{g.Modified, ChangeModified}, {g.Added, ChangeAdded}, {g.Removed, ChangeRemoved}} {
+			if c.n > 0 {
+				counts = append(counts, fmt.Sprintf("%d %s", c.n, c.t))
+			}
+		}
+		parts = append(parts, g.Key+": "+strings.Join(counts, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestGroupChanges(t *testing.T) {
+	route := func(proto, iface string) *Chunk {
+		return &Chunk{Data: []byte(fmt.Sprintf("Destination: x\n     Protocol: %s               Process ID: 0\n RelayNextHop: 0.0.0.0       Interface: %s", proto, iface))}
+	}
+	var changes []Change
+	for i := 0; i < 3; i++ {
+		changes = append(changes, Change{Type: ChangeModified, Destination: fmt.Sprintf("10.0.%d.0/24", i), New: route("IBGP", "VE1.75")})
+	}
+	changes = append(changes,
+		Change{Type: ChangeAdded, Destination: "10.1.0.0/16", New: route("IBGP", "VE1.80")},
+		Change{Type: ChangeRemoved, Destination: "0.0.0.0/0", Old: route("Static", "VE1.80")},
+		Change{Type: ChangeAdded, Destination: "10.2.0.0/16", New: &Chunk{Data: []byte("Destination: 10.2.0.0/16")}},
+	)
+
+	g := groupChanges(changes)
+	if got := formatGroups(g.ByProtocol, 5); got != "IBGP: 3 modified, 1 added; Static: 1 removed; unknown: 1 added" {
+		t.Errorf("by protocol = %q", got)
+	}
+	if got := formatGroups(g.ByInterface, 1); got != "VE1.75: 3 modified; +2 more" {
+		t.Errorf("by interface = %q", got)
+	}
+
+	// Large change sets are reported grouped
+	var b strings.Builder
+	reportChanges(&b, &ChangeSet{Path: "t.txt", Changes: changes}, 0, ReportOptions{PreviewLimit: 2})
+	if !strings.Contains(b.String(), "  by interface: VE1.75: 3 modified; VE1.80: 1 added, 1 removed; unknown: 1 added\n") {
+		t.Errorf("report:\n%s", b.String())
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// WatcherService serves the gowatcher.v1.Watcher gRPC service of
+// proto/watcher.proto, for services that want typed clients: listing the
+// files and their chunks, fetching a chunk and subscribing to change sets,
+// which are the Changeset messages of -output protobuf. Messages are
+// encoded by hand as in protobuf.go.
+type WatcherService struct {
+	// Targets returns the targets being watched
+	Targets func() []*Target
+	Feed    *ChangeFeed
+}
+
+// Handler returns the service's HTTP handler, to be served over HTTP/2
+func (s *WatcherService) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /gowatcher.v1.Watcher/ListFiles", s.listFiles)
+	mux.HandleFunc("POST /gowatcher.v1.Watcher/ListChunks", s.listChunks)
+	mux.HandleFunc("POST /gowatcher.v1.Watcher/GetChunk", s.getChunk)
+	mux.HandleFunc("POST /gowatcher.v1.Watcher/SubscribeChanges", s.subscribeChanges)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if grpcStart(w, r) {
+			grpcFinish(w, &grpcError{grpcUnimplemented, "unknown method " + r.URL.Path})
+		}
+	})
+	return mux
+}
+
+// grpcHandler serves the Watcher service and gNMI on one port
+func grpcHandler(targets func() []*Target, feed *ChangeFeed) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/gowatcher.v1.Watcher/", (&WatcherService{Targets: targets, Feed: feed}).Handler())
+	mux.Handle("/", (&GNMIServer{Targets: targets, Feed: feed}).Handler())
+	return mux
+}
+
+// request starts an RPC and reads its request message, ending the RPC if
+// that fails
+func (s *WatcherService) request(w http.ResponseWriter, r *http.Request) ([]protoField, bool) {
+	if !grpcStart(w, r) {
+		return nil, false
+	}
+	msg, err := readGRPCMessage(r.Body)
+	if err != nil {
+		grpcFinish(w, err)
+		return nil, false
+	}
+	fields, err := parseProto(msg)
+	if err != nil {
+		grpcFinish(w, &grpcError{grpcInvalidArgument, err.Error()})
+		return nil, false
+	}
+	return fields, true
+}
+
+// target returns the target with path file, or the only one
+func (s *WatcherService) target(file string) (*Target, error) {
+	targets := s.Targets()
+	if file == "" && len(targets) == 1 {
+		return targets[0], nil
+	}
+	if file == "" {
+		return nil, &grpcError{grpcInvalidArgument, "file is required when watching more than one file"}
+	}
+	for _, t := range targets {
+		if t.Name == file {
+			return t, nil
+		}
+	}
+	return nil, &grpcError{grpcNotFound, "not watching " + file}
+}
+
+func (s *WatcherService) listFiles(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.request(w, r); !ok {
+		return
+	}
+	targets := s.Targets()
+	slices.SortFunc(targets, func(a, b *Target) int { return strings.Compare(a.Name, b.Name) })
+	var b []byte
+	for _, t := range targets {
+		st := t.Status()
+		var file []byte
+		file = appendProtoString(file, 1, st.Name)
+		file = appendProtoVarint(file, 2, uint64(st.Routes))
+		file = appendProtoString(file, 3, st.Mechanism)
+		b = appendProtoBytes(b, 1, file)
+	}
+	grpcFinish(w, grpcSend(w, b))
+}
+
+func (s *WatcherService) listChunks(w http.ResponseWriter, r *http.Request) {
+	fields, ok := s.request(w, r)
+	if !ok {
+		return
+	}
+	var file string
+	var rules []string
+	var content bool
+	for _, f := range fields {
+		switch {
+		case f.field == 1 && f.wire == wireBytes:
+			file = string(f.data)
+		case f.field == 2 && f.wire == wireBytes:
+			rules = append(rules, string(f.data))
+		case f.field == 3 && f.wire == wireVarint:
+			content = f.num != 0
+		}
+	}
+	t, err := s.target(file)
+	if err != nil {
+		grpcFinish(w, err)
+		return
+	}
+	var prefixes *PrefixRules
+	if len(rules) > 0 {
+		if prefixes, err = newPrefixRules(rules); err != nil {
+			grpcFinish(w, &grpcError{grpcInvalidArgument, err.Error()})
+			return
+		}
+	}
+
+	t.Table.mu.RLock()
+	var chunks []*Chunk
+	for dest, c := range t.Table.Chunks {
+		if prefixes == nil || prefixes.Match(dest) {
+			chunks = append(chunks, c)
+		}
+	}
+	t.Table.mu.RUnlock()
+	slices.SortFunc(chunks, func(a, b *Chunk) int { return strings.Compare(a.Destination, b.Destination) })
+	// Each send waits for the client's flow control window, so a slow
+	// client slows the listing down rather than filling memory
+	for _, c := range chunks {
+		if err := grpcSend(w, marshalChunkProto(t, c, content)); err != nil {
+			return
+		}
+	}
+	grpcFinish(w, nil)
+}
+
+func (s *WatcherService) getChunk(w http.ResponseWriter, r *http.Request) {
+	fields, ok := s.request(w, r)
+	if !ok {
+		return
+	}
+	var file, dest string
+	for _, f := range fields {
+		switch {
+		case f.field == 1 && f.wire == wireBytes:
+			file = string(f.data)
+		case f.field == 2 && f.wire == wireBytes:
+			dest = string(f.data)
+		}
+	}
+	t, err := s.target(file)
+	if err != nil {
+		grpcFinish(w, err)
+		return
+	}
+	t.Table.mu.RLock()
+	c, ok := t.Table.Chunks[dest]
+	t.Table.mu.RUnlock()
+	if !ok {
+		grpcFinish(w, &grpcError{grpcNotFound, "no route to " + dest + " in " + t.Name})
+		return
+	}
+	grpcFinish(w, grpcSend(w, marshalChunkProto(t, c, true)))
+}
+
+// marshalChunkProto encodes chunk c of t as a Chunk message, with its
+// content if asked to
+func marshalChunkProto(t *Target, c *Chunk, content bool) []byte {
+	var b []byte
+	b = appendProtoString(b, 1, t.Name)
+	b = appendProtoString(b, 2, c.Destination)
+	b = appendProtoString(b, 3, c.Hash)
+	b = appendProtoVarint(b, 4, uint64(c.StartLine))
+	b = appendProtoVarint(b, 5, uint64(c.EndLine))
+	if content {
+		b = appendProtoString(b, 6, chunkText(c))
+	}
+	return b
+}
+
+// changeTypeNames maps the ChangeType enum to change types
+var changeTypeNames = map[uint64]string{1: string(ChangeAdded), 2: string(ChangeRemoved), 3: string(ChangeModified)}
+
+func (s *WatcherService) subscribeChanges(w http.ResponseWriter, r *http.Request) {
+	fields, ok := s.request(w, r)
+	if !ok {
+		return
+	}
+	var paths, types, rules []string
+	var after map[string]uint64
+	for _, f := range fields {
+		switch {
+		case f.field == 1 && f.wire == wireBytes:
+			paths = append(paths, string(f.data))
+		case f.field == 2:
+			nums, err := protoVarints(f)
+			if err != nil {
+				grpcFinish(w, &grpcError{grpcInvalidArgument, err.Error()})
+				return
+			}
+			for _, n := range nums {
+				name, ok := changeTypeNames[n]
+				if !ok {
+					grpcFinish(w, &grpcError{grpcInvalidArgument, fmt.Sprintf("unknown change type %d", n)})
+					return
+				}
+				types = append(types, name)
+			}
+		case f.field == 3 && f.wire == wireBytes:
+			rules = append(rules, string(f.data))
+		case f.field == 4 && f.wire == wireBytes:
+			entry, err := parseProto(f.data)
+			if err != nil {
+				grpcFinish(w, &grpcError{grpcInvalidArgument, err.Error()})
+				return
+			}
+			var stream string
+			var id uint64
+			for _, ef := range entry {
+				switch {
+				case ef.field == 1 && ef.wire == wireBytes:
+					stream = string(ef.data)
+				case ef.field == 2 && ef.wire == wireVarint:
+					id = ef.num
+				}
+			}
+			if after == nil {
+				after = make(map[string]uint64)
+			}
+			after[stream] = id
+		}
+	}
+	filter, err := parseChangeFilter(strings.Join(paths, ","), strings.Join(types, ","), strings.Join(rules, ","))
+	if err != nil {
+		grpcFinish(w, &grpcError{grpcInvalidArgument, err.Error()})
+		return
+	}
+
+	recent, feed, stop := s.Feed.SubscribeStrict()
+	defer stop()
+	send := func(e *feedEntry) error {
+		changes := filter.changes(e.cs)
+		if len(changes) == 0 {
+			return nil
+		}
+		cs := *e.cs
+		cs.Changes = changes
+		sum := cs.Summarize(0)
+		return grpcSend(w, marshalChangeSetProto(&cs, &sum))
+	}
+	if after != nil {
+		for _, e := range recent {
+			if last, ok := after[e.cs.Stream]; ok && e.cs.ID <= last {
+				continue
+			}
+			if err := send(e); err != nil {
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case e, ok := <-feed:
+			if !ok {
+				grpcFinish(w, &grpcError{grpcResourceExhausted, "subscriber fell behind; subscribe again with after set to resume"})
+				return
+			}
+			if err := send(e); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// protoVarints returns the values of a repeated varint field, packed or
+// not
+func protoVarints(f protoField) ([]uint64, error) {
+	if f.wire == wireVarint {
+		return []uint64{f.num}, nil
+	}
+	if f.wire != wireBytes {
+		return nil, errors.New("invalid repeated varint field")
+	}
+	var nums []uint64
+	for b := f.data; len(b) > 0; {
+		n, size := binary.Uvarint(b)
+		if size <= 0 {
+			return nil, errProtoTruncated
+		}
+		nums = append(nums, n)
+		b = b[size:]
+	}
+	return nums, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// watcherResponses reads the messages of a Watcher RPC until it ends,
+// returning them with its status
+func watcherResponses(t *testing.T, resp *http.Response) ([][]protoField, string) {
+	t.Helper()
+	var out [][]protoField
+	for {
+		msg, err := readGRPCMessage(resp.Body)
+		if err == io.EOF {
+			return out, resp.Trailer.Get("Grpc-Status") + " " + resp.Trailer.Get("Grpc-Message")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields, err := parseProto(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, fields)
+	}
+}
+
+// protoString returns string field n of a message
+func protoString(fields []protoField, n int) string {
+	for _, f := range fields {
+		if f.field == n && f.wire == wireBytes {
+			return string(f.data)
+		}
+	}
+	return ""
+}
+
+func TestWatcherService(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"), routeBlock("10.1.0.0/16", "OSPF", "172.31.0.2"), routeBlock("0.0.0.0/0", "Static", "172.31.0.254"))
+	target := NewTarget(path, loadTable(t, path), NewDispatcher(nil, nil))
+	targets := []*Target{target}
+	addr := startGRPC(t, grpcHandler(func() []*Target { return targets }, NewChangeFeed(10)))
+	call := func(method string, req []byte) ([][]protoField, string) {
+		t.Helper()
+		w, resp := grpcCall(t, addr, "/gowatcher.v1.Watcher/"+method)
+		w.Write(grpcFrame(req))
+		w.Close()
+		return watcherResponses(t, resp)
+	}
+
+	got, status := call("ListFiles", nil)
+	if len(got) != 1 || status != "0 " {
+		t.Fatalf("ListFiles = %v, status %q", got, status)
+	}
+	file, _ := parseProto(got[0][0].data)
+	if protoString(file, 1) != path || file[1].num != 3 {
+		t.Errorf("file = %+v", file)
+	}
+
+	var req []byte
+	req = appendProtoString(req, 2, "10.0.0.0/8+")
+	got, status = call("ListChunks", req)
+	if len(got) != 2 || status != "0 " || protoString(got[0], 2) != "10.0.0.0/8" || protoString(got[1], 2) != "10.1.0.0/16" || protoString(got[0], 6) != "" {
+		t.Errorf("ListChunks = %v, status %q", got, status)
+	}
+
+	req = appendProtoString(appendProtoString(nil, 1, path), 2, "0.0.0.0/0")
+	got, status = call("GetChunk", req)
+	if len(got) != 1 || status != "0 " || protoString(got[0], 3) != target.Table.Chunks["0.0.0.0/0"].Hash || !strings.Contains(protoString(got[0], 6), "Static") {
+		t.Errorf("GetChunk = %v, status %q", got, status)
+	}
+	for _, tt := range []struct {
+		method string
+		req    []byte
+		status string
+	}{
+		{"GetChunk", appendProtoString(nil, 2, "192.0.2.0/24"), "5 no route to 192.0.2.0/24 in " + path},
+		{"GetChunk", appendProtoString(nil, 1, "/elsewhere"), "5 not watching /elsewhere"},
+		{"ListChunks", appendProtoString(nil, 2, "10.0.0.0/33+"), "3 "},
+		{"SubscribeChanges", appendProtoVarint(nil, 2, 7), "3 unknown change type 7"},
+		{"Watch", nil, "12 unknown method /gowatcher.v1.Watcher/Watch"},
+	} {
+		if _, status := call(tt.method, tt.req); !strings.HasPrefix(status, tt.status) {
+			t.Errorf("%s %x: status %q, want %q", tt.method, tt.req, status, tt.status)
+		}
+	}
+}
+
+func TestWatcherSubscribe(t *testing.T) {
+	feed := NewChangeFeed(10)
+	addr := startGRPC(t, grpcHandler(func() []*Target { return nil }, feed))
+	cs := pluginChangeSetSample(t)
+	for id := uint64(1); id <= 3; id++ {
+		c := *cs
+		c.Stream, c.ID = "core", id
+		feed.Publish(&c)
+	}
+
+	// Resuming after ID 2 replays ID 3, with only the removals asked for
+	var req []byte
+	req = appendProtoPacked(req, 2, []uint64{2})
+	req = appendProtoBytes(req, 4, appendProtoVarint(appendProtoString(nil, 1, "core"), 2, 2))
+	w, resp := grpcCall(t, addr, "/gowatcher.v1.Watcher/SubscribeChanges")
+	w.Write(grpcFrame(req))
+	msg, err := readGRPCMessage(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, _ := parseProto(msg)
+	var changes []string
+	for _, f := range fields {
+		if f.field == 5 {
+			c, _ := parseProto(f.data)
+			changes = append(changes, protoString(c, 3))
+		}
+	}
+	if fields[1].num != 3 || strings.Join(changes, ",") != "192.0.2.0/24" {
+		t.Errorf("replayed change set %d with %v", fields[1].num, changes)
+	}
+
+	// New change sets follow; those with nothing asked for aren't sent
+	added := &ChangeSet{Stream: "core", ID: 4, Changes: []Change{{Type: ChangeAdded, Destination: "10.9.0.0/16"}}}
+	feed.Publish(added)
+	c := *cs
+	c.Stream, c.ID = "core", 5
+	feed.Publish(&c)
+	if msg, err = readGRPCMessage(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	if fields, _ = parseProto(msg); fields[1].num != 5 {
+		t.Errorf("sent change set %d, want 5", fields[1].num)
+	}
+}
+
+func TestSubscribeStrict(t *testing.T) {
+	feed := NewChangeFeed(0)
+	_, ch, stop := feed.SubscribeStrict()
+	defer stop()
+	for id := uint64(1); id <= 20; id++ {
+		feed.Publish(&ChangeSet{ID: id})
+	}
+	n := 0
+	for range ch {
+		n++
+	}
+	if n != 16 {
+		t.Errorf("got %d change sets before the channel closed, want 16", n)
+	}
+}
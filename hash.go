@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/fnv"
+
+	"github.com/cespare/xxhash/v2"
+	"lukechampine.com/blake3"
+)
+
+// HashAlgorithm names the hash used to fingerprint chunks. Hashes made with
+// different algorithms are never comparable.
+type HashAlgorithm string
+
+const (
+	HashSHA256 HashAlgorithm = "sha256"
+	HashXXHash HashAlgorithm = "xxhash"
+	HashBLAKE3 HashAlgorithm = "blake3"
+	HashFNV    HashAlgorithm = "fnv"
+)
+
+// DefaultHash is used when no algorithm is configured
+const DefaultHash = HashSHA256
+
+// hashAlgorithms lists the supported algorithms
+var hashAlgorithms = []HashAlgorithm{HashSHA256, HashXXHash, HashBLAKE3, HashFNV}
+
+// parseHashAlgorithm validates a -hash value
+func parseHashAlgorithm(s string) (HashAlgorithm, error) {
+	if s == "" {
+		return DefaultHash, nil
+	}
+	for _, a := range hashAlgorithms {
+		if string(a) == s {
+			return a, nil
+		}
+	}
+	return "", fmt.Errorf("unknown hash algorithm %q (want sha256, xxhash, blake3 or fnv)", s)
+}
+
+// orDefault returns a, or DefaultHash if a is unset
+func (a HashAlgorithm) orDefault() HashAlgorithm {
+	if a == "" {
+		return DefaultHash
+	}
+	return a
+}
+
+// New returns a fresh hash.Hash for the algorithm
+func (a HashAlgorithm) New() hash.Hash {
+	switch a.orDefault() {
+	case HashXXHash:
+		return xxhash.New()
+	case HashBLAKE3:
+		return blake3.New(32, nil)
+	case HashFNV:
+		return fnv.New64a()
+	default:
+		return sha256.New()
+	}
+}
+
+// Sum hashes data and returns the hex encoded digest
+func (a HashAlgorithm) Sum(data []byte) string {
+	if a.orDefault() == HashSHA256 {
+		return hashChunk(data)
+	}
+	h := a.New()
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestHashAlgorithms(t *testing.T) {
+	data := []byte(routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	seen := make(map[string]HashAlgorithm)
+	for _, a := range hashAlgorithms {
+		sum := a.Sum(data)
+		if sum == "" || sum != a.Sum(data) {
+			t.Errorf("%s: unstable digest %q", a, sum)
+		}
+		if other, ok := seen[sum]; ok {
+			t.Errorf("%s and %s produced the same digest", a, other)
+		}
+		seen[sum] = a
+	}
+	if HashSHA256.Sum(data) != hashChunk(data) {
+		t.Error("sha256 does not match hashChunk")
+	}
+	if _, err := parseHashAlgorithm("md5"); err == nil {
+		t.Error("unknown algorithm accepted")
+	}
+}
+
+func TestHashAlgorithmMismatch(t *testing.T) {
+	rt := loadTable(t, writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1")))
+	if rt.Algorithm != HashSHA256 {
+		t.Fatalf("algorithm = %q", rt.Algorithm)
+	}
+
+	rt.Options.Hash = HashXXHash
+	if _, err := rt.DetectChanges(context.Background()); err == nil || !strings.Contains(err.Error(), "cannot compare") {
+		t.Errorf("mixed comparison not rejected: %v", err)
+	}
+}
+
+func TestLineHasherMatchesJoinedChunk(t *testing.T) {
+	lines := strings.Split(routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1")+"  \r", "\n")
+	for _, opts := range []LoadOptions{{}, {IgnoreFields: []string{"Age"}, Normalize: normalizeSteps}} {
+		norm, err := newNormalizer(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		normalized := make([]string, len(lines))
+		for i, line := range lines {
+			normalized[i] = norm.line(line)
+		}
+		joined := []byte(strings.Join(normalized, "\n"))
+
+		for _, a := range hashAlgorithms {
+			lh := newLineHasher(norm, a)
+			// Hash twice to check that sum resets the hasher
+			for i := 0; i < 2; i++ {
+				for _, line := range lines {
+					lh.add([]byte(line))
+				}
+				if got, want := lh.sum(), a.Sum(joined); got != want {
+					t.Errorf("%s %+v pass %d: streamed %s, joined %s", a, opts, i, got, want)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Probes and status for Kubernetes, load balancers and monitoring:
+//
+//	GET /healthz   200 while the process is serving
+//	GET /readyz    200 once the tables are loaded and none is disabled by
+//	               its circuit breaker, 503 with the reasons otherwise
+//	GET /status    serviceStatus as JSON
+
+// serviceStatus is the response of /status
+type serviceStatus struct {
+	Time    time.Time `json:"time"`
+	Started time.Time `json:"started"`
+	Ready   bool      `json:"ready"`
+	// NotReady lists why the daemon isn't ready
+	NotReady []string       `json:"not_ready,omitempty"`
+	Files    []TargetStatus `json:"files"`
+	Sinks    []SinkHealth   `json:"sinks"`
+}
+
+func (ui *WebUI) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+func (ui *WebUI) readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	var files []TargetStatus
+	for _, t := range ui.Targets() {
+		files = append(files, t.Status())
+	}
+	if reasons := ui.notReady(files); len(reasons) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(reasons, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// notReady returns why the daemon isn't ready, given its files' status
+func (ui *WebUI) notReady(files []TargetStatus) []string {
+	var reasons []string
+	if ui.Ready != nil && !ui.Ready() {
+		reasons = append(reasons, "tables are still loading")
+	}
+	for _, f := range files {
+		if f.Breaker == BreakerOpen {
+			reasons = append(reasons, f.Name+": disabled after repeated failures")
+		}
+	}
+	return reasons
+}
+
+func (ui *WebUI) serviceStatus(w http.ResponseWriter, r *http.Request) {
+	s := serviceStatus{Time: time.Now(), Started: processStart, Files: []TargetStatus{}, Sinks: []SinkHealth{}}
+	for _, t := range ui.Targets() {
+		s.Files = append(s.Files, t.Status())
+	}
+	sort.Slice(s.Files, func(i, j int) bool { return s.Files[i].Name < s.Files[j].Name })
+	s.NotReady = ui.notReady(s.Files)
+	s.Ready = len(s.NotReady) == 0
+	if ui.Dispatcher != nil {
+		s.Sinks = ui.Dispatcher.Health()
+	}
+	writeJSON(w, s)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	good, bad := &fakeSink{name: "good"}, &fakeSink{name: "bad", err: errors.New("connection refused")}
+	dispatcher := NewDispatcher([]Sink{good, bad}, nil)
+	target := NewTarget(path, loadTable(t, path), dispatcher)
+	target.Out = io.Discard
+	target.Breaker = NewCircuitBreaker(1, time.Hour)
+	var ready atomic.Bool
+	ui := &WebUI{Targets: func() []*Target { return []*Target{target} }, Dispatcher: dispatcher, Ready: ready.Load}
+	srv := httptest.NewServer(ui.Handler())
+	defer srv.Close()
+
+	get := func(url string, code int) string {
+		t.Helper()
+		resp, err := http.Get(srv.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != code {
+			t.Errorf("GET %s: %s, want %d: %s", url, resp.Status, code, body)
+		}
+		return string(body)
+	}
+
+	get("/healthz", http.StatusOK)
+	if body := get("/readyz", http.StatusServiceUnavailable); !strings.Contains(body, "still loading") {
+		t.Errorf("readyz before loading = %q", body)
+	}
+	ready.Store(true)
+	get("/readyz", http.StatusOK)
+
+	var status serviceStatus
+	if err := json.Unmarshal([]byte(get("/status", http.StatusOK)), &status); err != nil {
+		t.Fatal(err)
+	}
+	loaded := status.Files[0].LastLoad
+	if !status.Ready || len(status.Files) != 1 || loaded.IsZero() || status.Files[0].LastChangeSet != nil || len(status.Sinks) != 2 || !status.Sinks[1].Healthy {
+		t.Errorf("status before a change = %+v", status)
+	}
+
+	// The failing sink opens the breaker, which takes the daemon out of
+	// rotation
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	target.Start(ctx)
+	rewriteFile(t, path, "172.31.0.1", "172.31.0.2")
+	target.reload(ctx)
+	target.Wait()
+	if body := get("/readyz", http.StatusServiceUnavailable); !strings.Contains(body, path+": disabled") {
+		t.Errorf("readyz with the breaker open = %q", body)
+	}
+	status = serviceStatus{}
+	if err := json.Unmarshal([]byte(get("/status", http.StatusOK)), &status); err != nil {
+		t.Fatal(err)
+	}
+	f := status.Files[0]
+	if status.Ready || !f.LastLoad.After(loaded) || f.LastChangeSet == nil || f.LastChangeSet.Changes != 1 || f.Breaker != BreakerOpen {
+		t.Errorf("status after a change = %+v", status)
+	}
+	if s := status.Sinks[0]; s.Name != "good" || !s.Healthy || s.Delivered != 1 || s.LastDelivery.IsZero() {
+		t.Errorf("good sink = %+v", s)
+	}
+	if s := status.Sinks[1]; s.Name != "bad" || s.Healthy || s.Failures != 1 || s.LastError != "connection refused" {
+		t.Errorf("bad sink = %+v", s)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// DefaultHistoryDB is the database the sqlite sink writes and the history
+// command reads unless given another
+const DefaultHistoryDB = "go-watcher-history.db"
+
+// historySchema creates the table history is kept in. Existing databases
+// are refused if it changes, unless it only adds columns at the end and
+// the schema before goes in historyOlderSchemas.
+const historySchema = `CREATE TABLE changes (
+	id INTEGER PRIMARY KEY,
+	time TEXT NOT NULL,
+	stream TEXT,
+	changeset INTEGER,
+	path TEXT NOT NULL,
+	seq INTEGER,
+	type TEXT NOT NULL,
+	destination TEXT NOT NULL,
+	critical INTEGER NOT NULL,
+	old_hash TEXT,
+	new_hash TEXT,
+	volatile INTEGER NOT NULL DEFAULT 0
+)`
+
+// historyOlderSchemas are the schemas of databases written by earlier
+// versions, which are updated to historySchema when opened for writing
+var historyOlderSchemas = []string{
+	// Before volatile changes were recorded
+	`CREATE TABLE changes (
+	id INTEGER PRIMARY KEY,
+	time TEXT NOT NULL,
+	stream TEXT,
+	changeset INTEGER,
+	path TEXT NOT NULL,
+	seq INTEGER,
+	type TEXT NOT NULL,
+	destination TEXT NOT NULL,
+	critical INTEGER NOT NULL,
+	old_hash TEXT,
+	new_hash TEXT
+)`,
+}
+
+// historyTimeFormat is how times are stored: in UTC, sortable as text and
+// understood by SQLite's date functions
+const historyTimeFormat = "2006-01-02T15:04:05.000Z"
+
+func init() {
+	sinkFactories["sqlite"] = func(u *url.URL) (Sink, error) {
+		return newHistorySink(u), nil
+	}
+}
+
+// HistorySink records every change in a SQLite database file, for
+// standalone watchers to keep history without an external database.
+// Changes to volatile chunks, which notifications leave out, are recorded
+// with volatile set.
+// The spec is sqlite:///path/to/history.db, sqlite://relative/path.db or
+// sqlite:// for DefaultHistoryDB. The history command queries the file,
+// and so can the sqlite3 shell, provided it only reads.
+type HistorySink struct {
+	name string
+	path string
+
+	mu sync.Mutex
+	db *sqliteTable
+	// recorded is the last change set ID recorded for each stream, so
+	// change sets delivered again aren't recorded twice
+	recorded map[string]uint64
+}
+
+func newHistorySink(u *url.URL) *HistorySink {
+	s := &HistorySink{name: sinkName(u), path: u.Host + u.Path}
+	if s.path == "" {
+		s.path = DefaultHistoryDB
+	}
+	return s
+}
+
+func (s *HistorySink) Name() string { return s.name }
+
+func (s *HistorySink) recordsHistory() bool { return true }
+
+// Deliver records the changes of cs, opening the database on first use
+func (s *HistorySink) Deliver(ctx context.Context, cs *ChangeSet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if cs.ID != 0 && cs.ID <= s.recorded[cs.Stream] {
+		return nil
+	}
+	var rows [][]any
+	for _, c := range cs.Changes {
+		rows = append(rows, historyRow(cs, c))
+	}
+	if len(rows) > 0 {
+		if err := s.db.Insert(rows); err != nil {
+			return fmt.Errorf("failed to record history: %w", err)
+		}
+	}
+	if cs.ID != 0 {
+		s.recorded[cs.Stream] = cs.ID
+	}
+	return nil
+}
+
+// open opens the database and finds what it already holds
+func (s *HistorySink) open() error {
+	db, err := openSQLiteTable(s.path, "changes", historySchema, false, historyOlderSchemas...)
+	if err != nil {
+		return fmt.Errorf("failed to open history: %w", err)
+	}
+	recorded := make(map[string]uint64)
+	err = db.Scan(func(_ int64, row []any) error {
+		stream, _ := row[2].(string)
+		if id, _ := row[3].(int64); uint64(id) > recorded[stream] {
+			recorded[stream] = uint64(id)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("failed to read history: %w", err)
+	}
+	s.db, s.recorded = db, recorded
+	return nil
+}
+
+// historyRow returns the row recording change c of cs
+func historyRow(cs *ChangeSet, c Change) []any {
+	ts := cs.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	var id, seq any
+	if cs.ID != 0 {
+		id = cs.ID
+	}
+	if c.Seq != 0 {
+		seq = c.Seq
+	}
+	return []any{nil, ts.UTC().Format(historyTimeFormat), cs.Stream, id, cs.Path, seq,
+		string(c.Type), c.Destination, c.Critical, sqlNullable(c.OldHash), sqlNullable(c.NewHash), c.Volatile}
+}
+
+// queryHistory calls fn with every change recorded in the database at
+// path since the given time that filter selects, oldest first. Each comes
+// in a change set of its own.
+func queryHistory(path string, since time.Time, filter changeFilter, fn func(*ChangeSet) error) error {
+	db, err := openSQLiteTable(path, "changes", historySchema, true, historyOlderSchemas...)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Scan(func(_ int64, row []any) error {
+		// Rows written before columns were added lack them
+		str := func(i int) string {
+			if i >= len(row) {
+				return ""
+			}
+			s, _ := row[i].(string)
+			return s
+		}
+		num := func(i int) uint64 {
+			if i >= len(row) {
+				return 0
+			}
+			n, _ := row[i].(int64)
+			return uint64(n)
+		}
+		ts, err := time.Parse(historyTimeFormat, str(1))
+		if err != nil || ts.Before(since) {
+			return nil
+		}
+		cs := &ChangeSet{Stream: str(2), ID: num(3), Path: str(4), Time: ts, Changes: []Change{{
+			Seq:         num(5),
+			Type:        ChangeType(str(6)),
+			Destination: str(7),
+			Critical:    num(8) != 0,
+			OldHash:     str(9),
+			NewHash:     str(10),
+			Volatile:    num(11) != 0,
+		}}}
+		if cs.Changes = filter.changes(cs); len(cs.Changes) == 0 {
+			return nil
+		}
+		return fn(cs)
+	})
+}
+
+// historyPrefixes turns each prefix of a comma separated list into a rule
+// also matching the prefixes inside it, as the history of 10.0.0.0/8
+// takes in that of 10.1.0.0/16
+func historyPrefixes(list string) string {
+	rules := splitList(list)
+	for i, r := range rules {
+		if _, err := netip.ParsePrefix(r); err == nil {
+			rules[i] = r + "+"
+		}
+	}
+	return strings.Join(rules, ",")
+}
+
+// parseSince parses -since: a duration back from now or an RFC 3339 time
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid -since %q (want a duration such as 24h or an RFC 3339 time)", s)
+	}
+	return t, nil
+}
+
+// runHistory implements the history command
+func runHistory(args []string) int {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s history [-db <file>] [options]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "List the changes recorded by a sqlite:// sink, oldest first.\n\n")
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	var dbPath, since, paths, types, prefixes, output string
+	var volatile bool
+	fs.StringVar(&dbPath, "db", DefaultHistoryDB, "History database written by the sqlite:// sink")
+	fs.StringVar(&since, "since", "", "Only list changes this long ago or later (e.g. 24h), or since an RFC 3339 time")
+	fs.StringVar(&prefixes, "prefix", "", "Only list changes to these comma separated prefixes or those inside them")
+	fs.StringVar(&types, "type", "", "Only list changes of these comma separated types: added, removed or modified")
+	fs.StringVar(&paths, "path", "", "Only list changes to these comma separated table files")
+	fs.StringVar(&output, "output", OutputText, "Output format: text or jsonl")
+	fs.BoolVar(&volatile, "volatile", false, "Also list changes to volatile chunks, which notifications leave out")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if output != OutputText && output != OutputJSONL {
+		fmt.Fprintf(os.Stderr, "Error: unknown -output %q (want text or jsonl)\n", output)
+		return 2
+	}
+	from, err := parseSince(since, time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 2
+	}
+	filter, err := parseChangeFilter(paths, types, historyPrefixes(prefixes))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 2
+	}
+	filter.volatile = volatile
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if output == OutputText {
+		fmt.Fprintln(tw, "TIME\tPATH\tCHANGE\tDESTINATION")
+	}
+	n := 0
+	err = queryHistory(dbPath, from, filter, func(cs *ChangeSet) error {
+		n++
+		c := cs.Changes[0]
+		if output == OutputJSONL {
+			data, err := changeEvent(cs, c)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Printf("%s\n", data)
+			return err
+		}
+		change := string(c.Type)
+		if c.Critical {
+			change += " (critical)"
+		}
+		if c.Volatile {
+			change += " (volatile)"
+		}
+		_, err := fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", cs.Time.Local().Format(time.RFC3339), cs.Path, change, c.Destination)
+		return err
+	})
+	if output == OutputText {
+		tw.Flush()
+		fmt.Printf("%d changes\n", n)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
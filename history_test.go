@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistorySink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	sink, err := newSink("sqlite://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	sets := []*ChangeSet{
+		{Stream: "s1", ID: 1, Path: "core.txt", Time: day.Add(-48 * time.Hour), Changes: []Change{
+			{Seq: 1, Type: ChangeAdded, Destination: "10.1.0.0/16", NewHash: "h1"},
+		}},
+		{Stream: "s1", ID: 2, Path: "core.txt", Time: day, Changes: []Change{
+			{Seq: 2, Type: ChangeRemoved, Destination: "10.1.0.0/16", OldHash: "h1", Critical: true},
+			{Seq: 3, Type: ChangeAdded, Destination: "192.168.0.0/24", NewHash: "h2"},
+			{Seq: 4, Type: ChangeModified, Destination: "10.9.0.0/16", Volatile: true},
+		}},
+	}
+	for _, cs := range append(sets, sets[1]) {
+		if err := sink.Deliver(context.Background(), cs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A watcher restarting picks up where it left off
+	sink, _ = newSink("sqlite://" + path)
+	if err := sink.Deliver(context.Background(), sets[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(since time.Time, prefixes string, volatile bool) []Change {
+		filter, err := parseChangeFilter("", "", historyPrefixes(prefixes))
+		if err != nil {
+			t.Fatal(err)
+		}
+		filter.volatile = volatile
+		var changes []Change
+		err = queryHistory(path, since, filter, func(cs *ChangeSet) error {
+			if cs.Stream != "s1" || cs.Path != "core.txt" || cs.Time.IsZero() {
+				t.Errorf("change set %+v", cs)
+			}
+			changes = append(changes, cs.Changes...)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return changes
+	}
+	if got := query(time.Time{}, "", false); len(got) != 3 {
+		t.Errorf("%d changes listed, want 3: %+v", len(got), got)
+	}
+	if got := query(time.Time{}, "", true); len(got) != 4 || got[3].Destination != "10.9.0.0/16" || !got[3].Volatile || got[2].Volatile {
+		t.Errorf("with volatile changes: %+v", got)
+	}
+	got := query(day.Add(-24*time.Hour), "10.0.0.0/8", false)
+	if len(got) != 1 || got[0].Destination != "10.1.0.0/16" || got[0].Type != ChangeRemoved || !got[0].Critical || got[0].OldHash != "h1" || got[0].Seq != 2 {
+		t.Errorf("since a day, within 10.0.0.0/8: %+v", got)
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for in, want := range map[string]time.Time{
+		"":                     {},
+		"24h":                  now.Add(-24 * time.Hour),
+		"2024-04-30T00:00:00Z": time.Date(2024, 4, 30, 0, 0, 0, 0, time.UTC),
+	} {
+		got, err := parseSince(in, now)
+		if err != nil || !got.Equal(want) {
+			t.Errorf("parseSince(%q) = %v, %v", in, got, err)
+		}
+	}
+	if _, err := parseSince("yesterday", now); err == nil {
+		t.Error("parsed yesterday")
+	}
+	if got := historyPrefixes("10.0.0.0/8, default,192.168.0.0/16+"); got != "10.0.0.0/8+,default,192.168.0.0/16+" {
+		t.Errorf("historyPrefixes = %q", got)
+	}
+}
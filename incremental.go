@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// incrementalBlockSize is the granularity of the block hash index. Smaller
+// blocks localize changes better at the cost of a larger index.
+const incrementalBlockSize = 64 << 10
+
+// blockIndex is a coarse fingerprint of a file: one hash per fixed-size
+// block, the last of which may be partial
+type blockIndex struct {
+	size   int64
+	hashes []uint64
+}
+
+// blockIndexer builds a blockIndex from the bytes written to it
+type blockIndexer struct {
+	h   *xxhash.Digest
+	n   int64
+	idx blockIndex
+}
+
+func newBlockIndexer() *blockIndexer {
+	return &blockIndexer{h: xxhash.New()}
+}
+
+// Write hashes p, starting a new block every incrementalBlockSize bytes
+func (b *blockIndexer) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		room := incrementalBlockSize - b.n
+		take := int64(len(p))
+		if take > room {
+			take = room
+		}
+		b.h.Write(p[:take])
+		b.n += take
+		b.idx.size += take
+		p = p[take:]
+		if b.n == incrementalBlockSize {
+			b.idx.hashes = append(b.idx.hashes, b.h.Sum64())
+			b.h.Reset()
+			b.n = 0
+		}
+	}
+	return written, nil
+}
+
+// index returns the finished index, including any partial last block
+func (b *blockIndexer) index() *blockIndex {
+	idx := b.idx
+	idx.hashes = append([]uint64(nil), b.idx.hashes...)
+	if b.n > 0 {
+		idx.hashes = append(idx.hashes, b.h.Sum64())
+	}
+	return &idx
+}
+
+// diff locates the bytes that differ between two versions of a file. start
+// is the first differing offset rounded down to a block. When the size is
+// unchanged, end is the last differing offset rounded up to a block;
+// otherwise the change is assumed to run to the end of the file.
+func (old *blockIndex) diff(cur *blockIndex) (start, end int64, same bool) {
+	n := len(old.hashes)
+	if len(cur.hashes) < n {
+		n = len(cur.hashes)
+	}
+	first := n
+	for i := 0; i < n; i++ {
+		if old.hashes[i] != cur.hashes[i] {
+			first = i
+			break
+		}
+	}
+	if first == n && old.size == cur.size {
+		return 0, 0, true
+	}
+	start = int64(first) * incrementalBlockSize
+	if old.size != cur.size {
+		return start, cur.size, false
+	}
+
+	last := first
+	for i := len(cur.hashes) - 1; i > first; i-- {
+		if old.hashes[i] != cur.hashes[i] {
+			last = i
+			break
+		}
+	}
+	end = int64(last+1) * incrementalBlockSize
+	if end > cur.size {
+		end = cur.size
+	}
+	return start, end, false
+}
+
+// detectIncremental compares the file with the block index from the last
+// load and re-parses only the chunks overlapping the changed region. ok is
+// false when the change can't be localized and a full reload is needed.
+func (rt *DataTable) detectIncremental(ctx context.Context) (cs *ChangeSet, ok bool, err error) {
+	rt.mu.RLock()
+	old := rt.blocks
+	oldChunks := rt.Chunks
+	oldAlgo := rt.Algorithm
+	wasOversize := rt.oversize
+	rt.mu.RUnlock()
+
+	if old == nil || len(oldChunks) == 0 || oldAlgo != rt.Options.Hash.orDefault() {
+		return nil, false, nil
+	}
+
+	file, err := openTable(rt.FilePath)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+	lean, err := rt.leanFor(file)
+	if err != nil {
+		return nil, false, err
+	}
+	if lean && !rt.Options.Lean && !wasOversize {
+		// The file just outgrew MaxSize; reload it all to drop the
+		// bodies of the chunks outside the changed region
+		return nil, false, nil
+	}
+
+	indexer := newBlockIndexer()
+	digest := xxhash.New()
+	if _, err := io.Copy(io.MultiWriter(indexer, digest), contextReader{ctx, file}); err != nil {
+		return nil, false, fmt.Errorf("error reading file: %w", err)
+	}
+	cur := indexer.index()
+
+	cs = &ChangeSet{Path: rt.FilePath, Time: time.Now(), Routes: len(oldChunks)}
+	start, end, same := old.diff(cur)
+	if same {
+		rt.observe(cs)
+		return cs, true, nil
+	}
+
+	ordered := chunksByOffset(oldChunks)
+
+	// Start one chunk before the one holding the first changed byte, in
+	// case the edit turned that chunk's Destination line into a plain line
+	i := sort.Search(len(ordered), func(k int) bool { return ordered[k].Offset > start }) - 1
+	if i < 0 {
+		// The change is in the header before the first route
+		return nil, false, nil
+	}
+	if i > 0 {
+		i--
+	}
+	parseStart := ordered[i].Offset
+	firstLine := ordered[i].StartLine - 1
+
+	// Stop at the first chunk that starts after the changed region; its
+	// bytes and everything after are untouched. If the size changed the
+	// tail has shifted, so parse to the end.
+	j := len(ordered)
+	parseEnd := cur.size
+	if old.size == cur.size {
+		j = sort.Search(len(ordered), func(k int) bool { return ordered[k].Offset > end })
+		if j < len(ordered) {
+			parseEnd = ordered[j].Offset
+		}
+	}
+
+	ck, err := rt.newChunker(lean)
+	if err != nil {
+		return nil, false, err
+	}
+	newAffected := make(map[string]*Chunk)
+	lines, err := ck.parse(contextReader{ctx, io.NewSectionReader(file, parseStart, parseEnd-parseStart)}, parseStart, firstLine, func(c *Chunk) {
+		newAffected[c.Destination] = c
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to reload routing table: %w", err)
+	}
+
+	oldAffected := make(map[string]*Chunk, j-i)
+	for _, c := range ordered[i:j] {
+		oldAffected[c.Destination] = c
+	}
+
+	// Keep the chunks outside the region, shifting their line numbers if
+	// the region gained or lost lines
+	var delta int64
+	if j < len(ordered) {
+		delta = lines - (ordered[j].StartLine - 1 - firstLine)
+	}
+	merged := make(map[string]*Chunk, len(oldChunks)-len(oldAffected)+len(newAffected))
+	for k, c := range ordered {
+		if k >= i && k < j {
+			continue
+		}
+		if k >= j && delta != 0 {
+			shifted := *c
+			shifted.StartLine += delta
+			shifted.EndLine += delta
+			c = &shifted
+		}
+		merged[c.Destination] = c
+	}
+	for dest, c := range newAffected {
+		merged[dest] = c
+	}
+
+	cs.Changes = diffChunks(oldAffected, newAffected)
+	cs.Routes = len(merged)
+	rt.observe(cs)
+
+	rt.mu.Lock()
+	rt.Chunks = merged
+	rt.blocks = cur
+	rt.digest = fmt.Sprintf("%016x", digest.Sum64())
+	rt.mu.Unlock()
+
+	return cs, true, nil
+}
+
+// chunksByOffset returns the chunks ordered by their position in the file
+func chunksByOffset(chunks map[string]*Chunk) []*Chunk {
+	ordered := make([]*Chunk, 0, len(chunks))
+	for _, c := range chunks {
+		ordered = append(ordered, c)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].Offset < ordered[j].Offset })
+	return ordered
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// tableOf renders n routes in 10.x.y.0/24
+func tableOf(n int) string {
+	blocks := make([]string, n)
+	for i := range blocks {
+		blocks[i] = routeBlock(fmt.Sprintf("10.%d.%d.0/24", i/256, i%256), "IBGP", "172.31.0.1")
+	}
+	return "Route Flags: R - relay\n\n" + strings.Join(blocks, "\n") + "\n"
+}
+
+// chunkSummary flattens chunks for comparison, ignoring data pointers
+func chunkSummary(chunks map[string]*Chunk) map[string]string {
+	out := make(map[string]string, len(chunks))
+	for dest, c := range chunks {
+		out[dest] = fmt.Sprintf("%s %d-%d @%d+%d", c.Hash, c.StartLine, c.EndLine, c.Offset, c.Length)
+	}
+	return out
+}
+
+func TestIncrementalDetect(t *testing.T) {
+	base := tableOf(2000) // several index blocks
+	edits := map[string]func(string) string{
+		"in place": func(s string) string {
+			return strings.Replace(s, "Destination: 10.3.200.0/24\n     Protocol: IBGP", "Destination: 10.3.200.0/24\n     Protocol: EBGP", 1)
+		},
+		"append": func(s string) string {
+			return s + routeBlock("192.168.0.0/16", "OSPF", "172.31.0.2") + "\n"
+		},
+		"delete middle": func(s string) string {
+			return strings.Replace(s, routeBlock("10.2.10.0/24", "IBGP", "172.31.0.1")+"\n", "", 1)
+		},
+		"extra line": func(s string) string {
+			return strings.Replace(s, "Destination: 10.3.1.0/24\n", "Destination: 10.3.1.0/24\n  Note: x\n", 1)
+		},
+		"unchanged": func(s string) string { return s },
+	}
+
+	for name, edit := range edits {
+		t.Run(name, func(t *testing.T) {
+			path := writeTable(t, base)
+			inc := NewDataTable(path)
+			inc.Options.Incremental = true
+			if err := inc.LoadDataTable(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			full := loadTable(t, path)
+
+			if err := os.WriteFile(path, []byte(edit(base)), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			want, err := full.DetectChanges(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok, err := inc.detectIncremental(context.Background())
+			if err != nil || !ok {
+				t.Fatalf("incremental detect fell back: ok=%v err=%v", ok, err)
+			}
+
+			if !reflect.DeepEqual(changeSummary(got), changeSummary(want)) {
+				t.Errorf("changes = %v, want %v", changeSummary(got), changeSummary(want))
+			}
+			if !reflect.DeepEqual(chunkSummary(inc.Chunks), chunkSummary(full.Chunks)) {
+				t.Error("incremental chunks differ from a full reload")
+			}
+		})
+	}
+}
+
+func changeSummary(cs *ChangeSet) []string {
+	var out []string
+	for _, c := range cs.Changes {
+		out = append(out, string(c.Type)+" "+c.Destination)
+	}
+	return out
+}
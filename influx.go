@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultInfluxMeasurement is the measurement change set points are
+// written to
+const DefaultInfluxMeasurement = "go_watcher"
+
+func init() {
+	sinkFactories["influx"] = func(u *url.URL) (Sink, error) {
+		return newInfluxSink(u)
+	}
+}
+
+// InfluxSink writes a point per change set, in InfluxDB line protocol, so
+// route churn can be graphed over time. The spec is
+// influx+https://host:8086?org=...&bucket=..., or influx+http://, which
+// writes to InfluxDB 2's /api/v2/write. With a path it writes there
+// instead, as to /write?db=... on InfluxDB 1 or to any other endpoint
+// taking line protocol, such as Telegraf's http_listener_v2. The
+// parameters are
+//
+//	measurement  measurement written (default go_watcher)
+//	tags         comma separated key=value tags added to every point
+//	token-env    environment variable holding an API token
+//	token-file   file holding it, instead
+//
+// plus the webhook sink's timeout, retries and backoff; others, such as
+// org, bucket, db and precision, are passed on in the URL. Points are
+// tagged with the table's path and the host, and have the integer fields
+// added, removed, modified, volatile, critical and routes (the table's
+// size after the change set), the boolean truncated and, when the file's
+// modification time is known, detection_latency: the seconds from then
+// to the change set.
+type InfluxSink struct {
+	name        string
+	post        *WebhookSink
+	measurement string
+	tags        string
+}
+
+func newInfluxSink(u *url.URL) (*InfluxSink, error) {
+	s := &InfluxSink{name: sinkName(u), measurement: DefaultInfluxMeasurement}
+	if err := s.parse(u); err != nil {
+		return nil, fmt.Errorf("influx sink %s: %w", s.name, err)
+	}
+	return s, nil
+}
+
+// parse takes the sink's options from u
+func (s *InfluxSink) parse(u *url.URL) error {
+	_, transport, _ := strings.Cut(u.Scheme, "+")
+	if transport != "http" && transport != "https" {
+		return errors.New("needs influx+https:// or influx+http://")
+	}
+	if u.Host == "" {
+		return errors.New("needs the server, as influx+https://host:8086")
+	}
+	q := u.Query()
+	token, err := readSecret(q, "token")
+	if err != nil {
+		return err
+	}
+	if v := q.Get("measurement"); v != "" {
+		s.measurement = v
+	}
+	tags := map[string]string{}
+	if host, err := os.Hostname(); err == nil {
+		tags["host"] = host
+	}
+	for _, kv := range splitList(q.Get("tags")) {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" || v == "" {
+			return fmt.Errorf("invalid tag %q (want key=value)", kv)
+		}
+		tags[k] = v
+	}
+	// Line protocol wants tags sorted by key
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s.tags += "," + influxEscape(k, ",= ") + "=" + influxEscape(tags[k], ",= ")
+	}
+	q.Del("measurement")
+	q.Del("tags")
+
+	target := *u
+	target.Scheme = transport
+	if target.Path == "" || target.Path == "/" {
+		target.Path = "/api/v2/write"
+	}
+	if s.post, err = newPoster(s.name, &target, q); err != nil {
+		return err
+	}
+	s.post.header = http.Header{"Content-Type": {"text/plain; charset=utf-8"}}
+	if token != nil {
+		s.post.header.Set("Authorization", "Token "+string(token))
+	}
+	return nil
+}
+
+func (s *InfluxSink) Name() string { return s.name }
+
+// Deliver writes the point of cs
+func (s *InfluxSink) Deliver(ctx context.Context, cs *ChangeSet) error {
+	return s.post.send(ctx, []byte(s.point(cs)))
+}
+
+// point returns the line protocol of cs's point
+func (s *InfluxSink) point(cs *ChangeSet) string {
+	sum := cs.Summarize(0)
+	critical := 0
+	for _, c := range cs.Notifiable() {
+		if c.Critical {
+			critical++
+		}
+	}
+	var b strings.Builder
+	b.WriteString(influxEscape(s.measurement, ", "))
+	if path := cs.Path; path != "" {
+		b.WriteString(",path=" + influxEscape(path, ",= "))
+	}
+	b.WriteString(s.tags)
+	fmt.Fprintf(&b, " added=%di,removed=%di,modified=%di,volatile=%di,critical=%di,routes=%di,truncated=%t",
+		sum.Added, sum.Removed, sum.Modified, sum.Volatile, critical, sum.Routes, cs.Truncated)
+	if mtime := influxModTime(cs); !mtime.IsZero() && !cs.Time.Before(mtime) {
+		b.WriteString(",detection_latency=" + strconv.FormatFloat(cs.Time.Sub(mtime).Seconds(), 'f', -1, 64))
+	}
+	ts := cs.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	fmt.Fprintf(&b, " %d\n", ts.UnixNano())
+	return b.String()
+}
+
+// influxModTime returns the modification time of cs's file: as recorded
+// with -watch-metadata or, failing that, as it is now, or the zero time
+// if it isn't a file
+func influxModTime(cs *ChangeSet) time.Time {
+	if cs.File != nil {
+		return cs.File.ModTime
+	}
+	if cs.Time.IsZero() || cs.Path == "" || cs.Path == "-" {
+		return time.Time{}
+	}
+	info, err := os.Stat(cs.Path)
+	if err != nil || !info.Mode().IsRegular() {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// influxEscape backslash-escapes the characters of special in s, and
+// backslashes, for line protocol. Newlines, which can't be escaped, become
+// spaces, escaped too.
+func influxEscape(s, special string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r == '\n' || r == '\r' {
+			r = ' '
+		}
+		if r == '\\' || strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
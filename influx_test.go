@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInfluxSink(t *testing.T) {
+	var got struct {
+		path, query, auth, ctype, body string
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got.path, got.query, got.body = r.URL.Path, r.URL.RawQuery, string(body)
+		got.auth, got.ctype = r.Header.Get("Authorization"), r.Header.Get("Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	t.Setenv("INFLUX_TEST_TOKEN", "secret")
+
+	sink, err := newSink(strings.Replace(srv.URL, "http://", "influx+http://", 1) + "?org=netops&bucket=routes&token-env=INFLUX_TEST_TOKEN&tags=site=ams 1,role=core&measurement=churn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cs := &ChangeSet{Path: "/data/core routes.txt", Time: mtime.Add(1500 * time.Millisecond), Routes: 42,
+		File: &FileMeta{ModTime: mtime},
+		Changes: []Change{
+			{Type: ChangeAdded, Destination: "10.1.0.0/16"},
+			{Type: ChangeRemoved, Destination: "0.0.0.0/0", Critical: true},
+			{Type: ChangeModified, Destination: "10.2.0.0/16", Volatile: true},
+		}}
+	if err := sink.Deliver(context.Background(), cs); err != nil {
+		t.Fatal(err)
+	}
+	if got.path != "/api/v2/write" || got.query != "bucket=routes&org=netops" {
+		t.Errorf("posted to %s?%s", got.path, got.query)
+	}
+	if got.auth != "Token secret" || got.ctype != "text/plain; charset=utf-8" {
+		t.Errorf("headers %q, %q", got.auth, got.ctype)
+	}
+	host, _ := os.Hostname()
+	want := `churn,path=/data/core\ routes.txt,host=` + influxEscape(host, ",= ") + `,role=core,site=ams\ 1 ` +
+		`added=1i,removed=1i,modified=0i,volatile=1i,critical=1i,routes=42i,truncated=false,detection_latency=1.5 1714564801500000000` + "\n"
+	if got.body != want {
+		t.Errorf("body =\n%s\nwant\n%s", got.body, want)
+	}
+
+	// A path is kept, for InfluxDB 1 and other endpoints
+	sink, _ = newSink(strings.Replace(srv.URL, "http://", "influx+http://", 1) + "/write?db=routes")
+	if err := sink.Deliver(context.Background(), &ChangeSet{Path: "-", Time: mtime}); err != nil {
+		t.Fatal(err)
+	}
+	if got.path != "/write" || got.query != "db=routes" || got.auth != "" || strings.Contains(got.body, "detection_latency") {
+		t.Errorf("posted %q to %s?%s", got.body, got.path, got.query)
+	}
+}
+
+func TestNewInfluxSinkErrors(t *testing.T) {
+	for _, spec := range []string{
+		"influx://db:8086",
+		"influx+https://",
+		"influx+https://db:8086?tags=site",
+		"influx+https://db:8086?token-env=INFLUX_TEST_UNSET",
+	} {
+		if _, err := newSink(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
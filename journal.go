@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultJournalSocket is where journald listens for native protocol
+// entries
+const DefaultJournalSocket = "/run/systemd/journal/socket"
+
+// DefaultJournalTag is the SYSLOG_IDENTIFIER of journal entries, so they
+// can be selected with journalctl -t
+const DefaultJournalTag = "go-watcher"
+
+// Journal priorities (syslog levels)
+const (
+	journalWarning = 4
+	journalNotice  = 5
+)
+
+func init() {
+	sinkFactories["journal"] = func(u *url.URL) (Sink, error) {
+		return newJournalSink(u), nil
+	}
+}
+
+// JournalSink writes every change to the systemd journal as an entry of
+// its own, through journald's native protocol, with the change's fields
+// (CHANGESET_ID, DESTINATION, CHANGE_TYPE, ...) as journal fields so they
+// can be queried with journalctl. The spec is journal:// for the default
+// socket or journal:///path/to/socket, with an optional ?tag= for the
+// SYSLOG_IDENTIFIER.
+type JournalSink struct {
+	name   string
+	socket string
+	tag    string
+
+	mu   sync.Mutex
+	conn *net.UnixConn
+}
+
+func newJournalSink(u *url.URL) *JournalSink {
+	s := &JournalSink{name: sinkName(u), socket: u.Path, tag: u.Query().Get("tag")}
+	if s.socket == "" {
+		s.socket = DefaultJournalSocket
+	}
+	if s.tag == "" {
+		s.tag = DefaultJournalTag
+	}
+	return s
+}
+
+// underSystemd reports whether the process's output goes to the journal,
+// as it does for a systemd service, so the journal sink should be added
+// without being asked for
+func underSystemd() bool {
+	if os.Getenv("JOURNAL_STREAM") == "" {
+		return false
+	}
+	_, err := os.Stat(DefaultJournalSocket)
+	return err == nil
+}
+
+func (s *JournalSink) Name() string { return s.name }
+
+// Deliver writes an entry per notifiable change in cs, plus one for a
+// truncated file
+func (s *JournalSink) Deliver(ctx context.Context, cs *ChangeSet) error {
+	var entries [][]byte
+	if cs.Truncated {
+		entries = append(entries, s.entry(cs, nil))
+	}
+	for _, c := range cs.Notifiable() {
+		entries = append(entries, s.entry(cs, &c))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: s.socket, Net: "unixgram"})
+		if err != nil {
+			return fmt.Errorf("failed to connect to the journal: %w", err)
+		}
+		s.conn = conn
+	}
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := s.conn.Write(e); err != nil {
+			// journald may have restarted; reconnect on the next delivery
+			s.conn.Close()
+			s.conn = nil
+			return fmt.Errorf("failed to write to the journal: %w", err)
+		}
+	}
+	return nil
+}
+
+// entry encodes the journal entry for change c of cs, or for the
+// truncation of cs's file if c is nil
+func (s *JournalSink) entry(cs *ChangeSet, c *Change) []byte {
+	var b bytes.Buffer
+	priority := journalNotice
+	if c == nil {
+		appendJournalField(&b, "MESSAGE", fmt.Sprintf("%s was truncated to zero bytes", cs.Path))
+		appendJournalField(&b, "TRUNCATED", "1")
+		priority = journalWarning
+	} else {
+		appendJournalField(&b, "MESSAGE", fmt.Sprintf("%s %s in %s", c.Type, c.Destination, cs.Path))
+		appendJournalField(&b, "DESTINATION", c.Destination)
+		appendJournalField(&b, "CHANGE_TYPE", string(c.Type))
+		appendJournalField(&b, "CHANGE_SEQ", strconv.FormatUint(c.Seq, 10))
+		appendJournalField(&b, "OLD_HASH", c.OldHash)
+		appendJournalField(&b, "NEW_HASH", c.NewHash)
+		if c.Critical {
+			appendJournalField(&b, "CRITICAL", "1")
+			priority = journalWarning
+		}
+	}
+	appendJournalField(&b, "PRIORITY", strconv.Itoa(priority))
+	appendJournalField(&b, "SYSLOG_IDENTIFIER", s.tag)
+	appendJournalField(&b, "CHANGESET_ID", strconv.FormatUint(cs.ID, 10))
+	appendJournalField(&b, "CHANGESET_STREAM", cs.Stream)
+	appendJournalField(&b, "TABLE_PATH", cs.Path)
+	return b.Bytes()
+}
+
+// appendJournalField appends a field in the native protocol's format:
+// NAME=value on a line, or, for values spanning lines, the name on a line
+// followed by the value's length as a little-endian uint64 and the value.
+// Empty values are left out.
+func appendJournalField(b *bytes.Buffer, name, value string) {
+	if value == "" {
+		return
+	}
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", name, value)
+		return
+	}
+	b.WriteString(name)
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
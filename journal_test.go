@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalSink(t *testing.T) {
+	// Unix socket paths are short; t.TempDir can be too long
+	dir, err := os.MkdirTemp("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	u, _ := url.Parse("journal://" + socket + "?tag=routes")
+	sink, err := newSink(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sink.Name() != "journal" {
+		t.Errorf("name = %q", sink.Name())
+	}
+	cs := &ChangeSet{ID: 7, Path: "t.txt", Truncated: true, Changes: []Change{
+		{Seq: 3, Type: ChangeModified, Destination: "10.0.0.0/8", OldHash: "aa", NewHash: "bb", Critical: true},
+		{Type: ChangeModified, Destination: "10.1.0.0/16", Volatile: true},
+	}}
+	if err := sink.Deliver(context.Background(), cs); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4096)
+	var entries []string
+	for range 2 {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, string(buf[:n]))
+	}
+	if want := "MESSAGE=t.txt was truncated to zero bytes\nTRUNCATED=1\nPRIORITY=4\nSYSLOG_IDENTIFIER=routes\nCHANGESET_ID=7\nTABLE_PATH=t.txt\n"; entries[0] != want {
+		t.Errorf("truncation entry =\n%s\nwant\n%s", entries[0], want)
+	}
+	if want := "MESSAGE=modified 10.0.0.0/8 in t.txt\nDESTINATION=10.0.0.0/8\nCHANGE_TYPE=modified\nCHANGE_SEQ=3\nOLD_HASH=aa\nNEW_HASH=bb\nCRITICAL=1\nPRIORITY=4\nSYSLOG_IDENTIFIER=routes\nCHANGESET_ID=7\nTABLE_PATH=t.txt\n"; entries[1] != want {
+		t.Errorf("change entry =\n%s\nwant\n%s", entries[1], want)
+	}
+
+	// Values spanning lines are sent length-prefixed
+	var b bytes.Buffer
+	appendJournalField(&b, "MESSAGE", "a\nb")
+	want := []byte("MESSAGE\n")
+	want = binary.LittleEndian.AppendUint64(want, 3)
+	want = append(want, "a\nb\n"...)
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("multi-line field = %q, want %q", b.Bytes(), want)
+	}
+}
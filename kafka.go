@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultKafkaTimeout bounds a request to a broker, and how long the
+// brokers wait for replicas to acknowledge records
+const DefaultKafkaTimeout = 10 * time.Second
+
+func init() {
+	sinkFactories["kafka"] = func(u *url.URL) (Sink, error) {
+		return newKafkaSink(u)
+	}
+}
+
+// KafkaSink publishes every change to a Kafka topic as a record keyed by
+// its destination, so the changes of a prefix stay in order on one
+// partition. The spec is kafka://broker1:9092,broker2:9092/topic, or
+// kafka+tls:// to connect over TLS, with these parameters:
+//
+//	encoding             json, a change event as -output jsonl writes it
+//	                     (the default), or protobuf, a Changeset message
+//	                     holding the one change
+//	acks                 all (the default) to wait for the in-sync
+//	                     replicas, or leader
+//	timeout              time allowed for a request (default 10s)
+//	sasl                 plain, scram-sha-256 or scram-sha-512, to
+//	                     authenticate as the spec's user, as
+//	                     kafka+tls://user@broker:9093/topic
+//	password-env         environment variable holding the password
+//	password-file        file holding it, instead
+//	tls-ca-file          PEM file of the CAs to trust for TLS
+//	tls-cert-file        client certificate to present over TLS
+//	tls-key-file         its key
+//	client-id            client ID sent to the brokers (default go-watcher)
+//	path, type, prefix   only publish the changes selected as for /events
+//
+// The default sink name is kafka-<topic>.
+type KafkaSink struct {
+	name     string
+	protobuf bool
+	filter   changeFilter
+	producer *kafkaProducer
+}
+
+func newKafkaSink(u *url.URL) (*KafkaSink, error) {
+	topic := strings.Trim(u.Path, "/")
+	s := &KafkaSink{name: u.Query().Get("name")}
+	if s.name == "" {
+		s.name = "kafka-" + topic
+	}
+	if err := s.parse(u, topic); err != nil {
+		return nil, fmt.Errorf("kafka sink %s: %w", s.name, err)
+	}
+	return s, nil
+}
+
+// parse takes the sink's options from u
+func (s *KafkaSink) parse(u *url.URL, topic string) error {
+	if topic == "" || strings.Contains(topic, "/") {
+		return errors.New("needs one topic, as kafka://broker:9092/topic")
+	}
+	var brokers []string
+	for _, b := range splitList(u.Host) {
+		if _, _, err := net.SplitHostPort(b); err != nil {
+			b = net.JoinHostPort(b, "9092")
+		}
+		brokers = append(brokers, b)
+	}
+	if len(brokers) == 0 {
+		return errors.New("needs brokers, as kafka://broker:9092/topic")
+	}
+	p := &kafkaProducer{
+		bootstrap: brokers,
+		topic:     topic,
+		auth:      &kafkaAuth{clientID: "go-watcher"},
+		acks:      -1,
+		timeout:   DefaultKafkaTimeout,
+	}
+	q := u.Query()
+	var err error
+
+	switch v := q.Get("encoding"); v {
+	case "", "json":
+	case "protobuf":
+		s.protobuf = true
+	default:
+		return fmt.Errorf("unknown encoding %q (want json or protobuf)", v)
+	}
+	switch v := q.Get("acks"); v {
+	case "", "all":
+	case "leader":
+		p.acks = 1
+	default:
+		return fmt.Errorf("unknown acks %q (want all or leader)", v)
+	}
+	if v := q.Get("timeout"); v != "" {
+		if p.timeout, err = time.ParseDuration(v); err != nil || p.timeout <= 0 {
+			return fmt.Errorf("invalid timeout %q", v)
+		}
+	}
+	if v := q.Get("client-id"); v != "" {
+		p.auth.clientID = v
+	}
+
+	tlsConfig, err := clientTLS(q)
+	if err != nil {
+		return err
+	}
+	switch _, transport, _ := strings.Cut(u.Scheme, "+"); transport {
+	case "":
+		if tlsConfig != nil {
+			return errors.New("tls-ca-file, tls-cert-file and tls-key-file need kafka+tls://")
+		}
+	case "tls":
+		p.auth.tls = tlsConfig
+		if p.auth.tls == nil {
+			p.auth.tls = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+	default:
+		return fmt.Errorf("unknown transport %q (want kafka:// or kafka+tls://)", u.Scheme)
+	}
+
+	password, err := readSecret(q, "password")
+	if err != nil {
+		return err
+	}
+	switch v := q.Get("sasl"); v {
+	case "":
+		if password != nil {
+			return errors.New("a password needs sasl")
+		}
+	case "plain", "scram-sha-256", "scram-sha-512":
+		if u.User == nil || password == nil {
+			return fmt.Errorf("sasl %s needs a user and password, as kafka://user@broker:9092/topic?password-env=VAR", v)
+		}
+		p.auth.mechanism = strings.ToUpper(v)
+		p.auth.user, p.auth.password = u.User.Username(), string(password)
+	default:
+		return fmt.Errorf("unknown sasl %q (want plain, scram-sha-256 or scram-sha-512)", v)
+	}
+
+	if s.filter, err = parseChangeFilter(q.Get("path"), q.Get("type"), q.Get("prefix")); err != nil {
+		return err
+	}
+	s.producer = p
+	return nil
+}
+
+func (s *KafkaSink) Name() string { return s.name }
+
+// Deliver publishes the changes of cs the sink selects
+func (s *KafkaSink) Deliver(ctx context.Context, cs *ChangeSet) error {
+	changes := s.filter.changes(cs)
+	if len(changes) == 0 {
+		return nil
+	}
+	ts := cs.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	records := make([]kafkaRecord, 0, len(changes))
+	for _, c := range changes {
+		value, err := s.encode(cs, c)
+		if err != nil {
+			return fmt.Errorf("failed to encode change: %w", err)
+		}
+		records = append(records, kafkaRecord{key: []byte(c.Destination), value: value, time: ts})
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.producer.timeout+5*time.Second)
+	defer cancel()
+	return s.producer.Produce(ctx, records)
+}
+
+// encode returns the value of the record of change c of cs
+func (s *KafkaSink) encode(cs *ChangeSet, c Change) ([]byte, error) {
+	if !s.protobuf {
+		return changeEvent(cs, c)
+	}
+	return marshalChangeSetProto(&ChangeSet{Stream: cs.Stream, ID: cs.ID, Path: cs.Path, Time: cs.Time, Changes: []Change{c}}, nil), nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// producedRecord is a record received by fakeKafka
+type producedRecord struct {
+	partition  int32
+	key, value string
+}
+
+// fakeKafka runs a broker serving Metadata and Produce for topic with
+// partitions partitions, accepting SASL PLAIN as user:pw. The first
+// notLeader produce requests fail with NOT_LEADER_OR_FOLLOWER.
+type fakeKafka struct {
+	t          *testing.T
+	addr       string
+	topic      string
+	partitions int
+	notLeader  int
+
+	mu       sync.Mutex
+	records  []producedRecord
+	auth     string
+	metadata int
+}
+
+func newFakeKafka(t *testing.T, topic string, partitions int) *fakeKafka {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	k := &fakeKafka{t: t, addr: ln.Addr().String(), topic: topic, partitions: partitions}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go k.serve(conn)
+		}
+	}()
+	return k
+}
+
+func (k *fakeKafka) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		var size int32
+		if binary.Read(r, binary.BigEndian, &size) != nil {
+			return
+		}
+		req := make([]byte, size)
+		if _, err := io.ReadFull(r, req); err != nil {
+			return
+		}
+		rd := kafkaReader{b: req}
+		key, version, corr := rd.int16(), rd.int16(), rd.int32()
+		if client := rd.string(); client != "go-watcher" {
+			k.t.Errorf("client ID %q", client)
+		}
+		w := kafkaWriter{b: make([]byte, 8)}
+		switch key {
+		case kafkaMetadata:
+			k.mu.Lock()
+			k.metadata++
+			k.mu.Unlock()
+			host, port, _ := net.SplitHostPort(k.addr)
+			n, _ := strconv.Atoi(port)
+			w.int32(0)
+			w.int32(1)
+			w.int32(1)
+			w.string(host)
+			w.int32(int32(n))
+			w.int16(-1)
+			w.int16(-1)
+			w.int32(1)
+			w.int32(1)
+			w.int16(0)
+			w.string(k.topic)
+			w.int8(0)
+			w.int32(int32(k.partitions))
+			for i := range k.partitions {
+				w.int16(0)
+				w.int32(int32(i))
+				w.int32(1)
+				w.int32(1)
+				w.int32(1)
+				w.int32(1)
+				w.int32(1)
+			}
+		case kafkaProduce:
+			rd.string() // transactional ID
+			if acks := rd.int16(); acks != -1 {
+				k.t.Errorf("acks = %d", acks)
+			}
+			rd.int32()
+			rd.array()
+			rd.string()
+			rd.array()
+			part := rd.int32()
+			batch := rd.bytes()
+			code := int16(0)
+			k.mu.Lock()
+			if k.notLeader > 0 {
+				k.notLeader--
+				code = kafkaNotLeader
+			} else {
+				k.records = append(k.records, k.decodeBatch(part, batch)...)
+			}
+			k.mu.Unlock()
+			w.int32(1)
+			w.string(k.topic)
+			w.int32(1)
+			w.int32(part)
+			w.int16(code)
+			w.int64(0)
+			w.int64(-1)
+			w.int32(0)
+		case kafkaSaslHandshake:
+			if mech := rd.string(); mech != "PLAIN" {
+				w.int16(33)
+			} else {
+				w.int16(0)
+			}
+			w.int32(1)
+			w.string("PLAIN")
+		case kafkaSaslAuthenticate:
+			k.mu.Lock()
+			k.auth = string(rd.bytes())
+			k.mu.Unlock()
+			w.int16(0)
+			w.int16(-1)
+			w.int32(0)
+		default:
+			k.t.Errorf("unexpected request %d v%d", key, version)
+			return
+		}
+		binary.BigEndian.PutUint32(w.b, uint32(len(w.b)-4))
+		binary.BigEndian.PutUint32(w.b[4:], uint32(corr))
+		conn.Write(w.b)
+	}
+}
+
+// decodeBatch decodes a v2 record batch, checking its length and CRC
+func (k *fakeKafka) decodeBatch(part int32, batch []byte) []producedRecord {
+	r := kafkaReader{b: batch}
+	r.int64()
+	if n := r.int32(); int(n) != len(batch)-12 {
+		k.t.Errorf("batch length %d of %d bytes", n, len(batch))
+	}
+	r.int32()
+	if magic := r.int8(); magic != 2 {
+		k.t.Errorf("magic %d", magic)
+	}
+	if crc := uint32(r.int32()); crc != crc32.Checksum(r.b, crc32.MakeTable(crc32.Castagnoli)) {
+		k.t.Error("bad batch CRC")
+	}
+	r.int16()
+	r.int32()
+	r.int64()
+	r.int64()
+	r.int64()
+	r.int16()
+	r.int32()
+	var recs []producedRecord
+	for range r.int32() {
+		rec := kafkaReader{b: r.take(int(r.varint()))}
+		rec.int8()
+		rec.varint()
+		rec.varint()
+		key := rec.take(int(rec.varint()))
+		value := rec.take(int(rec.varint()))
+		rec.varint()
+		if rec.err != nil || len(rec.b) != 0 {
+			k.t.Errorf("bad record: %v", rec.err)
+		}
+		recs = append(recs, producedRecord{part, string(key), string(value)})
+	}
+	if r.err != nil || len(r.b) != 0 {
+		k.t.Errorf("bad batch: %v", r.err)
+	}
+	return recs
+}
+
+func TestKafkaSink(t *testing.T) {
+	k := newFakeKafka(t, "routes", 4)
+	k.notLeader = 1
+	t.Setenv("KAFKA_TEST_PASSWORD", "pw")
+	sink, err := newSink("kafka://watcher@" + k.addr + "/routes?sasl=plain&password-env=KAFKA_TEST_PASSWORD&type=added,removed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sink.Name() != "kafka-routes" {
+		t.Errorf("name = %s", sink.Name())
+	}
+	cs := &ChangeSet{ID: 4, Path: "core.txt", Time: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), Changes: []Change{
+		{Seq: 1, Type: ChangeAdded, Destination: "10.1.0.0/16"},
+		{Seq: 2, Type: ChangeRemoved, Destination: "10.2.0.0/16"},
+		{Seq: 3, Type: ChangeModified, Destination: "10.3.0.0/16"},
+	}}
+	if err := sink.Deliver(context.Background(), cs); err != nil {
+		t.Fatal(err)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.auth != "\x00watcher\x00pw" {
+		t.Errorf("auth = %q", k.auth)
+	}
+	if k.metadata != 2 {
+		t.Errorf("%d metadata requests, want 2 (after NOT_LEADER)", k.metadata)
+	}
+	if len(k.records) != 2 {
+		t.Fatalf("%d records, want 2: %+v", len(k.records), k.records)
+	}
+	got := make(map[string]producedRecord)
+	for _, r := range k.records {
+		got[r.key] = r
+	}
+	for _, c := range cs.Changes[:2] {
+		r, ok := got[c.Destination]
+		if !ok {
+			t.Errorf("no record for %s", c.Destination)
+			continue
+		}
+		if want := kafkaPartition([]byte(c.Destination), 4); r.partition != want {
+			t.Errorf("%s on partition %d, want %d", c.Destination, r.partition, want)
+		}
+		var e jsonChange
+		if err := json.Unmarshal([]byte(r.value), &e); err != nil || e.Event != "change" || e.Path != "core.txt" || e.ChangeSet != 4 || e.Change.Seq != c.Seq {
+			t.Errorf("value %s (%v)", r.value, err)
+		}
+	}
+}
+
+func TestKafkaSinkProtobuf(t *testing.T) {
+	k := newFakeKafka(t, "routes", 1)
+	sink, err := newSink("kafka://" + k.addr + "/routes?encoding=protobuf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &ChangeSet{ID: 4, Path: "core.txt", Changes: []Change{{Seq: 1, Type: ChangeAdded, Destination: "10.1.0.0/16"}}}
+	if err := sink.Deliver(context.Background(), cs); err != nil {
+		t.Fatal(err)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.records) != 1 {
+		t.Fatalf("%d records, want 1", len(k.records))
+	}
+	want := marshalChangeSetProto(cs, nil)
+	if k.records[0].value != string(want) {
+		t.Errorf("value = %x, want %x", k.records[0].value, want)
+	}
+}
+
+func TestMurmur2(t *testing.T) {
+	// The Java client's own test vectors
+	for in, want := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		if got := murmur2([]byte(in)); got != want {
+			t.Errorf("murmur2(%q) = %d, want %d", in, got, want)
+		}
+	}
+}
+
+func TestNewKafkaSinkErrors(t *testing.T) {
+	t.Setenv("KAFKA_TEST_PASSWORD", "pw")
+	for _, spec := range []string{
+		"kafka://broker:9092",
+		"kafka:///routes",
+		"kafka://broker:9092/routes?encoding=avro",
+		"kafka://broker:9092/routes?acks=none",
+		"kafka://broker:9092/routes?sasl=gssapi",
+		"kafka://broker:9092/routes?sasl=plain&password-env=KAFKA_TEST_PASSWORD",
+		"kafka://broker:9092/routes?password-env=KAFKA_TEST_PASSWORD",
+		"kafka://broker:9092/routes?tls-ca-file=ca.pem",
+		"kafka+udp://broker:9092/routes",
+	} {
+		if _, err := newSink(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
@@ -0,0 +1,655 @@
+package main
+
+// A minimal Kafka producer: enough of the wire protocol to look up a
+// topic's partition leaders and produce record batches to them, over
+// plain TCP or TLS, with SASL PLAIN or SCRAM authentication. It speaks
+// Metadata v4, Produce v3 and SaslHandshake v1 / SaslAuthenticate v0,
+// which brokers from 1.0 to 4.x support.
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kafka API keys and the versions used
+const (
+	kafkaProduce          = 0
+	kafkaMetadata         = 3
+	kafkaSaslHandshake    = 17
+	kafkaSaslAuthenticate = 36
+)
+
+// Kafka error codes the producer handles; any other is returned
+const (
+	kafkaUnknownTopic    = 3
+	kafkaLeaderNotAvail  = 5
+	kafkaNotLeader       = 6
+	kafkaRequestTimedOut = 7
+	kafkaNotEnoughISR    = 19
+)
+
+// kafkaMaxBatch is the largest record batch produced, within the
+// brokers' default message.max.bytes of 1MB
+const kafkaMaxBatch = 900 << 10
+
+// kafkaMaxResponse guards against reading garbage as a response length
+const kafkaMaxResponse = 64 << 20
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaWriter encodes a request body
+type kafkaWriter struct{ b []byte }
+
+func (w *kafkaWriter) int8(v int8)   { w.b = append(w.b, byte(v)) }
+func (w *kafkaWriter) int16(v int16) { w.b = binary.BigEndian.AppendUint16(w.b, uint16(v)) }
+func (w *kafkaWriter) int32(v int32) { w.b = binary.BigEndian.AppendUint32(w.b, uint32(v)) }
+func (w *kafkaWriter) int64(v int64) { w.b = binary.BigEndian.AppendUint64(w.b, uint64(v)) }
+func (w *kafkaWriter) string(s string) {
+	w.int16(int16(len(s)))
+	w.b = append(w.b, s...)
+}
+func (w *kafkaWriter) bytes(v []byte) {
+	w.int32(int32(len(v)))
+	w.b = append(w.b, v...)
+}
+func (w *kafkaWriter) varint(v int64) { w.b = binary.AppendVarint(w.b, v) }
+
+// kafkaReader decodes a response body. The first error sticks and reads
+// after it return zero values.
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.b) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *kafkaReader) int8() int8 {
+	if b := r.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (r *kafkaReader) int16() int16 {
+	if b := r.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int32() int32 {
+	if b := r.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int64() int64 {
+	if b := r.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// string reads a string, nullable or not; null reads as ""
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.take(int(n)))
+}
+
+func (r *kafkaReader) bytes() []byte {
+	n := r.int32()
+	if n < 0 {
+		return nil
+	}
+	return r.take(int(n))
+}
+
+func (r *kafkaReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = errors.New("invalid varint")
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+// array reads an array's length, for reading its elements
+func (r *kafkaReader) array() int {
+	n := r.int32()
+	if n < 0 {
+		return 0
+	}
+	if int(n) > len(r.b) {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	return int(n)
+}
+
+// kafkaError is an error code returned by a broker
+type kafkaError int16
+
+func (e kafkaError) Error() string {
+	switch e {
+	case kafkaUnknownTopic:
+		return "unknown topic or partition"
+	case kafkaLeaderNotAvail:
+		return "leader not available"
+	case kafkaNotLeader:
+		return "not the leader for the partition"
+	case kafkaRequestTimedOut:
+		return "request timed out"
+	case kafkaNotEnoughISR:
+		return "not enough in-sync replicas"
+	}
+	return "kafka error " + strconv.Itoa(int(e))
+}
+
+// retriable reports whether the request may succeed after refreshing
+// metadata
+func (e kafkaError) retriable() bool {
+	switch e {
+	case kafkaUnknownTopic, kafkaLeaderNotAvail, kafkaNotLeader, kafkaRequestTimedOut, kafkaNotEnoughISR:
+		return true
+	}
+	return false
+}
+
+// kafkaConn is a connection to one broker. Requests are made one at a
+// time.
+type kafkaConn struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	clientID string
+	corr     int32
+}
+
+// roundTrip sends a request and returns the body of its response
+func (c *kafkaConn) roundTrip(ctx context.Context, key, version int16, body []byte) ([]byte, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultKafkaTimeout)
+	}
+	c.conn.SetDeadline(deadline)
+	c.corr++
+	w := kafkaWriter{b: make([]byte, 4, 4+10+len(c.clientID)+len(body))}
+	w.int16(key)
+	w.int16(version)
+	w.int32(c.corr)
+	w.string(c.clientID)
+	w.b = append(w.b, body...)
+	binary.BigEndian.PutUint32(w.b, uint32(len(w.b)-4))
+	if _, err := c.conn.Write(w.b); err != nil {
+		return nil, err
+	}
+
+	var head [8]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return nil, err
+	}
+	n := int32(binary.BigEndian.Uint32(head[:4]))
+	if n < 4 || n > kafkaMaxResponse {
+		return nil, fmt.Errorf("invalid response length %d", n)
+	}
+	if corr := int32(binary.BigEndian.Uint32(head[4:])); corr != c.corr {
+		return nil, fmt.Errorf("response %d to request %d", corr, c.corr)
+	}
+	resp := make([]byte, n-4)
+	if _, err := io.ReadFull(c.r, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *kafkaConn) Close() error { return c.conn.Close() }
+
+// kafkaAuth is how a producer connects and authenticates
+type kafkaAuth struct {
+	clientID string
+	tls      *tls.Config
+	// mechanism is PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512, or empty for
+	// no SASL
+	mechanism string
+	user      string
+	password  string
+}
+
+// dialKafka connects to the broker at addr
+func dialKafka(ctx context.Context, addr string, auth *kafkaAuth) (*kafkaConn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if auth.tls != nil {
+		cfg := auth.tls.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tc := tls.Client(conn, cfg)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with %s: %w", addr, err)
+		}
+		conn = tc
+	}
+	c := &kafkaConn{conn: conn, r: bufio.NewReader(conn), clientID: auth.clientID}
+	if auth.mechanism != "" {
+		if err := c.authenticate(ctx, auth); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("SASL authentication with %s: %w", addr, err)
+		}
+	}
+	return c, nil
+}
+
+// authenticate runs the SASL exchange of auth
+func (c *kafkaConn) authenticate(ctx context.Context, auth *kafkaAuth) error {
+	var w kafkaWriter
+	w.string(auth.mechanism)
+	resp, err := c.roundTrip(ctx, kafkaSaslHandshake, 1, w.b)
+	if err != nil {
+		return err
+	}
+	r := kafkaReader{b: resp}
+	if code := r.int16(); code != 0 {
+		var offered []string
+		for range r.array() {
+			offered = append(offered, r.string())
+		}
+		return fmt.Errorf("broker doesn't accept %s (offers %s)", auth.mechanism, strings.Join(offered, ", "))
+	}
+
+	step := func(msg []byte) ([]byte, error) {
+		var w kafkaWriter
+		w.bytes(msg)
+		resp, err := c.roundTrip(ctx, kafkaSaslAuthenticate, 0, w.b)
+		if err != nil {
+			return nil, err
+		}
+		r := kafkaReader{b: resp}
+		code, text, reply := r.int16(), r.string(), r.bytes()
+		if r.err != nil {
+			return nil, r.err
+		}
+		if code != 0 {
+			if text == "" {
+				text = kafkaError(code).Error()
+			}
+			return nil, errors.New(text)
+		}
+		return reply, nil
+	}
+
+	if auth.mechanism == "PLAIN" {
+		_, err := step([]byte("\x00" + auth.user + "\x00" + auth.password))
+		return err
+	}
+	newHash := sha256.New
+	if auth.mechanism == "SCRAM-SHA-512" {
+		newHash = sha512.New
+	}
+	nonce := make([]byte, 18)
+	rand.Read(nonce)
+	return scramAuthenticate(newHash, auth.user, auth.password, base64.RawStdEncoding.EncodeToString(nonce), step)
+}
+
+// kafkaRecord is a record to produce
+type kafkaRecord struct {
+	key, value []byte
+	time       time.Time
+}
+
+// appendRecordBatch appends records as a v2 record batch
+func appendRecordBatch(b []byte, records []kafkaRecord) []byte {
+	first := records[0].time.UnixMilli()
+	maxTS := first
+	var body kafkaWriter
+	for i, rec := range records {
+		ts := rec.time.UnixMilli()
+		maxTS = max(maxTS, ts)
+		var r kafkaWriter
+		r.int8(0) // attributes
+		r.varint(ts - first)
+		r.varint(int64(i))
+		r.varint(int64(len(rec.key)))
+		r.b = append(r.b, rec.key...)
+		r.varint(int64(len(rec.value)))
+		r.b = append(r.b, rec.value...)
+		r.varint(0) // headers
+		body.varint(int64(len(r.b)))
+		body.b = append(body.b, r.b...)
+	}
+
+	w := kafkaWriter{b: b}
+	start := len(w.b)
+	w.int64(0) // base offset
+	w.int32(0) // batch length, set below
+	w.int32(-1)
+	w.int8(2)  // magic
+	w.int32(0) // CRC, set below
+	crcStart := len(w.b)
+	w.int16(0) // attributes: no compression
+	w.int32(int32(len(records) - 1))
+	w.int64(first)
+	w.int64(maxTS)
+	w.int64(-1) // producer ID
+	w.int16(-1) // producer epoch
+	w.int32(-1) // base sequence
+	w.int32(int32(len(records)))
+	w.b = append(w.b, body.b...)
+	binary.BigEndian.PutUint32(w.b[start+8:], uint32(len(w.b)-start-12))
+	binary.BigEndian.PutUint32(w.b[crcStart-4:], crc32.Checksum(w.b[crcStart:], crc32c))
+	return w.b
+}
+
+// murmur2 is the hash of the Java client's default partitioner, so that
+// records keyed alike land on the same partition whichever client
+// produced them
+func murmur2(data []byte) int32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	n := len(data)
+	h := uint32(seed) ^ uint32(n)
+	for i := 0; i+4 <= n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[n&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// kafkaPartition picks the partition of a record with key among n
+func kafkaPartition(key []byte, n int) int32 {
+	return (murmur2(key) & 0x7fffffff) % int32(n)
+}
+
+// kafkaProducer produces records to one topic
+type kafkaProducer struct {
+	bootstrap []string
+	topic     string
+	auth      *kafkaAuth
+	// acks is -1 to wait for all in-sync replicas, or 1 for the leader
+	acks    int16
+	timeout time.Duration
+
+	mu      sync.Mutex
+	conns   map[int32]*kafkaConn
+	addrs   map[int32]string
+	leaders []int32
+}
+
+// refresh looks up the topic's partition leaders through any broker
+func (p *kafkaProducer) refresh(ctx context.Context) error {
+	var w kafkaWriter
+	w.int32(1)
+	w.string(p.topic)
+	w.int8(1) // allow_auto_topic_creation, if the brokers do
+	addrs := append([]string(nil), p.bootstrap...)
+	for _, a := range p.addrs {
+		addrs = append(addrs, a)
+	}
+	var errs []error
+	for _, addr := range addrs {
+		c, err := dialKafka(ctx, addr, p.auth)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		resp, err := c.roundTrip(ctx, kafkaMetadata, 4, w.b)
+		c.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("metadata from %s: %w", addr, err))
+			continue
+		}
+		return p.parseMetadata(resp)
+	}
+	return fmt.Errorf("no broker reachable: %w", errors.Join(errs...))
+}
+
+// parseMetadata takes the brokers and the topic's leaders from a Metadata
+// v4 response
+func (p *kafkaProducer) parseMetadata(resp []byte) error {
+	r := kafkaReader{b: resp}
+	r.int32() // throttle
+	addrs := make(map[int32]string)
+	for range r.array() {
+		id, host, port := r.int32(), r.string(), r.int32()
+		r.string() // rack
+		addrs[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	r.string() // cluster ID
+	r.int32()  // controller
+	var leaders []int32
+	var topicErr int16
+	for range r.array() {
+		code, name := r.int16(), r.string()
+		r.int8() // internal
+		for range r.array() {
+			pcode, index, leader := r.int16(), r.int32(), r.int32()
+			for range r.array() { // replicas
+				r.int32()
+			}
+			for range r.array() { // in-sync replicas
+				r.int32()
+			}
+			if name != p.topic {
+				continue
+			}
+			for int(index) >= len(leaders) {
+				leaders = append(leaders, -1)
+			}
+			if pcode == 0 {
+				leaders[index] = leader
+			}
+		}
+		if name == p.topic {
+			topicErr = code
+		}
+	}
+	if r.err != nil {
+		return fmt.Errorf("invalid metadata response: %w", r.err)
+	}
+	if topicErr != 0 {
+		return fmt.Errorf("topic %s: %w", p.topic, kafkaError(topicErr))
+	}
+	if len(leaders) == 0 {
+		return fmt.Errorf("topic %s has no partitions", p.topic)
+	}
+	p.addrs, p.leaders = addrs, leaders
+	return nil
+}
+
+// conn returns a connection to broker id
+func (p *kafkaProducer) conn(ctx context.Context, id int32) (*kafkaConn, error) {
+	if c := p.conns[id]; c != nil {
+		return c, nil
+	}
+	addr, ok := p.addrs[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown broker %d", id)
+	}
+	c, err := dialKafka(ctx, addr, p.auth)
+	if err != nil {
+		return nil, err
+	}
+	if p.conns == nil {
+		p.conns = make(map[int32]*kafkaConn)
+	}
+	p.conns[id] = c
+	return c, nil
+}
+
+// drop closes the connection to broker id after an error
+func (p *kafkaProducer) drop(id int32) {
+	if c := p.conns[id]; c != nil {
+		c.Close()
+		delete(p.conns, id)
+	}
+}
+
+// Produce writes records to the topic, partitioned by key, refreshing the
+// partition leaders and retrying when they have moved
+func (p *kafkaProducer) Produce(ctx context.Context, records []kafkaRecord) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.leaders == nil {
+		if err := p.refresh(ctx); err != nil {
+			return err
+		}
+	}
+	byPartition := make(map[int32][]kafkaRecord)
+	for _, rec := range records {
+		part := kafkaPartition(rec.key, len(p.leaders))
+		byPartition[part] = append(byPartition[part], rec)
+	}
+	for part, recs := range byPartition {
+		for len(recs) > 0 {
+			// Fill a batch up to kafkaMaxBatch, but with at least one record
+			n, size := 0, 0
+			for n < len(recs) && (n == 0 || size+len(recs[n].key)+len(recs[n].value)+32 <= kafkaMaxBatch) {
+				size += len(recs[n].key) + len(recs[n].value) + 32
+				n++
+			}
+			if err := p.produceBatch(ctx, part, recs[:n]); err != nil {
+				return err
+			}
+			recs = recs[n:]
+		}
+	}
+	return nil
+}
+
+// produceBatch writes records to one partition
+func (p *kafkaProducer) produceBatch(ctx context.Context, part int32, records []kafkaRecord) error {
+	var w kafkaWriter
+	w.int16(-1) // transactional ID
+	w.int16(p.acks)
+	w.int32(int32(p.timeout / time.Millisecond))
+	w.int32(1)
+	w.string(p.topic)
+	w.int32(1)
+	w.int32(part)
+	batch := appendRecordBatch(nil, records)
+	w.bytes(batch)
+
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			if rerr := p.refresh(ctx); rerr != nil {
+				return errors.Join(err, rerr)
+			}
+		}
+		if int(part) >= len(p.leaders) || p.leaders[part] < 0 {
+			err = fmt.Errorf("partition %d: %w", part, kafkaError(kafkaLeaderNotAvail))
+			continue
+		}
+		leader := p.leaders[part]
+		var c *kafkaConn
+		if c, err = p.conn(ctx, leader); err != nil {
+			continue
+		}
+		var resp []byte
+		if resp, err = c.roundTrip(ctx, kafkaProduce, 3, w.b); err != nil {
+			p.drop(leader)
+			continue
+		}
+		code, perr := produceError(resp)
+		if perr != nil {
+			return perr
+		}
+		if code == 0 {
+			return nil
+		}
+		err = fmt.Errorf("partition %d: %w", part, kafkaError(code))
+		if !kafkaError(code).retriable() {
+			return err
+		}
+	}
+	return err
+}
+
+// produceError returns the error code of the one partition in a Produce
+// v3 response
+func produceError(resp []byte) (int16, error) {
+	r := kafkaReader{b: resp}
+	var code int16
+	for range r.array() {
+		r.string()
+		for range r.array() {
+			r.int32()
+			code = r.int16()
+			r.int64() // base offset
+			r.int64() // log append time
+		}
+	}
+	if r.err != nil {
+		return 0, fmt.Errorf("invalid produce response: %w", r.err)
+	}
+	return code, nil
+}
+
+// Close closes the producer's connections
+func (p *kafkaProducer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id := range p.conns {
+		p.drop(id)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// errChunkGone is returned when a lean chunk's body can no longer be read
+// because the file has changed since the chunk was hashed
+var errChunkGone = errors.New("chunk content no longer available: the file changed since it was loaded")
+
+// chunkSource reads chunk bodies back from the table file for chunks loaded
+// in lean mode
+type chunkSource struct {
+	path string
+	norm *normalizer
+	algo HashAlgorithm
+}
+
+// Content returns the chunk body. Chunks loaded in lean mode have no Data,
+// so their body is read back from the file and checked against the hash.
+func (c *Chunk) Content() ([]byte, error) {
+	if c.Data != nil || c.src == nil {
+		return c.Data, nil
+	}
+	return c.src.read(c)
+}
+
+// read loads a chunk's bytes from the file and verifies that they still
+// hash to the chunk's hash
+func (s *chunkSource) read(c *Chunk) ([]byte, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, c.Length)
+	if _, err := f.ReadAt(buf, c.Offset); err != nil {
+		if err == io.EOF {
+			return nil, errChunkGone
+		}
+		return nil, fmt.Errorf("failed to read chunk: %w", err)
+	}
+
+	// Match the scanner, which strips the CR of CRLF line endings
+	data := bytes.ReplaceAll(buf, []byte("\r\n"), []byte("\n"))
+	if hashLines(strings.Split(string(data), "\n"), s.norm, s.algo) != c.Hash {
+		return nil, errChunkGone
+	}
+	return data, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestLeanContent(t *testing.T) {
+	blocks := []string{
+		routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"),
+		routeBlock("0.0.0.0/0", "Static", "172.31.0.254"),
+	}
+	full := loadTable(t, writeTable(t, blocks...))
+
+	path := writeTable(t, blocks...)
+	rewriteFile(t, path, "\n", "\r\n")
+	lean := NewDataTable(path)
+	lean.Options.Lean = true
+	if err := lean.LoadDataTable(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for dest, want := range full.Chunks {
+		c := lean.Chunks[dest]
+		if c.Data != nil {
+			t.Errorf("%s: lean chunk kept its data", dest)
+		}
+		if c.Hash != want.Hash {
+			t.Errorf("%s: hash differs from full load", dest)
+		}
+		data, err := c.Content()
+		if err != nil {
+			t.Fatalf("%s: %v", dest, err)
+		}
+		if !bytes.Equal(data, want.Data) {
+			t.Errorf("%s: content = %q, want %q", dest, data, want.Data)
+		}
+	}
+	if got := chunkField(lean.Chunks["0.0.0.0/0"], "Protocol"); got != "Static" {
+		t.Errorf("protocol = %q", got)
+	}
+
+	rewriteFile(t, path, "Static", "IBGP")
+	if _, err := lean.Chunks["0.0.0.0/0"].Content(); !errors.Is(err, errChunkGone) {
+		t.Errorf("stale chunk read: %v", err)
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	path := writeTable(t,
+		routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"),
+		routeBlock("0.0.0.0/0", "Static", "172.31.0.254"),
+	)
+	rt := NewDataTable(path)
+	rt.Options.MaxSize = 1 << 20
+	if err := rt.LoadDataTable(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if rt.Oversize() || rt.Chunks["10.0.0.0/8"].Data == nil {
+		t.Fatal("small file loaded lean")
+	}
+
+	// Over the limit, the table degrades to hashes and offsets
+	rt.Options.MaxSize = 64
+	rewriteFile(t, path, "172.31.0.1", "172.31.0.2")
+	cs, err := rt.DetectChanges(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Len() != 1 || !rt.Oversize() {
+		t.Fatalf("%d changes, oversize %v", cs.Len(), rt.Oversize())
+	}
+	for dest, c := range rt.Chunks {
+		if c.Data != nil {
+			t.Errorf("%s: kept its data over the limit", dest)
+		}
+	}
+
+	rt.Options.RefuseOversize = true
+	if _, err := rt.DetectChanges(context.Background()); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("refused load = %v, want ErrTooLarge", err)
+	}
+}
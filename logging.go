@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Log formats of watch mode
+const (
+	LogText = "text"
+	LogJSON = "json"
+)
+
+// logLevelVar is the level watch mode logs at, changed on SIGHUP when
+// -log-level is
+var logLevelVar slog.LevelVar
+
+// parseLogLevel parses a -log-level
+func parseLogLevel(s string) (slog.Level, error) {
+	switch s {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown -log-level %q (want debug, info, warn or error)", s)
+}
+
+// newLogger creates a logger writing records at level or above to w in
+// format, LogText or LogJSON
+func newLogger(w io.Writer, format string, level slog.Leveler) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case LogText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case LogJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown -log-format %q (want text or json)", format)
+}
+
+// statusHandler writes log records as status events, so that with -output
+// jsonl nothing but JSON reaches standard output. Attributes are appended
+// to the message as key=value pairs.
+type statusHandler struct {
+	out   *objectWriter
+	level slog.Leveler
+	attrs string
+}
+
+func newStatusHandler(out *objectWriter, level slog.Leveler) *statusHandler {
+	return &statusHandler{out: out, level: level}
+}
+
+func (h *statusHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *statusHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Message)
+	b.WriteString(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&b, "", a)
+		return true
+	})
+	t := r.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return h.out.write(jsonStatus{Event: "status", Time: h.out.times.In(t), Level: strings.ToLower(r.Level.String()), Message: b.String()})
+}
+
+func (h *statusHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	b.WriteString(h.attrs)
+	for _, a := range attrs {
+		appendAttr(&b, "", a)
+	}
+	return &statusHandler{out: h.out, level: h.level, attrs: b.String()}
+}
+
+// WithGroup is a no-op: group names aren't kept in status messages
+func (h *statusHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// appendAttr appends a as " key=value", flattening groups into dotted keys
+func appendAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, g := range v.Group() {
+			appendAttr(b, prefix, g)
+		}
+		return
+	}
+	if a.Key == "" {
+		return
+	}
+	s := v.String()
+	if s == "" || strings.ContainsAny(s, " =\"") {
+		s = fmt.Sprintf("%q", s)
+	}
+	fmt.Fprintf(b, " %s%s=%s", prefix, a.Key, s)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Error("parseLogLevel accepted verbose")
+	}
+	if _, err := newLogger(&bytes.Buffer{}, "xml", slog.LevelInfo); err == nil {
+		t.Error("newLogger accepted -log-format xml")
+	}
+
+	var out bytes.Buffer
+	var level slog.LevelVar
+	level.Set(slog.LevelWarn)
+	log, err := newLogger(&out, LogJSON, &level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Info("loaded table", "path", "t.txt")
+	log.Warn("file still changing; reading it anyway", "target", "t.txt")
+	// Lowering the level, as a SIGHUP does, applies straight away
+	debug, _ := parseLogLevel("debug")
+	level.Set(debug)
+	log.Debug("detecting changes", "target", "t.txt")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d records, want 2:\n%s", len(lines), out.String())
+	}
+	for i, want := range []string{"WARN", "DEBUG"} {
+		var r map[string]any
+		if err := json.Unmarshal([]byte(lines[i]), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r["level"] != want || r["target"] != "t.txt" {
+			t.Errorf("record %d = %v, want level %s", i, r, want)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	sinkFactories["loki"] = func(u *url.URL) (Sink, error) {
+		return newLokiSink(u)
+	}
+}
+
+// LokiSink pushes every change to Grafana Loki as a log line, the change
+// event as -output jsonl writes it, for LogQL's json parser. The spec is
+// loki+https://[user@]host:3100, or loki+http://, which pushes to
+// /loki/api/v1/push unless a path is given, with these parameters:
+//
+//	labels               comma separated key=value labels added to every
+//	                     line (default job=go-watcher)
+//	tenant               tenant sent as X-Scope-OrgID
+//	password-env         environment variable holding the user's password
+//	password-file        file holding it, instead
+//	token-env            environment variable holding a bearer token
+//	token-file           file holding it, instead
+//	path, type, prefix   only push the changes selected as for /events
+//
+// plus the webhook sink's timeout, retries and backoff. Lines are labelled
+// with source, the table file's name without extension, change_type and,
+// if the route has a Protocol field, protocol.
+type LokiSink struct {
+	name   string
+	post   *WebhookSink
+	labels map[string]string
+	filter changeFilter
+}
+
+// lokiStream is a stream of a push request: lines sharing their labels
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func newLokiSink(u *url.URL) (*LokiSink, error) {
+	s := &LokiSink{name: sinkName(u), labels: map[string]string{"job": "go-watcher"}}
+	if err := s.parse(u); err != nil {
+		return nil, fmt.Errorf("loki sink %s: %w", s.name, err)
+	}
+	return s, nil
+}
+
+// parse takes the sink's options from u
+func (s *LokiSink) parse(u *url.URL) error {
+	_, transport, _ := strings.Cut(u.Scheme, "+")
+	if transport != "http" && transport != "https" {
+		return errors.New("needs loki+https:// or loki+http://")
+	}
+	if u.Host == "" {
+		return errors.New("needs the server, as loki+https://host:3100")
+	}
+	q := u.Query()
+	password, err := readSecret(q, "password")
+	if err != nil {
+		return err
+	}
+	token, err := readSecret(q, "token")
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	switch {
+	case token != nil && u.User != nil:
+		return errors.New("takes a token or a user, not both")
+	case token != nil:
+		header.Set("Authorization", "Bearer "+string(token))
+	case u.User != nil:
+		if password == nil {
+			return errors.New("a user needs password-env or password-file")
+		}
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+string(password))))
+	}
+	if v := q.Get("tenant"); v != "" {
+		header.Set("X-Scope-OrgID", v)
+	}
+	if v := q.Get("labels"); v != "" {
+		s.labels = make(map[string]string)
+		for _, kv := range splitList(v) {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok || !lokiLabelName(k) || v == "" {
+				return fmt.Errorf("invalid label %q (want name=value)", kv)
+			}
+			s.labels[k] = v
+		}
+	}
+	if s.filter, err = parseChangeFilter(q.Get("path"), q.Get("type"), q.Get("prefix")); err != nil {
+		return err
+	}
+	for _, p := range []string{"labels", "tenant", "path", "type", "prefix"} {
+		q.Del(p)
+	}
+
+	target := *u
+	target.Scheme, target.User = transport, nil
+	if target.Path == "" || target.Path == "/" {
+		target.Path = "/loki/api/v1/push"
+	}
+	if s.post, err = newPoster(s.name, &target, q); err != nil {
+		return err
+	}
+	s.post.header = header
+	return nil
+}
+
+// lokiLabelName reports whether name is a valid label name
+func lokiLabelName(name string) bool {
+	for i, r := range name {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+func (s *LokiSink) Name() string { return s.name }
+
+// Deliver pushes the changes of cs the sink selects
+func (s *LokiSink) Deliver(ctx context.Context, cs *ChangeSet) error {
+	changes := s.filter.changes(cs)
+	if len(changes) == 0 {
+		return nil
+	}
+	ts := cs.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	byLabels := make(map[string]*lokiStream)
+	var streams []*lokiStream
+	for _, c := range changes {
+		line, err := changeEvent(cs, c)
+		if err != nil {
+			return fmt.Errorf("failed to encode change: %w", err)
+		}
+		labels := s.streamLabels(cs, c)
+		key := lokiKey(labels)
+		st := byLabels[key]
+		if st == nil {
+			st = &lokiStream{Stream: labels}
+			byLabels[key] = st
+			streams = append(streams, st)
+		}
+		st.Values = append(st.Values, [2]string{strconv.FormatInt(ts.UnixNano(), 10), string(line)})
+	}
+	body, err := json.Marshal(map[string]any{"streams": streams})
+	if err != nil {
+		return fmt.Errorf("failed to encode push: %w", err)
+	}
+	return s.post.send(ctx, body)
+}
+
+// streamLabels returns the labels of change c of cs
+func (s *LokiSink) streamLabels(cs *ChangeSet, c Change) map[string]string {
+	labels := make(map[string]string, len(s.labels)+3)
+	for k, v := range s.labels {
+		labels[k] = v
+	}
+	labels["source"] = tableSource(cs.Path)
+	labels["change_type"] = string(c.Type)
+	chunk := c.New
+	if chunk == nil {
+		chunk = c.Old
+	}
+	if protocol := chunkField(chunk, "Protocol"); protocol != "" {
+		labels["protocol"] = protocol
+	}
+	return labels
+}
+
+// lokiKey returns a key identifying a set of labels
+func lokiKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%q,", k, labels[k])
+	}
+	return b.String()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLokiSink(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	t.Setenv("LOKI_TEST_TOKEN", "tok")
+
+	sink, err := newSink(strings.Replace(srv.URL, "http://", "loki+http://", 1) + "?token-env=LOKI_TEST_TOKEN&tenant=netops&labels=job=routes,site=ams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &ChangeSet{Stream: "s1", ID: 2, Path: "/data/core.txt", Time: time.Unix(1714564800, 5), Changes: []Change{
+		{Seq: 1, Type: ChangeAdded, Destination: "10.1.0.0/16", New: &Chunk{Data: []byte("Destination: 10.1.0.0/16\nProtocol: OSPF\n")}},
+		{Seq: 2, Type: ChangeAdded, Destination: "10.2.0.0/16", New: &Chunk{Data: []byte("Destination: 10.2.0.0/16\nProtocol: OSPF\n")}},
+		{Seq: 3, Type: ChangeRemoved, Destination: "10.3.0.0/16"},
+		{Seq: 4, Type: ChangeRemoved, Destination: "10.4.0.0/16", Volatile: true},
+	}}
+	if err := sink.Deliver(context.Background(), cs); err != nil {
+		t.Fatal(err)
+	}
+	if got.URL.Path != "/loki/api/v1/push" || got.URL.RawQuery != "" {
+		t.Errorf("pushed to %s", got.URL)
+	}
+	if got.Header.Get("Authorization") != "Bearer tok" || got.Header.Get("X-Scope-OrgID") != "netops" {
+		t.Errorf("headers %v", got.Header)
+	}
+	var push struct {
+		Streams []lokiStream `json:"streams"`
+	}
+	if err := json.Unmarshal(body, &push); err != nil {
+		t.Fatal(err)
+	}
+	if len(push.Streams) != 2 {
+		t.Fatalf("%d streams: %s", len(push.Streams), body)
+	}
+	ospf, removed := push.Streams[0], push.Streams[1]
+	if lokiKey(ospf.Stream) != `change_type="added",job="routes",protocol="OSPF",site="ams",source="core",` || len(ospf.Values) != 2 {
+		t.Errorf("first stream %+v", ospf)
+	}
+	if lokiKey(removed.Stream) != `change_type="removed",job="routes",site="ams",source="core",` || len(removed.Values) != 1 {
+		t.Errorf("second stream %+v", removed)
+	}
+	if v := ospf.Values[1]; v[0] != "1714564800000000005" || !strings.Contains(v[1], `"destination":"10.2.0.0/16"`) {
+		t.Errorf("value %q", v)
+	}
+}
+
+func TestNewLokiSinkErrors(t *testing.T) {
+	for _, spec := range []string{
+		"loki://logs:3100",
+		"loki+https://",
+		"loki+https://watcher@logs:3100",
+		"loki+https://logs:3100?labels=job",
+		"loki+https://logs:3100?labels=9job=x",
+	} {
+		if _, err := newSink(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
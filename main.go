@@ -1,348 +1,1201 @@
 package main
 
 import (
-	"bufio"
-	"crypto/sha256"
-	"encoding/hex"
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 )
 
-// Chunk represents a single route entry in the routing table
-type Chunk struct {
-	StartLine int64
-	EndLine   int64
-	Hash      string
-	Data      []byte
-	Destination string
-}
+// FileWatcher handles file system notifications
+type FileWatcher struct {
+	// WatchMetadata also treats changes to the file's mode, owner or
+	// timestamps (Chmod events) as changes
+	WatchMetadata bool
+	// Coalescer debounces the file's events into change notifications
+	Coalescer *Coalescer
+	// OnError is called for every watcher error: errors from fsnotify,
+	// ErrWatcherClosed if the event stream ends without Close being
+	// called, and ErrFileMissing while the file or its directory is gone.
+	// It is called from the watcher's goroutines and must not block.
+	OnError func(error)
 
-// DataTable manages the routing table file and its chunks
-type DataTable struct {
-	FilePath string
-	Chunks   map[string]*Chunk // key is destination (e.g., "0.0.0.0/0")
-	mu       sync.RWMutex
-}
+	// dirWatch is the file's share of the pooled directory watch
+	dirWatch  *dirWatch
+	pool      *WatchPool
+	filePath  string
+	onChange  func()
+	lastEvent time.Time
+	mu        sync.Mutex
+	closed    bool
+	// missing is set while the file is gone and awaitFile is waiting for
+	// it to come back
+	missing bool
+	// dirLost is set when the watched directory was removed, which ends
+	// its watch; awaitFile re-adds it once the directory is back
+	dirLost       bool
+	rearmInterval time.Duration
+	stop          chan struct{}
 
-// NewDataTable creates a new DataTable instance
-func NewDataTable(filePath string) *DataTable {
-	return &DataTable{
-		FilePath: filePath,
-		Chunks:   make(map[string]*Chunk),
-	}
+	// restartBackoff is the first delay before rebuilding a failed
+	// fsnotify watcher; it doubles up to maxRestartBackoff
+	restartBackoff time.Duration
+	degraded       bool
+	restarts       int
+	lastErr        error
 }
 
-// hashChunk computes SHA256 hash of the chunk data
-func hashChunk(data []byte) string {
-	hash := sha256.Sum256(data)
-	return hex.EncodeToString(hash[:])
+// maxRestartBackoff caps the delay between attempts to rebuild a failed
+// fsnotify watcher
+const maxRestartBackoff = time.Minute
+
+// Watcher notices changes to a watched file
+type Watcher interface {
+	Start(ctx context.Context) error
+	Close() error
+	// Health reports whether the watcher is receiving events
+	Health() WatcherHealth
 }
 
-// LoadDataTable loads the routing table file, chunks it by routes, and hashes each chunk
-func (rt *DataTable) LoadDataTable() error {
-	rt.mu.Lock()
-	defer rt.mu.Unlock()
+// WatcherHealth describes whether a watcher is working. A degraded
+// watcher is not noticing changes while it tries to recover.
+type WatcherHealth struct {
+	Healthy  bool   `json:"healthy"`
+	Restarts int    `json:"restarts"`
+	Error    string `json:"error,omitempty"`
+}
 
-	file, err := os.Open(rt.FilePath)
+// NewFileWatcher creates a new file watcher
+func NewFileWatcher(filePath string, onChange func(), debounce time.Duration) (*FileWatcher, error) {
+	// Watch the directory containing the file, so that replacing the file
+	// (as atomic saves do) doesn't end the watch. Files in the same
+	// directory share the watch.
+	filePath = filepath.Clean(filePath)
+	watch, err := sharedWatchPool.Watch(filepath.Dir(filePath))
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	var currentChunk *Chunk
-	var chunkLines []string
-	var lineNum int64
-	var currentDestination string
-
-	for scanner.Scan() {
-		lineNum++
-		line := scanner.Text()
-		
-		// Check if this line starts a new route
-		if strings.HasPrefix(line, "Destination:") {
-			// Save previous chunk if exists
-			if currentChunk != nil && len(chunkLines) > 0 {
-				chunkData := []byte(strings.Join(chunkLines, "\n"))
-				currentChunk.Data = chunkData
-				currentChunk.Hash = hashChunk(chunkData)
-				currentChunk.EndLine = lineNum - 1
-				rt.Chunks[currentChunk.Destination] = currentChunk
-			}
-			
-			// Extract destination from line (e.g., "Destination: 0.0.0.0/0")
-			parts := strings.Fields(line)
-			if len(parts) >= 2 {
-				currentDestination = parts[1]
-			} else {
-				currentDestination = fmt.Sprintf("unknown_%d", lineNum)
-			}
-			
-			// Start new chunk
-			currentChunk = &Chunk{
-				StartLine:   lineNum,
-				Destination: currentDestination,
-			}
-			chunkLines = []string{line}
-		} else if currentChunk != nil {
-			// Add line to current chunk
-			chunkLines = append(chunkLines, line)
-			
-			// If we hit a blank line after some content, it might be end of route
-			// But we'll continue until next Destination: to be safe
-		}
+		return nil, err
 	}
 
-	// Save last chunk
-	if currentChunk != nil && len(chunkLines) > 0 {
-		chunkData := []byte(strings.Join(chunkLines, "\n"))
-		currentChunk.Data = chunkData
-		currentChunk.Hash = hashChunk(chunkData)
-		currentChunk.EndLine = lineNum
-		rt.Chunks[currentChunk.Destination] = currentChunk
+	fw := &FileWatcher{
+		dirWatch:       watch,
+		pool:           sharedWatchPool,
+		filePath:       filePath,
+		onChange:       onChange,
+		rearmInterval:  time.Second,
+		stop:           make(chan struct{}),
+		restartBackoff: time.Second,
+		OnError:        func(err error) { slog.Error("file watcher error", "err", err) },
 	}
+	fw.Coalescer = NewCoalescer(debounce, func(int) { fw.fire() })
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading file: %w", err)
-	}
+	return fw, nil
+}
 
-	fmt.Printf("Loaded %d route chunks from %s\n", len(rt.Chunks), rt.FilePath)
+// Start begins watching for file changes. Watching stops and the watcher
+// is closed when ctx is cancelled. Starting a closed watcher returns
+// ErrWatcherClosed.
+func (fw *FileWatcher) Start(ctx context.Context) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.closed {
+		return ErrWatcherClosed
+	}
+	fw.healthGauge().Set(1)
+	go fw.watch(ctx)
 	return nil
 }
 
-// DetectChanges re-hashes chunks and returns list of changed destinations
-func (rt *DataTable) DetectChanges() ([]string, error) {
-	rt.mu.RLock()
-	oldChunks := make(map[string]*Chunk)
-	for k, v := range rt.Chunks {
-		oldChunks[k] = v
+// watch monitors file system events. If the fsnotify event stream ends
+// without Close being called (for example when the process runs out of
+// file descriptors) the watcher is rebuilt.
+func (fw *FileWatcher) watch(ctx context.Context) {
+	for fw.watchEvents(ctx, fw.fsWatcher()) && fw.restart(ctx) {
 	}
-	rt.mu.RUnlock()
+}
+
+// fsWatcher returns the current directory watch
+func (fw *FileWatcher) fsWatcher() *dirWatch {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	return fw.dirWatch
+}
 
-	// Create temporary routing table to load new state
-	tempRT := NewDataTable(rt.FilePath)
-	if err := tempRT.LoadDataTable(); err != nil {
-		return nil, fmt.Errorf("failed to reload routing table: %w", err)
+// watchEvents handles the events of w until ctx is cancelled or the event
+// stream ends. It reports whether the stream ended unexpectedly.
+func (fw *FileWatcher) watchEvents(ctx context.Context, w *dirWatch) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			fw.Close()
+			return false
+		case <-w.Done:
+			return fw.stopped()
+		case event := <-w.Events:
+			slog.Debug("file event", "path", event.Name, "op", event.Op.String())
+
+			// Check if it's our file. Editors and tools like rsync save
+			// atomically: they write a temporary file and rename it over
+			// ours, or move ours aside and create a new one. That shows up
+			// as some mix of Rename, Remove, Create and Write on our path,
+			// which the debounce collapses into a single change.
+			//
+			// Deploy pipelines also replace the whole directory, which
+			// ends the directory watch.
+			switch name := filepath.Clean(event.Name); {
+			case name == fw.filePath && (event.Op != fsnotify.Chmod || fw.WatchMetadata):
+				fw.handleChange()
+			case name == filepath.Dir(fw.filePath) && (event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename)):
+				fw.lostDir()
+			}
+		case err := <-w.Errors:
+			metrics.Counter("fsnotify_errors_total", "Errors reported by fsnotify", "path", fw.filePath).Inc()
+			fw.OnError(err)
+		}
 	}
+}
 
-	var changed []string
+// stopped handles the end of the event stream, reporting whether it ended
+// without Close being called. The watcher is then degraded until restart
+// succeeds.
+func (fw *FileWatcher) stopped() bool {
+	fw.mu.Lock()
+	closed := fw.closed
+	if !closed {
+		fw.degraded = true
+		fw.lastErr = ErrWatcherClosed
+	}
+	fw.mu.Unlock()
+	if closed {
+		return false
+	}
+	fw.healthGauge().Set(0)
+	fw.OnError(ErrWatcherClosed)
+	return true
+}
 
-	// Compare hashes
-	tempRT.mu.RLock()
-	defer tempRT.mu.RUnlock()
+// restart rebuilds the fsnotify watcher, retrying with exponential
+// backoff. It reports false if the watcher was closed or ctx cancelled
+// first.
+func (fw *FileWatcher) restart(ctx context.Context) bool {
+	backoff := fw.restartBackoff
+	for {
+		select {
+		case <-ctx.Done():
+			fw.Close()
+			return false
+		case <-fw.stop:
+			return false
+		case <-time.After(backoff):
+		}
 
-	// Check existing chunks for changes
-	for dest, oldChunk := range oldChunks {
-		newChunk, exists := tempRT.Chunks[dest]
-		if !exists {
-			// Route was deleted
-			changed = append(changed, dest)
-		} else if newChunk.Hash != oldChunk.Hash {
-			// Route was modified
-			changed = append(changed, dest)
+		w, err := fw.pool.Watch(filepath.Dir(fw.filePath))
+		if err != nil {
+			err = fmt.Errorf("failed to restart watcher: %w", err)
+			fw.mu.Lock()
+			fw.lastErr = err
+			fw.mu.Unlock()
+			fw.OnError(err)
+			backoff = min(2*backoff, maxRestartBackoff)
+			continue
 		}
-	}
 
-	// Check for new routes
-	for dest := range tempRT.Chunks {
-		if _, exists := oldChunks[dest]; !exists {
-			changed = append(changed, dest)
+		fw.mu.Lock()
+		if fw.closed {
+			fw.mu.Unlock()
+			w.Close()
+			return false
 		}
-	}
+		old := fw.dirWatch
+		fw.dirWatch = w
+		fw.degraded = false
+		fw.lastErr = nil
+		fw.restarts++
+		fw.mu.Unlock()
+		old.Close()
 
-	// Update our chunks with new state
-	rt.mu.Lock()
-	rt.Chunks = tempRT.Chunks
-	rt.mu.Unlock()
+		fw.healthGauge().Set(1)
+		metrics.Counter("watcher_restarts_total", "Times a failed fsnotify watcher was rebuilt", "path", fw.filePath).Inc()
+		slog.Info("file watcher restarted; watching again", "path", fw.filePath)
+		// The file may have changed while nothing was watching it
+		fw.handleChange()
+		return true
+	}
+}
 
-	return changed, nil
+// Health reports whether the watcher is receiving events
+func (fw *FileWatcher) Health() WatcherHealth {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	h := WatcherHealth{Healthy: !fw.degraded, Restarts: fw.restarts}
+	if fw.lastErr != nil {
+		h.Error = fw.lastErr.Error()
+	}
+	return h
 }
 
-// FileWatcher handles file system notifications
-type FileWatcher struct {
-	watcher   *fsnotify.Watcher
-	filePath  string
-	onChange  func()
-	debounce  time.Duration
-	lastEvent time.Time
-	timer     *time.Timer
-	mu        sync.Mutex
+func (fw *FileWatcher) healthGauge() *Gauge {
+	return metrics.Gauge("watcher_healthy", "Whether the file watcher is receiving events", "path", fw.filePath)
 }
 
-// NewFileWatcher creates a new file watcher
-func NewFileWatcher(filePath string, onChange func(), debounce time.Duration) (*FileWatcher, error) {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create watcher: %w", err)
-	}
+// handleChange debounces change events
+func (fw *FileWatcher) handleChange() {
+	fw.Coalescer.Event()
+}
 
-	// Watch the directory containing the file
-	dir := filepath.Dir(filePath)
-	if err := watcher.Add(dir); err != nil {
-		watcher.Close()
-		return nil, fmt.Errorf("failed to watch directory: %w", err)
+// fire reports a change once the debounce expires. When the file is
+// missing the change is not reported: the file was moved aside or removed,
+// and awaitFile reports it once it is back.
+func (fw *FileWatcher) fire() {
+	if _, err := os.Stat(fw.filePath); err != nil {
+		fw.awaitFile()
+		return
 	}
-
-	fw := &FileWatcher{
-		watcher:  watcher,
-		filePath: filePath,
-		onChange: onChange,
-		debounce: debounce,
+	fw.mu.Lock()
+	rearm := fw.missing
+	fw.missing = false
+	fw.lastEvent = time.Now()
+	fw.mu.Unlock()
+	if rearm {
+		fw.rearm()
 	}
-
-	return fw, nil
+	fw.onChange()
 }
 
-// Start begins watching for file changes
-func (fw *FileWatcher) Start() error {
-	go fw.watch()
-	return nil
+// lostDir handles removal of the watched directory
+func (fw *FileWatcher) lostDir() {
+	fw.mu.Lock()
+	fw.dirLost = true
+	fw.mu.Unlock()
+	metrics.Counter("watch_dir_lost_total", "Times the watched directory was removed").Inc()
+	fw.OnError(fmt.Errorf("%w: directory %s was removed; retrying the watch until it is back", ErrFileMissing, filepath.Dir(fw.filePath)))
+	fw.awaitFile()
 }
 
-// watch monitors file system events
-func (fw *FileWatcher) watch() {
-	for {
-		select {
-		case event, ok := <-fw.watcher.Events:
-			if !ok {
+// awaitFile stats the missing file until it reappears, re-adding the
+// directory watch first if the directory was removed. Some platforms
+// deliver no events for a file recreated in a watched directory, so this
+// doesn't rely on the Create event arriving.
+func (fw *FileWatcher) awaitFile() {
+	fw.mu.Lock()
+	if fw.missing || fw.closed {
+		fw.mu.Unlock()
+		return
+	}
+	fw.missing = true
+	fw.mu.Unlock()
+	fw.OnError(fmt.Errorf("%w: %s; waiting for it to reappear", ErrFileMissing, fw.filePath))
+
+	go func() {
+		ticker := time.NewTicker(fw.rearmInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-fw.stop:
 				return
+			case <-ticker.C:
 			}
-			
-			// Check if it's our file
-			if event.Name == fw.filePath {
-				if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create {
-					fw.handleChange()
-				}
+			fw.mu.Lock()
+			missing, dirLost := fw.missing, fw.dirLost
+			fw.mu.Unlock()
+			if !missing {
+				return
 			}
-		case err, ok := <-fw.watcher.Errors:
-			if !ok {
+			if dirLost && fw.addDir() != nil {
+				continue
+			}
+			if _, err := os.Stat(fw.filePath); err == nil {
+				fw.handleChange()
 				return
 			}
-			fmt.Printf("File watcher error: %v\n", err)
 		}
+	}()
+}
+
+// rearm re-adds the directory watch after the file reappeared, so that
+// events for its new inode are delivered
+func (fw *FileWatcher) rearm() {
+	dir := filepath.Dir(fw.filePath)
+	if err := fw.addDir(); err != nil {
+		fw.OnError(fmt.Errorf("failed to re-arm watch on %s: %w", dir, err))
+		return
 	}
+	metrics.Counter("watch_rearms_total", "Times the file watch was re-armed after the file was recreated").Inc()
+	slog.Info("watched file is back; watching again", "path", fw.filePath)
 }
 
-// handleChange debounces change events
-func (fw *FileWatcher) handleChange() {
+// addDir (re-)adds the directory watch
+func (fw *FileWatcher) addDir() error {
+	dir := filepath.Dir(fw.filePath)
+	if err := fw.pool.Readd(dir); err != nil {
+		return err
+	}
 	fw.mu.Lock()
-	defer fw.mu.Unlock()
-
-	// Cancel previous timer if exists
-	if fw.timer != nil {
-		fw.timer.Stop()
+	lost := fw.dirLost
+	fw.dirLost = false
+	fw.mu.Unlock()
+	if lost {
+		slog.Info("watched directory is back; watching again", "dir", dir)
 	}
-
-	// Set new timer
-	fw.timer = time.AfterFunc(fw.debounce, func() {
-		fw.mu.Lock()
-		fw.lastEvent = time.Now()
-		fw.mu.Unlock()
-		fw.onChange()
-	})
+	return nil
 }
 
-// Close stops the file watcher
+// Close stops the file watcher. Closing it again has no effect.
 func (fw *FileWatcher) Close() error {
 	fw.mu.Lock()
-	if fw.timer != nil {
-		fw.timer.Stop()
+	if fw.closed {
+		fw.mu.Unlock()
+		return nil
 	}
+	fw.closed = true
+	close(fw.stop)
+	w := fw.dirWatch
 	fw.mu.Unlock()
-	return fw.watcher.Close()
+	fw.Coalescer.Stop()
+	return w.Close()
+}
+
+// commands maps subcommand names to their entry points. Each returns the
+// process exit code.
+var commands = map[string]func(args []string) int{
+	"union":     func(args []string) int { return runSetOp("union", args, os.Stdout) },
+	"intersect": func(args []string) int { return runSetOp("intersect", args, os.Stdout) },
+	"subtract":  func(args []string) int { return runSetOp("subtract", args, os.Stdout) },
+	"dlq":       runDLQ,
+	"bench":     runBench,
+	"check":     runCheck,
+	"tui":       runTUI,
+	"history":   runHistory,
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		os.Args = append(os.Args[:1], serveArgs(os.Args[2:])...)
+	}
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+
 	// Setup command line flags
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s -file <file>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s -file <file>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -command <command> [-interval <duration>]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s serve [-listen <addr>] -file <file> [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s union|intersect|subtract [options] <file> <file>...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s dlq list|show|retry|purge -dir <dir> [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s bench [-json] [-sizes n,n...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s check -file <file> -state <file> [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s tui -file <file> [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s history [-db <file>] [-since <duration>] [-prefix <prefix>]\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Watch a file for changes and detect modified content using hashing.\n\n")
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nExample:\n")
 		fmt.Fprintf(os.Stderr, "  %s -file .data/t.txt\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -command \"ssh router display ip routing-table verbose\" -interval 5m\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  ssh router display ip routing-table | %s -file -\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s subtract routerA.txt routerB.txt\n", os.Args[0])
 	}
 
-	var filePath string
-	flag.StringVar(&filePath, "file", "", "Path to routing table file (required)")
+	var files stringList
+	var command, ignoreFields, normalize, tailMarker string
+	var interval, stdinIdle time.Duration
+	var reportOpts ReportOptions
+	var volatileAfter int
+	var hashName, chunkerName string
+	var lean, incremental, watchMetadata, holdOnTruncate, noColor, graphQL, pprofOn bool
+	var sinkSpecs, filterExprs, filterPlugins stringList
+	var dlqDir, outboxDir, critical, refsPath, watchMode, auditPath, journal, onChangeExec string
+	var auditSync bool
+	var auditMaxSize byteSize
+	var auditMaxAge, onChangeExecTimeout, outboxRetention time.Duration
+	var onChangeExecConcurrency, outboxHighWater int
+	var auditBackups int
+	var settle, progressInterval, batchWindow, breakerCooldown, pollInterval, sweep, debounce, debounceMax, maxDelay time.Duration
+	var httpAddr, metricsAddr, otlpEndpoint, tlsCert, tlsKey, tlsClientCA, authTokens, oidcIssuer, oidcAudience, gnmiAddr, grpcAddr, configPath, exclude, oversize, output, tmpl, snapshotDir, logLevel, logFormat, tsFormat, tz string
+	var maxSize byteSize
+	var breakerFailures, workers, maxLineBytes, diffCacheSize int
+	flag.Var(&files, "file", "Path or file name pattern (e.g. /var/routes/*.txt) of routing tables to watch; repeat or comma separate for several (required unless -command is set); - reads tables from standard input")
+	flag.StringVar(&exclude, "exclude", "", "Comma separated file name patterns of files matching a -file pattern to ignore, e.g. *.swp,*.bak,*~")
+	flag.StringVar(&command, "command", "", "Shell command whose output is the routing table, run every -interval instead of watching a file")
+	flag.DurationVar(&interval, "interval", time.Minute, "How often to run -command; also its timeout")
+	flag.StringVar(&tailMarker, "tail-marker", "", "Follow files that dumps are appended to, splitting them at lines matching this regular expression and diffing each new dump against the last")
+	flag.DurationVar(&stdinIdle, "stdin-idle", DefaultStdinIdle, "With -file -, how long standard input must pause after a complete line to end a table version")
+	flag.StringVar(&ignoreFields, "ignore-fields", "Age", "Comma separated route fields to ignore when hashing (empty to hash everything)")
+	flag.StringVar(&normalize, "normalize", "none", "Whitespace normalization before hashing: comma separated eol, trim, collapse, or all/none")
+	flag.StringVar(&hashName, "hash", string(DefaultHash), "Chunk hash algorithm: sha256, xxhash, blake3 or fnv")
+	flag.StringVar(&chunkerName, "chunker", ChunkByDestination, "How to split the table into routes: destination (\"Destination:\" blocks) or line (one route per unindented line)")
+	flag.IntVar(&maxLineBytes, "max-line-bytes", DefaultMaxLineBytes, "Longest line the table may contain")
+	flag.Var(&maxSize, "max-size", "Largest table file to hold in memory, e.g. 2G; larger files are handled as set by -oversize (0 for no limit)")
+	flag.StringVar(&oversize, "oversize", OversizeLean, "What to do with a file over -max-size: lean (keep only hashes and offsets in memory) or error (refuse to load it)")
+	flag.BoolVar(&lean, "lean", false, "Keep only hashes and byte offsets in memory and read chunk bodies from disk when needed")
+	flag.DurationVar(&progressInterval, "progress-interval", DefaultProgressInterval, "While a table takes longer than this to load, log the bytes read, routes parsed and estimated time left at this interval (0 disables)")
+	flag.BoolVar(&incremental, "incremental", false, "Keep a block hash index of the file and re-parse only changed regions")
+	flag.IntVar(&volatileAfter, "volatile-after", 5, "Mark chunks volatile after this many consecutive changed loads and stop reporting them (0 disables)")
+	flag.IntVar(&reportOpts.PreviewLimit, "preview-limit", 10, "Number of changed routes to list; larger change sets get a stratified preview")
+	flag.StringVar(&reportOpts.ChangesDir, "changes-dir", "", "Directory to write complete change sets to when only a preview is printed")
+	flag.StringVar(&reportOpts.Diff, "diff", DiffNone, "Diff printed under each listed change: none, fields, unified or side-by-side")
+	flag.StringVar(&tmpl, "template", "", "Go template printed for each changed route instead of the report, e.g. '{{.Timestamp}} {{.Destination}} {{.Type}}'; fields are those of a change plus Timestamp, Path and ChangeSet")
+	flag.BoolVar(&noColor, "no-color", false, "Don't color the report, even on a terminal (also set by the NO_COLOR environment variable)")
+	flag.StringVar(&tsFormat, "ts-format", DefaultTimeFormat, "Format of the timestamp on every change and change set: RFC3339, RFC3339Nano, RFC1123, DateTime, StampMilli or another Go time constant name, unix, unixmilli, or a Go layout such as \"2006-01-02 15:04:05\"")
+	flag.StringVar(&tz, "tz", DefaultTimeZone, "Time zone of report timestamps: UTC, Local or an IANA name such as Europe/Prague")
+	flag.StringVar(&logLevel, "log-level", "info", "Log messages at this level or above: debug, info, warn or error")
+	flag.StringVar(&logFormat, "log-format", LogText, "Format of log messages on standard error: text or json (with -output jsonl they are status events instead)")
+	flag.StringVar(&output, "output", OutputText, "Report format: text; json for one JSON object per loaded table and change set on standard output, with messages moved to standard error; jsonl for one line per loaded table, change, change set and message; yaml, like json with a YAML document per object; csv, a row per changed route; or protobuf, a length-delimited message per change set as in proto/changes.proto")
+	flag.IntVar(&diffCacheSize, "diff-cache-size", 1024, "Number of rendered diffs to cache")
+	flag.Var(&sinkSpecs, "sink", "Sink URL to deliver change sets to (repeatable)")
+	flag.Var(&filterExprs, "filter", `Expression a change must match to be reported and delivered, in a subset of CEL, e.g. change.type == "removed" && prefix.within("10.0.0.0/8") (repeatable, all must match)`)
+	flag.Var(&filterPlugins, "filter-plugin", "Plugin that can drop changes before they are reported and delivered: the name of a go-watcher-NAME program on $PATH, or its path, with its options as a query string, e.g. classify?mode=strict (repeatable)")
+	flag.StringVar(&journal, "journal", "auto", "Write every change to the systemd journal with its fields: on, off, or auto to do so when running as a systemd service (same as -sink journal://)")
+	flag.StringVar(&critical, "critical", DefaultCriticalRules, "Comma separated critical prefixes delivered without batching; append + to include more-specifics (e.g. 10.0.0.0/8+)")
+	flag.DurationVar(&batchWindow, "batch-window", 0, "Hold non-critical changes this long and deliver them to sinks as one change set (0 disables)")
+	flag.StringVar(&watchMode, "watch-mode", WatchAuto, "How to notice file changes: fsnotify, poll, or auto (poll on network and other filesystems where fsnotify is unreliable)")
+	flag.DurationVar(&pollInterval, "poll", 0, "Stat and hash the file at this interval instead of relying on fsnotify, e.g. on NFS or CIFS mounts (0 leaves it to -watch-mode)")
+	flag.DurationVar(&debounce, "debounce", 500*time.Millisecond, "Quiet period after the last file event before detecting changes (0 reacts to every event)")
+	flag.DurationVar(&debounceMax, "debounce-max", 0, "Extend the debounce while writes keep arriving, reporting at most this long after the first event (0 keeps a fixed debounce; at most -max-delay)")
+	flag.DurationVar(&maxDelay, "max-delay", DefaultMaxDelay, "Report file changes no later than this after the first event, even while writes continue (0 waits for a quiet period)")
+	flag.BoolVar(&watchMetadata, "watch-metadata", false, "Also react to mode, owner and timestamp changes, and report the file's metadata with every change set")
+	flag.DurationVar(&settle, "settle", 100*time.Millisecond, "Before detecting changes, wait until the file's size and mtime are unchanged across two samples this far apart, so half-written exports aren't parsed (0 disables)")
+	flag.BoolVar(&holdOnTruncate, "hold-on-truncate", false, "While the file is truncated to zero bytes, keep the previous table instead of reporting every route removed")
+	flag.DurationVar(&sweep, "sweep", 0, "Also re-hash the file at this interval and report changes fsnotify missed (0 disables)")
+	flag.IntVar(&workers, "workers", 1, "Change sets that may be in delivery at once before reloads wait")
+	flag.IntVar(&breakerFailures, "breaker-failures", 5, "Disable the target after this many consecutive parse or sink failures (0 never disables)")
+	flag.DurationVar(&breakerCooldown, "breaker-cooldown", time.Minute, "How long a disabled target waits before probing again")
+	flag.StringVar(&refsPath, "refs", "", "JSON file of ticket references (system, id, url, prefixes, from, until) to attach to matching changes")
+	flag.StringVar(&auditPath, "audit-log", "", "File to append every change set to as a JSON line, independent of the report and sinks")
+	flag.BoolVar(&auditSync, "audit-fsync", false, "Fsync the audit log after every change set")
+	flag.Var(&auditMaxSize, "audit-max-size", "Rotate the audit log once it would grow over this size, e.g. 100M (0 never rotates by size)")
+	flag.DurationVar(&auditMaxAge, "audit-max-age", 0, "Rotate the audit log once its first change set is this old, e.g. 24h (0 never rotates by age)")
+	flag.IntVar(&auditBackups, "audit-max-backups", DefaultAuditBackups, "Rotated audit logs to keep (0 keeps all)")
+	flag.StringVar(&onChangeExec, "on-change-exec", "", "Shell command to run for every change set, with the change set as JSON on its standard input and its key fields in GO_WATCHER_* environment variables (same as -sink exec://?command=...)")
+	flag.DurationVar(&onChangeExecTimeout, "on-change-exec-timeout", DefaultExecTimeout, "Time -on-change-exec may run before it is killed and the delivery fails")
+	flag.IntVar(&onChangeExecConcurrency, "on-change-exec-concurrency", DefaultExecConcurrency, "Runs of -on-change-exec at once")
+	flag.StringVar(&dlqDir, "dlq-dir", "", "Directory to keep failed sink deliveries in for \"dlq retry\"")
+	flag.StringVar(&outboxDir, "outbox-dir", "", "Directory to queue change sets in for each sink, so those made while a sink is down are delivered when it is back, even after a restart")
+	flag.DurationVar(&outboxRetention, "outbox-retention", DefaultOutboxRetention, "How long -outbox-dir keeps a change set a sink hasn't taken before moving it to -dlq-dir, or dropping it (0 keeps it forever)")
+	flag.IntVar(&outboxHighWater, "outbox-high-water", DefaultOutboxHighWater, "Change sets -outbox-dir keeps for a sink, beyond which the oldest are moved to -dlq-dir, or dropped (0 for no limit)")
+	flag.StringVar(&snapshotDir, "snapshot-dir", "", "Directory to save each table's chunk map to after loading and on exit; a table whose file is unchanged on the next start is loaded from it without parsing")
+	flag.StringVar(&httpAddr, "http-addr", "", "Address to serve a read-only web UI of the tables, their changes and routes on, e.g. :8080 (empty disables it)")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "OTLP/HTTP collector to export traces of table loads, change detection and sink deliveries to, e.g. http://collector:4318 (default $OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or $OTEL_EXPORTER_OTLP_ENDPOINT; empty disables tracing)")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Address to serve Prometheus metrics on at /metrics, e.g. :9100 (empty disables it; -http-addr serves them too)")
+	flag.BoolVar(&pprofOn, "pprof", false, "Serve CPU, heap and other profiles on /debug/pprof/ and runtime memory statistics on /debug/vars of -http-addr, which should then not be reachable by everyone")
+	flag.BoolVar(&graphQL, "graphql", false, "Serve GraphQL queries of the chunks, their fields and change history on /graphql of -http-addr")
+	flag.StringVar(&tlsCert, "tls-cert", "", "PEM certificate to serve -http-addr, -metrics-addr, -grpc-addr and -gnmi-addr over TLS with, read again when it changes (needs -tls-key)")
+	flag.StringVar(&tlsKey, "tls-key", "", "PEM private key of -tls-cert")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "PEM file of the CAs whose client certificates the APIs require, for mutual TLS (needs -tls-cert; the probes and page stay open)")
+	flag.StringVar(&authTokens, "auth-tokens", "", "File of static bearer tokens, one per line, optionally after a name, that the web UI, REST, GraphQL, WebSocket, gRPC and gNMI APIs require one of (empty leaves them open unless -oidc-issuer is set)")
+	flag.StringVar(&oidcIssuer, "oidc-issuer", "", "OpenID Connect issuer whose signed JWTs the APIs accept as bearer tokens, e.g. https://login.example.com/realms/netops")
+	flag.StringVar(&oidcAudience, "oidc-audience", "", "Audience JWTs from -oidc-issuer must be issued for (required with -oidc-issuer)")
+	flag.StringVar(&grpcAddr, "grpc-addr", "", "Address to serve the gowatcher.v1.Watcher gRPC API of proto/watcher.proto on, with gNMI, over gRPC (with TLS if -tls-cert is set), e.g. :9340 (empty disables it)")
+	flag.StringVar(&gnmiAddr, "gnmi-addr", "", "Address to serve the tables' routes and changes on as gNMI subscriptions, over gRPC (with TLS if -tls-cert is set), e.g. :9339 (empty disables it)")
+	flag.StringVar(&configPath, "config", "", "JSON file of option values by flag name, plus per-file settings under \"files\"; flags on the command line take precedence")
 	flag.Parse()
 
-	// Check if file argument was provided
-	if filePath == "" {
-		fmt.Fprintf(os.Stderr, "Error: -file argument is required\n\n")
+	var config *Config
+	if configPath != "" {
+		var err error
+		if config, err = LoadConfig(configPath); err == nil {
+			err = config.apply(flag.CommandLine)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := checkOutput(output); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if tmpl != "" {
+		if output != OutputText {
+			fmt.Fprintf(os.Stderr, "Error: -template can't be combined with -output %s\n", output)
+			os.Exit(1)
+		}
+		t, err := parseTemplate(tmpl)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -template: %v\n", err)
+			os.Exit(1)
+		}
+		reportOpts.Objects = newTemplateWriter(os.Stdout, t)
+	}
+	if output != OutputText {
+		reportOpts.Objects = newObjectWriter(os.Stdout, output)
+	}
+	level, err := parseLogLevel(logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	logLevelVar.Set(level)
+	logger, err := newLogger(os.Stderr, logFormat, &logLevelVar)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if output == OutputJSONL {
+		// Keep standard output to JSON lines
+		logger = slog.New(newStatusHandler(reportOpts.Objects, &logLevelVar))
+	}
+	slog.SetDefault(logger)
+	if reportOpts.Time, err = parseTimeFormat(tsFormat, tz); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if reportOpts.Objects != nil {
+		reportOpts.Objects.times = reportOpts.Time
+	}
+	reportOpts.Color = reportOpts.Objects == nil && colorEnabled(os.Stdout, noColor)
+
+	// Check that exactly one source was provided
+	var paths, patterns []string
+	for _, f := range files {
+		for _, p := range splitList(f) {
+			p = filepath.Clean(p)
+			switch {
+			case isGlob(p) && !slices.Contains(patterns, p):
+				patterns = append(patterns, p)
+			case !isGlob(p) && !slices.Contains(paths, p):
+				paths = append(paths, p)
+			}
+		}
+	}
+	if (len(paths)+len(patterns) == 0) == (command == "") {
+		fmt.Fprintf(os.Stderr, "Error: one of -file or -command is required\n\n")
 		flag.Usage()
 		os.Exit(1)
 	}
+	var source Source
+	var stream *StreamSource
+	if slices.Contains(paths, "-") && (len(paths) > 1 || len(patterns) > 0) {
+		fmt.Fprintf(os.Stderr, "Error: -file - can't be combined with other files\n")
+		os.Exit(1)
+	}
+	if command != "" {
+		if interval <= 0 {
+			fmt.Fprintf(os.Stderr, "Error: -interval must be positive\n")
+			os.Exit(1)
+		}
+		if lean || incremental {
+			fmt.Fprintf(os.Stderr, "Error: -lean and -incremental need a file and can't be used with -command\n")
+			os.Exit(1)
+		}
+		if tailMarker != "" {
+			fmt.Fprintf(os.Stderr, "Error: -tail-marker needs a file and can't be used with -command\n")
+			os.Exit(1)
+		}
+		source = &CommandSource{Command: command, Timeout: interval}
+		paths = []string{command}
+	} else if len(paths) == 1 && paths[0] == "-" {
+		if lean || incremental {
+			fmt.Fprintf(os.Stderr, "Error: -lean and -incremental need a file and can't be used with -file -\n")
+			os.Exit(1)
+		}
+		if tailMarker != "" {
+			fmt.Fprintf(os.Stderr, "Error: -tail-marker needs a file and can't be used with -file -\n")
+			os.Exit(1)
+		}
+		stream = NewStreamSource(os.Stdin)
+		stream.Idle = stdinIdle
+		source = stream
+		paths = []string{"stdin"}
+	} else {
+		for _, path := range paths {
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				slog.Error("file does not exist", "path", path)
+				os.Exit(1)
+			}
+		}
+	}
+	if tailMarker != "" {
+		if _, err := NewTailSource("", tailMarker); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -tail-marker: %v\n", err)
+			os.Exit(1)
+		}
+		if lean || incremental || sweep > 0 {
+			fmt.Fprintf(os.Stderr, "Error: -lean, -incremental and -sweep read the whole file and can't be used with -tail-marker\n")
+			os.Exit(1)
+		}
+	}
+	excludes, err := parseExclude(exclude)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -exclude: %v\n", err)
+		os.Exit(1)
+	}
+	if pollInterval > 0 {
+		if watchMode == WatchFsnotify {
+			fmt.Fprintf(os.Stderr, "Error: -poll can't be used with -watch-mode fsnotify\n")
+			os.Exit(1)
+		}
+		watchMode = WatchPoll
+	}
+	if (pprofOn || graphQL) && httpAddr == "" {
+		fmt.Fprintf(os.Stderr, "Error: -pprof and -graphql are served on -http-addr, which isn't set\n")
+		os.Exit(1)
+	}
+	if tracer, err = tracerFromEnv(otlpEndpoint); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -otlp-endpoint: %v\n", err)
+		os.Exit(1)
+	}
+	var serverTLSConfig *tls.Config
+	if tlsCert != "" || tlsKey != "" {
+		if serverTLSConfig, err = serverTLS(tlsCert, tlsKey, tlsClientCA); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -tls-cert: %v\n", err)
+			os.Exit(1)
+		}
+	} else if tlsClientCA != "" {
+		fmt.Fprintf(os.Stderr, "Error: -tls-client-ca needs -tls-cert and -tls-key\n")
+		os.Exit(1)
+	}
+	var auth *Authenticator
+	if authTokens != "" || oidcIssuer != "" || tlsClientCA != "" {
+		auth = &Authenticator{ClientCerts: tlsClientCA != ""}
+	}
+	if authTokens != "" {
+		if err := auth.LoadTokens(authTokens); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -auth-tokens: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if oidcIssuer != "" {
+		if u, err := url.Parse(oidcIssuer); err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+			fmt.Fprintf(os.Stderr, "Error: -oidc-issuer: invalid URL %q\n", oidcIssuer)
+			os.Exit(1)
+		}
+		if oidcAudience == "" {
+			fmt.Fprintf(os.Stderr, "Error: -oidc-issuer needs -oidc-audience\n")
+			os.Exit(1)
+		}
+		auth.OIDC = NewOIDCVerifier(oidcIssuer, oidcAudience)
+	}
 
-	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		fmt.Printf("Error: file %s does not exist\n", filePath)
+	// Validate the load options shared by every table
+	var opts LoadOptions
+	opts.IgnoreFields = splitList(ignoreFields)
+	steps, err := parseNormalize(normalize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -normalize: %v\n", err)
+		os.Exit(1)
+	}
+	opts.Normalize = steps
+	opts.Lean = lean
+	opts.MaxLineBytes = maxLineBytes
+	opts.MaxSize = int64(maxSize)
+	switch oversize {
+	case OversizeLean:
+	case OversizeError:
+		opts.RefuseOversize = true
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown -oversize %q (want lean or error)\n", oversize)
+		os.Exit(1)
+	}
+	if opts.Chunker, err = parseChunker(chunkerName); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -chunker: %v\n", err)
+		os.Exit(1)
+	}
+	opts.Incremental = incremental
+	if opts.Hash, err = parseHashAlgorithm(hashName); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -hash: %v\n", err)
+		os.Exit(1)
+	}
+	if err := checkDiff(reportOpts.Diff); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if reportOpts.Renderer, err = NewDiffRenderer(opts, diffCacheSize); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
+	var refs *RefFile
+	if refsPath != "" {
+		refs = &RefFile{Path: refsPath}
+		if _, err := refs.load(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -refs: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
-	// Create routing table
-	rt := NewDataTable(filePath)
-	
-	fmt.Println("Loading  table...")
-	start := time.Now()
-	if err := rt.LoadDataTable(); err != nil {
-		fmt.Printf("Error loading  table: %v\n", err)
+	switch journal {
+	case "on", "off", "auto":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown -journal %q (want on, off or auto)\n", journal)
+		os.Exit(1)
+	}
+	hasJournal := slices.ContainsFunc(sinkSpecs, func(s string) bool { return strings.HasPrefix(s, "journal:") })
+	if !hasJournal && (journal == "on" || journal == "auto" && underSystemd()) {
+		sinkSpecs = append(sinkSpecs, "journal://")
+	}
+	if onChangeExec != "" {
+		sinkSpecs = append(sinkSpecs, execSpec(onChangeExec, onChangeExecTimeout, onChangeExecConcurrency))
+	}
+	sinks, err := newSinks(sinkSpecs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -sink: %v\n", err)
+		os.Exit(1)
+	}
+	var filters []Enricher
+	for _, src := range filterExprs {
+		f, err := newExprFilter(src)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -filter: %v\n", err)
+			os.Exit(1)
+		}
+		filters = append(filters, f)
+	}
+	for _, spec := range filterPlugins {
+		f, err := newPluginFilter(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -filter-plugin: %v\n", err)
+			os.Exit(1)
+		}
+		filters = append(filters, f)
+	}
+	var dlq *DeadLetterQueue
+	if dlqDir != "" {
+		if dlq, err = OpenDeadLetterQueue(dlqDir); err != nil {
+			slog.Error("failed to open dead-letter queue", "err", err)
+			os.Exit(1)
+		}
+	}
+	router := NewRouter(sinks)
+	if err := router.Configure(config.routing()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -config: %v\n", err)
+		os.Exit(1)
+	}
+	for i, s := range sinks {
+		sinks[i] = router.Route(s)
+	}
+	var outboxes []*OutboxSink
+	if outboxDir != "" {
+		for i, s := range sinks {
+			o, err := NewOutboxSink(s, outboxPath(outboxDir, s), dlq)
+			if err != nil {
+				slog.Error("failed to open outbox", "sink", s.Name(), "err", err)
+				os.Exit(1)
+			}
+			o.Retention, o.HighWater = outboxRetention, outboxHighWater
+			sinks[i] = o
+			outboxes = append(outboxes, o)
+		}
+	}
+	var audit *AuditLog
+	if auditPath != "" {
+		if audit, err = OpenAuditLog(auditPath); err != nil {
+			slog.Error("failed to open audit log", "err", err)
+			os.Exit(1)
+		}
+		audit.Sync = auditSync
+		audit.MaxSize = int64(auditMaxSize)
+		audit.MaxAge = auditMaxAge
+		audit.MaxBackups = auditBackups
+		defer audit.Close()
+	}
+	var feed *ChangeFeed
+	if httpAddr != "" || gnmiAddr != "" || grpcAddr != "" {
+		feed = NewChangeFeed(DefaultFeedSize)
+	}
+	dispatcher := NewDispatcher(sinks, dlq)
+	dispatcher.BatchWindow = batchWindow
+	if dispatcher.Priority, err = parsePrefixRules(critical); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -critical: %v\n", err)
 		os.Exit(1)
 	}
-	loadDuration := time.Since(start)
-	fmt.Printf("Loaded in %v\n", loadDuration)
 
-	// Setup file watcher
-	onChange := func() {
-		fmt.Println("\n[File Change Detected] Detecting changes...")
+	// Cancel loads and reloads in progress on Ctrl+C or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	for _, o := range outboxes {
+		go o.Run(ctx)
+	}
+	if tracer != nil {
+		go tracer.Run(ctx)
+	}
+	
+	// Wait for the first table on standard input before loading it
+	var versions chan []byte
+	if stream != nil {
+		versions = make(chan []byte)
+		go func() {
+			if err := stream.Read(ctx, versions); err != nil && ctx.Err() == nil {
+				slog.Error("failed to read standard input", "err", err)
+			}
+		}()
+		slog.Info("waiting for a table on standard input")
+		select {
+		case first, ok := <-versions:
+			if !ok {
+				fmt.Fprintf(os.Stderr, "Error: no table on standard input\n")
+				os.Exit(1)
+			}
+			stream.Set(first)
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	// Each file gets its own table and target; they share the sinks. The
+	// config is replaced on SIGHUP while files matching a pattern may be
+	// opened.
+	var configMu sync.Mutex
+	set := newWatchSet(func(ctx context.Context, path string) (*watchedFile, error) {
+		rt := NewDataTable(path)
+		rt.Options = opts
+		if volatileAfter > 0 {
+			rt.Volatile = NewVolatileTracker(volatileAfter)
+		}
+		if progressInterval > 0 {
+			rt.OnProgress = logProgress
+			rt.ProgressInterval = progressInterval
+		}
+
+		slog.Info("loading table", "path", path)
 		start := time.Now()
-		changed, err := rt.DetectChanges()
+		var err error
+		source := source
+		if tailMarker != "" {
+			source, _ = NewTailSource(path, tailMarker)
+		}
+		var snap string
+		switch {
+		case source != nil:
+			err = source.Load(ctx, rt)
+		case snapshotDir != "":
+			snap = snapshotPath(snapshotDir, path)
+			err = loadWithSnapshot(ctx, rt, snap)
+		default:
+			err = rt.LoadDataTable(ctx)
+		}
 		if err != nil {
-			fmt.Printf("Error detecting changes: %v\n", err)
-			return
+			return nil, fmt.Errorf("failed to load %s: %w", path, err)
 		}
-		detectDuration := time.Since(start)
-		
-		if len(changed) == 0 {
-			fmt.Printf("No changes detected (checked in %v)\n", detectDuration)
-		} else {
-			fmt.Printf("Found %d changed routes (detected in %v):\n", len(changed), detectDuration)
-			// Show first 10 changed routes
-			maxShow := 10
-			if len(changed) < maxShow {
-				maxShow = len(changed)
+		if reportOpts.Objects != nil {
+			if err := reportOpts.Objects.loaded(rt.FilePath, len(rt.Chunks), time.Since(start)); err != nil {
+				slog.Error("failed to write report", "err", err)
+			}
+		}
+		slog.Info("loaded table", "path", rt.FilePath, "routes", len(rt.Chunks), "took", time.Since(start))
+
+		target := NewTarget(path, rt, dispatcher)
+		configMu.Lock()
+		target.Report = reportOpts
+		configMu.Unlock()
+		target.Workers = workers
+		target.Snapshot = snap
+		target.Audit = audit
+		target.Feed = feed
+		target.Breaker = NewCircuitBreaker(breakerFailures, breakerCooldown)
+		target.Command = source
+		target.WatchMetadata = watchMetadata && (source == nil || tailMarker != "")
+		target.Settle = settle
+		target.HoldOnTruncate = holdOnTruncate
+		target.Enrichers = append(target.Enrichers, filters...)
+		if refs != nil {
+			target.Enrichers = append(target.Enrichers, refs)
+		}
+		target.Start(ctx)
+		w := &watchedFile{target: target}
+		if source != nil && tailMarker == "" {
+			return w, nil
+		}
+		configMu.Lock()
+		d, dm, md := config.debounce(path, debounce), config.debounceMax(path, debounceMax), config.maxDelay(path, maxDelay)
+		configMu.Unlock()
+		if err := w.watch(ctx, watchMode, pollInterval, sweep, d, dm, md); err != nil {
+			return nil, err
+		}
+		return w, nil
+	})
+	// The web UI is ready for traffic once the files named at startup are
+	// loaded
+	var ready atomic.Bool
+	if httpAddr != "" {
+		ln, err := net.Listen("tcp", httpAddr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -http-addr: %v\n", err)
+			os.Exit(1)
+		}
+		srv := &http.Server{
+			Handler:           (&WebUI{Targets: set.targets, Feed: feed, GraphQL: graphQL, Debug: pprofOn, Dispatcher: dispatcher, Ready: ready.Load, Auth: auth}).Handler(),
+			ReadHeaderTimeout: 10 * time.Second,
+			TLSConfig:         serverTLSConfig,
+		}
+		go func() {
+			if err := serveHTTP(srv, ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("web UI stopped", "addr", httpAddr, "err", err)
 			}
-			for i := 0; i < maxShow; i++ {
-				fmt.Printf("  - %s\n", changed[i])
+		}()
+		defer srv.Close()
+		slog.Info("serving web UI", "addr", httpAddr)
+	}
+	if metricsAddr != "" {
+		ln, err := net.Listen("tcp", metricsAddr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -metrics-addr: %v\n", err)
+			os.Exit(1)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /metrics", serveMetrics)
+		srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second, TLSConfig: serverTLSConfig}
+		go func() {
+			if err := serveHTTP(srv, ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("metrics server stopped", "addr", metricsAddr, "err", err)
+			}
+		}()
+		defer srv.Close()
+		slog.Info("serving metrics", "addr", metricsAddr)
+	}
+	if gnmiAddr != "" {
+		ln, err := net.Listen("tcp", gnmiAddr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -gnmi-addr: %v\n", err)
+			os.Exit(1)
+		}
+		srv := &http.Server{
+			Handler:           auth.GRPC((&GNMIServer{Targets: set.targets, Feed: feed}).Handler()),
+			Protocols:         grpcProtocols(serverTLSConfig != nil),
+			ReadHeaderTimeout: 10 * time.Second,
+			TLSConfig:         serverTLSConfig,
+		}
+		go func() {
+			if err := serveHTTP(srv, ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("gNMI server stopped", "addr", gnmiAddr, "err", err)
 			}
-			if len(changed) > maxShow {
-				fmt.Printf("  ... and %d more\n", len(changed)-maxShow)
+		}()
+		defer srv.Close()
+		slog.Info("serving gNMI", "addr", gnmiAddr)
+	}
+	if grpcAddr != "" {
+		ln, err := net.Listen("tcp", grpcAddr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -grpc-addr: %v\n", err)
+			os.Exit(1)
+		}
+		srv := &http.Server{
+			Handler:           auth.GRPC(grpcHandler(set.targets, feed)),
+			Protocols:         grpcProtocols(serverTLSConfig != nil),
+			ReadHeaderTimeout: 10 * time.Second,
+			TLSConfig:         serverTLSConfig,
+		}
+		go func() {
+			if err := serveHTTP(srv, ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("gRPC server stopped", "addr", grpcAddr, "err", err)
 			}
+		}()
+		defer srv.Close()
+		slog.Info("serving gRPC", "addr", grpcAddr)
+	}
+	for _, path := range paths {
+		if err := set.add(ctx, path, ""); err != nil {
+			slog.Error("failed to watch file", "err", err)
+			os.Exit(1)
 		}
 	}
+	ready.Store(true)
 
-	watcher, err := NewFileWatcher(filePath, onChange, 500*time.Millisecond)
+	// On SIGHUP, re-read the command line and config file, apply what can
+	// change while running, and re-chunk the tables straight away
+	snapshot, _, err := snapshotFlags(flag.CommandLine, os.Args[1:])
 	if err != nil {
-		fmt.Printf("Error creating file watcher: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
-	defer watcher.Close()
+	// The reloadable flags are only updated once a reload has been checked,
+	// under configMu as files matching a pattern read them
+	live := liveSettings{
+		debounce: debounce, debounceMax: debounceMax, maxDelay: maxDelay, batchWindow: batchWindow,
+		critical: critical, diff: reportOpts.Diff, logLevel: logLevel, previewLimit: reportOpts.PreviewLimit,
+	}
+	applyLive := func(cfg *Config, next liveSettings) error {
+		files := set.list()
+		for _, w := range files {
+			path := w.target.Name
+			if err := checkDebounce(cfg.debounce(path, next.debounce), cfg.debounceMax(path, next.debounceMax), cfg.maxDelay(path, next.maxDelay)); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		}
+		if err := checkDiff(next.diff); err != nil {
+			return err
+		}
+		level, err := parseLogLevel(next.logLevel)
+		if err != nil {
+			return err
+		}
+		priority, err := parsePrefixRules(next.critical)
+		if err != nil {
+			return fmt.Errorf("-critical: %w", err)
+		}
+		if err := router.Configure(cfg.routing()); err != nil {
+			return err
+		}
+		configMu.Lock()
+		config = cfg
+		debounce, debounceMax, maxDelay, batchWindow = next.debounce, next.debounceMax, next.maxDelay, next.batchWindow
+		critical, logLevel = next.critical, next.logLevel
+		reportOpts.Diff, reportOpts.PreviewLimit = next.diff, next.previewLimit
+		report := reportOpts
+		configMu.Unlock()
+		live = next
+		logLevelVar.Set(level)
+		for _, w := range files {
+			path := w.target.Name
+			if w.coalescer != nil {
+				w.coalescer.Configure(cfg.debounce(path, next.debounce), cfg.debounceMax(path, next.debounceMax), cfg.maxDelay(path, next.maxDelay))
+			}
+			w.target.SetReport(report)
+		}
+		dispatcher.Configure(priority, next.batchWindow)
+		return nil
+	}
+	reload := func() {
+		slog.Info("SIGHUP received; reloading configuration")
+		next := live
+		snap, cfg, restart, err := reloadFlags(flag.CommandLine, next.flags(), os.Args[1:], snapshot)
+		if err == nil {
+			err = applyLive(cfg, next)
+		}
+		if err != nil {
+			slog.Error("failed to reload configuration", "err", err)
+		} else {
+			snapshot = snap
+			for _, name := range restart {
+				slog.Warn("option changed; restart to apply it", "flag", "-"+name)
+			}
+		}
+		for _, t := range set.targets() {
+			t.Reload()
+		}
+	}
 
-	if err := watcher.Start(); err != nil {
-		fmt.Printf("Error starting file watcher: %v\n", err)
-		os.Exit(1)
+	if stream != nil {
+		// Diff each further version as it is read, and stop once the
+		// input ends
+		target := set.targets()[0]
+		target.setMechanism("stdin")
+		handleHangup(ctx, reload)
+		slog.Info("reading table versions from standard input (press Ctrl+C to exit)")
+	read:
+		for {
+			select {
+			case <-ctx.Done():
+				break read
+			case version, ok := <-versions:
+				if !ok {
+					break read
+				}
+				stream.Set(version)
+				target.reload(ctx)
+			}
+		}
+		shutdown(dispatcher, set.targets()...)
+		return
+	}
+	if source != nil {
+		target := set.targets()[0]
+		target.setMechanism("command")
+		target.Poll(ctx, interval)
+		handleHangup(ctx, reload)
+		slog.Info("running command (press Ctrl+C to exit)", "command", command, "interval", interval)
+		<-ctx.Done()
+		shutdown(dispatcher, set.targets()...)
+		return
+	}
+
+	// Pick up files matching a pattern as they appear, and drop them when
+	// they go away
+	for _, pattern := range patterns {
+		gw, err := NewGlobWatcher(pattern, debounce)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -file: %v\n", err)
+			os.Exit(1)
+		}
+		gw.Interval = pollInterval
+		gw.Exclude = excludes
+		gw.OnAdd = func(path string) error {
+			err := set.add(ctx, path, pattern)
+			if err != nil {
+				slog.Error("failed to watch file", "path", path, "err", err)
+			}
+			return err
+		}
+		gw.OnRemove = set.remove
+		defer gw.Close()
+		gw.Start(ctx)
 	}
+	handleHangup(ctx, reload)
 
-	fmt.Printf("Watching %s for changes... (press Ctrl+C to exit)\n", filePath)
+	slog.Info("watching for changes (press Ctrl+C to exit)", "paths", strings.Join(append(paths, patterns...), ", "))
 	
 	// Keep program running
-	select {}
+	<-ctx.Done()
+	shutdown(dispatcher, set.targets()...)
+}
+
+// loadWithSnapshot loads rt from the snapshot at snap if the file hasn't
+// changed since it was saved, and otherwise from the file, saving a new
+// snapshot
+func loadWithSnapshot(ctx context.Context, rt *DataTable, snap string) error {
+	used, err := rt.LoadSnapshot(snap)
+	if errors.Is(err, ErrTooLarge) {
+		return err
+	}
+	if err != nil {
+		slog.Warn("ignoring snapshot", "err", err)
+	}
+	if used {
+		slog.Info("table unchanged since its snapshot; skipped parsing it", "path", rt.FilePath, "snapshot", snap)
+		return nil
+	}
+	if err := rt.LoadDataTable(ctx); err != nil {
+		return err
+	}
+	if err := rt.SaveSnapshot(snap); err != nil {
+		slog.Warn("failed to save snapshot", "err", err)
+	}
+	return nil
 }
 
+// shutdownTimeout bounds how long deliveries in flight and the final flush
+// may take once the watcher is stopping
+const shutdownTimeout = 10 * time.Second
+
+// shutdown waits for deliveries in flight and flushes batched changes so
+// nothing detected before the signal is lost, and saves the tables'
+// snapshots
+func shutdown(dispatcher *Dispatcher, targets ...*Target) {
+	slog.Info("shutting down")
+	for _, t := range targets {
+		t.Wait()
+		if t.Snapshot == "" {
+			continue
+		}
+		if err := t.Table.SaveSnapshot(t.Snapshot); err != nil {
+			slog.Warn("failed to save snapshot", "err", err)
+		}
+	}
+	// The signal context is done; give the final flush its own deadline
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	dispatcher.Flush(ctx)
+	if tracer != nil {
+		if err := tracer.Flush(ctx); err != nil {
+			slog.Warn("failed to export traces", "err", err)
+		}
+	}
+}
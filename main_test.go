@@ -1,7 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -102,3 +109,312 @@ func TestHashingVsParsing(t *testing.T) {
 	t.Logf("Hashing is %.2fx faster", parseDuration.Seconds()/hashDuration.Seconds())
 }
 
+// BenchmarkSuite runs the bench command's cases as sub-benchmarks, e.g.
+// go test -bench 'Suite/load/line' -run '^$'
+func BenchmarkSuite(b *testing.B) {
+	for _, n := range []int{10000, 100000, 1000000} {
+		if n > 100000 && testing.Short() {
+			continue
+		}
+		fixtures := make(map[string][]byte)
+		for _, c := range benchCases() {
+			fixture, ok := fixtures[c.chunker]
+			if !ok {
+				var buf bytes.Buffer
+				if err := generateTable(&buf, n, c.chunker, 0); err != nil {
+					b.Fatal(err)
+				}
+				fixture = buf.Bytes()
+				fixtures[c.chunker] = fixture
+			}
+			b.Run(fmt.Sprintf("%s/%s/%s/%d", c.name, c.chunker, c.hash, n), func(b *testing.B) {
+				path := filepath.Join(b.TempDir(), "table.txt")
+				if err := os.WriteFile(path, fixture, 0o644); err != nil {
+					b.Fatal(err)
+				}
+				benchChunker, benchHash = c.chunker, c.hash
+				c.fn(b, fixture, path)
+			})
+		}
+	}
+}
+
+// routeBlock renders a route entry in the same layout as the sample above
+func routeBlock(dest, protocol, nextHop string) string {
+	return fmt.Sprintf(`Destination: %s
+     Protocol: %s               Process ID: 0
+   Preference: 255                      Cost: 0
+      NextHop: %s      Neighbour: %s
+        State: Active Adv Relied         Age: 27d02h01m21s`, dest, protocol, nextHop, nextHop)
+}
+
+// writeTable writes the given route blocks to a temporary table file and
+// returns its path
+func writeTable(t testing.TB, blocks ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "table.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(blocks, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// loadTable loads a table file written by writeTable
+func loadTable(t testing.TB, path string) *DataTable {
+	t.Helper()
+	rt := NewDataTable(path)
+	if err := rt.LoadDataTable(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return rt
+}
+
+// rewriteFile replaces old with new in the file at path
+func rewriteFile(t testing.TB, path, old, new string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(strings.ReplaceAll(string(data), old, new)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileWatcherAtomicSave(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	block := routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1")
+	if err := os.WriteFile("table.txt", []byte(block), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A relative path with a ./ prefix still matches the event names
+	var changes atomic.Int32
+	fw, err := NewFileWatcher("./table.txt", func() { changes.Add(1) }, 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+
+	saves := map[string]func(){
+		// rsync and most libraries: write a temp file, rename it over ours
+		"rename over": func() {
+			if err := os.WriteFile(".table.txt.tmp", []byte(block+"\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(".table.txt.tmp", "table.txt"); err != nil {
+				t.Fatal(err)
+			}
+		},
+		// vim: move ours aside as a backup, write a new file
+		"move aside": func() {
+			if err := os.Rename("table.txt", "table.txt~"); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile("table.txt", []byte(block), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			os.Remove("table.txt~")
+		},
+	}
+	for _, name := range []string{"rename over", "move aside"} {
+		before := changes.Load()
+		saves[name]()
+		waitFor(t, name, func() bool { return changes.Load() > before })
+		time.Sleep(60 * time.Millisecond)
+		if n := changes.Load() - before; n != 1 {
+			t.Errorf("%s reported %d times", name, n)
+		}
+	}
+
+	// Removing the file reports nothing until it is back
+	before := changes.Load()
+	if err := os.Remove("table.txt"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if n := changes.Load() - before; n != 0 {
+		t.Errorf("removal reported %d times", n)
+	}
+	if err := os.WriteFile("table.txt", []byte(block), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "recreation", func() bool { return changes.Load() > before })
+}
+
+func TestFileWatcherRearm(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	var changes atomic.Int32
+	fw, err := NewFileWatcher(path, func() { changes.Add(1) }, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.rearmInterval = 5 * time.Millisecond
+	errs := make(chan error, 10)
+	fw.OnError = func(err error) { errs <- err }
+	if err := fw.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+
+	data, _ := os.ReadFile(path)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "removal", func() bool {
+		fw.mu.Lock()
+		defer fw.mu.Unlock()
+		return fw.missing
+	})
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "recreation", func() bool { return changes.Load() == 1 })
+	time.Sleep(40 * time.Millisecond)
+	if n := changes.Load(); n != 1 {
+		t.Errorf("recreation reported %d times", n)
+	}
+
+	// The removal went to OnError rather than stdout
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrFileMissing) {
+			t.Errorf("error = %v, want ErrFileMissing", err)
+		}
+	default:
+		t.Error("removal not reported to OnError")
+	}
+
+	// Changes to the new file are still seen
+	rewriteFile(t, path, "172.31.0.1", "172.31.0.2")
+	waitFor(t, "modification", func() bool { return changes.Load() == 2 })
+}
+
+func TestFileWatcherDirRecreated(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tables")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "table.txt")
+	data := []byte(routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var changes atomic.Int32
+	fw, err := NewFileWatcher(path, func() { changes.Add(1) }, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.rearmInterval = 5 * time.Millisecond
+	if err := fw.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+
+	// Move the directory aside, as a deploy swapping in a new release does
+	if err := os.Rename(dir, dir+".old"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "directory removal", func() bool {
+		fw.mu.Lock()
+		defer fw.mu.Unlock()
+		return fw.dirLost
+	})
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "directory watch", func() bool {
+		fw.mu.Lock()
+		defer fw.mu.Unlock()
+		return !fw.dirLost
+	})
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "recreation", func() bool { return changes.Load() == 1 })
+
+	rewriteFile(t, path, "172.31.0.1", "172.31.0.2")
+	waitFor(t, "modification", func() bool { return changes.Load() == 2 })
+}
+
+func TestFileWatcherNoDebounce(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	var changes atomic.Int32
+	fw, err := NewFileWatcher(path, func() { changes.Add(1) }, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+
+	rewriteFile(t, path, "172.31.0.1", "172.31.0.2")
+	waitFor(t, "change", func() bool { return changes.Load() >= 1 })
+}
+
+func TestFileWatcherMaxWait(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	var changes atomic.Int32
+	fw, err := NewFileWatcher(path, func() { changes.Add(1) }, 30*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Coalescer.MaxWait = 100 * time.Millisecond
+	if err := fw.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+
+	// Writes that never leave a quiet period are still reported
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for start := time.Now(); time.Since(start) < 400*time.Millisecond; {
+		f.WriteString("\n")
+		time.Sleep(5 * time.Millisecond)
+	}
+	if changes.Load() == 0 {
+		t.Error("no change reported during continuous writes")
+	}
+}
+
+func TestFileWatcherRestart(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	var changes atomic.Int32
+	fw, err := NewFileWatcher(path, func() { changes.Add(1) }, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.restartBackoff = 20 * time.Millisecond
+	errs := make(chan error, 10)
+	fw.OnError = func(err error) { errs <- err }
+	if err := fw.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+
+	// Kill the fsnotify watcher behind the FileWatcher's back
+	fw.fsWatcher().Close()
+	if err := <-errs; !errors.Is(err, ErrWatcherClosed) {
+		t.Fatalf("error = %v", err)
+	}
+	if h := fw.Health(); h.Healthy {
+		t.Errorf("health after the event stream ended = %+v", h)
+	}
+
+	// It is rebuilt, re-checks the file and sees later changes
+	waitFor(t, "restart", func() bool { return fw.Health().Healthy })
+	if h := fw.Health(); h.Restarts != 1 || h.Error != "" {
+		t.Errorf("health = %+v", h)
+	}
+	waitFor(t, "check after restart", func() bool { return changes.Load() == 1 })
+	rewriteFile(t, path, "172.31.0.1", "172.31.0.2")
+	waitFor(t, "modification", func() bool { return changes.Load() == 2 })
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counter is a monotonically increasing metric
+type Counter struct {
+	v atomic.Int64
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() { c.v.Add(1) }
+
+// Add adds n to the counter
+func (c *Counter) Add(n int64) { c.v.Add(n) }
+
+// Value returns the current count
+func (c *Counter) Value() int64 { return c.v.Load() }
+
+// Gauge is a metric that can go up and down
+type Gauge struct {
+	v atomic.Int64
+}
+
+// Set sets the gauge to n
+func (g *Gauge) Set(n int64) { g.v.Store(n) }
+
+// Add adds n (which may be negative) to the gauge
+func (g *Gauge) Add(n int64) { g.v.Add(n) }
+
+// Value returns the current value
+func (g *Gauge) Value() int64 { return g.v.Load() }
+
+// DurationBuckets are the upper bounds, in seconds, of the buckets of
+// duration histograms: Prometheus' defaults, stretched to cover loading
+// tables of millions of routes
+var DurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// Histogram counts observations in buckets, as Prometheus histograms do
+type Histogram struct {
+	bounds []float64
+	// counts are per bucket, not cumulative; the last is above every
+	// bound
+	counts []atomic.Int64
+	count  atomic.Int64
+	// sum holds the bits of a float64
+	sum atomic.Uint64
+}
+
+func newHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]atomic.Int64, len(bounds)+1)}
+}
+
+// Observe records a value
+func (h *Histogram) Observe(v float64) {
+	i, _ := slices.BinarySearch(h.bounds, v)
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// ObserveDuration records a duration in seconds
+func (h *Histogram) ObserveDuration(d time.Duration) { h.Observe(d.Seconds()) }
+
+// Count returns the number of observations
+func (h *Histogram) Count() int64 { return h.count.Load() }
+
+// metricKey identifies one labelled series of a metric
+type metricKey struct {
+	name   string
+	labels string
+}
+
+// Registry holds the process metrics. Series are created on first use.
+type Registry struct {
+	mu       sync.Mutex
+	help     map[string]string
+	counters map[metricKey]*Counter
+	gauges   map[metricKey]*Gauge
+	histos   map[metricKey]*Histogram
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		help:     make(map[string]string),
+		counters: make(map[metricKey]*Counter),
+		gauges:   make(map[metricKey]*Gauge),
+		histos:   make(map[metricKey]*Histogram),
+	}
+}
+
+// metrics is the registry used throughout the process
+var metrics = NewRegistry()
+
+// Counter returns the counter series for name with the given label
+// name/value pairs, creating it if needed
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.help[name] = help
+	key := metricKey{name, formatLabels(labels)}
+	c, ok := r.counters[key]
+	if !ok {
+		c = &Counter{}
+		r.counters[key] = c
+	}
+	return c
+}
+
+// Gauge returns the gauge series for name with the given label name/value
+// pairs, creating it if needed
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.help[name] = help
+	key := metricKey{name, formatLabels(labels)}
+	g, ok := r.gauges[key]
+	if !ok {
+		g = &Gauge{}
+		r.gauges[key] = g
+	}
+	return g
+}
+
+// Histogram returns the histogram series for name with the given label
+// name/value pairs, creating it with buckets bounded by bounds if needed
+func (r *Registry) Histogram(name, help string, bounds []float64, labels ...string) *Histogram {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.help[name] = help
+	key := metricKey{name, formatLabels(labels)}
+	h, ok := r.histos[key]
+	if !ok {
+		h = newHistogram(bounds)
+		r.histos[key] = h
+	}
+	return h
+}
+
+// Sample is one series value read from the registry
+type Sample struct {
+	Name   string
+	Labels string
+	Value  int64
+}
+
+// Snapshot returns the current value of every series, ordered by name
+func (r *Registry) Snapshot() []Sample {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []Sample
+	for k, c := range r.counters {
+		out = append(out, Sample{k.name, k.labels, c.Value()})
+	}
+	for k, g := range r.gauges {
+		out = append(out, Sample{k.name, k.labels, g.Value()})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Name != out[j].Name {
+			return out[i].Name < out[j].Name
+		}
+		return out[i].Labels < out[j].Labels
+	})
+	return out
+}
+
+// formatLabels renders name/value pairs as `a="x",b="y"`
+func formatLabels(labels []string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+// WritePrometheus writes every series in the Prometheus text format
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	type series struct {
+		labels string
+		write  func(bw *bufio.Writer, name, labels string)
+	}
+	r.mu.Lock()
+	kinds := make(map[string]string)
+	byName := make(map[string][]series)
+	for k, c := range r.counters {
+		kinds[k.name] = "counter"
+		v := c.Value()
+		byName[k.name] = append(byName[k.name], series{k.labels, func(bw *bufio.Writer, name, labels string) {
+			fmt.Fprintf(bw, "%s%s %d\n", name, braced(labels), v)
+		}})
+	}
+	for k, g := range r.gauges {
+		kinds[k.name] = "gauge"
+		v := g.Value()
+		byName[k.name] = append(byName[k.name], series{k.labels, func(bw *bufio.Writer, name, labels string) {
+			fmt.Fprintf(bw, "%s%s %d\n", name, braced(labels), v)
+		}})
+	}
+	for k, h := range r.histos {
+		kinds[k.name] = "histogram"
+		counts := make([]int64, len(h.counts))
+		for i := range h.counts {
+			counts[i] = h.counts[i].Load()
+		}
+		count, sum := h.count.Load(), math.Float64frombits(h.sum.Load())
+		byName[k.name] = append(byName[k.name], series{k.labels, func(bw *bufio.Writer, name, labels string) {
+			var cum int64
+			for i, n := range counts {
+				cum += n
+				le := "+Inf"
+				if i < len(h.bounds) {
+					le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+				}
+				fmt.Fprintf(bw, "%s_bucket{%s} %d\n", name, joinLabels(labels, `le="`+le+`"`), cum)
+			}
+			fmt.Fprintf(bw, "%s_sum%s %s\n", name, braced(labels), strconv.FormatFloat(sum, 'g', -1, 64))
+			fmt.Fprintf(bw, "%s_count%s %d\n", name, braced(labels), count)
+		}})
+	}
+	help := make(map[string]string, len(kinds))
+	for name := range kinds {
+		help[name] = r.help[name]
+	}
+	r.mu.Unlock()
+
+	names := make([]string, 0, len(kinds))
+	for name := range kinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		fmt.Fprintf(bw, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help[name]))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, kinds[name])
+		list := byName[name]
+		sort.Slice(list, func(i, j int) bool { return list[i].labels < list[j].labels })
+		for _, s := range list {
+			s.write(bw, name, s.labels)
+		}
+	}
+	return bw.Flush()
+}
+
+// braced returns labels in braces, or nothing if there are none
+func braced(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+// joinLabels joins two formatted label lists
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+// processStart is when the process started, for process_start_time_seconds
+var processStart = time.Now()
+
+// serveMetrics serves the process metrics for Prometheus to scrape
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.Gauge("go_goroutines", "Goroutines that currently exist").Set(int64(runtime.NumGoroutine()))
+	metrics.Gauge("process_start_time_seconds", "Start time of the process since the Unix epoch, in seconds").Set(processStart.Unix())
+	if err := metrics.WritePrometheus(w); err != nil {
+		slog.Debug("failed to write metrics", "err", err)
+	}
+}
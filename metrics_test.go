@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("sink_delivery_failures_total", "Change sets sinks failed to accept", "sink", `web"hook`).Add(2)
+	r.Gauge("watched_files", "Table files being watched").Set(3)
+	h := r.Histogram("table_load_seconds", "Time taken to load a table", []float64{0.1, 1}, "path", "core.txt")
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.ObserveDuration(2 * time.Second)
+
+	var b strings.Builder
+	if err := r.WritePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP sink_delivery_failures_total Change sets sinks failed to accept
+# TYPE sink_delivery_failures_total counter
+sink_delivery_failures_total{sink="web\"hook"} 2
+# HELP table_load_seconds Time taken to load a table
+# TYPE table_load_seconds histogram
+table_load_seconds_bucket{path="core.txt",le="0.1"} 1
+table_load_seconds_bucket{path="core.txt",le="1"} 2
+table_load_seconds_bucket{path="core.txt",le="+Inf"} 3
+table_load_seconds_sum{path="core.txt"} 2.55
+table_load_seconds_count{path="core.txt"} 3
+# HELP watched_files Table files being watched
+# TYPE watched_files gauge
+watched_files 3
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"), routeBlock("0.0.0.0/0", "Static", "172.31.0.254"))
+	loaded := metrics.Counter("chunks_loaded_total", "", "path", path)
+	before := loaded.Value()
+	loadTable(t, path)
+	if n := loaded.Value() - before; n != 2 {
+		t.Errorf("chunks_loaded_total went up by %d, want 2", n)
+	}
+
+	w := httptest.NewRecorder()
+	serveMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE table_load_seconds histogram\n",
+		`table_load_seconds_count{path="` + path + `"} 1`,
+		"# TYPE go_goroutines gauge\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics don't contain %q", want)
+		}
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %s", ct)
+	}
+}
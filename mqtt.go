@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMQTTTimeout bounds the publishing of a change set, including
+// waiting for the broker's acknowledgements
+const DefaultMQTTTimeout = 10 * time.Second
+
+// mqttWindow is the number of messages sent before waiting for their
+// acknowledgements
+const mqttWindow = 100
+
+// MQTT control packet types
+const (
+	mqttConnect = 1
+	mqttConnAck = 2
+	mqttPublish = 3
+	mqttPubAck  = 4
+	mqttPubRec  = 5
+	mqttPubRel  = 6
+	mqttPubComp = 7
+)
+
+func init() {
+	sinkFactories["mqtt"] = func(u *url.URL) (Sink, error) {
+		return newMQTTSink(u)
+	}
+}
+
+// MQTTSink publishes every change to an MQTT broker, speaking MQTT 3.1.1.
+// The change event, as -output jsonl writes it, goes on
+// <topic>/<source>/<type>, where source is the table file's base name up
+// to its extension. With retain set, the route's current state, as
+// /api/chunks gives it, is also kept on <topic>/<source>/routes/<dest> as
+// a retained message, and cleared when the route is removed, so a client
+// subscribing later learns the routes that have changed since. The spec
+// is mqtt://[user@]broker[:1883], or mqtt+tls://broker[:8883], with these
+// parameters:
+//
+//	topic                topic prefix (default go-watcher)
+//	qos                  0, 1 (the default) or 2
+//	retain               true to keep the routes' state as above
+//	client-id            client identifier (default go-watcher-<hostname>)
+//	password-env         environment variable holding the user's password
+//	password-file        file holding it, instead
+//	timeout              time allowed to publish a change set (default 10s)
+//	path, type, prefix   only publish the changes selected as for /events
+type MQTTSink struct {
+	name     string
+	addr     string
+	tls      *tls.Config
+	topic    string
+	qos      byte
+	retain   bool
+	clientID string
+	user     string
+	password []byte
+	timeout  time.Duration
+	filter   changeFilter
+
+	mu     sync.Mutex
+	conn   net.Conn
+	r      *bufio.Reader
+	nextID uint16
+}
+
+// mqttMessage is a message to publish
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// mqttRefused is a CONNACK refusal, which reconnecting won't cure
+type mqttRefused byte
+
+func (e mqttRefused) Error() string {
+	switch e {
+	case 1:
+		return "broker refused the connection: unacceptable protocol version"
+	case 2:
+		return "broker refused the connection: client identifier rejected"
+	case 3:
+		return "broker refused the connection: server unavailable"
+	case 4:
+		return "broker refused the connection: bad user name or password"
+	case 5:
+		return "broker refused the connection: not authorized"
+	}
+	return "broker refused the connection: code " + strconv.Itoa(int(e))
+}
+
+func newMQTTSink(u *url.URL) (*MQTTSink, error) {
+	s := &MQTTSink{name: sinkName(u), topic: "go-watcher", qos: 1, timeout: DefaultMQTTTimeout}
+	if err := s.parse(u); err != nil {
+		return nil, fmt.Errorf("mqtt sink %s: %w", s.name, err)
+	}
+	return s, nil
+}
+
+// parse takes the sink's options from u
+func (s *MQTTSink) parse(u *url.URL) error {
+	if u.Hostname() == "" {
+		return errors.New("needs the broker, as mqtt://broker:1883")
+	}
+	port := u.Port()
+	switch _, transport, _ := strings.Cut(u.Scheme, "+"); transport {
+	case "":
+		if port == "" {
+			port = "1883"
+		}
+	case "tls":
+		s.tls = &tls.Config{MinVersion: tls.VersionTLS12, ServerName: u.Hostname()}
+		if port == "" {
+			port = "8883"
+		}
+	default:
+		return fmt.Errorf("unknown transport %q (want mqtt:// or mqtt+tls://)", u.Scheme)
+	}
+	s.addr = net.JoinHostPort(u.Hostname(), port)
+	q := u.Query()
+	var err error
+
+	if v := q.Get("topic"); v != "" {
+		if strings.ContainsAny(v, "+#") || strings.HasSuffix(v, "/") {
+			return fmt.Errorf("invalid topic %q", v)
+		}
+		s.topic = v
+	}
+	if v := q.Get("qos"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 2 {
+			return fmt.Errorf("invalid qos %q (want 0, 1 or 2)", v)
+		}
+		s.qos = byte(n)
+	}
+	if v := q.Get("retain"); v != "" {
+		if s.retain, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("invalid retain %q", v)
+		}
+	}
+	if v := q.Get("timeout"); v != "" {
+		if s.timeout, err = time.ParseDuration(v); err != nil || s.timeout <= 0 {
+			return fmt.Errorf("invalid timeout %q", v)
+		}
+	}
+	s.clientID = q.Get("client-id")
+	if s.clientID == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			host = strconv.Itoa(os.Getpid())
+		}
+		s.clientID = "go-watcher-" + host
+	}
+	if s.password, err = readSecret(q, "password"); err != nil {
+		return err
+	}
+	if u.User != nil {
+		s.user = u.User.Username()
+	} else if s.password != nil {
+		return errors.New("a password needs a user, as mqtt://user@broker")
+	}
+
+	if s.filter, err = parseChangeFilter(q.Get("path"), q.Get("type"), q.Get("prefix")); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *MQTTSink) Name() string { return s.name }
+
+// Deliver publishes the changes of cs the sink selects, reconnecting and
+// trying again once if the connection has failed
+func (s *MQTTSink) Deliver(ctx context.Context, cs *ChangeSet) error {
+	changes := s.filter.changes(cs)
+	if len(changes) == 0 {
+		return nil
+	}
+	source := strings.ReplaceAll(tableSource(cs.Path), "/", "_")
+	base := s.topic + "/" + source
+	var msgs, states []mqttMessage
+	for _, c := range changes {
+		data, err := changeEvent(cs, c)
+		if err != nil {
+			return fmt.Errorf("failed to encode change: %w", err)
+		}
+		msgs = append(msgs, mqttMessage{topic: base + "/" + string(c.Type), payload: data})
+		if !s.retain {
+			continue
+		}
+		// An empty retained message clears the removed route's state
+		state := mqttMessage{topic: base + "/routes/" + c.Destination, retain: true}
+		if chunk := c.New; chunk != nil {
+			wc := webChunk{Target: cs.Path, Destination: chunk.Destination, StartLine: chunk.StartLine, EndLine: chunk.EndLine, Hash: chunk.Hash}
+			if content, err := chunk.Content(); err != nil {
+				wc.Error = err.Error()
+			} else {
+				wc.Content = string(content)
+			}
+			if state.payload, err = json.Marshal(wc); err != nil {
+				return fmt.Errorf("failed to encode route: %w", err)
+			}
+		}
+		states = append(states, state)
+	}
+	msgs = append(msgs, states...)
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fresh := s.conn == nil
+	err := s.publish(ctx, msgs, false)
+	var refused mqttRefused
+	if err != nil && !fresh && !errors.As(err, &refused) && ctx.Err() == nil {
+		err = s.publish(ctx, msgs, true)
+	}
+	return err
+}
+
+// publish sends msgs, in windows of mqttWindow, and waits for them to be
+// acknowledged at the sink's QoS. dup marks a resend.
+func (s *MQTTSink) publish(ctx context.Context, msgs []mqttMessage, dup bool) error {
+	if s.conn == nil {
+		if err := s.dial(ctx); err != nil {
+			return err
+		}
+	}
+	deadline, _ := ctx.Deadline()
+	s.conn.SetDeadline(deadline)
+	for len(msgs) > 0 {
+		n := min(len(msgs), mqttWindow)
+		if err := s.exchange(msgs[:n], dup); err != nil {
+			s.close()
+			return err
+		}
+		msgs = msgs[n:]
+	}
+	return nil
+}
+
+// exchange writes msgs and reads their acknowledgements
+func (s *MQTTSink) exchange(msgs []mqttMessage, dup bool) error {
+	w := bufio.NewWriter(s.conn)
+	// pending maps the packet IDs awaiting an acknowledgement to the
+	// packet type expected next
+	pending := make(map[uint16]byte)
+	for _, m := range msgs {
+		flags := s.qos << 1
+		if m.retain {
+			flags |= 0x01
+		}
+		if dup && s.qos > 0 {
+			flags |= 0x08
+		}
+		var body []byte
+		body = appendMQTTString(body, m.topic)
+		if s.qos > 0 {
+			s.nextID++
+			if s.nextID == 0 {
+				s.nextID = 1
+			}
+			body = binary.BigEndian.AppendUint16(body, s.nextID)
+			pending[s.nextID] = mqttPubAck
+			if s.qos == 2 {
+				pending[s.nextID] = mqttPubRec
+			}
+		}
+		body = append(body, m.payload...)
+		w.Write(appendMQTTHeader(nil, mqttPublish<<4|flags, len(body)))
+		w.Write(body)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for len(pending) > 0 {
+		typ, body, err := s.readPacket()
+		if err != nil {
+			return err
+		}
+		if len(body) < 2 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(body)
+		if want, ok := pending[id]; !ok || typ>>4 != want {
+			continue
+		}
+		switch typ >> 4 {
+		case mqttPubRec:
+			// QoS 2: release the message and wait for its completion
+			rel := append(appendMQTTHeader(nil, mqttPubRel<<4|0x02, 2), body[:2]...)
+			if _, err := s.conn.Write(rel); err != nil {
+				return err
+			}
+			pending[id] = mqttPubComp
+		default:
+			delete(pending, id)
+		}
+	}
+	return nil
+}
+
+// dial connects to the broker and sends CONNECT, with a clean session
+// and no keep-alive since connections are remade when they fail
+func (s *MQTTSink) dial(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if s.tls != nil {
+		tc := tls.Client(conn, s.tls)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return fmt.Errorf("TLS handshake with %s: %w", s.addr, err)
+		}
+		conn = tc
+	}
+	s.conn, s.r = conn, bufio.NewReader(conn)
+
+	var body []byte
+	body = appendMQTTString(body, "MQTT")
+	flags := byte(0x02) // clean session
+	if s.user != "" {
+		flags |= 0x80
+	}
+	if s.password != nil {
+		flags |= 0x40
+	}
+	body = append(body, 4, flags, 0, 0)
+	body = appendMQTTString(body, s.clientID)
+	if s.user != "" {
+		body = appendMQTTString(body, s.user)
+	}
+	if s.password != nil {
+		body = binary.BigEndian.AppendUint16(body, uint16(len(s.password)))
+		body = append(body, s.password...)
+	}
+	if _, err := conn.Write(append(appendMQTTHeader(nil, mqttConnect<<4, len(body)), body...)); err != nil {
+		s.close()
+		return err
+	}
+	typ, ack, err := s.readPacket()
+	if err == nil && (typ>>4 != mqttConnAck || len(ack) != 2) {
+		err = fmt.Errorf("expected CONNACK, got packet type %d", typ>>4)
+	}
+	if err == nil && ack[1] != 0 {
+		err = mqttRefused(ack[1])
+	}
+	if err != nil {
+		s.close()
+		return fmt.Errorf("connecting to %s: %w", s.addr, err)
+	}
+	return nil
+}
+
+// readPacket reads a control packet, returning its first byte and the
+// rest after the remaining length
+func (s *MQTTSink) readPacket() (byte, []byte, error) {
+	typ, err := s.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, 0
+	for {
+		b, err := s.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, errors.New("invalid remaining length")
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(s.r, body); err != nil {
+		return 0, nil, err
+	}
+	return typ, body, nil
+}
+
+// close drops the connection, to be made again on the next delivery
+func (s *MQTTSink) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn, s.r = nil, nil
+	}
+}
+
+// appendMQTTHeader appends a fixed header with first byte typ
+func appendMQTTHeader(b []byte, typ byte, length int) []byte {
+	b = append(b, typ)
+	for {
+		digit := byte(length & 0x7f)
+		length >>= 7
+		if length > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if length == 0 {
+			return b
+		}
+	}
+}
+
+// appendMQTTString appends a length-prefixed UTF-8 string
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// mqttReceived is a PUBLISH received by fakeMQTT
+type mqttReceived struct {
+	topic, payload string
+	qos            byte
+	retain         bool
+}
+
+// fakeMQTT runs an MQTT broker acknowledging every QoS and returns its
+// address, the CONNECT packets and the messages it has received
+func fakeMQTT(t *testing.T) (string, func() ([][]byte, []mqttReceived)) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var mu sync.Mutex
+	var connects [][]byte
+	var msgs []mqttReceived
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				s := &MQTTSink{r: bufio.NewReader(conn)}
+				for {
+					typ, body, err := s.readPacket()
+					if err != nil {
+						return
+					}
+					switch typ >> 4 {
+					case mqttConnect:
+						mu.Lock()
+						connects = append(connects, body)
+						mu.Unlock()
+						conn.Write([]byte{mqttConnAck << 4, 2, 0, 0})
+					case mqttPublish:
+						m := mqttReceived{qos: typ >> 1 & 3, retain: typ&1 == 1}
+						n := int(binary.BigEndian.Uint16(body))
+						m.topic, body = string(body[2:2+n]), body[2+n:]
+						var id []byte
+						if m.qos > 0 {
+							id, body = body[:2], body[2:]
+						}
+						m.payload = string(body)
+						mu.Lock()
+						msgs = append(msgs, m)
+						mu.Unlock()
+						switch m.qos {
+						case 1:
+							conn.Write(append([]byte{mqttPubAck << 4, 2}, id...))
+						case 2:
+							conn.Write(append([]byte{mqttPubRec << 4, 2}, id...))
+						}
+					case mqttPubRel:
+						conn.Write(append([]byte{mqttPubComp << 4, 2}, body...))
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), func() ([][]byte, []mqttReceived) {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([][]byte(nil), connects...), append([]mqttReceived(nil), msgs...)
+	}
+}
+
+func TestMQTTSink(t *testing.T) {
+	addr, received := fakeMQTT(t)
+	t.Setenv("MQTT_TEST_PASSWORD", "pw")
+	sink, err := newSink("mqtt://edge@" + addr + "?password-env=MQTT_TEST_PASSWORD&topic=site1/routes&qos=2&retain=true&client-id=watcher-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &ChangeSet{ID: 4, Path: "/data/core.txt", Changes: []Change{
+		{Seq: 1, Type: ChangeAdded, Destination: "10.1.0.0/16", New: &Chunk{Destination: "10.1.0.0/16", StartLine: 3, EndLine: 4, Hash: "h1", Data: []byte("S 10.1.0.0/16 via 1.1.1.1\n")}},
+		{Seq: 2, Type: ChangeRemoved, Destination: "10.2.0.0/16", Old: &Chunk{Destination: "10.2.0.0/16"}},
+	}}
+	if err := sink.Deliver(context.Background(), cs); err != nil {
+		t.Fatal(err)
+	}
+
+	connects, msgs := received()
+	if len(connects) != 1 {
+		t.Fatalf("%d connections, want 1", len(connects))
+	}
+	// Protocol name, level 4, user, password and clean session flags, no
+	// keep-alive, then the client ID, user and password
+	want := "\x00\x04MQTT\x04\xc2\x00\x00\x00\x09watcher-1\x00\x04edge\x00\x02pw"
+	if string(connects[0]) != want {
+		t.Errorf("CONNECT = %q, want %q", connects[0], want)
+	}
+	if len(msgs) != 4 {
+		t.Fatalf("%d messages, want 4: %+v", len(msgs), msgs)
+	}
+	for i, want := range []struct {
+		topic  string
+		retain bool
+	}{
+		{"site1/routes/core/added", false},
+		{"site1/routes/core/removed", false},
+		{"site1/routes/core/routes/10.1.0.0/16", true},
+		{"site1/routes/core/routes/10.2.0.0/16", true},
+	} {
+		if m := msgs[i]; m.topic != want.topic || m.retain != want.retain || m.qos != 2 {
+			t.Errorf("message %d = %+v, want topic %s and retain %v", i, m, want.topic, want.retain)
+		}
+	}
+	var e jsonChange
+	if err := json.Unmarshal([]byte(msgs[0].payload), &e); err != nil || e.ChangeSet != 4 || e.Change.Destination != "10.1.0.0/16" {
+		t.Errorf("event %s (%v)", msgs[0].payload, err)
+	}
+	var state webChunk
+	if err := json.Unmarshal([]byte(msgs[2].payload), &state); err != nil || state.Hash != "h1" || state.Content != "S 10.1.0.0/16 via 1.1.1.1\n" {
+		t.Errorf("state %s (%v)", msgs[2].payload, err)
+	}
+	if msgs[3].payload != "" {
+		t.Errorf("removed route's state = %q, want empty", msgs[3].payload)
+	}
+}
+
+func TestMQTTSinkRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		(&MQTTSink{r: bufio.NewReader(conn)}).readPacket()
+		conn.Write([]byte{mqttConnAck << 4, 2, 0, 5})
+		io.Copy(io.Discard, conn)
+	}()
+	sink, err := newSink("mqtt://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.Deliver(context.Background(), &ChangeSet{Path: "t.txt", Changes: []Change{{Type: ChangeAdded, Destination: "10.1.0.0/16"}}})
+	if err == nil || err.Error() != "connecting to "+ln.Addr().String()+": broker refused the connection: not authorized" {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestNewMQTTSinkErrors(t *testing.T) {
+	t.Setenv("MQTT_TEST_PASSWORD", "pw")
+	for _, spec := range []string{
+		"mqtt://",
+		"mqtt+ws://broker",
+		"mqtt://broker?topic=a/%23",
+		"mqtt://broker?qos=3",
+		"mqtt://broker?retain=maybe",
+		"mqtt://broker?password-env=MQTT_TEST_PASSWORD",
+	} {
+		if _, err := newSink(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
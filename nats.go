@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultNATSTimeout bounds the publishing of a change set, including
+// waiting for JetStream to acknowledge it
+const DefaultNATSTimeout = 10 * time.Second
+
+// DefaultNATSSubject is the subject changes are published on unless the
+// spec sets one
+const DefaultNATSSubject = "go-watcher.{source}.{type}"
+
+func init() {
+	sinkFactories["nats"] = func(u *url.URL) (Sink, error) {
+		return newNATSSink(u)
+	}
+}
+
+// NATSSink publishes every change to NATS as a change event, as -output
+// jsonl writes it, on a subject made from a template, so consumers can
+// subscribe to just the tables, types or prefixes they want. The spec is
+// nats://[user@]server1:4222,server2:4222, or nats+tls:// to require TLS,
+// with these parameters:
+//
+//	subject              template of the subject (default
+//	                     go-watcher.{source}.{type})
+//	jetstream            true to wait for a JetStream stream to store
+//	                     every change, deduplicated by change
+//	password-env         environment variable holding the user's password
+//	password-file        file holding it, instead
+//	token-env            environment variable holding an auth token
+//	token-file           file holding it, instead
+//	timeout              time allowed to publish a change set (default 10s)
+//	path, type, prefix   only publish the changes selected as for /events
+//
+// In the subject, {source} is the table file's base name up to its
+// extension, {path} its path, {stream} the change's stream, {type} added,
+// removed or modified and {destination} the route's destination. Dots in
+// a destination are kept, so routes.{destination} puts 10.1.0.0/16 on
+// routes.10.1.0.0/16 and routes.10.> subscribes to 10.0.0.0/8's routes;
+// dots in the other values become underscores.
+type NATSSink struct {
+	name      string
+	servers   []string
+	subject   string
+	jetstream bool
+	timeout   time.Duration
+	tls       *tls.Config
+	connect   natsConnect
+	filter    changeFilter
+
+	mu    sync.Mutex
+	conn  net.Conn
+	r     *bufio.Reader
+	info  natsInfo
+	inbox string
+}
+
+// natsInfo is the part of a server's INFO the sink uses
+type natsInfo struct {
+	Headers     bool  `json:"headers"`
+	TLSRequired bool  `json:"tls_required"`
+	MaxPayload  int64 `json:"max_payload"`
+}
+
+// natsConnect is the sink's CONNECT message
+type natsConnect struct {
+	Verbose      bool   `json:"verbose"`
+	Pedantic     bool   `json:"pedantic"`
+	TLSRequired  bool   `json:"tls_required"`
+	Name         string `json:"name"`
+	Lang         string `json:"lang"`
+	Version      string `json:"version"`
+	Protocol     int    `json:"protocol"`
+	Headers      bool   `json:"headers"`
+	NoResponders bool   `json:"no_responders"`
+	User         string `json:"user,omitempty"`
+	Pass         string `json:"pass,omitempty"`
+	AuthToken    string `json:"auth_token,omitempty"`
+}
+
+// natsPubAck is JetStream's reply to a publish
+type natsPubAck struct {
+	Stream string `json:"stream"`
+	Seq    uint64 `json:"seq"`
+	Error  *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+// natsServerError is an error reported by the server, which resending
+// won't cure
+type natsServerError struct{ msg string }
+
+func (e *natsServerError) Error() string { return e.msg }
+
+func newNATSSink(u *url.URL) (*NATSSink, error) {
+	s := &NATSSink{name: sinkName(u), subject: DefaultNATSSubject, timeout: DefaultNATSTimeout}
+	if err := s.parse(u); err != nil {
+		return nil, fmt.Errorf("nats sink %s: %w", s.name, err)
+	}
+	return s, nil
+}
+
+// parse takes the sink's options from u
+func (s *NATSSink) parse(u *url.URL) error {
+	for _, srv := range splitList(u.Host) {
+		if _, _, err := net.SplitHostPort(srv); err != nil {
+			srv = net.JoinHostPort(srv, "4222")
+		}
+		s.servers = append(s.servers, srv)
+	}
+	if len(s.servers) == 0 {
+		return errors.New("needs servers, as nats://server:4222")
+	}
+	switch _, transport, _ := strings.Cut(u.Scheme, "+"); transport {
+	case "":
+	case "tls":
+		s.tls = &tls.Config{MinVersion: tls.VersionTLS12}
+		s.connect.TLSRequired = true
+	default:
+		return fmt.Errorf("unknown transport %q (want nats:// or nats+tls://)", u.Scheme)
+	}
+	q := u.Query()
+	var err error
+
+	if v := q.Get("subject"); v != "" {
+		s.subject = v
+	}
+	if err := validNATSSubject(renderTopic(s.subject, topicSample, topicSample.Changes[0])); err != nil {
+		return fmt.Errorf("invalid subject %q: %w", s.subject, err)
+	}
+	if v := q.Get("jetstream"); v != "" {
+		if s.jetstream, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("invalid jetstream %q", v)
+		}
+	}
+	if v := q.Get("timeout"); v != "" {
+		if s.timeout, err = time.ParseDuration(v); err != nil || s.timeout <= 0 {
+			return fmt.Errorf("invalid timeout %q", v)
+		}
+	}
+
+	s.connect.Name, s.connect.Lang, s.connect.Version = "go-watcher", "go", "1"
+	s.connect.Protocol, s.connect.Headers, s.connect.NoResponders = 1, true, true
+	password, err := readSecret(q, "password")
+	if err != nil {
+		return err
+	}
+	token, err := readSecret(q, "token")
+	if err != nil {
+		return err
+	}
+	switch {
+	case u.User != nil && password == nil:
+		return errors.New("a user needs password-env or password-file")
+	case u.User == nil && password != nil:
+		return errors.New("a password needs a user, as nats://user@server:4222")
+	case password != nil && token != nil:
+		return errors.New("set a user and password or a token, not both")
+	}
+	if u.User != nil {
+		s.connect.User, s.connect.Pass = u.User.Username(), string(password)
+	}
+	s.connect.AuthToken = string(token)
+
+	if s.filter, err = parseChangeFilter(q.Get("path"), q.Get("type"), q.Get("prefix")); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validNATSSubject checks that subject can be published on
+func validNATSSubject(subject string) error {
+	if strings.ContainsAny(subject, " \t\r\n") {
+		return errors.New("whitespace in subject")
+	}
+	for _, tok := range strings.Split(subject, ".") {
+		switch tok {
+		case "":
+			return errors.New("empty token in subject")
+		case "*", ">":
+			return errors.New("wildcard in subject")
+		}
+		if strings.ContainsAny(tok, "{}") {
+			return fmt.Errorf("unknown placeholder in %q (known: %s)", tok, strings.Join(topicPlaceholders, ", "))
+		}
+	}
+	return nil
+}
+
+func (s *NATSSink) Name() string { return s.name }
+
+// natsMessage is a message to publish
+type natsMessage struct {
+	subject, id string
+	data        []byte
+}
+
+// Deliver publishes the changes of cs the sink selects, reconnecting and
+// trying again once if the connection has failed
+func (s *NATSSink) Deliver(ctx context.Context, cs *ChangeSet) error {
+	changes := s.filter.changes(cs)
+	if len(changes) == 0 {
+		return nil
+	}
+	msgs := make([]natsMessage, 0, len(changes))
+	for _, c := range changes {
+		data, err := changeEvent(cs, c)
+		if err != nil {
+			return fmt.Errorf("failed to encode change: %w", err)
+		}
+		subject := renderTopic(s.subject, cs, c)
+		if err := validNATSSubject(subject); err != nil {
+			return fmt.Errorf("subject %q: %w", subject, err)
+		}
+		msgs = append(msgs, natsMessage{subject: subject, id: changeEventID(cs, c), data: data})
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fresh := s.conn == nil
+	err := s.publish(ctx, msgs)
+	var serr *natsServerError
+	if err != nil && !fresh && !errors.As(err, &serr) && ctx.Err() == nil {
+		err = s.publish(ctx, msgs)
+	}
+	return err
+}
+
+// publish sends msgs and waits for the server to have taken them, and
+// for JetStream to have stored them if the sink uses it
+func (s *NATSSink) publish(ctx context.Context, msgs []natsMessage) error {
+	if s.conn == nil {
+		if err := s.dial(ctx); err != nil {
+			return err
+		}
+	}
+	deadline, _ := ctx.Deadline()
+	s.conn.SetDeadline(deadline)
+	err := s.exchange(msgs)
+	if err != nil {
+		var serr *natsServerError
+		if !errors.As(err, &serr) || strings.HasPrefix(err.Error(), "-ERR") {
+			s.close()
+		}
+	}
+	return err
+}
+
+// exchange writes msgs and a PING, and reads until the PONG and every
+// JetStream acknowledgement are in
+func (s *NATSSink) exchange(msgs []natsMessage) error {
+	w := bufio.NewWriter(s.conn)
+	for i, m := range msgs {
+		if s.info.MaxPayload > 0 && int64(len(m.data)) > s.info.MaxPayload {
+			return &natsServerError{fmt.Sprintf("change event of %d bytes exceeds the server's max_payload", len(m.data))}
+		}
+		switch {
+		case !s.jetstream:
+			fmt.Fprintf(w, "PUB %s %d\r\n", m.subject, len(m.data))
+		case s.info.Headers:
+			// JetStream drops repeats of a Nats-Msg-Id, so a retry after a
+			// lost acknowledgement stores the change once
+			hdr := "NATS/1.0\r\nNats-Msg-Id: " + m.id + "\r\n\r\n"
+			fmt.Fprintf(w, "HPUB %s %s.%d %d %d\r\n%s", m.subject, s.inbox, i, len(hdr), len(hdr)+len(m.data), hdr)
+		default:
+			fmt.Fprintf(w, "PUB %s %s.%d %d\r\n", m.subject, s.inbox, i, len(m.data))
+		}
+		w.Write(m.data)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("PING\r\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	acks := 0
+	if s.jetstream {
+		acks = len(msgs)
+	}
+	pong := false
+	var failed error
+	for !pong || acks > 0 {
+		line, err := s.readLine()
+		if err != nil {
+			return err
+		}
+		verb, args, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "PING":
+			if _, err := io.WriteString(s.conn, "PONG\r\n"); err != nil {
+				return err
+			}
+		case "PONG":
+			pong = true
+		case "-ERR":
+			return &natsServerError{line}
+		case "MSG", "HMSG":
+			hdr, data, err := s.readMessage(strings.ToUpper(verb) == "HMSG", strings.Fields(args))
+			if err != nil {
+				return err
+			}
+			acks--
+			if err := natsAckError(hdr, data); err != nil && failed == nil {
+				failed = err
+			}
+		}
+	}
+	return failed
+}
+
+// natsAckError returns the error in JetStream's reply to a publish, if any
+func natsAckError(hdr string, data []byte) error {
+	if status, _, _ := strings.Cut(hdr, "\r\n"); strings.HasPrefix(status, "NATS/1.0 503") {
+		return &natsServerError{"no JetStream stream takes the subject"}
+	}
+	var ack natsPubAck
+	if err := json.Unmarshal(data, &ack); err != nil {
+		return &natsServerError{fmt.Sprintf("invalid JetStream acknowledgement %q", data)}
+	}
+	if ack.Error != nil {
+		return &natsServerError{fmt.Sprintf("JetStream: %s (%d)", ack.Error.Description, ack.Error.Code)}
+	}
+	return nil
+}
+
+// readLine reads a protocol line
+func (s *NATSSink) readLine() (string, error) {
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readMessage reads the payload of a MSG or HMSG with arguments args,
+// returning its headers, if any, and data
+func (s *NATSSink) readMessage(headers bool, args []string) (string, []byte, error) {
+	if len(args) < 3 {
+		return "", nil, fmt.Errorf("invalid message arguments %q", args)
+	}
+	total, err := strconv.Atoi(args[len(args)-1])
+	hdrLen := 0
+	if headers {
+		if len(args) < 4 {
+			return "", nil, fmt.Errorf("invalid message arguments %q", args)
+		}
+		hdrLen, err = strconv.Atoi(args[len(args)-2])
+	}
+	if err != nil || total < hdrLen || total > 1<<26 {
+		return "", nil, fmt.Errorf("invalid message arguments %q", args)
+	}
+	buf := make([]byte, total+2)
+	if _, err := io.ReadFull(s.r, buf); err != nil {
+		return "", nil, err
+	}
+	return string(buf[:hdrLen]), buf[hdrLen:total], nil
+}
+
+// dial connects to the first server that takes the connection
+func (s *NATSSink) dial(ctx context.Context) error {
+	var errs []error
+	for _, srv := range s.servers {
+		err := s.dialServer(ctx, srv)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", srv, err))
+	}
+	return fmt.Errorf("no server reachable: %w", errors.Join(errs...))
+}
+
+// dialServer connects to srv: reads its INFO, upgrades to TLS if either
+// side wants it, and sends CONNECT and the inbox subscription
+func (s *NATSSink) dialServer(ctx context.Context, srv string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", srv)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	s.conn, s.r = conn, bufio.NewReader(conn)
+	if err := s.handshake(ctx, srv); err != nil {
+		s.close()
+		return err
+	}
+	return nil
+}
+
+func (s *NATSSink) handshake(ctx context.Context, srv string) error {
+	line, err := s.readLine()
+	if err != nil {
+		return err
+	}
+	info, ok := strings.CutPrefix(line, "INFO ")
+	if !ok {
+		return fmt.Errorf("expected INFO, got %q", line)
+	}
+	s.info = natsInfo{}
+	if err := json.Unmarshal([]byte(info), &s.info); err != nil {
+		return fmt.Errorf("invalid INFO: %w", err)
+	}
+	if s.tls != nil || s.info.TLSRequired {
+		cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+		if s.tls != nil {
+			cfg = s.tls.Clone()
+		}
+		cfg.ServerName, _, _ = net.SplitHostPort(srv)
+		tc := tls.Client(s.conn, cfg)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return fmt.Errorf("TLS handshake: %w", err)
+		}
+		s.conn, s.r = tc, bufio.NewReader(tc)
+	}
+
+	connect, err := json.Marshal(s.connect)
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	s.inbox = "_INBOX." + hex.EncodeToString(id)
+	if _, err := fmt.Fprintf(s.conn, "CONNECT %s\r\nSUB %s.* 1\r\nPING\r\n", connect, s.inbox); err != nil {
+		return err
+	}
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			io.WriteString(s.conn, "PONG\r\n")
+		case strings.HasPrefix(line, "-ERR"):
+			return &natsServerError{line}
+		}
+	}
+}
+
+// close drops the connection, to be made again on the next delivery
+func (s *NATSSink) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn, s.r = nil, nil
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// natsPublished is a message received by fakeNATS
+type natsPublished struct {
+	subject, reply, header, data string
+}
+
+// fakeNATS runs a NATS server, with JetStream acknowledging publishes
+// with a reply subject if jetstream is set, and returns its address, the
+// CONNECTs and the messages it has received
+func fakeNATS(t *testing.T, jetstream bool) (string, func() ([]natsConnect, []natsPublished)) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var mu sync.Mutex
+	var connects []natsConnect
+	var msgs []natsPublished
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				io.WriteString(conn, `INFO {"server_id":"fake","headers":true,"max_payload":1048576}`+"\r\n")
+				seq := 0
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					verb, args, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+					f := strings.Fields(args)
+					switch verb {
+					case "CONNECT":
+						var c natsConnect
+						json.Unmarshal([]byte(args), &c)
+						mu.Lock()
+						connects = append(connects, c)
+						mu.Unlock()
+					case "PUB", "HPUB":
+						m := natsPublished{subject: f[0]}
+						hdrLen := 0
+						if verb == "HPUB" {
+							hdrLen, _ = strconv.Atoi(f[len(f)-2])
+						}
+						total, _ := strconv.Atoi(f[len(f)-1])
+						if len(f) == 3 && verb == "PUB" || len(f) == 4 {
+							m.reply = f[1]
+						}
+						buf := make([]byte, total+2)
+						io.ReadFull(r, buf)
+						m.header, m.data = string(buf[:hdrLen]), string(buf[hdrLen:total])
+						mu.Lock()
+						msgs = append(msgs, m)
+						mu.Unlock()
+						if jetstream && m.reply != "" {
+							seq++
+							ack := fmt.Sprintf(`{"stream":"ROUTES","seq":%d}`, seq)
+							fmt.Fprintf(conn, "MSG %s 1 %d\r\n%s\r\n", m.reply, len(ack), ack)
+						}
+					case "PING":
+						io.WriteString(conn, "PONG\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), func() ([]natsConnect, []natsPublished) {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]natsConnect(nil), connects...), append([]natsPublished(nil), msgs...)
+	}
+}
+
+func TestNATSSink(t *testing.T) {
+	addr, received := fakeNATS(t, false)
+	t.Setenv("NATS_TEST_PASSWORD", "pw")
+	sink, err := newSink("nats://watcher@" + addr + "?password-env=NATS_TEST_PASSWORD&subject=routes.{source}.{destination}&type=added,removed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &ChangeSet{Stream: "s1", ID: 4, Path: "/data/core.txt", Time: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), Changes: []Change{
+		{Seq: 1, Type: ChangeAdded, Destination: "10.1.0.0/16"},
+		{Seq: 2, Type: ChangeModified, Destination: "10.3.0.0/16"},
+		{Seq: 3, Type: ChangeRemoved, Destination: "2001:db8::/32"},
+	}}
+	if err := sink.Deliver(context.Background(), cs); err != nil {
+		t.Fatal(err)
+	}
+
+	connects, msgs := received()
+	if len(connects) != 1 || connects[0].User != "watcher" || connects[0].Pass != "pw" || connects[0].Verbose {
+		t.Errorf("connects = %+v", connects)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("%d messages, want 2: %+v", len(msgs), msgs)
+	}
+	for i, want := range []string{"routes.core.10.1.0.0/16", "routes.core.2001:db8::/32"} {
+		if msgs[i].subject != want || msgs[i].reply != "" {
+			t.Errorf("message %d on %q (reply %q), want %q", i, msgs[i].subject, msgs[i].reply, want)
+		}
+	}
+	var e jsonChange
+	if err := json.Unmarshal([]byte(msgs[0].data), &e); err != nil || e.ChangeSet != 4 || e.Change.Destination != "10.1.0.0/16" {
+		t.Errorf("data %s (%v)", msgs[0].data, err)
+	}
+}
+
+func TestNATSSinkJetStream(t *testing.T) {
+	addr, received := fakeNATS(t, true)
+	sink, err := newSink("nats://" + addr + "?jetstream=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := range uint64(2) {
+		cs := &ChangeSet{Stream: "s1", ID: id + 1, Path: "core.txt", Changes: []Change{{Seq: id + 1, Type: ChangeAdded, Destination: "10.1.0.0/16"}}}
+		if err := sink.Deliver(context.Background(), cs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	connects, msgs := received()
+	if len(connects) != 1 {
+		t.Errorf("%d connections, want 1", len(connects))
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("%d messages, want 2", len(msgs))
+	}
+	for i, m := range msgs {
+		if m.subject != "go-watcher.core.added" || !strings.HasPrefix(m.reply, "_INBOX.") {
+			t.Errorf("message %d = %+v", i, m)
+		}
+		if want := fmt.Sprintf("Nats-Msg-Id: s1-%d\r\n", i+1); !strings.Contains(m.header, want) {
+			t.Errorf("header %q, want %q", m.header, want)
+		}
+	}
+}
+
+func TestNATSSinkNoStream(t *testing.T) {
+	// Without a stream on the subject nothing acknowledges the publish
+	addr, _ := fakeNATS(t, false)
+	sink, err := newSink("nats://" + addr + "?jetstream=true&timeout=100ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &ChangeSet{Path: "core.txt", Changes: []Change{{Seq: 1, Type: ChangeAdded, Destination: "10.1.0.0/16"}}}
+	if err := sink.Deliver(context.Background(), cs); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestNewNATSSinkErrors(t *testing.T) {
+	t.Setenv("NATS_TEST_PASSWORD", "pw")
+	for _, spec := range []string{
+		"nats://",
+		"nats+udp://localhost",
+		"nats://localhost?subject=routes.{table}",
+		"nats://localhost?subject=routes..{type}",
+		"nats://localhost?subject=routes.>",
+		"nats://localhost?jetstream=maybe",
+		"nats://watcher@localhost",
+		"nats://localhost?password-env=NATS_TEST_PASSWORD",
+		"nats://watcher@localhost?password-env=NATS_TEST_PASSWORD&token-env=NATS_TEST_PASSWORD",
+	} {
+		if _, err := newSink(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Normalization steps applied to each line before hashing
+const (
+	// NormalizeTrim removes trailing whitespace
+	NormalizeTrim = "trim"
+	// NormalizeCollapse collapses runs of spaces and tabs into one space
+	NormalizeCollapse = "collapse"
+	// NormalizeEOL strips carriage returns left over from CRLF or CR line
+	// endings
+	NormalizeEOL = "eol"
+)
+
+// normalizeSteps lists every step in the order it is applied
+var normalizeSteps = []string{NormalizeEOL, NormalizeTrim, NormalizeCollapse}
+
+// parseNormalize parses a -normalize value: a comma separated list of
+// steps, "all", or "none"/empty
+func parseNormalize(s string) ([]string, error) {
+	switch strings.TrimSpace(s) {
+	case "", "none":
+		return nil, nil
+	case "all":
+		return append([]string(nil), normalizeSteps...), nil
+	}
+	steps := splitList(s)
+	for _, step := range steps {
+		if !slices.Contains(normalizeSteps, step) {
+			return nil, fmt.Errorf("unknown normalization step %q (want %s)", step, strings.Join(normalizeSteps, ", "))
+		}
+	}
+	return steps, nil
+}
+
+// normalizer rewrites chunk lines so that differences without meaning
+// don't change the chunk hash. Raw chunk data is left untouched.
+type normalizer struct {
+	ignore   fieldSet
+	eol      bool
+	trim     bool
+	collapse bool
+}
+
+// newNormalizer builds the normalization pipeline for the given options
+func newNormalizer(opts LoadOptions) (*normalizer, error) {
+	n := &normalizer{ignore: newFieldSet(opts.IgnoreFields)}
+	for _, step := range opts.Normalize {
+		switch step {
+		case NormalizeEOL:
+			n.eol = true
+		case NormalizeTrim:
+			n.trim = true
+		case NormalizeCollapse:
+			n.collapse = true
+		default:
+			return nil, fmt.Errorf("unknown normalization step %q", step)
+		}
+	}
+	return n, nil
+}
+
+// identity reports whether the normalizer leaves lines unchanged
+func (n *normalizer) identity() bool {
+	return len(n.ignore) == 0 && !n.eol && !n.trim && !n.collapse
+}
+
+// line normalizes a single line. Fields are masked first because field
+// parsing relies on the original column spacing.
+func (n *normalizer) line(s string) string {
+	s = maskFields(s, n.ignore)
+	if n.eol {
+		s = strings.ReplaceAll(s, "\r", "")
+	}
+	if n.trim {
+		s = strings.TrimRight(s, " \t")
+	}
+	if n.collapse {
+		s = collapseSpaces(s)
+	}
+	return s
+}
+
+// collapseSpaces replaces every run of spaces and tabs with a single space
+func collapseSpaces(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	inRun := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == ' ' || c == '\t' {
+			if !inRun {
+				b.WriteByte(' ')
+			}
+			inRun = true
+			continue
+		}
+		inRun = false
+		b.WriteByte(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseNormalize(t *testing.T) {
+	if steps, err := parseNormalize("none"); err != nil || steps != nil {
+		t.Errorf("none = %v, %v", steps, err)
+	}
+	if steps, err := parseNormalize("all"); err != nil || len(steps) != 3 {
+		t.Errorf("all = %v, %v", steps, err)
+	}
+	if _, err := parseNormalize("trim,squash"); err == nil {
+		t.Error("unknown step accepted")
+	}
+}
+
+func TestNormalizerLine(t *testing.T) {
+	n, err := newNormalizer(LoadOptions{IgnoreFields: []string{"Age"}, Normalize: []string{NormalizeEOL, NormalizeTrim, NormalizeCollapse}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := n.line("        State: Active Adv Relied         Age: 27d02h01m21s   \r")
+	b := n.line("  State: Active\tAdv Relied  Age: 1s")
+	if a != b {
+		t.Errorf("normalized lines differ: %q vs %q", a, b)
+	}
+	if want := " State: Active Adv Relied Age:"; a != want {
+		t.Errorf("normalized = %q, want %q", a, want)
+	}
+}
+
+func TestNormalizeHashing(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	rt := NewDataTable(path)
+	rt.Options.Normalize = []string{NormalizeEOL, NormalizeTrim}
+	if err := rt.LoadDataTable(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	rewriteFile(t, path, "\n", "   \r\n")
+	cs, err := rt.DetectChanges(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Len() != 0 {
+		t.Errorf("whitespace-only change reported: %+v", cs.Changes)
+	}
+}
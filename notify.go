@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Dispatcher hands change sets to the configured sinks. Deliveries that
+// fail are saved to the dead-letter queue, if one is configured, so they can
+// be replayed later with "dlq retry".
+//
+// With a BatchWindow, changes are held and merged so a burst of reloads
+// reaches the sinks as one change set. Changes matching the Priority rules
+// skip the batch and are delivered straight away. Each table is batched
+// separately, since routes of different tables must not be merged.
+type Dispatcher struct {
+	sinks []Sink
+	dlq   *DeadLetterQueue
+	// Priority selects the critical changes; nil means none are
+	Priority *PrefixRules
+	// BatchWindow is how long non-critical changes are held before
+	// delivery; zero delivers every change set immediately
+	BatchWindow time.Duration
+	// OnError is called for every failed delivery
+	OnError func(error)
+
+	mu sync.Mutex
+	// pending holds the batched change set of each table, by path
+	pending map[string]*ChangeSet
+	timer   *time.Timer
+	// health records the outcome of each sink's deliveries, by name
+	health map[string]*SinkHealth
+}
+
+// SinkHealth describes how a sink's deliveries have gone. A sink is
+// healthy until a delivery fails, and again after one succeeds.
+type SinkHealth struct {
+	Name         string    `json:"name"`
+	Healthy      bool      `json:"healthy"`
+	Delivered    int       `json:"delivered"`
+	Failures     int       `json:"failures"`
+	LastDelivery time.Time `json:"last_delivery,omitzero"`
+	LastError    string    `json:"last_error,omitempty"`
+	LastFailure  time.Time `json:"last_failure,omitzero"`
+}
+
+// NewDispatcher creates a dispatcher for sinks; dlq may be nil
+func NewDispatcher(sinks []Sink, dlq *DeadLetterQueue) *Dispatcher {
+	return &Dispatcher{
+		sinks:   sinks,
+		dlq:     dlq,
+		OnError: func(err error) { slog.Error("notification error", "err", err) },
+	}
+}
+
+// Dispatch delivers cs to every sink: all its changes to sinks keeping
+// history, and the notifiable ones to the rest. Critical changes are
+// delivered before Dispatch returns; the rest are delivered now or, with
+// a BatchWindow, when the window closes. The returned error joins the
+// failures of the deliveries made before returning.
+func (d *Dispatcher) Dispatch(ctx context.Context, cs *ChangeSet) error {
+	if cs.Len() == 0 && !cs.Truncated {
+		return nil
+	}
+	d.mu.Lock()
+	priority, window := d.Priority, d.BatchWindow
+	d.mu.Unlock()
+	critical, normal := priority.split(cs)
+	var err error
+	if critical.Len() > 0 {
+		metrics.Counter("priority_changes_total", "Critical changes delivered without batching").Add(int64(critical.Len()))
+		err = d.send(ctx, critical)
+	}
+	if normal.Len() == 0 && !normal.Truncated {
+		return err
+	}
+	if window <= 0 {
+		return errors.Join(err, d.send(ctx, normal))
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pending == nil {
+		d.pending = make(map[string]*ChangeSet)
+		d.timer = time.AfterFunc(window, func() { d.Flush(context.Background()) })
+	}
+	if held, ok := d.pending[normal.Path]; ok {
+		held.merge(normal)
+	} else {
+		d.pending[normal.Path] = normal
+	}
+	var n int
+	for _, held := range d.pending {
+		n += len(held.Notifiable())
+	}
+	batchedChanges().Set(int64(n))
+	return err
+}
+
+// Configure replaces the priority rules and batch window of a dispatcher
+// that may be in use. A batch already pending keeps its window.
+func (d *Dispatcher) Configure(priority *PrefixRules, window time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Priority, d.BatchWindow = priority, window
+}
+
+// Flush delivers any batched changes without waiting for the window, and
+// has sinks that hold change sets back send them
+func (d *Dispatcher) Flush(ctx context.Context) error {
+	d.mu.Lock()
+	pending := d.pending
+	d.pending = nil
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.mu.Unlock()
+
+	batchedChanges().Set(0)
+	paths := make([]string, 0, len(pending))
+	for path := range pending {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var errs []error
+	for _, path := range paths {
+		if cs := pending[path]; cs.Len() > 0 || cs.Truncated {
+			errs = append(errs, d.send(ctx, cs))
+		}
+	}
+	for _, s := range d.sinks {
+		if f, ok := s.(flusher); ok {
+			if err := f.Flush(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("sink %s: %w", s.Name(), err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func batchedChanges() *Gauge {
+	return metrics.Gauge("batched_changes", "Non-critical changes waiting for the batch window")
+}
+
+// send delivers cs to every sink, leaving the changes to volatile chunks
+// out for all but those keeping history
+func (d *Dispatcher) send(ctx context.Context, cs *ChangeSet) error {
+	notify := cs.forNotification()
+	var errs []error
+	for _, s := range d.sinks {
+		out := notify
+		if recordsHistory(s) {
+			out = cs
+		} else if out.Len() == 0 && !out.Truncated {
+			continue
+		}
+		errs = append(errs, d.deliver(ctx, s, out))
+	}
+	return errors.Join(errs...)
+}
+
+// deliver sends cs to one sink, dead-lettering it on failure
+func (d *Dispatcher) deliver(ctx context.Context, s Sink, cs *ChangeSet) error {
+	ctx, span := startClientSpan(ctx, "deliver", "sink", s.Name(), "changeset.id", cs.ID, "changes", cs.Len())
+	err := s.Deliver(ctx, cs)
+	span.End(err)
+	d.recordHealth(s.Name(), err)
+	if err == nil {
+		metrics.Counter("sink_deliveries_total", "Change sets delivered to sinks", "sink", s.Name()).Inc()
+		return nil
+	}
+	metrics.Counter("sink_delivery_failures_total", "Change sets sinks failed to accept", "sink", s.Name()).Inc()
+	err = fmt.Errorf("sink %s: %w", s.Name(), err)
+	if d.dlq != nil {
+		if qerr := d.dlq.Put(s.Name(), cs, err); qerr != nil {
+			err = fmt.Errorf("%w (and saving to the dead-letter queue failed: %v)", err, qerr)
+		} else {
+			err = fmt.Errorf("%w (saved to the dead-letter queue)", err)
+		}
+	}
+	d.OnError(err)
+	return err
+}
+
+// recordHealth records the outcome of a delivery to the named sink
+func (d *Dispatcher) recordHealth(name string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.health == nil {
+		d.health = make(map[string]*SinkHealth)
+	}
+	h, ok := d.health[name]
+	if !ok {
+		h = &SinkHealth{Name: name}
+		d.health[name] = h
+	}
+	h.Healthy = err == nil
+	if err == nil {
+		h.Delivered++
+		h.LastDelivery = time.Now()
+	} else {
+		h.Failures++
+		h.LastError, h.LastFailure = err.Error(), time.Now()
+	}
+}
+
+// Health returns the health of each sink, in the order they were given
+func (d *Dispatcher) Health() []SinkHealth {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make([]SinkHealth, 0, len(d.sinks))
+	for _, s := range d.sinks {
+		if h, ok := d.health[s.Name()]; ok {
+			out = append(out, *h)
+		} else {
+			out = append(out, SinkHealth{Name: s.Name(), Healthy: true})
+		}
+	}
+	return out
+}
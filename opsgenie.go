@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// opsgenieAPI is the Alert API's address, unless the spec names another
+// such as api.eu.opsgenie.com
+var opsgenieAPI = "https://api.opsgenie.com"
+
+// Limits of the Alert API
+const (
+	opsgenieMaxTags    = 20
+	opsgenieMaxMessage = 130
+)
+
+func init() {
+	sinkFactories["opsgenie"] = func(u *url.URL) (Sink, error) {
+		return newOpsgenieSink(u)
+	}
+}
+
+// OpsgenieSink creates Opsgenie alerts when an alert condition fires and
+// closes them when it clears, as the PagerDuty sink does with incidents.
+// The spec is opsgenie://?key-env=VAR (or key-file) with an API
+// integration's key, or opsgenie://api.eu.opsgenie.com?... for the EU
+// instance, with the parameters of alertConditions and
+//
+//	priority           priority of alerts on ordinary routes (default P3)
+//	critical-priority  priority of alerts on critical routes, as selected
+//	                   by -critical (default P1)
+//	tags               comma separated tags added to every alert
+//	link               the web UI's address, linked from alerts
+//
+// plus the webhook sink's timeout, retries and backoff. Alerts are tagged
+// with their condition and the affected prefixes, and conditions' keys
+// are their aliases, so Opsgenie folds repeats into one alert.
+type OpsgenieSink struct {
+	alertConditions
+	name     string
+	api      string
+	post     *WebhookSink
+	priority string
+	critical string
+	tags     []string
+	link     string
+	source   string
+}
+
+func newOpsgenieSink(u *url.URL) (*OpsgenieSink, error) {
+	s := &OpsgenieSink{name: sinkName(u), api: opsgenieAPI, priority: "P3", critical: "P1"}
+	s.open, s.close, s.service = s.create, s.closeAlert, "Opsgenie"
+	if u.Host != "" {
+		s.api = "https://" + u.Host
+	}
+	q := u.Query()
+	key, err := readSecret(q, "key")
+	if err != nil {
+		return nil, fmt.Errorf("opsgenie sink %s: %w", s.name, err)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("opsgenie sink %s: needs the API key in key-env or key-file", s.name)
+	}
+	if err := s.alertConditions.parse(q); err != nil {
+		return nil, fmt.Errorf("opsgenie sink %s: %w", s.name, err)
+	}
+	if err := s.parse(q); err != nil {
+		return nil, fmt.Errorf("opsgenie sink %s: %w", s.name, err)
+	}
+	if s.source, err = os.Hostname(); err != nil {
+		s.source = "go-watcher"
+	}
+
+	target, err := url.Parse(s.api + "/v2/alerts")
+	if err != nil {
+		return nil, err
+	}
+	// One request at a time, so a close can't overtake its create
+	q.Set("concurrency", "1")
+	if s.post, err = newPoster(s.name, target, q); err != nil {
+		return nil, fmt.Errorf("opsgenie sink %s: %w", s.name, err)
+	}
+	s.post.header = http.Header{"Authorization": {"GenieKey " + string(key)}}
+	return s, nil
+}
+
+// parse takes the sink's alert options from q
+func (s *OpsgenieSink) parse(q url.Values) error {
+	for _, p := range []struct {
+		name string
+		dst  *string
+	}{{"priority", &s.priority}, {"critical-priority", &s.critical}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimPrefix(v, "P")); err != nil || !strings.HasPrefix(v, "P") || n < 1 || n > 5 {
+			return fmt.Errorf("invalid %s %q (want P1 to P5)", p.name, v)
+		}
+		*p.dst = v
+	}
+	s.tags = splitList(q.Get("tags"))
+	s.link = q.Get("link")
+	for _, p := range []string{"priority", "critical-priority", "tags", "link"} {
+		q.Del(p)
+	}
+	return nil
+}
+
+func (s *OpsgenieSink) Name() string { return s.name }
+
+// Deliver checks the alert conditions against cs
+func (s *OpsgenieSink) Deliver(ctx context.Context, cs *ChangeSet) error {
+	return s.check(ctx, cs)
+}
+
+// opsgenieAlert is the body of a create alert request
+type opsgenieAlert struct {
+	Message     string            `json:"message"`
+	Alias       string            `json:"alias"`
+	Description string            `json:"description,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	Details     map[string]string `json:"details,omitempty"`
+	Entity      string            `json:"entity,omitempty"`
+	Source      string            `json:"source,omitempty"`
+	Priority    string            `json:"priority"`
+}
+
+// create creates the alert of a
+func (s *OpsgenieSink) create(ctx context.Context, a *alert) error {
+	body, err := json.Marshal(s.alert(a))
+	if err != nil {
+		return fmt.Errorf("failed to encode alert: %w", err)
+	}
+	return s.post.send(ctx, body)
+}
+
+// alert lays a out for the Alert API
+func (s *OpsgenieSink) alert(a *alert) opsgenieAlert {
+	oa := opsgenieAlert{
+		Message:  a.Summary,
+		Alias:    a.Key,
+		Entity:   a.cs.Path,
+		Source:   s.source,
+		Priority: s.priority,
+		Details: map[string]string{
+			"changeset":       strconv.FormatUint(a.cs.ID, 10),
+			"routes_in_table": strconv.Itoa(a.cs.Routes),
+		},
+	}
+	if a.Critical {
+		oa.Priority = s.critical
+	}
+	if len(oa.Message) > opsgenieMaxMessage {
+		oa.Message = oa.Message[:opsgenieMaxMessage]
+	}
+	if s.link != "" {
+		oa.Details["link"] = s.link
+	}
+
+	var desc strings.Builder
+	fmt.Fprintf(&desc, "%s, changeset %d:\n", a.Summary, a.cs.ID)
+	for _, dest := range a.Destinations {
+		fmt.Fprintf(&desc, "  %s\n", dest)
+	}
+	if a.Unlisted > 0 {
+		fmt.Fprintf(&desc, "  (%d more not listed)\n", a.Unlisted)
+	}
+	oa.Description = desc.String()
+
+	oa.Tags = append([]string{"go-watcher", a.Class}, s.tags...)
+	for _, dest := range a.Destinations {
+		if len(oa.Tags) == opsgenieMaxTags {
+			break
+		}
+		oa.Tags = append(oa.Tags, dest)
+	}
+	return oa
+}
+
+// closeAlert closes the alert of key
+func (s *OpsgenieSink) closeAlert(ctx context.Context, key string) error {
+	body, err := json.Marshal(map[string]string{"source": s.source, "note": "Condition cleared"})
+	if err != nil {
+		return err
+	}
+	return s.post.sendTo(ctx, s.api+"/v2/alerts/"+url.PathEscape(key)+"/close?identifierType=alias", body)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// opsgenieRequest is a request to the Alert API
+type opsgenieRequest struct {
+	path, query, auth string
+	alert             opsgenieAlert
+}
+
+func TestOpsgenieSink(t *testing.T) {
+	var mu sync.Mutex
+	var reqs []opsgenieRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := opsgenieRequest{path: r.URL.EscapedPath(), query: r.URL.RawQuery, auth: r.Header.Get("Authorization")}
+		data, _ := io.ReadAll(r.Body)
+		json.Unmarshal(data, &req.alert)
+		mu.Lock()
+		reqs = append(reqs, req)
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+	defer func(api string) { opsgenieAPI = api }(opsgenieAPI)
+	opsgenieAPI = srv.URL
+	t.Setenv("OPSGENIE_TEST_KEY", "g3n1e")
+
+	sink, err := newSink("opsgenie://?key-env=OPSGENIE_TEST_KEY&removed=0.0.0.0/0,10.0.0.0/8%2B&resolve-after=1ms&tags=core,noc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := sink.Deliver(ctx, &ChangeSet{ID: 5, Path: "core.txt", Routes: 9, Changes: []Change{
+		{Type: ChangeRemoved, Destination: "0.0.0.0/0", Critical: true},
+		{Type: ChangeRemoved, Destination: "10.1.0.0/16"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Deliver(ctx, &ChangeSet{ID: 6, Path: "core.txt", Changes: []Change{
+		{Type: ChangeAdded, Destination: "0.0.0.0/0"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(reqs)
+		mu.Unlock()
+		if n >= 3 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reqs) != 3 {
+		t.Fatalf("%d requests, want 3: %+v", len(reqs), reqs)
+	}
+	for i, want := range []struct{ alias, priority string }{
+		{"go-watcher/core.txt/removed/0.0.0.0/0", "P1"},
+		{"go-watcher/core.txt/removed/10.1.0.0/16", "P3"},
+	} {
+		r := reqs[i]
+		if r.path != "/v2/alerts" || r.auth != "GenieKey g3n1e" {
+			t.Errorf("request %d = %+v", i, r)
+		}
+		if r.alert.Alias != want.alias || r.alert.Priority != want.priority || r.alert.Entity != "core.txt" {
+			t.Errorf("alert %d = %+v, want alias %s and priority %s", i, r.alert, want.alias, want.priority)
+		}
+	}
+	if tags := reqs[0].alert.Tags; len(tags) != 5 || tags[0] != "go-watcher" || tags[1] != "route-removed" || tags[2] != "core" || tags[4] != "0.0.0.0/0" {
+		t.Errorf("tags = %q", tags)
+	}
+	if r := reqs[2]; r.path != "/v2/alerts/go-watcher%2Fcore.txt%2Fremoved%2F0.0.0.0%2F0/close" || r.query != "identifierType=alias" {
+		t.Errorf("close request = %+v", r)
+	}
+}
+
+func TestNewOpsgenieSinkErrors(t *testing.T) {
+	t.Setenv("OPSGENIE_TEST_KEY", "g3n1e")
+	for _, spec := range []string{
+		"opsgenie://",
+		"opsgenie://?key-env=OPSGENIE_TEST_KEY&priority=P6",
+		"opsgenie://?key-env=OPSGENIE_TEST_KEY&critical-priority=high",
+		"opsgenie://?key-env=OPSGENIE_TEST_KEY&resolve-after=later",
+	} {
+		if _, err := newSink(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Defaults of outboxes
+const (
+	DefaultOutboxRetention = 24 * time.Hour
+	DefaultOutboxHighWater = 10000
+)
+
+// Waits between attempts to deliver an outbox's oldest change set
+const (
+	outboxMinBackoff = time.Second
+	outboxMaxBackoff = time.Minute
+)
+
+// OutboxSink makes the deliveries to a sink durable. A change set is
+// accepted once it is written to the sink's outbox directory, and delivered
+// from there in order by Run, which retries the oldest one until the sink
+// takes it, so change sets made while the sink is down reach it when it is
+// back, across restarts. Delivery is at least once: a change set delivered
+// just before a crash may be delivered again.
+//
+// Change sets older than Retention, or beyond HighWater of them, are moved
+// to the dead-letter queue, if there is one, or dropped, so a sink that
+// stays down doesn't fill the disk.
+type OutboxSink struct {
+	sink    Sink
+	letters *letterDir
+	dlq     *DeadLetterQueue
+	// Retention is how long a change set is kept for delivery; zero is
+	// forever
+	Retention time.Duration
+	// HighWater is the most change sets kept; zero is no limit
+	HighWater int
+
+	// sending is held while change sets are delivered or given up on, so
+	// Flush and Run take turns
+	sending sync.Mutex
+	mu      sync.Mutex
+	// queue holds the change sets waiting, oldest first, as on disk
+	queue []*DeadLetter
+	wake  chan struct{}
+	now   func() time.Time
+}
+
+// NewOutboxSink wraps sink in an outbox in dir, taking up the change sets
+// left there by an earlier run; dlq may be nil
+func NewOutboxSink(sink Sink, dir string, dlq *DeadLetterQueue) (*OutboxSink, error) {
+	letters, err := openLetterDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open outbox: %w", err)
+	}
+	queue, err := letters.list()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox: %w", err)
+	}
+	o := &OutboxSink{
+		sink:      sink,
+		letters:   letters,
+		dlq:       dlq,
+		Retention: DefaultOutboxRetention,
+		HighWater: DefaultOutboxHighWater,
+		queue:     queue,
+		wake:      make(chan struct{}, 1),
+		now:       time.Now,
+	}
+	o.depth().Set(int64(len(queue)))
+	if len(queue) > 0 {
+		slog.Info("resuming outbox", "sink", sink.Name(), "changesets", len(queue))
+	}
+	return o, nil
+}
+
+// outboxPath returns the outbox directory of sink under dir
+func outboxPath(dir string, sink Sink) string {
+	return filepath.Join(dir, sanitizeName(sink.Name()))
+}
+
+func (o *OutboxSink) Name() string { return o.sink.Name() }
+
+func (o *OutboxSink) recordsHistory() bool { return recordsHistory(o.sink) }
+
+func (o *OutboxSink) depth() *Gauge {
+	return metrics.Gauge("outbox_depth", "Change sets waiting in outboxes", "sink", o.sink.Name())
+}
+
+// Deliver writes cs to the outbox; it fails only if that does
+func (o *OutboxSink) Deliver(ctx context.Context, cs *ChangeSet) error {
+	dl := o.letters.newLetter(o.sink.Name(), cs)
+	if err := o.letters.write(dl); err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	o.mu.Lock()
+	o.queue = append(o.queue, dl)
+	n := len(o.queue)
+	o.mu.Unlock()
+	o.depth().Set(int64(n))
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run delivers the change sets of the outbox until ctx is done, waiting
+// longer between attempts while the sink keeps failing
+func (o *OutboxSink) Run(ctx context.Context) {
+	backoff := outboxMinBackoff
+	for {
+		if err := o.send(ctx); err == nil {
+			backoff = outboxMinBackoff
+			select {
+			case <-o.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		} else if ctx.Err() == nil {
+			slog.Warn("outbox delivery failed; will retry", "sink", o.sink.Name(), "err", err, "retry_in", backoff)
+		}
+		select {
+		case <-time.After(backoff):
+			backoff = min(2*backoff, outboxMaxBackoff)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// send gives up on the change sets past the retention or high-water
+// mark, then delivers the others
+func (o *OutboxSink) send(ctx context.Context) error {
+	o.sending.Lock()
+	defer o.sending.Unlock()
+	o.expire()
+	return o.drain(ctx)
+}
+
+// drain delivers the change sets of the outbox in order, stopping at the
+// first that fails
+func (o *OutboxSink) drain(ctx context.Context) error {
+	for ctx.Err() == nil {
+		o.mu.Lock()
+		if len(o.queue) == 0 {
+			o.mu.Unlock()
+			return nil
+		}
+		dl := o.queue[0]
+		o.mu.Unlock()
+
+		sctx, span := startClientSpan(ctx, "deliver", "sink", o.sink.Name(), "changeset.id", dl.Payload.ID, "changes", dl.Payload.Len(), "outbox.attempts", dl.Attempts)
+		err := o.sink.Deliver(sctx, dl.Payload)
+		span.End(err)
+		if err != nil {
+			metrics.Counter("sink_delivery_failures_total", "Change sets sinks failed to accept", "sink", o.sink.Name()).Inc()
+			dl.Attempts++
+			dl.Reason = err.Error()
+			if werr := o.letters.write(dl); werr != nil {
+				slog.Warn("failed to update outbox", "sink", o.sink.Name(), "err", werr)
+			}
+			return err
+		}
+		metrics.Counter("sink_deliveries_total", "Change sets delivered to sinks", "sink", o.sink.Name()).Inc()
+		o.pop()
+		if err := o.letters.remove(dl.ID); err != nil {
+			slog.Warn("failed to remove delivered change set from outbox; it will be delivered again", "sink", o.sink.Name(), "id", dl.ID, "err", err)
+		}
+	}
+	return ctx.Err()
+}
+
+// pop removes the change set at the front of the queue, just delivered
+func (o *OutboxSink) pop() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.queue = o.queue[1:]
+	o.depth().Set(int64(len(o.queue)))
+}
+
+// expire moves the change sets past the retention or the high-water mark
+// to the dead-letter queue. Deliver can add to the queue meanwhile, but
+// only drain takes from it.
+func (o *OutboxSink) expire() {
+	o.mu.Lock()
+	var evicted []*DeadLetter
+	now := o.now()
+	for len(o.queue) > 0 {
+		dl := o.queue[0]
+		old := o.Retention > 0 && now.Sub(dl.Time) > o.Retention
+		over := o.HighWater > 0 && len(o.queue) > o.HighWater
+		if !old && !over {
+			break
+		}
+		evicted = append(evicted, dl)
+		o.queue = o.queue[1:]
+	}
+	o.depth().Set(int64(len(o.queue)))
+	o.mu.Unlock()
+
+	if len(evicted) == 0 {
+		return
+	}
+	metrics.Counter("outbox_evicted_total", "Change sets given up on for being too old or too many", "sink", o.sink.Name()).Add(int64(len(evicted)))
+	slog.Warn("outbox over its retention or high-water mark", "sink", o.sink.Name(), "evicted", len(evicted), "dead_lettered", o.dlq != nil)
+	for _, dl := range evicted {
+		if dl.Reason == "" {
+			dl.Reason = "not attempted"
+		}
+		dl.Reason = fmt.Sprintf("outbox full or past retention after %d attempts: %s", dl.Attempts, dl.Reason)
+		if o.dlq != nil {
+			if err := o.dlq.add(dl); err != nil {
+				slog.Error("failed to dead-letter change set from outbox", "sink", o.sink.Name(), "id", dl.ID, "err", err)
+				continue
+			}
+		}
+		if err := o.letters.remove(dl.ID); err != nil {
+			slog.Warn("failed to remove change set from outbox", "sink", o.sink.Name(), "id", dl.ID, "err", err)
+		}
+	}
+}
+
+// Flush makes one attempt to deliver what the outbox holds, then has the
+// sink send any change sets it holds back
+func (o *OutboxSink) Flush(ctx context.Context) error {
+	if err := o.send(ctx); err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	if f, ok := o.sink.(flusher); ok {
+		return f.Flush(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOutboxSink(t *testing.T) {
+	dir := t.TempDir()
+	sink := &fakeSink{name: "hook", err: errors.New("connection refused")}
+	o, err := NewOutboxSink(sink, outboxPath(dir, sink), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, dest := range []string{"10.0.0.0/8", "0.0.0.0/0"} {
+		cs := &ChangeSet{Path: "t.txt", Changes: []Change{{Type: ChangeAdded, Destination: dest}}}
+		if err := o.Deliver(ctx, cs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.send(ctx); err == nil {
+		t.Fatal("sink down: no error")
+	}
+
+	// After a restart, the change sets left are delivered in order
+	sink.err = nil
+	if o, err = NewOutboxSink(sink, outboxPath(dir, sink), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got := sink.delivered()
+	if len(got) != 2 || got[0].Changes[0].Destination != "10.0.0.0/8" || got[1].Changes[0].Destination != "0.0.0.0/0" {
+		t.Fatalf("delivered = %+v", got)
+	}
+	if left, _ := o.letters.list(); len(left) != 0 || len(o.queue) != 0 {
+		t.Errorf("outbox still holds %d, %d", len(left), len(o.queue))
+	}
+}
+
+func TestOutboxRun(t *testing.T) {
+	sink := &fakeSink{name: "hook"}
+	o, err := NewOutboxSink(sink, t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go o.Run(ctx)
+	if err := o.Deliver(ctx, &ChangeSet{Path: "t.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.delivered()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("change set not delivered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOutboxEviction(t *testing.T) {
+	dir := t.TempDir()
+	dlq, err := OpenDeadLetterQueue(filepath.Join(dir, "dlq"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &fakeSink{name: "hook", err: errors.New("connection refused")}
+	o, err := NewOutboxSink(sink, filepath.Join(dir, "outbox"), dlq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Retention, o.HighWater = time.Hour, 2
+	ctx := context.Background()
+	for _, dest := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"} {
+		if err := o.Deliver(ctx, &ChangeSet{Path: "t.txt", Changes: []Change{{Type: ChangeAdded, Destination: dest}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o.send(ctx)
+	letters, _ := dlq.List()
+	if len(letters) != 1 || letters[0].Payload.Changes[0].Destination != "10.0.0.0/8" || letters[0].Sink != "hook" {
+		t.Fatalf("dead letters over the high-water mark = %+v", letters)
+	}
+
+	// Two hours later, the rest are past the retention
+	o.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	o.send(ctx)
+	if letters, _ = dlq.List(); len(letters) != 3 || letters[1].Attempts != 1 || letters[2].Attempts != 0 {
+		t.Fatalf("dead letters past the retention = %+v", letters)
+	}
+	if left, _ := o.letters.list(); len(left) != 0 {
+		t.Errorf("outbox still holds %d", len(left))
+	}
+}
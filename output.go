@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats of watch mode
+const (
+	OutputText     = "text"
+	OutputJSON     = "json"
+	OutputJSONL    = "jsonl"
+	OutputYAML     = "yaml"
+	OutputCSV      = "csv"
+	OutputProtobuf = "protobuf"
+)
+
+// checkOutput validates an -output format
+func checkOutput(format string) error {
+	switch format {
+	case OutputText, OutputJSON, OutputJSONL, OutputYAML, OutputCSV, OutputProtobuf:
+		return nil
+	}
+	return fmt.Errorf("unknown -output %q (want text, json, jsonl, yaml, csv or protobuf)", format)
+}
+
+// objectWriter writes reports as objects in one of the structured -output
+// formats to a writer shared by several targets, one whole object at a
+// time. With OutputJSONL each object is written on one line, and change
+// sets are written as one object per change; with OutputYAML each object
+// is a YAML document. OutputCSV writes a row per change instead, under
+// csvHeader, OutputProtobuf a delimited Changeset message (see
+// proto/changes.proto) per change set, and a writer with a template writes a line per change
+// formatted by it.
+type objectWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+	// header is set once the CSV header has been written
+	header bool
+	tmpl   *template.Template
+	// times formats and zones the timestamps written
+	times TimeFormat
+}
+
+// newObjectWriter creates a writer of format, which must be OutputJSON,
+// OutputJSONL, OutputYAML, OutputCSV or OutputProtobuf
+func newObjectWriter(w io.Writer, format string) *objectWriter {
+	return &objectWriter{w: w, format: format}
+}
+
+// newTemplateWriter creates a writer that formats each change with tmpl
+func newTemplateWriter(w io.Writer, tmpl *template.Template) *objectWriter {
+	return &objectWriter{w: w, tmpl: tmpl}
+}
+
+// write writes v in the writer's format
+func (o *objectWriter) write(v any) error {
+	var data []byte
+	var err error
+	switch o.format {
+	case OutputJSONL:
+		data, err = json.Marshal(v)
+	case OutputYAML:
+		data, err = marshalYAML(v)
+	default:
+		data, err = json.MarshalIndent(v, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+	if o.format == OutputYAML {
+		data = append([]byte("---\n"), data...)
+	} else {
+		data = append(data, '\n')
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	_, err = o.w.Write(data)
+	return err
+}
+
+// marshalYAML encodes v as YAML with the field names and order of its JSON
+// encoding. JSON is valid YAML, so the JSON is parsed as YAML and written
+// back out in block style.
+func marshalYAML(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	blockStyle(&doc)
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// blockStyle clears the flow and quoting styles taken from JSON, except
+// for strings that would read back as another type unquoted
+func blockStyle(n *yaml.Node) {
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!str" {
+		n.Style = 0
+		var probe yaml.Node
+		if yaml.Unmarshal([]byte(n.Value), &probe) != nil || len(probe.Content) == 0 || probe.Content[0].Tag != "!!str" {
+			n.Style = yaml.DoubleQuotedStyle
+		}
+	} else {
+		n.Style = 0
+	}
+	for _, c := range n.Content {
+		blockStyle(c)
+	}
+}
+
+// jsonLoad is the result of loading a table, in -output json or yaml
+type jsonLoad struct {
+	Event  string    `json:"event"`
+	Time   time.Time `json:"time"`
+	Path   string    `json:"path"`
+	Routes int       `json:"routes"`
+	TookMS float64   `json:"took_ms"`
+}
+
+// jsonChanges is the result of a DetectChanges run, in -output json or
+// yaml. All changes are listed, volatile ones marked as such.
+type jsonChanges struct {
+	Event string `json:"event"`
+	*ChangeSet
+	Summary Summary `json:"summary"`
+	Groups  *Groups `json:"groups,omitempty"`
+	TookMS  float64 `json:"took_ms"`
+}
+
+// jsonChange is one change, in -output jsonl
+type jsonChange struct {
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	Path      string    `json:"path"`
+	Stream    string    `json:"stream,omitempty"`
+	ChangeSet uint64    `json:"changeset,omitempty"`
+	Change
+}
+
+// jsonChangeSet summarizes a change set after its changes, in -output
+// jsonl
+type jsonChangeSet struct {
+	Event       string    `json:"event"`
+	Time        time.Time `json:"time"`
+	Path        string    `json:"path"`
+	Stream      string    `json:"stream,omitempty"`
+	ID          uint64    `json:"id,omitempty"`
+	Changes     int       `json:"changes"`
+	Truncated   bool      `json:"truncated,omitempty"`
+	File        *FileMeta `json:"file,omitempty"`
+	MetaChanges []string  `json:"meta_changes,omitempty"`
+	Summary     Summary   `json:"summary"`
+	Groups      *Groups   `json:"groups,omitempty"`
+	TookMS      float64   `json:"took_ms"`
+}
+
+// jsonStatus is a progress or error message, in -output jsonl
+type jsonStatus struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+// loaded reports a table loaded in took
+func (o *objectWriter) loaded(path string, routes int, took time.Duration) error {
+	if o.format == OutputCSV || o.format == OutputProtobuf || o.tmpl != nil {
+		return nil
+	}
+	return o.write(jsonLoad{Event: "load", Time: o.times.In(time.Now()), Path: path, Routes: routes, TookMS: milliseconds(took)})
+}
+
+// changes reports a change set detected in took
+func (o *objectWriter) changes(cs *ChangeSet, took time.Duration) error {
+	if o.tmpl != nil {
+		return o.templateLines(cs)
+	}
+	switch o.format {
+	case OutputJSONL:
+		return o.changeLines(cs, took)
+	case OutputCSV:
+		return o.changeRows(cs)
+	case OutputProtobuf:
+		return o.changeProto(cs, took)
+	}
+	c := *cs
+	c.Time = o.times.In(cs.Time)
+	if c.Changes == nil {
+		// List no changes as [] rather than null
+		c.Changes = []Change{}
+	}
+	return o.write(jsonChanges{Event: "changes", ChangeSet: &c, Summary: cs.Summarize(took), Groups: changeGroups(cs), TookMS: milliseconds(took)})
+}
+
+// changeLines writes each change in cs, followed by a summary of the set.
+// A change set with nothing to report writes nothing.
+func (o *objectWriter) changeLines(cs *ChangeSet, took time.Duration) error {
+	if cs.Len() == 0 && !cs.Truncated && len(cs.MetaChanges) == 0 {
+		return nil
+	}
+	for _, c := range cs.Changes {
+		if err := o.write(jsonChange{Event: "change", Time: o.times.In(cs.Time), Path: cs.Path, Stream: cs.Stream, ChangeSet: cs.ID, Change: c}); err != nil {
+			return err
+		}
+	}
+	return o.write(jsonChangeSet{
+		Event:       "changeset",
+		Time:        o.times.In(cs.Time),
+		Path:        cs.Path,
+		Stream:      cs.Stream,
+		ID:          cs.ID,
+		Changes:     cs.Len(),
+		Truncated:   cs.Truncated,
+		File:        cs.File,
+		MetaChanges: cs.MetaChanges,
+		Summary:     cs.Summarize(took),
+		Groups:      changeGroups(cs),
+		TookMS:      milliseconds(took),
+	})
+}
+
+// changeGroups groups the notifiable changes in cs, or returns nil if
+// there are none
+func changeGroups(cs *ChangeSet) *Groups {
+	changes := cs.Notifiable()
+	if len(changes) == 0 {
+		return nil
+	}
+	return groupChanges(changes)
+}
+
+// csvHeader names the columns of -output csv
+var csvHeader = []string{"timestamp", "destination", "type", "old_hash", "new_hash", "path"}
+
+// changeRows writes a CSV row for each notifiable change in cs, preceded
+// by the header if this is the first row
+func (o *objectWriter) changeRows(cs *ChangeSet) error {
+	changes := cs.Notifiable()
+	if len(changes) == 0 {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	w := csv.NewWriter(o.w)
+	if !o.header {
+		w.Write(csvHeader)
+		o.header = true
+	}
+	ts := o.times.Format(cs.Time)
+	for _, c := range changes {
+		w.Write([]string{ts, c.Destination, string(c.Type), c.OldHash, c.NewHash, cs.Path})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// changeProto writes cs as a delimited Changeset message, unless it has
+// nothing to report
+func (o *objectWriter) changeProto(cs *ChangeSet, took time.Duration) error {
+	if cs.Len() == 0 && !cs.Truncated && len(cs.MetaChanges) == 0 {
+		return nil
+	}
+	s := cs.Summarize(took)
+	data := appendProtoDelimited(nil, marshalChangeSetProto(cs, &s))
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	_, err := o.w.Write(data)
+	return err
+}
+
+// TemplateChange is what a -template is executed with for each change:
+// the change's fields plus those of its change set. Time is Timestamp
+// formatted with -ts-format and -tz.
+type TemplateChange struct {
+	Change
+	Timestamp time.Time
+	Time      string
+	Path      string
+	ChangeSet uint64
+}
+
+// parseTemplate parses a -template
+func parseTemplate(text string) (*template.Template, error) {
+	return template.New("change").Parse(text)
+}
+
+// templateLines writes a line for each notifiable change in cs, adding
+// the newline if the template doesn't end with one
+func (o *objectWriter) templateLines(cs *ChangeSet) error {
+	var buf bytes.Buffer
+	for _, c := range cs.Notifiable() {
+		if err := o.tmpl.Execute(&buf, TemplateChange{Change: c, Timestamp: o.times.In(cs.Time), Time: o.times.Format(cs.Time), Path: cs.Path, ChangeSet: cs.ID}); err != nil {
+			return err
+		}
+		if !bytes.HasSuffix(buf.Bytes(), newline) {
+			buf.WriteByte('\n')
+		}
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	_, err := o.w.Write(buf.Bytes())
+	return err
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
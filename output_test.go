@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReportJSON(t *testing.T) {
+	var out, text bytes.Buffer
+	opts := ReportOptions{PreviewLimit: 10, Objects: newObjectWriter(&out, OutputJSON)}
+	if err := opts.Objects.loaded("t.txt", 2, 1500*time.Microsecond); err != nil {
+		t.Fatal(err)
+	}
+	cs := &ChangeSet{ID: 3, Path: "t.txt", Routes: 2, Changes: []Change{
+		{Seq: 7, Type: ChangeModified, Destination: "10.0.0.0/8", OldHash: "aa", NewHash: "bb"},
+		{Type: ChangeModified, Destination: "10.1.0.0/16", Volatile: true},
+	}}
+	reportChanges(&text, cs, time.Millisecond, opts)
+	reportChanges(&text, &ChangeSet{ID: 4, Path: "t.txt"}, time.Millisecond, opts)
+	if text.Len() != 0 {
+		t.Errorf("text report written alongside JSON: %q", text.String())
+	}
+
+	type object struct {
+		Event   string  `json:"event"`
+		Path    string  `json:"path"`
+		Routes  int     `json:"routes"`
+		ID      uint64  `json:"id"`
+		TookMS  float64 `json:"took_ms"`
+		Changes []Change
+		Summary Summary
+	}
+	var got []object
+	dec := json.NewDecoder(&out)
+	for {
+		var o object
+		if err := dec.Decode(&o); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, o)
+	}
+	if len(got) != 3 {
+		t.Fatalf("got %d objects, want 3", len(got))
+	}
+	if got[0].Event != "load" || got[0].Routes != 2 || got[0].TookMS != 1.5 {
+		t.Errorf("load = %+v", got[0])
+	}
+	if c := got[1]; c.Event != "changes" || c.ID != 3 || len(c.Changes) != 2 || c.Changes[0].NewHash != "bb" || c.Changes[0].Seq != 7 {
+		t.Errorf("changes = %+v", c)
+	}
+	if s := got[1].Summary; s != (Summary{Modified: 1, Volatile: 1, Routes: 2, TookMS: 1}) {
+		t.Errorf("summary = %+v", s)
+	}
+	if c := got[2]; c.Changes == nil || len(c.Changes) != 0 {
+		t.Errorf("empty change set = %+v", c)
+	}
+}
+
+func TestReportJSONLines(t *testing.T) {
+	var out bytes.Buffer
+	opts := ReportOptions{Objects: newObjectWriter(&out, OutputJSONL)}
+	log := slog.New(newStatusHandler(opts.Objects, slog.LevelInfo))
+	log.Info("detecting changes", "target", "t.txt")
+	log.Debug("not logged")
+	reportChanges(io.Discard, &ChangeSet{ID: 1, Path: "t.txt"}, time.Millisecond, opts)
+	reportChanges(io.Discard, &ChangeSet{ID: 2, Path: "t.txt", Changes: []Change{
+		{Seq: 1, Type: ChangeAdded, Destination: "10.0.0.0/8", NewHash: "aa"},
+		{Seq: 2, Type: ChangeRemoved, Destination: "10.1.0.0/16", OldHash: "bb"},
+	}}, time.Millisecond, opts)
+	log.Error("failed to detect changes", "target", "t.txt", "err", errors.New("boom"))
+
+	var got []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var o map[string]any
+		if err := json.Unmarshal([]byte(line), &o); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		got = append(got, o)
+	}
+	want := []struct{ event, key, value string }{
+		{"status", "message", "detecting changes target=t.txt"},
+		{"change", "destination", "10.0.0.0/8"},
+		{"change", "type", "removed"},
+		{"changeset", "path", "t.txt"},
+		{"status", "level", "error"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d:\n%s", len(got), len(want), out.String())
+	}
+	for i, w := range want {
+		if got[i]["event"] != w.event || got[i][w.key] != w.value {
+			t.Errorf("event %d = %v, want %s with %s %q", i, got[i], w.event, w.key, w.value)
+		}
+	}
+	if got[3]["changes"] != float64(2) {
+		t.Errorf("changeset = %v", got[3])
+	}
+	if got[4]["message"] != "failed to detect changes target=t.txt err=boom" {
+		t.Errorf("status = %v", got[4])
+	}
+}
+
+func TestReportYAML(t *testing.T) {
+	var out bytes.Buffer
+	opts := ReportOptions{Objects: newObjectWriter(&out, OutputYAML)}
+	reportChanges(io.Discard, &ChangeSet{ID: 5, Path: "t.txt", Changes: []Change{
+		{Seq: 1, Type: ChangeModified, Destination: "10.0.0.0/8", OldHash: "aa", NewHash: "123"},
+	}}, time.Millisecond, opts)
+	reportChanges(io.Discard, &ChangeSet{ID: 6, Path: "t.txt"}, time.Millisecond, opts)
+
+	docs := strings.Split(strings.TrimPrefix(out.String(), "---\n"), "---\n")
+	if len(docs) != 2 {
+		t.Fatalf("got %d documents:\n%s", len(docs), out.String())
+	}
+	for _, want := range []string{
+		"event: changes\n",
+		"id: 5\n",
+		"changes:\n  - seq: 1\n    type: modified\n    destination: 10.0.0.0/8\n",
+		// A hash that looks like a number stays a string
+		`new_hash: "123"` + "\n",
+	} {
+		if !strings.Contains(docs[0], want) {
+			t.Errorf("document lacks %q:\n%s", want, docs[0])
+		}
+	}
+	if !strings.Contains(docs[1], "changes: []\n") {
+		t.Errorf("empty change set:\n%s", docs[1])
+	}
+}
+
+func TestReportCSV(t *testing.T) {
+	var out bytes.Buffer
+	opts := ReportOptions{Objects: newObjectWriter(&out, OutputCSV)}
+	if err := opts.Objects.loaded("t.txt", 2, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	reportChanges(io.Discard, &ChangeSet{ID: 1, Path: "t.txt", Time: at, Changes: []Change{
+		{Type: ChangeModified, Destination: "10.0.0.0/8", OldHash: "aa", NewHash: "bb"},
+		{Type: ChangeModified, Destination: "10.1.0.0/16", OldHash: "cc", NewHash: "dd", Volatile: true},
+	}}, time.Millisecond, opts)
+	reportChanges(io.Discard, &ChangeSet{ID: 2, Path: "t,2.txt", Time: at, Changes: []Change{
+		{Type: ChangeAdded, Destination: "0.0.0.0/0", NewHash: "ee"},
+	}}, time.Millisecond, opts)
+
+	want := "timestamp,destination,type,old_hash,new_hash,path\n" +
+		"2024-05-01T12:00:00Z,10.0.0.0/8,modified,aa,bb,t.txt\n" +
+		"2024-05-01T12:00:00Z,0.0.0.0/0,added,,ee,\"t,2.txt\"\n"
+	if out.String() != want {
+		t.Errorf("csv =\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestReportTemplate(t *testing.T) {
+	tmpl, err := parseTemplate(`{{.Timestamp.Format "2006-01-02"}} {{.Destination}} {{.Type}}{{if .OldHash}} was {{.OldHash}}{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	opts := ReportOptions{Objects: newTemplateWriter(&out, tmpl)}
+	if err := opts.Objects.loaded("t.txt", 2, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	reportChanges(io.Discard, &ChangeSet{Path: "t.txt", Time: at, Changes: []Change{
+		{Type: ChangeRemoved, Destination: "10.0.0.0/8", OldHash: "aa"},
+		{Type: ChangeModified, Destination: "10.1.0.0/16", Volatile: true},
+		{Type: ChangeAdded, Destination: "10.2.0.0/16", NewHash: "bb"},
+	}}, time.Millisecond, opts)
+
+	want := "2024-05-01 10.0.0.0/8 removed was aa\n2024-05-01 10.2.0.0/16 added\n"
+	if out.String() != want {
+		t.Errorf("output =\n%s\nwant\n%s", out.String(), want)
+	}
+
+	if _, err := parseTemplate("{{.Destination"); err == nil {
+		t.Error("parsed a broken template")
+	}
+}
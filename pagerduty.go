@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+// pagerDutyAPI is the Events API v2 endpoint
+var pagerDutyAPI = "https://events.pagerduty.com/v2/enqueue"
+
+func init() {
+	sinkFactories["pagerduty"] = func(u *url.URL) (Sink, error) {
+		return newPagerDutySink(u)
+	}
+}
+
+// PagerDutySink triggers PagerDuty incidents through the Events API v2
+// when an alert condition fires, and resolves them when it clears. The
+// spec is pagerduty://?key-env=VAR (or key-file) with the integration's
+// routing key, the parameters of alertConditions and
+//
+//	severity  critical, error, warning or info (default critical)
+//	link      the web UI's address, linked from incidents
+//
+// plus the webhook sink's timeout, retries and backoff. Conditions' keys
+// are the incidents' dedup keys, so PagerDuty folds repeated triggers
+// into one incident.
+type PagerDutySink struct {
+	alertConditions
+	name     string
+	key      string
+	post     *WebhookSink
+	severity string
+	link     string
+	source   string
+}
+
+func newPagerDutySink(u *url.URL) (*PagerDutySink, error) {
+	s := &PagerDutySink{name: sinkName(u), severity: "critical"}
+	s.open, s.close, s.service = s.trigger, s.resolve, "PagerDuty"
+	q := u.Query()
+	key, err := readSecret(q, "key")
+	if err != nil {
+		return nil, fmt.Errorf("pagerduty sink %s: %w", s.name, err)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("pagerduty sink %s: needs the routing key in key-env or key-file", s.name)
+	}
+	s.key = string(key)
+	if err := s.alertConditions.parse(q); err != nil {
+		return nil, fmt.Errorf("pagerduty sink %s: %w", s.name, err)
+	}
+	if err := s.parse(q); err != nil {
+		return nil, fmt.Errorf("pagerduty sink %s: %w", s.name, err)
+	}
+	if s.source, err = os.Hostname(); err != nil {
+		s.source = "go-watcher"
+	}
+
+	target, err := url.Parse(pagerDutyAPI)
+	if err != nil {
+		return nil, err
+	}
+	// One event at a time, so a resolve can't overtake its trigger
+	q.Set("concurrency", "1")
+	if s.post, err = newPoster(s.name, target, q); err != nil {
+		return nil, fmt.Errorf("pagerduty sink %s: %w", s.name, err)
+	}
+	return s, nil
+}
+
+// parse takes the sink's event options from q
+func (s *PagerDutySink) parse(q url.Values) error {
+	if v := q.Get("severity"); v != "" {
+		switch v {
+		case "critical", "error", "warning", "info":
+			s.severity = v
+		default:
+			return fmt.Errorf("unknown severity %q (want critical, error, warning or info)", v)
+		}
+	}
+	s.link = q.Get("link")
+	q.Del("severity")
+	q.Del("link")
+	return nil
+}
+
+func (s *PagerDutySink) Name() string { return s.name }
+
+// Deliver checks the alert conditions against cs
+func (s *PagerDutySink) Deliver(ctx context.Context, cs *ChangeSet) error {
+	return s.check(ctx, cs)
+}
+
+// trigger triggers the incident of a
+func (s *PagerDutySink) trigger(ctx context.Context, a *alert) error {
+	details := map[string]any{"changeset": a.cs.ID, "routes_in_table": a.cs.Routes, "destinations": a.Destinations}
+	if a.Unlisted > 0 {
+		details["destinations_not_listed"] = a.Unlisted
+	}
+	return s.send(ctx, pagerDutyEvent{
+		Action: "trigger",
+		Key:    a.Key,
+		Payload: &pagerDutyPayload{
+			Summary:   a.Summary,
+			Source:    s.source,
+			Severity:  s.severity,
+			Component: a.cs.Path,
+			Class:     a.Class,
+			Details:   details,
+		},
+	})
+}
+
+// resolve resolves the incident of key
+func (s *PagerDutySink) resolve(ctx context.Context, key string) error {
+	return s.send(ctx, pagerDutyEvent{Action: "resolve", Key: key})
+}
+
+// pagerDutyEvent is an Events API v2 event
+type pagerDutyEvent struct {
+	RoutingKey string            `json:"routing_key"`
+	Action     string            `json:"event_action"`
+	Key        string            `json:"dedup_key"`
+	Payload    *pagerDutyPayload `json:"payload,omitempty"`
+	Client     string            `json:"client,omitempty"`
+	ClientURL  string            `json:"client_url,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary   string         `json:"summary"`
+	Source    string         `json:"source"`
+	Severity  string         `json:"severity"`
+	Component string         `json:"component,omitempty"`
+	Class     string         `json:"class,omitempty"`
+	Details   map[string]any `json:"custom_details,omitempty"`
+}
+
+// send posts e with the sink's routing key
+func (s *PagerDutySink) send(ctx context.Context, e pagerDutyEvent) error {
+	e.RoutingKey = s.key
+	e.Client, e.ClientURL = "go-watcher", s.link
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+	return s.post.send(ctx, body)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pagerDutyServer stands in for the Events API, returning the events
+// received so far
+func pagerDutyServer(t *testing.T) func() []pagerDutyEvent {
+	var mu sync.Mutex
+	var events []pagerDutyEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		var e pagerDutyEvent
+		if err := json.Unmarshal(data, &e); err != nil {
+			t.Errorf("invalid event %s: %v", data, err)
+		}
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, `{"status": "success"}`)
+	}))
+	t.Cleanup(srv.Close)
+	api := pagerDutyAPI
+	pagerDutyAPI = srv.URL
+	t.Cleanup(func() { pagerDutyAPI = api })
+	t.Setenv("PD_TEST_KEY", "R0UT1NG")
+	return func() []pagerDutyEvent {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]pagerDutyEvent(nil), events...)
+	}
+}
+
+// waitEvents waits for n events to arrive
+func waitEvents(t *testing.T, events func() []pagerDutyEvent, n int) []pagerDutyEvent {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(events()) < n && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	got := events()
+	if len(got) != n {
+		t.Fatalf("%d events, want %d: %+v", len(got), n, got)
+	}
+	return got
+}
+
+func TestPagerDutySinkRemoved(t *testing.T) {
+	events := pagerDutyServer(t)
+	sink, err := newSink("pagerduty://?key-env=PD_TEST_KEY&resolve-after=20ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	removed := &ChangeSet{ID: 1, Path: "core.txt", Changes: []Change{
+		{Type: ChangeRemoved, Destination: "0.0.0.0/0"},
+		{Type: ChangeRemoved, Destination: "10.0.0.0/8"},
+	}}
+	back := &ChangeSet{ID: 2, Path: "core.txt", Changes: []Change{{Type: ChangeAdded, Destination: "0.0.0.0/0"}}}
+
+	if err := sink.Deliver(ctx, removed); err != nil {
+		t.Fatal(err)
+	}
+	got := waitEvents(t, events, 1)
+	e := got[0]
+	if e.Action != "trigger" || e.RoutingKey != "R0UT1NG" || e.Key != "go-watcher/core.txt/removed/0.0.0.0/0" {
+		t.Errorf("event = %+v", e)
+	}
+	if e.Payload == nil || e.Payload.Summary != "0.0.0.0/0 removed from core.txt" || e.Payload.Severity != "critical" {
+		t.Errorf("payload = %+v", e.Payload)
+	}
+
+	// Flapping back and forth within resolve-after neither resolves nor
+	// pages again
+	for _, cs := range []*ChangeSet{back, removed} {
+		if err := sink.Deliver(ctx, cs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	waitEvents(t, events, 1)
+
+	if err := sink.Deliver(ctx, back); err != nil {
+		t.Fatal(err)
+	}
+	got = waitEvents(t, events, 2)
+	if e := got[1]; e.Action != "resolve" || e.Key != "go-watcher/core.txt/removed/0.0.0.0/0" || e.Payload != nil {
+		t.Errorf("event = %+v", e)
+	}
+}
+
+func TestPagerDutySinkWithdrawn(t *testing.T) {
+	events := pagerDutyServer(t)
+	sink, err := newSink("pagerduty://?key-env=PD_TEST_KEY&removed=&withdrawn=2&resolve-after=1ms&severity=warning")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	change := func(t ChangeType, dests ...string) *ChangeSet {
+		cs := &ChangeSet{Path: "core.txt"}
+		for _, d := range dests {
+			cs.Changes = append(cs.Changes, Change{Type: t, Destination: d})
+		}
+		return cs
+	}
+
+	// Under the threshold
+	if err := sink.Deliver(ctx, change(ChangeRemoved, "0.0.0.0/0", "10.1.0.0/16")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Deliver(ctx, change(ChangeRemoved, "10.2.0.0/16", "10.3.0.0/16", "10.4.0.0/16")); err != nil {
+		t.Fatal(err)
+	}
+	got := waitEvents(t, events, 1)
+	if e := got[0]; e.Key != "go-watcher/core.txt/withdrawn" || e.Payload.Summary != "3 routes withdrawn from core.txt" || e.Payload.Severity != "warning" {
+		t.Errorf("event = %+v", e)
+	}
+
+	// Still more than 2 missing
+	if err := sink.Deliver(ctx, change(ChangeAdded, "10.9.0.0/16", "10.1.0.0/16")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Deliver(ctx, change(ChangeRemoved, "10.5.0.0/16")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	waitEvents(t, events, 1)
+
+	if err := sink.Deliver(ctx, change(ChangeAdded, "10.3.0.0/16", "10.5.0.0/16")); err != nil {
+		t.Fatal(err)
+	}
+	got = waitEvents(t, events, 2)
+	if e := got[1]; e.Action != "resolve" || e.Key != "go-watcher/core.txt/withdrawn" {
+		t.Errorf("event = %+v", e)
+	}
+}
+
+func TestNewPagerDutySinkErrors(t *testing.T) {
+	t.Setenv("PD_TEST_KEY", "R0UT1NG")
+	for _, spec := range []string{
+		"pagerduty://",
+		"pagerduty://?key-env=PD_TEST_KEY&withdrawn=lots",
+		"pagerduty://?key-env=PD_TEST_KEY&severity=dire",
+		"pagerduty://?key-env=PD_TEST_KEY&removed=10.0.0.0/33%2B",
+	} {
+		if _, err := newSink(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
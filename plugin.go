@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PluginProtocol is the version of the plugin protocol spoken
+const PluginProtocol = 1
+
+// DefaultPluginTimeout is how long a plugin has to answer a request
+const DefaultPluginTimeout = 30 * time.Second
+
+// pluginPrefix is the prefix of plugin programs found on $PATH by name
+const pluginPrefix = "go-watcher-"
+
+// maxPluginResponse is the longest response line read from a plugin
+const maxPluginResponse = 64 << 20
+
+func init() {
+	sinkFactories["plugin"] = func(u *url.URL) (Sink, error) {
+		return newPluginSink(u)
+	}
+}
+
+// Plugin is an external program adding a sink or a filter without
+// patching go-watcher. It is started when first needed and kept running,
+// reading requests from its standard input and writing a response to each
+// on its standard output, one JSON object per line:
+//
+//	{"id": 1, "method": "configure", "params": {...}}
+//	{"id": 1, "result": {"protocol": 1}}
+//
+// A response has the request's id and either a result or, if the request
+// failed, an "error" string. The first request is configure, with params
+// protocol (PluginProtocol), kind ("sink" or "filter"), name and options,
+// the parameters given with the plugin; the plugin answers with the
+// protocol it speaks. Sinks are then sent deliver requests and filters
+// filter requests, one at a time, with a change set as params: as in the
+// audit log, plus each change's old_content and new_content. A sink's
+// result is ignored, and a filter's is {"drop": [...]}, the destinations
+// of the changes to leave out. A plugin that exits, writes anything else
+// to standard output or doesn't answer within the timeout is stopped, and
+// started again for the next request. Plugins should log to standard
+// error, which is go-watcher's, and exit at the end of their input.
+type Plugin struct {
+	kind    string
+	name    string
+	program string
+	options map[string]string
+	timeout time.Duration
+
+	// mu serializes requests
+	mu   sync.Mutex
+	proc *pluginProcess
+	id   uint64
+}
+
+// pluginProcess is a running plugin
+type pluginProcess struct {
+	cmd   *exec.Cmd
+	stdin *os.File
+	// lines receives the plugin's output, and is closed when it exits
+	lines chan []byte
+	done  chan struct{}
+}
+
+type pluginRequest struct {
+	ID     uint64 `json:"id"`
+	Method string `json:"method"`
+	Params any    `json:"params"`
+}
+
+type pluginResponse struct {
+	ID     uint64          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  string          `json:"error"`
+}
+
+// pluginChangeSet is a change set as sent to plugins
+type pluginChangeSet struct {
+	*ChangeSet
+	Changes []pluginChange `json:"changes"`
+	Summary Summary        `json:"summary"`
+}
+
+type pluginChange struct {
+	Change
+	OldContent string `json:"old_content,omitempty"`
+	NewContent string `json:"new_content,omitempty"`
+}
+
+// newPlugin builds a plugin of kind running program, a path or the name of
+// a go-watcher-NAME program on $PATH, with the options in q: its name and
+// timeout, and the plugin's own
+func newPlugin(kind, program string, q url.Values) (*Plugin, error) {
+	p := &Plugin{kind: kind, name: q.Get("name"), timeout: DefaultPluginTimeout, options: make(map[string]string)}
+	if program == "" {
+		return nil, errors.New("needs the plugin's name or path")
+	}
+	if p.name == "" {
+		p.name = strings.TrimPrefix(filepath.Base(program), pluginPrefix)
+	}
+	if !strings.ContainsRune(program, '/') && !strings.ContainsRune(program, filepath.Separator) {
+		program = pluginPrefix + program
+	}
+	var err error
+	if p.program, err = exec.LookPath(program); err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", p.name, err)
+	}
+	if v := q.Get("timeout"); v != "" {
+		if p.timeout, err = time.ParseDuration(v); err != nil || p.timeout <= 0 {
+			return nil, fmt.Errorf("plugin %s: invalid timeout %q", p.name, v)
+		}
+	}
+	for k := range q {
+		if k != "name" && k != "timeout" {
+			p.options[k] = q.Get(k)
+		}
+	}
+	return p, nil
+}
+
+// call sends a request to the plugin, starting it if it isn't running,
+// and decodes its result into result
+func (p *Plugin) call(ctx context.Context, method string, params, result any) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.proc == nil {
+		if err := p.start(ctx); err != nil {
+			return fmt.Errorf("plugin %s: %w", p.name, err)
+		}
+	}
+	if err := p.roundTrip(ctx, method, params, result); err != nil {
+		return fmt.Errorf("plugin %s: %w", p.name, err)
+	}
+	return nil
+}
+
+// start runs the plugin and configures it
+func (p *Plugin) start(ctx context.Context) error {
+	cmd := exec.Command(p.program)
+	cmd.Stderr = os.Stderr
+	// A pipe of our own, rather than StdinPipe, takes a write deadline, so
+	// a plugin that stops reading can't hold up deliveries
+	stdinR, stdin, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = stdinR
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		stdinR.Close()
+		stdin.Close()
+		return err
+	}
+	err = cmd.Start()
+	stdinR.Close()
+	if err != nil {
+		stdin.Close()
+		return fmt.Errorf("failed to start: %w", err)
+	}
+	proc := &pluginProcess{cmd: cmd, stdin: stdin, lines: make(chan []byte), done: make(chan struct{})}
+	go func() {
+		defer close(proc.lines)
+		defer cmd.Wait()
+		sc := bufio.NewScanner(stdout)
+		sc.Buffer(nil, maxPluginResponse)
+		for sc.Scan() {
+			select {
+			case proc.lines <- append([]byte(nil), sc.Bytes()...):
+			case <-proc.done:
+				return
+			}
+		}
+	}()
+	p.proc = proc
+	slog.Debug("started plugin", "plugin", p.name, "pid", cmd.Process.Pid)
+
+	var reply struct {
+		Protocol int `json:"protocol"`
+	}
+	params := map[string]any{"protocol": PluginProtocol, "kind": p.kind, "name": p.name, "options": p.options}
+	if err := p.roundTrip(ctx, "configure", params, &reply); err != nil {
+		p.stop()
+		return fmt.Errorf("failed to configure: %w", err)
+	}
+	if reply.Protocol != PluginProtocol {
+		p.stop()
+		return fmt.Errorf("speaks protocol %d, not %d", reply.Protocol, PluginProtocol)
+	}
+	return nil
+}
+
+// roundTrip sends a request and waits for its response, stopping the
+// plugin if it doesn't answer properly
+func (p *Plugin) roundTrip(ctx context.Context, method string, params, result any) error {
+	p.id++
+	req, err := json.Marshal(pluginRequest{ID: p.id, Method: method, Params: params})
+	if err != nil {
+		return fmt.Errorf("failed to encode %s request: %w", method, err)
+	}
+	// Pipes don't take deadlines everywhere; there the write just blocks
+	p.proc.stdin.SetWriteDeadline(time.Now().Add(p.timeout))
+	if _, err := p.proc.stdin.Write(append(req, '\n')); err != nil {
+		p.stop()
+		return fmt.Errorf("failed to send %s request: %w", method, err)
+	}
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	select {
+	case line, ok := <-p.proc.lines:
+		if !ok {
+			p.stop()
+			return errors.New("exited")
+		}
+		var resp pluginResponse
+		if err := json.Unmarshal(line, &resp); err != nil || resp.ID != p.id {
+			p.stop()
+			return fmt.Errorf("invalid response to %s: %.200q", method, line)
+		}
+		if resp.Error != "" {
+			return errors.New(resp.Error)
+		}
+		if result != nil && len(resp.Result) > 0 {
+			if err := json.Unmarshal(resp.Result, result); err != nil {
+				return fmt.Errorf("invalid result of %s: %w", method, err)
+			}
+		}
+		return nil
+	case <-timer.C:
+		p.stop()
+		return fmt.Errorf("no response to %s in %v", method, p.timeout)
+	case <-ctx.Done():
+		// The response would be taken for the next request's
+		p.stop()
+		return ctx.Err()
+	}
+}
+
+// stop kills the plugin
+func (p *Plugin) stop() {
+	if p.proc == nil {
+		return
+	}
+	close(p.proc.done)
+	p.proc.stdin.Close()
+	p.proc.cmd.Process.Kill()
+	p.proc = nil
+}
+
+// pluginParams returns cs as sent to plugins
+func pluginParams(cs *ChangeSet) pluginChangeSet {
+	params := pluginChangeSet{ChangeSet: cs, Changes: make([]pluginChange, len(cs.Changes)), Summary: cs.Summarize(0)}
+	for i, c := range cs.Changes {
+		params.Changes[i] = pluginChange{Change: c, OldContent: chunkText(c.Old), NewContent: chunkText(c.New)}
+	}
+	return params
+}
+
+// chunkText returns the text of chunk, or nothing if there is none or it
+// can't be read back
+func chunkText(chunk *Chunk) string {
+	if chunk == nil {
+		return ""
+	}
+	data, err := chunk.Content()
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// PluginSink delivers change sets through a sink plugin. The spec is
+// plugin://NAME for the program go-watcher-NAME on $PATH, or
+// plugin:///path/to/program, with the optional parameters name and
+// timeout (default 30s); the others are passed to the plugin.
+type PluginSink struct {
+	plugin *Plugin
+}
+
+func newPluginSink(u *url.URL) (*PluginSink, error) {
+	program := u.Host
+	if u.Host == "" {
+		program = u.Path
+	} else if u.Path != "" && u.Path != "/" {
+		return nil, fmt.Errorf("plugin sink %s: takes plugin://NAME or plugin:///path/to/program", u)
+	}
+	q := u.Query()
+	if q.Get("name") == "" {
+		q.Set("name", "plugin-"+strings.TrimPrefix(filepath.Base(program), pluginPrefix))
+	}
+	p, err := newPlugin("sink", program, q)
+	if err != nil {
+		return nil, fmt.Errorf("plugin sink: %w", err)
+	}
+	return &PluginSink{plugin: p}, nil
+}
+
+func (s *PluginSink) Name() string { return s.plugin.name }
+
+// Deliver sends cs to the plugin
+func (s *PluginSink) Deliver(ctx context.Context, cs *ChangeSet) error {
+	return s.plugin.call(ctx, "deliver", pluginParams(cs), nil)
+}
+
+// PluginFilter leaves out the changes a filter plugin drops, before they
+// are reported and delivered. If the plugin fails, no change is left out.
+type PluginFilter struct {
+	plugin *Plugin
+}
+
+// newPluginFilter builds the filter of a -filter-plugin spec: the name
+// of a go-watcher-NAME program on $PATH, or its path, with its parameters
+// as for a plugin sink, as in classify?mode=strict
+func newPluginFilter(spec string) (*PluginFilter, error) {
+	program, query, _ := strings.Cut(spec, "?")
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter plugin %q: %w", spec, err)
+	}
+	p, err := newPlugin("filter", program, q)
+	if err != nil {
+		return nil, err
+	}
+	return &PluginFilter{plugin: p}, nil
+}
+
+// Enrich asks the plugin which changes of cs to drop, and drops them
+func (f *PluginFilter) Enrich(ctx context.Context, cs *ChangeSet) error {
+	if len(cs.Changes) == 0 {
+		return nil
+	}
+	var result struct {
+		Drop []string `json:"drop"`
+	}
+	if err := f.plugin.call(ctx, "filter", pluginParams(cs), &result); err != nil {
+		return err
+	}
+	if len(result.Drop) == 0 {
+		return nil
+	}
+	drop := make(map[string]bool, len(result.Drop))
+	for _, dest := range result.Drop {
+		drop[dest] = true
+	}
+	kept := cs.Changes[:0]
+	for _, c := range cs.Changes {
+		if !drop[c.Destination] {
+			kept = append(kept, c)
+		}
+	}
+	slog.Debug("plugin dropped changes", "plugin", f.plugin.name, "path", cs.Path, "dropped", len(cs.Changes)-len(kept))
+	cs.Changes = kept
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writePlugin writes a plugin script named name to dir, answering each
+// request as the case arms in cases do, with $id set to its ID, and
+// logging every request to the file log
+func writePlugin(t *testing.T, dir, name, log, cases string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("uses /bin/sh")
+	}
+	script := `#!/bin/sh
+while IFS= read -r line; do
+  printf '%s\n' "$line" >> '` + log + `'
+  id=$(printf '%s\n' "$line" | sed 's/^{"id":\([0-9]*\),.*/\1/')
+  case "$line" in
+` + cases + `
+  *'"method":"configure"'*) echo "{\"id\":$id,\"result\":{\"protocol\":1}}" ;;
+  *) echo "{\"id\":$id}" ;;
+  esac
+done
+`
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// pluginChangeSetSample returns a change set with a change of each type
+func pluginChangeSetSample(t *testing.T) *ChangeSet {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"), routeBlock("0.0.0.0/0", "Static", "172.31.0.254"))
+	rt := loadTable(t, path)
+	return &ChangeSet{Stream: "s", ID: 3, Path: path, Routes: 2, Changes: []Change{
+		{Seq: 1, Type: ChangeAdded, Destination: "10.0.0.0/8", New: rt.Chunks["10.0.0.0/8"]},
+		{Seq: 2, Type: ChangeModified, Destination: "0.0.0.0/0", Old: rt.Chunks["0.0.0.0/0"], New: rt.Chunks["0.0.0.0/0"]},
+		{Seq: 3, Type: ChangeRemoved, Destination: "192.0.2.0/24"},
+	}}
+}
+
+func TestPluginSink(t *testing.T) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+	writePlugin(t, dir, "go-watcher-tickets", log, `  *'"destination":"203.0.113.0/24"'*) echo "{\"id\":$id,\"error\":\"ticket system down\"}" ;;`)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	s, err := newSink("plugin://tickets?queue=noc&timeout=5s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Name() != "plugin-tickets" {
+		t.Errorf("name = %q", s.Name())
+	}
+	ctx := context.Background()
+	cs := pluginChangeSetSample(t)
+	for range 2 {
+		if err := s.Deliver(ctx, cs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	failing := &ChangeSet{Path: "t.txt", Changes: []Change{{Seq: 1, Type: ChangeAdded, Destination: "203.0.113.0/24"}}}
+	if err := s.Deliver(ctx, failing); err == nil || err.Error() != "plugin plugin-tickets: ticket system down" {
+		t.Errorf("failed delivery: %v", err)
+	}
+
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("plugin got %d requests, want configure and 3 deliveries:\n%s", len(lines), data)
+	}
+	if want := `{"id":1,"method":"configure","params":{"kind":"sink","name":"plugin-tickets","options":{"queue":"noc"},"protocol":1}}`; lines[0] != want {
+		t.Errorf("configure = %s, want %s", lines[0], want)
+	}
+	for _, want := range []string{`{"id":2,"method":"deliver"`, `"destination":"10.0.0.0/8"`, `"new_content":"Destination: 10.0.0.0/8`, `"summary":{"added":1,"removed":1,"modified":1`} {
+		if !strings.Contains(lines[1], want) {
+			t.Errorf("deliver request lacks %s: %s", want, lines[1])
+		}
+	}
+}
+
+func TestPluginRestart(t *testing.T) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+	// The plugin exits on its second delivery, and hangs on a third
+	path := writePlugin(t, dir, "flaky", log, `  *'"destination":"192.0.2.2/32"'*) exit 1 ;;
+  *'"destination":"192.0.2.3/32"'*) exec sleep 5 ;;`)
+	s, err := newSink("plugin://" + path + "?timeout=200ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Name() != "plugin-flaky" {
+		t.Errorf("name = %q", s.Name())
+	}
+	ctx := context.Background()
+	deliver := func(dest string) error {
+		return s.Deliver(ctx, &ChangeSet{Path: "t.txt", Changes: []Change{{Seq: 1, Type: ChangeAdded, Destination: dest}}})
+	}
+	if err := deliver("192.0.2.1/32"); err != nil {
+		t.Fatal(err)
+	}
+	if err := deliver("192.0.2.2/32"); err == nil || !strings.HasSuffix(err.Error(), ": exited") {
+		t.Errorf("plugin exiting: %v", err)
+	}
+	start := time.Now()
+	if err := deliver("192.0.2.3/32"); err == nil || !strings.Contains(err.Error(), "no response to deliver in 200ms") {
+		t.Errorf("plugin hanging: %v", err)
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("hanging plugin stopped after %v", took)
+	}
+	if err := deliver("192.0.2.1/32"); err != nil {
+		t.Errorf("after restart: %v", err)
+	}
+	data, _ := os.ReadFile(log)
+	if n := strings.Count(string(data), `"method":"configure"`); n != 3 {
+		t.Errorf("plugin configured %d times, want 3:\n%s", n, data)
+	}
+}
+
+func TestPluginFilter(t *testing.T) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+	path := writePlugin(t, dir, "classify", log, `  *'"method":"filter"'*) echo "{\"id\":$id,\"result\":{\"drop\":[\"0.0.0.0/0\",\"198.51.100.0/24\"]}}" ;;`)
+	f, err := newPluginFilter(path + "?mode=strict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := pluginChangeSetSample(t)
+	if err := f.Enrich(context.Background(), cs); err != nil {
+		t.Fatal(err)
+	}
+	if got := changeSummary(cs); strings.Join(got, ", ") != "added 10.0.0.0/8, removed 192.0.2.0/24" {
+		t.Errorf("changes kept: %v", got)
+	}
+	data, _ := os.ReadFile(log)
+	if !strings.Contains(string(data), `"kind":"filter","name":"classify","options":{"mode":"strict"}`) {
+		t.Errorf("configure request: %s", data)
+	}
+
+	// A plugin of another protocol isn't used, and drops nothing
+	old := writePlugin(t, dir, "old", log, `  *'"method":"configure"'*) echo "{\"id\":$id,\"result\":{\"protocol\":2}}" ;;`)
+	if f, err = newPluginFilter(old); err != nil {
+		t.Fatal(err)
+	}
+	cs = pluginChangeSetSample(t)
+	if err := f.Enrich(context.Background(), cs); err == nil || !strings.Contains(err.Error(), "speaks protocol 2, not 1") || len(cs.Changes) != 3 {
+		t.Errorf("plugin of protocol 2: %v, %d changes kept", err, len(cs.Changes))
+	}
+}
+
+func TestNewPluginErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := writePlugin(t, dir, "p", filepath.Join(dir, "log"), "")
+	t.Setenv("PATH", dir)
+	for _, spec := range []string{
+		"plugin://",
+		"plugin://missing",
+		"plugin://p/extra",
+		"plugin://" + filepath.ToSlash(filepath.Join(dir, "none")),
+		"plugin:///" + strings.TrimPrefix(filepath.ToSlash(path), "/") + "?timeout=0s",
+	} {
+		if _, err := newSink(spec); err == nil {
+			t.Errorf("%s: no error", spec)
+		}
+	}
+	if _, err := newPluginFilter("missing?x=1"); err == nil {
+		t.Error("filter missing: no error")
+	}
+	if _, err := newPluginFilter("p?x=%zz"); err == nil {
+		t.Error("filter with a bad query: no error")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// DefaultPollInterval is how often a PollWatcher checks the file
+const DefaultPollInterval = 2 * time.Second
+
+// PollWatcher detects changes by checking the file's size and modification
+// time on an interval. It works on filesystems where fsnotify raises no
+// events, at the cost of up to one interval of latency.
+type PollWatcher struct {
+	// VerifyContent also hashes the file on every check, catching changes
+	// that leave the size and modification time alone, as attribute
+	// caching on network filesystems can
+	VerifyContent bool
+	// WatchMetadata also reports changes to the file's mode or owner
+	WatchMetadata bool
+
+	filePath string
+	onChange func()
+	interval time.Duration
+
+	mu      sync.Mutex
+	last    os.FileInfo
+	lastSum uint64
+	stop    chan struct{}
+	closed  bool
+}
+
+// NewPollWatcher creates a watcher that checks filePath every interval
+func NewPollWatcher(filePath string, onChange func(), interval time.Duration) *PollWatcher {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	last, _ := os.Stat(filePath)
+	return &PollWatcher{
+		filePath: filePath,
+		onChange: onChange,
+		interval: interval,
+		last:     last,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start begins polling until ctx is cancelled or the watcher is closed
+func (pw *PollWatcher) Start(ctx context.Context) error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.closed {
+		return ErrWatcherClosed
+	}
+	go pw.poll(ctx)
+	return nil
+}
+
+func (pw *PollWatcher) poll(ctx context.Context) {
+	if pw.VerifyContent {
+		pw.lastSum, _ = fileSum(pw.filePath)
+	}
+	ticker := time.NewTicker(pw.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pw.stop:
+			return
+		case <-ticker.C:
+			if pw.check() {
+				pw.onChange()
+			}
+		}
+	}
+}
+
+// check stats the file and reports whether it changed since the last
+// check. A file that disappears is reported when it comes back.
+func (pw *PollWatcher) check() bool {
+	cur, err := os.Stat(pw.filePath)
+	if err != nil {
+		cur = nil
+	}
+	var sum uint64
+	if cur != nil && pw.VerifyContent {
+		if sum, err = fileSum(pw.filePath); err != nil {
+			// Unreadable for now; look again next interval
+			return false
+		}
+	}
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	prev, prevSum := pw.last, pw.lastSum
+	pw.last, pw.lastSum = cur, sum
+	if cur == nil {
+		return false
+	}
+	if prev == nil || cur.Size() != prev.Size() || !cur.ModTime().Equal(prev.ModTime()) {
+		return true
+	}
+	if pw.WatchMetadata && !fileMeta(cur).sameAttrs(fileMeta(prev)) {
+		return true
+	}
+	return pw.VerifyContent && sum != prevSum
+}
+
+// fileSum hashes the contents of the file at path
+func fileSum(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h := xxhash.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return 0, err
+	}
+	return h.Sum64(), nil
+}
+
+// Health reports the poll watcher healthy; it has no event stream to lose
+func (pw *PollWatcher) Health() WatcherHealth {
+	return WatcherHealth{Healthy: true}
+}
+
+// Close stops polling. Closing it again has no effect.
+func (pw *PollWatcher) Close() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if !pw.closed {
+		pw.closed = true
+		close(pw.stop)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPollWatcher(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	var changes atomic.Int32
+	pw := NewPollWatcher(path, func() { changes.Add(1) }, 5*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := pw.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer pw.Close()
+
+	time.Sleep(20 * time.Millisecond)
+	if n := changes.Load(); n != 0 {
+		t.Fatalf("%d changes reported for an untouched file", n)
+	}
+
+	rewriteFile(t, path, "172.31.0.1", "172.31.0.22")
+	waitFor(t, "modification", func() bool { return changes.Load() == 1 })
+
+	// A removed file is reported once it is back
+	data, _ := os.ReadFile(path)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "recreation", func() bool { return changes.Load() == 2 })
+
+	pw.Close()
+	if err := pw.Start(ctx); err != ErrWatcherClosed {
+		t.Errorf("start after close = %v", err)
+	}
+}
+
+func TestPollWatcherVerifyContent(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changes atomic.Int32
+	pw := NewPollWatcher(path, func() { changes.Add(1) }, 5*time.Millisecond)
+	pw.VerifyContent = true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := pw.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer pw.Close()
+
+	time.Sleep(20 * time.Millisecond)
+	if n := changes.Load(); n != 0 {
+		t.Fatalf("%d changes reported for an untouched file", n)
+	}
+
+	// Same size, modification time restored: only the hash differs
+	rewriteFile(t, path, "172.31.0.1", "172.31.0.2")
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "content change", func() bool { return changes.Load() == 1 })
+	time.Sleep(20 * time.Millisecond)
+	if n := changes.Load(); n != 1 {
+		t.Errorf("content change reported %d times", n)
+	}
+}
+
+func TestPollWatcherWatchMetadata(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	pw := NewPollWatcher(path, func() {}, time.Hour)
+	if pw.check() {
+		t.Fatal("untouched file reported")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Keep the modification time, as a chmod does
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if pw.check() {
+		t.Error("mode change reported without WatchMetadata")
+	}
+	pw.WatchMetadata = true
+	if err := os.Chmod(path, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if !pw.check() {
+		t.Error("mode change not reported with WatchMetadata")
+	}
+}
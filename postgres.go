@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPostgresTimeout bounds the writing of a change set
+const DefaultPostgresTimeout = 30 * time.Second
+
+// postgresRowsPerInsert keeps an INSERT of changes within the protocol's
+// 65535 parameters
+const postgresRowsPerInsert = 1000
+
+// postgresMigrations create and evolve the sink's tables. Each runs once
+// per database, in order, recorded in go_watcher_migrations; append to
+// the list rather than editing a migration that has shipped.
+var postgresMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS go_watcher_changesets (
+		id bigserial PRIMARY KEY,
+		stream text NOT NULL,
+		changeset bigint,
+		path text NOT NULL,
+		time timestamptz NOT NULL,
+		routes integer NOT NULL,
+		added integer NOT NULL,
+		removed integer NOT NULL,
+		modified integer NOT NULL,
+		truncated boolean NOT NULL,
+		UNIQUE (stream, changeset)
+	);
+	CREATE TABLE IF NOT EXISTS go_watcher_changes (
+		changeset_id bigint NOT NULL REFERENCES go_watcher_changesets (id) ON DELETE CASCADE,
+		seq bigint NOT NULL,
+		type text NOT NULL,
+		destination text NOT NULL,
+		critical boolean NOT NULL,
+		old_hash text,
+		new_hash text,
+		old_content text,
+		new_content text,
+		PRIMARY KEY (changeset_id, seq)
+	);
+	CREATE INDEX IF NOT EXISTS go_watcher_changesets_time ON go_watcher_changesets (time);
+	CREATE INDEX IF NOT EXISTS go_watcher_changes_destination ON go_watcher_changes (destination);`,
+	`ALTER TABLE go_watcher_changes ADD COLUMN IF NOT EXISTS volatile boolean NOT NULL DEFAULT false`,
+}
+
+// postgresLock is the advisory lock that keeps watchers sharing a
+// database from migrating it at once
+const postgresLock = 0x67772d6d6967 // "gw-mig"
+
+func init() {
+	factory := func(u *url.URL) (Sink, error) {
+		return newPostgresSink(u)
+	}
+	sinkFactories["postgres"] = factory
+	sinkFactories["postgresql"] = factory
+}
+
+// PostgresSink records every change set and its changes in PostgreSQL,
+// for route history to be queried with SQL. Changes to volatile chunks,
+// which notifications leave out, are recorded too, with volatile set in
+// go_watcher_changes. It creates its tables,
+// go_watcher_changesets and go_watcher_changes, and migrates them when
+// they change. The spec is postgres://user@host[:5432]/database with
+// these parameters:
+//
+//	password-env         environment variable holding the password
+//	password-file        file holding it, instead
+//	sslmode              disable, prefer (the default), require or
+//	                     verify-full, as in libpq
+//	timeout              time allowed to write a change set (default 30s)
+//
+// Change sets are unique by stream and ID, so retrying one already
+// recorded, as the dead-letter queue does, doesn't record it twice.
+type PostgresSink struct {
+	name    string
+	cfg     pgConfig
+	timeout time.Duration
+
+	mu   sync.Mutex
+	conn *pgConn
+}
+
+func newPostgresSink(u *url.URL) (*PostgresSink, error) {
+	s := &PostgresSink{name: sinkName(u), timeout: DefaultPostgresTimeout}
+	if err := s.parse(u); err != nil {
+		return nil, fmt.Errorf("postgres sink %s: %w", s.name, err)
+	}
+	return s, nil
+}
+
+// parse takes the sink's options from u
+func (s *PostgresSink) parse(u *url.URL) error {
+	if u.Hostname() == "" {
+		return errors.New("needs the server, as postgres://user@host:5432/database")
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return errors.New("needs a user, as postgres://user@host:5432/database")
+	}
+	port := u.Port()
+	if port == "" {
+		port = "5432"
+	}
+	s.cfg = pgConfig{addr: net.JoinHostPort(u.Hostname(), port), user: u.User.Username(), sslmode: "prefer"}
+	if s.cfg.database = strings.Trim(u.Path, "/"); s.cfg.database == "" {
+		s.cfg.database = s.cfg.user
+	}
+	q := u.Query()
+	password, err := readSecret(q, "password")
+	if err != nil {
+		return err
+	}
+	s.cfg.password = string(password)
+	if v := q.Get("sslmode"); v != "" {
+		switch v {
+		case "disable", "prefer", "require", "verify-full":
+			s.cfg.sslmode = v
+		default:
+			return fmt.Errorf("unknown sslmode %q (want disable, prefer, require or verify-full)", v)
+		}
+	}
+	if v := q.Get("timeout"); v != "" {
+		if s.timeout, err = time.ParseDuration(v); err != nil || s.timeout <= 0 {
+			return fmt.Errorf("invalid timeout %q", v)
+		}
+	}
+	return nil
+}
+
+func (s *PostgresSink) Name() string { return s.name }
+
+func (s *PostgresSink) recordsHistory() bool { return true }
+
+// Deliver records cs, reconnecting and trying again once if the
+// connection has failed
+func (s *PostgresSink) Deliver(ctx context.Context, cs *ChangeSet) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fresh := s.conn == nil
+	err := s.record(ctx, cs)
+	var perr *pgError
+	if err != nil && !fresh && !errors.As(err, &perr) && ctx.Err() == nil {
+		err = s.record(ctx, cs)
+	}
+	return err
+}
+
+// record writes cs in one transaction, connecting and migrating first if
+// need be
+func (s *PostgresSink) record(ctx context.Context, cs *ChangeSet) error {
+	if s.conn == nil {
+		conn, err := dialPostgres(ctx, &s.cfg)
+		if err != nil {
+			return fmt.Errorf("connecting to %s: %w", s.cfg.addr, err)
+		}
+		s.conn = conn
+		deadline, _ := ctx.Deadline()
+		conn.conn.SetDeadline(deadline)
+		if err := s.migrate(); err != nil {
+			s.close()
+			return fmt.Errorf("failed to migrate tables: %w", err)
+		}
+	}
+	deadline, _ := ctx.Deadline()
+	s.conn.conn.SetDeadline(deadline)
+
+	err := s.conn.Exec("BEGIN")
+	if err == nil {
+		err = s.insert(cs)
+	}
+	if err == nil {
+		err = s.conn.Exec("COMMIT")
+	}
+	var perr *pgError
+	if errors.As(err, &perr) {
+		// The connection is fine; only the transaction failed
+		if rerr := s.conn.Exec("ROLLBACK"); rerr != nil {
+			s.close()
+		}
+	} else if err != nil {
+		s.close()
+	}
+	return err
+}
+
+// insert inserts cs and its changes, unless it is already in. The change
+// set's counts leave out volatile changes, as reports do.
+func (s *PostgresSink) insert(cs *ChangeSet) error {
+	changes := cs.Changes
+	var added, removed, modified int
+	for _, c := range cs.Notifiable() {
+		switch c.Type {
+		case ChangeAdded:
+			added++
+		case ChangeRemoved:
+			removed++
+		case ChangeModified:
+			modified++
+		}
+	}
+	// Change sets without an ID can't be told apart, so are always added
+	var id any
+	if cs.ID != 0 {
+		id = cs.ID
+	}
+	ts := cs.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	rows, err := s.conn.Query(`INSERT INTO go_watcher_changesets
+		(stream, changeset, path, time, routes, added, removed, modified, truncated)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (stream, changeset) DO NOTHING RETURNING id`,
+		cs.Stream, id, cs.Path, ts, cs.Routes, added, removed, modified, cs.Truncated)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	csID := rows[0][0]
+
+	// Changes without a sequence number, such as volatile ones, are
+	// numbered after the change set's last
+	var last uint64
+	for _, c := range changes {
+		last = max(last, c.Seq)
+	}
+	for done := 0; done < len(changes); {
+		n := min(len(changes)-done, postgresRowsPerInsert)
+		var sql strings.Builder
+		sql.WriteString("INSERT INTO go_watcher_changes (changeset_id, seq, type, destination, critical, volatile, old_hash, new_hash, old_content, new_content) VALUES ")
+		args := make([]any, 0, n*10)
+		for i, c := range changes[done : done+n] {
+			if i > 0 {
+				sql.WriteString(", ")
+			}
+			p := len(args)
+			fmt.Fprintf(&sql, "($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)", p+1, p+2, p+3, p+4, p+5, p+6, p+7, p+8, p+9, p+10)
+			seq := c.Seq
+			if seq == 0 {
+				last++
+				seq = last
+			}
+			args = append(args, csID, seq, string(c.Type), c.Destination, c.Critical, c.Volatile,
+				sqlNullable(c.OldHash), sqlNullable(c.NewHash), pgContent(c.Old), pgContent(c.New))
+		}
+		if _, err := s.conn.Query(sql.String(), args...); err != nil {
+			return err
+		}
+		done += n
+	}
+	return nil
+}
+
+// sqlNullable returns s, or nil for NULL if it is empty
+func sqlNullable(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// pgContent returns the body of chunk as text, or nil for NULL if there
+// is none or it can't be read back
+func pgContent(chunk *Chunk) any {
+	if chunk == nil {
+		return nil
+	}
+	data, err := chunk.Content()
+	if err != nil || data == nil {
+		return nil
+	}
+	return strings.ToValidUTF8(strings.ReplaceAll(string(data), "\x00", ""), "\uFFFD")
+}
+
+// migrate applies the migrations the database hasn't had yet
+func (s *PostgresSink) migrate() error {
+	if err := s.conn.Exec(`CREATE TABLE IF NOT EXISTS go_watcher_migrations (
+		version integer PRIMARY KEY,
+		applied timestamptz NOT NULL DEFAULT now()
+	)`); err != nil {
+		return err
+	}
+	rows, err := s.conn.Query("SELECT coalesce(max(version), 0) FROM go_watcher_migrations")
+	if err != nil {
+		return err
+	}
+	version := 0
+	if len(rows) == 1 && len(rows[0]) == 1 {
+		version, _ = strconv.Atoi(rows[0][0])
+	}
+	for v := version + 1; v <= len(postgresMigrations); v++ {
+		// Migrations are written to be idempotent, so one applied by
+		// another watcher while this one waited for the lock is harmless
+		err := s.conn.Exec(fmt.Sprintf(`BEGIN;
+			SELECT pg_advisory_xact_lock(%d);
+			%s;
+			INSERT INTO go_watcher_migrations (version) VALUES (%d) ON CONFLICT DO NOTHING;
+			COMMIT`, postgresLock, postgresMigrations[v-1], v))
+		if err != nil {
+			s.conn.Exec("ROLLBACK")
+			return fmt.Errorf("migration %d: %w", v, err)
+		}
+	}
+	return nil
+}
+
+// close drops the connection, to be made again on the next delivery
+func (s *PostgresSink) close() {
+	if s.conn != nil {
+		s.conn.conn.Close()
+		s.conn = nil
+	}
+}
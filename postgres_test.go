@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pgStatement is a statement received by fakePostgres, with its
+// parameters; NULL parameters read as "NULL"
+type pgStatement struct {
+	sql  string
+	args []string
+}
+
+// fakePostgres runs a PostgreSQL server that asks for an MD5 password,
+// turns TLS down and keeps just enough state to answer the sink: the
+// migrations applied and the change sets inserted. It returns its address
+// and the statements it has received.
+func fakePostgres(t *testing.T, user, password string) (string, func() []pgStatement) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var mu sync.Mutex
+	var stmts []pgStatement
+	migrated := 0
+	changesets := make(map[string]bool)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				c := &pgConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+				readStartup := func() []byte {
+					var n uint32
+					binary.Read(c.r, binary.BigEndian, &n)
+					body := make([]byte, n-4)
+					io.ReadFull(c.r, body)
+					return body
+				}
+				startup := readStartup()
+				if binary.BigEndian.Uint32(startup) == 80877103 {
+					conn.Write([]byte{'N'})
+					startup = readStartup()
+				}
+				if !strings.Contains(string(startup), "user\x00"+user+"\x00") {
+					t.Errorf("startup %q", startup)
+				}
+				c.send('R', []byte{0, 0, 0, 5, 1, 2, 3, 4})
+				_, reply, _ := c.receive()
+				inner := md5.Sum([]byte(password + user))
+				outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), 1, 2, 3, 4))
+				if string(reply) != "md5"+hex.EncodeToString(outer[:])+"\x00" {
+					c.send('E', []byte("SFATAL\x00C28P01\x00Mpassword authentication failed\x00\x00"))
+					return
+				}
+				c.send('R', []byte{0, 0, 0, 0})
+				c.send('Z', []byte{'I'})
+
+				var st pgStatement
+				for {
+					typ, body, err := c.receive()
+					if err != nil {
+						return
+					}
+					switch typ {
+					case 'Q':
+						sql := strings.TrimRight(string(body), "\x00")
+						mu.Lock()
+						stmts = append(stmts, pgStatement{sql: sql})
+						if strings.Contains(sql, "INSERT INTO go_watcher_migrations") {
+							migrated++
+						}
+						mu.Unlock()
+						c.write('C', []byte("OK\x00"))
+						c.send('Z', []byte{'I'})
+					case 'P':
+						st = pgStatement{sql: strings.Split(string(body[1:]), "\x00")[0]}
+					case 'B':
+						r := kafkaReader{b: body[4:]}
+						for range r.int16() {
+							n := r.int32()
+							if n < 0 {
+								st.args = append(st.args, "NULL")
+							} else {
+								st.args = append(st.args, string(r.take(int(n))))
+							}
+						}
+					case 'S':
+						mu.Lock()
+						stmts = append(stmts, st)
+						row := ""
+						switch {
+						case strings.Contains(st.sql, "max(version)"):
+							row = strconv.Itoa(migrated)
+						case strings.Contains(st.sql, "RETURNING id"):
+							key := st.args[0] + "/" + st.args[1]
+							if !changesets[key] {
+								changesets[key] = true
+								row = strconv.Itoa(len(changesets))
+							}
+						}
+						mu.Unlock()
+						c.write('1', nil)
+						c.write('2', nil)
+						if row != "" {
+							d := binary.BigEndian.AppendUint16(nil, 1)
+							d = binary.BigEndian.AppendUint32(d, uint32(len(row)))
+							c.write('D', append(d, row...))
+						}
+						c.write('C', []byte("OK\x00"))
+						c.send('Z', []byte{'T'})
+					case 'X':
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), func() []pgStatement {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]pgStatement(nil), stmts...)
+	}
+}
+
+func TestPostgresSink(t *testing.T) {
+	addr, received := fakePostgres(t, "watcher", "pw")
+	t.Setenv("PG_TEST_PASSWORD", "pw")
+	sink, err := newSink("postgres://watcher@" + addr + "/netops?password-env=PG_TEST_PASSWORD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &ChangeSet{Stream: "s1", ID: 4, Path: "core.txt", Routes: 10, Time: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), Changes: []Change{
+		{Seq: 7, Type: ChangeAdded, Destination: "10.1.0.0/16", NewHash: "h1", New: &Chunk{Data: []byte("S 10.1.0.0/16\n")}},
+		{Seq: 8, Type: ChangeRemoved, Destination: "10.2.0.0/16", OldHash: "h2", Critical: true},
+		{Type: ChangeModified, Destination: "10.3.0.0/16", Volatile: true},
+	}}
+	// The second delivery is a retry, which records nothing new
+	for range 2 {
+		if err := sink.Deliver(context.Background(), cs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var sqls []string
+	var inserts []pgStatement
+	for _, st := range received() {
+		sql := strings.Fields(st.sql)
+		sqls = append(sqls, strings.Join(sql[:min(2, len(sql))], " "))
+		if strings.HasPrefix(st.sql, "INSERT INTO go_watcher_change") {
+			inserts = append(inserts, st)
+		}
+	}
+	want := []string{
+		"CREATE TABLE", "SELECT coalesce(max(version),", "BEGIN; SELECT", "BEGIN; SELECT",
+		"BEGIN", "INSERT INTO", "INSERT INTO", "COMMIT",
+		"BEGIN", "INSERT INTO", "COMMIT",
+	}
+	if strings.Join(sqls, "\n") != strings.Join(want, "\n") {
+		t.Errorf("statements:\n%s\nwant\n%s", strings.Join(sqls, "\n"), strings.Join(want, "\n"))
+	}
+	if len(inserts) != 3 {
+		t.Fatalf("%d inserts, want 3", len(inserts))
+	}
+	if got := strings.Join(inserts[0].args, ","); got != "s1,4,core.txt,2024-05-01T12:00:00Z,10,1,1,0,false" {
+		t.Errorf("change set args = %s", got)
+	}
+	// The volatile change is recorded too, numbered after the others
+	if got := strings.Join(inserts[1].args, ","); got != "1,7,added,10.1.0.0/16,false,false,NULL,h1,NULL,S 10.1.0.0/16\n,1,8,removed,10.2.0.0/16,true,false,h2,NULL,NULL,NULL,1,9,modified,10.3.0.0/16,false,true,NULL,NULL,NULL,NULL" {
+		t.Errorf("change args = %q", got)
+	}
+}
+
+func TestPostgresSinkBadPassword(t *testing.T) {
+	addr, _ := fakePostgres(t, "watcher", "pw")
+	t.Setenv("PG_TEST_PASSWORD", "nope")
+	sink, err := newSink("postgres://watcher@" + addr + "?password-env=PG_TEST_PASSWORD&sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.Deliver(context.Background(), &ChangeSet{Path: "t.txt"})
+	if err == nil || !strings.Contains(err.Error(), "password authentication failed (SQLSTATE 28P01)") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestNewPostgresSinkErrors(t *testing.T) {
+	for _, spec := range []string{
+		"postgres://",
+		"postgres://db.example.com/netops",
+		"postgres://watcher@db.example.com/netops?sslmode=allow",
+		"postgres://watcher@db.example.com/netops?timeout=soon",
+	} {
+		if _, err := newSink(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+// A minimal PostgreSQL client: enough of the frontend/backend protocol
+// (version 3.0) to log in, optionally over TLS, with a cleartext, MD5 or
+// SCRAM-SHA-256 password, and to run statements with text parameters.
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pgError is an error reported by the server, which resending won't cure
+type pgError struct {
+	code, msg string
+}
+
+func (e *pgError) Error() string { return e.msg + " (SQLSTATE " + e.code + ")" }
+
+// pgConn is a connection to a PostgreSQL server
+type pgConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// pgConfig is how to connect
+type pgConfig struct {
+	addr, user, password, database string
+	// sslmode is disable, prefer, require or verify-full, as in libpq
+	sslmode string
+}
+
+// dialPostgres connects to the server of cfg and logs in
+func dialPostgres(ctx context.Context, cfg *pgConfig) (*pgConn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", cfg.addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if cfg.sslmode != "disable" {
+		if conn, err = pgStartTLS(ctx, conn, cfg); err != nil {
+			return nil, err
+		}
+	}
+	c := &pgConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if err := c.startup(cfg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// pgStartTLS asks the server for TLS and upgrades conn if it agrees
+func pgStartTLS(ctx context.Context, conn net.Conn, cfg *pgConfig) (net.Conn, error) {
+	req := binary.BigEndian.AppendUint32(nil, 8)
+	req = binary.BigEndian.AppendUint32(req, 80877103)
+	var reply [1]byte
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if reply[0] != 'S' {
+		if cfg.sslmode == "prefer" {
+			return conn, nil
+		}
+		conn.Close()
+		return nil, errors.New("server doesn't support TLS")
+	}
+	host, _, _ := net.SplitHostPort(cfg.addr)
+	// As in libpq, only verify-full checks the server's certificate
+	tc := tls.Client(conn, &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         host,
+		InsecureSkipVerify: cfg.sslmode != "verify-full",
+	})
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake: %w", err)
+	}
+	return tc, nil
+}
+
+// startup sends the startup message and answers the server's password
+// request
+func (c *pgConn) startup(cfg *pgConfig) error {
+	msg := binary.BigEndian.AppendUint32(nil, 196608) // protocol 3.0
+	for _, kv := range [][2]string{{"user", cfg.user}, {"database", cfg.database}, {"application_name", "go-watcher"}, {"client_encoding", "UTF8"}} {
+		msg = append(append(msg, kv[0]...), 0)
+		msg = append(append(msg, kv[1]...), 0)
+	}
+	msg = append(msg, 0)
+	c.w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(msg)+4)))
+	c.w.Write(msg)
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	for {
+		typ, body, err := c.receive()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'E':
+			return pgErrorFrom(body)
+		case 'Z':
+			return nil
+		case 'R':
+			if err := c.authenticate(cfg, body); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// authenticate answers an authentication request
+func (c *pgConn) authenticate(cfg *pgConfig, body []byte) error {
+	if len(body) < 4 {
+		return errors.New("short authentication request")
+	}
+	switch kind := binary.BigEndian.Uint32(body); kind {
+	case 0: // AuthenticationOk
+		return nil
+	case 3: // cleartext
+		return c.send('p', append([]byte(cfg.password), 0))
+	case 5: // MD5, salted
+		if len(body) < 8 {
+			return errors.New("short MD5 salt")
+		}
+		inner := md5.Sum([]byte(cfg.password + cfg.user))
+		outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), body[4:8]...))
+		return c.send('p', append([]byte("md5"+hex.EncodeToString(outer[:])), 0))
+	case 10: // SASL
+		if !slices.Contains(strings.Split(strings.TrimRight(string(body[4:]), "\x00"), "\x00"), "SCRAM-SHA-256") {
+			return errors.New("server doesn't offer SCRAM-SHA-256")
+		}
+		nonce := make([]byte, 18)
+		rand.Read(nonce)
+		first := true
+		step := func(msg []byte) ([]byte, error) {
+			if first {
+				first = false
+				init := append([]byte("SCRAM-SHA-256\x00"), binary.BigEndian.AppendUint32(nil, uint32(len(msg)))...)
+				if err := c.send('p', append(init, msg...)); err != nil {
+					return nil, err
+				}
+			} else if err := c.send('p', msg); err != nil {
+				return nil, err
+			}
+			typ, body, err := c.receive()
+			if err != nil {
+				return nil, err
+			}
+			if typ == 'E' {
+				return nil, pgErrorFrom(body)
+			}
+			if typ != 'R' || len(body) < 4 {
+				return nil, fmt.Errorf("unexpected %q during SCRAM", typ)
+			}
+			return body[4:], nil
+		}
+		// The server takes the user from the startup message
+		return scramAuthenticate(sha256.New, "", cfg.password, base64.RawStdEncoding.EncodeToString(nonce), step)
+	default:
+		return fmt.Errorf("unsupported authentication method %d", kind)
+	}
+}
+
+// send writes and flushes a message
+func (c *pgConn) send(typ byte, body []byte) error {
+	c.write(typ, body)
+	return c.w.Flush()
+}
+
+// write buffers a message
+func (c *pgConn) write(typ byte, body []byte) {
+	c.w.WriteByte(typ)
+	c.w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(body)+4)))
+	c.w.Write(body)
+}
+
+// receive reads a message
+func (c *pgConn) receive() (byte, []byte, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(head[1:])
+	if n < 4 || n > 1<<26 {
+		return 0, nil, fmt.Errorf("invalid message length %d", n)
+	}
+	body := make([]byte, n-4)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return head[0], body, nil
+}
+
+// pgErrorFrom decodes an ErrorResponse
+func pgErrorFrom(body []byte) *pgError {
+	e := &pgError{}
+	for _, field := range strings.Split(string(body), "\x00") {
+		if field == "" {
+			continue
+		}
+		switch field[0] {
+		case 'C':
+			e.code = field[1:]
+		case 'M':
+			e.msg = field[1:]
+		}
+	}
+	return e
+}
+
+// Exec runs sql, which may hold several statements but no parameters,
+// with the simple query protocol
+func (c *pgConn) Exec(sql string) error {
+	if err := c.send('Q', append([]byte(sql), 0)); err != nil {
+		return err
+	}
+	_, err := c.results()
+	return err
+}
+
+// Query runs one statement with args as its $1, $2... parameters, and
+// returns the rows it yields as text. Args are strings, integers, bools,
+// times or nil for NULL.
+func (c *pgConn) Query(sql string, args ...any) ([][]string, error) {
+	var parse []byte
+	parse = append(parse, 0) // unnamed statement
+	parse = append(append(parse, sql...), 0)
+	parse = append(parse, 0, 0) // parameter types inferred
+	c.write('P', parse)
+
+	bind := []byte{0, 0, 0, 0} // unnamed portal and statement, text formats
+	bind = binary.BigEndian.AppendUint16(bind, uint16(len(args)))
+	for _, a := range args {
+		v, null := pgText(a)
+		if null {
+			bind = binary.BigEndian.AppendUint32(bind, 0xffffffff)
+			continue
+		}
+		bind = binary.BigEndian.AppendUint32(bind, uint32(len(v)))
+		bind = append(bind, v...)
+	}
+	bind = append(bind, 0, 0) // result formats: text
+	c.write('B', bind)
+	c.write('E', []byte{0, 0, 0, 0, 0})
+	if err := c.send('S', nil); err != nil {
+		return nil, err
+	}
+	return c.results()
+}
+
+// pgText returns a parameter as text, or null
+func pgText(a any) (string, bool) {
+	switch v := a.(type) {
+	case nil:
+		return "", true
+	case string:
+		return v, false
+	case int:
+		return strconv.Itoa(v), false
+	case int64:
+		return strconv.FormatInt(v, 10), false
+	case uint64:
+		return strconv.FormatUint(v, 10), false
+	case bool:
+		return strconv.FormatBool(v), false
+	case time.Time:
+		return v.Format(time.RFC3339Nano), false
+	}
+	panic(fmt.Sprintf("unsupported parameter type %T", a))
+}
+
+// results reads up to ReadyForQuery, returning the rows of DataRows and
+// the first error
+func (c *pgConn) results() ([][]string, error) {
+	var rows [][]string
+	var failed error
+	for {
+		typ, body, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case 'E':
+			if failed == nil {
+				failed = pgErrorFrom(body)
+			}
+		case 'D':
+			if len(body) < 2 {
+				return nil, errors.New("short data row")
+			}
+			n := int(binary.BigEndian.Uint16(body))
+			row := make([]string, 0, n)
+			body = body[2:]
+			for range n {
+				if len(body) < 4 {
+					return nil, errors.New("short data row")
+				}
+				size := int32(binary.BigEndian.Uint32(body))
+				body = body[4:]
+				if size < 0 {
+					row = append(row, "")
+					continue
+				}
+				if int(size) > len(body) {
+					return nil, errors.New("short data row")
+				}
+				row = append(row, string(body[:size]))
+				body = body[size:]
+			}
+			rows = append(rows, row)
+		case 'Z':
+			return rows, failed
+		}
+	}
+}
+
+// Close ends the session
+func (c *pgConn) Close() error {
+	c.send('X', nil)
+	return c.conn.Close()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+)
+
+// Count is a label with the number of changes carrying it
+type Count struct {
+	Key string
+	N   int
+}
+
+// Preview is a stratified summary of a change set too large to list in full
+type Preview struct {
+	Total      int
+	ByType     []Count
+	ByProtocol []Count
+	ByBlock    []Count
+	// Groups breaks the changes down by protocol and interface and type
+	Groups *Groups
+	// Sample holds representative changes drawn from every stratum
+	Sample []Change
+	// FullRef points at where the complete change set can be read, if
+	// anywhere
+	FullRef string
+}
+
+// prefixBlock returns the covering /8 of an IPv4 destination or /16 of an
+// IPv6 destination, used to group changes by address block
+func prefixBlock(dest string) string {
+	p, err := netip.ParsePrefix(dest)
+	if err != nil {
+		return "other"
+	}
+	bits := 8
+	if p.Addr().Is6() {
+		bits = 16
+	}
+	if p.Bits() < bits {
+		bits = p.Bits()
+	}
+	block, _ := p.Addr().Prefix(bits)
+	return block.String()
+}
+
+// changeProtocol returns the routing protocol of the changed route
+func changeProtocol(c *Change) string {
+	if proto := chunkField(c.Chunk(), "Protocol"); proto != "" {
+		return proto
+	}
+	return "unknown"
+}
+
+// buildPreview summarizes changes and draws a sample of at most limit changes,
+// stratified by change type, protocol and address block so that every
+// group is represented roughly in proportion to its size
+func buildPreview(changes []Change, limit int) *Preview {
+	p := &Preview{Total: len(changes)}
+
+	byType := make(map[string]int)
+	byProto := make(map[string]int)
+	byBlock := make(map[string]int)
+	protocols, interfaces := make(groupCounter), make(groupCounter)
+	strata := make(map[string][]int)
+	var order []string
+
+	for i := range changes {
+		c := &changes[i]
+		proto := changeProtocol(c)
+		block := prefixBlock(c.Destination)
+		byType[string(c.Type)]++
+		byProto[proto]++
+		byBlock[block]++
+		protocols.add(proto, c.Type)
+		interfaces.add(changeInterface(c), c.Type)
+
+		key := string(c.Type) + "|" + proto + "|" + block
+		if _, ok := strata[key]; !ok {
+			order = append(order, key)
+		}
+		strata[key] = append(strata[key], i)
+	}
+
+	p.ByType = sortCounts(byType)
+	p.ByProtocol = sortCounts(byProto)
+	p.ByBlock = sortCounts(byBlock)
+	p.Groups = &Groups{ByProtocol: protocols.sorted(), ByInterface: interfaces.sorted()}
+
+	// Largest strata first so they win any ties for the limited slots
+	sort.SliceStable(order, func(i, j int) bool {
+		return len(strata[order[i]]) > len(strata[order[j]])
+	})
+	sizes := make([]int, len(order))
+	for i, key := range order {
+		sizes[i] = len(strata[key])
+	}
+	for i, q := range allocateSample(sizes, limit) {
+		members := strata[order[i]]
+		for k := 0; k < q; k++ {
+			// Spread picks evenly through the stratum
+			p.Sample = append(p.Sample, changes[members[k*len(members)/q]])
+		}
+	}
+	sort.Slice(p.Sample, func(i, j int) bool {
+		return lessDestination(p.Sample[i].Destination, p.Sample[j].Destination)
+	})
+	return p
+}
+
+// allocateSample splits limit sample slots across strata of the given sizes
+// (sorted largest first). Every stratum gets one slot while slots last; the
+// rest are shared in proportion to stratum size using largest remainders.
+func allocateSample(sizes []int, limit int) []int {
+	quotas := make([]int, len(sizes))
+	total := 0
+	for i, n := range sizes {
+		if limit > 0 && n > 0 {
+			quotas[i] = 1
+			limit--
+		}
+		total += n
+	}
+	if limit <= 0 || total == 0 {
+		return quotas
+	}
+
+	remaining := total - len(sizes)
+	if remaining <= 0 {
+		return quotas
+	}
+	extra := limit
+	type rem struct{ i, frac int }
+	var rems []rem
+	for i, n := range sizes {
+		share := (n - 1) * extra
+		q := share / remaining
+		if quotas[i]+q > n {
+			q = n - quotas[i]
+		}
+		quotas[i] += q
+		limit -= q
+		rems = append(rems, rem{i, share % remaining})
+	}
+	sort.SliceStable(rems, func(a, b int) bool { return rems[a].frac > rems[b].frac })
+	for _, r := range rems {
+		if limit == 0 {
+			break
+		}
+		if quotas[r.i] < sizes[r.i] {
+			quotas[r.i]++
+			limit--
+		}
+	}
+	return quotas
+}
+
+// sortCounts orders counts by size, largest first, then by key
+func sortCounts(m map[string]int) []Count {
+	counts := make([]Count, 0, len(m))
+	for k, n := range m {
+		counts = append(counts, Count{Key: k, N: n})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].N != counts[j].N {
+			return counts[i].N > counts[j].N
+		}
+		return counts[i].Key < counts[j].Key
+	})
+	return counts
+}
+
+// formatCounts renders the first max counts as "key n, key n", noting how
+// many were left out
+func formatCounts(counts []Count, max int) string {
+	s := ""
+	for i, c := range counts {
+		if i == max {
+			s += fmt.Sprintf(", +%d more", len(counts)-max)
+			break
+		}
+		if i > 0 {
+			s += ", "
+		}
+		s += fmt.Sprintf("%s %d", c.Key, c.N)
+	}
+	return s
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPrefixBlock(t *testing.T) {
+	tests := map[string]string{
+		"10.1.2.0/24":   "10.0.0.0/8",
+		"0.0.0.0/0":     "0.0.0.0/0",
+		"2001:db8::/32": "2001::/16",
+		"unknown_3":     "other",
+	}
+	for dest, want := range tests {
+		if got := prefixBlock(dest); got != want {
+			t.Errorf("prefixBlock(%q) = %q, want %q", dest, got, want)
+		}
+	}
+}
+
+func TestAllocateSample(t *testing.T) {
+	got := allocateSample([]int{900, 90, 10}, 10)
+	sum := 0
+	for i, q := range got {
+		if q < 1 {
+			t.Errorf("stratum %d got no slots: %v", i, got)
+		}
+		sum += q
+	}
+	if sum != 10 {
+		t.Errorf("allocated %d slots, want 10: %v", sum, got)
+	}
+	if got[0] <= got[1] {
+		t.Errorf("largest stratum not favored: %v", got)
+	}
+
+	got = allocateSample([]int{5, 4, 3, 2, 1}, 3)
+	if fmt.Sprint(got) != "[1 1 1 0 0]" {
+		t.Errorf("more strata than slots: %v", got)
+	}
+}
+
+func TestBuildPreview(t *testing.T) {
+	cs := &ChangeSet{Path: "core.txt"}
+	for i := 0; i < 500; i++ {
+		cs.Changes = append(cs.Changes, Change{
+			Type:        ChangeAdded,
+			Destination: fmt.Sprintf("10.%d.%d.0/24", i/256, i%256),
+			New:         &Chunk{Data: []byte("Destination: x\n     Protocol: IBGP               Process ID: 0")},
+		})
+	}
+	cs.Changes = append(cs.Changes, Change{
+		Type:        ChangeRemoved,
+		Destination: "0.0.0.0/0",
+		Old:         &Chunk{Data: []byte("Destination: 0.0.0.0/0\n     Protocol: Static               Process ID: 0")},
+	})
+
+	p := buildPreview(cs.Changes, 10)
+	if p.Total != 501 || len(p.Sample) != 10 {
+		t.Fatalf("total %d, sample %d", p.Total, len(p.Sample))
+	}
+	if p.Sample[0].Destination != "0.0.0.0/0" {
+		t.Errorf("rare stratum missing from sample: %v", p.Sample[0])
+	}
+	if got := formatCounts(p.ByProtocol, 5); got != "IBGP 500, Static 1" {
+		t.Errorf("by protocol = %q", got)
+	}
+
+	var b strings.Builder
+	reportChanges(&b, cs, 0, ReportOptions{PreviewLimit: 10, ChangesDir: t.TempDir()})
+	if !strings.Contains(b.String(), "Found 501 changed routes in core.txt") {
+		t.Errorf("report not tagged with the table path:\n%s", b.String())
+	}
+	if !strings.Contains(b.String(), "full change set: ") {
+		t.Errorf("report missing full set reference:\n%s", b.String())
+	}
+}
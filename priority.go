@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// DefaultCriticalRules marks default routes as critical
+const DefaultCriticalRules = "0.0.0.0/0,::/0,default"
+
+// PrefixRules select routes by destination, e.g. the critical routes that
+// skip batching. A rule is a prefix, matched exactly, or a prefix followed
+// by "+", which also matches every more-specific prefix inside it. Anything
+// else is matched as a literal destination, such as "default" in "ip route"
+// output.
+type PrefixRules struct {
+	exact  map[string]bool
+	within []netip.Prefix
+}
+
+// parsePrefixRules parses a comma separated rule list such as -critical
+func parsePrefixRules(spec string) (*PrefixRules, error) {
+	return newPrefixRules(splitList(spec))
+}
+
+// newPrefixRules builds rules from a list of rule strings
+func newPrefixRules(rules []string) (*PrefixRules, error) {
+	r := &PrefixRules{exact: make(map[string]bool)}
+	for _, rule := range rules {
+		orLonger := strings.HasSuffix(rule, "+")
+		p, err := netip.ParsePrefix(strings.TrimSuffix(rule, "+"))
+		switch {
+		case err == nil && orLonger:
+			r.within = append(r.within, p.Masked())
+		case err == nil:
+			r.exact[p.Masked().String()] = true
+		case orLonger:
+			return nil, fmt.Errorf("invalid prefix in rule %q: %w", rule, err)
+		default:
+			r.exact[rule] = true
+		}
+	}
+	return r, nil
+}
+
+// Match reports whether dest is selected by any rule
+func (r *PrefixRules) Match(dest string) bool {
+	if r == nil {
+		return false
+	}
+	if r.exact[dest] {
+		return true
+	}
+	p, err := netip.ParsePrefix(dest)
+	if err != nil {
+		return false
+	}
+	p = p.Masked()
+	if r.exact[p.String()] {
+		return true
+	}
+	for _, w := range r.within {
+		if w.Bits() <= p.Bits() && w.Contains(p.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// split divides cs into the critical changes and the rest, marking the
+// critical ones. Volatile changes and bookkeeping, metadata changes and
+// truncation stay with the rest.
+func (r *PrefixRules) split(cs *ChangeSet) (critical, normal *ChangeSet) {
+	critical = &ChangeSet{Path: cs.Path, Time: cs.Time, Routes: cs.Routes, File: cs.File}
+	normal = &ChangeSet{Path: cs.Path, Time: cs.Time, Routes: cs.Routes, NewlyVolatile: cs.NewlyVolatile, ClearedVolatile: cs.ClearedVolatile, File: cs.File, MetaChanges: cs.MetaChanges, Truncated: cs.Truncated}
+	for _, c := range cs.Changes {
+		if !c.Volatile && r.Match(c.Destination) {
+			c.Critical = true
+			critical.Changes = append(critical.Changes, c)
+		} else {
+			normal.Changes = append(normal.Changes, c)
+		}
+	}
+	return critical, normal
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPrefixRules(t *testing.T) {
+	r, err := parsePrefixRules(DefaultCriticalRules + ",10.0.0.0/8+,192.168.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]bool{
+		"0.0.0.0/0":      true,
+		"::/0":           true,
+		"default":        true,
+		"10.0.0.0/8":     true,
+		"10.20.0.0/16":   true,
+		"11.0.0.0/8":     false,
+		"192.168.1.0/24": true,
+		"192.168.1.0/25": false,
+		"1.0.0.0/24":     false,
+		"2001:db8::/32":  false,
+	}
+	for dest, want := range tests {
+		if got := r.Match(dest); got != want {
+			t.Errorf("Critical(%q) = %v, want %v", dest, got, want)
+		}
+	}
+
+	if _, err := parsePrefixRules("core+"); err == nil {
+		t.Error("non-prefix rule with + accepted")
+	}
+	var none *PrefixRules
+	if none.Match("0.0.0.0/0") {
+		t.Error("nil rules matched")
+	}
+}
+
+func TestChangeSetMerge(t *testing.T) {
+	cs := &ChangeSet{Changes: []Change{
+		{Type: ChangeAdded, Destination: "10.1.0.0/16", NewHash: "a"},
+		{Type: ChangeModified, Destination: "10.2.0.0/16", OldHash: "a", NewHash: "b"},
+		{Type: ChangeModified, Destination: "10.3.0.0/16", OldHash: "a", NewHash: "b"},
+		{Type: ChangeRemoved, Destination: "10.4.0.0/16", OldHash: "a"},
+	}}
+	cs.merge(&ChangeSet{Path: "t.txt", Changes: []Change{
+		{Type: ChangeRemoved, Destination: "10.1.0.0/16", OldHash: "a"},
+		{Type: ChangeModified, Destination: "10.2.0.0/16", OldHash: "b", NewHash: "a"},
+		{Type: ChangeRemoved, Destination: "10.3.0.0/16", OldHash: "b"},
+		{Type: ChangeAdded, Destination: "10.4.0.0/16", NewHash: "c"},
+		{Type: ChangeAdded, Destination: "10.0.0.0/16", NewHash: "d"},
+	}})
+
+	got := changeSummary(cs)
+	want := []string{"added 10.0.0.0/16", "removed 10.3.0.0/16", "modified 10.4.0.0/16"}
+	if len(got) != len(want) {
+		t.Fatalf("merged = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("merged = %v, want %v", got, want)
+		}
+	}
+	if c := cs.Changes[2]; c.OldHash != "a" || c.NewHash != "c" {
+		t.Errorf("re-added route hashes %s -> %s", c.OldHash, c.NewHash)
+	}
+	if cs.Path != "t.txt" {
+		t.Errorf("path = %q", cs.Path)
+	}
+}
+
+func TestDispatcherPriorityLane(t *testing.T) {
+	sink := &fakeSink{name: "hook"}
+	d := NewDispatcher([]Sink{sink}, nil)
+	d.BatchWindow = time.Hour
+	var err error
+	if d.Priority, err = parsePrefixRules(DefaultCriticalRules); err != nil {
+		t.Fatal(err)
+	}
+
+	d.Dispatch(context.Background(), &ChangeSet{Changes: []Change{
+		{Type: ChangeModified, Destination: "10.1.0.0/16", OldHash: "a", NewHash: "b"},
+	}})
+	if n := len(sink.delivered()); n != 0 {
+		t.Fatalf("%d deliveries before the batch window closed", n)
+	}
+
+	d.Dispatch(context.Background(), &ChangeSet{Changes: []Change{
+		{Type: ChangeRemoved, Destination: "0.0.0.0/0", OldHash: "a"},
+		{Type: ChangeAdded, Destination: "10.2.0.0/16", NewHash: "c"},
+	}})
+	got := sink.delivered()
+	if len(got) != 1 || got[0].Len() != 1 || !got[0].Changes[0].Critical {
+		t.Fatalf("critical delivery = %+v", got)
+	}
+
+	d.Flush(context.Background())
+	got = sink.delivered()
+	if len(got) != 2 || got[1].Len() != 2 {
+		t.Fatalf("batched delivery = %+v", got)
+	}
+	for _, c := range got[1].Changes {
+		if c.Critical {
+			t.Errorf("%s marked critical", c.Destination)
+		}
+	}
+}
+
+func TestDispatcherBatchWindow(t *testing.T) {
+	sink := &fakeSink{name: "hook"}
+	d := NewDispatcher([]Sink{sink}, nil)
+	d.BatchWindow = 20 * time.Millisecond
+	d.Dispatch(context.Background(), &ChangeSet{Changes: []Change{{Type: ChangeAdded, Destination: "10.1.0.0/16"}}})
+	d.Dispatch(context.Background(), &ChangeSet{Changes: []Change{{Type: ChangeAdded, Destination: "10.2.0.0/16"}}})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(sink.delivered()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	got := sink.delivered()
+	if len(got) != 1 || got[0].Len() != 2 {
+		t.Fatalf("deliveries = %+v", got)
+	}
+}
+
+func TestDispatcherBatchPerTable(t *testing.T) {
+	sink := &fakeSink{name: "hook"}
+	d := NewDispatcher([]Sink{sink}, nil)
+	d.BatchWindow = time.Hour
+	d.Dispatch(context.Background(), &ChangeSet{Path: "b.txt", Changes: []Change{{Type: ChangeAdded, Destination: "10.1.0.0/16"}}})
+	d.Dispatch(context.Background(), &ChangeSet{Path: "a.txt", Changes: []Change{{Type: ChangeAdded, Destination: "10.1.0.0/16"}}})
+	d.Dispatch(context.Background(), &ChangeSet{Path: "b.txt", Changes: []Change{{Type: ChangeRemoved, Destination: "10.1.0.0/16"}}})
+
+	d.Flush(context.Background())
+	got := sink.delivered()
+	if len(got) != 1 || got[0].Path != "a.txt" || got[0].Len() != 1 {
+		t.Fatalf("deliveries = %+v, want only the a.txt addition", got)
+	}
+}
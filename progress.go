@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultProgressInterval is how often progress is reported while a table
+// loads; loads that finish sooner report nothing
+const DefaultProgressInterval = 5 * time.Second
+
+// LoadProgress is how far a table load has got
+type LoadProgress struct {
+	Path string `json:"path"`
+	// Bytes is how much of the file has been read, and Total its size
+	// (zero if unknown)
+	Bytes  int64 `json:"bytes"`
+	Total  int64 `json:"total,omitempty"`
+	Chunks int64 `json:"chunks"`
+	// Elapsed is the time since the load started, and ETA an estimate of
+	// the time left at the rate so far (zero if unknown)
+	Elapsed time.Duration `json:"elapsed"`
+	ETA     time.Duration `json:"eta,omitempty"`
+}
+
+// Percent returns how much of the file has been read, or -1 if its size
+// isn't known
+func (p LoadProgress) Percent() float64 {
+	if p.Total <= 0 {
+		return -1
+	}
+	return 100 * float64(p.Bytes) / float64(p.Total)
+}
+
+// logProgress logs p at info level, for DataTable.OnProgress
+func logProgress(p LoadProgress) {
+	attrs := []any{"path", p.Path, "bytes", p.Bytes, "routes", p.Chunks, "elapsed", p.Elapsed.Round(time.Second)}
+	if p.Total > 0 {
+		attrs = append(attrs, "total", p.Total, "percent", int(p.Percent()))
+	}
+	if p.ETA > 0 {
+		attrs = append(attrs, "eta", p.ETA.Round(time.Second))
+	}
+	slog.Info("loading table", attrs...)
+}
+
+// loadTracker counts the bytes read and chunks parsed by a load in
+// progress
+type loadTracker struct {
+	path   string
+	total  int64
+	start  time.Time
+	bytes  atomic.Int64
+	chunks atomic.Int64
+}
+
+// reader counts the bytes read through r
+func (lt *loadTracker) reader(r io.Reader) io.Reader {
+	return countingReader{r, &lt.bytes}
+}
+
+func (lt *loadTracker) progress() LoadProgress {
+	p := LoadProgress{
+		Path:    lt.path,
+		Bytes:   lt.bytes.Load(),
+		Total:   lt.total,
+		Chunks:  lt.chunks.Load(),
+		Elapsed: time.Since(lt.start),
+	}
+	if p.Total > 0 && p.Bytes > 0 && p.Bytes < p.Total {
+		p.ETA = time.Duration(float64(p.Elapsed) * float64(p.Total-p.Bytes) / float64(p.Bytes))
+	}
+	return p
+}
+
+// countingReader adds the number of bytes read to n
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n.Add(int64(n))
+	return n, err
+}
+
+// trackLoad starts tracking a load of total bytes (zero if unknown) for
+// Progress, calling OnProgress every ProgressInterval until the returned
+// function is called
+func (rt *DataTable) trackLoad(total int64) (*loadTracker, func()) {
+	lt := &loadTracker{path: rt.FilePath, total: total, start: time.Now()}
+	rt.loading.Store(lt)
+	done := make(chan struct{})
+	if rt.OnProgress != nil {
+		interval := rt.ProgressInterval
+		if interval <= 0 {
+			interval = DefaultProgressInterval
+		}
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					rt.OnProgress(lt.progress())
+				}
+			}
+		}()
+	}
+	return lt, func() {
+		close(done)
+		rt.loading.CompareAndSwap(lt, nil)
+	}
+}
+
+// Progress returns the progress of the load in progress, if any. It
+// doesn't wait for the load, so it can be polled while one runs.
+func (rt *DataTable) Progress() (LoadProgress, bool) {
+	lt := rt.loading.Load()
+	if lt == nil {
+		return LoadProgress{}, false
+	}
+	return lt.progress(), true
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadProgress(t *testing.T) {
+	rt := NewDataTable("t.txt")
+	if _, ok := rt.Progress(); ok {
+		t.Fatal("progress reported with no load running")
+	}
+
+	table := routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1") + "\n" + routeBlock("0.0.0.0/0", "Static", "172.31.0.254")
+	lt, done := rt.trackLoad(int64(4 * len(table)))
+	if err := rt.load(context.Background(), lt.reader(strings.NewReader(table)), false, false); err != nil {
+		t.Fatal(err)
+	}
+	lt.start = time.Now().Add(-time.Second)
+	p, ok := rt.Progress()
+	if !ok {
+		t.Fatal("no progress while loading")
+	}
+	if p.Path != "t.txt" || p.Bytes != int64(len(table)) || p.Chunks != 2 {
+		t.Errorf("progress = %+v", p)
+	}
+	if p.Percent() != 25 {
+		t.Errorf("percent = %v, want 25", p.Percent())
+	}
+	// A quarter read in a second leaves three seconds
+	if p.ETA < 2900*time.Millisecond || p.ETA > 3100*time.Millisecond {
+		t.Errorf("ETA = %v, want 3s", p.ETA)
+	}
+	done()
+	if _, ok := rt.Progress(); ok {
+		t.Error("progress reported after the load finished")
+	}
+
+	// Without a known size there is no percentage or ETA
+	lt, done = rt.trackLoad(0)
+	defer done()
+	io.Copy(io.Discard, lt.reader(strings.NewReader(table)))
+	if p := lt.progress(); p.Percent() != -1 || p.ETA != 0 {
+		t.Errorf("unknown size: percent %v, ETA %v", p.Percent(), p.ETA)
+	}
+}
+
+func TestLoadProgressCallback(t *testing.T) {
+	rt := NewDataTable("t.txt")
+	reports := make(chan LoadProgress, 1)
+	rt.OnProgress = func(p LoadProgress) {
+		select {
+		case reports <- p:
+		default:
+		}
+	}
+	rt.ProgressInterval = 10 * time.Millisecond
+	_, done := rt.trackLoad(100)
+	select {
+	case p := <-reports:
+		if p.Total != 100 {
+			t.Errorf("progress = %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no progress reported")
+	}
+	done()
+	// Drain a report that raced with done; none may follow
+	select {
+	case <-reports:
+	default:
+	}
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case p := <-reports:
+		t.Errorf("progress reported after the load finished: %+v", p)
+	default:
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Protobuf encoding of change sets, following proto/changes.proto. The
+// messages are small and flat, so they are encoded by hand rather than
+// through generated code.
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// protoChangeType maps change types to the ChangeType enum
+var protoChangeType = map[ChangeType]uint64{
+	ChangeAdded:    1,
+	ChangeRemoved:  2,
+	ChangeModified: 3,
+}
+
+// marshalChangeSetProto encodes cs as a Changeset message, with its
+// summary if s is set
+func marshalChangeSetProto(cs *ChangeSet, s *Summary) []byte {
+	var b []byte
+	b = appendProtoString(b, 1, cs.Stream)
+	b = appendProtoVarint(b, 2, cs.ID)
+	b = appendProtoString(b, 3, cs.Path)
+	if !cs.Time.IsZero() {
+		b = appendProtoVarint(b, 4, uint64(cs.Time.UnixNano()))
+	}
+	for i := range cs.Changes {
+		b = appendProtoBytes(b, 5, marshalChangeProto(&cs.Changes[i]))
+	}
+	b = appendProtoPacked(b, 6, cs.MergedIDs)
+	b = appendProtoPacked(b, 7, cs.Cancelled)
+	b = appendProtoBool(b, 8, cs.Truncated)
+	for _, m := range cs.MetaChanges {
+		b = appendProtoBytes(b, 9, []byte(m))
+	}
+	if s != nil {
+		b = appendProtoBytes(b, 10, marshalSummaryProto(s))
+	}
+	return b
+}
+
+// marshalSummaryProto encodes s as a Summary message
+func marshalSummaryProto(s *Summary) []byte {
+	var b []byte
+	b = appendProtoVarint(b, 1, uint64(s.Added))
+	b = appendProtoVarint(b, 2, uint64(s.Removed))
+	b = appendProtoVarint(b, 3, uint64(s.Modified))
+	b = appendProtoVarint(b, 4, uint64(s.Volatile))
+	b = appendProtoVarint(b, 5, uint64(s.Routes))
+	b = appendProtoVarint(b, 6, uint64(s.TookMS*1000))
+	return b
+}
+
+// marshalChangeProto encodes c as a ChangeEvent message
+func marshalChangeProto(c *Change) []byte {
+	var b []byte
+	b = appendProtoVarint(b, 1, c.Seq)
+	b = appendProtoVarint(b, 2, protoChangeType[c.Type])
+	b = appendProtoString(b, 3, c.Destination)
+	b = appendProtoString(b, 4, c.OldHash)
+	b = appendProtoString(b, 5, c.NewHash)
+	b = appendProtoBool(b, 6, c.Volatile)
+	b = appendProtoBool(b, 7, c.Critical)
+	b = appendProtoPacked(b, 8, c.Coalesced)
+	return b
+}
+
+// appendProtoDelimited appends msg preceded by its length, as
+// writeDelimitedTo does
+func appendProtoDelimited(b, msg []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(msg)))
+	return append(b, msg...)
+}
+
+func appendProtoTag(b []byte, field int, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wire))
+}
+
+// appendProtoVarint appends a non-zero varint field; proto3 leaves zero
+// values out
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendProtoTag(b, field, wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoBool(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendProtoVarint(b, field, 1)
+}
+
+func appendProtoString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return appendProtoBytes(b, field, []byte(s))
+}
+
+// appendProtoBytes appends a length-delimited field, even if empty, since
+// repeated and embedded fields are present when empty
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = appendProtoTag(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendProtoFixed64(b []byte, field int, v uint64) []byte {
+	b = appendProtoTag(b, field, wireFixed64)
+	return binary.LittleEndian.AppendUint64(b, v)
+}
+
+// appendProtoPacked appends a packed repeated uint64 field
+func appendProtoPacked(b []byte, field int, vs []uint64) []byte {
+	if len(vs) == 0 {
+		return b
+	}
+	var packed []byte
+	for _, v := range vs {
+		packed = binary.AppendUvarint(packed, v)
+	}
+	return appendProtoBytes(b, field, packed)
+}
+
+// protoField is a field of a decoded message. Varint and fixed fields
+// have their value in num, length-delimited ones in data.
+type protoField struct {
+	field int
+	wire  int
+	num   uint64
+	data  []byte
+}
+
+var errProtoTruncated = errors.New("truncated protobuf message")
+
+// parseProto decodes the fields of a message, in the order they appear,
+// without knowing its schema
+func parseProto(b []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 || tag>>3 == 0 {
+			return nil, errors.New("invalid protobuf tag")
+		}
+		b = b[n:]
+		f := protoField{field: int(tag >> 3), wire: int(tag & 7)}
+		switch f.wire {
+		case wireVarint:
+			if f.num, n = binary.Uvarint(b); n <= 0 {
+				return nil, errProtoTruncated
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return nil, errProtoTruncated
+			}
+			f.num, b = binary.LittleEndian.Uint64(b), b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return nil, errProtoTruncated
+			}
+			f.num, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return nil, errProtoTruncated
+			}
+			f.data, b = b[n:n+int(size)], b[n+int(size):]
+		default:
+			return nil, errors.New("unsupported protobuf wire type")
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
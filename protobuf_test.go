@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMarshalChangeSetProto(t *testing.T) {
+	c := Change{Seq: 1, Type: ChangeAdded, Destination: "a", NewHash: "h", Coalesced: []uint64{3, 300}}
+	want := []byte{
+		0x08, 0x01, // seq = 1
+		0x10, 0x01, // type = CHANGE_TYPE_ADDED
+		0x1a, 0x01, 'a', // destination
+		0x2a, 0x01, 'h', // new_hash
+		0x42, 0x03, 0x03, 0xac, 0x02, // coalesced, packed
+	}
+	if got := marshalChangeProto(&c); !bytes.Equal(got, want) {
+		t.Errorf("ChangeEvent = % x, want % x", got, want)
+	}
+
+	cs := &ChangeSet{ID: 2, Path: "t", Time: time.Unix(0, 5), Changes: []Change{c}, Truncated: true}
+	want = append([]byte{
+		0x10, 0x02, // id = 2
+		0x1a, 0x01, 't', // path
+		0x20, 0x05, // time_unix_nano = 5
+		0x2a, byte(len(want)), // changes
+	}, want...)
+	want = append(want, 0x40, 0x01) // truncated
+	got := marshalChangeSetProto(cs, nil)
+	if !bytes.Equal(got, want) {
+		t.Errorf("Changeset = % x, want % x", got, want)
+	}
+
+	var out bytes.Buffer
+	w := newObjectWriter(&out, OutputProtobuf)
+	if err := w.changes(&ChangeSet{ID: 1, Path: "t"}, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.changes(cs, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	// The written message ends with the summary
+	got = append(got,
+		0x52, 0x05, // summary
+		0x08, 0x01, // added = 1
+		0x30, 0xe8, 0x07, // took_us = 1000
+	)
+	if want := append([]byte{byte(len(got))}, got...); !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("stream = % x, want % x", out.Bytes(), want)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRedisTimeout bounds the publishing of a change set
+const DefaultRedisTimeout = 5 * time.Second
+
+// DefaultRedisMaxLen is about the most entries kept in a stream
+const DefaultRedisMaxLen = 10000
+
+func init() {
+	sinkFactories["redis"] = func(u *url.URL) (Sink, error) {
+		return newRedisSink(u)
+	}
+}
+
+// RedisSink publishes every change to a Redis channel, adds it to a Redis
+// stream, or both. The spec is redis://[user@]host[:6379][/db], or
+// redis+tls://, with these parameters:
+//
+//	channel              channel to PUBLISH change events to
+//	stream               stream to XADD changes to
+//	maxlen               trim the stream to about this many entries
+//	                     (default 10000; 0 to keep all)
+//	password-env         environment variable holding the password
+//	password-file        file holding it, instead
+//	timeout              time allowed to publish a change set (default 5s)
+//	path, type, prefix   only publish the changes selected as for /events
+//
+// channel and stream are templates with the placeholders of the NATS
+// sink's subject, so routes.{type} publishes on routes.added and so on,
+// for PSUBSCRIBE routes.*. Published messages are change events, as
+// -output jsonl writes them. Stream entries have the fields type,
+// destination, path and changeset, and the change event in event.
+type RedisSink struct {
+	name     string
+	addr     string
+	tls      *tls.Config
+	db       int
+	user     string
+	password string
+	channel  string
+	stream   string
+	maxLen   int
+	timeout  time.Duration
+	filter   changeFilter
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisError is an error reply, which resending won't cure
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+func newRedisSink(u *url.URL) (*RedisSink, error) {
+	s := &RedisSink{name: sinkName(u), maxLen: DefaultRedisMaxLen, timeout: DefaultRedisTimeout}
+	if err := s.parse(u); err != nil {
+		return nil, fmt.Errorf("redis sink %s: %w", s.name, err)
+	}
+	return s, nil
+}
+
+// parse takes the sink's options from u
+func (s *RedisSink) parse(u *url.URL) error {
+	if u.Hostname() == "" {
+		return errors.New("needs the server, as redis://host:6379")
+	}
+	switch _, transport, _ := strings.Cut(u.Scheme, "+"); transport {
+	case "":
+	case "tls":
+		s.tls = &tls.Config{MinVersion: tls.VersionTLS12, ServerName: u.Hostname()}
+	default:
+		return fmt.Errorf("unknown transport %q (want redis:// or redis+tls://)", u.Scheme)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "6379"
+	}
+	s.addr = net.JoinHostPort(u.Hostname(), port)
+	var err error
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if s.db, err = strconv.Atoi(db); err != nil || s.db < 0 {
+			return fmt.Errorf("invalid database %q", db)
+		}
+	}
+	q := u.Query()
+
+	s.channel, s.stream = q.Get("channel"), q.Get("stream")
+	if s.channel == "" && s.stream == "" {
+		return errors.New("needs a channel, a stream or both")
+	}
+	for _, tmpl := range []string{s.channel, s.stream} {
+		if strings.ContainsAny(renderTopic(tmpl, topicSample, topicSample.Changes[0]), "{}") {
+			return fmt.Errorf("unknown placeholder in %q (known: %s)", tmpl, strings.Join(topicPlaceholders, ", "))
+		}
+	}
+	if v := q.Get("maxlen"); v != "" {
+		if s.maxLen, err = strconv.Atoi(v); err != nil || s.maxLen < 0 {
+			return fmt.Errorf("invalid maxlen %q", v)
+		}
+	}
+	if v := q.Get("timeout"); v != "" {
+		if s.timeout, err = time.ParseDuration(v); err != nil || s.timeout <= 0 {
+			return fmt.Errorf("invalid timeout %q", v)
+		}
+	}
+	password, err := readSecret(q, "password")
+	if err != nil {
+		return err
+	}
+	if u.User != nil {
+		if password == nil {
+			return errors.New("a user needs password-env or password-file")
+		}
+		s.user = u.User.Username()
+	}
+	s.password = string(password)
+
+	if s.filter, err = parseChangeFilter(q.Get("path"), q.Get("type"), q.Get("prefix")); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *RedisSink) Name() string { return s.name }
+
+// Deliver publishes the changes of cs the sink selects, reconnecting and
+// trying again once if the connection has failed
+func (s *RedisSink) Deliver(ctx context.Context, cs *ChangeSet) error {
+	changes := s.filter.changes(cs)
+	if len(changes) == 0 {
+		return nil
+	}
+	var cmds [][]string
+	for _, c := range changes {
+		data, err := changeEvent(cs, c)
+		if err != nil {
+			return fmt.Errorf("failed to encode change: %w", err)
+		}
+		if s.channel != "" {
+			cmds = append(cmds, []string{"PUBLISH", renderTopic(s.channel, cs, c), string(data)})
+		}
+		if s.stream != "" {
+			cmd := []string{"XADD", renderTopic(s.stream, cs, c)}
+			if s.maxLen > 0 {
+				cmd = append(cmd, "MAXLEN", "~", strconv.Itoa(s.maxLen))
+			}
+			cmds = append(cmds, append(cmd, "*",
+				"type", string(c.Type),
+				"destination", c.Destination,
+				"path", cs.Path,
+				"changeset", strconv.FormatUint(cs.ID, 10),
+				"event", string(data)))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fresh := s.conn == nil
+	err := s.do(ctx, cmds)
+	var rerr redisError
+	if err != nil && !fresh && !errors.As(err, &rerr) && ctx.Err() == nil {
+		err = s.do(ctx, cmds)
+	}
+	return err
+}
+
+// do sends cmds in one go and reads their replies, returning the first
+// error reply
+func (s *RedisSink) do(ctx context.Context, cmds [][]string) error {
+	if s.conn == nil {
+		if err := s.dial(ctx); err != nil {
+			return err
+		}
+	}
+	deadline, _ := ctx.Deadline()
+	s.conn.SetDeadline(deadline)
+	err := s.exchange(cmds)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		s.close()
+	}
+	return err
+}
+
+// exchange writes cmds and reads a reply to each
+func (s *RedisSink) exchange(cmds [][]string) error {
+	w := bufio.NewWriter(s.conn)
+	for _, cmd := range cmds {
+		fmt.Fprintf(w, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	var failed error
+	for range cmds {
+		err := s.readReply()
+		var rerr redisError
+		if err != nil && !errors.As(err, &rerr) {
+			return err
+		}
+		if err != nil && failed == nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
+// readReply reads a RESP2 reply, returning an error reply as redisError
+func (s *RedisSink) readReply() error {
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return nil
+	case '-':
+		return redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return fmt.Errorf("invalid reply %q", line)
+		}
+		if n >= 0 {
+			_, err = io.CopyN(io.Discard, s.r, int64(n)+2)
+		}
+		return err
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return fmt.Errorf("invalid reply %q", line)
+		}
+		for range n {
+			if err := s.readReply(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid reply %q", line)
+}
+
+// dial connects to the server, authenticates and selects the database
+func (s *RedisSink) dial(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	if s.tls != nil {
+		tc := tls.Client(conn, s.tls)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return fmt.Errorf("TLS handshake with %s: %w", s.addr, err)
+		}
+		conn = tc
+	}
+	s.conn, s.r = conn, bufio.NewReader(conn)
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	var cmds [][]string
+	switch {
+	case s.user != "":
+		cmds = append(cmds, []string{"AUTH", s.user, s.password})
+	case s.password != "":
+		cmds = append(cmds, []string{"AUTH", s.password})
+	}
+	if s.db != 0 {
+		cmds = append(cmds, []string{"SELECT", strconv.Itoa(s.db)})
+	}
+	if err := s.exchange(cmds); err != nil {
+		s.close()
+		return fmt.Errorf("connecting to %s: %w", s.addr, err)
+	}
+	return nil
+}
+
+// close drops the connection, to be made again on the next delivery
+func (s *RedisSink) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn, s.r = nil, nil
+	}
+}
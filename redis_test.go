@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedis runs a Redis server that accepts any command, failing those
+// on keys starting with "bad", and returns its address and the commands
+// it has received
+func fakeRedis(t *testing.T) (string, func() [][]string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var mu sync.Mutex
+	var cmds [][]string
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+					cmd := make([]string, n)
+					for i := range cmd {
+						line, _ = r.ReadString('\n')
+						size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+						buf := make([]byte, size+2)
+						io.ReadFull(r, buf)
+						cmd[i] = string(buf[:size])
+					}
+					mu.Lock()
+					cmds = append(cmds, cmd)
+					mu.Unlock()
+					switch {
+					case len(cmd) > 1 && strings.HasPrefix(cmd[1], "bad"):
+						io.WriteString(conn, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
+					case cmd[0] == "PUBLISH":
+						io.WriteString(conn, ":2\r\n")
+					case cmd[0] == "XADD":
+						fmt.Fprintf(conn, "$15\r\n1700000000000-%d\r\n", len(cmds)%10)
+					default:
+						io.WriteString(conn, "+OK\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([][]string(nil), cmds...)
+	}
+}
+
+func TestRedisSink(t *testing.T) {
+	addr, received := fakeRedis(t)
+	t.Setenv("REDIS_TEST_PASSWORD", "pw")
+	sink, err := newSink("redis://watcher@" + addr + "/2?password-env=REDIS_TEST_PASSWORD&channel=routes.{type}&stream=routes:{source}&maxlen=500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &ChangeSet{ID: 4, Path: "/data/core.txt", Changes: []Change{{Seq: 1, Type: ChangeAdded, Destination: "10.1.0.0/16"}}}
+	if err := sink.Deliver(context.Background(), cs); err != nil {
+		t.Fatal(err)
+	}
+
+	cmds := received()
+	if len(cmds) != 4 {
+		t.Fatalf("%d commands, want 4: %q", len(cmds), cmds)
+	}
+	if got := strings.Join(cmds[0], " "); got != "AUTH watcher pw" {
+		t.Errorf("command 0 = %q", got)
+	}
+	if got := strings.Join(cmds[1], " "); got != "SELECT 2" {
+		t.Errorf("command 1 = %q", got)
+	}
+	if pub := cmds[2]; pub[0] != "PUBLISH" || pub[1] != "routes.added" {
+		t.Errorf("command 2 = %q", pub)
+	}
+	var e jsonChange
+	if err := json.Unmarshal([]byte(cmds[2][2]), &e); err != nil || e.ChangeSet != 4 || e.Change.Destination != "10.1.0.0/16" {
+		t.Errorf("message %s (%v)", cmds[2][2], err)
+	}
+	if got := strings.Join(cmds[3][:11], " "); got != "XADD routes:core MAXLEN ~ 500 * type added destination 10.1.0.0/16 path" {
+		t.Errorf("command 3 = %q", got)
+	}
+	if x := cmds[3]; x[11] != "/data/core.txt" || x[12] != "changeset" || x[13] != "4" || x[14] != "event" || x[15] != cmds[2][2] {
+		t.Errorf("stream entry = %q", x[5:])
+	}
+}
+
+func TestRedisSinkErrorReply(t *testing.T) {
+	addr, received := fakeRedis(t)
+	sink, err := newSink("redis://" + addr + "?stream=bad-{type}&maxlen=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &ChangeSet{Path: "t.txt", Changes: []Change{{Type: ChangeAdded, Destination: "10.1.0.0/16"}}}
+	err = sink.Deliver(context.Background(), cs)
+	if err == nil || !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		t.Errorf("err = %v", err)
+	}
+	// An error reply isn't retried, and the connection is kept
+	if err := sink.Deliver(context.Background(), cs); err == nil {
+		t.Error("expected an error")
+	}
+	if cmds := received(); len(cmds) != 2 || cmds[0][2] != "*" {
+		t.Errorf("commands = %q", cmds)
+	}
+}
+
+func TestNewRedisSinkErrors(t *testing.T) {
+	t.Setenv("REDIS_TEST_PASSWORD", "pw")
+	for _, spec := range []string{
+		"redis://localhost",
+		"redis://?channel=routes",
+		"redis+ws://localhost?channel=routes",
+		"redis://localhost/zero?channel=routes",
+		"redis://localhost?channel=routes.{table}",
+		"redis://localhost?stream=routes&maxlen=-1",
+		"redis://watcher@localhost?channel=routes",
+	} {
+		if _, err := newSink(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ExternalRef links a change to a record in another system, such as the
+// Jira issue or ServiceNow change request that authorized it
+type ExternalRef struct {
+	System string `json:"system"`
+	ID     string `json:"id"`
+	URL    string `json:"url,omitempty"`
+}
+
+// String returns the reference as "system:id", e.g. "jira:NET-1234"
+func (r ExternalRef) String() string {
+	if r.System == "" {
+		return r.ID
+	}
+	return r.System + ":" + r.ID
+}
+
+// Enricher adds information, such as external references, to a change set
+// after it is detected and before it is reported and delivered
+type Enricher interface {
+	Enrich(ctx context.Context, cs *ChangeSet) error
+}
+
+// AttachRef adds ref to the change for dest unless it is already there. It
+// reports whether cs has a change for dest.
+func (cs *ChangeSet) AttachRef(dest string, ref ExternalRef) bool {
+	found := false
+	for i := range cs.Changes {
+		c := &cs.Changes[i]
+		if c.Destination != dest {
+			continue
+		}
+		found = true
+		c.Refs = addRef(c.Refs, ref)
+	}
+	return found
+}
+
+// addRef appends ref to refs unless it is already present
+func addRef(refs []ExternalRef, ref ExternalRef) []ExternalRef {
+	for _, r := range refs {
+		if r.System == ref.System && r.ID == ref.ID {
+			return refs
+		}
+	}
+	return append(refs, ref)
+}
+
+// RefRule attaches a reference to changes of matching routes made during
+// the rule's time window
+type RefRule struct {
+	ExternalRef
+	// Prefixes uses the PrefixRules syntax ("10.0.0.0/8+" for a prefix and
+	// everything inside it)
+	Prefixes []string `json:"prefixes"`
+	// From and Until bound the change window; zero means unbounded
+	From  time.Time `json:"from,omitempty"`
+	Until time.Time `json:"until,omitempty"`
+
+	match *PrefixRules
+}
+
+// active reports whether t falls within the rule's window
+func (r *RefRule) active(t time.Time) bool {
+	return (r.From.IsZero() || !t.Before(r.From)) && (r.Until.IsZero() || !t.After(r.Until))
+}
+
+// RefFile is an Enricher that reads RefRules from a JSON file, so the
+// change requests for planned work can be registered while the watcher
+// runs. The file is re-read whenever it changes.
+type RefFile struct {
+	Path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	rules   []*RefRule
+}
+
+// Enrich attaches the reference of every active rule to the changes it
+// matches
+func (f *RefFile) Enrich(ctx context.Context, cs *ChangeSet) error {
+	rules, err := f.load()
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if !r.active(cs.Time) {
+			continue
+		}
+		for i := range cs.Changes {
+			c := &cs.Changes[i]
+			if r.match.Match(c.Destination) {
+				c.Refs = addRef(c.Refs, r.ExternalRef)
+			}
+		}
+	}
+	return nil
+}
+
+// load returns the rules, re-reading the file if it changed since the last
+// read. On error the previous rules are kept.
+func (f *RefFile) load() ([]*RefRule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return f.rules, fmt.Errorf("failed to read reference file: %w", err)
+	}
+	if info.ModTime().Equal(f.modTime) {
+		return f.rules, nil
+	}
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return f.rules, fmt.Errorf("failed to read reference file: %w", err)
+	}
+	var rules []*RefRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return f.rules, fmt.Errorf("failed to parse %s: %w", f.Path, err)
+	}
+	for i, r := range rules {
+		if r.ID == "" {
+			return f.rules, fmt.Errorf("%s: rule %d has no id", f.Path, i+1)
+		}
+		if r.match, err = newPrefixRules(r.Prefixes); err != nil {
+			return f.rules, fmt.Errorf("%s: rule %s: %w", f.Path, r.ExternalRef, err)
+		}
+	}
+	f.rules, f.modTime = rules, info.ModTime()
+	return rules, nil
+}
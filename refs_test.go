@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRefFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "refs.json")
+	writeRefs := func(s string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeRefs(`[
+		{"system": "jira", "id": "NET-1", "prefixes": ["10.0.0.0/8+"]},
+		{"system": "servicenow", "id": "CHG0001", "prefixes": ["10.1.0.0/16"], "until": "2020-01-01T00:00:00Z"}
+	]`)
+
+	cs := &ChangeSet{Time: time.Now(), Changes: []Change{
+		{Type: ChangeModified, Destination: "10.1.0.0/16"},
+		{Type: ChangeAdded, Destination: "192.168.0.0/16"},
+	}}
+	f := &RefFile{Path: path}
+	if err := f.Enrich(context.Background(), cs); err != nil {
+		t.Fatal(err)
+	}
+	if refs := cs.Changes[0].Refs; len(refs) != 1 || refs[0].String() != "jira:NET-1" {
+		t.Errorf("10.1.0.0/16 refs = %v", refs)
+	}
+	if refs := cs.Changes[1].Refs; len(refs) != 0 {
+		t.Errorf("192.168.0.0/16 refs = %v", refs)
+	}
+
+	// Edits are picked up; a broken file keeps the last good rules
+	writeRefs(`[{"system": "jira", "id": "NET-2", "prefixes": ["192.168.0.0/16"]}]`)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	if err := f.Enrich(context.Background(), cs); err != nil {
+		t.Fatal(err)
+	}
+	if refs := cs.Changes[1].Refs; len(refs) != 1 || refs[0].ID != "NET-2" {
+		t.Errorf("192.168.0.0/16 refs after edit = %v", refs)
+	}
+	writeRefs(`[{"system": "jira"`)
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second))
+	if err := f.Enrich(context.Background(), cs); err == nil {
+		t.Error("broken file accepted")
+	}
+	if len(f.rules) != 1 {
+		t.Errorf("kept %d rules", len(f.rules))
+	}
+}
+
+func TestAttachRef(t *testing.T) {
+	cs := &ChangeSet{Time: time.Now(), Changes: []Change{{Type: ChangeRemoved, Destination: "0.0.0.0/0"}}}
+	ref := ExternalRef{System: "jira", ID: "NET-3", URL: "https://jira.example.com/browse/NET-3"}
+	if !cs.AttachRef("0.0.0.0/0", ref) || !cs.AttachRef("0.0.0.0/0", ref) {
+		t.Fatal("change not found")
+	}
+	if cs.AttachRef("10.0.0.0/8", ref) {
+		t.Error("attached to a missing change")
+	}
+	if n := len(cs.Changes[0].Refs); n != 1 {
+		t.Errorf("%d refs after attaching the same ref twice", n)
+	}
+
+	var out bytes.Buffer
+	reportChanges(&out, cs, time.Millisecond, ReportOptions{PreviewLimit: 10})
+	if !strings.Contains(out.String(), "0.0.0.0/0 [jira:NET-3]") {
+		t.Errorf("report:\n%s", out.String())
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// reloadableFlags are the flags a SIGHUP applies to the running watcher.
+// Changes to any other flag need a restart.
+var reloadableFlags = map[string]bool{
+	"debounce":      true,
+	"debounce-max":  true,
+	"max-delay":     true,
+	"batch-window":  true,
+	"critical":      true,
+	"preview-limit": true,
+	"diff":          true,
+	"log-level":     true,
+}
+
+// flagRecorder is a flag.Value that keeps the raw values a flag was given
+type flagRecorder struct {
+	values []string
+	isBool bool
+}
+
+func (r *flagRecorder) String() string     { return strings.Join(r.values, ",") }
+func (r *flagRecorder) IsBoolFlag() bool   { return r.isBool }
+func (r *flagRecorder) Set(s string) error { r.values = append(r.values, s); return nil }
+
+// flagSnapshot holds the raw values of the flags set on the command line
+// or in the config file, by flag name
+type flagSnapshot map[string][]string
+
+// snapshotFlags parses args, and the config file named by their -config
+// flag, against stand-ins for the flags of fs and returns the raw values
+// given. fs itself is left alone.
+func snapshotFlags(fs *flag.FlagSet, args []string) (flagSnapshot, *Config, error) {
+	scratch := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	scratch.SetOutput(io.Discard)
+	recorders := make(map[string]*flagRecorder)
+	fs.VisitAll(func(f *flag.Flag) {
+		r := &flagRecorder{}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok {
+			r.isBool = b.IsBoolFlag()
+		}
+		recorders[f.Name] = r
+		scratch.Var(r, f.Name, f.Usage)
+	})
+	if err := scratch.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	var config *Config
+	if r := recorders["config"]; r != nil && len(r.values) > 0 {
+		path := r.values[len(r.values)-1]
+		var err error
+		if config, err = LoadConfig(path); err != nil {
+			return nil, nil, err
+		}
+		if err := config.apply(scratch); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	snap := make(flagSnapshot)
+	for name, r := range recorders {
+		if len(r.values) > 0 {
+			snap[name] = r.values
+		}
+	}
+	return snap, config, nil
+}
+
+// liveSettings holds the values of the reloadable flags, so a SIGHUP can
+// parse and check them before the running watcher sees any
+type liveSettings struct {
+	debounce, debounceMax, maxDelay, batchWindow time.Duration
+	critical, diff, logLevel                     string
+	previewLimit                                 int
+}
+
+// flags returns a flag set of the reloadable flags that writes to s
+func (s *liveSettings) flags() *flag.FlagSet {
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.DurationVar(&s.debounce, "debounce", s.debounce, "")
+	fs.DurationVar(&s.debounceMax, "debounce-max", s.debounceMax, "")
+	fs.DurationVar(&s.maxDelay, "max-delay", s.maxDelay, "")
+	fs.DurationVar(&s.batchWindow, "batch-window", s.batchWindow, "")
+	fs.StringVar(&s.critical, "critical", s.critical, "")
+	fs.IntVar(&s.previewLimit, "preview-limit", s.previewLimit, "")
+	fs.StringVar(&s.diff, "diff", s.diff, "")
+	fs.StringVar(&s.logLevel, "log-level", s.logLevel, "")
+	return fs
+}
+
+// reloadFlags re-reads args and the config file after a SIGHUP and sets
+// the flags of live that changed since prev, reverting those no longer
+// given to their defaults in fs. Only reloadable flags are set, and fs
+// itself is left alone, so the caller can check the new values before
+// using them. It returns the new snapshot, the new config and the names of
+// changed flags that need a restart.
+func reloadFlags(fs, live *flag.FlagSet, args []string, prev flagSnapshot) (flagSnapshot, *Config, []string, error) {
+	next, config, err := snapshotFlags(fs, args)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	names := make(map[string]bool)
+	for name := range prev {
+		names[name] = true
+	}
+	for name := range next {
+		names[name] = true
+	}
+	var restart []string
+	for name := range names {
+		if slices.Equal(prev[name], next[name]) {
+			continue
+		}
+		if !reloadableFlags[name] {
+			restart = append(restart, name)
+			continue
+		}
+		value := fs.Lookup(name).DefValue
+		if v := next[name]; len(v) > 0 {
+			value = v[len(v)-1]
+		}
+		if err := live.Set(name, value); err != nil {
+			return nil, nil, nil, fmt.Errorf("-%s: %w", name, err)
+		}
+	}
+	sort.Strings(restart)
+	return next, config, restart, nil
+}
+
+// checkDebounce validates the debounce settings of a watched file. A
+// debounce longer than -max-delay would be cut short by it, so it is
+// refused rather than silently shortened.
+func checkDebounce(debounce, debounceMax, maxDelay time.Duration) error {
+	switch {
+	case debounce < 0:
+		return fmt.Errorf("-debounce must not be negative")
+	case debounceMax > 0 && debounceMax < debounce:
+		return fmt.Errorf("-debounce-max must be at least -debounce")
+	case maxDelay < 0:
+		return fmt.Errorf("-max-delay must not be negative")
+	case maxDelay > 0 && debounce > maxDelay:
+		return fmt.Errorf("-debounce must not exceed -max-delay (%v); raise -max-delay or set it to 0", maxDelay)
+	case maxDelay > 0 && debounceMax > maxDelay:
+		return fmt.Errorf("-debounce-max must not exceed -max-delay (%v); raise -max-delay or set it to 0", maxDelay)
+	}
+	return nil
+}
+
+// checkDiff validates a -diff mode
+func checkDiff(mode string) error {
+	switch mode {
+	case DiffNone, DiffFields, DiffUnified, DiffSideBySide:
+		return nil
+	}
+	return fmt.Errorf("unknown -diff %q (want none, fields, unified or side-by-side)", mode)
+}
+
+// handleHangup calls reload on every SIGHUP until ctx is cancelled
+func handleHangup(ctx context.Context, reload func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				reload()
+			}
+		}
+	}()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloadFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeFile := func(body string) {
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(`{"debounce": "1s", "workers": 2, "critical": "10.0.0.0/8"}`)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	debounce := fs.Duration("debounce", 500*time.Millisecond, "")
+	workers := fs.Int("workers", 1, "")
+	critical := fs.String("critical", "default", "")
+	diff := fs.String("diff", DiffNone, "")
+	fs.String("config", "", "")
+	args := []string{"-config", path, "-diff", DiffFields}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	snap, _, err := snapshotFlags(fs, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snap["debounce"]) != 1 || snap["debounce"][0] != "1s" {
+		t.Fatalf("snapshot = %v", snap)
+	}
+
+	// Reloadable flags are applied, removed ones revert to their default,
+	// the command line still wins, and other changes need a restart
+	writeFile(`{"debounce": "2s", "workers": 3, "diff": "unified"}`)
+	live := liveSettings{debounce: *debounce, critical: *critical, diff: *diff}
+	snap, cfg, restart, err := reloadFlags(fs, live.flags(), args, snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg == nil {
+		t.Fatal("no config returned")
+	}
+	if live.debounce != 2*time.Second || live.critical != "default" || live.diff != DiffFields {
+		t.Errorf("debounce=%v critical=%q diff=%q", live.debounce, live.critical, live.diff)
+	}
+	if len(restart) != 1 || restart[0] != "workers" {
+		t.Errorf("restart=%v", restart)
+	}
+	// The flags themselves are left for the caller to update
+	if *debounce != 500*time.Millisecond || *workers != 1 {
+		t.Errorf("flags set: debounce=%v workers=%d", *debounce, *workers)
+	}
+
+	// Nothing changed: nothing to do
+	if _, _, restart, err = reloadFlags(fs, live.flags(), args, snap); err != nil || len(restart) != 0 {
+		t.Errorf("restart=%v err=%v", restart, err)
+	}
+
+	writeFile(`{"debounce": "soon"}`)
+	if _, _, _, err := reloadFlags(fs, live.flags(), args, snap); err == nil {
+		t.Error("invalid debounce accepted")
+	}
+}
+
+func TestLiveSettingsFlags(t *testing.T) {
+	// Every reloadable flag can be set
+	live := liveSettings{}
+	fs := live.flags()
+	for name := range reloadableFlags {
+		if fs.Lookup(name) == nil {
+			t.Errorf("-%s missing", name)
+		}
+	}
+	if err := fs.Set("preview-limit", "25"); err != nil || live.previewLimit != 25 {
+		t.Errorf("preview-limit=%d err=%v", live.previewLimit, err)
+	}
+}
+
+func TestCheckDebounce(t *testing.T) {
+	for _, d := range [][3]time.Duration{
+		{time.Second, 0, DefaultMaxDelay},
+		{time.Second, time.Minute, 0},
+		{time.Second, time.Minute, time.Minute},
+		{15 * time.Second, 0, 0},
+	} {
+		if err := checkDebounce(d[0], d[1], d[2]); err != nil {
+			t.Errorf("%v: %v", d, err)
+		}
+	}
+	for _, d := range [][3]time.Duration{
+		{-time.Second, 0, 0},
+		{time.Second, time.Millisecond, 0},
+		{0, 0, -time.Second},
+		// The default -max-delay would cut these short
+		{time.Second, time.Minute, DefaultMaxDelay},
+		{15 * time.Second, 0, DefaultMaxDelay},
+	} {
+		if checkDebounce(d[0], d[1], d[2]) == nil {
+			t.Errorf("%v accepted", d)
+		}
+	}
+}
+
+func TestTargetReload(t *testing.T) {
+	path := writeTable(t,
+		routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"),
+		routeBlock("0.0.0.0/0", "Static", "172.31.0.254"),
+	)
+	rt := NewDataTable(path)
+	rt.Options.Incremental = true
+	if err := rt.LoadDataTable(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sink := &fakeSink{name: "hook"}
+	target := NewTarget(t.Name(), rt, NewDispatcher([]Sink{sink}, nil))
+	target.Out = io.Discard
+	target.Breaker = NewCircuitBreaker(1, time.Hour)
+	target.Breaker.Failure()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	target.Start(ctx)
+
+	// A forced reload runs even with the breaker open
+	rewriteFile(t, path, "172.31.0.1", "172.31.0.2")
+	target.Reload()
+	waitFor(t, "delivery", func() bool { return len(sink.delivered()) == 1 })
+	if s := target.Breaker.State(); s != BreakerClosed {
+		t.Errorf("breaker %s after a successful reload", s)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ReportOptions controls the human-readable change report
+type ReportOptions struct {
+	// PreviewLimit is the number of changes listed individually; larger
+	// change sets are summarized with a stratified preview
+	PreviewLimit int
+	// ChangesDir, if set, receives a file with the complete change set
+	// whenever the report only shows a preview
+	ChangesDir string
+	// Diff selects a rendering (DiffFields or DiffUnified) printed under
+	// each listed change; empty or DiffNone prints none
+	Diff     string
+	Renderer *DiffRenderer
+	// Objects, if set, receives each report as a JSON or YAML object
+	// instead
+	Objects *objectWriter
+	// Color colors changes and diff lines by type, for terminals
+	Color bool
+	// Time formats the timestamp on each change set and change
+	Time TimeFormat
+}
+
+// reportChanges prints the result of a DetectChanges run to w
+func reportChanges(w io.Writer, cs *ChangeSet, took time.Duration, opts ReportOptions) {
+	if opts.Objects != nil {
+		if err := opts.Objects.changes(cs, took); err != nil {
+			fmt.Fprintf(w, "Error writing report: %v\n", err)
+		}
+		return
+	}
+	defer reportVolatile(w, cs)
+	ts := opts.Time.Format(cs.Time)
+	if cs.Truncated && cs.Len() > 0 {
+		fmt.Fprintf(w, "[%s] %s was truncated to zero bytes; every route reads as removed (see -hold-on-truncate)\n", ts, cs.Path)
+	}
+	if len(cs.MetaChanges) > 0 {
+		fmt.Fprintf(w, "[%s] File metadata of %s changed: %s\n", ts, cs.Path, strings.Join(cs.MetaChanges, ", "))
+	}
+
+	changes := cs.Notifiable()
+	suppressed := ""
+	if n := cs.Len() - len(changes); n > 0 {
+		suppressed = fmt.Sprintf(", %d volatile suppressed", n)
+	}
+	if len(changes) == 0 {
+		fmt.Fprintf(w, "[%s] No changes detected in %s (checked in %v%s)\n", ts, cs.Path, took, suppressed)
+		return
+	}
+
+	fmt.Fprintf(w, "[%s] Found %d changed routes in %s, changeset %d (detected in %v%s):\n", ts, len(changes), cs.Path, cs.ID, took, suppressed)
+	if len(changes) <= opts.PreviewLimit {
+		for i := range changes {
+			c := &changes[i]
+			printChange(w, ts, c, opts.Color)
+			printDiff(w, c, opts)
+		}
+	} else {
+		p := buildPreview(changes, opts.PreviewLimit)
+		if opts.ChangesDir != "" {
+			ref, err := writeFullChangeSet(opts.ChangesDir, cs)
+			if err != nil {
+				fmt.Fprintf(w, "Error saving full change set: %v\n", err)
+			}
+			p.FullRef = ref
+		}
+		printPreview(w, p, ts, opts.Color)
+	}
+	s := cs.Summarize(took)
+	fmt.Fprintf(w, "  summary: %d added, %d removed, %d modified; %d routes in table; detected in %v\n", s.Added, s.Removed, s.Modified, s.Routes, took)
+}
+
+// printChange prints the line of one change, stamped with its change
+// set's time
+func printChange(w io.Writer, ts string, c *Change, color bool) {
+	fmt.Fprintf(w, "  - %s #%-6d %s %s%s\n", ts, c.Seq, paint(color, changeColor(c.Type), fmt.Sprintf("%-8s", c.Type)), c.Destination, formatRefs(c.Refs))
+}
+
+// printDiff prints the diff selected by opts for one change, indented
+// under its line in the report
+func printDiff(w io.Writer, c *Change, opts ReportOptions) {
+	if opts.Renderer == nil {
+		return
+	}
+	switch opts.Diff {
+	case DiffFields:
+		if c.Type != ChangeModified {
+			return
+		}
+		fields, err := opts.Renderer.Fields(c)
+		if err != nil {
+			fmt.Fprintf(w, "      (diff unavailable: %v)\n", err)
+			return
+		}
+		for _, f := range fields {
+			fmt.Fprintf(w, "      %s: %s -> %s\n", f.Name, paint(opts.Color, ansiRed, fmt.Sprintf("%q", f.Old)), paint(opts.Color, ansiGreen, fmt.Sprintf("%q", f.New)))
+		}
+	case DiffUnified, DiffSideBySide:
+		render := opts.Renderer.Unified
+		if opts.Diff == DiffSideBySide {
+			render = opts.Renderer.SideBySide
+		}
+		diff, err := render(c)
+		if err != nil {
+			fmt.Fprintf(w, "      (diff unavailable: %v)\n", err)
+			return
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(diff, "\n"), "\n") {
+			if opts.Diff == DiffUnified {
+				line = paint(opts.Color, diffLineColor(line), line)
+			} else if strings.Trim(line, " ^") == "" {
+				line = paint(opts.Color, ansiYellow, line)
+			}
+			fmt.Fprintf(w, "      %s\n", line)
+		}
+	}
+}
+
+// reportVolatile prints chunks that started or stopped being treated as
+// volatile, so the normalization config can be fixed
+func reportVolatile(w io.Writer, cs *ChangeSet) {
+	if len(cs.NewlyVolatile) > 0 {
+		fmt.Fprintf(w, "Marked %d chunks volatile (changed on every load; consider -ignore-fields or -normalize):\n", len(cs.NewlyVolatile))
+		for _, dest := range cs.NewlyVolatile {
+			fmt.Fprintf(w, "  ~ %s\n", dest)
+		}
+	}
+	if len(cs.ClearedVolatile) > 0 {
+		fmt.Fprintf(w, "No longer volatile: %s\n", strings.Join(cs.ClearedVolatile, ", "))
+	}
+}
+
+// printPreview prints a stratified preview of a large change set detected
+// at ts
+func printPreview(w io.Writer, p *Preview, ts string, color bool) {
+	fmt.Fprintf(w, "  by type:      %s\n", formatCounts(p.ByType, 3))
+	fmt.Fprintf(w, "  by protocol:  %s\n", formatGroups(p.Groups.ByProtocol, 5))
+	fmt.Fprintf(w, "  by interface: %s\n", formatGroups(p.Groups.ByInterface, 5))
+	fmt.Fprintf(w, "  by block:     %s\n", formatCounts(p.ByBlock, 5))
+	fmt.Fprintf(w, "  sample of %d:\n", len(p.Sample))
+	for i := range p.Sample {
+		printChange(w, ts, &p.Sample[i], color)
+	}
+	if p.FullRef != "" {
+		fmt.Fprintf(w, "  full change set: %s\n", p.FullRef)
+	} else {
+		fmt.Fprintf(w, "  (%d changes not shown; set -changes-dir to keep the full set)\n", p.Total-len(p.Sample))
+	}
+}
+
+// writeFullChangeSet writes every change in cs to a new file in dir and
+// returns its path
+func writeFullChangeSet(dir string, cs *ChangeSet) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("changes-%s.txt", cs.Time.UTC().Format("20060102T150405.000000000"))
+	path := filepath.Join(dir, name)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(f, "# changeset %s/%d\n", cs.Stream, cs.ID)
+	for _, c := range cs.Changes {
+		refs := make([]string, len(c.Refs))
+		for i, r := range c.Refs {
+			refs[i] = r.String()
+		}
+		fmt.Fprintf(f, "%d\t%s\t%s\t%s\t%s\t%s\n", c.Seq, c.Type, c.Destination, c.OldHash, c.NewHash, strings.Join(refs, ","))
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// formatRefs renders external references as a " [jira:NET-1, ...]" suffix
+func formatRefs(refs []ExternalRef) string {
+	if len(refs) == 0 {
+		return ""
+	}
+	parts := make([]string, len(refs))
+	for i, r := range refs {
+		parts[i] = r.String()
+	}
+	return " [" + strings.Join(parts, ", ") + "]"
+}
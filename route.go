@@ -0,0 +1,117 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Field is a single "Name: value" pair from a route entry line
+type Field struct {
+	Name  string
+	Value string
+
+	// valueStart and valueEnd locate Value within the source line
+	valueStart int
+	valueEnd   int
+}
+
+// fieldPattern matches a field name. Names start at the beginning of a line
+// or after a run of at least two spaces, which is how the dump lays out its
+// two-column "Name: value      Name: value" rows.
+var fieldPattern = regexp.MustCompile(`(?:^|\s\s)\s*([A-Za-z][A-Za-z0-9 ]*?):(?:\s|$)`)
+
+// parseFields splits a route entry line into its fields
+func parseFields(line string) []Field {
+	matches := fieldPattern.FindAllStringSubmatchIndex(line, -1)
+	fields := make([]Field, 0, len(matches))
+	for i, m := range matches {
+		end := len(line)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+		start := m[1]
+		if start > end {
+			start = end
+		}
+		raw := line[start:end]
+		trimmed := strings.TrimSpace(raw)
+		valueStart := start + strings.Index(raw, trimmed)
+		if trimmed == "" {
+			valueStart = start
+		}
+		fields = append(fields, Field{
+			Name:       line[m[2]:m[3]],
+			Value:      trimmed,
+			valueStart: valueStart,
+			valueEnd:   valueStart + len(trimmed),
+		})
+	}
+	return fields
+}
+
+// fieldSet is a case-insensitive set of field names
+type fieldSet map[string]bool
+
+// newFieldSet builds a fieldSet from a list of names
+func newFieldSet(names []string) fieldSet {
+	set := make(fieldSet, len(names))
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			set[strings.ToLower(name)] = true
+		}
+	}
+	return set
+}
+
+// has reports whether name is in the set
+func (s fieldSet) has(name string) bool {
+	return s[strings.ToLower(name)]
+}
+
+// maskFields blanks the values of the given fields in line, leaving the
+// field names and surrounding layout in place
+func maskFields(line string, ignore fieldSet) string {
+	if len(ignore) == 0 {
+		return line
+	}
+	fields := parseFields(line)
+	// Cut from the right so earlier offsets stay valid
+	for i := len(fields) - 1; i >= 0; i-- {
+		f := fields[i]
+		if f.Value != "" && ignore.has(f.Name) {
+			line = line[:f.valueStart] + line[f.valueEnd:]
+		}
+	}
+	return line
+}
+
+// splitList splits a comma separated flag value into its non-empty items
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// chunkField returns the value of the named field in a chunk, or "" if the
+// chunk has no such field
+func chunkField(c *Chunk, name string) string {
+	if c == nil {
+		return ""
+	}
+	data, err := c.Content()
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		for _, f := range parseFields(line) {
+			if strings.EqualFold(f.Name, name) {
+				return f.Value
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseFields(t *testing.T) {
+	line := "        State: Active Adv Relied         Age: 27d02h01m21s        "
+	fields := parseFields(line)
+	if len(fields) != 2 {
+		t.Fatalf("got %d fields: %+v", len(fields), fields)
+	}
+	if fields[0].Name != "State" || fields[0].Value != "Active Adv Relied" {
+		t.Errorf("field 0 = %+v", fields[0])
+	}
+	if fields[1].Name != "Age" || fields[1].Value != "27d02h01m21s" {
+		t.Errorf("field 1 = %+v", fields[1])
+	}
+
+	fields = parseFields("   IndirectID: 0x6005CE7            Instance:                                 ")
+	if len(fields) != 2 || fields[1].Name != "Instance" || fields[1].Value != "" {
+		t.Errorf("empty value fields = %+v", fields)
+	}
+
+	fields = parseFields("     Protocol: IBGP               Process ID: 0              ")
+	if len(fields) != 2 || fields[1].Name != "Process ID" || fields[1].Value != "0" {
+		t.Errorf("spaced name fields = %+v", fields)
+	}
+
+	fields = parseFields("      NextHop: fe80::1      Neighbour: fe80::1")
+	if len(fields) != 2 || fields[0].Value != "fe80::1" {
+		t.Errorf("ipv6 value fields = %+v", fields)
+	}
+}
+
+func TestMaskFields(t *testing.T) {
+	ignore := newFieldSet([]string{"age"})
+	a := maskFields("        State: Active Adv Relied         Age: 27d02h01m21s", ignore)
+	b := maskFields("        State: Active Adv Relied         Age: 27d02h01m22s", ignore)
+	if a != b {
+		t.Errorf("masked lines differ: %q vs %q", a, b)
+	}
+	if want := "        State: Active Adv Relied         Age: "; a != want {
+		t.Errorf("masked = %q, want %q", a, want)
+	}
+	if got := maskFields("Tag: 0", ignore); got != "Tag: 0" {
+		t.Errorf("unrelated line changed: %q", got)
+	}
+}
+
+func TestIgnoreFieldsHashing(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	rt := NewDataTable(path)
+	rt.Options.IgnoreFields = []string{"Age"}
+	if err := rt.LoadDataTable(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	aged := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	rewriteFile(t, aged, "27d02h01m21s", "27d02h05m00s")
+	rt.FilePath = aged
+	cs, err := rt.DetectChanges(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Len() != 0 {
+		t.Errorf("age-only change reported: %+v", cs.Changes)
+	}
+}
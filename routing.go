@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Severities a routing rule can match
+const (
+	SeverityCritical = "critical"
+	SeverityNormal   = "normal"
+)
+
+// RoutingRule sends the changes it matches to some sinks, so each team
+// only hears about the routes it owns. A change matches when it matches
+// every criterion given; empty ones match everything.
+type RoutingRule struct {
+	// Name identifies the rule in errors
+	Name string `json:"name,omitempty"`
+	// Path lists the tables whose changes match
+	Path []string `json:"path,omitempty"`
+	// Prefix lists prefix rules as in -critical
+	Prefix []string `json:"prefix,omitempty"`
+	// Protocol lists values of the route's Protocol field, in any case
+	Protocol []string `json:"protocol,omitempty"`
+	// Type lists change types
+	Type []string `json:"type,omitempty"`
+	// Severity is critical, for changes matching -critical, or normal
+	Severity string `json:"severity,omitempty"`
+	// Sinks names the sinks the matching changes go to
+	Sinks []string `json:"sinks"`
+}
+
+// routingRule is a checked RoutingRule
+type routingRule struct {
+	RoutingRule
+	prefixes *PrefixRules
+}
+
+// match reports whether change c of cs matches the rule
+func (r *routingRule) match(cs *ChangeSet, c *Change) bool {
+	if len(r.Path) > 0 && !slices.Contains(r.Path, cs.Path) {
+		return false
+	}
+	if len(r.Type) > 0 && !slices.Contains(r.Type, string(c.Type)) {
+		return false
+	}
+	if r.Severity != "" && (r.Severity == SeverityCritical) != c.Critical {
+		return false
+	}
+	if r.prefixes != nil && !r.prefixes.Match(c.Destination) {
+		return false
+	}
+	if len(r.Protocol) > 0 {
+		protocol := routeProtocol(c)
+		return slices.ContainsFunc(r.Protocol, func(p string) bool { return strings.EqualFold(p, protocol) })
+	}
+	return true
+}
+
+// routeProtocol returns the Protocol field of the route a change is about
+func routeProtocol(c *Change) string {
+	for _, line := range strings.Split(chunkText(c.Chunk()), "\n") {
+		for _, f := range parseFields(line) {
+			if f.Name == "Protocol" {
+				return f.Value
+			}
+		}
+	}
+	return ""
+}
+
+// compileRouting checks rules against the names of the sinks there are
+func compileRouting(rules []RoutingRule, sinks []string) ([]routingRule, error) {
+	compiled := make([]routingRule, len(rules))
+	for i, r := range rules {
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		if len(r.Sinks) == 0 {
+			return nil, fmt.Errorf("routing rule %s: no sinks", name)
+		}
+		for _, s := range r.Sinks {
+			if !slices.Contains(sinks, s) {
+				return nil, fmt.Errorf("routing rule %s: no sink named %q (have %s)", name, s, strings.Join(sinks, ", "))
+			}
+		}
+		f, err := parseChangeFilter("", strings.Join(r.Type, ","), strings.Join(r.Prefix, ","))
+		if err != nil {
+			return nil, fmt.Errorf("routing rule %s: %w", name, err)
+		}
+		if r.Severity != "" && r.Severity != SeverityCritical && r.Severity != SeverityNormal {
+			return nil, fmt.Errorf("routing rule %s: unknown severity %q (want critical or normal)", name, r.Severity)
+		}
+		compiled[i] = routingRule{RoutingRule: r, prefixes: f.prefixes}
+	}
+	return compiled, nil
+}
+
+// Router narrows what each sink is sent by the routing rules of the config
+// file. A sink named by rules gets the changes that match any of them; the
+// others get every change. The rules can be replaced while in use.
+type Router struct {
+	mu    sync.RWMutex
+	rules []routingRule
+	sinks []string
+}
+
+// NewRouter returns a router for sinks, with no rules yet
+func NewRouter(sinks []Sink) *Router {
+	r := &Router{}
+	for _, s := range sinks {
+		r.sinks = append(r.sinks, s.Name())
+	}
+	return r
+}
+
+// Configure checks rules and puts them in place
+func (r *Router) Configure(rules []RoutingRule) error {
+	compiled, err := compileRouting(rules, r.sinks)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.rules = compiled
+	r.mu.Unlock()
+	return nil
+}
+
+// Route wraps sink so it is only sent the changes routed to it
+func (r *Router) Route(sink Sink) Sink {
+	return &routedSink{Sink: sink, router: r}
+}
+
+// changes returns what of cs goes to the sink named sink, and whether
+// anything does
+func (r *Router) changes(sink string, cs *ChangeSet) (*ChangeSet, bool) {
+	r.mu.RLock()
+	var rules []*routingRule
+	for i := range r.rules {
+		if slices.Contains(r.rules[i].Sinks, sink) {
+			rules = append(rules, &r.rules[i])
+		}
+	}
+	r.mu.RUnlock()
+	if len(rules) == 0 {
+		return cs, true
+	}
+	out := *cs
+	out.Changes = nil
+	for _, c := range cs.Changes {
+		if slices.ContainsFunc(rules, func(rule *routingRule) bool { return rule.match(cs, &c) }) {
+			out.Changes = append(out.Changes, c)
+		}
+	}
+	return &out, out.Len() > 0 || out.Truncated
+}
+
+// routedSink is a sink sent only the changes routed to it
+type routedSink struct {
+	Sink
+	router *Router
+}
+
+func (s *routedSink) Deliver(ctx context.Context, cs *ChangeSet) error {
+	out, ok := s.router.changes(s.Name(), cs)
+	if !ok {
+		return nil
+	}
+	return s.Sink.Deliver(ctx, out)
+}
+
+func (s *routedSink) recordsHistory() bool { return recordsHistory(s.Sink) }
+
+// Flush passes on to sinks that hold change sets back
+func (s *routedSink) Flush(ctx context.Context) error {
+	if f, ok := s.Sink.(flusher); ok {
+		return f.Flush(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	noc, core, archive := &fakeSink{name: "noc"}, &fakeSink{name: "core"}, &fakeSink{name: "archive"}
+	sinks := []Sink{noc, core, archive}
+	router := NewRouter(sinks)
+	err := router.Configure([]RoutingRule{
+		{Name: "bgp", Protocol: []string{"ibgp"}, Type: []string{"added", "removed"}, Sinks: []string{"core"}},
+		{Name: "default route", Prefix: []string{"0.0.0.0/0"}, Severity: SeverityCritical, Sinks: []string{"noc", "core"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := pluginChangeSetSample(t)
+	cs.Changes[1].Critical = true
+	for _, s := range sinks {
+		if err := router.Route(s).Deliver(context.Background(), cs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct {
+		sink *fakeSink
+		want string
+	}{
+		{noc, "modified 0.0.0.0/0"},
+		{core, "added 10.0.0.0/8, modified 0.0.0.0/0"},
+		{archive, "added 10.0.0.0/8, modified 0.0.0.0/0, removed 192.0.2.0/24"},
+	} {
+		got := tt.sink.delivered()
+		if len(got) != 1 || strings.Join(changeSummary(got[0]), ", ") != tt.want {
+			t.Errorf("%s got %d change sets, first %v; want %s", tt.sink.name, len(got), got, tt.want)
+		}
+	}
+
+	// Nothing routed is nothing delivered
+	cs.Changes[1].Critical = false
+	router.Route(noc).Deliver(context.Background(), cs)
+	if n := len(noc.delivered()); n != 1 {
+		t.Errorf("noc got %d change sets", n)
+	}
+}
+
+func TestRoutingErrors(t *testing.T) {
+	sinks := []Sink{&fakeSink{name: "noc"}}
+	for _, rule := range []RoutingRule{
+		{},
+		{Sinks: []string{"pager"}},
+		{Type: []string{"changed"}, Sinks: []string{"noc"}},
+		{Prefix: []string{"10.0.0.0/33+"}, Sinks: []string{"noc"}},
+		{Severity: "high", Sinks: []string{"noc"}},
+	} {
+		if err := NewRouter(sinks).Configure([]RoutingRule{rule}); err == nil {
+			t.Errorf("%+v: no error", rule)
+		}
+	}
+}
+
+func TestConfigRouting(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	os.WriteFile(path, []byte(`{"debounce": "1s", "routing": [{"name": "core", "prefix": ["10.0.0.0/8+"], "sinks": ["core"]}]}`), 0o644)
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := c.routing(); len(r) != 1 || r[0].Name != "core" || r[0].Prefix[0] != "10.0.0.0/8+" {
+		t.Errorf("routing = %+v", r)
+	}
+	if _, ok := c.Flags["routing"]; ok {
+		t.Error("routing taken for a flag")
+	}
+	os.WriteFile(path, []byte(`{"routing": [{"prefixes": ["10.0.0.0/8"]}]}`), 0o644)
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("unknown routing key: no error")
+	}
+}
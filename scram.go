@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// scramAuthenticate runs a SCRAM exchange (RFC 5802) with client nonce
+// cnonce through step, which sends a client message and returns the
+// server's reply
+func scramAuthenticate(newHash func() hash.Hash, user, password, cnonce string, step func([]byte) ([]byte, error)) error {
+	name := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(user)
+	first := "n=" + name + ",r=" + cnonce
+	reply, err := step([]byte("n,," + first))
+	if err != nil {
+		return err
+	}
+	serverFirst := string(reply)
+	attrs := make(map[string]string)
+	for _, kv := range strings.Split(serverFirst, ",") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			attrs[k] = v
+		}
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return fmt.Errorf("invalid SCRAM salt: %w", err)
+	}
+	iter, err := strconv.Atoi(attrs["i"])
+	if err != nil || iter < 1 {
+		return fmt.Errorf("invalid SCRAM iteration count %q", attrs["i"])
+	}
+	if !strings.HasPrefix(attrs["r"], cnonce) {
+		return errors.New("SCRAM server nonce doesn't extend ours")
+	}
+
+	mac := func(key []byte, msg string) []byte {
+		m := hmac.New(newHash, key)
+		m.Write([]byte(msg))
+		return m.Sum(nil)
+	}
+	salted, err := pbkdf2.Key(newHash, password, salt, iter, newHash().Size())
+	if err != nil {
+		return err
+	}
+	clientKey := mac(salted, "Client Key")
+	h := newHash()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+	final := "c=biws,r=" + attrs["r"]
+	authMessage := first + "," + serverFirst + "," + final
+	proof := mac(storedKey, authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	reply, err = step([]byte(final + ",p=" + base64.StdEncoding.EncodeToString(proof)))
+	if err != nil {
+		return err
+	}
+	want := "v=" + base64.StdEncoding.EncodeToString(mac(mac(salted, "Server Key"), authMessage))
+	if !hmac.Equal(reply, []byte(want)) {
+		return errors.New("SCRAM server signature doesn't match")
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/sha256"
+	"strings"
+	"testing"
+)
+
+func TestScramAuthenticate(t *testing.T) {
+	// The SCRAM-SHA-256 exchange of RFC 7677
+	const (
+		clientFirst = "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"
+		serverFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+		clientFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+		serverFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+	)
+	var sent []string
+	step := func(reply string) func([]byte) ([]byte, error) {
+		return func(msg []byte) ([]byte, error) {
+			sent = append(sent, string(msg))
+			if len(sent) == 1 {
+				return []byte(serverFirst), nil
+			}
+			return []byte(reply), nil
+		}
+	}
+	if err := scramAuthenticate(sha256.New, "user", "pencil", "rOprNGfwEbeRWgbNEkqO", step(serverFinal)); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 2 || sent[0] != clientFirst || sent[1] != clientFinal {
+		t.Errorf("sent %q", sent)
+	}
+
+	sent = nil
+	err := scramAuthenticate(sha256.New, "user", "pencil", "rOprNGfwEbeRWgbNEkqO", step("v=d3Jvbmc="))
+	if err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Errorf("err = %v, want a signature mismatch", err)
+	}
+}
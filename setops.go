@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+)
+
+// setMatch controls how routes from different tables are considered equal
+type setMatch string
+
+const (
+	// matchPrefix treats routes with the same destination as equal
+	matchPrefix setMatch = "prefix"
+	// matchContent additionally requires the chunk hashes to be identical
+	matchContent setMatch = "content"
+)
+
+// same reports whether two chunks for the same destination are equal under m
+func (m setMatch) same(a, b *Chunk) bool {
+	if m == matchContent {
+		return a.Hash == b.Hash
+	}
+	return true
+}
+
+// contains reports whether rt holds a route equal to c under m
+func (m setMatch) contains(rt *DataTable, c *Chunk) bool {
+	other, ok := rt.Chunks[c.Destination]
+	return ok && m.same(c, other)
+}
+
+// unionChunks returns every route found in any of the tables. When a
+// destination appears in several tables the leftmost table wins.
+func unionChunks(tables []*DataTable) []*Chunk {
+	seen := make(map[string]bool)
+	var out []*Chunk
+	for _, rt := range tables {
+		for dest, c := range rt.Chunks {
+			if seen[dest] {
+				continue
+			}
+			seen[dest] = true
+			out = append(out, c)
+		}
+	}
+	return sortChunks(out)
+}
+
+// intersectChunks returns the routes of the first table that are present in
+// every other table
+func intersectChunks(tables []*DataTable, m setMatch) []*Chunk {
+	if len(tables) == 0 {
+		return nil
+	}
+	var out []*Chunk
+	for _, c := range tables[0].Chunks {
+		inAll := true
+		for _, rt := range tables[1:] {
+			if !m.contains(rt, c) {
+				inAll = false
+				break
+			}
+		}
+		if inAll {
+			out = append(out, c)
+		}
+	}
+	return sortChunks(out)
+}
+
+// subtractChunks returns the routes of the first table that are present in
+// none of the other tables
+func subtractChunks(tables []*DataTable, m setMatch) []*Chunk {
+	if len(tables) == 0 {
+		return nil
+	}
+	var out []*Chunk
+	for _, c := range tables[0].Chunks {
+		inAny := false
+		for _, rt := range tables[1:] {
+			if m.contains(rt, c) {
+				inAny = true
+				break
+			}
+		}
+		if !inAny {
+			out = append(out, c)
+		}
+	}
+	return sortChunks(out)
+}
+
+// sortChunks orders chunks by destination prefix
+func sortChunks(chunks []*Chunk) []*Chunk {
+	sort.Slice(chunks, func(i, j int) bool {
+		return lessDestination(chunks[i].Destination, chunks[j].Destination)
+	})
+	return chunks
+}
+
+// sortDestinations sorts destinations in prefix order
+func sortDestinations(dests []string) {
+	sort.Slice(dests, func(i, j int) bool {
+		return lessDestination(dests[i], dests[j])
+	})
+}
+
+// lessDestination orders destinations as prefixes where possible: IPv4
+// before IPv6, then by address and prefix length. Destinations that are not
+// valid prefixes sort after all prefixes, lexically.
+func lessDestination(a, b string) bool {
+	pa, errA := netip.ParsePrefix(a)
+	pb, errB := netip.ParsePrefix(b)
+	switch {
+	case errA != nil && errB != nil:
+		return a < b
+	case errA != nil:
+		return false
+	case errB != nil:
+		return true
+	}
+	if pa.Addr().Is4() != pb.Addr().Is4() {
+		return pa.Addr().Is4()
+	}
+	if c := pa.Addr().Compare(pb.Addr()); c != 0 {
+		return c < 0
+	}
+	return pa.Bits() < pb.Bits()
+}
+
+// writeChunks prints the result of a set operation, either as a prefix list
+// or as the full chunk content
+func writeChunks(w io.Writer, chunks []*Chunk, format string) error {
+	for _, c := range chunks {
+		var err error
+		switch format {
+		case "chunks":
+			var data []byte
+			if data, err = c.Content(); err == nil {
+				_, err = fmt.Fprintf(w, "%s\n\n", data)
+			}
+		default:
+			_, err = fmt.Fprintln(w, c.Destination)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runSetOp implements the union, intersect and subtract commands, writing
+// the result to out
+func runSetOp(name string, args []string, out io.Writer) int {
+	ops := map[string]func([]*DataTable, setMatch) []*Chunk{
+		// Every destination is in the union whatever the match
+		"union":     func(tables []*DataTable, _ setMatch) []*Chunk { return unionChunks(tables) },
+		"intersect": intersectChunks,
+		"subtract":  subtractChunks,
+	}
+	op := ops[name]
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [options] <file> <file>...\n\n", os.Args[0], name)
+		switch name {
+		case "union":
+			fmt.Fprintf(fs.Output(), "Print routes present in any of the files.\n\n")
+		case "intersect":
+			fmt.Fprintf(fs.Output(), "Print routes present in all of the files.\n\n")
+		case "subtract":
+			fmt.Fprintf(fs.Output(), "Print routes present in the first file but in none of the others.\n\n")
+		}
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	var match, format, ignoreFields, normalize, hashName string
+	var maxLineBytes int
+	fs.StringVar(&match, "match", string(matchPrefix), "Route equality: prefix (destination only) or content (destination and hash)")
+	fs.StringVar(&format, "output", "prefixes", "Output format: prefixes or chunks")
+	fs.StringVar(&ignoreFields, "ignore-fields", "Age", "Comma separated route fields to ignore when hashing (empty to hash everything)")
+	fs.StringVar(&normalize, "normalize", "none", "Whitespace normalization before hashing: comma separated eol, trim, collapse, or all/none")
+	fs.StringVar(&hashName, "hash", string(DefaultHash), "Chunk hash algorithm: sha256, xxhash, blake3 or fnv")
+	fs.IntVar(&maxLineBytes, "max-line-bytes", DefaultMaxLineBytes, "Longest line a table may contain")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if match != string(matchPrefix) && match != string(matchContent) {
+		fmt.Fprintf(os.Stderr, "Error: unknown -match %q\n", match)
+		return 2
+	}
+	if format != "prefixes" && format != "chunks" {
+		fmt.Fprintf(os.Stderr, "Error: unknown -output %q\n", format)
+		return 2
+	}
+	opts := LoadOptions{IgnoreFields: splitList(ignoreFields), MaxLineBytes: maxLineBytes}
+	var err error
+	if opts.Normalize, err = parseNormalize(normalize); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -normalize: %v\n", err)
+		return 2
+	}
+	if opts.Hash, err = parseHashAlgorithm(hashName); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -hash: %v\n", err)
+		return 2
+	}
+	if fs.NArg() < 2 {
+		fmt.Fprintf(os.Stderr, "Error: %s needs at least two files\n\n", name)
+		fs.Usage()
+		return 2
+	}
+
+	tables := make([]*DataTable, 0, fs.NArg())
+	for _, path := range fs.Args() {
+		rt := NewDataTable(path)
+		rt.Options = opts
+		if err := rt.LoadDataTable(context.Background()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading %s: %v\n", path, err)
+			return 1
+		}
+		tables = append(tables, rt)
+	}
+
+	if err := writeChunks(out, op(tables, setMatch(match)), format); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing output: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func destinations(chunks []*Chunk) []string {
+	out := make([]string, 0, len(chunks))
+	for _, c := range chunks {
+		out = append(out, c.Destination)
+	}
+	return out
+}
+
+func TestSetOps(t *testing.T) {
+	a := loadTable(t, writeTable(t,
+		routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"),
+		routeBlock("0.0.0.0/0", "Static", "172.31.0.254"),
+		routeBlock("192.168.1.0/24", "OSPF", "172.31.0.2"),
+	))
+	b := loadTable(t, writeTable(t,
+		routeBlock("10.0.0.0/8", "IBGP", "172.31.0.9"),
+		routeBlock("192.168.1.0/24", "OSPF", "172.31.0.2"),
+		routeBlock("2001:db8::/32", "IBGP", "fe80::1"),
+	))
+	tables := []*DataTable{a, b}
+
+	tests := []struct {
+		name  string
+		op    func([]*DataTable, setMatch) []*Chunk
+		match setMatch
+		want  []string
+	}{
+		{"union", func(tables []*DataTable, _ setMatch) []*Chunk { return unionChunks(tables) }, matchPrefix, []string{"0.0.0.0/0", "10.0.0.0/8", "192.168.1.0/24", "2001:db8::/32"}},
+		{"intersect", intersectChunks, matchPrefix, []string{"10.0.0.0/8", "192.168.1.0/24"}},
+		{"intersect content", intersectChunks, matchContent, []string{"192.168.1.0/24"}},
+		{"subtract", subtractChunks, matchPrefix, []string{"0.0.0.0/0"}},
+		{"subtract content", subtractChunks, matchContent, []string{"0.0.0.0/0", "10.0.0.0/8"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := destinations(tt.op(tables, tt.match))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetOpIgnoresAge(t *testing.T) {
+	// Routes differing only in their age are the same route, as in watch
+	// mode
+	a := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"), routeBlock("0.0.0.0/0", "Static", "172.31.0.254"))
+	b := writeTable(t, strings.ReplaceAll(routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"), "27d02h01m21s", "00h00m05s"))
+	var out bytes.Buffer
+	if code := runSetOp("intersect", []string{"-match", "content", a, b}, &out); code != 0 || out.String() != "10.0.0.0/8\n" {
+		t.Errorf("intersect = %d, %q", code, out.String())
+	}
+	out.Reset()
+	if code := runSetOp("intersect", []string{"-match", "content", "-ignore-fields", "", a, b}, &out); code != 0 || out.String() != "" {
+		t.Errorf("intersect hashing Age = %d, %q", code, out.String())
+	}
+}
+
+func TestWriteChunks(t *testing.T) {
+	rt := loadTable(t, writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1")))
+	chunks := sortChunks([]*Chunk{rt.Chunks["10.0.0.0/8"]})
+
+	var buf bytes.Buffer
+	if err := writeChunks(&buf, chunks, "prefixes"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "10.0.0.0/8\n" {
+		t.Errorf("prefixes output = %q", buf.String())
+	}
+
+	buf.Reset()
+	if err := writeChunks(&buf, chunks, "chunks"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("Destination: 10.0.0.0/8\n     Protocol: IBGP")) {
+		t.Errorf("chunks output = %q", buf.String())
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Sink delivers change sets somewhere outside the process
+type Sink interface {
+	// Name identifies the sink in logs and in the dead-letter queue
+	Name() string
+	// Deliver sends one change set, returning an error if it was not
+	// accepted. Critical changes can be delivered while a batch is still
+	// being delivered, so Deliver must be safe for concurrent use.
+	Deliver(ctx context.Context, cs *ChangeSet) error
+}
+
+// flusher is implemented by sinks that hold change sets back, such as the
+// email sink's digests, so they are sent when the dispatcher is flushed
+type flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// historyRecorder is implemented by sinks that keep the history of
+// changes. They are sent every change, including those to volatile chunks
+// that notifications leave out.
+type historyRecorder interface {
+	recordsHistory() bool
+}
+
+// recordsHistory reports whether s keeps the history of changes
+func recordsHistory(s Sink) bool {
+	r, ok := s.(historyRecorder)
+	return ok && r.recordsHistory()
+}
+
+// sinkFactories maps sink URL schemes to their constructors
+var sinkFactories = map[string]func(u *url.URL) (Sink, error){}
+
+// newSink builds a sink from a URL spec such as "webhook+https://host/path".
+// The scheme selects the sink type; a "name" query parameter overrides the
+// default sink name.
+func newSink(spec string) (Sink, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sink %q: %w", spec, err)
+	}
+	factory, ok := sinkFactories[sinkKind(u)]
+	if !ok {
+		return nil, fmt.Errorf("unknown sink type %q (known: %s)", u.Scheme, strings.Join(sinkKinds(), ", "))
+	}
+	return factory(u)
+}
+
+// newSinks builds every sink in specs and checks that their names are
+// unique, since the dead-letter queue refers to sinks by name
+func newSinks(specs []string) ([]Sink, error) {
+	sinks := make([]Sink, 0, len(specs))
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		s, err := newSink(spec)
+		if err != nil {
+			return nil, err
+		}
+		if seen[s.Name()] {
+			return nil, fmt.Errorf("duplicate sink name %q; add ?name= to tell them apart", s.Name())
+		}
+		seen[s.Name()] = true
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+// sinkKind returns the sink type of a spec: the scheme up to any "+"
+// transport suffix
+func sinkKind(u *url.URL) string {
+	kind, _, _ := strings.Cut(u.Scheme, "+")
+	return kind
+}
+
+// sinkKinds lists the registered sink types
+func sinkKinds() []string {
+	kinds := make([]string, 0, len(sinkFactories))
+	for k := range sinkFactories {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// sinkName returns the name for a sink built from u: the "name" query
+// parameter if set, otherwise the sink type and host
+func sinkName(u *url.URL) string {
+	if name := u.Query().Get("name"); name != "" {
+		return name
+	}
+	if u.Host != "" {
+		return sinkKind(u) + "-" + u.Host
+	}
+	return sinkKind(u)
+}
+
+// topicPlaceholders are what the subject and routing key templates of the
+// message bus sinks can refer to
+var topicPlaceholders = []string{"{source}", "{path}", "{stream}", "{type}", "{destination}"}
+
+// topicSample is the change set templates are checked against
+var topicSample = &ChangeSet{Stream: "s", Path: "t.txt", Changes: []Change{{Type: ChangeAdded, Destination: "10.0.0.0/8"}}}
+
+// tableSource returns the base name of a table file up to its extension,
+// which stands for its table in topics
+func tableSource(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
+
+// renderTopic fills in the placeholders of a topic template for change c
+// of cs. Dots in the destination are kept, as separators of the words
+// that subscriptions' wildcards match; dots in the other values, and
+// whitespace and wildcards in any, become underscores.
+func renderTopic(tmpl string, cs *ChangeSet, c Change) string {
+	word := strings.NewReplacer(" ", "_", "\t", "_", "*", "_", ">", "_", "#", "_", "+", "_")
+	value := func(v string) string {
+		if v == "" {
+			return "_"
+		}
+		return word.Replace(strings.ReplaceAll(v, ".", "_"))
+	}
+	return strings.NewReplacer(
+		"{source}", value(tableSource(cs.Path)),
+		"{path}", value(cs.Path),
+		"{stream}", value(cs.Stream),
+		"{type}", value(string(c.Type)),
+		"{destination}", word.Replace(c.Destination),
+	).Replace(tmpl)
+}
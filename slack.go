@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// slackAPI is where bot tokens post messages
+var slackAPI = "https://slack.com/api/chat.postMessage"
+
+func init() {
+	sinkFactories["slack"] = func(u *url.URL) (Sink, error) {
+		return newSlackSink(u)
+	}
+}
+
+// SlackSink posts a summary of every change set to a Slack channel: the
+// counts by type, the address blocks with the most changes and a link to
+// the change set in the web UI. The spec is either an incoming webhook,
+// which posts to the channel it was created for:
+//
+//	slack+https://hooks.slack.com/services/T000/B000/XXXX
+//
+// or a channel name or ID posted to with a bot token, read as for the
+// webhook sink's secret:
+//
+//	slack://route-changes?token-env=SLACK_TOKEN
+//
+// Several sinks route change sets to different channels with the
+// parameters of chatNotifier, and take the webhook sink's timeout,
+// retries and backoff.
+type SlackSink struct {
+	chatNotifier
+	name    string
+	channel string
+	post    *WebhookSink
+}
+
+func newSlackSink(u *url.URL) (*SlackSink, error) {
+	s := &SlackSink{name: sinkName(u)}
+	q := u.Query()
+	if err := s.chatNotifier.parse(q); err != nil {
+		return nil, fmt.Errorf("slack sink %s: %w", s.name, err)
+	}
+	token, err := readSecret(q, "token")
+	if err != nil {
+		return nil, fmt.Errorf("slack sink %s: %w", s.name, err)
+	}
+
+	var target *url.URL
+	switch _, transport, _ := strings.Cut(u.Scheme, "+"); transport {
+	case "https", "http":
+		if token != nil {
+			return nil, fmt.Errorf("slack sink %s: incoming webhooks don't take a token", s.name)
+		}
+		target = &url.URL{Scheme: transport, Host: u.Host, Path: u.Path}
+	case "":
+		if s.channel = strings.TrimPrefix(u.Host+u.Path, "#"); s.channel == "" || token == nil {
+			return nil, fmt.Errorf("slack sink %s: needs slack://CHANNEL?token-env=VAR or an incoming webhook as slack+https://", s.name)
+		}
+		if target, err = url.Parse(slackAPI); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("slack sink %q needs slack:// or slack+https://", u.Redacted())
+	}
+
+	// One message at a time, so the channel reads in order
+	q.Set("concurrency", "1")
+	if s.post, err = newPoster(s.name, target, q); err != nil {
+		return nil, fmt.Errorf("slack sink %s: %w", s.name, err)
+	}
+	if token != nil {
+		s.post.header = http.Header{"Authorization": {"Bearer " + string(token)}}
+		s.post.accept = slackAccept
+	}
+	return s, nil
+}
+
+func (s *SlackSink) Name() string { return s.name }
+
+// Deliver posts the summary of cs, unless the sink's filter leaves nothing
+// of it
+func (s *SlackSink) Deliver(ctx context.Context, cs *ChangeSet) error {
+	sum := s.summarize(cs)
+	if sum == nil {
+		return nil
+	}
+	body, err := json.Marshal(slackMessage{Channel: s.channel, Text: slackText(sum)})
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+	if err := s.wait(ctx); err != nil {
+		return err
+	}
+	return s.post.send(ctx, body)
+}
+
+// slackMessage is the body of a message for an incoming webhook or
+// chat.postMessage
+type slackMessage struct {
+	Channel     string `json:"channel,omitempty"`
+	Text        string `json:"text"`
+	UnfurlLinks bool   `json:"unfurl_links"`
+}
+
+// slackText formats sum in Slack's mrkdwn
+func slackText(sum *chatSummary) string {
+	var b strings.Builder
+	cs := sum.cs
+	if cs.Truncated {
+		fmt.Fprintf(&b, ":warning: `%s` was truncated to zero bytes\n", cs.Path)
+	}
+	if sum.Changes > 0 {
+		fmt.Fprintf(&b, "*%d changed routes* in `%s`, changeset %d: %d added, %d removed, %d modified; %d routes in table\n",
+			sum.Changes, cs.Path, cs.ID, sum.Added, sum.Removed, sum.Modified, cs.Routes)
+	}
+	if sum.Critical > 0 {
+		fmt.Fprintf(&b, ":rotating_light: %d critical\n", sum.Critical)
+	}
+	if sum.Blocks != "" {
+		fmt.Fprintf(&b, "Top prefixes: %s\n", sum.Blocks)
+	}
+	if sum.Link != "" {
+		fmt.Fprintf(&b, "<%s|Full change set>\n", sum.Link)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// slackAccept checks a chat.postMessage reply, which reports errors with a
+// 200 status
+func slackAccept(body []byte) error {
+	var reply struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &reply); err != nil {
+		return fmt.Errorf("unexpected reply from Slack: %w", err)
+	}
+	if !reply.OK {
+		return errors.New("slack: " + reply.Error)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slackServer records the messages posted to it, answering with reply
+func slackServer(t *testing.T, reply string) (*httptest.Server, func() []slackMessage, func() http.Header) {
+	var mu sync.Mutex
+	var msgs []slackMessage
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		var m slackMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Errorf("invalid message %s: %v", data, err)
+		}
+		mu.Lock()
+		msgs = append(msgs, m)
+		header = r.Header.Clone()
+		mu.Unlock()
+		io.WriteString(w, reply)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []slackMessage {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]slackMessage(nil), msgs...)
+		}, func() http.Header {
+			mu.Lock()
+			defer mu.Unlock()
+			return header
+		}
+}
+
+func TestSlackSinkWebhook(t *testing.T) {
+	srv, msgs, _ := slackServer(t, "ok")
+	sink, err := newSink("slack+" + srv.URL + "/services/T0/B0/x?link=http://watcher:8080/&prefix=10.0.0.0/8%2B&top=1&interval=1ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &ChangeSet{ID: 42, Stream: "s1", Path: "core.txt", Routes: 100, Changes: []Change{
+		{Type: ChangeAdded, Destination: "10.1.0.0/16"},
+		{Type: ChangeModified, Destination: "10.2.0.0/16", Critical: true},
+		{Type: ChangeRemoved, Destination: "10.3.0.0/16", Volatile: true},
+		{Type: ChangeRemoved, Destination: "192.168.0.0/24"},
+	}}
+	if err := sink.Deliver(context.Background(), cs); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing this sink routes
+	if err := sink.Deliver(context.Background(), &ChangeSet{ID: 43, Path: "core.txt", Changes: []Change{
+		{Type: ChangeRemoved, Destination: "192.168.0.0/24"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := msgs()
+	if len(got) != 1 {
+		t.Fatalf("%d messages, want 1", len(got))
+	}
+	want := "*2 changed routes* in `core.txt`, changeset 42: 1 added, 0 removed, 1 modified; 100 routes in table\n" +
+		":rotating_light: 1 critical\n" +
+		"Top prefixes: 10.0.0.0/8: 1 modified, 1 added\n" +
+		"<http://watcher:8080/#changeset-s1-42|Full change set>"
+	if got[0].Text != want {
+		t.Errorf("text =\n%s\nwant\n%s", got[0].Text, want)
+	}
+	if got[0].Channel != "" {
+		t.Errorf("channel = %q; incoming webhooks have their own", got[0].Channel)
+	}
+}
+
+func TestSlackSinkBot(t *testing.T) {
+	srv, msgs, header := slackServer(t, `{"ok": true}`)
+	defer func(api string) { slackAPI = api }(slackAPI)
+	slackAPI = srv.URL + "/api/chat.postMessage"
+	t.Setenv("SLACK_TEST_TOKEN", "xoxb-1")
+
+	sink, err := newSink("slack://route-changes?token-env=SLACK_TEST_TOKEN&interval=30ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sink.Name() != "slack-route-changes" {
+		t.Errorf("name = %q", sink.Name())
+	}
+	start := time.Now()
+	for range 3 {
+		if err := sink.Deliver(context.Background(), &ChangeSet{Path: "t.txt", Truncated: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if took := time.Since(start); took < 60*time.Millisecond {
+		t.Errorf("3 messages in %v; want them 30ms apart", took)
+	}
+	got := msgs()
+	if len(got) != 3 || got[0].Channel != "route-changes" || !strings.Contains(got[0].Text, "`t.txt` was truncated") {
+		t.Errorf("messages = %+v", got)
+	}
+	if auth := header().Get("Authorization"); auth != "Bearer xoxb-1" {
+		t.Errorf("Authorization = %q", auth)
+	}
+}
+
+func TestSlackSinkAPIError(t *testing.T) {
+	srv, _, _ := slackServer(t, `{"ok": false, "error": "channel_not_found"}`)
+	defer func(api string) { slackAPI = api }(slackAPI)
+	slackAPI = srv.URL
+	t.Setenv("SLACK_TEST_TOKEN", "xoxb-1")
+
+	sink, err := newSink("slack://nowhere?token-env=SLACK_TEST_TOKEN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.Deliver(context.Background(), &ChangeSet{Path: "t.txt", Truncated: true})
+	if err == nil || !strings.Contains(err.Error(), "channel_not_found") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestNewSlackSinkErrors(t *testing.T) {
+	t.Setenv("SLACK_TEST_TOKEN", "xoxb-1")
+	for _, spec := range []string{
+		"slack://route-changes",
+		"slack://?token-env=SLACK_TEST_TOKEN",
+		"slack+https://hooks.slack.com/services/x?token-env=SLACK_TEST_TOKEN",
+		"slack+ftp://host/x",
+		"slack://c?token-env=SLACK_TEST_TOKEN&type=renamed",
+		"slack://c?token-env=SLACK_TEST_TOKEN&interval=often",
+	} {
+		if _, err := newSink(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
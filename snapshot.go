@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// snapshotVersion changes whenever the snapshot layout does, so older
+// snapshots are ignored rather than misread
+const snapshotVersion = 1
+
+// snapshot is the chunk map of a table saved after loading it, so the
+// next start can skip parsing and hashing a file that hasn't changed
+type snapshot struct {
+	Version int
+	// Digest is the xxhash of the file the chunks were parsed from
+	Digest string
+	// Options fingerprints the load options that affect chunk hashes
+	Options   string
+	Algorithm HashAlgorithm
+	Chunks    []snapshotChunk
+}
+
+// snapshotChunk is a chunk without its body
+type snapshotChunk struct {
+	Destination        string
+	Hash               string
+	StartLine, EndLine int64
+	Offset, Length     int64
+}
+
+// snapshotPath returns the snapshot file for the table at path in dir
+func snapshotPath(dir, path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	name := strings.Trim(strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(abs), "_")
+	return filepath.Join(dir, name+".snap")
+}
+
+// optionsKey fingerprints the load options that change how a file is
+// chunked and hashed
+func (rt *DataTable) optionsKey() string {
+	o := rt.Options
+	return fmt.Sprintf("chunker=%s hash=%s normalize=%q ignore=%q max-line=%d", o.Chunker, o.Hash.orDefault(), o.Normalize, o.IgnoreFields, o.MaxLineBytes)
+}
+
+// SaveSnapshot writes the table's chunk map to path. Tables that weren't
+// parsed from the whole file, such as compressed ones, have nothing to
+// save.
+func (rt *DataTable) SaveSnapshot(path string) error {
+	rt.mu.RLock()
+	digest := rt.digest
+	rt.mu.RUnlock()
+	if digest == "" {
+		return nil
+	}
+	return rt.SaveState(path)
+}
+
+// SaveState writes the table's chunk map to path, for LoadState
+func (rt *DataTable) SaveState(path string) error {
+	rt.mu.RLock()
+	snap := snapshot{
+		Version:   snapshotVersion,
+		Digest:    rt.digest,
+		Options:   rt.optionsKey(),
+		Algorithm: rt.Algorithm,
+		Chunks:    make([]snapshotChunk, 0, len(rt.Chunks)),
+	}
+	for _, c := range rt.Chunks {
+		snap.Chunks = append(snap.Chunks, snapshotChunk{c.Destination, c.Hash, c.StartLine, c.EndLine, c.Offset, c.Length})
+	}
+	rt.mu.RUnlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".snapshot-*")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	err = gob.NewEncoder(w).Encode(&snap)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	// Replace the old snapshot in one step, so a crash never leaves a
+	// partial one
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return nil
+}
+
+// readSnapshot reads the snapshot at path, or returns nil if there is none
+func readSnapshot(path string) (*snapshot, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer f.Close()
+	var snap snapshot
+	if err := gob.NewDecoder(bufio.NewReader(f)).Decode(&snap); err != nil {
+		return nil, fmt.Errorf("failed to read snapshot %s: %w", path, err)
+	}
+	return &snap, nil
+}
+
+// LoadSnapshot loads the chunk map saved at path if it was saved with the
+// same options from a file identical to the current one. It reports
+// whether the snapshot was used; a missing or stale snapshot isn't an
+// error. Chunks loaded from a snapshot have no bodies in memory, as in
+// lean mode, and read them back from the file when needed.
+func (rt *DataTable) LoadSnapshot(path string) (bool, error) {
+	snap, err := readSnapshot(path)
+	if snap == nil || err != nil {
+		return false, err
+	}
+	if snap.Version != snapshotVersion || snap.Options != rt.optionsKey() || snap.Algorithm != rt.Options.Hash.orDefault() {
+		return false, nil
+	}
+
+	file, err := openTable(rt.FilePath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	if _, err := rt.leanFor(file); err != nil {
+		return false, err
+	}
+	if format, err := compression(file); err != nil || format != "" {
+		return false, err
+	}
+	digest := xxhash.New()
+	if _, err := io.Copy(digest, file); err != nil {
+		return false, fmt.Errorf("failed to read file: %w", err)
+	}
+	if fmt.Sprintf("%016x", digest.Sum64()) != snap.Digest {
+		return false, nil
+	}
+
+	ck, err := rt.newChunker(true)
+	if err != nil {
+		return false, err
+	}
+	chunks := make(map[string]*Chunk, len(snap.Chunks))
+	for _, c := range snap.Chunks {
+		chunks[c.Destination] = &Chunk{
+			Destination: c.Destination,
+			Hash:        c.Hash,
+			StartLine:   c.StartLine,
+			EndLine:     c.EndLine,
+			Offset:      c.Offset,
+			Length:      c.Length,
+			src:         ck.src,
+		}
+	}
+	rt.mu.Lock()
+	rt.Chunks = chunks
+	rt.Algorithm = snap.Algorithm
+	rt.digest = snap.Digest
+	rt.blocks = nil
+	rt.mu.Unlock()
+	return true, nil
+}
+
+// LoadState loads the chunk map saved at path as the table's state,
+// whether or not the file changed since, so that the next DetectChanges
+// reports what changed in between. It reports whether there was a saved
+// state. Unlike LoadSnapshot the chunks have no bodies at all, since the
+// file may no longer hold them.
+func (rt *DataTable) LoadState(path string) (bool, error) {
+	snap, err := readSnapshot(path)
+	if snap == nil || err != nil {
+		return false, err
+	}
+	if snap.Version != snapshotVersion {
+		return false, fmt.Errorf("%s has snapshot version %d, want %d; delete it to start over", path, snap.Version, snapshotVersion)
+	}
+	if snap.Options != rt.optionsKey() {
+		return false, fmt.Errorf("%s was saved with other options (%s); delete it to start over", path, snap.Options)
+	}
+
+	chunks := make(map[string]*Chunk, len(snap.Chunks))
+	for _, c := range snap.Chunks {
+		chunks[c.Destination] = &Chunk{
+			Destination: c.Destination,
+			Hash:        c.Hash,
+			StartLine:   c.StartLine,
+			EndLine:     c.EndLine,
+			Offset:      c.Offset,
+			Length:      c.Length,
+		}
+	}
+	rt.mu.Lock()
+	rt.Chunks = chunks
+	rt.Algorithm = snap.Algorithm
+	rt.digest = snap.Digest
+	rt.blocks = nil
+	rt.mu.Unlock()
+	return true, nil
+}
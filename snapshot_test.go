@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	path := writeTable(t,
+		routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"),
+		routeBlock("0.0.0.0/0", "Static", "172.31.0.254"))
+	snap := snapshotPath(t.TempDir(), path)
+	loaded := loadTable(t, path)
+	if err := loaded.SaveSnapshot(snap); err != nil {
+		t.Fatal(err)
+	}
+
+	// An unchanged file is loaded from the snapshot, bodies read back from
+	// the file
+	rt := NewDataTable(path)
+	used, err := rt.LoadSnapshot(snap)
+	if err != nil || !used {
+		t.Fatalf("LoadSnapshot = %v, %v, want true", used, err)
+	}
+	if len(rt.Chunks) != len(loaded.Chunks) {
+		t.Fatalf("loaded %d chunks, want %d", len(rt.Chunks), len(loaded.Chunks))
+	}
+	for dest, c := range loaded.Chunks {
+		got := rt.Chunks[dest]
+		if got == nil || got.Hash != c.Hash {
+			t.Fatalf("%s: chunk %+v, want hash %s", dest, got, c.Hash)
+		}
+		body, err := got.Content()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, _ := c.Content(); !bytes.Equal(body, want) {
+			t.Errorf("%s: content %q, want %q", dest, body, want)
+		}
+	}
+
+	// A snapshot saved with other options is ignored
+	other := NewDataTable(path)
+	other.Options.Hash = HashBLAKE3
+	if used, err := other.LoadSnapshot(snap); err != nil || used {
+		t.Errorf("LoadSnapshot with other options = %v, %v, want false", used, err)
+	}
+
+	// Changes are still detected against the snapshot's chunks
+	rewriteFile(t, path, "172.31.0.1", "172.31.0.2")
+	cs, err := rt.DetectChanges(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Len() != 1 || cs.Changes[0].Destination != "10.0.0.0/8" {
+		t.Errorf("changes %+v, want 10.0.0.0/8 modified", cs.Changes)
+	}
+
+	// So is a snapshot of an older version of the file
+	if used, err := NewDataTable(path).LoadSnapshot(snap); err != nil || used {
+		t.Errorf("LoadSnapshot after change = %v, %v, want false", used, err)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultSNMPOID is the OID the sink's notifications and objects are
+// under unless given another: NET-SNMP-MIB's netSnmpPlaypen, meant for
+// experiments, so real deployments should use their enterprise's own
+const DefaultSNMPOID = "1.3.6.1.4.1.8072.9999.9999"
+
+// Notifications and objects, under the sink's OID
+var (
+	snmpRouteRemoved    = []uint32{0, 1}
+	snmpRoutesWithdrawn = []uint32{0, 2}
+	snmpAlertCleared    = []uint32{0, 3}
+
+	snmpAlertKey     = []uint32{1, 1}
+	snmpAlertSummary = []uint32{1, 2}
+	snmpAlertTable   = []uint32{1, 3}
+	snmpAlertPrefix  = []uint32{1, 4}
+	snmpAlertCount   = []uint32{1, 5}
+	snmpAlertCrit    = []uint32{1, 6}
+)
+
+func init() {
+	sinkFactories["snmp"] = func(u *url.URL) (Sink, error) {
+		return newSNMPSink(u)
+	}
+}
+
+// SNMPSink sends SNMP traps when an alert condition fires and clears, as
+// the PagerDuty sink opens and resolves incidents, for network management
+// systems that only take SNMP. The spec is snmp://host[:162] for v2c or
+// snmp://user@host[:162]?version=3, with the parameters of
+// alertConditions and
+//
+//	community-env        environment variable holding the v2c community
+//	community-file       file holding it, instead (default public)
+//	auth                 v3 authentication: md5, sha (the default) or
+//	                     sha256
+//	auth-password-env    environment variable holding the v3 user's
+//	auth-password-file   authentication password, or file holding it
+//	priv                 v3 privacy: aes, the only one, for AES-128
+//	priv-password-env    environment variable holding the privacy
+//	priv-password-file   password, or file holding it
+//	engine-id            the v3 engine ID, in hex (default one of format
+//	                     text with the host name)
+//	oid                  the OID of the notifications (default
+//	                     DefaultSNMPOID)
+//
+// Under the OID, notifications .0.1, .0.2 and .0.3 are sent when a route
+// is removed, routes are withdrawn and an alert clears. They carry the
+// alert's key in .1.1, its summary in .1.2, the table in .1.3, the
+// affected prefixes, comma separated, in .1.4, their number in .1.5 and,
+// in .1.6, whether any is critical (1, or 2 for false, as TruthValue).
+// The v3 engine's boots are the Unix time it started, so receivers
+// accept its traps after a restart.
+type SNMPSink struct {
+	alertConditions
+	name      string
+	addr      string
+	oid       []uint32
+	community string
+	// user is set for v3
+	user     *snmpUser
+	engineID []byte
+	start    time.Time
+
+	// requestID and conn are only used with alertConditions' lock held
+	requestID int32
+	conn      net.Conn
+}
+
+func newSNMPSink(u *url.URL) (*SNMPSink, error) {
+	s := &SNMPSink{name: sinkName(u), start: time.Now()}
+	s.open, s.close, s.service = s.raiseTrap, s.clearTrap, "SNMP"
+	if err := s.parse(u); err != nil {
+		return nil, fmt.Errorf("snmp sink %s: %w", s.name, err)
+	}
+	return s, nil
+}
+
+// parse takes the sink's options from u
+func (s *SNMPSink) parse(u *url.URL) error {
+	if u.Hostname() == "" {
+		return errors.New("needs the trap receiver, as snmp://host:162")
+	}
+	port := u.Port()
+	if port == "" {
+		port = "162"
+	}
+	s.addr = net.JoinHostPort(u.Hostname(), port)
+	q := u.Query()
+	if err := s.alertConditions.parse(q); err != nil {
+		return err
+	}
+	var err error
+	oid := DefaultSNMPOID
+	if v := q.Get("oid"); v != "" {
+		oid = v
+	}
+	if s.oid, err = parseOID(oid); err != nil {
+		return err
+	}
+
+	switch version := q.Get("version"); version {
+	case "", "2c":
+		community, err := readSecret(q, "community")
+		if err != nil {
+			return err
+		}
+		if s.community = string(community); community == nil {
+			s.community = "public"
+		}
+		return nil
+	case "3":
+		return s.parseV3(u, q)
+	default:
+		return fmt.Errorf("unknown version %q (want 2c or 3)", version)
+	}
+}
+
+// parseV3 takes the v3 user's options from u and q, localizing their
+// keys to the engine ID
+func (s *SNMPSink) parseV3(u *url.URL, q url.Values) error {
+	if u.User == nil || u.User.Username() == "" {
+		return errors.New("version 3 needs a user, as snmp://user@host:162")
+	}
+	s.user = &snmpUser{name: u.User.Username()}
+	if v := q.Get("engine-id"); v != "" {
+		var err error
+		if s.engineID, err = hex.DecodeString(strings.TrimPrefix(v, "0x")); err != nil || len(s.engineID) < 5 || len(s.engineID) > 32 {
+			return fmt.Errorf("invalid engine-id %q (want 5 to 32 bytes in hex)", v)
+		}
+	} else {
+		host, err := os.Hostname()
+		if err != nil || host == "" {
+			host = "go-watcher"
+		}
+		// Net-SNMP's enterprise number, then format 4 (text)
+		s.engineID = append([]byte{0x80, 0x00, 0x1f, 0x88, 4}, host[:min(len(host), 27)]...)
+	}
+
+	authPassword, err := readSecret(q, "auth-password")
+	if err != nil {
+		return err
+	}
+	privPassword, err := readSecret(q, "priv-password")
+	if err != nil {
+		return err
+	}
+	authName, privName := q.Get("auth"), q.Get("priv")
+	if authPassword == nil {
+		if authName != "" || privName != "" || privPassword != nil {
+			return errors.New("auth and priv need auth-password-env or auth-password-file")
+		}
+		return nil
+	}
+	if authName == "" {
+		authName = "sha"
+	}
+	auth, ok := snmpAuths[authName]
+	if !ok {
+		return fmt.Errorf("unknown auth %q (want md5, sha or sha256)", authName)
+	}
+	if len(authPassword) < 8 {
+		return errors.New("auth-password must be at least 8 characters")
+	}
+	s.user.auth = &auth
+	s.user.authKey = snmpLocalizeKey(auth.hash, string(authPassword), s.engineID)
+
+	if privName == "" && privPassword == nil {
+		return nil
+	}
+	if privName != "" && privName != "aes" {
+		return fmt.Errorf("unknown priv %q (want aes)", privName)
+	}
+	if len(privPassword) < 8 {
+		return errors.New("priv needs priv-password-env or priv-password-file, of at least 8 characters")
+	}
+	s.user.privKey = snmpLocalizeKey(auth.hash, string(privPassword), s.engineID)[:16]
+	return nil
+}
+
+func (s *SNMPSink) Name() string { return s.name }
+
+// Deliver checks the alert conditions against cs
+func (s *SNMPSink) Deliver(ctx context.Context, cs *ChangeSet) error {
+	return s.check(ctx, cs)
+}
+
+// raiseTrap sends the trap of a
+func (s *SNMPSink) raiseTrap(ctx context.Context, a *alert) error {
+	trap := snmpRouteRemoved
+	if a.Class == "routes-withdrawn" {
+		trap = snmpRoutesWithdrawn
+	}
+	critical := int64(2)
+	if a.Critical {
+		critical = 1
+	}
+	return s.send(trap, []snmpVarBind{
+		{s.object(snmpAlertKey), berTLV(berOctets, []byte(a.Key))},
+		{s.object(snmpAlertSummary), berTLV(berOctets, []byte(a.Summary))},
+		{s.object(snmpAlertTable), berTLV(berOctets, []byte(a.cs.Path))},
+		{s.object(snmpAlertPrefix), berTLV(berOctets, []byte(strings.Join(a.Destinations, ",")))},
+		{s.object(snmpAlertCount), berInt(berInteger, int64(len(a.Destinations)+a.Unlisted))},
+		{s.object(snmpAlertCrit), berInt(berInteger, critical)},
+	})
+}
+
+// clearTrap sends the trap of the alert of key clearing
+func (s *SNMPSink) clearTrap(ctx context.Context, key string) error {
+	return s.send(snmpAlertCleared, []snmpVarBind{
+		{s.object(snmpAlertKey), berTLV(berOctets, []byte(key))},
+	})
+}
+
+// object returns the OID of one of the sink's notifications or objects
+func (s *SNMPSink) object(sub []uint32) []uint32 {
+	return append(append([]uint32(nil), s.oid...), sub...)
+}
+
+// send sends notification trap with binds
+func (s *SNMPSink) send(trap []uint32, binds []snmpVarBind) error {
+	s.requestID++
+	up := time.Since(s.start)
+	pdu := snmpTrapPDU(s.requestID, uint32(up/(10*time.Millisecond)), s.object(trap), binds)
+	msg := snmpV2cMessage(s.community, pdu)
+	if s.user != nil {
+		var err error
+		msg, err = snmpV3Message(s.requestID, s.engineID, int32(s.start.Unix()), int32(up/time.Second), s.user, pdu)
+		if err != nil {
+			return fmt.Errorf("failed to encode trap: %w", err)
+		}
+	}
+	if s.conn == nil {
+		conn, err := net.Dial("udp", s.addr)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	if _, err := s.conn.Write(msg); err != nil {
+		// Dial again next time, in case the receiver's address changed
+		s.conn.Close()
+		s.conn = nil
+		return fmt.Errorf("failed to send trap: %w", err)
+	}
+	return nil
+}
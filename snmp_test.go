@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+)
+
+// berNode is a decoded TLV, with its children if it is constructed
+type berNode struct {
+	tag      byte
+	value    []byte
+	children []berNode
+	// offset is where value starts in the message
+	offset int
+}
+
+// decodeBER decodes the TLVs in b, at offset in the message
+func decodeBER(t *testing.T, b []byte, offset int) []berNode {
+	t.Helper()
+	var nodes []berNode
+	for i := 0; i < len(b); {
+		tag, n := b[i], int(b[i+1])
+		head := 2
+		if n&0x80 != 0 {
+			size := n & 0x7f
+			n = 0
+			for _, c := range b[i+2 : i+2+size] {
+				n = n<<8 | int(c)
+			}
+			head += size
+		}
+		node := berNode{tag: tag, value: b[i+head : i+head+n], offset: offset + i + head}
+		if tag&0x20 != 0 {
+			node.children = decodeBER(t, node.value, node.offset)
+		}
+		nodes = append(nodes, node)
+		i += head + n
+	}
+	return nodes
+}
+
+func TestSNMPLocalizeKey(t *testing.T) {
+	// RFC 3414 A.3
+	engineID, _ := hex.DecodeString("000000000000000000000002")
+	for _, tc := range []struct {
+		auth string
+		want string
+	}{
+		{"md5", "526f5eed9fcce26f8964c2930787d82b"},
+		{"sha", "6695febc9288e36282235fc7151f128497b38f3f"},
+	} {
+		if got := hex.EncodeToString(snmpLocalizeKey(snmpAuths[tc.auth].hash, "maplesyrup", engineID)); got != tc.want {
+			t.Errorf("%s key = %s, want %s", tc.auth, got, tc.want)
+		}
+	}
+}
+
+func TestBEREncoding(t *testing.T) {
+	for _, tc := range []struct {
+		got, want []byte
+	}{
+		{berInt(berInteger, 0), []byte{2, 1, 0}},
+		{berInt(berInteger, 127), []byte{2, 1, 0x7f}},
+		{berInt(berInteger, 128), []byte{2, 2, 0, 0x80}},
+		{berInt(berInteger, -129), []byte{2, 2, 0xff, 0x7f}},
+		{berUint(berTimeTicks, 0xffffffff), []byte{0x43, 5, 0, 0xff, 0xff, 0xff, 0xff}},
+		{berObjectID([]uint32{1, 3, 6, 1, 4, 1, 8072, 16384}), []byte{6, 10, 0x2b, 6, 1, 4, 1, 0xbf, 0x08, 0x81, 0x80, 0}},
+		{berTLV(berOctets, make([]byte, 200))[:3], []byte{4, 0x81, 200}},
+	} {
+		if !bytes.Equal(tc.got, tc.want) {
+			t.Errorf("% x, want % x", tc.got, tc.want)
+		}
+	}
+}
+
+// snmpReceiver listens for traps and returns its address and a channel
+// of the messages received
+func snmpReceiver(t *testing.T) (string, chan []byte) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	msgs := make(chan []byte, 10)
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			msgs <- bytes.Clone(buf[:n])
+		}
+	}()
+	return conn.LocalAddr().String(), msgs
+}
+
+func receiveTrap(t *testing.T, msgs chan []byte) []byte {
+	t.Helper()
+	select {
+	case msg := <-msgs:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no trap received")
+		return nil
+	}
+}
+
+// trapVarBinds returns the values of the varbinds of a trap PDU node by
+// OID, in dotted form
+func trapVarBinds(t *testing.T, pdu berNode) map[string][]byte {
+	if pdu.tag != berTrapPDU {
+		t.Fatalf("PDU tag %#x", pdu.tag)
+	}
+	binds := make(map[string][]byte)
+	for _, vb := range pdu.children[3].children {
+		binds[hex.EncodeToString(vb.children[0].value)] = vb.children[1].value
+	}
+	return binds
+}
+
+func TestSNMPSinkV2c(t *testing.T) {
+	addr, msgs := snmpReceiver(t)
+	t.Setenv("SNMP_TEST_COMMUNITY", "s3cret")
+	sink, err := newSink("snmp://" + addr + "?community-env=SNMP_TEST_COMMUNITY&oid=1.3.6.1.4.1.99999&resolve-after=10ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &ChangeSet{ID: 4, Path: "core.txt", Changes: []Change{{Type: ChangeRemoved, Destination: "0.0.0.0/0", Critical: true}}}
+	if err := sink.Deliver(context.Background(), cs); err != nil {
+		t.Fatal(err)
+	}
+	msg := decodeBER(t, receiveTrap(t, msgs), 0)[0]
+	if msg.children[0].value[0] != 1 || string(msg.children[1].value) != "s3cret" {
+		t.Errorf("version %v, community %q", msg.children[0].value, msg.children[1].value)
+	}
+	binds := trapVarBinds(t, msg.children[2])
+	oid := func(s string) string {
+		o, _ := parseOID(s)
+		return hex.EncodeToString(berObjectID(o)[2:])
+	}
+	if got := hex.EncodeToString(binds[oid("1.3.6.1.6.3.1.1.4.1.0")]); got != oid("1.3.6.1.4.1.99999.0.1") {
+		t.Errorf("trap OID %s", got)
+	}
+	if got := string(binds[oid("1.3.6.1.4.1.99999.1.4")]); got != "0.0.0.0/0" {
+		t.Errorf("prefix %q", got)
+	}
+	if got := string(binds[oid("1.3.6.1.4.1.99999.1.1")]); got != "go-watcher/core.txt/removed/0.0.0.0/0" {
+		t.Errorf("key %q", got)
+	}
+	if got := binds[oid("1.3.6.1.4.1.99999.1.6")]; !bytes.Equal(got, []byte{1}) {
+		t.Errorf("critical %v", got)
+	}
+
+	// The route coming back clears the alert
+	cs = &ChangeSet{ID: 5, Path: "core.txt", Changes: []Change{{Type: ChangeAdded, Destination: "0.0.0.0/0"}}}
+	if err := sink.Deliver(context.Background(), cs); err != nil {
+		t.Fatal(err)
+	}
+	binds = trapVarBinds(t, decodeBER(t, receiveTrap(t, msgs), 0)[0].children[2])
+	if got := hex.EncodeToString(binds[oid("1.3.6.1.6.3.1.1.4.1.0")]); got != oid("1.3.6.1.4.1.99999.0.3") {
+		t.Errorf("clear trap OID %s", got)
+	}
+}
+
+func TestSNMPSinkV3(t *testing.T) {
+	addr, msgs := snmpReceiver(t)
+	t.Setenv("SNMP_TEST_AUTH", "authpass1")
+	t.Setenv("SNMP_TEST_PRIV", "privpass1")
+	sink, err := newSink("snmp://watcher@" + addr + "?version=3&auth=md5&auth-password-env=SNMP_TEST_AUTH&priv=aes&priv-password-env=SNMP_TEST_PRIV&engine-id=8000000001020304")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &ChangeSet{Path: "core.txt", Changes: []Change{{Type: ChangeRemoved, Destination: "::/0"}}}
+	if err := sink.Deliver(context.Background(), cs); err != nil {
+		t.Fatal(err)
+	}
+	raw := receiveTrap(t, msgs)
+	msg := decodeBER(t, raw, 0)[0]
+	if msg.children[0].value[0] != 3 {
+		t.Fatalf("version %v", msg.children[0].value)
+	}
+	if flags := msg.children[1].children[2].value; !bytes.Equal(flags, []byte{3}) {
+		t.Errorf("flags %v", flags)
+	}
+	usm := decodeBER(t, msg.children[2].value, msg.children[2].offset)[0].children
+	engineID, _ := hex.DecodeString("8000000001020304")
+	if !bytes.Equal(usm[0].value, engineID) || string(usm[3].value) != "watcher" {
+		t.Errorf("engine %x, user %q", usm[0].value, usm[3].value)
+	}
+
+	// The MAC is over the message with it zeroed
+	mac := usm[4]
+	zeroed := bytes.Clone(raw)
+	clear(zeroed[mac.offset : mac.offset+len(mac.value)])
+	h := hmac.New(md5.New, snmpLocalizeKey(md5.New, "authpass1", engineID))
+	h.Write(zeroed)
+	if !bytes.Equal(mac.value, h.Sum(nil)[:12]) {
+		t.Errorf("MAC %x, want %x", mac.value, h.Sum(nil)[:12])
+	}
+
+	block, _ := aes.NewCipher(snmpLocalizeKey(md5.New, "privpass1", engineID)[:16])
+	// The IV is boots and time, as 32 bits each, and the salt
+	var boots, secs uint32
+	for _, c := range usm[1].value {
+		boots = boots<<8 | uint32(c)
+	}
+	for _, c := range usm[2].value {
+		secs = secs<<8 | uint32(c)
+	}
+	iv := append([]byte{byte(boots >> 24), byte(boots >> 16), byte(boots >> 8), byte(boots), byte(secs >> 24), byte(secs >> 16), byte(secs >> 8), byte(secs)}, usm[5].value...)
+	enc := msg.children[3].value
+	scoped := make([]byte, len(enc))
+	cipher.NewCFBDecrypter(block, iv).XORKeyStream(scoped, enc)
+	pdu := decodeBER(t, scoped, 0)[0].children[2]
+	found := false
+	for _, v := range trapVarBinds(t, pdu) {
+		found = found || string(v) == "::/0"
+	}
+	if !found {
+		t.Error("prefix not found in decrypted trap")
+	}
+}
+
+func TestNewSNMPSinkErrors(t *testing.T) {
+	t.Setenv("SNMP_TEST_SHORT", "short")
+	t.Setenv("SNMP_TEST_AUTH", "authpass1")
+	for _, spec := range []string{
+		"snmp://",
+		"snmp://nms?version=1",
+		"snmp://nms?oid=1.x",
+		"snmp://nms?version=3",
+		"snmp://watcher@nms?version=3&auth=sha",
+		"snmp://watcher@nms?version=3&auth-password-env=SNMP_TEST_SHORT",
+		"snmp://watcher@nms?version=3&auth=sha512&auth-password-env=SNMP_TEST_AUTH",
+		"snmp://watcher@nms?version=3&auth-password-env=SNMP_TEST_AUTH&priv=des&priv-password-env=SNMP_TEST_AUTH",
+		"snmp://watcher@nms?version=3&auth-password-env=SNMP_TEST_AUTH&priv=aes",
+		"snmp://watcher@nms?version=3&engine-id=zz",
+	} {
+		if _, err := newSink(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+// Just enough SNMP to send notifications: BER encoding of SNMPv2-Trap
+// PDUs in v2c messages, and in v3 messages with the user-based security
+// model (RFC 3414): HMAC-MD5-96, HMAC-SHA-96 or HMAC-SHA-256-192
+// authentication (RFC 7860) and AES-128 privacy (RFC 3826).
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// BER tags
+const (
+	berInteger   = 0x02
+	berOctets    = 0x04
+	berOID       = 0x06
+	berSequence  = 0x30
+	berTimeTicks = 0x43
+	berTrapPDU   = 0xa7
+)
+
+// Well-known OIDs of SNMPv2-MIB
+var (
+	oidSysUpTime = []uint32{1, 3, 6, 1, 2, 1, 1, 3, 0}
+	oidTrapOID   = []uint32{1, 3, 6, 1, 6, 3, 1, 1, 4, 1, 0}
+)
+
+// berTLV encodes a tag, length and value
+func berTLV(tag byte, value []byte) []byte {
+	b := []byte{tag}
+	switch n := len(value); {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n <= 0xff:
+		b = append(b, 0x81, byte(n))
+	default:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	}
+	return append(b, value...)
+}
+
+// berInt encodes an integer of type tag, in as few bytes as keep its sign
+func berInt(tag byte, v int64) []byte {
+	b := binary.BigEndian.AppendUint64(nil, uint64(v))
+	for len(b) > 1 && (b[0] == 0 && b[1]&0x80 == 0 || b[0] == 0xff && b[1]&0x80 != 0) {
+		b = b[1:]
+	}
+	return berTLV(tag, b)
+}
+
+// berUint encodes an unsigned integer of an application type such as
+// TimeTicks, which BER still writes as signed
+func berUint(tag byte, v uint32) []byte {
+	return berInt(tag, int64(v))
+}
+
+// berObjectID encodes an object identifier
+func berObjectID(oid []uint32) []byte {
+	b := []byte{byte(40*oid[0] + oid[1])}
+	for _, arc := range oid[2:] {
+		// Base 128, most significant group first, all but the last
+		// with the high bit set
+		n := 1
+		for v := arc >> 7; v != 0; v >>= 7 {
+			n++
+		}
+		for i := n - 1; i >= 0; i-- {
+			c := byte(arc>>(7*i)) & 0x7f
+			if i > 0 {
+				c |= 0x80
+			}
+			b = append(b, c)
+		}
+	}
+	return berTLV(berOID, b)
+}
+
+// parseOID parses a dotted object identifier
+func parseOID(s string) ([]uint32, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "."), ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+	oid := make([]uint32, len(parts))
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		oid[i] = uint32(n)
+	}
+	if oid[0] > 2 || oid[0] < 2 && oid[1] >= 40 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+	return oid, nil
+}
+
+// snmpVarBind is a variable binding: an OID and its encoded value
+type snmpVarBind struct {
+	oid   []uint32
+	value []byte
+}
+
+// snmpTrapPDU encodes an SNMPv2-Trap-PDU of the notification trap, sent
+// uptime hundredths of a second after the sender started
+func snmpTrapPDU(requestID int32, uptime uint32, trap []uint32, binds []snmpVarBind) []byte {
+	list := berTLV(berSequence, append(berObjectID(oidSysUpTime), berUint(berTimeTicks, uptime)...))
+	list = append(list, berTLV(berSequence, append(berObjectID(oidTrapOID), berObjectID(trap)...))...)
+	for _, vb := range binds {
+		list = append(list, berTLV(berSequence, append(berObjectID(vb.oid), vb.value...))...)
+	}
+	var pdu []byte
+	pdu = append(pdu, berInt(berInteger, int64(requestID))...)
+	pdu = append(pdu, berInt(berInteger, 0)...) // error-status
+	pdu = append(pdu, berInt(berInteger, 0)...) // error-index
+	pdu = append(pdu, berTLV(berSequence, list)...)
+	return berTLV(berTrapPDU, pdu)
+}
+
+// snmpV2cMessage wraps pdu in a v2c message for community
+func snmpV2cMessage(community string, pdu []byte) []byte {
+	msg := berInt(berInteger, 1) // version-2c
+	msg = append(msg, berTLV(berOctets, []byte(community))...)
+	return berTLV(berSequence, append(msg, pdu...))
+}
+
+// snmpAuth is a USM authentication protocol
+type snmpAuth struct {
+	hash func() hash.Hash
+	// macLen is how much of the HMAC goes in the message
+	macLen int
+}
+
+var snmpAuths = map[string]snmpAuth{
+	"md5":    {md5.New, 12},
+	"sha":    {sha1.New, 12},
+	"sha256": {sha256.New, 24},
+}
+
+// snmpUser is a USM user, with keys localized to the sending engine
+type snmpUser struct {
+	name    string
+	auth    *snmpAuth
+	authKey []byte
+	// privKey is the AES-128 key, if messages are encrypted
+	privKey []byte
+}
+
+// snmpLocalizeKey turns a password into a key for engineID, as in RFC
+// 3414 A.2: the hash of a megabyte of the password repeated, hashed again
+// between two copies of the engine ID
+func snmpLocalizeKey(newHash func() hash.Hash, password string, engineID []byte) []byte {
+	h := newHash()
+	buf := make([]byte, 64)
+	for i, n := 0, 0; n < 1<<20; n += 64 {
+		for j := range buf {
+			buf[j] = password[i%len(password)]
+			i++
+		}
+		h.Write(buf)
+	}
+	ku := h.Sum(nil)
+	h.Reset()
+	h.Write(ku)
+	h.Write(engineID)
+	h.Write(ku)
+	return h.Sum(nil)
+}
+
+// snmpV3Message wraps pdu in a v3 message from user at the authoritative
+// engineID, which has booted boots times and been up for seconds
+func snmpV3Message(msgID int32, engineID []byte, boots, seconds int32, user *snmpUser, pdu []byte) ([]byte, error) {
+	var flags byte
+	if user.auth != nil {
+		flags |= 1
+	}
+	scoped := append(berTLV(berOctets, engineID), berTLV(berOctets, nil)...) // context engine ID and name
+	scoped = berTLV(berSequence, append(scoped, pdu...))
+
+	var salt, data []byte
+	if user.privKey != nil {
+		flags |= 2
+		salt = make([]byte, 8)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(user.privKey)
+		if err != nil {
+			return nil, err
+		}
+		iv := binary.BigEndian.AppendUint32(nil, uint32(boots))
+		iv = binary.BigEndian.AppendUint32(iv, uint32(seconds))
+		iv = append(iv, salt...)
+		enc := make([]byte, len(scoped))
+		cipher.NewCFBEncrypter(block, iv).XORKeyStream(enc, scoped)
+		data = berTLV(berOctets, enc)
+	} else {
+		data = scoped
+	}
+
+	global := berInt(berInteger, int64(msgID))
+	global = append(global, berInt(berInteger, 65507)...) // msgMaxSize
+	global = append(global, berTLV(berOctets, []byte{flags})...)
+	global = append(global, berInt(berInteger, 3)...) // USM
+	global = berTLV(berSequence, global)
+
+	// The MAC is computed with its place zeroed, then written there
+	var macLen int
+	if user.auth != nil {
+		macLen = user.auth.macLen
+	}
+	usm := berTLV(berOctets, engineID)
+	usm = append(usm, berInt(berInteger, int64(boots))...)
+	usm = append(usm, berInt(berInteger, int64(seconds))...)
+	usm = append(usm, berTLV(berOctets, []byte(user.name))...)
+	macAt := len(usm) + 2
+	usm = append(usm, berTLV(berOctets, make([]byte, macLen))...)
+	usm = append(usm, berTLV(berOctets, salt)...)
+	usmSeq := berTLV(berSequence, usm)
+	macAt += len(usmSeq) - len(usm)
+	secParams := berTLV(berOctets, usmSeq)
+	macAt += len(secParams) - len(usmSeq)
+
+	body := berInt(berInteger, 3)
+	body = append(body, global...)
+	macAt += len(body)
+	body = append(append(body, secParams...), data...)
+	msg := berTLV(berSequence, body)
+	macAt += len(msg) - len(body)
+
+	if user.auth != nil {
+		mac := hmac.New(user.auth.hash, user.authKey)
+		mac.Write(msg)
+		copy(msg[macAt:macAt+macLen], mac.Sum(nil))
+	}
+	return msg, nil
+}
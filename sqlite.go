@@ -0,0 +1,882 @@
+package main
+
+// A minimal SQLite database writer and reader: enough of the file format
+// (https://www.sqlite.org/fileformat2.html) to keep one rowid table that
+// is only ever appended to, in a file that the sqlite3 shell and any other
+// SQLite client can open and query.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+)
+
+const (
+	sqlitePageSize = 4096
+	sqliteMagic    = "SQLite format 3\x00"
+	// sqliteVersion is the SQLITE_VERSION_NUMBER written in the header
+	sqliteVersion = 3045000
+
+	sqliteLeaf     = 0x0d // table b-tree leaf page
+	sqliteInterior = 0x05 // table b-tree interior page
+
+	// Payloads up to sqliteMaxLocal bytes are kept in the cell; larger
+	// ones spill to overflow pages, keeping at least sqliteMinLocal
+	sqliteMaxLocal = sqlitePageSize - 35
+	sqliteMinLocal = (sqlitePageSize-12)*32/255 - 23
+)
+
+// sqliteTable is a rowid table, alone in a SQLite database file, that
+// rows are appended to. Appends are atomic: the pages they change are
+// first copied to an undo file, from which the next open restores them
+// if the append didn't finish. Readers don't lock the file; Scan starts
+// over if a write happens while it reads.
+type sqliteTable struct {
+	f        *os.File
+	path     string
+	readOnly bool
+	root     uint32
+	// pages is the size of the database in pages, counter its file
+	// change counter and last the largest rowid in the table
+	pages   uint32
+	counter uint32
+	last    int64
+
+	// dirty holds the pages an append has changed, and orig the
+	// original content of those that were in the file before
+	dirty map[uint32][]byte
+	orig  map[uint32][]byte
+}
+
+// openSQLiteTable opens the database at path holding the table name,
+// created by schema, creating the file if need be. A database with other
+// tables or another schema is refused, unless its schema is one of older:
+// schemas that schema adds columns to the end of. Rows of those lack the
+// added columns, which read as their defaults, as in SQLite, and a table
+// opened for writing has its schema changed as ALTER TABLE ADD COLUMN
+// does.
+func openSQLiteTable(path, name, schema string, readOnly bool, older ...string) (*sqliteTable, error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flags = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	t := &sqliteTable{f: f, path: path, readOnly: readOnly}
+	if err := t.open(name, schema, older); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return t, nil
+}
+
+func (t *sqliteTable) open(name, schema string, older []string) error {
+	if !t.readOnly {
+		if err := t.recover(); err != nil {
+			return fmt.Errorf("failed to restore an unfinished write: %w", err)
+		}
+	}
+	info, err := t.f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		if t.readOnly {
+			return errors.New("empty database")
+		}
+		return t.create(name, schema)
+	}
+	current, err := t.load(name)
+	switch {
+	case err != nil:
+		return err
+	case current == schema:
+		return nil
+	case !slices.Contains(older, current):
+		return fmt.Errorf("the %s table has another schema", name)
+	case t.readOnly:
+		return nil
+	}
+	if err := t.alter(name, schema); err != nil {
+		return fmt.Errorf("failed to update the %s table's schema: %w", name, err)
+	}
+	return nil
+}
+
+// create writes a new database holding an empty table
+func (t *sqliteTable) create(name, schema string) error {
+	page1 := make([]byte, sqlitePageSize)
+	copy(page1, sqliteMagic)
+	binary.BigEndian.PutUint16(page1[16:], sqlitePageSize)
+	page1[18], page1[19] = 1, 1 // legacy (rollback journal) file format
+	page1[21], page1[22], page1[23] = 64, 32, 32
+	binary.BigEndian.PutUint32(page1[40:], 1) // schema cookie
+	binary.BigEndian.PutUint32(page1[44:], 4) // schema format
+	binary.BigEndian.PutUint32(page1[56:], 1) // UTF-8
+	row := sqliteRecord([]any{"table", name, name, int64(2), schema})
+	cell := sqliteLeafCell(1, len(row), row, 0)
+	if len(cell) > sqlitePageSize-100-8-2 {
+		return errors.New("schema too long")
+	}
+	sqliteLayout(page1, sqliteLeaf, [][]byte{cell}, 0)
+	page2 := make([]byte, sqlitePageSize)
+	sqliteLayout(page2, sqliteLeaf, nil, 0)
+
+	t.root, t.pages, t.counter = 2, 2, 1
+	t.stamp(page1)
+	if _, err := t.f.WriteAt(append(page1, page2...), 0); err != nil {
+		return err
+	}
+	return t.f.Sync()
+}
+
+// load reads the header of an existing database and returns the schema of
+// its table
+func (t *sqliteTable) load(name string) (string, error) {
+	t.pages = 1
+	page1, err := t.page(1)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case string(page1[:16]) != sqliteMagic:
+		return "", errors.New("not a SQLite database")
+	case binary.BigEndian.Uint16(page1[16:]) != sqlitePageSize || page1[20] != 0:
+		return "", fmt.Errorf("unsupported page size %d", binary.BigEndian.Uint16(page1[16:]))
+	case page1[18] != 1 || page1[19] != 1:
+		return "", errors.New("unsupported journal mode (WAL?)")
+	case binary.BigEndian.Uint32(page1[52:]) != 0:
+		return "", errors.New("unsupported auto-vacuum database")
+	case binary.BigEndian.Uint32(page1[56:]) != 1:
+		return "", errors.New("unsupported text encoding")
+	}
+	t.counter = binary.BigEndian.Uint32(page1[24:])
+	t.pages = binary.BigEndian.Uint32(page1[28:])
+	if binary.BigEndian.Uint32(page1[92:]) != t.counter || t.pages == 0 {
+		info, err := t.f.Stat()
+		if err != nil {
+			return "", err
+		}
+		t.pages = uint32(info.Size() / sqlitePageSize)
+	}
+
+	var rows [][]any
+	if err := t.scan(1, func(_ int64, row []any) error {
+		rows = append(rows, row)
+		return nil
+	}); err != nil {
+		return "", fmt.Errorf("reading schema: %w", err)
+	}
+	if len(rows) != 1 || len(rows[0]) != 5 || rows[0][1] != name {
+		return "", fmt.Errorf("database holds more than the %s table", name)
+	}
+	schema, _ := rows[0][4].(string)
+	root, ok := rows[0][3].(int64)
+	if !ok || root < 2 || root > int64(t.pages) {
+		return "", errors.New("invalid root page")
+	}
+	t.root = uint32(root)
+
+	// The largest rowid is in the last cell of the rightmost leaf
+	pg := t.root
+	for {
+		p, err := t.page(pg)
+		if err != nil {
+			return "", err
+		}
+		if p[0] == sqliteInterior {
+			pg = binary.BigEndian.Uint32(p[8:])
+			continue
+		}
+		if p[0] != sqliteLeaf {
+			return "", fmt.Errorf("page %d isn't a table page", pg)
+		}
+		if cells := sqliteCells(p, 0); len(cells) > 0 {
+			_, n := sqliteVarint(cells[len(cells)-1])
+			rowid, _ := sqliteVarint(cells[len(cells)-1][n:])
+			t.last = int64(rowid)
+		}
+		return schema, nil
+	}
+}
+
+// alter replaces the schema of the table with schema, leaving its rows as
+// they are
+func (t *sqliteTable) alter(name, schema string) error {
+	t.dirty, t.orig = make(map[uint32][]byte), make(map[uint32][]byte)
+	defer func() { t.dirty, t.orig = nil, nil }()
+	page1, err := t.change(1)
+	if err != nil {
+		return err
+	}
+	row := sqliteRecord([]any{"table", name, name, int64(t.root), schema})
+	cell := sqliteLeafCell(1, len(row), row, 0)
+	if len(cell) > sqlitePageSize-100-8-2 {
+		return errors.New("schema too long")
+	}
+	sqliteLayout(page1, sqliteLeaf, [][]byte{cell}, 0)
+	// A new schema cookie has SQLite connections read the schema again
+	binary.BigEndian.PutUint32(page1[40:], binary.BigEndian.Uint32(page1[40:])+1)
+	return t.commit(t.pages)
+}
+
+// stamp writes the database size and change counter in page 1
+func (t *sqliteTable) stamp(page1 []byte) {
+	binary.BigEndian.PutUint32(page1[24:], t.counter)
+	binary.BigEndian.PutUint32(page1[28:], t.pages)
+	binary.BigEndian.PutUint32(page1[92:], t.counter)
+	binary.BigEndian.PutUint32(page1[96:], sqliteVersion)
+}
+
+// page returns page n, as changed by the append in progress if it has been
+func (t *sqliteTable) page(n uint32) ([]byte, error) {
+	if p, ok := t.dirty[n]; ok {
+		return p, nil
+	}
+	if n == 0 || n > t.pages {
+		return nil, fmt.Errorf("page %d out of range", n)
+	}
+	p := make([]byte, sqlitePageSize)
+	if _, err := t.f.ReadAt(p, int64(n-1)*sqlitePageSize); err != nil {
+		return nil, fmt.Errorf("reading page %d: %w", n, err)
+	}
+	return p, nil
+}
+
+// change returns page n for the append in progress to change
+func (t *sqliteTable) change(n uint32) ([]byte, error) {
+	if p, ok := t.dirty[n]; ok {
+		return p, nil
+	}
+	p, err := t.page(n)
+	if err != nil {
+		return nil, err
+	}
+	t.orig[n] = bytes.Clone(p)
+	t.dirty[n] = p
+	return p, nil
+}
+
+// allocate adds a page to the end of the database
+func (t *sqliteTable) allocate() ([]byte, uint32) {
+	t.pages++
+	p := make([]byte, sqlitePageSize)
+	t.dirty[t.pages] = p
+	return p, t.pages
+}
+
+// Insert appends rows, each a value per column, with the rowids following
+// the largest in the table
+func (t *sqliteTable) Insert(rows [][]any) error {
+	if t.readOnly {
+		return errors.New("database opened read-only")
+	}
+	t.dirty, t.orig = make(map[uint32][]byte), make(map[uint32][]byte)
+	pages, last := t.pages, t.last
+	err := t.insert(rows)
+	if err == nil {
+		err = t.commit(pages)
+	}
+	if err != nil {
+		t.pages, t.last = pages, last
+	}
+	t.dirty, t.orig = nil, nil
+	return err
+}
+
+func (t *sqliteTable) insert(rows [][]any) error {
+	for _, row := range rows {
+		payload := sqliteRecord(row)
+		local, overflow := payload, uint32(0)
+		if len(payload) > sqliteMaxLocal {
+			local = payload[:sqliteLocal(len(payload))]
+			overflow = t.spill(payload[len(local):])
+		}
+		rowid := t.last + 1
+		if err := t.append(sqliteLeafCell(rowid, len(payload), local, overflow), rowid); err != nil {
+			return err
+		}
+		t.last = rowid
+	}
+	return nil
+}
+
+// spill writes data to a chain of overflow pages and returns the first
+func (t *sqliteTable) spill(data []byte) uint32 {
+	var first uint32
+	var prev []byte
+	for len(data) > 0 {
+		p, n := t.allocate()
+		if prev == nil {
+			first = n
+		} else {
+			binary.BigEndian.PutUint32(prev, n)
+		}
+		data = data[copy(p[4:], data):]
+		prev = p
+	}
+	return first
+}
+
+// append adds cell, the row with rowid, to the rightmost leaf. When the
+// leaf is full, a new one is started and linked into the tree, splitting
+// interior pages on the way up as need be.
+func (t *sqliteTable) append(cell []byte, rowid int64) error {
+	path := []uint32{t.root}
+	for {
+		p, err := t.page(path[len(path)-1])
+		if err != nil {
+			return err
+		}
+		if p[0] != sqliteInterior {
+			break
+		}
+		path = append(path, binary.BigEndian.Uint32(p[8:]))
+	}
+	leaf, err := t.change(path[len(path)-1])
+	if err != nil {
+		return err
+	}
+	cells := sqliteCells(leaf, 0)
+	if sqliteFits(append(cells, cell), sqliteLeaf) {
+		sqliteLayout(leaf, sqliteLeaf, append(cells, cell), 0)
+		return nil
+	}
+	p, n := t.allocate()
+	sqliteLayout(p, sqliteLeaf, [][]byte{cell}, 0)
+	return t.push(path[:len(path)-1], path[len(path)-1], t.last, n)
+}
+
+// push makes right, holding the rowids above key, the right child of the
+// last page of path, whose right child was left. The root splits in
+// place, as its page number is in the schema.
+func (t *sqliteTable) push(path []uint32, left uint32, key int64, right uint32) error {
+	if len(path) == 0 {
+		root, err := t.change(left)
+		if err != nil {
+			return err
+		}
+		moved, n := t.allocate()
+		copy(moved, root)
+		sqliteLayout(root, sqliteInterior, [][]byte{sqliteInteriorCell(n, key)}, right)
+		return nil
+	}
+	pg := path[len(path)-1]
+	parent, err := t.change(pg)
+	if err != nil {
+		return err
+	}
+	cells := append(sqliteCells(parent, 0), sqliteInteriorCell(left, key))
+	if sqliteFits(cells, sqliteInterior) {
+		sqliteLayout(parent, sqliteInterior, cells, right)
+		return nil
+	}
+	// A new interior page takes left and right, and the child of the
+	// parent's last cell becomes its right child
+	sibling, n := t.allocate()
+	sqliteLayout(sibling, sqliteInterior, cells[len(cells)-1:], right)
+	last := cells[len(cells)-2]
+	lastKey, _ := sqliteVarint(last[4:])
+	sqliteLayout(parent, sqliteInterior, cells[:len(cells)-2], binary.BigEndian.Uint32(last))
+	return t.push(path[:len(path)-1], pg, int64(lastKey), n)
+}
+
+// commit writes the append's pages, saving the originals of those it
+// changes to the undo file first; pages is the database's size before
+func (t *sqliteTable) commit(pages uint32) error {
+	page1, err := t.change(1)
+	if err != nil {
+		return err
+	}
+	t.counter++
+	t.stamp(page1)
+
+	undo := binary.BigEndian.AppendUint32(nil, pages)
+	for n, p := range t.orig {
+		undo = binary.BigEndian.AppendUint32(undo, n)
+		undo = append(undo, p...)
+	}
+	undo = append(undo, sqliteMagic...)
+	if err := writeSynced(t.path+"-undo", undo); err != nil {
+		t.counter--
+		return fmt.Errorf("failed to write undo file: %w", err)
+	}
+	// New pages go first, so a reader never follows a link to one not
+	// yet written, and page 1, with the change counter, last
+	for _, pass := range []func(uint32) bool{
+		func(n uint32) bool { return n > pages },
+		func(n uint32) bool { return n <= pages && n != 1 },
+		func(n uint32) bool { return n == 1 },
+	} {
+		for n, p := range t.dirty {
+			if !pass(n) {
+				continue
+			}
+			if _, err := t.f.WriteAt(p, int64(n-1)*sqlitePageSize); err != nil {
+				return t.abort(err)
+			}
+		}
+	}
+	if err := t.f.Sync(); err != nil {
+		return t.abort(err)
+	}
+	return os.Remove(t.path + "-undo")
+}
+
+// abort undoes a failed commit
+func (t *sqliteTable) abort(err error) error {
+	t.counter--
+	if rerr := t.recover(); rerr != nil {
+		return fmt.Errorf("%w (and restoring the database: %v)", err, rerr)
+	}
+	return err
+}
+
+// recover restores the pages saved in the undo file of an unfinished
+// commit, if there is one
+func (t *sqliteTable) recover() error {
+	undo, err := os.ReadFile(t.path + "-undo")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Without its trailer the undo file was cut short, before the
+	// database was touched
+	if bytes.HasSuffix(undo, []byte(sqliteMagic)) && (len(undo)-4-len(sqliteMagic))%(4+sqlitePageSize) == 0 {
+		pages := binary.BigEndian.Uint32(undo)
+		for b := undo[4 : len(undo)-len(sqliteMagic)]; len(b) > 0; b = b[4+sqlitePageSize:] {
+			n := binary.BigEndian.Uint32(b)
+			if _, err := t.f.WriteAt(b[4:4+sqlitePageSize], int64(n-1)*sqlitePageSize); err != nil {
+				return err
+			}
+		}
+		if err := t.f.Truncate(int64(pages) * sqlitePageSize); err != nil {
+			return err
+		}
+		if err := t.f.Sync(); err != nil {
+			return err
+		}
+	}
+	return os.Remove(t.path + "-undo")
+}
+
+// writeSynced writes data to path and flushes it to disk
+func writeSynced(path string, data []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Scan calls fn with the rowid and values of every row, in rowid order.
+// If the database is written meanwhile, it starts over, skipping the
+// rows fn has seen.
+func (t *sqliteTable) Scan(fn func(rowid int64, row []any) error) error {
+	var seen int64
+	for attempt := 0; ; attempt++ {
+		counter, err := t.readCounter()
+		if err != nil {
+			return err
+		}
+		var ferr error
+		err = t.scan(t.root, func(rowid int64, row []any) error {
+			if rowid <= seen {
+				return nil
+			}
+			seen = rowid
+			ferr = fn(rowid, row)
+			return ferr
+		})
+		if ferr != nil {
+			return ferr
+		}
+		now, cerr := t.readCounter()
+		if cerr != nil {
+			return cerr
+		}
+		if now == counter {
+			return err
+		}
+		if attempt == 5 {
+			return errors.New("database keeps changing while being read")
+		}
+	}
+}
+
+// readCounter reads the file change counter. A reader takes the size
+// of the database along with it, as the file may have grown.
+func (t *sqliteTable) readCounter() (uint32, error) {
+	var b [8]byte
+	if _, err := t.f.ReadAt(b[:], 24); err != nil {
+		return 0, err
+	}
+	if t.readOnly {
+		t.pages = binary.BigEndian.Uint32(b[4:])
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+// scan walks the b-tree rooted at page pg
+func (t *sqliteTable) scan(pg uint32, fn func(int64, []any) error) error {
+	p, err := t.page(pg)
+	if err != nil {
+		return err
+	}
+	hdr := 0
+	if pg == 1 {
+		hdr = 100
+	}
+	switch p[hdr] {
+	case sqliteInterior:
+		for _, c := range sqliteCells(p, hdr) {
+			if err := t.scan(binary.BigEndian.Uint32(c), fn); err != nil {
+				return err
+			}
+		}
+		return t.scan(binary.BigEndian.Uint32(p[hdr+8:]), fn)
+	case sqliteLeaf:
+		for _, c := range sqliteCells(p, hdr) {
+			size, n := sqliteVarint(c)
+			rowid, m := sqliteVarint(c[n:])
+			payload := c[n+m:]
+			if int(size) > sqliteMaxLocal {
+				local := sqliteLocal(int(size))
+				if len(payload) < local+4 {
+					return fmt.Errorf("page %d: short cell", pg)
+				}
+				if payload, err = t.overflow(payload[:local], binary.BigEndian.Uint32(payload[local:]), int(size)); err != nil {
+					return err
+				}
+			} else if len(payload) < int(size) {
+				return fmt.Errorf("page %d: short cell", pg)
+			} else {
+				payload = payload[:size]
+			}
+			row, err := sqliteDecodeRecord(payload)
+			if err != nil {
+				return fmt.Errorf("row %d: %w", rowid, err)
+			}
+			if err := fn(int64(rowid), row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("page %d isn't a table page", pg)
+}
+
+// overflow reads the rest of a payload of size bytes from its overflow
+// pages, starting with next
+func (t *sqliteTable) overflow(local []byte, next uint32, size int) ([]byte, error) {
+	payload := bytes.Clone(local)
+	for len(payload) < size {
+		if next == 0 {
+			return nil, errors.New("overflow chain ends early")
+		}
+		p, err := t.page(next)
+		if err != nil {
+			return nil, err
+		}
+		payload = append(payload, p[4:4+min(size-len(payload), sqlitePageSize-4)]...)
+		next = binary.BigEndian.Uint32(p)
+	}
+	return payload, nil
+}
+
+// Close closes the database file
+func (t *sqliteTable) Close() error {
+	return t.f.Close()
+}
+
+// sqliteLocal returns how much of a payload of size bytes, too large for
+// a cell, is kept in the cell
+func sqliteLocal(size int) int {
+	local := sqliteMinLocal + (size-sqliteMinLocal)%(sqlitePageSize-4)
+	if local > sqliteMaxLocal {
+		return sqliteMinLocal
+	}
+	return local
+}
+
+// sqliteCells returns the cells of page p, whose header is at hdr
+func sqliteCells(p []byte, hdr int) [][]byte {
+	n := int(binary.BigEndian.Uint16(p[hdr+3:]))
+	size := 8
+	if p[hdr] == sqliteInterior {
+		size = 12
+	}
+	cells := make([][]byte, 0, n+1)
+	for i := range n {
+		off := int(binary.BigEndian.Uint16(p[hdr+size+2*i:]))
+		if off >= len(p) {
+			break
+		}
+		cells = append(cells, p[off:off+sqliteCellSize(p[off:], p[hdr])])
+	}
+	return cells
+}
+
+// sqliteCellSize returns the size of the cell at the start of c
+func sqliteCellSize(c []byte, typ byte) int {
+	if typ == sqliteInterior {
+		_, n := sqliteVarint(c[4:])
+		return 4 + n
+	}
+	size, n := sqliteVarint(c)
+	_, m := sqliteVarint(c[n:])
+	if int(size) > sqliteMaxLocal {
+		return min(n+m+sqliteLocal(int(size))+4, len(c))
+	}
+	return min(n+m+int(size), len(c))
+}
+
+// sqliteFits reports whether cells fit on a page of type typ
+func sqliteFits(cells [][]byte, typ byte) bool {
+	used := 8
+	if typ == sqliteInterior {
+		used = 12
+	}
+	for _, c := range cells {
+		used += 2 + len(c)
+	}
+	return used <= sqlitePageSize
+}
+
+// sqliteLayout rewrites page p, other than page 1, as a b-tree page of
+// type typ holding cells, with right as its right child if it is an
+// interior page
+func sqliteLayout(p []byte, typ byte, cells [][]byte, right uint32) {
+	hdr := 0
+	if string(p[:16]) == sqliteMagic {
+		hdr = 100
+	}
+	// cells may point into p
+	var content []byte
+	for _, c := range cells {
+		content = append(content, c...)
+	}
+	clear(p[hdr:])
+	p[hdr] = typ
+	size := 8
+	if typ == sqliteInterior {
+		size = 12
+		binary.BigEndian.PutUint32(p[hdr+8:], right)
+	}
+	binary.BigEndian.PutUint16(p[hdr+3:], uint16(len(cells)))
+	off := len(p)
+	for i, c := range cells {
+		off -= len(c)
+		copy(p[off:], content[:len(c)])
+		content = content[len(c):]
+		binary.BigEndian.PutUint16(p[hdr+size+2*i:], uint16(off))
+	}
+	binary.BigEndian.PutUint16(p[hdr+5:], uint16(off))
+}
+
+// sqliteLeafCell encodes a table leaf cell for a payload of size bytes,
+// holding local of it and the first overflow page, if not 0, of the rest
+func sqliteLeafCell(rowid int64, size int, local []byte, overflow uint32) []byte {
+	c := appendSQLiteVarint(nil, uint64(size))
+	c = appendSQLiteVarint(c, uint64(rowid))
+	c = append(c, local...)
+	if overflow != 0 {
+		c = binary.BigEndian.AppendUint32(c, overflow)
+	}
+	return c
+}
+
+// sqliteInteriorCell encodes a table interior cell pointing at child,
+// whose largest rowid is key
+func sqliteInteriorCell(child uint32, key int64) []byte {
+	return appendSQLiteVarint(binary.BigEndian.AppendUint32(nil, child), uint64(key))
+}
+
+// sqliteRecord encodes values, each nil, a string, []byte, an integer,
+// a float64 or a bool, in the record format
+func sqliteRecord(values []any) []byte {
+	var types, body []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			types = appendSQLiteVarint(types, 0)
+		case string:
+			types = appendSQLiteVarint(types, uint64(2*len(v)+13))
+			body = append(body, v...)
+		case []byte:
+			types = appendSQLiteVarint(types, uint64(2*len(v)+12))
+			body = append(body, v...)
+		case float64:
+			types = append(types, 7)
+			body = binary.BigEndian.AppendUint64(body, math.Float64bits(v))
+		case bool:
+			types = append(types, 8)
+			if v {
+				types[len(types)-1] = 9
+			}
+		case int:
+			types, body = appendSQLiteInt(types, body, int64(v))
+		case int64:
+			types, body = appendSQLiteInt(types, body, v)
+		case uint64:
+			types, body = appendSQLiteInt(types, body, int64(v))
+		default:
+			panic(fmt.Sprintf("unsupported value type %T", v))
+		}
+	}
+	// The header's size counts itself
+	size := len(types) + 1
+	for sqliteVarintLen(uint64(size)) != size-len(types) {
+		size = len(types) + sqliteVarintLen(uint64(size))
+	}
+	return append(append(appendSQLiteVarint(nil, uint64(size)), types...), body...)
+}
+
+// appendSQLiteInt appends v in the smallest integer serial type
+func appendSQLiteInt(types, body []byte, v int64) ([]byte, []byte) {
+	switch {
+	case v == 0:
+		return append(types, 8), body
+	case v == 1:
+		return append(types, 9), body
+	}
+	for _, st := range []struct {
+		typ   byte
+		bytes int
+	}{{1, 1}, {2, 2}, {3, 3}, {4, 4}, {5, 6}, {6, 8}} {
+		bits := 8*st.bytes - 1
+		if st.bytes == 8 || v >= -1<<bits && v < 1<<bits {
+			for i := st.bytes - 1; i >= 0; i-- {
+				body = append(body, byte(v>>(8*i)))
+			}
+			return append(types, st.typ), body
+		}
+	}
+	panic("unreachable")
+}
+
+// sqliteDecodeRecord decodes a record into nil, string, []byte, int64
+// and float64 values
+func sqliteDecodeRecord(b []byte) ([]any, error) {
+	size, n := sqliteVarint(b)
+	if n == 0 || int(size) > len(b) || int(size) < n {
+		return nil, errors.New("invalid record header")
+	}
+	types, body := b[n:size], b[size:]
+	var values []any
+	for len(types) > 0 {
+		st, n := sqliteVarint(types)
+		if n == 0 {
+			return nil, errors.New("invalid record header")
+		}
+		types = types[n:]
+		var width int
+		switch {
+		case st >= 1 && st <= 4:
+			width = int(st)
+		case st == 5:
+			width = 6
+		case st == 6 || st == 7:
+			width = 8
+		case st >= 12:
+			width = int(st-12) / 2
+		}
+		if width > len(body) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		v := body[:width]
+		body = body[width:]
+		switch {
+		case st == 0:
+			values = append(values, nil)
+		case st <= 6:
+			var i int64
+			if v[0]&0x80 != 0 {
+				i = -1
+			}
+			for _, c := range v {
+				i = i<<8 | int64(c)
+			}
+			values = append(values, i)
+		case st == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(v)))
+		case st == 8 || st == 9:
+			values = append(values, int64(st-8))
+		case st >= 12 && st%2 == 0:
+			values = append(values, bytes.Clone(v))
+		case st >= 13:
+			values = append(values, string(v))
+		default:
+			return nil, fmt.Errorf("invalid serial type %d", st)
+		}
+	}
+	return values, nil
+}
+
+// appendSQLiteVarint appends v as a SQLite varint: big-endian groups of 7
+// bits, with the ninth byte, if needed, holding 8
+func appendSQLiteVarint(b []byte, v uint64) []byte {
+	if v>>56 != 0 {
+		for i := range 8 {
+			b = append(b, byte(v>>(57-7*i))|0x80)
+		}
+		return append(b, byte(v))
+	}
+	n := sqliteVarintLen(v)
+	for i := n - 1; i >= 0; i-- {
+		c := byte(v>>(7*i)) & 0x7f
+		if i > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+// sqliteVarintLen returns the size of v as a SQLite varint
+func sqliteVarintLen(v uint64) int {
+	if v>>56 != 0 {
+		return 9
+	}
+	n := 1
+	for v >>= 7; v != 0; v >>= 7 {
+		n++
+	}
+	return n
+}
+
+// sqliteVarint decodes a SQLite varint, returning its size too, or 0 if
+// b is too short
+func sqliteVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 8; i++ {
+		if i >= len(b) {
+			return 0, 0
+		}
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	if len(b) < 9 {
+		return 0, 0
+	}
+	return v<<8 | uint64(b[8]), 9
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSQLiteVarint(t *testing.T) {
+	for _, v := range []uint64{0, 1, 127, 128, 16383, 16384, 1<<56 - 1, 1 << 56, 1<<63 + 12345, ^uint64(0)} {
+		b := appendSQLiteVarint(nil, v)
+		if len(b) != sqliteVarintLen(v) {
+			t.Errorf("%d: %d bytes, want %d", v, len(b), sqliteVarintLen(v))
+		}
+		got, n := sqliteVarint(b)
+		if got != v || n != len(b) {
+			t.Errorf("%d: decoded %d (%d bytes)", v, got, n)
+		}
+	}
+	// From the file format's description: 0x81 0x00 is 128
+	if v, n := sqliteVarint([]byte{0x81, 0x00}); v != 128 || n != 2 {
+		t.Errorf("0x81 0x00 = %d (%d bytes)", v, n)
+	}
+}
+
+func TestSQLiteRecord(t *testing.T) {
+	in := []any{nil, "route", int64(0), int64(1), int64(-2), int64(300), int64(1 << 40), int64(-1 << 62), 2.5, []byte{1, 2}, true, strings.Repeat("x", 200)}
+	got, err := sqliteDecodeRecord(sqliteRecord(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []any{nil, "route", int64(0), int64(1), int64(-2), int64(300), int64(1 << 40), int64(-1 << 62), 2.5, []byte{1, 2}, int64(1), strings.Repeat("x", 200)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %v", got)
+	}
+}
+
+func TestSQLiteTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.db")
+	const schema = "CREATE TABLE t (id INTEGER PRIMARY KEY, n INTEGER, s TEXT)"
+	db, err := openSQLiteTable(path, "t", schema, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enough rows for a tree three pages deep, and one spilling to
+	// overflow pages
+	big := strings.Repeat("route ", 3000)
+	for i := range 60 {
+		var rows [][]any
+		for j := range 500 {
+			rows = append(rows, []any{nil, int64(i*500 + j), "10.0.0.0/8"})
+		}
+		if i == 3 {
+			rows = append(rows, []any{nil, int64(-1), big})
+		}
+		if err := db.Insert(rows); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	db, err = openSQLiteTable(path, "t", schema, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Insert([][]any{{nil, int64(30000), "last"}}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if _, err := os.Stat(path + "-undo"); !os.IsNotExist(err) {
+		t.Errorf("undo file left behind: %v", err)
+	}
+
+	db, err = openSQLiteTable(path, "t", schema, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var rowids, bigs int
+	var last []any
+	err = db.Scan(func(rowid int64, row []any) error {
+		rowids++
+		if rowid != int64(rowids) {
+			t.Fatalf("rowid %d, want %d", rowid, rowids)
+		}
+		if row[1] == int64(-1) {
+			bigs++
+			if row[2] != big {
+				t.Errorf("overflowing row read back %d bytes", len(row[2].(string)))
+			}
+		}
+		last = row
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rowids != 30002 || bigs != 1 || !reflect.DeepEqual(last, []any{nil, int64(30000), "last"}) {
+		t.Errorf("%d rows, %d big, last %v", rowids, bigs, last)
+	}
+	if err := db.Insert([][]any{{nil}}); err == nil {
+		t.Error("read-only insert succeeded")
+	}
+
+	if _, err := openSQLiteTable(path, "t", "CREATE TABLE t (id INTEGER PRIMARY KEY)", false); err == nil || !strings.Contains(err.Error(), "another schema") {
+		t.Errorf("other schema: %v", err)
+	}
+	if _, err := openSQLiteTable(path, "u", schema, false); err == nil {
+		t.Error("opened a missing table")
+	}
+}
+
+func TestSQLiteTableOlderSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.db")
+	const older = "CREATE TABLE t (id INTEGER PRIMARY KEY, n INTEGER)"
+	const schema = "CREATE TABLE t (id INTEGER PRIMARY KEY, n INTEGER, s TEXT)"
+	db, err := openSQLiteTable(path, "t", older, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Insert([][]any{{nil, int64(1)}}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Reading leaves the file alone
+	db, err = openSQLiteTable(path, "t", schema, true, older)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if _, err := openSQLiteTable(path, "t", older, true); err != nil {
+		t.Errorf("schema updated by a read-only open: %v", err)
+	}
+
+	db, err = openSQLiteTable(path, "t", schema, false, older)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Insert([][]any{{nil, int64(2), "new"}}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = openSQLiteTable(path, "t", schema, true)
+	if err != nil {
+		t.Fatalf("schema not updated: %v", err)
+	}
+	defer db.Close()
+	var rows [][]any
+	err = db.Scan(func(_ int64, row []any) error {
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]any{{nil, int64(1)}, {nil, int64(2), "new"}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows %v, want %v", rows, want)
+	}
+}
+
+func TestSQLiteTableRecover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.db")
+	const schema = "CREATE TABLE t (id INTEGER PRIMARY KEY, s TEXT)"
+	db, err := openSQLiteTable(path, "t", schema, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Insert([][]any{{nil, "kept"}})
+	before, _ := os.ReadFile(path)
+	var rows [][]any
+	for range 100 {
+		rows = append(rows, []any{nil, "lost"})
+	}
+	db.Insert(rows)
+	db.Close()
+	after, _ := os.ReadFile(path)
+
+	// As left by a crash while writing the second insert
+	undo := binary.BigEndian.AppendUint32(nil, uint32(len(before)/sqlitePageSize))
+	for n := 0; n < len(before)/sqlitePageSize; n++ {
+		page := before[n*sqlitePageSize : (n+1)*sqlitePageSize]
+		if !bytes.Equal(page, after[n*sqlitePageSize:(n+1)*sqlitePageSize]) {
+			undo = binary.BigEndian.AppendUint32(undo, uint32(n+1))
+			undo = append(undo, page...)
+		}
+	}
+	os.WriteFile(path+"-undo", append(undo, sqliteMagic...), 0o644)
+
+	db, err = openSQLiteTable(path, "t", schema, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	restored, _ := os.ReadFile(path)
+	if !bytes.Equal(restored, before) {
+		t.Error("database not restored")
+	}
+	if _, err := os.Stat(path + "-undo"); !os.IsNotExist(err) {
+		t.Errorf("undo file left behind: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultStdinIdle is how long standard input must stay quiet before what
+// was read is taken as a complete table
+const DefaultStdinIdle = time.Second
+
+// StreamSource produces the routing table from a stream such as standard
+// input, for "ssh router display ip routing-table | go-watcher -file -".
+// The stream is split into versions of the table at pauses in the input
+// and at its end; each version is diffed against the one before.
+type StreamSource struct {
+	// Idle is how long the stream must pause, after a complete line, for
+	// what was read to count as one version (0 for DefaultStdinIdle)
+	Idle time.Duration
+
+	r io.Reader
+
+	// mu serializes diffs, which may come from both the reading loop and
+	// the target's own reloads
+	mu      sync.Mutex
+	current []byte
+}
+
+// NewStreamSource creates a source that reads versions of the table from r
+func NewStreamSource(r io.Reader) *StreamSource {
+	return &StreamSource{r: r}
+}
+
+// Read reads the stream until it ends or ctx is cancelled, sending each
+// version to versions. versions is closed when Read returns.
+func (s *StreamSource) Read(ctx context.Context, versions chan<- []byte) error {
+	defer close(versions)
+	idle := s.Idle
+	if idle <= 0 {
+		idle = DefaultStdinIdle
+	}
+
+	type read struct {
+		data []byte
+		err  error
+	}
+	reads := make(chan read)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := s.r.Read(buf)
+			select {
+			case reads <- read{bytes.Clone(buf[:n]), err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var pending []byte
+	send := func() bool {
+		if len(pending) == 0 {
+			return true
+		}
+		select {
+		case versions <- pending:
+			pending = nil
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	timer := time.NewTimer(idle)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			// Only a complete line ends a version; a pause mid-line is
+			// the writer being slow
+			if bytes.HasSuffix(pending, []byte("\n")) && !send() {
+				return ctx.Err()
+			}
+		case r := <-reads:
+			pending = append(pending, r.data...)
+			if r.err != nil {
+				if !send() {
+					return ctx.Err()
+				}
+				if r.err == io.EOF {
+					return nil
+				}
+				return r.err
+			}
+			timer.Reset(idle)
+		}
+	}
+}
+
+// Set makes version the table that the next Load or DetectChanges reads
+func (s *StreamSource) Set(version []byte) {
+	s.mu.Lock()
+	s.current = version
+	s.mu.Unlock()
+}
+
+// Load loads the current version into rt
+func (s *StreamSource) Load(ctx context.Context, rt *DataTable) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return rt.LoadFrom(ctx, bytes.NewReader(s.current))
+}
+
+// DetectChanges diffs the current version against rt
+func (s *StreamSource) DetectChanges(ctx context.Context, rt *DataTable) (*ChangeSet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return rt.DetectChangesFrom(ctx, bytes.NewReader(s.current))
+}
+
+// Event describes a reload for the report
+func (s *StreamSource) Event() string {
+	return "New Input"
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestStreamSource(t *testing.T) {
+	r, w := io.Pipe()
+	src := NewStreamSource(r)
+	src.Idle = 50 * time.Millisecond
+	versions := make(chan []byte)
+	done := make(chan error, 1)
+	go func() { done <- src.Read(context.Background(), versions) }()
+
+	first := routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1") + "\n"
+	second := routeBlock("10.0.0.0/8", "IBGP", "172.31.0.2") + "\n"
+	go func() {
+		// A pause mid-line doesn't end a version
+		io.WriteString(w, first[:20])
+		time.Sleep(150 * time.Millisecond)
+		io.WriteString(w, first[20:])
+		time.Sleep(150 * time.Millisecond)
+		io.WriteString(w, second)
+		w.Close()
+	}()
+
+	got := <-versions
+	if string(got) != first {
+		t.Fatalf("first version = %q", got)
+	}
+	src.Set(got)
+	rt := NewDataTable("stdin")
+	if err := src.Load(context.Background(), rt); err != nil {
+		t.Fatal(err)
+	}
+
+	got = <-versions
+	if string(got) != second {
+		t.Fatalf("second version = %q", got)
+	}
+	src.Set(got)
+	cs, err := src.DetectChanges(context.Background(), rt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary := changeSummary(cs); len(summary) != 1 || summary[0] != "modified 10.0.0.0/8" {
+		t.Errorf("changes = %v", summary)
+	}
+
+	if _, ok := <-versions; ok {
+		t.Error("versions not closed at end of input")
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Read = %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// TailSource follows a file that a collector appends successive table
+// dumps to, separated by marker lines. Only data appended since the last
+// marker is read, so a long history isn't re-read on every change. A dump
+// counts as complete once a marker line follows it, so collectors that
+// write the marker after each dump have it diffed straight away.
+type TailSource struct {
+	Path   string
+	Marker *regexp.Regexp
+
+	// mu guards offset, and serializes reads of the file
+	mu sync.Mutex
+	// offset is where the dump in progress starts: just after the last
+	// marker line read
+	offset int64
+}
+
+// NewTailSource creates a source that follows path, splitting it at lines
+// matching the regular expression marker
+func NewTailSource(path, marker string) (*TailSource, error) {
+	re, err := regexp.Compile(marker)
+	if err != nil {
+		return nil, fmt.Errorf("bad marker %q: %w", marker, err)
+	}
+	return &TailSource{Path: path, Marker: re}, nil
+}
+
+// Load reads the whole file and loads its last complete dump into rt,
+// leaving rt empty if no dump is complete yet
+func (s *TailSource) Load(ctx context.Context, rt *DataTable) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offset = 0
+	dumps, err := s.read()
+	if err != nil {
+		return err
+	}
+	var last []byte
+	if len(dumps) > 0 {
+		last = dumps[len(dumps)-1]
+	}
+	return rt.LoadFrom(ctx, bytes.NewReader(last))
+}
+
+// DetectChanges diffs each dump completed since the last call against the
+// one before, returning their net change as one change set. If the file
+// shrank it was truncated or replaced, and is read again from the start.
+func (s *TailSource) DetectChanges(ctx context.Context, rt *DataTable) (*ChangeSet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file: %w", err)
+	}
+	restart := info.Size() < s.offset
+	if restart {
+		s.offset = 0
+	}
+	dumps, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	if restart && len(dumps) > 1 {
+		// Only the latest of the dumps in a new file is news
+		dumps = dumps[len(dumps)-1:]
+	}
+	if len(dumps) == 0 {
+		return &ChangeSet{Path: rt.FilePath, Time: time.Now(), Routes: rt.Len()}, nil
+	}
+
+	var cs *ChangeSet
+	for _, dump := range dumps {
+		next, err := rt.DetectChangesFrom(ctx, bytes.NewReader(dump))
+		if err != nil {
+			return nil, err
+		}
+		if cs == nil {
+			cs = next
+		} else {
+			cs.merge(next)
+		}
+	}
+	metrics.Counter("tail_dumps_total", "Complete dumps read from followed files").Add(int64(len(dumps)))
+	return cs, nil
+}
+
+// read returns the dumps completed after offset and moves offset past
+// their markers. Empty dumps, such as before a leading marker, are
+// skipped, and a final line still being written is left for the next read.
+func (s *TailSource) read() ([][]byte, error) {
+	file, err := openTable(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(s.offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek: %w", err)
+	}
+
+	var dumps [][]byte
+	var dump []byte
+	offset := s.offset
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+		offset += int64(len(line))
+		if !s.Marker.Match(bytes.TrimRight(line, "\r\n")) {
+			dump = append(dump, line...)
+			continue
+		}
+		if len(bytes.TrimSpace(dump)) > 0 {
+			dumps = append(dumps, dump)
+		}
+		dump = nil
+		s.offset = offset
+	}
+	return dumps, nil
+}
+
+// Event describes a reload for the report
+func (s *TailSource) Event() string {
+	return "Dump Appended"
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTailSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dumps.txt")
+	appendDump := func(content string) {
+		t.Helper()
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	appendDump(routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1") + "\n=== END ===\n")
+	appendDump(routeBlock("10.0.0.0/8", "IBGP", "172.31.0.2") + "\n=== END ===\n")
+
+	src, err := NewTailSource(path, `^=== END ===$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := NewDataTable(path)
+	if err := src.Load(context.Background(), rt); err != nil {
+		t.Fatal(err)
+	}
+	if c := rt.Chunks["10.0.0.0/8"]; c == nil || len(rt.Chunks) != 1 {
+		t.Fatalf("chunks = %v", rt.Chunks)
+	}
+
+	// A dump without its marker isn't complete yet
+	appendDump(routeBlock("10.0.0.0/8", "IBGP", "172.31.0.2") + "\n" + routeBlock("192.168.0.0/16", "Static", "172.31.0.254") + "\n")
+	cs, err := src.DetectChanges(context.Background(), rt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Len() != 0 {
+		t.Fatalf("changes before marker = %v", changeSummary(cs))
+	}
+
+	// Two dumps completed at once are diffed in turn and merged
+	appendDump("=== END ===\n" + routeBlock("10.0.0.0/8", "IBGP", "172.31.0.3") + "\n" + routeBlock("192.168.0.0/16", "Static", "172.31.0.254") + "\n=== END ===\n")
+	cs, err = src.DetectChanges(context.Background(), rt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := changeSummary(cs); len(got) != 2 || got[0] != "modified 10.0.0.0/8" || got[1] != "added 192.168.0.0/16" {
+		t.Errorf("changes = %v", got)
+	}
+
+	// A truncated file is read again from the start
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	appendDump(routeBlock("10.0.0.0/8", "IBGP", "172.31.0.3") + "\n=== END ===\n")
+	cs, err = src.DetectChanges(context.Background(), rt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := changeSummary(cs); len(got) != 1 || got[0] != "removed 192.168.0.0/16" {
+		t.Errorf("changes after truncation = %v", got)
+	}
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Source produces versions of a table from somewhere other than a watched
+// file, such as a command's output or standard input
+type Source interface {
+	// Load loads the current version into rt
+	Load(ctx context.Context, rt *DataTable) error
+	// DetectChanges diffs the current version against rt
+	DetectChanges(ctx context.Context, rt *DataTable) (*ChangeSet, error)
+	// Event describes a reload for the report, such as "Running Command"
+	Event() string
+}
+
+// Target is one watched table with its own reload and notify pipeline.
+// Each target reloads on its own goroutine, bounds its notifications with
+// its own worker budget and is disabled by its own circuit breaker, so a
+// misbehaving export can't starve the other targets.
+type Target struct {
+	Name       string
+	Table      *DataTable
+	Dispatcher *Dispatcher
+	// Breaker disables the target after repeated parse or sink failures
+	Breaker *CircuitBreaker
+	Report  ReportOptions
+	// Enrichers run on every change set before it is reported
+	Enrichers []Enricher
+	// Command, if set, produces the table instead of the file at
+	// Table.FilePath
+	Command Source
+	// Workers is the number of change sets that may be in delivery at
+	// once. When all workers are busy the next reload waits. With more
+	// than one worker, change sets may reach sinks out of order.
+	Workers int
+	Out     io.Writer
+	// Filesystem describes where the table file lives, if known
+	Filesystem *FSInfo
+	// Watcher notices changes to the table file, if it is watched
+	Watcher Watcher
+	// HoldOnTruncate keeps the previous table while the file is empty,
+	// as it briefly is when an export is truncated and rewritten in
+	// place, instead of reporting every route removed and then added
+	// back. Either way the truncation is reported as such.
+	HoldOnTruncate bool
+	// Settle, if set, holds reloads until the file's size and
+	// modification time stay the same across two samples this far apart,
+	// so a file still being written isn't parsed half-way
+	Settle time.Duration
+	// Snapshot, if set, is the file the table's chunk map is saved to on
+	// shutdown
+	Snapshot string
+	// Audit, if set, records every change set detected
+	Audit *AuditLog
+	// Feed, if set, passes every change set detected to the web UI and
+	// gNMI server
+	Feed *ChangeFeed
+	// WatchMetadata attaches the file's metadata, and how it changed, to
+	// every change set
+	WatchMetadata bool
+
+	mechanism string
+
+	trigger chan struct{}
+	slots   chan struct{}
+	wg      sync.WaitGroup
+
+	mu     sync.Mutex
+	missed bool
+	// sweeping is set while a pending reload was requested by Sweep
+	// rather than by the watcher
+	sweeping bool
+	// full is set while a pending reload was requested by Reload
+	full bool
+	// meta is the file's metadata at the last reload
+	meta *FileMeta
+	// holding is set while HoldOnTruncate keeps the previous table
+	holding bool
+	// oversize is set while the table file is over its size limit
+	oversize bool
+	// loaded is when the table was last loaded or diffed without error
+	loaded time.Time
+	// last is the last change set recorded
+	last *ChangeSetStatus
+}
+
+// NewTarget creates a target that reloads table and notifies d
+func NewTarget(name string, table *DataTable, d *Dispatcher) *Target {
+	t := &Target{
+		Name:       name,
+		Table:      table,
+		Dispatcher: d,
+		Breaker:    NewCircuitBreaker(0, 0),
+		Workers:    1,
+		Out:        os.Stdout,
+		trigger:    make(chan struct{}, 1),
+		loaded:     time.Now(),
+	}
+	return t
+}
+
+// TargetStatus is a snapshot of a target for status reporting
+type TargetStatus struct {
+	Name string `json:"name"`
+	// Mechanism is how changes are noticed: fsnotify, poll, command or
+	// stdin
+	Mechanism  string       `json:"mechanism"`
+	Filesystem *FSInfo      `json:"filesystem,omitempty"`
+	Breaker    BreakerState `json:"breaker"`
+	Routes     int          `json:"routes"`
+	// Watcher is the health of the file watcher, if there is one
+	Watcher *WatcherHealth `json:"watcher,omitempty"`
+	// Loading is the progress of a table load in progress; Routes is
+	// left at zero until it finishes
+	Loading *LoadProgress `json:"loading,omitempty"`
+	// LastLoad is when the table was last loaded or reloaded without
+	// error
+	LastLoad      time.Time        `json:"last_load"`
+	LastChangeSet *ChangeSetStatus `json:"last_change_set,omitempty"`
+}
+
+// ChangeSetStatus identifies a change set for status reporting
+type ChangeSetStatus struct {
+	ID      uint64    `json:"id"`
+	Time    time.Time `json:"time"`
+	Changes int       `json:"changes"`
+}
+
+// Status returns the target's current status
+func (t *Target) Status() TargetStatus {
+	// A load holds the table's lock throughout, so don't wait for it
+	var routes int
+	loading, ok := t.Table.Progress()
+	if !ok {
+		routes = t.Table.Len()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := TargetStatus{
+		Name:          t.Name,
+		Mechanism:     t.mechanism,
+		Filesystem:    t.Filesystem,
+		Breaker:       t.Breaker.State(),
+		Routes:        routes,
+		LastLoad:      t.loaded,
+		LastChangeSet: t.last,
+	}
+	if ok {
+		s.Loading = &loading
+	}
+	if t.Watcher != nil {
+		h := t.Watcher.Health()
+		s.Watcher = &h
+	}
+	return s
+}
+
+// setMechanism records how the target's changes are noticed
+func (t *Target) setMechanism(m string) {
+	t.mu.Lock()
+	t.mechanism = m
+	t.mu.Unlock()
+	metrics.Gauge("watch_mechanism", "Change detection mechanism in use (1 for the active one)", "target", t.Name, "mechanism", m).Set(1)
+}
+
+// Trigger asks the target to reload. Triggers that arrive while a reload
+// is pending are coalesced into it.
+func (t *Target) Trigger() {
+	t.mu.Lock()
+	t.sweeping = false
+	t.mu.Unlock()
+	t.queue()
+}
+
+// Reload asks the target to re-chunk the whole table straight away, even
+// in incremental mode and while the circuit breaker is open
+func (t *Target) Reload() {
+	t.mu.Lock()
+	t.sweeping = false
+	t.full = true
+	t.mu.Unlock()
+	t.queue()
+}
+
+// SetReport replaces the report options of a running target
+func (t *Target) SetReport(opts ReportOptions) {
+	t.mu.Lock()
+	t.Report = opts
+	t.mu.Unlock()
+}
+
+func (t *Target) queue() {
+	select {
+	case t.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Start runs the target until ctx is cancelled
+func (t *Target) Start(ctx context.Context) {
+	workers := t.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	t.slots = make(chan struct{}, workers)
+	if t.WatchMetadata {
+		t.meta, _ = statMeta(t.Table.FilePath)
+	}
+	t.checkOversize()
+	metrics.Gauge("target_breaker_open", "Whether the target's circuit breaker is open", "target", t.Name).Set(0)
+	go t.run(ctx)
+}
+
+// Poll triggers a reload every interval until ctx is cancelled
+func (t *Target) Poll(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				t.Trigger()
+			}
+		}
+	}()
+}
+
+// sweepGrace is how long after the file's last modification a sweep waits
+// before checking it, so that it doesn't race the watcher for a change
+// that is still being debounced
+const sweepGrace = 5 * time.Second
+
+// Sweep re-hashes the table every interval until ctx is cancelled. Events
+// can be dropped under load even on local disks; changes a sweep finds
+// were missed by the watcher and are reported as such.
+func (t *Target) Sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if info, err := os.Stat(t.Table.FilePath); err == nil && time.Since(info.ModTime()) < sweepGrace {
+				continue
+			}
+			t.mu.Lock()
+			t.sweeping = true
+			t.mu.Unlock()
+			t.queue()
+		}
+	}()
+}
+
+// Wait blocks until notifications in flight have been delivered
+func (t *Target) Wait() {
+	t.wg.Wait()
+}
+
+func (t *Target) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.trigger:
+			t.reload(ctx)
+		}
+	}
+}
+
+// reload detects changes, reports them and hands them to a worker for
+// delivery
+func (t *Target) reload(ctx context.Context) {
+	t.mu.Lock()
+	full := t.full
+	t.full = false
+	t.mu.Unlock()
+	if !full && !t.Breaker.Allow() {
+		// Remember the skipped change so the table is reloaded as soon
+		// as the breaker closes
+		t.mu.Lock()
+		t.missed = true
+		t.mu.Unlock()
+		metrics.Counter("target_reloads_skipped_total", "Reloads skipped while the circuit breaker was open", "target", t.Name).Inc()
+		return
+	}
+	t.mu.Lock()
+	t.missed = false
+	sweep := t.sweeping
+	t.sweeping = false
+	report := t.Report
+	t.mu.Unlock()
+
+	if t.Command == nil {
+		if err := t.awaitStable(ctx); err != nil {
+			return
+		}
+		if t.holdTruncated(ctx) {
+			return
+		}
+	}
+
+	var cs *ChangeSet
+	var err error
+	ctx, span := startSpan(ctx, "reload", "target", t.Name, "sweep", sweep, "full", full)
+	defer func() {
+		span.End(err)
+		if err == nil {
+			t.mu.Lock()
+			t.loaded = time.Now()
+			t.mu.Unlock()
+		}
+	}()
+	start := time.Now()
+	meta, metaChanges := t.statMeta()
+	if sweep {
+		cs, err = t.Table.DetectChanges(ctx)
+		if err == nil && len(cs.Notifiable()) == 0 && len(metaChanges) == 0 {
+			return
+		}
+		if err == nil {
+			metrics.Counter("sweep_caught_total", "Sweeps that found changes the watcher missed", "target", t.Name).Inc()
+			slog.Info("sweep found changes the file watcher missed", "target", t.Name, "changes", len(cs.Notifiable()))
+		}
+	} else if full && t.Command == nil {
+		slog.Info("reload requested; re-reading the whole table", "target", t.Name)
+		cs, err = t.Table.DetectChangesFull(ctx)
+	} else if t.Command != nil {
+		slog.Info("detecting changes", "target", t.Name, "event", t.Command.Event())
+		cs, err = t.Command.DetectChanges(ctx, t.Table)
+	} else {
+		slog.Info("detecting changes", "target", t.Name, "event", "File Change Detected")
+		cs, err = t.Table.DetectChanges(ctx)
+	}
+	if err != nil {
+		slog.Error("failed to detect changes", "target", t.Name, "err", err)
+		metrics.Counter("target_reload_failures_total", "Reloads that failed to parse the table", "target", t.Name).Inc()
+		t.failed()
+		return
+	}
+	cs.File, cs.MetaChanges = meta, metaChanges
+	t.checkOversize()
+	if t.Command == nil && t.truncated(cs) {
+		// Without HoldOnTruncate the empty file was read as is
+		cs.Truncated = true
+		metrics.Counter("target_truncations_total", "Times the table file was found truncated to zero bytes", "target", t.Name).Inc()
+	}
+	for _, e := range t.Enrichers {
+		if err := e.Enrich(ctx, cs); err != nil {
+			slog.Error("failed to enrich changes", "target", t.Name, "err", err)
+		}
+	}
+	t.countChanges(cs, time.Since(start))
+	reportChanges(t.Out, cs, time.Since(start), report)
+	t.record(cs)
+	t.dispatch(ctx, cs)
+}
+
+// countChanges counts a detected change set and its changes by type, so churn
+// can be alerted on
+func (t *Target) countChanges(cs *ChangeSet, took time.Duration) {
+	metrics.Histogram("change_detection_seconds", "Time taken to detect the changes to a table, from reading it to diffing it", DurationBuckets, "target", t.Name).ObserveDuration(took)
+	changes := cs.Notifiable()
+	if len(changes) == 0 {
+		return
+	}
+	metrics.Counter("changesets_detected_total", "Change sets with notifiable changes detected", "target", t.Name).Inc()
+	counts := make(map[ChangeType]int64)
+	for _, c := range changes {
+		counts[c.Type]++
+	}
+	for _, typ := range []ChangeType{ChangeAdded, ChangeRemoved, ChangeModified} {
+		metrics.Counter("route_changes_total", "Routes added, removed or modified, by type", "target", t.Name, "type", string(typ)).Add(counts[typ])
+	}
+}
+
+// record records cs in the audit log and the web UI's feed, unless it has
+// nothing to record
+func (t *Target) record(cs *ChangeSet) {
+	if cs.Len() == 0 && !cs.Truncated && len(cs.MetaChanges) == 0 {
+		return
+	}
+	t.mu.Lock()
+	t.last = &ChangeSetStatus{ID: cs.ID, Time: cs.Time, Changes: cs.Len()}
+	t.mu.Unlock()
+	if t.Feed != nil {
+		t.Feed.Publish(cs)
+	}
+	if t.Audit == nil {
+		return
+	}
+	if err := t.Audit.Write(cs); err != nil {
+		metrics.Counter("audit_write_failures_total", "Change sets that could not be written to the audit log", "target", t.Name).Inc()
+		slog.Error("failed to write audit log", "target", t.Name, "err", err)
+	}
+}
+
+// dispatch hands cs to a worker for delivery, waiting for one to be free
+func (t *Target) dispatch(ctx context.Context, cs *ChangeSet) {
+	select {
+	case t.slots <- struct{}{}:
+	case <-ctx.Done():
+		return
+	}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		defer func() { <-t.slots }()
+		// A delivery outlives ctx, which is cancelled on shutdown, so
+		// shutdown can wait for it rather than have it dead-lettered. It
+		// gets shutdownTimeout to finish from then.
+		dctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		defer cancel()
+		stop := context.AfterFunc(ctx, func() { time.AfterFunc(shutdownTimeout, cancel) })
+		defer stop()
+		// The dispatcher is shared, so its failures are counted against
+		// the target from what Dispatch returns
+		if err := t.Dispatcher.Dispatch(dctx, cs); err != nil {
+			t.failed()
+		} else {
+			t.succeeded()
+		}
+	}()
+}
+
+// holdTruncated reports whether the reload should be skipped because the
+// file has been truncated to zero bytes and HoldOnTruncate keeps the
+// previous table. The truncation is reported and delivered as an empty,
+// truncated change set once per truncation.
+func (t *Target) holdTruncated(ctx context.Context) bool {
+	if !t.HoldOnTruncate {
+		return false
+	}
+	info, err := os.Stat(t.Table.FilePath)
+	empty := err == nil && info.Size() == 0
+	t.Table.mu.RLock()
+	routes := len(t.Table.Chunks)
+	t.Table.mu.RUnlock()
+
+	hold := empty && routes > 0
+	t.mu.Lock()
+	holding := t.holding
+	t.holding = hold
+	t.mu.Unlock()
+	switch {
+	case hold == holding:
+		return hold
+	case holding:
+		slog.Info("truncation over; comparing the file with the held table", "target", t.Name)
+		return false
+	}
+	metrics.Counter("target_truncations_total", "Times the table file was found truncated to zero bytes", "target", t.Name).Inc()
+	slog.Warn("file truncated; holding the previous table until content returns", "target", t.Name, "routes", routes)
+	cs := &ChangeSet{Path: t.Table.FilePath, Time: time.Now(), Routes: t.Table.Len(), Truncated: true}
+	t.record(cs)
+	t.dispatch(ctx, cs)
+	return true
+}
+
+// checkOversize reports the table file growing over, or shrinking back
+// under, its size limit
+func (t *Target) checkOversize() {
+	over := t.Table.Oversize()
+	t.mu.Lock()
+	changed := over != t.oversize
+	t.oversize = over
+	t.mu.Unlock()
+	if !changed {
+		return
+	}
+	var v int64
+	if over {
+		v = 1
+		slog.Warn("file over -max-size; keeping only hashes and offsets in memory", "target", t.Name)
+	}
+	metrics.Gauge("table_oversize", "Whether the table file is over its size limit and loaded lean", "target", t.Name).Set(v)
+}
+
+// truncated reports whether cs emptied the table because the file was
+// truncated to zero bytes
+func (t *Target) truncated(cs *ChangeSet) bool {
+	if cs.Len() == 0 {
+		return false
+	}
+	t.Table.mu.RLock()
+	routes := len(t.Table.Chunks)
+	t.Table.mu.RUnlock()
+	info, err := os.Stat(t.Table.FilePath)
+	return routes == 0 && err == nil && info.Size() == 0
+}
+
+// maxSettle bounds how long a reload waits for the file to stop changing
+// before parsing it anyway
+const maxSettle = time.Minute
+
+// awaitStable waits until the table file stops growing or changing, as
+// seen by its size and modification time, sampling it every Settle. It
+// returns early only if ctx is cancelled.
+func (t *Target) awaitStable(ctx context.Context) error {
+	if t.Settle <= 0 {
+		return nil
+	}
+	deadline := time.Now().Add(maxSettle)
+	prev, _ := os.Stat(t.Table.FilePath)
+	waited := false
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(t.Settle):
+		}
+		cur, _ := os.Stat(t.Table.FilePath)
+		switch {
+		case prev == nil && cur == nil:
+			// Gone for good; let the reload report it
+			return nil
+		case prev != nil && cur != nil && cur.Size() == prev.Size() && cur.ModTime().Equal(prev.ModTime()):
+			return nil
+		}
+		if time.Now().After(deadline) {
+			slog.Warn("file still changing; reading it anyway", "target", t.Name, "waited", maxSettle)
+			return nil
+		}
+		if !waited {
+			waited = true
+			metrics.Counter("target_settle_waits_total", "Reloads held back while the file was still being written", "target", t.Name).Inc()
+		}
+		prev = cur
+	}
+}
+
+// statMeta reads the file's metadata if it is being watched and returns
+// it with how it changed since the last reload
+func (t *Target) statMeta() (*FileMeta, []string) {
+	if !t.WatchMetadata {
+		return nil, nil
+	}
+	meta, err := statMeta(t.Table.FilePath)
+	if err != nil {
+		return nil, nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var changes []string
+	if t.meta != nil {
+		changes = meta.changes(t.meta)
+	}
+	t.meta = meta
+	return meta, changes
+}
+
+// failed records a parse or sink failure, disabling the target if the
+// breaker opens
+func (t *Target) failed() {
+	if !t.Breaker.Failure() {
+		return
+	}
+	metrics.Gauge("target_breaker_open", "Whether the target's circuit breaker is open", "target", t.Name).Set(1)
+	slog.Warn("target disabled after repeated failures", "target", t.Name, "probe_in", t.Breaker.Cooldown)
+	time.AfterFunc(t.Breaker.Cooldown, t.Trigger)
+}
+
+// succeeded records a clean reload and delivery, re-enabling the target if
+// it was disabled
+func (t *Target) succeeded() {
+	if !t.Breaker.Success() {
+		return
+	}
+	metrics.Gauge("target_breaker_open", "Whether the target's circuit breaker is open", "target", t.Name).Set(0)
+	slog.Info("target recovered", "target", t.Name)
+	t.mu.Lock()
+	missed := t.missed
+	t.mu.Unlock()
+	if missed {
+		t.Trigger()
+	}
+}
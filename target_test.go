@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+func TestTargetCircuitBreaker(t *testing.T) {
+	path := writeTable(t,
+		routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"),
+		routeBlock("0.0.0.0/0", "Static", "172.31.0.254"),
+	)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &fakeSink{name: "hook"}
+	d := NewDispatcher([]Sink{sink}, nil)
+	d.OnError = func(error) {}
+	target := NewTarget(t.Name(), loadTable(t, path), d)
+	target.Out = io.Discard
+	target.Breaker = NewCircuitBreaker(2, 50*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	target.Start(ctx)
+
+	// Two failed reloads disable the target
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	failures := metrics.Counter("target_reload_failures_total", "", "target", t.Name())
+	base := failures.Value()
+	for i := int64(1); i <= 2; i++ {
+		target.Trigger()
+		waitFor(t, "reload failure", func() bool { return failures.Value() == base+i })
+	}
+	if s := target.Breaker.State(); s != BreakerOpen {
+		t.Fatalf("breaker %s after repeated failures", s)
+	}
+
+	// Changes while disabled are skipped, then picked up by the probe
+	if err := os.WriteFile(path, []byte(string(data)+routeBlock("192.168.0.0/16", "OSPF", "172.31.0.3")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	target.Trigger()
+	waitFor(t, "probe", func() bool { return target.Breaker.State() == BreakerClosed })
+	target.Wait()
+
+	got := sink.delivered()
+	if len(got) != 1 || got[0].Len() != 1 || got[0].Changes[0].Destination != "192.168.0.0/16" {
+		t.Fatalf("deliveries = %+v", got)
+	}
+}
+
+func TestTargetSinkFailuresOpenBreaker(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	sink := &fakeSink{name: "hook", err: io.ErrClosedPipe}
+	d := NewDispatcher([]Sink{sink}, nil)
+	d.OnError = func(error) {}
+	target := NewTarget(t.Name(), loadTable(t, path), d)
+	target.Out = io.Discard
+	target.Breaker = NewCircuitBreaker(1, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	target.Start(ctx)
+
+	rewriteFile(t, path, "172.31.0.1", "172.31.0.2")
+	target.Trigger()
+	waitFor(t, "breaker to open", func() bool { return target.Breaker.State() == BreakerOpen })
+	target.Wait()
+}
+
+func TestTargetSinkFailuresIsolated(t *testing.T) {
+	// Targets share the dispatcher, but only the one whose delivery
+	// failed is disabled
+	sink := &fakeSink{name: "hook", err: io.ErrClosedPipe}
+	d := NewDispatcher([]Sink{sink}, nil)
+	d.OnError = func(error) {}
+	var targets []*Target
+	for _, name := range []string{"a", "b"} {
+		path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+		target := NewTarget(name, loadTable(t, path), d)
+		target.Out = io.Discard
+		target.Breaker = NewCircuitBreaker(1, time.Hour)
+		targets = append(targets, target)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a, b := targets[0], targets[1]
+	a.Start(ctx)
+	b.Start(ctx)
+
+	rewriteFile(t, a.Table.FilePath, "172.31.0.1", "172.31.0.2")
+	a.reload(ctx)
+	a.Wait()
+	if s := a.Breaker.State(); s != BreakerOpen {
+		t.Errorf("failing target's breaker %s", s)
+	}
+	if s := b.Breaker.State(); s != BreakerClosed {
+		t.Errorf("other target's breaker %s after a's delivery failed", s)
+	}
+}
+
+// gateSink blocks each delivery until release is closed, failing it if
+// its context is done first
+type gateSink struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *gateSink) Name() string { return "gate" }
+
+func (s *gateSink) Deliver(ctx context.Context, _ *ChangeSet) error {
+	s.entered <- struct{}{}
+	select {
+	case <-s.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestTargetDeliveryOutlivesShutdown(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	sink := &gateSink{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	d := NewDispatcher([]Sink{sink}, nil)
+	var errs []error
+	d.OnError = func(err error) { errs = append(errs, err) }
+	target := NewTarget(t.Name(), loadTable(t, path), d)
+	target.Out = io.Discard
+	target.Breaker = NewCircuitBreaker(1, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	target.Start(ctx)
+
+	rewriteFile(t, path, "172.31.0.1", "172.31.0.2")
+	target.Trigger()
+	<-sink.entered
+	// Shutting down leaves the delivery in flight to finish
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	close(sink.release)
+	target.Wait()
+	if len(errs) != 0 {
+		t.Errorf("delivery failed on shutdown: %v", errs)
+	}
+	if s := target.Breaker.State(); s != BreakerClosed {
+		t.Errorf("breaker %s after shutdown", s)
+	}
+}
+
+func TestTargetSweep(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	sink := &fakeSink{name: "hook"}
+	target := NewTarget(t.Name(), loadTable(t, path), NewDispatcher([]Sink{sink}, nil))
+	target.Out = io.Discard
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	target.Start(ctx)
+	target.Sweep(ctx, 5*time.Millisecond)
+
+	caught := metrics.Counter("sweep_caught_total", "", "target", t.Name())
+	base := caught.Value()
+
+	// A change the watcher never reported, old enough not to be pending
+	rewriteFile(t, path, "172.31.0.1", "172.31.0.2")
+	old := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "sweep", func() bool { return caught.Value() == base+1 })
+	target.Wait()
+	if got := sink.delivered(); len(got) != 1 || got[0].Len() != 1 {
+		t.Fatalf("deliveries = %+v", got)
+	}
+
+	// Sweeps of an unchanged file stay quiet
+	time.Sleep(30 * time.Millisecond)
+	if n := caught.Value(); n != base+1 {
+		t.Errorf("caught %d, want 1", n-base)
+	}
+}
+
+func TestTargetChangeMetrics(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	target := NewTarget(t.Name(), loadTable(t, path), NewDispatcher(nil, nil))
+	target.Out = io.Discard
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	target.Start(ctx)
+
+	// Reloading an unchanged file is timed, but no change set is counted
+	target.reload(ctx)
+	rewriteFile(t, path, "172.31.0.1", "172.31.0.2")
+	target.reload(ctx)
+	target.Wait()
+	for _, tt := range []struct {
+		name string
+		got  int64
+		want int64
+	}{
+		{"change_detection_seconds", metrics.Histogram("change_detection_seconds", "", DurationBuckets, "target", t.Name()).Count(), 2},
+		{"changesets_detected_total", metrics.Counter("changesets_detected_total", "", "target", t.Name()).Value(), 1},
+		{"route_changes_total modified", metrics.Counter("route_changes_total", "", "target", t.Name(), "type", "modified").Value(), 1},
+		{"route_changes_total added", metrics.Counter("route_changes_total", "", "target", t.Name(), "type", "added").Value(), 0},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s = %d, want %d", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestTargetWatchMetadata(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	if err := os.Chmod(path, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sink := &fakeSink{name: "hook"}
+	target := NewTarget(t.Name(), loadTable(t, path), NewDispatcher([]Sink{sink}, nil))
+	var out strings.Builder
+	target.Out = &out
+	target.WatchMetadata = true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	target.Start(ctx)
+
+	// A mode change alone is reported, though no route changed
+	if err := os.Chmod(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	target.reload(ctx)
+	target.Wait()
+	if !strings.Contains(out.String(), "mode -rw-r--r-- -> -rw-------") {
+		t.Errorf("report missing the mode change:\n%s", out.String())
+	}
+
+	rewriteFile(t, path, "172.31.0.1", "172.31.0.2")
+	target.reload(ctx)
+	target.Wait()
+	got := sink.delivered()
+	if len(got) != 1 || got[0].File == nil || got[0].File.Mode != "-rw-------" {
+		t.Fatalf("deliveries = %+v, want one with the file metadata", got)
+	}
+}
+
+func TestTargetSettle(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	sink := &fakeSink{name: "hook"}
+	target := NewTarget(t.Name(), loadTable(t, path), NewDispatcher([]Sink{sink}, nil))
+	target.Out = io.Discard
+	target.Settle = 25 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	target.Start(ctx)
+
+	// An export still being appended to is read once it is complete
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer f.Close()
+		for i := 1; i <= 5; i++ {
+			f.WriteString("\n" + routeBlock(fmt.Sprintf("192.168.%d.0/24", i), "OSPF", "172.31.0.3") + "\n")
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	time.Sleep(5 * time.Millisecond)
+	target.reload(ctx)
+	target.Wait()
+	<-done
+	got := sink.delivered()
+	if len(got) != 1 {
+		t.Fatalf("%d deliveries, want 1", len(got))
+	}
+	var added int
+	for _, c := range got[0].Changes {
+		if c.Type == ChangeAdded {
+			added++
+		}
+	}
+	if added != 5 {
+		t.Errorf("%d routes added, want all 5", added)
+	}
+}
+
+func TestTargetTruncate(t *testing.T) {
+	path := writeTable(t,
+		routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"),
+		routeBlock("0.0.0.0/0", "Static", "172.31.0.254"),
+	)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hold := range []bool{false, true} {
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		sink := &fakeSink{name: "hook"}
+		target := NewTarget(t.Name(), loadTable(t, path), NewDispatcher([]Sink{sink}, nil))
+		target.Out = io.Discard
+		target.HoldOnTruncate = hold
+		ctx, cancel := context.WithCancel(context.Background())
+		target.Start(ctx)
+
+		if err := os.Truncate(path, 0); err != nil {
+			t.Fatal(err)
+		}
+		target.reload(ctx)
+		target.reload(ctx)
+		target.Wait()
+		got := sink.delivered()
+		want := 2
+		if hold {
+			want = 0
+		}
+		if len(got) != 1 || !got[0].Truncated || got[0].Len() != want {
+			t.Fatalf("hold %v: deliveries = %+v, want one truncation with %d removals", hold, got, want)
+		}
+
+		// Content coming back is compared with the held table
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		rewriteFile(t, path, "172.31.0.1", "172.31.0.2")
+		target.reload(ctx)
+		target.Wait()
+		got = sink.delivered()
+		want = 2
+		if hold {
+			want = 1
+		}
+		if len(got) != 2 || got[1].Truncated || got[1].Len() != want {
+			t.Errorf("hold %v: refill delivered %+v, want %d changes", hold, got[1:], want)
+		}
+		cancel()
+	}
+}
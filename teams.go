@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	sinkFactories["teams"] = func(u *url.URL) (Sink, error) {
+		return newTeamsSink(u)
+	}
+}
+
+// TeamsSink posts a summary of every change set to a Microsoft Teams
+// channel as an Adaptive Card, through an incoming webhook or a Workflows
+// webhook:
+//
+//	teams+https://example.webhook.office.com/webhookb2/...
+//
+// It says the same as the Slack sink and takes the same parameters: those
+// of chatNotifier and the webhook sink's timeout, retries and backoff.
+type TeamsSink struct {
+	chatNotifier
+	name string
+	post *WebhookSink
+}
+
+func newTeamsSink(u *url.URL) (*TeamsSink, error) {
+	s := &TeamsSink{name: sinkName(u)}
+	_, transport, _ := strings.Cut(u.Scheme, "+")
+	if transport != "https" && transport != "http" {
+		return nil, fmt.Errorf("teams sink %q needs teams+https://", u.Redacted())
+	}
+	q := u.Query()
+	if err := s.chatNotifier.parse(q); err != nil {
+		return nil, fmt.Errorf("teams sink %s: %w", s.name, err)
+	}
+	target := *u
+	target.Scheme = transport
+	// One message at a time, so the channel reads in order
+	q.Set("concurrency", "1")
+	var err error
+	if s.post, err = newPoster(s.name, &target, q); err != nil {
+		return nil, fmt.Errorf("teams sink %s: %w", s.name, err)
+	}
+	return s, nil
+}
+
+func (s *TeamsSink) Name() string { return s.name }
+
+// Deliver posts the card of cs, unless the sink's filter leaves nothing
+// of it
+func (s *TeamsSink) Deliver(ctx context.Context, cs *ChangeSet) error {
+	sum := s.summarize(cs)
+	if sum == nil {
+		return nil
+	}
+	body, err := json.Marshal(teamsMessage(sum))
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+	if err := s.wait(ctx); err != nil {
+		return err
+	}
+	return s.post.send(ctx, body)
+}
+
+// Adaptive Card elements, as far as the Teams sink uses them
+type (
+	teamsPayload struct {
+		Type        string            `json:"type"`
+		Attachments []teamsAttachment `json:"attachments"`
+	}
+	teamsAttachment struct {
+		ContentType string       `json:"contentType"`
+		Content     adaptiveCard `json:"content"`
+	}
+	adaptiveCard struct {
+		Schema  string           `json:"$schema"`
+		Type    string           `json:"type"`
+		Version string           `json:"version"`
+		Body    []map[string]any `json:"body"`
+		Actions []map[string]any `json:"actions,omitempty"`
+	}
+	adaptiveFact struct {
+		Title string `json:"title"`
+		Value string `json:"value"`
+	}
+)
+
+// teamsMessage lays sum out as an Adaptive Card: a heading, the counts as
+// facts, the top address blocks and a button opening the change set
+func teamsMessage(sum *chatSummary) teamsPayload {
+	cs := sum.cs
+	card := adaptiveCard{
+		Schema:  "http://adaptivecards.io/schemas/adaptive-card.json",
+		Type:    "AdaptiveCard",
+		Version: "1.4",
+	}
+	text := func(s string, extra map[string]any) {
+		block := map[string]any{"type": "TextBlock", "text": s, "wrap": true}
+		for k, v := range extra {
+			block[k] = v
+		}
+		card.Body = append(card.Body, block)
+	}
+	if cs.Truncated {
+		text(fmt.Sprintf("⚠ %s was truncated to zero bytes", cs.Path), map[string]any{"weight": "Bolder", "color": "Attention"})
+	}
+	if sum.Changes > 0 {
+		heading := map[string]any{"weight": "Bolder", "size": "Medium"}
+		if sum.Critical > 0 {
+			heading["color"] = "Attention"
+		}
+		text(fmt.Sprintf("%d changed routes in %s", sum.Changes, cs.Path), heading)
+		facts := []adaptiveFact{
+			{"Changeset", strconv.FormatUint(cs.ID, 10)},
+			{"Added", strconv.Itoa(sum.Added)},
+			{"Removed", strconv.Itoa(sum.Removed)},
+			{"Modified", strconv.Itoa(sum.Modified)},
+		}
+		if sum.Critical > 0 {
+			facts = append(facts, adaptiveFact{"Critical", strconv.Itoa(sum.Critical)})
+		}
+		facts = append(facts, adaptiveFact{"Routes in table", strconv.Itoa(cs.Routes)})
+		card.Body = append(card.Body, map[string]any{"type": "FactSet", "facts": facts})
+	}
+	if sum.Blocks != "" {
+		text("Top prefixes: "+sum.Blocks, map[string]any{"isSubtle": true})
+	}
+	if sum.Link != "" {
+		card.Actions = append(card.Actions, map[string]any{"type": "Action.OpenUrl", "title": "Full change set", "url": sum.Link})
+	}
+	return teamsPayload{
+		Type:        "message",
+		Attachments: []teamsAttachment{{ContentType: "application/vnd.microsoft.card.adaptive", Content: card}},
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTeamsSink(t *testing.T) {
+	var bodies [][]byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, data)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	sink, err := newSink("teams+" + srv.URL + "/webhookb2/x?link=http://watcher:8080&type=added,modified&interval=1ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Deliver(context.Background(), &ChangeSet{ID: 9, Path: "core.txt", Routes: 50, Changes: []Change{
+		{Type: ChangeAdded, Destination: "10.1.0.0/16", Critical: true},
+		{Type: ChangeRemoved, Destination: "10.2.0.0/16"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	// Only removals, which this sink doesn't route
+	if err := sink.Deliver(context.Background(), &ChangeSet{ID: 10, Path: "core.txt", Changes: []Change{
+		{Type: ChangeRemoved, Destination: "10.2.0.0/16"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 1 {
+		t.Fatalf("%d messages, want 1", len(bodies))
+	}
+
+	var msg struct {
+		Type        string `json:"type"`
+		Attachments []struct {
+			ContentType string `json:"contentType"`
+			Content     struct {
+				Type string `json:"type"`
+				Body []struct {
+					Type  string         `json:"type"`
+					Text  string         `json:"text"`
+					Color string         `json:"color"`
+					Facts []adaptiveFact `json:"facts"`
+				} `json:"body"`
+				Actions []struct {
+					Type string `json:"type"`
+					URL  string `json:"url"`
+				} `json:"actions"`
+			} `json:"content"`
+		} `json:"attachments"`
+	}
+	if err := json.Unmarshal(bodies[0], &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "message" || len(msg.Attachments) != 1 || msg.Attachments[0].ContentType != "application/vnd.microsoft.card.adaptive" {
+		t.Fatalf("message = %s", bodies[0])
+	}
+	card := msg.Attachments[0].Content
+	if card.Type != "AdaptiveCard" || len(card.Body) != 3 {
+		t.Fatalf("card = %s", bodies[0])
+	}
+	if b := card.Body[0]; b.Text != "1 changed routes in core.txt" || b.Color != "Attention" {
+		t.Errorf("heading = %+v", b)
+	}
+	want := []adaptiveFact{{"Changeset", "9"}, {"Added", "1"}, {"Removed", "0"}, {"Modified", "0"}, {"Critical", "1"}, {"Routes in table", "50"}}
+	if got := card.Body[1].Facts; len(got) != len(want) {
+		t.Errorf("facts = %+v", got)
+	} else {
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("fact %d = %+v, want %+v", i, got[i], want[i])
+			}
+		}
+	}
+	if b := card.Body[2]; b.Text != "Top prefixes: 10.0.0.0/8: 1 added" {
+		t.Errorf("blocks = %q", b.Text)
+	}
+	if len(card.Actions) != 1 || card.Actions[0].URL != "http://watcher:8080/#changeset-9" {
+		t.Errorf("actions = %+v", card.Actions)
+	}
+}
+
+func TestNewTeamsSinkErrors(t *testing.T) {
+	for _, spec := range []string{
+		"teams://example.webhook.office.com/webhookb2/x",
+		"teams+https://example.webhook.office.com/webhookb2/x?top=-1",
+	} {
+		if _, err := newSink(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
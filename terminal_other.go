@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// cbreak can't change terminal modes on this platform, so keys take
+// effect once Enter is pressed
+func cbreak(f *os.File) (func(), error) {
+	return func() {}, nil
+}
+
+// terminalSize can't ask the terminal on this platform and falls back to
+// $COLUMNS and $LINES
+func terminalSize(f *os.File) (int, int) {
+	return envTerminalSize()
+}
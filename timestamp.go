@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Default -ts-format and -tz
+const (
+	DefaultTimeFormat = "RFC3339"
+	DefaultTimeZone   = "Local"
+)
+
+// timeLayouts are the named -ts-format values
+var timeLayouts = map[string]string{
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"RFC1123":     time.RFC1123,
+	"RFC1123Z":    time.RFC1123Z,
+	"RFC822":      time.RFC822,
+	"DateTime":    time.DateTime,
+	"Stamp":       time.Stamp,
+	"StampMilli":  time.StampMilli,
+	"StampMicro":  time.StampMicro,
+	"Kitchen":     time.Kitchen,
+}
+
+// Numeric -ts-format values
+const (
+	timeUnix      = "unix"
+	timeUnixMilli = "unixmilli"
+)
+
+// TimeFormat formats the timestamps of reports. The zero TimeFormat
+// writes RFC 3339 in each time's own zone.
+type TimeFormat struct {
+	// Layout is a Go time layout, or "unix" or "unixmilli" for seconds or
+	// milliseconds since the epoch
+	Layout string
+	// Location, if set, is the zone times are converted to
+	Location *time.Location
+}
+
+// parseTimeFormat parses a -ts-format, either one of the names in
+// timeLayouts, "unix", "unixmilli" or a Go layout, and a -tz, either
+// "UTC", "Local" or an IANA zone name
+func parseTimeFormat(format, tz string) (TimeFormat, error) {
+	var f TimeFormat
+	switch layout, ok := timeLayouts[format]; {
+	case ok:
+		f.Layout = layout
+	case format == timeUnix || format == timeUnixMilli:
+		f.Layout = format
+	case time.Unix(0, 0).Format(format) == format:
+		// Nothing in it is a layout element, so it's likely a misspelt
+		// name
+		return f, fmt.Errorf("unknown -ts-format %q (want a name such as RFC3339, unix, unixmilli or a Go layout)", format)
+	default:
+		f.Layout = format
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return f, fmt.Errorf("-tz: %w", err)
+	}
+	f.Location = loc
+	return f, nil
+}
+
+// In converts t to the format's zone
+func (f TimeFormat) In(t time.Time) time.Time {
+	if f.Location == nil {
+		return t
+	}
+	return t.In(f.Location)
+}
+
+// Format formats t
+func (f TimeFormat) Format(t time.Time) string {
+	switch f.Layout {
+	case "":
+		return f.In(t).Format(time.RFC3339)
+	case timeUnix:
+		return strconv.FormatInt(t.Unix(), 10)
+	case timeUnixMilli:
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	}
+	return f.In(t).Format(f.Layout)
+}
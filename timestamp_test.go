@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeFormat(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	for _, tc := range []struct{ format, tz, want string }{
+		{"RFC3339", "UTC", "2024-05-01T12:30:00Z"},
+		{"RFC3339", "Asia/Tokyo", "2024-05-01T21:30:00+09:00"},
+		{"DateTime", "UTC", "2024-05-01 12:30:00"},
+		{"unix", "Asia/Tokyo", "1714566600"},
+		{"unixmilli", "UTC", "1714566600000"},
+		{"02/01 15:04", "UTC", "01/05 12:30"},
+	} {
+		f, err := parseTimeFormat(tc.format, tc.tz)
+		if err != nil {
+			t.Errorf("%s %s: %v", tc.format, tc.tz, err)
+			continue
+		}
+		if got := f.Format(at); got != tc.want {
+			t.Errorf("%s %s: %s, want %s", tc.format, tc.tz, got, tc.want)
+		}
+	}
+	if _, err := parseTimeFormat("unixtime", "UTC"); err == nil {
+		t.Error("accepted a misspelt -ts-format")
+	}
+	if _, err := parseTimeFormat("RFC3339", "Mars/Olympus"); err == nil {
+		t.Error("accepted an unknown -tz")
+	}
+
+	// Every change set and change line of the report is stamped
+	f, _ := parseTimeFormat("DateTime", "UTC")
+	var out bytes.Buffer
+	reportChanges(&out, &ChangeSet{ID: 1, Path: "t.txt", Time: at, Changes: []Change{
+		{Seq: 1, Type: ChangeAdded, Destination: "10.0.0.0/8"},
+	}}, time.Millisecond, ReportOptions{PreviewLimit: 10, Time: f})
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "[2024-05-01 12:30:00] Found 1 changed routes") || !strings.HasPrefix(lines[1], "  - 2024-05-01 12:30:00 #1 ") {
+		t.Errorf("report:\n%s", out.String())
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// keyPair is a certificate and key read from files, read again when
+// either file changes so renewed certificates are picked up without a
+// restart
+type keyPair struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// loadKeyPair reads the certificate and key of certFile and keyFile
+func loadKeyPair(certFile, keyFile string) (*keyPair, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("a certificate needs both its file and its key file")
+	}
+	k := &keyPair{certFile: certFile, keyFile: keyFile}
+	if _, err := k.get(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// get returns the certificate, reading the files again if they changed
+// since they were last read. A renewed certificate that can't be read is
+// counted and the previous one kept until the files change again.
+func (k *keyPair) get() (*tls.Certificate, error) {
+	var modTime time.Time
+	for _, f := range []string{k.certFile, k.keyFile} {
+		if info, err := os.Stat(f); err == nil && info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.cert != nil && !modTime.After(k.modTime) {
+		return k.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		if k.cert != nil {
+			k.modTime = modTime
+			metrics.Counter("tls_reload_failures_total", "Renewed certificates that couldn't be read", "cert", k.certFile).Inc()
+			return k.cert, nil
+		}
+		return nil, err
+	}
+	k.cert, k.modTime = &cert, modTime
+	return k.cert, nil
+}
+
+// loadCAs reads the PEM certificates of file into a pool
+func loadCAs(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CAs: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", file)
+	}
+	return pool, nil
+}
+
+// serverTLS returns the TLS configuration for serving with the
+// certificate of certFile and keyFile. With clientCAs, clients that
+// present a certificate must have one those CAs issued; Authenticator
+// requires them to.
+func serverTLS(certFile, keyFile, clientCAs string) (*tls.Config, error) {
+	k, err := loadKeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return k.get()
+		},
+	}
+	if clientCAs != "" {
+		// The probes can't present a certificate, so checking that one
+		// was is left to Authenticator
+		if cfg.ClientCAs, err = loadCAs(clientCAs); err != nil {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// clientTLS returns the TLS configuration of a sink's tls-ca-file,
+// tls-cert-file and tls-key-file parameters in q, or nil if none is set,
+// and removes them from q. tls-ca-file is the PEM file of the CAs to
+// trust instead of the system's; tls-cert-file and tls-key-file are the
+// client certificate to present to servers that require one, read again
+// when they change. The prefix keeps them apart from the key-file of
+// sinks' API keys.
+func clientTLS(q url.Values) (*tls.Config, error) {
+	caFile, certFile, keyFile := q.Get("tls-ca-file"), q.Get("tls-cert-file"), q.Get("tls-key-file")
+	for _, p := range []string{"tls-ca-file", "tls-cert-file", "tls-key-file"} {
+		q.Del(p)
+	}
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		var err error
+		if cfg.RootCAs, err = loadCAs(caFile); err != nil {
+			return nil, err
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		k, err := loadKeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return k.get()
+		}
+	}
+	return cfg, nil
+}
+
+// serveHTTP serves srv on ln, over TLS if srv.TLSConfig is set
+func serveHTTP(srv *http.Server, ln net.Listener) error {
+	if srv.TLSConfig != nil {
+		return srv.ServeTLS(ln, "", "")
+	}
+	return srv.Serve(ln)
+}
+
+// grpcProtocols returns the protocols of a gRPC server: HTTP/2 over TLS
+// or, without it, HTTP/2 from the start, as gRPC clients speak it without
+// an upgrade
+func grpcProtocols(overTLS bool) *http.Protocols {
+	var p http.Protocols
+	if overTLS {
+		p.SetHTTP2(true)
+	} else {
+		p.SetUnencryptedHTTP2(true)
+	}
+	return &p
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// file is the CA's certificate in PEM
+	file string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{key: key, file: filepath.Join(t.TempDir(), "ca.pem")}
+	ca.cert, _ = x509.ParseCertificate(der)
+	os.WriteFile(ca.file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+	return ca
+}
+
+// issue writes a certificate for name, valid for 127.0.0.1, and its key,
+// returning their files
+func (ca *testCA) issue(t *testing.T, name string) (certFile, keyFile string) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func TestServerMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, "go-watcher")
+	cfg, err := serverTLS(certFile, keyFile, ca.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	target := NewTarget("core", loadTable(t, path), NewDispatcher(nil, nil))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler:   (&WebUI{Targets: func() []*Target { return []*Target{target} }, Auth: &Authenticator{ClientCerts: true}}).Handler(),
+		TLSConfig: cfg,
+	}
+	go serveHTTP(srv, ln)
+	defer srv.Close()
+	base := "https://" + ln.Addr().String()
+
+	roots, _ := loadCAs(ca.file)
+	client := func(cert *tls.Certificate) *http.Client {
+		cfg := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			cfg.Certificates = []tls.Certificate{*cert}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	}
+	get := func(c *http.Client, path string, code int) {
+		t.Helper()
+		resp, err := c.Get(base + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != code {
+			t.Errorf("GET %s: %s, want %d", path, resp.Status, code)
+		}
+	}
+	get(client(nil), "/healthz", http.StatusOK)
+	get(client(nil), "/api/status", http.StatusUnauthorized)
+	clientCert, clientKey := ca.issue(t, "grafana")
+	cert, _ := tls.LoadX509KeyPair(clientCert, clientKey)
+	get(client(&cert), "/api/status", http.StatusOK)
+
+	// A certificate from another CA is refused in the handshake
+	other, _ := newTestCA(t).issue(t, "mallory")
+	otherCert, _ := tls.LoadX509KeyPair(other, filepath.Join(filepath.Dir(other), "key.pem"))
+	if _, err := client(&otherCert).Get(base + "/api/status"); err == nil {
+		t.Error("client certificate from an unknown CA accepted")
+	}
+
+	if _, err := serverTLS(certFile, "", ""); err == nil {
+		t.Error("certificate without a key: no error")
+	}
+}
+
+func TestWebhookClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	roots, _ := loadCAs(ca.file)
+	var got string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.TLS.PeerCertificates[0].Subject.CommonName
+	}))
+	serverCert, serverKey := ca.issue(t, "receiver")
+	cert, _ := tls.LoadX509KeyPair(serverCert, serverKey)
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, ClientCAs: roots, ClientAuth: tls.RequireAndVerifyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	clientCert, clientKey := ca.issue(t, "go-watcher")
+	spec := "webhook+" + srv.URL + "?retries=0&tls-ca-file=" + url.QueryEscape(ca.file)
+	sink, err := newSink(spec + "&tls-cert-file=" + url.QueryEscape(clientCert) + "&tls-key-file=" + url.QueryEscape(clientKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Deliver(context.Background(), pluginChangeSetSample(t)); err != nil || got != "go-watcher" {
+		t.Errorf("delivery with a client certificate: %v, server saw %q", err, got)
+	}
+	sink, err = newSink(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Deliver(context.Background(), pluginChangeSetSample(t)); err == nil {
+		t.Error("delivery without a client certificate succeeded")
+	}
+
+	for _, spec := range []string{
+		"webhook+http://host/path?tls-ca-file=" + url.QueryEscape(ca.file),
+		"webhook+https://host/path?tls-cert-file=" + url.QueryEscape(clientCert),
+		"kafka://broker:9092/routes?tls-cert-file=" + url.QueryEscape(clientCert) + "&tls-key-file=" + url.QueryEscape(clientKey),
+	} {
+		if _, err := newSink(spec); err == nil {
+			t.Errorf("%s: no error", spec)
+		}
+	}
+}
+
+func TestPagerDutyClientCertificate(t *testing.T) {
+	// The routing key's key-file and the client certificate's
+	// tls-key-file are different parameters
+	ca := newTestCA(t)
+	roots, _ := loadCAs(ca.file)
+	events := make(chan pagerDutyEvent, 1)
+	var got string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.TLS.PeerCertificates[0].Subject.CommonName
+		var e pagerDutyEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		w.WriteHeader(http.StatusAccepted)
+		events <- e
+	}))
+	serverCert, serverKey := ca.issue(t, "events")
+	cert, _ := tls.LoadX509KeyPair(serverCert, serverKey)
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, ClientCAs: roots, ClientAuth: tls.RequireAndVerifyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+	api := pagerDutyAPI
+	pagerDutyAPI = srv.URL
+	defer func() { pagerDutyAPI = api }()
+
+	routingKey := filepath.Join(t.TempDir(), "routing-key")
+	os.WriteFile(routingKey, []byte("R0UT1NG\n"), 0o600)
+	clientCert, clientKey := ca.issue(t, "go-watcher")
+	sink, err := newSink("pagerduty://?key-file=" + url.QueryEscape(routingKey) + "&tls-ca-file=" + url.QueryEscape(ca.file) +
+		"&tls-cert-file=" + url.QueryEscape(clientCert) + "&tls-key-file=" + url.QueryEscape(clientKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := &ChangeSet{ID: 1, Path: "core.txt", Changes: []Change{{Type: ChangeRemoved, Destination: "0.0.0.0/0"}}}
+	if err := sink.Deliver(context.Background(), removed); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-events:
+		if e.RoutingKey != "R0UT1NG" || got != "go-watcher" {
+			t.Errorf("event with routing key %q, server saw %q", e.RoutingKey, got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event")
+	}
+}
+
+func TestKeyPairReload(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, "first")
+	k, err := loadKeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := k.get()
+
+	// Renew the certificate in place, as cert-manager does
+	renewedCert, renewedKey := ca.issue(t, "renewed")
+	for _, f := range [][2]string{{renewedCert, certFile}, {renewedKey, keyFile}} {
+		data, _ := os.ReadFile(f[0])
+		os.WriteFile(f[1], data, 0o600)
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(f[1], later, later)
+	}
+	renewed, _ := k.get()
+	if renewed == first || renewed.Leaf.Subject.CommonName != "renewed" {
+		t.Errorf("certificate not reloaded: %s", renewed.Leaf.Subject.CommonName)
+	}
+
+	// A broken renewal keeps the certificate in use
+	os.WriteFile(keyFile, []byte("garbage"), 0o600)
+	later := time.Now().Add(2 * time.Minute)
+	os.Chtimes(keyFile, later, later)
+	if kept, err := k.get(); err != nil || kept != renewed {
+		t.Errorf("after a broken renewal: %v", err)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing of the load, detect and deliver pipeline with OpenTelemetry
+// spans, exported to a collector with OTLP over HTTP in protobuf. A reload
+// is a trace: its reload span has the DetectChanges span, with the table's
+// LoadDataTable, and a deliver span per sink. Webhooks are sent the trace
+// in a W3C traceparent header, so receivers can continue it.
+
+// Limits on the spans waiting to be exported
+const (
+	traceBatchSize = 512
+	traceQueueSize = 4096
+	// traceInterval is how often spans are exported when there are fewer
+	// than traceBatchSize
+	traceInterval = 5 * time.Second
+)
+
+// tracer exports the spans of the process; nil when tracing is off
+var tracer *Tracer
+
+// Tracer batches ended spans and exports them to an OTLP collector
+type Tracer struct {
+	endpoint string
+	headers  http.Header
+	service  string
+	client   *http.Client
+
+	mu    sync.Mutex
+	queue []*Span
+	wake  chan struct{}
+}
+
+// NewTracer returns a tracer exporting to the OTLP/HTTP endpoint, such as
+// http://collector:4318, to which /v1/traces is added unless it has a path
+func NewTracer(endpoint, service string, headers http.Header) (*Tracer, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	return &Tracer{
+		endpoint: u.String(),
+		headers:  headers,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		wake:     make(chan struct{}, 1),
+	}, nil
+}
+
+// tracerFromEnv returns a tracer configured by the standard OpenTelemetry
+// environment variables, or nil if no endpoint is set. endpoint, if set,
+// takes the place of OTEL_EXPORTER_OTLP_TRACES_ENDPOINT.
+func tracerFromEnv(endpoint string) (*Tracer, error) {
+	if endpoint == "" {
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	}
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return nil, nil
+	}
+	headers := make(http.Header)
+	for _, kv := range splitList(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")) {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS entry %q", kv)
+		}
+		k, _ = url.QueryUnescape(strings.TrimSpace(k))
+		v, _ = url.QueryUnescape(strings.TrimSpace(v))
+		headers.Set(k, v)
+	}
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "go-watcher"
+	}
+	return NewTracer(endpoint, service, headers)
+}
+
+// Span is an operation of a trace. A nil *Span, as started with tracing
+// off, does nothing.
+type Span struct {
+	tracer  *Tracer
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	kind    uint64
+	start   time.Time
+	end     time.Time
+	attrs   []spanAttr
+	err     error
+}
+
+type spanAttr struct {
+	key   string
+	value any
+}
+
+// OTLP span kinds
+const (
+	spanInternal = 1
+	spanClient   = 3
+)
+
+type spanKey struct{}
+
+// startSpan starts a span as a child of the one in ctx, if there is one,
+// returning a context carrying it. attrs are key/value pairs.
+func startSpan(ctx context.Context, name string, attrs ...any) (context.Context, *Span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	s := &Span{tracer: tracer, name: name, kind: spanInternal, start: time.Now()}
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok {
+		s.traceID, s.parent = parent.traceID, parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	s.SetAttributes(attrs...)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// startClientSpan starts a span of a call to another service, as
+// startSpan does
+func startClientSpan(ctx context.Context, name string, attrs ...any) (context.Context, *Span) {
+	ctx, s := startSpan(ctx, name, attrs...)
+	if s != nil {
+		s.kind = spanClient
+	}
+	return ctx, s
+}
+
+// SetAttributes adds key/value pairs to the span
+func (s *Span) SetAttributes(attrs ...any) {
+	if s == nil {
+		return
+	}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		key, _ := attrs[i].(string)
+		s.attrs = append(s.attrs, spanAttr{key, attrs[i+1]})
+	}
+}
+
+// End ends the span, marking it failed if err is set, and queues it for
+// export
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.end, s.err = time.Now(), err
+	s.tracer.add(s)
+}
+
+// traceParent returns the W3C traceparent header of the span in ctx, or
+// nothing
+func traceParent(ctx context.Context) string {
+	s, ok := ctx.Value(spanKey{}).(*Span)
+	if !ok {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+// add queues an ended span, dropping it if the queue is full
+func (t *Tracer) add(s *Span) {
+	t.mu.Lock()
+	if len(t.queue) >= traceQueueSize {
+		t.mu.Unlock()
+		metrics.Counter("trace_spans_dropped_total", "Spans dropped because the exporter fell behind").Inc()
+		return
+	}
+	t.queue = append(t.queue, s)
+	full := len(t.queue) >= traceBatchSize
+	t.mu.Unlock()
+	if full {
+		select {
+		case t.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run exports spans until ctx is done
+func (t *Tracer) Run(ctx context.Context) {
+	ticker := time.NewTicker(traceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-t.wake:
+		}
+		if err := t.Flush(ctx); err != nil {
+			slog.Warn("failed to export traces", "endpoint", t.endpoint, "err", err)
+		}
+	}
+}
+
+// Flush exports the queued spans, a batch at a time
+func (t *Tracer) Flush(ctx context.Context) error {
+	for {
+		t.mu.Lock()
+		batch := t.queue[:min(len(t.queue), traceBatchSize)]
+		t.queue = t.queue[len(batch):]
+		t.mu.Unlock()
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := t.export(ctx, batch); err != nil {
+			metrics.Counter("trace_export_failures_total", "Span batches the OTLP collector didn't accept").Inc()
+			return err
+		}
+	}
+}
+
+// export posts spans to the collector as an ExportTraceServiceRequest
+func (t *Tracer) export(ctx context.Context, spans []*Span) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(t.marshal(spans)))
+	if err != nil {
+		return err
+	}
+	for k, v := range t.headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("collector returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// marshal encodes spans as an ExportTraceServiceRequest of one resource
+// and instrumentation scope
+func (t *Tracer) marshal(spans []*Span) []byte {
+	var resource []byte
+	resource = appendProtoBytes(resource, 1, marshalSpanAttr(spanAttr{"service.name", t.service}))
+	var scope []byte
+	scope = appendProtoBytes(scope, 1, appendProtoString(nil, 1, "github.com/pershinghar/go-watcher"))
+	for _, s := range spans {
+		scope = appendProtoBytes(scope, 2, s.marshal())
+	}
+	var rs []byte
+	rs = appendProtoBytes(rs, 1, resource)
+	rs = appendProtoBytes(rs, 2, scope)
+	return appendProtoBytes(nil, 1, rs)
+}
+
+// marshal encodes the span as an OTLP Span message
+func (s *Span) marshal() []byte {
+	var b []byte
+	b = appendProtoBytes(b, 1, s.traceID[:])
+	b = appendProtoBytes(b, 2, s.spanID[:])
+	if s.parent != [8]byte{} {
+		b = appendProtoBytes(b, 4, s.parent[:])
+	}
+	b = appendProtoString(b, 5, s.name)
+	b = appendProtoVarint(b, 6, s.kind)
+	b = appendProtoFixed64(b, 7, uint64(s.start.UnixNano()))
+	b = appendProtoFixed64(b, 8, uint64(s.end.UnixNano()))
+	for _, a := range s.attrs {
+		b = appendProtoBytes(b, 9, marshalSpanAttr(a))
+	}
+	// Status: ERROR with the message, or OK
+	var status []byte
+	if s.err != nil {
+		status = appendProtoString(status, 2, s.err.Error())
+		status = appendProtoVarint(status, 3, 2)
+	} else {
+		status = appendProtoVarint(status, 3, 1)
+	}
+	return appendProtoBytes(b, 15, status)
+}
+
+// marshalSpanAttr encodes an attribute as a KeyValue message. The value
+// is a oneof, so it is written even when zero.
+func marshalSpanAttr(a spanAttr) []byte {
+	var v []byte
+	switch x := a.value.(type) {
+	case bool:
+		var n uint64
+		if x {
+			n = 1
+		}
+		v = binary.AppendUvarint(appendProtoTag(v, 2, wireVarint), n)
+	case int:
+		v = binary.AppendUvarint(appendProtoTag(v, 3, wireVarint), uint64(x))
+	case int64:
+		v = binary.AppendUvarint(appendProtoTag(v, 3, wireVarint), uint64(x))
+	case uint64:
+		v = binary.AppendUvarint(appendProtoTag(v, 3, wireVarint), x)
+	default:
+		v = appendProtoBytes(v, 1, []byte(fmt.Sprint(x)))
+	}
+	var b []byte
+	b = appendProtoString(b, 1, a.key)
+	return appendProtoBytes(b, 2, v)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testSpan is a span decoded from an export
+type testSpan struct {
+	name, traceID, spanID, parent string
+	attrs                         map[string]string
+	failed                        bool
+}
+
+// decodeSpans decodes the spans of an ExportTraceServiceRequest
+func decodeSpans(t *testing.T, body []byte) []testSpan {
+	t.Helper()
+	field := func(b []byte, n int) [][]byte {
+		fields, err := parseProto(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out [][]byte
+		for _, f := range fields {
+			if f.field == n {
+				out = append(out, f.data)
+			}
+		}
+		return out
+	}
+	var spans []testSpan
+	for _, rs := range field(body, 1) {
+		for _, ss := range field(rs, 2) {
+			for _, b := range field(ss, 2) {
+				fields, _ := parseProto(b)
+				s := testSpan{attrs: make(map[string]string)}
+				for _, f := range fields {
+					switch f.field {
+					case 1:
+						s.traceID = hex.EncodeToString(f.data)
+					case 2:
+						s.spanID = hex.EncodeToString(f.data)
+					case 4:
+						s.parent = hex.EncodeToString(f.data)
+					case 5:
+						s.name = string(f.data)
+					case 9:
+						kv, _ := parseProto(f.data)
+						v, _ := parseProto(kv[1].data)
+						s.attrs[string(kv[0].data)] = string(v[0].data)
+					case 15:
+						st, _ := parseProto(f.data)
+						s.failed = st[len(st)-1].num == 2
+					}
+				}
+				spans = append(spans, s)
+			}
+		}
+	}
+	return spans
+}
+
+func TestTracing(t *testing.T) {
+	var mu sync.Mutex
+	var bodies [][]byte
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" || r.Header.Get("Authorization") != "Bearer t" {
+			t.Errorf("export to %s with headers %v", r.URL.Path, r.Header)
+		}
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, body)
+		mu.Unlock()
+	}))
+	defer collector.Close()
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "Authorization=Bearer%20t")
+	tr, err := tracerFromEnv("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer = tr
+	defer func() { tracer = nil }()
+
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"))
+	good, bad := &fakeSink{name: "good"}, &fakeSink{name: "bad", err: errors.New("down")}
+	target := NewTarget(path, loadTable(t, path), NewDispatcher([]Sink{good, bad}, nil))
+	target.Out = io.Discard
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	target.Start(ctx)
+	rewriteFile(t, path, "172.31.0.1", "172.31.0.2")
+	target.reload(ctx)
+	target.Wait()
+	if err := tracer.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var spans []testSpan
+	for _, b := range bodies {
+		spans = append(spans, decodeSpans(t, b)...)
+	}
+	byName := make(map[string][]testSpan)
+	for _, s := range spans {
+		byName[s.name] = append(byName[s.name], s)
+	}
+	// The initial load is a trace of its own; the reload's spans share one
+	reload := byName["reload"]
+	if len(byName["LoadDataTable"]) != 2 || len(reload) != 1 || len(byName["DetectChanges"]) != 1 || len(byName["deliver"]) != 2 {
+		t.Fatalf("spans = %+v", spans)
+	}
+	detect := byName["DetectChanges"][0]
+	if detect.parent != reload[0].spanID || detect.traceID != reload[0].traceID || detect.attrs["path"] != path {
+		t.Errorf("DetectChanges = %+v, reload = %+v", detect, reload[0])
+	}
+	if load := byName["LoadDataTable"][1]; load.parent != detect.spanID {
+		t.Errorf("LoadDataTable = %+v, want a child of DetectChanges", load)
+	}
+	for _, d := range byName["deliver"] {
+		if d.parent != reload[0].spanID || d.failed != (d.attrs["sink"] == "bad") {
+			t.Errorf("deliver = %+v", d)
+		}
+	}
+	if reload[0].failed || reload[0].attrs["target"] != path {
+		t.Errorf("reload = %+v", reload[0])
+	}
+}
+
+func TestTraceParent(t *testing.T) {
+	if tp := traceParent(context.Background()); tp != "" {
+		t.Errorf("traceparent without a span = %q", tp)
+	}
+	// With tracing off, spans are nil and do nothing
+	ctx, span := startSpan(context.Background(), "off")
+	span.SetAttributes("k", "v")
+	span.End(nil)
+	if traceParent(ctx) != "" {
+		t.Error("span started with tracing off")
+	}
+
+	tracer, _ = NewTracer("http://collector:4318", "test", nil)
+	defer func() { tracer = nil }()
+	ctx, span = startSpan(context.Background(), "on")
+	tp := traceParent(ctx)
+	if parts := strings.Split(tp, "-"); len(parts) != 4 || parts[1] != hex.EncodeToString(span.traceID[:]) || parts[2] != hex.EncodeToString(span.spanID[:]) {
+		t.Errorf("traceparent = %q", tp)
+	}
+	if _, err := NewTracer("collector:4318", "test", nil); err == nil {
+		t.Error("endpoint without a scheme: no error")
+	}
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultTUIHistory is how many change sets the dashboard keeps
+const DefaultTUIHistory = 100
+
+// Escape sequences for the dashboard
+const (
+	ansiAltScreen  = "\x1b[?1049h\x1b[?25l"
+	ansiMainScreen = "\x1b[?25h\x1b[?1049l"
+	ansiHome       = "\x1b[H"
+	ansiClearLine  = "\x1b[K"
+	ansiClearBelow = "\x1b[J"
+	ansiReverse    = "\x1b[7m"
+	ansiBold       = "\x1b[1m"
+)
+
+// Dashboard panes that take the arrow keys
+const (
+	paneSets = iota
+	paneChanges
+)
+
+// runTUI implements the tui command: a live view of one table for
+// operators who keep a terminal open during maintenance windows
+func runTUI(args []string) int {
+	fs := flag.NewFlagSet("tui", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s tui -file <file> [options]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Watch a table in a live terminal dashboard of recent change sets, changed routes and their diffs.\n")
+		fmt.Fprintf(fs.Output(), "Keys: up/down or k/j select, tab switches between change sets and routes, PgUp/PgDn page, q quits.\n\n")
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	var path, ignoreFields, normalize, hashName, chunkerName, watchMode string
+	var maxLineBytes, history int
+	var debounce, pollInterval time.Duration
+	var noColor bool
+	fs.StringVar(&path, "file", "", "Table file to watch")
+	fs.StringVar(&ignoreFields, "ignore-fields", "Age", "Comma separated route fields to ignore when hashing (empty to hash everything)")
+	fs.StringVar(&normalize, "normalize", "none", "Whitespace normalization before hashing: comma separated eol, trim, collapse, or all/none")
+	fs.StringVar(&hashName, "hash", string(DefaultHash), "Chunk hash algorithm: sha256, xxhash, blake3 or fnv")
+	fs.StringVar(&chunkerName, "chunker", ChunkByDestination, "How to split the table into routes: destination (\"Destination:\" blocks) or line (one route per unindented line)")
+	fs.IntVar(&maxLineBytes, "max-line-bytes", DefaultMaxLineBytes, "Longest line a table may contain")
+	fs.StringVar(&watchMode, "watch-mode", WatchAuto, "How to notice file changes: fsnotify, poll, or auto, as in watch mode")
+	fs.DurationVar(&pollInterval, "poll", DefaultPollInterval, "How often to check the file with -watch-mode poll")
+	fs.DurationVar(&debounce, "debounce", 500*time.Millisecond, "Quiet period after the last file event before detecting changes")
+	fs.IntVar(&history, "history", DefaultTUIHistory, "Number of change sets to keep")
+	fs.BoolVar(&noColor, "no-color", false, "Don't color changes and diffs")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if path == "" {
+		fmt.Fprintf(os.Stderr, "Error: -file is required\n\n")
+		fs.Usage()
+		return 2
+	}
+	if info, err := os.Stdout.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		fmt.Fprintf(os.Stderr, "Error: tui needs a terminal\n")
+		return 2
+	}
+
+	rt := NewDataTable(path)
+	rt.Options.IgnoreFields = splitList(ignoreFields)
+	rt.Options.MaxLineBytes = maxLineBytes
+	var err error
+	if rt.Options.Normalize, err = parseNormalize(normalize); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -normalize: %v\n", err)
+		return 2
+	}
+	if rt.Options.Chunker, err = parseChunker(chunkerName); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -chunker: %v\n", err)
+		return 2
+	}
+	if rt.Options.Hash, err = parseHashAlgorithm(hashName); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -hash: %v\n", err)
+		return 2
+	}
+	renderer, err := NewDiffRenderer(rt.Options, 256)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 2
+	}
+	fsInfo, _ := detectFilesystem(path)
+	mechanism, err := chooseMechanism(watchMode, fsInfo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -watch-mode: %v\n", err)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Load before taking over the screen, so progress and errors show
+	rt.OnProgress = logProgress
+	fmt.Fprintf(os.Stderr, "Loading %s...\n", path)
+	if err := rt.LoadDataTable(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to load %s: %v\n", path, err)
+		return 1
+	}
+
+	m := newTUIModel(path, mechanism, renderer, history)
+	m.color = !noColor && os.Getenv("NO_COLOR") == ""
+	m.loaded(rt.Len(), time.Now())
+	slog.SetDefault(slog.New(slog.NewTextHandler(m, &slog.HandlerOptions{ReplaceAttr: dropTime})))
+
+	trigger := make(chan struct{}, 1)
+	onChange := func() {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+	var watcher Watcher
+	if mechanism == WatchPoll {
+		pw := NewPollWatcher(path, onChange, pollInterval)
+		pw.VerifyContent = true
+		watcher = pw
+	} else {
+		fw, err := NewFileWatcher(path, onChange, debounce)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to create file watcher for %s: %v\n", path, err)
+			return 1
+		}
+		watcher = fw
+	}
+	if err := watcher.Start(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to start file watcher for %s: %v\n", path, err)
+		return 1
+	}
+	defer watcher.Close()
+
+	restore, err := cbreak(os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to set up the terminal: %v\n", err)
+		return 1
+	}
+	defer restore()
+	fmt.Fprint(os.Stdout, ansiAltScreen)
+	defer fmt.Fprint(os.Stdout, ansiMainScreen)
+
+	keys := make(chan string)
+	go readKeys(os.Stdin, keys)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	draw := func() {
+		w, h := terminalSize(os.Stdout)
+		io.WriteString(os.Stdout, m.render(w, h, time.Now()))
+	}
+	draw()
+	for {
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-trigger:
+			start := time.Now()
+			cs, err := rt.DetectChanges(ctx)
+			if err != nil {
+				slog.Error("failed to detect changes", "path", path, "err", err)
+			} else {
+				m.add(cs, time.Since(start))
+				m.loaded(rt.Len(), time.Now())
+			}
+		case k, ok := <-keys:
+			if !ok || m.key(k) {
+				return 0
+			}
+		case <-ticker.C:
+		}
+		draw()
+	}
+}
+
+// dropTime removes the time from dashboard log messages
+func dropTime(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 && a.Key == slog.TimeKey {
+		return slog.Attr{}
+	}
+	return a
+}
+
+// readKeys sends the keys read from r to keys until r fails
+func readKeys(r io.Reader, keys chan<- string) {
+	defer close(keys)
+	buf := make([]byte, 64)
+	for {
+		n, err := r.Read(buf)
+		for _, k := range parseKeys(buf[:n]) {
+			keys <- k
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// keySequences maps the escape sequences of the keys the dashboard uses
+// to their names
+var keySequences = []struct{ seq, key string }{
+	{"\x1b[A", "up"},
+	{"\x1b[B", "down"},
+	{"\x1b[5~", "pgup"},
+	{"\x1b[6~", "pgdn"},
+	{"\x1bOA", "up"},
+	{"\x1bOB", "down"},
+}
+
+// parseKeys splits terminal input into key names: "up", "down", "pgup" and
+// "pgdn" for those keys and the character for anything else
+func parseKeys(b []byte) []string {
+	var keys []string
+next:
+	for len(b) > 0 {
+		for _, ks := range keySequences {
+			if bytes.HasPrefix(b, []byte(ks.seq)) {
+				keys = append(keys, ks.key)
+				b = b[len(ks.seq):]
+				continue next
+			}
+		}
+		if b[0] != '\r' && b[0] != '\n' {
+			keys = append(keys, string(b[0]))
+		}
+		b = b[1:]
+	}
+	return keys
+}
+
+// tuiEntry is a change set shown on the dashboard
+type tuiEntry struct {
+	cs      *ChangeSet
+	changes []Change
+	took    time.Duration
+}
+
+// tuiModel is the state of the dashboard. It is the io.Writer of the log,
+// whose last line is shown at the bottom.
+type tuiModel struct {
+	path      string
+	mechanism string
+	renderer  *DiffRenderer
+	history   int
+	color     bool
+
+	mu      sync.Mutex
+	routes  int
+	updated time.Time
+	entries []tuiEntry
+	focus   int
+	set     int
+	change  int
+	// page is the height of the focused pane at the last render
+	page    int
+	message string
+}
+
+func newTUIModel(path, mechanism string, renderer *DiffRenderer, history int) *tuiModel {
+	if history <= 0 {
+		history = DefaultTUIHistory
+	}
+	return &tuiModel{path: path, mechanism: mechanism, renderer: renderer, history: history, page: 1}
+}
+
+// Write keeps the last log line for the status bar
+func (m *tuiModel) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+	if i := strings.LastIndexByte(line, '\n'); i >= 0 {
+		line = line[i+1:]
+	}
+	m.mu.Lock()
+	m.message = line
+	m.mu.Unlock()
+	return len(p), nil
+}
+
+// loaded records the size of the table
+func (m *tuiModel) loaded(routes int, now time.Time) {
+	m.mu.Lock()
+	m.routes, m.updated = routes, now
+	m.mu.Unlock()
+}
+
+// add puts cs at the top of the change sets, keeping the selection on the
+// change set it was on unless that was the newest
+func (m *tuiModel) add(cs *ChangeSet, took time.Duration) {
+	changes := cs.Notifiable()
+	if len(changes) == 0 && !cs.Truncated {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append([]tuiEntry{{cs: cs, changes: changes, took: took}}, m.entries...)
+	if len(m.entries) > m.history {
+		m.entries = m.entries[:m.history]
+	}
+	if m.set > 0 {
+		m.set = min(m.set+1, len(m.entries)-1)
+	} else {
+		m.change = 0
+	}
+}
+
+// key handles a key press, reporting whether it quits
+func (m *tuiModel) key(k string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch k {
+	case "q", "Q":
+		return true
+	case "\t":
+		m.focus = (m.focus + 1) % 2
+	case "up", "k":
+		m.move(-1)
+	case "down", "j":
+		m.move(1)
+	case "pgup":
+		m.move(-m.page)
+	case "pgdn":
+		m.move(m.page)
+	}
+	return false
+}
+
+// move moves the selection in the focused pane by n lines
+func (m *tuiModel) move(n int) {
+	if m.focus == paneSets {
+		set := clamp(m.set+n, 0, len(m.entries)-1)
+		if set != m.set {
+			m.set, m.change = set, 0
+		}
+		return
+	}
+	if len(m.entries) > 0 {
+		m.change = clamp(m.change+n, 0, len(m.entries[m.set].changes)-1)
+	}
+}
+
+// clamp limits n to [lo, hi], or returns lo if the range is empty
+func clamp(n, lo, hi int) int {
+	return max(lo, min(n, hi))
+}
+
+// render draws the dashboard for a terminal of w columns and h rows
+func (m *tuiModel) render(w, h int, now time.Time) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w, h = max(w, 20), max(h, 10)
+
+	// Header, three titled panes and two lines at the bottom
+	body := h - 6
+	setsHeight := max(body/4, 1)
+	changesHeight := max(body/3, 1)
+	diffHeight := max(body-setsHeight-changesHeight, 1)
+	if m.focus == paneSets {
+		m.page = setsHeight
+	} else {
+		m.page = changesHeight
+	}
+
+	var b strings.Builder
+	b.WriteString(ansiHome)
+	line := func(s, color string) {
+		b.WriteString(paint(m.color && color != "", color, truncateLine(s, w)))
+		b.WriteString(ansiClearLine)
+		b.WriteString("\n")
+	}
+	header := fmt.Sprintf(" go-watcher  %s  %d routes  %s", m.path, m.routes, m.mechanism)
+	clock := now.Format(time.TimeOnly) + " "
+	if pad := w - len([]rune(header)) - len(clock); pad > 0 {
+		header += strings.Repeat(" ", pad) + clock
+	}
+	line(header, ansiReverse)
+
+	title := func(s string, pane int) {
+		if m.focus == pane {
+			s = "▸ " + s
+		} else {
+			s = "  " + s
+		}
+		line(s, ansiBold)
+	}
+
+	title(fmt.Sprintf("Change sets (%d)", len(m.entries)), paneSets)
+	var sets []string
+	for _, e := range m.entries {
+		sets = append(sets, entryLine(e, m.color))
+	}
+	if len(sets) == 0 {
+		sets = []string{fmt.Sprintf("  no changes since %s", m.updated.Format(time.TimeOnly))}
+	}
+	m.pane(&b, w, sets, m.set, setsHeight, m.focus == paneSets && len(m.entries) > 0)
+
+	var changes []Change
+	if len(m.entries) > 0 {
+		changes = m.entries[m.set].changes
+	}
+	title(fmt.Sprintf("Changed routes (%d)", len(changes)), paneChanges)
+	var routes []string
+	for _, c := range changes {
+		s := fmt.Sprintf("  %-8s %s", c.Type, c.Destination)
+		if c.Critical {
+			s += " (critical)"
+		}
+		routes = append(routes, paint(m.color, changeColor(c.Type), s))
+	}
+	if len(routes) == 0 && len(m.entries) > 0 && m.entries[m.set].cs.Truncated {
+		routes = []string{"  the file was truncated to zero bytes"}
+	}
+	m.pane(&b, w, routes, m.change, changesHeight, m.focus == paneChanges && len(changes) > 0)
+
+	var diff []string
+	if len(changes) > 0 {
+		c := &changes[m.change]
+		title("Diff of "+c.Destination, -1)
+		if text, err := m.renderer.Unified(c); err != nil {
+			diff = []string{"  " + err.Error()}
+		} else if text != "" {
+			for _, l := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+				diff = append(diff, paint(m.color, diffLineColor(l), "  "+l))
+			}
+		}
+	} else {
+		title("Diff", -1)
+	}
+	m.pane(&b, w, diff, -1, diffHeight, false)
+
+	line(" "+m.message, "")
+	line(" ↑/↓ k/j select  tab switch list  PgUp/PgDn page  q quit", ansiReverse)
+	b.WriteString(ansiClearBelow)
+	return b.String()
+}
+
+// pane writes height lines of lines, scrolled so the selected line shows
+// and highlighted if highlight is set
+func (m *tuiModel) pane(b *strings.Builder, w int, lines []string, selected, height int, highlight bool) {
+	start := 0
+	if selected >= height {
+		start = selected - height + 1
+	}
+	for i := start; i < start+height; i++ {
+		s := ""
+		if i < len(lines) {
+			s = truncateLine(lines[i], w)
+		}
+		if i == selected && highlight {
+			s = ansiReverse + s + ansiReset
+		}
+		b.WriteString(s)
+		b.WriteString(ansiClearLine)
+		b.WriteString("\n")
+	}
+}
+
+// entryLine describes a change set in the list of change sets
+func entryLine(e tuiEntry, color bool) string {
+	s := e.cs.Summarize(e.took)
+	line := fmt.Sprintf("  #%-5d %s  %s %s %s", e.cs.ID, e.cs.Time.Format(time.TimeOnly),
+		paint(color, ansiGreen, "+"+strconv.Itoa(s.Added)),
+		paint(color, ansiRed, "-"+strconv.Itoa(s.Removed)),
+		paint(color, ansiYellow, "~"+strconv.Itoa(s.Modified)))
+	if e.cs.Truncated {
+		line += "  truncated"
+	}
+	return line + fmt.Sprintf("  in %v", e.took.Round(time.Millisecond))
+}
+
+// truncateLine cuts s to w visible columns, skipping over escape sequences
+// and closing any color it cuts off
+func truncateLine(s string, w int) string {
+	var b strings.Builder
+	cols, escaped, colored := 0, false, false
+	for _, r := range s {
+		switch {
+		case r == '\x1b':
+			escaped, colored = true, true
+		case escaped:
+			if r >= '@' && r <= '~' && r != '[' {
+				escaped = false
+			}
+		case cols == w:
+			if colored {
+				b.WriteString(ansiReset)
+			}
+			return b.String()
+		default:
+			if r == '\t' {
+				r = ' '
+			}
+			cols++
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// envTerminalSize returns $COLUMNS by $LINES, or 80 by 24
+func envTerminalSize() (int, int) {
+	w, _ := strconv.Atoi(os.Getenv("COLUMNS"))
+	h, _ := strconv.Atoi(os.Getenv("LINES"))
+	if w <= 0 {
+		w = 80
+	}
+	if h <= 0 {
+		h = 24
+	}
+	return w, h
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseKeys(t *testing.T) {
+	got := parseKeys([]byte("j\x1b[A\x1b[6~\tq\n"))
+	want := []string{"j", "up", "pgdn", "\t", "q"}
+	if !slices.Equal(got, want) {
+		t.Errorf("keys = %q, want %q", got, want)
+	}
+}
+
+func TestTUIModel(t *testing.T) {
+	renderer, err := NewDiffRenderer(LoadOptions{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newTUIModel("core.txt", WatchFsnotify, renderer, 2)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	m.loaded(2, now)
+	if out := m.render(80, 24, now); !strings.Contains(out, "core.txt  2 routes  fsnotify") || !strings.Contains(out, "no changes since 12:00:00") {
+		t.Errorf("empty dashboard:\n%s", out)
+	}
+
+	changeSet := func(id uint64, dests ...string) *ChangeSet {
+		cs := &ChangeSet{ID: id, Time: now}
+		for _, d := range dests {
+			cs.Changes = append(cs.Changes, Change{Type: ChangeModified, Destination: d,
+				Old: &Chunk{Data: []byte(routeBlock(d, "IBGP", "172.31.0.1"))},
+				New: &Chunk{Data: []byte(routeBlock(d, "IBGP", "172.31.0.2"))}})
+		}
+		return cs
+	}
+	m.add(changeSet(1, "10.0.0.0/8", "10.1.0.0/16"), time.Millisecond)
+	m.add(&ChangeSet{ID: 2, Changes: []Change{{Type: ChangeModified, Volatile: true}}}, 0)
+	if len(m.entries) != 1 {
+		t.Fatalf("%d entries; change sets with nothing notifiable should be left out", len(m.entries))
+	}
+
+	// Select the second route and check its diff is shown
+	m.key("\t")
+	m.key("j")
+	out := m.render(80, 24, now)
+	if !strings.Contains(out, "Diff of 10.1.0.0/16") || !strings.Contains(out, "+      NextHop: 172.31.0.2") {
+		t.Errorf("diff of the selected route missing:\n%s", out)
+	}
+	m.key("j")
+	if m.change != 1 {
+		t.Errorf("selection moved past the last route: %d", m.change)
+	}
+
+	// A new change set keeps an older selection on the same change set,
+	// and the history is capped
+	m.key("\t")
+	m.add(changeSet(3, "0.0.0.0/0"), 0)
+	m.key("down")
+	m.add(changeSet(4, "0.0.0.0/0"), 0)
+	if len(m.entries) != 2 || m.entries[m.set].cs.ID != 3 {
+		t.Errorf("selected change set %d of %d", m.entries[m.set].cs.ID, len(m.entries))
+	}
+	if !m.key("q") {
+		t.Error("q doesn't quit")
+	}
+
+	// Every line fits the terminal
+	m.Write([]byte("level=INFO msg=" + strings.Repeat("x", 200) + "\n"))
+	for i, l := range strings.Split(m.render(40, 12, now), "\n") {
+		if n := len([]rune(stripANSI(l))); n > 40 {
+			t.Errorf("line %d is %d columns: %q", i, n, l)
+		}
+	}
+}
+
+func TestTruncateLine(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		w    int
+		want string
+	}{
+		{"abcdef", 3, "abc"},
+		{"abc", 5, "abc"},
+		{ansiRed + "abcdef" + ansiReset, 2, ansiRed + "ab" + ansiReset},
+	} {
+		if got := truncateLine(tc.in, tc.w); got != tc.want {
+			t.Errorf("truncateLine(%q, %d) = %q, want %q", tc.in, tc.w, got, tc.want)
+		}
+	}
+}
+
+// stripANSI removes escape sequences from s
+func stripANSI(s string) string {
+	var b strings.Builder
+	escaped := false
+	for _, r := range s {
+		switch {
+		case r == '\x1b':
+			escaped = true
+		case escaped:
+			escaped = !(r >= '@' && r <= '~' && r != '[')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
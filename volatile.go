@@ -0,0 +1,76 @@
+package main
+
+import "sync"
+
+// VolatileTracker spots chunks that change on every load even after field
+// masking and normalization (e.g. blocks with embedded timestamps). Once a
+// chunk has changed in Threshold consecutive loads it is marked volatile:
+// its changes stay in the change set but are flagged so reports and
+// notifications can skip them.
+type VolatileTracker struct {
+	Threshold int
+
+	mu       sync.Mutex
+	streaks  map[string]int
+	volatile map[string]bool
+}
+
+// NewVolatileTracker creates a tracker that marks chunks volatile after
+// threshold consecutive changes
+func NewVolatileTracker(threshold int) *VolatileTracker {
+	return &VolatileTracker{
+		Threshold: threshold,
+		streaks:   make(map[string]int),
+		volatile:  make(map[string]bool),
+	}
+}
+
+// Observe records the outcome of one load. Modified chunks extend their
+// streak; every other tracked chunk resets, and a volatile chunk that held
+// still is cleared. Changes to volatile chunks are flagged in cs, and
+// chunks that became volatile or stopped being volatile are recorded in
+// cs.NewlyVolatile and cs.ClearedVolatile.
+func (vt *VolatileTracker) Observe(cs *ChangeSet) {
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+
+	modified := make(map[string]bool)
+	for i := range cs.Changes {
+		c := &cs.Changes[i]
+		if c.Type != ChangeModified {
+			continue
+		}
+		modified[c.Destination] = true
+		vt.streaks[c.Destination]++
+		if vt.streaks[c.Destination] >= vt.Threshold && !vt.volatile[c.Destination] {
+			vt.volatile[c.Destination] = true
+			cs.NewlyVolatile = append(cs.NewlyVolatile, c.Destination)
+		}
+		c.Volatile = vt.volatile[c.Destination]
+	}
+
+	for dest := range vt.streaks {
+		if modified[dest] {
+			continue
+		}
+		delete(vt.streaks, dest)
+		if vt.volatile[dest] {
+			delete(vt.volatile, dest)
+			cs.ClearedVolatile = append(cs.ClearedVolatile, dest)
+		}
+	}
+	sortDestinations(cs.NewlyVolatile)
+	sortDestinations(cs.ClearedVolatile)
+}
+
+// Volatile returns the destinations currently marked volatile
+func (vt *VolatileTracker) Volatile() []string {
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+	out := make([]string, 0, len(vt.volatile))
+	for dest := range vt.volatile {
+		out = append(out, dest)
+	}
+	sortDestinations(out)
+	return out
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func modifiedSet(dests ...string) *ChangeSet {
+	cs := &ChangeSet{}
+	for _, d := range dests {
+		cs.Changes = append(cs.Changes, Change{Type: ChangeModified, Destination: d})
+	}
+	return cs
+}
+
+func TestVolatileTracker(t *testing.T) {
+	vt := NewVolatileTracker(3)
+
+	for i := 0; i < 2; i++ {
+		cs := modifiedSet("10.0.0.0/8", "192.168.0.0/16")
+		vt.Observe(cs)
+		if len(cs.NewlyVolatile) != 0 || len(cs.Notifiable()) != 2 {
+			t.Fatalf("load %d: marked too early: %+v", i, cs)
+		}
+	}
+
+	// 192.168.0.0/16 holds still on the third load and resets its streak
+	cs := modifiedSet("10.0.0.0/8")
+	vt.Observe(cs)
+	if !reflect.DeepEqual(cs.NewlyVolatile, []string{"10.0.0.0/8"}) {
+		t.Fatalf("newly volatile = %v", cs.NewlyVolatile)
+	}
+	if len(cs.Notifiable()) != 0 || cs.Len() != 1 {
+		t.Errorf("volatile change not suppressed: %+v", cs.Changes)
+	}
+	if got := vt.Volatile(); !reflect.DeepEqual(got, []string{"10.0.0.0/8"}) {
+		t.Errorf("volatile set = %v", got)
+	}
+
+	cs = modifiedSet("192.168.0.0/16")
+	vt.Observe(cs)
+	if !reflect.DeepEqual(cs.ClearedVolatile, []string{"10.0.0.0/8"}) {
+		t.Errorf("cleared = %v", cs.ClearedVolatile)
+	}
+	if len(cs.Notifiable()) != 1 {
+		t.Errorf("non-volatile change suppressed: %+v", cs.Changes)
+	}
+}
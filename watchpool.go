@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// WatchPool shares one fsnotify watcher between FileWatchers. Each
+// directory is watched once however many of its files are watched, so
+// watching hundreds of tables stays within the kernel's inotify limits.
+type WatchPool struct {
+	mu      sync.Mutex
+	watcher *fsnotify.Watcher
+	// dirs holds the subscriptions to each watched directory
+	dirs map[string]map[*dirWatch]bool
+}
+
+// dirWatch is one subscription to a pooled directory watch. Events
+// receives the events for the directory and its entries, and Errors the
+// watcher's errors. Done is closed when the subscription ends: when it is
+// closed, or when the pooled watcher's event stream ends.
+type dirWatch struct {
+	Events chan fsnotify.Event
+	Errors chan error
+	Done   chan struct{}
+
+	pool *WatchPool
+	dir  string
+	once sync.Once
+}
+
+// sharedWatchPool is the pool used by every FileWatcher
+var sharedWatchPool = NewWatchPool()
+
+// NewWatchPool creates an empty pool. Its fsnotify watcher is created with
+// the first subscription and closed with the last.
+func NewWatchPool() *WatchPool {
+	return &WatchPool{dirs: make(map[string]map[*dirWatch]bool)}
+}
+
+// Watch subscribes to the events of dir, adding it to the pooled watcher
+// if nothing watches it yet
+func (p *WatchPool) Watch(dir string) (*dirWatch, error) {
+	dir = filepath.Clean(dir)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.watcher == nil {
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create watcher: %w", inotifyLimitError(err))
+		}
+		p.watcher = w
+		go p.run(w)
+	}
+	subs := p.dirs[dir]
+	if subs == nil {
+		if err := p.watcher.Add(dir); err != nil {
+			p.closeIfIdle()
+			return nil, fmt.Errorf("failed to watch directory: %w", inotifyLimitError(err))
+		}
+		subs = make(map[*dirWatch]bool)
+		p.dirs[dir] = subs
+		p.watchGauge()
+	}
+	d := &dirWatch{
+		Events: make(chan fsnotify.Event, 64),
+		Errors: make(chan error, 8),
+		Done:   make(chan struct{}),
+		pool:   p,
+		dir:    dir,
+	}
+	subs[d] = true
+	return d, nil
+}
+
+// run hands the events of w to the subscriptions of the directories they
+// concern, until w's event stream ends
+func (p *WatchPool) run(w *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-w.Events:
+			if !ok {
+				p.lost(w)
+				return
+			}
+			name := filepath.Clean(event.Name)
+			for _, d := range p.subscribers(name, filepath.Dir(name)) {
+				select {
+				case d.Events <- event:
+				case <-d.Done:
+				}
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				p.lost(w)
+				return
+			}
+			for _, d := range p.subscribers() {
+				select {
+				case d.Errors <- err:
+				case <-d.Done:
+				}
+			}
+		}
+	}
+}
+
+// subscribers returns the subscriptions to dirs, or to every directory if
+// none are given
+func (p *WatchPool) subscribers(dirs ...string) []*dirWatch {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var out []*dirWatch
+	for dir, subs := range p.dirs {
+		if len(dirs) > 0 && !slices.Contains(dirs, dir) {
+			continue
+		}
+		for d := range subs {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// lost ends every subscription after the event stream of w ended without
+// the pool closing it. The next Watch creates a new watcher.
+func (p *WatchPool) lost(w *fsnotify.Watcher) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.watcher != w {
+		return
+	}
+	p.watcher = nil
+	for dir, subs := range p.dirs {
+		for d := range subs {
+			d.end()
+		}
+		delete(p.dirs, dir)
+	}
+	p.watchGauge()
+}
+
+// Readd removes and re-adds the watch on dir, so that the watch follows a
+// directory or file that was replaced
+func (p *WatchPool) Readd(dir string) error {
+	dir = filepath.Clean(dir)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.watcher == nil {
+		return ErrWatcherClosed
+	}
+	if err := p.watcher.Remove(dir); err != nil && !errors.Is(err, fsnotify.ErrNonExistentWatch) {
+		return err
+	}
+	if err := p.watcher.Add(dir); err != nil {
+		return inotifyLimitError(err)
+	}
+	return nil
+}
+
+// release drops a subscription, removing the directory watch with its
+// last subscriber and closing the watcher with the last directory
+func (p *WatchPool) release(d *dirWatch) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	subs := p.dirs[d.dir]
+	if !subs[d] {
+		return
+	}
+	delete(subs, d)
+	if len(subs) == 0 {
+		delete(p.dirs, d.dir)
+		if p.watcher != nil {
+			p.watcher.Remove(d.dir)
+		}
+		p.watchGauge()
+	}
+	p.closeIfIdle()
+}
+
+// closeIfIdle closes the watcher once no directory is watched
+func (p *WatchPool) closeIfIdle() {
+	if len(p.dirs) == 0 && p.watcher != nil {
+		w := p.watcher
+		p.watcher = nil
+		go w.Close()
+	}
+}
+
+func (p *WatchPool) watchGauge() {
+	metrics.Gauge("watch_dirs", "Directories watched through the shared fsnotify watcher").Set(int64(len(p.dirs)))
+}
+
+// end marks the subscription done
+func (d *dirWatch) end() {
+	d.once.Do(func() { close(d.Done) })
+}
+
+// Close ends the subscription, as if the event stream had ended
+func (d *dirWatch) Close() error {
+	d.pool.release(d)
+	d.end()
+	return nil
+}
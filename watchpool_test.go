@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchPool(t *testing.T) {
+	dir := t.TempDir()
+	p := NewWatchPool()
+	a, err := p.Watch(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := p.Watch(dir + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(p.dirs); n != 1 {
+		t.Fatalf("%d directory watches for one directory", n)
+	}
+
+	// Every subscriber of the directory sees its events
+	if err := os.WriteFile(filepath.Join(dir, "table.txt"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []*dirWatch{a, b} {
+		select {
+		case event := <-d.Events:
+			if filepath.Base(event.Name) != "table.txt" {
+				t.Errorf("event for %s", event.Name)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no event delivered")
+		}
+	}
+
+	// The watch outlives all but its last subscriber
+	a.Close()
+	if p.watcher == nil || len(p.dirs) != 1 {
+		t.Fatal("watch dropped with a subscriber left")
+	}
+	b.Close()
+	if p.watcher != nil || len(p.dirs) != 0 {
+		t.Error("watcher kept after the last subscriber left")
+	}
+}
+
+func TestWatchPoolLost(t *testing.T) {
+	p := NewWatchPool()
+	d, err := p.Watch(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Kill the fsnotify watcher behind the pool's back
+	p.watcher.Close()
+	select {
+	case <-d.Done:
+	case <-time.After(time.Second):
+		t.Fatal("subscription not ended with the event stream")
+	}
+	d, err = p.Watch(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// watchedFile is a table file being watched, with the target that reloads
+// it
+type watchedFile struct {
+	target *Target
+	// pattern is the -file pattern the file was found by, if any
+	pattern string
+	cancel  context.CancelFunc
+	// coalescer debounces the fsnotify events, if fsnotify is used
+	coalescer *Coalescer
+	watcher   Watcher
+}
+
+// watch starts noticing changes to the file, polling where fsnotify can't
+// be trusted
+func (w *watchedFile) watch(ctx context.Context, mode string, pollInterval, sweep, debounce, debounceMax, maxDelay time.Duration) error {
+	path := w.target.Name
+	if err := checkDebounce(debounce, debounceMax, maxDelay); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	fsInfo, err := detectFilesystem(path)
+	if err != nil {
+		slog.Warn("could not identify the filesystem", "path", path, "err", err)
+	}
+	mechanism, err := chooseMechanism(mode, fsInfo)
+	if err != nil {
+		return fmt.Errorf("-watch-mode: %w", err)
+	}
+	w.target.Filesystem = &fsInfo
+	w.target.setMechanism(mechanism)
+	slog.Info("detecting changes", "path", path, "filesystem", fsInfo, "mechanism", mechanism)
+	if !fsInfo.Reliable && mechanism == WatchFsnotify {
+		slog.Warn("fsnotify is unreliable on this filesystem; changes may be missed (consider -watch-mode poll)", "path", path, "filesystem", fsInfo.Type)
+	}
+
+	if mechanism == WatchPoll {
+		pw := NewPollWatcher(path, w.target.Trigger, pollInterval)
+		pw.VerifyContent = true
+		pw.WatchMetadata = w.target.WatchMetadata
+		w.watcher = pw
+	} else {
+		fw, err := NewFileWatcher(path, w.target.Trigger, debounce)
+		if err != nil {
+			return fmt.Errorf("failed to create file watcher for %s: %w", path, err)
+		}
+		fw.WatchMetadata = w.target.WatchMetadata
+		fw.Coalescer.MaxWait = debounceMax
+		fw.Coalescer.MaxDelay = maxDelay
+		w.coalescer = fw.Coalescer
+		w.watcher = fw
+	}
+	w.target.Watcher = w.watcher
+
+	if err := w.watcher.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start file watcher for %s: %w", path, err)
+	}
+	if sweep > 0 && mechanism == WatchFsnotify {
+		w.target.Sweep(ctx, sweep)
+	}
+	return nil
+}
+
+// stop stops watching the file and reloading its table
+func (w *watchedFile) stop() {
+	w.cancel()
+	if w.watcher != nil {
+		w.watcher.Close()
+	}
+}
+
+// watchSet is the set of tables being watched. It grows and shrinks as
+// files matching a -file pattern come and go.
+type watchSet struct {
+	// open loads the table at path and starts its target, and watcher if
+	// there is one; both stop when ctx is cancelled
+	open func(ctx context.Context, path string) (*watchedFile, error)
+
+	mu    sync.Mutex
+	files map[string]*watchedFile
+}
+
+func newWatchSet(open func(ctx context.Context, path string) (*watchedFile, error)) *watchSet {
+	return &watchSet{open: open, files: make(map[string]*watchedFile)}
+}
+
+// add starts watching path, found by pattern if that isn't empty. Adding
+// a file already being watched does nothing.
+func (s *watchSet) add(ctx context.Context, path, pattern string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[path]; ok {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	w, err := s.open(ctx, path)
+	if err != nil {
+		cancel()
+		return err
+	}
+	w.pattern, w.cancel = pattern, cancel
+	s.files[path] = w
+	watchedFiles().Set(int64(len(s.files)))
+	return nil
+}
+
+// remove stops watching path if it was found by a pattern. Files named
+// explicitly stay watched, waiting for the file to come back.
+func (s *watchSet) remove(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w, ok := s.files[path]
+	if !ok || w.pattern == "" {
+		return
+	}
+	w.stop()
+	delete(s.files, path)
+	watchedFiles().Set(int64(len(s.files)))
+	slog.Info("stopped watching file: it no longer matches the pattern", "path", path, "pattern", w.pattern)
+}
+
+// list returns the files being watched, ordered by path
+func (s *watchSet) list() []*watchedFile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files := make([]*watchedFile, 0, len(s.files))
+	for _, w := range s.files {
+		files = append(files, w)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].target.Name < files[j].target.Name })
+	return files
+}
+
+// targets returns the targets of the files being watched
+func (s *watchSet) targets() []*Target {
+	files := s.list()
+	targets := make([]*Target, len(files))
+	for i, w := range files {
+		targets[i] = w.target
+	}
+	return targets
+}
+
+func watchedFiles() *Gauge {
+	return metrics.Gauge("watched_files", "Table files being watched")
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWatchSetRemove(t *testing.T) {
+	opened := 0
+	set := newWatchSet(func(ctx context.Context, path string) (*watchedFile, error) {
+		opened++
+		return &watchedFile{target: &Target{Name: path}}, nil
+	})
+	ctx := context.Background()
+	for _, add := range []struct{ path, pattern string }{
+		{"core.txt", ""},
+		{"edge.txt", "*.txt"},
+		{"core.txt", "*.txt"},
+	} {
+		if err := set.add(ctx, add.path, add.pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if opened != 2 {
+		t.Errorf("opened %d tables, want 2", opened)
+	}
+
+	// Only files found by a pattern are dropped when they go away
+	set.remove("core.txt")
+	set.remove("edge.txt")
+	targets := set.targets()
+	if len(targets) != 1 || targets[0].Name != "core.txt" {
+		t.Errorf("watching %v, want only core.txt", targets)
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+// DefaultFeedSize is how many change sets the web UI shows when it opens
+const DefaultFeedSize = 200
+
+// Limits on chunk searches in the web UI
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 500
+)
+
+// ChangeFeed keeps the most recent change sets and passes new ones to the
+// web UI's open pages and event streams, and to gNMI and gRPC
+// subscriptions. Change sets are kept without their chunks, so the feed
+// doesn't hold on to old tables.
+type ChangeFeed struct {
+	size int
+
+	mu     sync.Mutex
+	recent []*feedEntry
+	// subs maps the subscribers' channels to whether they are closed,
+	// rather than skipped, when full
+	subs map[chan *feedEntry]bool
+}
+
+// feedEntry is a change set in the feed
+type feedEntry struct {
+	cs *ChangeSet
+	// data is cs encoded as in the audit log
+	data []byte
+}
+
+// NewChangeFeed creates a feed keeping the last size change sets
+func NewChangeFeed(size int) *ChangeFeed {
+	if size <= 0 {
+		size = DefaultFeedSize
+	}
+	return &ChangeFeed{size: size, subs: make(map[chan *feedEntry]bool)}
+}
+
+// Publish adds cs to the feed. Pages too slow to keep up miss it rather
+// than hold up the target.
+func (f *ChangeFeed) Publish(cs *ChangeSet) {
+	data, err := json.Marshal(auditRecord{ChangeSet: cs, Summary: cs.Summarize(0)})
+	if err != nil {
+		slog.Error("failed to encode change set for the web UI", "err", err)
+		return
+	}
+	lean := *cs
+	lean.Changes = make([]Change, len(cs.Changes))
+	for i, c := range cs.Changes {
+		c.Old, c.New = nil, nil
+		lean.Changes[i] = c
+	}
+	e := &feedEntry{cs: &lean, data: data}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.recent = append(f.recent, e)
+	if len(f.recent) > f.size {
+		f.recent = f.recent[len(f.recent)-f.size:]
+	}
+	for ch, strict := range f.subs {
+		select {
+		case ch <- e:
+		default:
+			if strict {
+				delete(f.subs, ch)
+				close(ch)
+			}
+		}
+	}
+}
+
+// Recent returns the change sets kept, oldest first
+func (f *ChangeFeed) Recent() []*feedEntry {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*feedEntry(nil), f.recent...)
+}
+
+// Subscribe returns the change sets kept and a channel receiving those
+// published from now on, with no gap between them, and a function to stop
+// receiving them
+func (f *ChangeFeed) Subscribe() ([]*feedEntry, <-chan *feedEntry, func()) {
+	return f.subscribe(false)
+}
+
+// SubscribeStrict is like Subscribe, but a subscriber too slow to keep up
+// has its channel closed instead of missing change sets
+func (f *ChangeFeed) SubscribeStrict() ([]*feedEntry, <-chan *feedEntry, func()) {
+	return f.subscribe(true)
+}
+
+func (f *ChangeFeed) subscribe(strict bool) ([]*feedEntry, <-chan *feedEntry, func()) {
+	ch := make(chan *feedEntry, 16)
+	f.mu.Lock()
+	f.subs[ch] = strict
+	recent := append([]*feedEntry(nil), f.recent...)
+	f.mu.Unlock()
+	return recent, ch, func() {
+		f.mu.Lock()
+		delete(f.subs, ch)
+		f.mu.Unlock()
+	}
+}
+
+// WebUI serves a read-only page of the watched tables, a live feed of
+// their change sets and a search of their routes, for teammates without
+// shell access. The page reads:
+//
+//	GET /api/status              the targets, as TargetStatus
+//	GET /api/changes             the recent change sets, oldest first
+//	GET /api/events              new change sets as server-sent events
+//	GET /api/chunks?q=&target=   routes whose destination or body contains q
+//
+// GET /events streams every change as a server-sent event for other
+// dashboards and curl, and GET /ws as WebSocket messages for real-time
+// integrations. GET /metrics serves the process metrics for Prometheus,
+// and GET /healthz, /readyz and /status are for probes and monitoring.
+// The REST API under /api/v1 is described at routeAPI.
+type WebUI struct {
+	// Targets returns the targets being watched
+	Targets func() []*Target
+	Feed    *ChangeFeed
+	// KeepAlive is how often an idle event stream sends a comment, so
+	// proxies don't close it
+	KeepAlive time.Duration
+	// Heartbeat is how often WebSocket clients are sent a heartbeat
+	// message; zero means DefaultHeartbeat
+	Heartbeat time.Duration
+	// GraphQL serves /graphql, described at graphQLSchema
+	GraphQL bool
+	// Debug serves net/http/pprof's profiles under /debug/pprof/ and the
+	// runtime's memory statistics at /debug/vars
+	Debug bool
+	// Dispatcher, if set, is reported on by /status
+	Dispatcher *Dispatcher
+	// Ready reports whether the tables to watch at startup have been
+	// loaded; nil means they have
+	Ready func() bool
+	// Auth, if set, is required of every request but those for the page
+	// itself and the probes
+	Auth *Authenticator
+}
+
+// Handler returns the UI's HTTP handler
+func (ui *WebUI) Handler() http.Handler {
+	static, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /", http.FileServerFS(static))
+	mux.HandleFunc("GET /api/status", ui.status)
+	mux.HandleFunc("GET /api/changes", ui.changes)
+	mux.HandleFunc("GET /api/events", ui.events)
+	mux.HandleFunc("GET /api/chunks", ui.chunks)
+	mux.HandleFunc("GET /events", ui.changeEvents)
+	mux.HandleFunc("GET /ws", ui.webSocket)
+	mux.HandleFunc("GET /metrics", serveMetrics)
+	mux.HandleFunc("GET /healthz", ui.healthz)
+	mux.HandleFunc("GET /readyz", ui.readyz)
+	mux.HandleFunc("GET /status", ui.serviceStatus)
+	ui.routeAPI(mux)
+	if ui.GraphQL {
+		mux.HandleFunc("GET /graphql", ui.graphQL)
+		mux.HandleFunc("POST /graphql", ui.graphQL)
+	}
+	if ui.Debug {
+		mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+		mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+		mux.Handle("GET /debug/vars", expvar.Handler())
+	}
+	return ui.Auth.HTTP(mux, webPublic)
+}
+
+// webPublic reports whether r may be served without authentication: the
+// page, which holds no data, and the probes
+func webPublic(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/", "/index.html", "/healthz", "/readyz":
+		return r.Method == http.MethodGet || r.Method == http.MethodHead
+	}
+	return false
+}
+
+// webStatus is the response of /api/status
+type webStatus struct {
+	Time    time.Time      `json:"time"`
+	Routes  int            `json:"routes"`
+	Targets []TargetStatus `json:"targets"`
+}
+
+func (ui *WebUI) status(w http.ResponseWriter, r *http.Request) {
+	s := webStatus{Time: time.Now(), Targets: []TargetStatus{}}
+	for _, t := range ui.Targets() {
+		ts := t.Status()
+		s.Routes += ts.Routes
+		s.Targets = append(s.Targets, ts)
+	}
+	sort.Slice(s.Targets, func(i, j int) bool { return s.Targets[i].Name < s.Targets[j].Name })
+	writeJSON(w, s)
+}
+
+func (ui *WebUI) changes(w http.ResponseWriter, r *http.Request) {
+	writeChangeSets(w, ui.Feed.Recent())
+}
+
+// writeChangeSets writes the change sets of the feed entries as a JSON
+// array
+func writeChangeSets(w http.ResponseWriter, entries []*feedEntry) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("["))
+	for i, e := range entries {
+		if i > 0 {
+			w.Write([]byte(","))
+		}
+		w.Write(e.data)
+	}
+	w.Write([]byte("]\n"))
+}
+
+// events streams change sets as they are detected, as "changeset" events
+func (ui *WebUI) events(w http.ResponseWriter, r *http.Request) {
+	_, feed, stop := ui.Feed.Subscribe()
+	defer stop()
+	ui.stream(w, r, nil, feed, func(w io.Writer, e *feedEntry) {
+		fmt.Fprintf(w, "event: changeset\ndata: %s\n\n", e.data)
+	})
+}
+
+// changeFilter selects the changes a client of /events or /ws wants: by
+// table path, change type and destination prefix. Empty lists select
+// everything. Changes to volatile chunks are left out unless volatile is
+// set.
+type changeFilter struct {
+	paths    []string
+	types    []string
+	prefixes *PrefixRules
+	volatile bool
+}
+
+// parseChangeFilter parses comma separated lists of paths, change types
+// and prefix rules as in -critical
+func parseChangeFilter(paths, types, prefixes string) (changeFilter, error) {
+	f := changeFilter{paths: splitList(paths), types: splitList(types)}
+	for _, t := range f.types {
+		if t != string(ChangeAdded) && t != string(ChangeRemoved) && t != string(ChangeModified) {
+			return f, fmt.Errorf("unknown change type %q (want added, removed or modified)", t)
+		}
+	}
+	if rules := splitList(prefixes); len(rules) > 0 {
+		var err error
+		if f.prefixes, err = newPrefixRules(rules); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+// changes returns the notifiable changes of cs that f selects
+func (f changeFilter) changes(cs *ChangeSet) []Change {
+	if len(f.paths) > 0 && !slices.Contains(f.paths, cs.Path) {
+		return nil
+	}
+	var out []Change
+	for _, c := range cs.Changes {
+		if c.Volatile && !f.volatile {
+			continue
+		}
+		if len(f.types) > 0 && !slices.Contains(f.types, string(c.Type)) {
+			continue
+		}
+		if f.prefixes != nil && !f.prefixes.Match(c.Destination) {
+			continue
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// changeEvent encodes change c of cs as in -output jsonl
+func changeEvent(cs *ChangeSet, c Change) ([]byte, error) {
+	return json.Marshal(jsonChange{Event: "change", Time: cs.Time, Path: cs.Path, Stream: cs.Stream, ChangeSet: cs.ID, Change: c})
+}
+
+// changeEvents streams every notifiable change as a "change" event, in the
+// form of -output jsonl. The event ID is the change's stream and sequence
+// number, so a client reconnecting with Last-Event-ID is first sent the
+// changes it missed, as far back as the feed goes. The path, type and
+// prefix parameters narrow the stream (see changeFilter).
+func (ui *WebUI) changeEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter, err := parseChangeFilter(q.Get("path"), q.Get("type"), q.Get("prefix"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	write := func(w io.Writer, e *feedEntry) {
+		for _, c := range filter.changes(e.cs) {
+			data, err := changeEvent(e.cs, c)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %s\nevent: change\ndata: %s\n\n", changeEventID(e.cs, c), data)
+		}
+	}
+
+	recent, feed, stop := ui.Feed.Subscribe()
+	defer stop()
+	ui.stream(w, r, missedSince(recent, r.Header.Get("Last-Event-ID")), feed, write)
+}
+
+// changeEventID identifies change c of cs in /events
+func changeEventID(cs *ChangeSet, c Change) string {
+	return cs.Stream + "-" + strconv.FormatUint(c.Seq, 10)
+}
+
+// missedSince returns the part of recent after the change with the event
+// ID last, trimming the changes up to it from the change set it is in. It
+// returns nothing if last is empty or no longer in the feed.
+func missedSince(recent []*feedEntry, last string) []*feedEntry {
+	if last == "" {
+		return nil
+	}
+	for i, e := range recent {
+		for j, c := range e.cs.Changes {
+			if changeEventID(e.cs, c) != last {
+				continue
+			}
+			rest := *e.cs
+			rest.Changes = e.cs.Changes[j+1:]
+			return append([]*feedEntry{{cs: &rest}}, recent[i+1:]...)
+		}
+	}
+	return nil
+}
+
+// stream writes server-sent events: those written by write for backlog,
+// then for every entry from feed until the client goes away
+func (ui *WebUI) stream(w http.ResponseWriter, r *http.Request, backlog []*feedEntry, feed <-chan *feedEntry, write func(io.Writer, *feedEntry)) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, ": connected\n\n")
+	for _, e := range backlog {
+		write(w, e)
+	}
+	flusher.Flush()
+
+	keepAlive := ui.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = 30 * time.Second
+	}
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-feed:
+			write(w, e)
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+// webChunk is a route found by /api/chunks
+type webChunk struct {
+	Target      string `json:"target"`
+	Destination string `json:"destination"`
+	StartLine   int64  `json:"start_line"`
+	EndLine     int64  `json:"end_line"`
+	Hash        string `json:"hash"`
+	Content     string `json:"content,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// webSearch is the response of /api/chunks. More is set when matches
+// beyond the limit were left out.
+type webSearch struct {
+	Chunks []webChunk `json:"chunks"`
+	More   bool       `json:"more,omitempty"`
+}
+
+// chunks searches the routes of the targets, or of the one named by
+// target, for q, case-insensitively. Bodies held in memory are searched;
+// lean tables are searched by destination only, since reading every body
+// back from disk would take too long.
+func (ui *WebUI) chunks(w http.ResponseWriter, r *http.Request) {
+	q := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+	if q == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	limit := defaultSearchLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxSearchLimit)
+	}
+	only := r.URL.Query().Get("target")
+
+	type match struct {
+		target string
+		chunk  *Chunk
+	}
+	var matches []match
+	for _, t := range ui.Targets() {
+		if only != "" && t.Name != only {
+			continue
+		}
+		t.Table.mu.RLock()
+		for dest, c := range t.Table.Chunks {
+			if strings.Contains(strings.ToLower(dest), q) || containsFold(c.Data, q) {
+				matches = append(matches, match{t.Name, c})
+			}
+		}
+		t.Table.mu.RUnlock()
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].target != matches[j].target {
+			return matches[i].target < matches[j].target
+		}
+		return matches[i].chunk.Destination < matches[j].chunk.Destination
+	})
+
+	res := webSearch{Chunks: []webChunk{}}
+	if len(matches) > limit {
+		matches, res.More = matches[:limit], true
+	}
+	// Lean bodies are read back outside the table's lock
+	for _, m := range matches {
+		c := webChunk{Target: m.target, Destination: m.chunk.Destination, StartLine: m.chunk.StartLine, EndLine: m.chunk.EndLine, Hash: m.chunk.Hash}
+		if data, err := m.chunk.Content(); err != nil {
+			c.Error = err.Error()
+		} else {
+			c.Content = string(data)
+		}
+		res.Chunks = append(res.Chunks, c)
+	}
+	writeJSON(w, res)
+}
+
+// containsFold reports whether data contains the lower case string q,
+// ignoring case
+func containsFold(data []byte, q string) bool {
+	return len(data) >= len(q) && strings.Contains(strings.ToLower(string(data)), q)
+}
+
+// writeJSON writes v as the JSON response
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Debug("failed to write web UI response", "err", err)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebUI(t *testing.T) {
+	path := writeTable(t, routeBlock("10.0.0.0/8", "IBGP", "172.31.0.1"), routeBlock("0.0.0.0/0", "Static", "172.31.0.254"))
+	target := NewTarget("core", loadTable(t, path), NewDispatcher(nil, nil))
+	target.setMechanism(WatchPoll)
+	feed := NewChangeFeed(2)
+	srv := httptest.NewServer((&WebUI{Targets: func() []*Target { return []*Target{target} }, Feed: feed}).Handler())
+	defer srv.Close()
+
+	get := func(url string, v any) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: %s", url, resp.Status)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(page), "<title>go-watcher</title>") {
+		t.Errorf("index page not served: %.100s", page)
+	}
+
+	var status webStatus
+	get("/api/status", &status)
+	if status.Routes != 2 || len(status.Targets) != 1 || status.Targets[0].Mechanism != WatchPoll {
+		t.Errorf("status = %+v", status)
+	}
+
+	var found webSearch
+	get("/api/chunks?q=nexthop:+172.31.0.254", &found)
+	if len(found.Chunks) != 1 || found.Chunks[0].Destination != "0.0.0.0/0" || !strings.Contains(found.Chunks[0].Content, "Static") {
+		t.Errorf("search by content = %+v", found)
+	}
+	get("/api/chunks?q=/&limit=1", &found)
+	if len(found.Chunks) != 1 || !found.More || found.Chunks[0].Destination != "0.0.0.0/0" {
+		t.Errorf("limited search = %+v", found)
+	}
+	if resp, err := http.Get(srv.URL + "/api/chunks"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("search without q: %v %v", resp.Status, err)
+	}
+
+	// Open pages get new change sets as events; the feed keeps the last
+	// few for pages opened later
+	events, err := http.Get(srv.URL + "/api/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer events.Body.Close()
+	r := bufio.NewReader(events.Body)
+	if line, _ := r.ReadString('\n'); line != ": connected\n" {
+		t.Fatalf("first line of event stream = %q", line)
+	}
+	r.ReadString('\n')
+	for id := uint64(1); id <= 3; id++ {
+		feed.Publish(&ChangeSet{ID: id, Path: path, Time: time.Now(), Changes: []Change{{Type: ChangeAdded, Destination: "10.1.0.0/16"}}})
+	}
+	var lines []string
+	for len(lines) < 2 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	if lines[0] != "event: changeset" || !strings.HasPrefix(lines[1], "data: {") || !strings.Contains(lines[1], `"id":1,`) {
+		t.Errorf("event = %q", lines)
+	}
+
+	var recent []struct {
+		ID      uint64  `json:"id"`
+		Summary Summary `json:"summary"`
+	}
+	get("/api/changes", &recent)
+	if len(recent) != 2 || recent[0].ID != 2 || recent[1].ID != 3 || recent[1].Summary.Added != 1 {
+		t.Errorf("recent change sets = %+v", recent)
+	}
+}
+
+func TestChangeEvents(t *testing.T) {
+	feed := NewChangeFeed(10)
+	srv := httptest.NewServer((&WebUI{Targets: func() []*Target { return nil }, Feed: feed}).Handler())
+	defer srv.Close()
+	feed.Publish(&ChangeSet{Stream: "s", ID: 1, Path: "a.txt", Changes: []Change{
+		{Seq: 1, Type: ChangeAdded, Destination: "10.0.0.0/8"},
+		{Seq: 2, Type: ChangeRemoved, Destination: "10.1.0.0/16"},
+	}})
+	feed.Publish(&ChangeSet{Stream: "s", ID: 2, Path: "a.txt", Changes: []Change{
+		{Seq: 3, Type: ChangeModified, Destination: "10.2.0.0/16"},
+		{Type: ChangeModified, Destination: "10.3.0.0/16", Volatile: true},
+	}})
+
+	// events reads the IDs of the first n change events from /events
+	events := func(query, last string, n int) []string {
+		t.Helper()
+		req, _ := http.NewRequest("GET", srv.URL+"/events"+query, nil)
+		if last != "" {
+			req.Header.Set("Last-Event-ID", last)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("content type %q", ct)
+		}
+		r := bufio.NewReader(resp.Body)
+		var ids []string
+		for len(ids) < n {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id, ok := strings.CutPrefix(line, "id: "); ok {
+				ids = append(ids, strings.TrimSpace(id))
+			}
+			if data, ok := strings.CutPrefix(line, "data: "); ok && !strings.Contains(data, `"event":"change"`) {
+				t.Errorf("data = %s", data)
+			}
+		}
+		return ids
+	}
+
+	// A reconnecting client gets what it missed, then new changes
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		feed.Publish(&ChangeSet{Stream: "s", ID: 3, Path: "b.txt", Changes: []Change{{Seq: 4, Type: ChangeAdded, Destination: "10.4.0.0/16"}}})
+	}()
+	if got, want := events("", "s-1", 3), []string{"s-2", "s-3", "s-4"}; !slices.Equal(got, want) {
+		t.Errorf("resumed events = %q, want %q", got, want)
+	}
+
+	// Filters apply to the backlog and new changes alike
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		feed.Publish(&ChangeSet{Stream: "s", ID: 4, Path: "b.txt", Changes: []Change{{Seq: 5, Type: ChangeAdded, Destination: "10.5.0.0/16"}}})
+		feed.Publish(&ChangeSet{Stream: "s", ID: 5, Path: "a.txt", Changes: []Change{{Seq: 6, Type: ChangeAdded, Destination: "10.6.0.0/16"}}})
+	}()
+	if got, want := events("?type=added&path=a.txt", "", 1), []string{"s-6"}; !slices.Equal(got, want) {
+		t.Errorf("filtered events = %q, want %q", got, want)
+	}
+
+	if resp, err := http.Get(srv.URL + "/events?type=changed"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown type: %v %v", resp.Status, err)
+	}
+}
+
+func TestWebUIDebug(t *testing.T) {
+	for _, debug := range []bool{false, true} {
+		srv := httptest.NewServer((&WebUI{Targets: func() []*Target { return nil }, Feed: NewChangeFeed(1), Debug: debug}).Handler())
+		for url, want := range map[string]string{
+			"/debug/pprof/":                  "heap",
+			"/debug/pprof/heap?debug=1":      "heap profile",
+			"/debug/pprof/goroutine?debug=1": "goroutine profile",
+			"/debug/vars":                    `"memstats"`,
+		} {
+			resp, err := http.Get(srv.URL + url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if served := resp.StatusCode == http.StatusOK && strings.Contains(string(body), want); served != debug {
+				t.Errorf("Debug %v: GET %s: %s, served %v", debug, url, resp.Status, served)
+			}
+		}
+		srv.Close()
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults of webhook sinks
+const (
+	DefaultWebhookTimeout     = 10 * time.Second
+	DefaultWebhookRetries     = 3
+	DefaultWebhookBackoff     = time.Second
+	DefaultWebhookConcurrency = 4
+)
+
+// maxWebhookBackoff caps the wait between retries
+const maxWebhookBackoff = time.Minute
+
+func init() {
+	sinkFactories["webhook"] = func(u *url.URL) (Sink, error) {
+		return newWebhookSink(u)
+	}
+}
+
+// WebhookSink POSTs every change set as JSON, in the form of the audit
+// log, to a URL. The spec is webhook+https://host/path (or webhook+http://)
+// with these optional parameters, which are removed from the URL posted
+// to:
+//
+//	timeout      time allowed for each attempt (default 10s)
+//	retries      attempts after the first when the failure is worth
+//	             retrying: network errors, 429 and 5xx (default 3)
+//	backoff      wait before the first retry, doubled for every further
+//	             one, or the server's Retry-After if longer (default 1s)
+//	concurrency  deliveries in flight at once (default 4)
+//	secret-env   environment variable holding a secret to sign bodies with
+//	secret-file  file holding the secret, instead
+//	tls-ca-file    PEM file of the CAs to trust instead of the system's
+//	tls-cert-file  client certificate to present to servers requiring one,
+//	tls-key-file   with its key
+//
+// A signed request carries its Unix time in X-Signature-Timestamp and
+// "sha256=" and the hex HMAC-SHA256 of the timestamp, a ".", and the body
+// in X-Signature. Receivers should check both, rejecting old timestamps
+// so a captured request can't be replayed.
+type WebhookSink struct {
+	name    string
+	url     string
+	client  *http.Client
+	retries int
+	backoff time.Duration
+	secret  []byte
+	// header is added to every request
+	header http.Header
+	// accept checks the body of a 2xx response, for APIs that report
+	// errors in it
+	accept func(body []byte) error
+	slots  chan struct{}
+}
+
+func newWebhookSink(u *url.URL) (*WebhookSink, error) {
+	_, transport, _ := strings.Cut(u.Scheme, "+")
+	if transport != "http" && transport != "https" {
+		return nil, fmt.Errorf("webhook sink %q needs webhook+https:// or webhook+http://", u.Redacted())
+	}
+	name := sinkName(u)
+	q := u.Query()
+	secret, err := readSecret(q, "secret")
+	if err != nil {
+		return nil, fmt.Errorf("webhook sink %s: %w", name, err)
+	}
+	target := *u
+	target.Scheme = transport
+	s, err := newPoster(name, &target, q)
+	if err != nil {
+		return nil, fmt.Errorf("webhook sink %s: %w", name, err)
+	}
+	s.secret = secret
+	return s, nil
+}
+
+// newPoster builds a WebhookSink named name posting to u, with the
+// timeout, retries, backoff and concurrency options in q. What is left of
+// q, bar the sink's name, becomes u's query.
+func newPoster(name string, u *url.URL, q url.Values) (*WebhookSink, error) {
+	s := &WebhookSink{name: name, retries: DefaultWebhookRetries, backoff: DefaultWebhookBackoff}
+	timeout, concurrency := DefaultWebhookTimeout, DefaultWebhookConcurrency
+	var err error
+	if v := q.Get("timeout"); v != "" {
+		if timeout, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid timeout: %w", err)
+		}
+	}
+	if v := q.Get("retries"); v != "" {
+		if s.retries, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid retries: %w", err)
+		}
+	}
+	if v := q.Get("backoff"); v != "" {
+		if s.backoff, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid backoff: %w", err)
+		}
+	}
+	if v := q.Get("concurrency"); v != "" {
+		if concurrency, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid concurrency: %w", err)
+		}
+	}
+	if timeout <= 0 || s.retries < 0 || s.backoff <= 0 || concurrency <= 0 {
+		return nil, errors.New("timeout, backoff and concurrency must be positive and retries not negative")
+	}
+	tlsConfig, err := clientTLS(q)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil && u.Scheme != "https" {
+		return nil, errors.New("tls-ca-file, tls-cert-file and tls-key-file need https")
+	}
+	for _, p := range []string{"name", "timeout", "retries", "backoff", "concurrency"} {
+		q.Del(p)
+	}
+
+	target := *u
+	target.RawQuery = q.Encode()
+	s.url = target.String()
+	s.client = &http.Client{Timeout: timeout}
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		s.client.Transport = transport
+	}
+	s.slots = make(chan struct{}, concurrency)
+	return s, nil
+}
+
+// readSecret returns the secret in the environment variable named by the
+// key-env parameter of q or in the file named by key-file, if either is
+// set, and removes both from q
+func readSecret(q url.Values, key string) ([]byte, error) {
+	env, file := q.Get(key+"-env"), q.Get(key+"-file")
+	q.Del(key + "-env")
+	q.Del(key + "-file")
+	switch {
+	case env != "" && file != "":
+		return nil, fmt.Errorf("%s-env and %s-file both set", key, key)
+	case env != "":
+		secret := []byte(os.Getenv(env))
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("$%s is empty", env)
+		}
+		return secret, nil
+	case file != "":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", key, err)
+		}
+		if data = bytes.TrimSpace(data); len(data) == 0 {
+			return nil, fmt.Errorf("%s is empty", file)
+		}
+		return data, nil
+	}
+	return nil, nil
+}
+
+func (s *WebhookSink) Name() string { return s.name }
+
+// Deliver posts cs as JSON
+func (s *WebhookSink) Deliver(ctx context.Context, cs *ChangeSet) error {
+	body, err := json.Marshal(auditRecord{ChangeSet: cs, Summary: cs.Summarize(0)})
+	if err != nil {
+		return fmt.Errorf("failed to encode change set: %w", err)
+	}
+	return s.send(ctx, body)
+}
+
+// send posts body, retrying with exponential backoff
+func (s *WebhookSink) send(ctx context.Context, body []byte) error {
+	return s.sendTo(ctx, s.url, body)
+}
+
+// sendTo posts body to target rather than the sink's URL
+func (s *WebhookSink) sendTo(ctx context.Context, target string, body []byte) error {
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-s.slots }()
+
+	wait := s.backoff
+	for attempt := 0; ; attempt++ {
+		after, retry, err := s.post(ctx, target, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt == s.retries {
+			return err
+		}
+		// Spread out the retries of deliveries that failed together
+		delay := max(wait+rand.N(wait/4+1), after)
+		metrics.Counter("webhook_retries_total", "Webhook deliveries retried", "sink", s.name).Inc()
+		slog.Warn("webhook delivery failed; retrying", "sink", s.name, "attempt", attempt+1, "in", delay, "err", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		wait = min(2*wait, maxWebhookBackoff)
+	}
+}
+
+// post makes one attempt at posting body to target. On failure it
+// reports whether to retry, and how long the server asked to wait first.
+func (s *WebhookSink) post(ctx context.Context, target string, body []byte) (time.Duration, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-watcher")
+	if tp := traceParent(ctx); tp != "" {
+		req.Header.Set("traceparent", tp)
+	}
+	for k, v := range s.header {
+		req.Header[k] = v
+	}
+	if s.secret != nil {
+		// Signed for each attempt, so retries aren't taken for replays
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Signature-Timestamp", ts)
+		req.Header.Set("X-Signature", webhookSignature(s.secret, ts, body))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// Keep the URL, which may hold a token, out of the error
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return 0, ctx.Err() == nil, fmt.Errorf("failed to post: %w", err)
+	}
+	defer resp.Body.Close()
+	reply, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if s.accept != nil {
+			return 0, false, s.accept(reply)
+		}
+		return 0, false, nil
+	}
+	var after time.Duration
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		after = min(time.Duration(secs)*time.Second, maxWebhookBackoff)
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return after, retry, fmt.Errorf("webhook returned %s", resp.Status)
+}
+
+// webhookSignature is the X-Signature of body sent at timestamp ts
+func webhookSignature(secret []byte, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
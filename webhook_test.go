@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookSink(t *testing.T) {
+	var calls atomic.Int32
+	var body []byte
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail twice, then accept
+		if calls.Add(1) < 3 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ = io.ReadAll(r.Body)
+		query = r.URL.RawQuery
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+	}))
+	defer srv.Close()
+
+	sink, err := newSink("webhook+" + srv.URL + "/hook?token=x&backoff=1ms&retries=2&name=ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sink.Name() != "ops" {
+		t.Errorf("name = %q", sink.Name())
+	}
+	cs := &ChangeSet{ID: 7, Path: "t.txt", Routes: 3, Changes: []Change{
+		{Type: ChangeAdded, Destination: "10.0.0.0/8"},
+	}}
+	if err := sink.Deliver(context.Background(), cs); err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("%d attempts, want 3", n)
+	}
+	if query != "token=x" {
+		t.Errorf("query = %q; sink parameters should be removed", query)
+	}
+	var rec struct {
+		ID      uint64  `json:"id"`
+		Path    string  `json:"path"`
+		Summary Summary `json:"summary"`
+	}
+	if err := json.Unmarshal(body, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.ID != 7 || rec.Path != "t.txt" || rec.Summary.Added != 1 {
+		t.Errorf("posted %s", body)
+	}
+
+	// Out of retries
+	calls.Store(-10)
+	if err := sink.Deliver(context.Background(), cs); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("err = %v", err)
+	}
+	if n := calls.Load(); n != -7 {
+		t.Errorf("%d attempts, want 3", n+10)
+	}
+}
+
+func TestWebhookSinkNoRetry(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "no", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	sink, err := newSink("webhook+" + srv.URL + "?backoff=1ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Deliver(context.Background(), &ChangeSet{}); err == nil {
+		t.Error("expected an error")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("%d attempts; a 400 shouldn't be retried", n)
+	}
+}
+
+func TestWebhookSinkTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	sink, err := newSink("webhook+" + srv.URL + "?timeout=20ms&retries=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Deliver(context.Background(), &ChangeSet{}); err == nil {
+		t.Error("expected a timeout")
+	} else if strings.Contains(err.Error(), srv.URL) {
+		t.Errorf("error %q holds the URL", err)
+	}
+}
+
+func TestWebhookSinkConcurrency(t *testing.T) {
+	var inFlight, peak atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	sink, err := newSink("webhook+" + srv.URL + "?concurrency=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for range 6 {
+		wg.Go(func() {
+			if err := sink.Deliver(context.Background(), &ChangeSet{}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	wg.Wait()
+	if p := peak.Load(); p > 2 {
+		t.Errorf("%d deliveries in flight, want at most 2", p)
+	}
+}
+
+func TestWebhookSinkSignature(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var headers http.Header
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	sink, err := newSink("webhook+" + srv.URL + "?secret-file=" + url.QueryEscape(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now().Unix()
+	if err := sink.Deliver(context.Background(), &ChangeSet{ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	ts := headers.Get("X-Signature-Timestamp")
+	if sec, err := strconv.ParseInt(ts, 10, 64); err != nil || sec < before || sec > time.Now().Unix() {
+		t.Errorf("timestamp = %q", ts)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(ts + "." + string(body)))
+	if got, want := headers.Get("X-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("signature = %q, want %q", got, want)
+	}
+
+	// Unsigned without a secret
+	sink, _ = newSink("webhook+" + srv.URL)
+	if err := sink.Deliver(context.Background(), &ChangeSet{ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if sig := headers.Get("X-Signature"); sig != "" {
+		t.Errorf("unsigned request has X-Signature %q", sig)
+	}
+}
+
+func TestNewWebhookSinkErrors(t *testing.T) {
+	for _, spec := range []string{
+		"webhook://host/path",
+		"webhook+ftp://host/path",
+		"webhook+https://host/path?timeout=soon",
+		"webhook+https://host/path?concurrency=0",
+		"webhook+https://host/path?retries=-1",
+		"webhook+https://host/path?secret-env=GO_WATCHER_TEST_UNSET",
+		"webhook+https://host/path?secret-file=/nonexistent",
+	} {
+		if _, err := newSink(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
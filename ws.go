@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHeartbeat is how often /ws sends a heartbeat message
+const DefaultHeartbeat = 30 * time.Second
+
+// webSocketGUID is appended to the client's key to accept a WebSocket
+// handshake (RFC 6455, section 1.3)
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// wsMaxMessage is the largest message accepted from a client; clients
+// only send filters
+const wsMaxMessage = 64 << 10
+
+// wsWriteTimeout bounds every write, so a stalled client is dropped
+const wsWriteTimeout = 10 * time.Second
+
+// wsConn is the server side of a WebSocket connection. Writes may come
+// from any goroutine; reads from one.
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+// upgradeWebSocket completes the WebSocket handshake of r and takes over
+// its connection. On failure it has already responded.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		http.Error(w, "expected a WebSocket handshake", http.StatusBadRequest)
+		return nil, errors.New("not a WebSocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported WebSocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("connection can't be hijacked")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to take over connection: %w", err)
+	}
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to complete handshake: %w", err)
+	}
+	return &wsConn{conn: conn, r: rw.Reader, w: rw.Writer}, nil
+}
+
+// headerHasToken reports whether the comma separated header name contains
+// token, ignoring case
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// write sends data as one frame of type op
+func (c *wsConn) write(op byte, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	header := []byte{0x80 | op}
+	switch n := len(data); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = binary.BigEndian.AppendUint16(append(header, 126), uint16(n))
+	default:
+		header = binary.BigEndian.AppendUint64(append(header, 127), uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	c.w.Write(header)
+	c.w.Write(data)
+	return c.w.Flush()
+}
+
+// read returns the next message, or control frame, from the client
+func (c *wsConn) read() (byte, []byte, error) {
+	var op byte
+	var msg []byte
+	for {
+		var h [2]byte
+		if _, err := io.ReadFull(c.r, h[:]); err != nil {
+			return 0, nil, err
+		}
+		fin, frameOp, masked := h[0]&0x80 != 0, h[0]&0x0F, h[1]&0x80 != 0
+		if !masked {
+			return 0, nil, errors.New("client frame not masked")
+		}
+		n := uint64(h[1] & 0x7F)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+				return 0, nil, err
+			}
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+				return 0, nil, err
+			}
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		if n > wsMaxMessage || uint64(len(msg))+n > wsMaxMessage {
+			return 0, nil, fmt.Errorf("message over %d bytes", wsMaxMessage)
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return 0, nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		if frameOp >= wsClose {
+			// Control frames can arrive between the fragments of a message
+			return frameOp, payload, nil
+		}
+		if frameOp != wsContinuation {
+			op = frameOp
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return op, msg, nil
+		}
+	}
+}
+
+// Close closes the connection without a closing handshake
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
+
+// wsFilter is a filter sent by a /ws client, replacing the one it
+// connected with. Fields are comma separated as in the query string.
+type wsFilter struct {
+	Path   string `json:"path"`
+	Type   string `json:"type"`
+	Prefix string `json:"prefix"`
+}
+
+// parseWSFilter parses a filter message from a /ws client
+func parseWSFilter(data []byte) (changeFilter, error) {
+	var wf wsFilter
+	if err := json.Unmarshal(data, &wf); err != nil {
+		return changeFilter{}, err
+	}
+	return parseChangeFilter(wf.Path, wf.Type, wf.Prefix)
+}
+
+// wsEvent is a message from /ws other than a change
+type wsEvent struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message,omitempty"`
+}
+
+// webSocket streams every notifiable change to a WebSocket client as a
+// text message in the form of -output jsonl, with a "heartbeat" message
+// every Heartbeat. The path, type and prefix parameters select the
+// changes as for /events; the client can replace them at any time by
+// sending a JSON object with the same keys.
+func (ui *WebUI) webSocket(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter, err := parseChangeFilter(q.Get("path"), q.Get("type"), q.Get("prefix"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_, feed, stop := ui.Feed.Subscribe()
+	defer stop()
+
+	send := func(v any) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return conn.write(wsText, data)
+	}
+
+	// Client messages are read on their own goroutine: filters are passed
+	// on, pings answered and a close ends the connection
+	filters := make(chan changeFilter)
+	done, quit := make(chan struct{}), make(chan struct{})
+	defer close(quit)
+	go func() {
+		defer close(done)
+		for {
+			op, data, err := conn.read()
+			if err != nil {
+				return
+			}
+			switch op {
+			case wsPing:
+				conn.write(wsPong, data)
+			case wsClose:
+				conn.write(wsClose, data)
+				return
+			case wsText:
+				f, err := parseWSFilter(data)
+				if err != nil {
+					send(wsEvent{Event: "error", Time: time.Now(), Message: "invalid filter: " + err.Error()})
+					continue
+				}
+				select {
+				case filters <- f:
+				case <-quit:
+					return
+				}
+			}
+		}
+	}()
+
+	heartbeat := ui.Heartbeat
+	if heartbeat <= 0 {
+		heartbeat = DefaultHeartbeat
+	}
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case <-done:
+			return
+		case filter = <-filters:
+		case e := <-feed:
+			for _, c := range filter.changes(e.cs) {
+				data, jerr := changeEvent(e.cs, c)
+				if jerr != nil {
+					continue
+				}
+				if err = conn.write(wsText, data); err != nil {
+					break
+				}
+			}
+		case t := <-ticker.C:
+			err = send(wsEvent{Event: "heartbeat", Time: t})
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsClient is the client side of a test WebSocket connection
+type wsClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialWebSocket(t *testing.T, srv *httptest.Server, path string) *wsClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	req := "GET " + path + " HTTP/1.1\r\nHost: test\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake: %s", resp.Status)
+	}
+	// The accept key for this client key, from RFC 6455
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Sec-WebSocket-Accept = %q", got)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &wsClient{t: t, conn: conn, r: r}
+}
+
+// send writes a masked frame, as clients must
+func (c *wsClient) send(op byte, data string) {
+	c.t.Helper()
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x80 | op, 0x80 | byte(len(data))}
+	frame = append(frame, mask[:]...)
+	for i := range len(data) {
+		frame = append(frame, data[i]^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// next reads the next frame, skipping heartbeats unless heartbeats is set
+func (c *wsClient) next(heartbeats bool) (byte, string) {
+	c.t.Helper()
+	for {
+		var h [2]byte
+		if _, err := io.ReadFull(c.r, h[:]); err != nil {
+			c.t.Fatal(err)
+		}
+		n := uint64(h[1] & 0x7F)
+		switch n {
+		case 126:
+			var ext [2]byte
+			io.ReadFull(c.r, ext[:])
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			io.ReadFull(c.r, ext[:])
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			c.t.Fatal(err)
+		}
+		if !heartbeats && strings.Contains(string(data), `"event":"heartbeat"`) {
+			continue
+		}
+		return h[0] & 0x0F, string(data)
+	}
+}
+
+// destination reads the next change message and returns its destination
+func (c *wsClient) destination() string {
+	c.t.Helper()
+	op, data := c.next(false)
+	var ev struct {
+		Event       string `json:"event"`
+		Destination string `json:"destination"`
+	}
+	if err := json.Unmarshal([]byte(data), &ev); op != wsText || err != nil || ev.Event != "change" {
+		c.t.Fatalf("expected a change, got opcode %d %s", op, data)
+	}
+	return ev.Destination
+}
+
+func TestWebSocket(t *testing.T) {
+	feed := NewChangeFeed(10)
+	srv := httptest.NewServer((&WebUI{Targets: func() []*Target { return nil }, Feed: feed, Heartbeat: 20 * time.Millisecond}).Handler())
+	defer srv.Close()
+	publish := func(changes ...Change) {
+		feed.Publish(&ChangeSet{Stream: "s", ID: 1, Path: "a.txt", Changes: changes})
+	}
+
+	c := dialWebSocket(t, srv, "/ws?type=added")
+	if _, data := c.next(true); !strings.Contains(data, `"event":"heartbeat"`) {
+		t.Errorf("expected a heartbeat, got %s", data)
+	}
+	publish(Change{Seq: 1, Type: ChangeRemoved, Destination: "10.0.0.0/8"}, Change{Seq: 2, Type: ChangeAdded, Destination: "10.1.0.0/16"})
+	if d := c.destination(); d != "10.1.0.0/16" {
+		t.Errorf("type filter passed %s", d)
+	}
+
+	// A new filter replaces the one given when connecting; the pong shows
+	// it has been taken up
+	c.send(wsText, `{"prefix":"192.168.0.0/16+"}`)
+	c.send(wsPing, "hi")
+	if op, data := c.next(false); op != wsPong || data != "hi" {
+		t.Fatalf("ping answered with opcode %d %q", op, data)
+	}
+	publish(Change{Seq: 3, Type: ChangeRemoved, Destination: "10.0.0.0/8"}, Change{Seq: 4, Type: ChangeRemoved, Destination: "192.168.1.0/24"})
+	if d := c.destination(); d != "192.168.1.0/24" {
+		t.Errorf("prefix filter passed %s", d)
+	}
+
+	c.send(wsText, `{"type":"changed"}`)
+	if _, data := c.next(false); !strings.Contains(data, `"event":"error"`) || !strings.Contains(data, "unknown change type") {
+		t.Errorf("invalid filter answered with %s", data)
+	}
+
+	c.send(wsClose, "")
+	if op, _ := c.next(false); op != wsClose {
+		t.Errorf("close answered with opcode %d", op)
+	}
+
+	// Plain requests and bad filters are refused before upgrading
+	if resp, err := http.Get(srv.URL + "/ws"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("plain GET /ws: %v %v", resp.Status, err)
+	}
+	if resp, err := http.Get(srv.URL + "/ws?prefix=10.0.0.0/33%2B"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad prefix: %v %v", resp.Status, err)
+	}
+}